@@ -0,0 +1,106 @@
+// Package addresses verifies and normalizes postal addresses, with EasyPost,
+// SmartyStreets or a check of the format of postal codes that needs no
+// external service.
+package addresses
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// Names of the address validation providers.
+const (
+	EasyPost      = "easypost"
+	SmartyStreets = "smartystreets"
+	Regex         = "regex"
+)
+
+// Modes of address validation.
+const (
+	// Advisory accepts invalid addresses as entered.
+	Advisory = "advisory"
+	// Blocking rejects invalid addresses.
+	Blocking = "blocking"
+)
+
+// Result is the outcome of verifying an address.
+type Result struct {
+	Valid bool
+	// Address is the normalized address, or the address as entered when
+	// the provider couldn't match it.
+	Address models.AddressRequest
+	// Messages explain why an address is invalid.
+	Messages []string
+}
+
+// Validator verifies addresses.
+type Validator interface {
+	Name() string
+	Verify(ctx context.Context, address models.AddressRequest) (*Result, error)
+}
+
+// Config holds the credentials of the providers. The URL replaces the one of
+// the provider.
+type Config struct {
+	APIKey    string
+	AuthID    string
+	AuthToken string
+	URL       string
+}
+
+// NewValidator returns the validator with a name.
+func NewValidator(name string, config Config) (Validator, error) {
+	switch name {
+	case EasyPost:
+		if config.APIKey == "" {
+			return nil, fmt.Errorf("EasyPost needs an API key")
+		}
+		if config.URL == "" {
+			config.URL = easyPostURL
+		}
+		return &easyPostValidator{url: config.URL, apiKey: config.APIKey}, nil
+	case SmartyStreets:
+		if config.AuthID == "" || config.AuthToken == "" {
+			return nil, fmt.Errorf("SmartyStreets needs an auth ID and token")
+		}
+		if config.URL == "" {
+			config.URL = smartyStreetsURL
+		}
+		return &smartyStreetsValidator{url: config.URL, authID: config.AuthID, authToken: config.AuthToken}, nil
+	case Regex:
+		return &regexValidator{}, nil
+	}
+	return nil, fmt.Errorf("Unknown address validation provider: %v", name)
+}
+
+// clean trims the fields of an address and collapses their whitespace.
+func clean(address models.AddressRequest) models.AddressRequest {
+	for _, field := range []*string{
+		&address.Name, &address.Company, &address.Address1, &address.Address2,
+		&address.City, &address.Country, &address.State, &address.Zip,
+	} {
+		*field = strings.Join(strings.Fields(*field), " ")
+	}
+	return address
+}
+
+// client gives up on providers that don't answer in time, since orders wait
+// for the verification of their address.
+var client = &http.Client{Timeout: 10 * time.Second}
+
+func do(req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Verifying the address with %v failed with status %v", req.URL.Host, resp.StatusCode)
+	}
+	return resp, nil
+}
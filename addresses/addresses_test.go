@@ -0,0 +1,141 @@
+package addresses
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestRegex(t *testing.T) {
+	validator, err := NewValidator(Regex, Config{})
+	require.NoError(t, err)
+
+	cases := []struct {
+		country string
+		zip     string
+		valid   bool
+		result  string
+	}{
+		{"USA", "10001", true, "10001"},
+		{"United States", "100011234", true, "10001-1234"},
+		{"US", "1000", false, "1000"},
+		{"Canada", "k1a0b1", true, "K1A 0B1"},
+		{"United Kingdom", "sw1a1aa", true, "SW1A 1AA"},
+		{"Netherlands", "1012AB", true, "1012 AB"},
+		{"Germany", "10115", true, "10115"},
+		{"germany", "1011", false, "1011"},
+		{"Japan", "1000001", true, "100-0001"},
+		{"Atlantis", "anything", true, "anything"},
+	}
+	for _, c := range cases {
+		address := models.AddressRequest{Name: " Bruce  Wayne ", Address1: "1007 Mountain Drive", City: "Gotham", Country: c.country, Zip: c.zip, State: "ny"}
+		result, err := validator.Verify(context.Background(), address)
+		require.NoError(t, err)
+		assert.Equal(t, c.valid, result.Valid, "%v %v", c.country, c.zip)
+		assert.Equal(t, c.result, result.Address.Zip, "%v %v", c.country, c.zip)
+		assert.Equal(t, "Bruce Wayne", result.Address.Name)
+		if !c.valid {
+			assert.NotEmpty(t, result.Messages)
+		}
+	}
+
+	result, err := validator.Verify(context.Background(), models.AddressRequest{Country: "USA", Zip: "10001", State: "ny"})
+	require.NoError(t, err)
+	assert.Equal(t, "NY", result.Address.State)
+}
+
+func TestEasyPost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _, _ := r.BasicAuth(); user != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body := struct {
+			Address easyPostAddress `json:"address"`
+		}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "US", body.Address.Country)
+		if body.Address.Street1 == "nowhere" {
+			fmt.Fprint(w, `{"street1": "NOWHERE", "verifications": {"delivery": {"success": false, "errors": [{"message": "Address not found"}]}}}`)
+			return
+		}
+		fmt.Fprint(w, `{"street1": "417 MONTGOMERY ST", "street2": "FL 5", "city": "SAN FRANCISCO", "state": "CA", "zip": "94104-1129", "country": "US",
+			"verifications": {"delivery": {"success": true, "errors": []}}}`)
+	}))
+	defer server.Close()
+
+	_, err := NewValidator(EasyPost, Config{URL: server.URL})
+	assert.Error(t, err, "an API key is required")
+
+	validator, err := NewValidator(EasyPost, Config{APIKey: "secret", URL: server.URL})
+	require.NoError(t, err)
+	result, err := validator.Verify(context.Background(), models.AddressRequest{
+		Name: "Test", Address1: "417 montgomery street", Address2: "floor 5", City: "SF", State: "ca", Zip: "94104", Country: "USA",
+	})
+	require.NoError(t, err)
+	assert.True(t, result.Valid)
+	assert.Equal(t, models.AddressRequest{
+		Name: "Test", Address1: "417 MONTGOMERY ST", Address2: "FL 5", City: "SAN FRANCISCO", State: "CA", Zip: "94104-1129", Country: "USA",
+	}, result.Address, "the country is kept as entered")
+
+	result, err = validator.Verify(context.Background(), models.AddressRequest{Address1: "nowhere", Country: "USA"})
+	require.NoError(t, err)
+	assert.False(t, result.Valid)
+	assert.Equal(t, "nowhere", result.Address.Address1)
+	assert.Equal(t, []string{"Address not found"}, result.Messages)
+
+	validator, err = NewValidator(EasyPost, Config{APIKey: "wrong", URL: server.URL})
+	require.NoError(t, err)
+	_, err = validator.Verify(context.Background(), models.AddressRequest{Address1: "nowhere", Country: "USA"})
+	assert.Error(t, err)
+}
+
+func TestSmartyStreets(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		query := r.URL.Query()
+		assert.Equal(t, "id", query.Get("auth-id"))
+		assert.Equal(t, "token", query.Get("auth-token"))
+		if query.Get("street") == "nowhere" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[{"delivery_line_1": "1600 Amphitheatre Pkwy",
+			"components": {"city_name": "Mountain View", "state_abbreviation": "CA", "zipcode": "94043", "plus4_code": "1351"},
+			"analysis": {"dpv_match_code": "Y"}}]`)
+	}))
+	defer server.Close()
+
+	_, err := NewValidator(SmartyStreets, Config{AuthID: "id", URL: server.URL})
+	assert.Error(t, err, "an auth token is required")
+
+	validator, err := NewValidator(SmartyStreets, Config{AuthID: "id", AuthToken: "token", URL: server.URL})
+	require.NoError(t, err)
+	result, err := validator.Verify(context.Background(), models.AddressRequest{
+		Address1: "1600 amphitheatre parkway", City: "mountain view", Zip: "94043", Country: "United States",
+	})
+	require.NoError(t, err)
+	assert.True(t, result.Valid)
+	assert.Equal(t, "1600 Amphitheatre Pkwy", result.Address.Address1)
+	assert.Equal(t, "CA", result.Address.State)
+	assert.Equal(t, "94043-1351", result.Address.Zip)
+
+	result, err = validator.Verify(context.Background(), models.AddressRequest{Address1: "nowhere", Country: "USA"})
+	require.NoError(t, err)
+	assert.False(t, result.Valid)
+	assert.NotEmpty(t, result.Messages)
+
+	result, err = validator.Verify(context.Background(), models.AddressRequest{Address1: "Unter den Linden 1", Zip: "1011", Country: "Germany"})
+	require.NoError(t, err)
+	assert.False(t, result.Valid, "the postal codes of other countries are checked locally")
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,104 @@
+package addresses
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+const easyPostURL = "https://api.easypost.com/v2/addresses"
+
+type easyPostValidator struct {
+	url    string
+	apiKey string
+}
+
+func (v *easyPostValidator) Name() string {
+	return EasyPost
+}
+
+type easyPostAddress struct {
+	Name    string `json:"name"`
+	Company string `json:"company"`
+	Street1 string `json:"street1"`
+	Street2 string `json:"street2"`
+	City    string `json:"city"`
+	State   string `json:"state"`
+	Zip     string `json:"zip"`
+	Country string `json:"country"`
+}
+
+// Verify creates the address with delivery verification. EasyPost verifies
+// the addresses of most countries, and returns them corrected even when
+// delivery can't be verified.
+func (v *easyPostValidator) Verify(ctx context.Context, address models.AddressRequest) (*Result, error) {
+	address = clean(address)
+	country := CountryCode(address.Country)
+	if country == "" {
+		country = address.Country
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"address": &easyPostAddress{
+			Name:    address.Name,
+			Company: address.Company,
+			Street1: address.Address1,
+			Street2: address.Address2,
+			City:    address.City,
+			State:   address.State,
+			Zip:     address.Zip,
+			Country: country,
+		},
+		"verify": []string{"delivery"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, v.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(v.apiKey, "")
+	resp, err := do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data := struct {
+		easyPostAddress
+		Verifications struct {
+			Delivery *struct {
+				Success bool `json:"success"`
+				Errors  []struct {
+					Message string `json:"message"`
+				} `json:"errors"`
+			} `json:"delivery"`
+		} `json:"verifications"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("Error reading EasyPost address: %v", err)
+	}
+	delivery := data.Verifications.Delivery
+	if delivery == nil {
+		return nil, fmt.Errorf("EasyPost returned no delivery verification")
+	}
+
+	result := &Result{Valid: delivery.Success, Address: address}
+	for _, e := range delivery.Errors {
+		result.Messages = append(result.Messages, e.Message)
+	}
+	if delivery.Success {
+		result.Address.Address1 = data.Street1
+		result.Address.Address2 = data.Street2
+		result.Address.City = data.City
+		result.Address.State = data.State
+		result.Address.Zip = data.Zip
+		result.Address = clean(result.Address)
+	}
+	return result, nil
+}
@@ -0,0 +1,144 @@
+package addresses
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// postalFormat is the format of the postal codes of a country. Format
+// rewrites a valid code into its canonical form.
+type postalFormat struct {
+	pattern *regexp.Regexp
+	format  func(zip string) string
+}
+
+func withSpace(suffix int) func(string) string {
+	return func(zip string) string {
+		zip = strings.Replace(zip, " ", "", -1)
+		return zip[:len(zip)-suffix] + " " + zip[len(zip)-suffix:]
+	}
+}
+
+var (
+	fourDigits = postalFormat{pattern: regexp.MustCompile(`^\d{4}$`)}
+	fiveDigits = postalFormat{pattern: regexp.MustCompile(`^\d{5}$`)}
+)
+
+// postalFormats are the formats of postal codes by ISO country code.
+var postalFormats = map[string]postalFormat{
+	"US": {
+		pattern: regexp.MustCompile(`^\d{5}(-?\d{4})?$`),
+		format: func(zip string) string {
+			zip = strings.Replace(zip, "-", "", -1)
+			if len(zip) == 9 {
+				return zip[:5] + "-" + zip[5:]
+			}
+			return zip
+		},
+	},
+	"CA": {pattern: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), format: withSpace(3)},
+	"GB": {pattern: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), format: withSpace(3)},
+	"NL": {pattern: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), format: withSpace(2)},
+	"SE": {pattern: regexp.MustCompile(`^\d{3} ?\d{2}$`), format: withSpace(2)},
+	"JP": {
+		pattern: regexp.MustCompile(`^\d{3}-?\d{4}$`),
+		format: func(zip string) string {
+			zip = strings.Replace(zip, "-", "", -1)
+			return zip[:3] + "-" + zip[3:]
+		},
+	},
+	"DE": fiveDigits,
+	"ES": fiveDigits,
+	"FR": fiveDigits,
+	"IT": fiveDigits,
+	"AT": fourDigits,
+	"AU": fourDigits,
+	"BE": fourDigits,
+	"CH": fourDigits,
+	"DK": fourDigits,
+	"NO": fourDigits,
+}
+
+// countryCodes are the ISO codes of countries by their lower case names.
+var countryCodes = map[string]string{
+	"united states":            "US",
+	"united states of america": "US",
+	"usa":                      "US",
+	"canada":                   "CA",
+	"united kingdom":           "GB",
+	"great britain":            "GB",
+	"uk":                       "GB",
+	"netherlands":              "NL",
+	"the netherlands":          "NL",
+	"sweden":                   "SE",
+	"japan":                    "JP",
+	"germany":                  "DE",
+	"deutschland":              "DE",
+	"spain":                    "ES",
+	"france":                   "FR",
+	"italy":                    "IT",
+	"austria":                  "AT",
+	"australia":                "AU",
+	"belgium":                  "BE",
+	"switzerland":              "CH",
+	"denmark":                  "DK",
+	"norway":                   "NO",
+}
+
+// CountryCode returns the ISO code of a country given by name or code, or an
+// empty string for countries it doesn't know.
+func CountryCode(country string) string {
+	country = strings.ToLower(strings.TrimSpace(country))
+	if code, ok := countryCodes[country]; ok {
+		return code
+	}
+	if code := strings.ToUpper(country); len(code) == 2 {
+		if _, ok := postalFormats[code]; ok {
+			return code
+		}
+	}
+	return ""
+}
+
+// regexValidator checks the format of the postal codes of the countries it
+// knows, and accepts the addresses of other countries.
+type regexValidator struct{}
+
+func (v *regexValidator) Name() string {
+	return Regex
+}
+
+func (v *regexValidator) Verify(ctx context.Context, address models.AddressRequest) (*Result, error) {
+	return verifyFormat(address), nil
+}
+
+func verifyFormat(address models.AddressRequest) *Result {
+	address = clean(address)
+	code := CountryCode(address.Country)
+	result := &Result{Valid: true, Address: address}
+	if code == "" {
+		return result
+	}
+	if code == "US" || code == "CA" {
+		if len(address.State) == 2 {
+			result.Address.State = strings.ToUpper(address.State)
+		}
+	}
+
+	format := postalFormats[code]
+	zip := strings.ToUpper(address.Zip)
+	if !format.pattern.MatchString(zip) {
+		result.Valid = false
+		result.Messages = []string{fmt.Sprintf("%v is not a valid postal code in %v", address.Zip, address.Country)}
+		return result
+	}
+	if format.format != nil {
+		zip = format.format(zip)
+	}
+	result.Address.Zip = zip
+	return result
+}
@@ -0,0 +1,104 @@
+package addresses
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+const smartyStreetsURL = "https://us-street.api.smartystreets.com/street-address"
+
+type smartyStreetsValidator struct {
+	url       string
+	authID    string
+	authToken string
+}
+
+func (v *smartyStreetsValidator) Name() string {
+	return SmartyStreets
+}
+
+// Verify looks the address up in the US Street API. SmartyStreets only knows
+// addresses in the United States, the postal codes of other addresses are
+// checked like the regex validator does.
+func (v *smartyStreetsValidator) Verify(ctx context.Context, address models.AddressRequest) (*Result, error) {
+	address = clean(address)
+	if CountryCode(address.Country) != "US" {
+		return verifyFormat(address), nil
+	}
+
+	u, err := url.Parse(v.url)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("auth-id", v.authID)
+	query.Set("auth-token", v.authToken)
+	query.Set("street", address.Address1)
+	query.Set("secondary", address.Address2)
+	query.Set("city", address.City)
+	query.Set("state", address.State)
+	query.Set("zipcode", address.Zip)
+	query.Set("candidates", "1")
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	candidates := []struct {
+		DeliveryLine1 string `json:"delivery_line_1"`
+		DeliveryLine2 string `json:"delivery_line_2"`
+		Components    struct {
+			CityName          string `json:"city_name"`
+			StateAbbreviation string `json:"state_abbreviation"`
+			Zipcode           string `json:"zipcode"`
+			Plus4Code         string `json:"plus4_code"`
+		} `json:"components"`
+		Analysis struct {
+			DPVMatchCode string `json:"dpv_match_code"`
+		} `json:"analysis"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&candidates); err != nil {
+		return nil, fmt.Errorf("Error reading SmartyStreets candidates: %v", err)
+	}
+
+	result := &Result{Address: address}
+	if len(candidates) == 0 {
+		result.Messages = []string{"The address could not be found"}
+		return result, nil
+	}
+	candidate := candidates[0]
+	// Y is a confirmed address, S and D are confirmed without the secondary
+	// number of an apartment or suite, or one that's missing.
+	switch candidate.Analysis.DPVMatchCode {
+	case "Y":
+		result.Valid = true
+	case "S", "D":
+		result.Valid = true
+		result.Messages = []string{"The apartment or suite number could not be confirmed"}
+	default:
+		result.Messages = []string{"The address is not deliverable"}
+		return result, nil
+	}
+
+	result.Address.Address1 = candidate.DeliveryLine1
+	result.Address.Address2 = candidate.DeliveryLine2
+	result.Address.City = candidate.Components.CityName
+	result.Address.State = candidate.Components.StateAbbreviation
+	result.Address.Zip = candidate.Components.Zipcode
+	if candidate.Components.Plus4Code != "" {
+		result.Address.Zip += "-" + candidate.Components.Plus4Code
+	}
+	return result, nil
+}
@@ -0,0 +1,30 @@
+// Package admin serves the built-in admin dashboard, a single page app that
+// talks to the admin endpoints of the API with the JWT of an admin.
+//
+// The page is compiled into the binary from index.html. Run go generate after
+// changing it.
+package admin
+
+//go:generate go run gen.go
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Handler serves the admin dashboard for every path it is mounted under, so
+// the app can be reloaded on any of its pages.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Frame-Options", "DENY")
+		http.ServeContent(w, r, "index.html", time.Time{}, strings.NewReader(indexHTML))
+	})
+}
@@ -0,0 +1,31 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	for _, path := range []string{"/admin", "/admin/", "/admin/orders"} {
+		recorder := httptest.NewRecorder()
+		Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code, path)
+		assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+		assert.Contains(t, recorder.Body.String(), "<title>GoCommerce Admin</title>")
+	}
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestAssetsUpToDate(t *testing.T) {
+	html, err := ioutil.ReadFile("index.html")
+	require.NoError(t, err)
+	assert.Equal(t, string(html), indexHTML, "assets.go is out of date, run go generate")
+}
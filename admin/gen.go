@@ -0,0 +1,36 @@
+//go:build ignore
+// +build ignore
+
+// gen compiles index.html into assets.go.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"strconv"
+)
+
+func main() {
+	html, err := ioutil.ReadFile("index.html")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "// Code generated by gen.go. DO NOT EDIT.")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "package admin")
+	fmt.Fprintln(buf)
+	fmt.Fprintf(buf, "const indexHTML = %s\n", strconv.Quote(string(html)))
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("assets.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	abandonedOrdersInterval  = time.Hour
+	abandonedOrdersBatchSize = 100
+)
+
+// abandonedOrdersResult counts what a run of the abandoned orders cleanup did.
+type abandonedOrdersResult struct {
+	Abandoned int `json:"abandoned"`
+	Purged    int `json:"purged"`
+}
+
+// RunAbandonedOrders cleans up the abandoned orders of every instance in the
+// background, every hour.
+func (a *API) RunAbandonedOrders(db *gorm.DB, log *logrus.Entry) {
+	go func() {
+		for {
+			a.cleanUpAllAbandonedOrders(db, log)
+			time.Sleep(abandonedOrdersInterval)
+		}
+	}()
+}
+
+func (a *API) cleanUpAllAbandonedOrders(db *gorm.DB, log *logrus.Entry) {
+	instanceIDs := []string{""}
+	if a.config.MultiInstanceMode {
+		instances := []models.Instance{}
+		if rsp := db.Find(&instances); rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Error loading instances")
+			return
+		}
+		instanceIDs = instanceIDs[:0]
+		for _, instance := range instances {
+			instanceIDs = append(instanceIDs, instance.ID)
+		}
+	}
+
+	for _, instanceID := range instanceIDs {
+		instanceLog := log.WithField("instance_id", instanceID)
+		ctx, err := a.instanceContext(db, instanceID)
+		if err != nil {
+			instanceLog.WithError(err).Error("Error loading instance config")
+			continue
+		}
+		result, err := cleanUpAbandonedOrders(ctx, db, instanceID, instanceLog)
+		if err != nil {
+			instanceLog.WithError(err).Error("Error cleaning up abandoned orders")
+			continue
+		}
+		if result.Abandoned > 0 || result.Purged > 0 {
+			instanceLog.WithField("abandoned", result.Abandoned).WithField("purged", result.Purged).Info("Cleaned up abandoned orders")
+		}
+	}
+}
+
+// cleanUpAbandonedOrders cancels the orders of an instance that stayed unpaid
+// for longer than AbandonedOrders.After, and deletes the ones that were
+// abandoned more than AbandonedOrders.PurgeAfter ago for good.
+func cleanUpAbandonedOrders(ctx context.Context, db *gorm.DB, instanceID string, log logrus.FieldLogger) (*abandonedOrdersResult, error) {
+	config := gcontext.GetConfig(ctx)
+	result := &abandonedOrdersResult{}
+
+	if config.AbandonedOrders.After > 0 {
+		before := time.Now().Add(-time.Duration(config.AbandonedOrders.After) * time.Hour)
+		skipped := 0
+		for {
+			orders := []*models.Order{}
+			rsp := orderQuery(db).
+				Where("instance_id = ? AND payment_state = ? AND created_at < ?", instanceID, models.PendingState, before).
+				Order("created_at asc").
+				Offset(skipped).
+				Limit(abandonedOrdersBatchSize).
+				Find(&orders)
+			if rsp.Error != nil {
+				return result, rsp.Error
+			}
+			for _, order := range orders {
+				abandoned, err := abandonOrder(ctx, db, order, log)
+				if err != nil {
+					return result, err
+				}
+				if abandoned {
+					result.Abandoned++
+				} else {
+					skipped++
+				}
+			}
+			if len(orders) < abandonedOrdersBatchSize {
+				break
+			}
+		}
+	}
+
+	if config.AbandonedOrders.PurgeAfter > 0 {
+		before := time.Now().AddDate(0, 0, -config.AbandonedOrders.PurgeAfter)
+		purged, err := models.PurgeAbandonedOrders(db, instanceID, before, abandonedOrdersBatchSize)
+		result.Purged = purged
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// abandonOrder cancels an unpaid order as abandoned, and calls the abandoned
+// webhook with it. Orders with a payment in progress are left alone, and so
+// are orders that were paid or abandoned by another process since they were
+// listed. Stock is only taken out of the inventory when an order is paid, so
+// cancelling the order is what releases the stock it would take.
+func abandonOrder(ctx context.Context, db *gorm.DB, order *models.Order, log logrus.FieldLogger) (bool, error) {
+	config := gcontext.GetConfig(ctx)
+
+	now := time.Now()
+	tx := db.Begin()
+	// payments lock the order while they are taken, so this waits for a
+	// payment in progress and keeps new ones from starting
+	if rsp := models.ForUpdate(tx).Preload("Transactions").First(order, "id = ?", order.ID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return false, nil
+		}
+		return false, rsp.Error
+	}
+	for _, t := range order.Transactions {
+		if t.Status == models.PendingState {
+			tx.Rollback()
+			return false, nil
+		}
+	}
+	rsp := tx.Model(&models.Order{}).
+		Where("id = ? AND abandoned_at IS NULL AND payment_state = ?", order.ID, models.PendingState).
+		UpdateColumns(map[string]interface{}{"abandoned_at": now, "deleted_at": now})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	order.AbandonedAt = &now
+	order.DeletedAt = &now
+	models.LogEvent(tx, "", "", order.ID, models.EventAbandoned, nil)
+
+	orderLog := log.WithField("order_id", order.ID)
+	if config.Webhooks.Abandoned != "" && !order.SuppressNotifications {
+		hook := newHook(ctx, orderLog, order.InstanceID, models.OrderAbandonedHook, config.Webhooks.Abandoned, order.UserID, order)
+		if rsp := tx.Save(hook); rsp.Error != nil {
+			tx.Rollback()
+			return false, rsp.Error
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return false, rsp.Error
+	}
+	orderLog.Info("Cancelled abandoned order")
+	return true, nil
+}
+
+// AbandonedOrdersCleanUp cleans up the abandoned orders of the instance right
+// away, instead of waiting for the next run in the background, and returns how
+// many orders were abandoned and purged.
+func (a *API) AbandonedOrdersCleanUp(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	if config.AbandonedOrders.After <= 0 && config.AbandonedOrders.PurgeAfter <= 0 {
+		return badRequestError("Abandoned orders aren't cleaned up, set abandoned_orders.after or abandoned_orders.purge_after first")
+	}
+
+	result, err := cleanUpAbandonedOrders(ctx, a.db, gcontext.GetInstanceID(ctx), getLogEntry(r))
+	if err != nil {
+		return internalServerError("Error cleaning up abandoned orders").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAbandonedOrders(t *testing.T) {
+	// the route tests lower the global log level, the tests that sort after
+	// this file expect it back
+	defer logrus.SetLevel(logrus.GetLevel())
+	test := NewRouteTest(t)
+	token := testAdminToken("admin", "")
+	url := "/orders/abandoned/cleanup"
+
+	t.Run("Disabled", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	test.Config.AbandonedOrders.After = 24
+	test.Config.Webhooks.Abandoned = "https://example.com/hooks/abandoned"
+	old := time.Now().Add(-48 * time.Hour)
+	for _, order := range []*models.Order{test.Data.firstOrder, test.Data.secondOrder} {
+		require.NoError(t, test.DB.Model(order).UpdateColumns(map[string]interface{}{"payment_state": models.PendingState, "created_at": old}).Error)
+	}
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("status", models.FailedState).Error)
+	require.NoError(t, test.DB.Model(test.Data.secondTransaction).UpdateColumn("status", models.PendingState).Error)
+
+	t.Run("NonAdmin", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("Abandon", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		result := &abandonedOrdersResult{}
+		extractPayload(t, http.StatusOK, recorder, result)
+		assert.Equal(t, &abandonedOrdersResult{Abandoned: 1}, result, "the order with a payment in progress is left alone")
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Unscoped().First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		require.NotNil(t, order.AbandonedAt)
+		assert.NotNil(t, order.DeletedAt, "abandoned orders are cancelled")
+
+		hook := &models.Hook{}
+		require.NoError(t, test.DB.First(hook, "type = ?", models.OrderAbandonedHook).Error)
+		assert.Equal(t, test.Config.Webhooks.Abandoned, hook.URL)
+		assert.Contains(t, hook.Payload, test.Data.firstOrder.ID)
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.First(event, "order_id = ? AND type = ?", order.ID, models.EventAbandoned).Error)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, token)
+		result = &abandonedOrdersResult{}
+		extractPayload(t, http.StatusOK, recorder, result)
+		assert.Equal(t, &abandonedOrdersResult{}, result, "orders are abandoned once")
+	})
+
+	t.Run("PaidSinceListed", func(t *testing.T) {
+		require.NoError(t, test.DB.Model(test.Data.secondTransaction).UpdateColumn("status", models.FailedState).Error)
+		stale := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(stale, "id = ?", test.Data.secondOrder.ID).Error)
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", stale.ID).UpdateColumn("payment_state", models.PaidState).Error)
+
+		ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+		require.NoError(t, err)
+		abandoned, err := abandonOrder(ctx, test.DB, stale, testLogger)
+		require.NoError(t, err)
+		assert.False(t, abandoned)
+		assert.NoError(t, test.DB.First(&models.Order{}, "id = ?", stale.ID).Error, "the paid order isn't cancelled")
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		test.Config.AbandonedOrders.PurgeAfter = 30
+		require.NoError(t, test.DB.Unscoped().Model(&models.Order{}).Where("id = ?", test.Data.firstOrder.ID).UpdateColumn("abandoned_at", time.Now().AddDate(0, 0, -31)).Error)
+		order := test.Data.firstOrder
+		require.NoError(t, test.DB.Create(&models.ActionLink{InstanceID: order.InstanceID, ID: "purged-link", OrderID: order.ID, Action: models.MarkPaidAction}).Error)
+		require.NoError(t, test.DB.Create(&models.PriceOverride{InstanceID: order.InstanceID, ID: "purged-override", OrderID: order.ID}).Error)
+		require.NoError(t, test.DB.Create(&models.FunnelEvent{InstanceID: order.InstanceID, CheckoutID: "purged", Step: models.OrderCreatedStep, OrderID: order.ID}).Error)
+		_, err := models.EnqueueJob(test.DB, order.InstanceID, models.OrderAutomationsJob, &automationsJob{OrderID: order.ID})
+		require.NoError(t, err)
+		_, err = models.EnqueueJob(test.DB, order.InstanceID, models.OrderConfirmationMailJob, &mailJob{TransactionID: test.Data.firstTransaction.ID})
+		require.NoError(t, err)
+		kept, err := models.EnqueueJob(test.DB, order.InstanceID, models.OrderAutomationsJob, &automationsJob{OrderID: test.Data.secondOrder.ID})
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		result := &abandonedOrdersResult{}
+		extractPayload(t, http.StatusOK, recorder, result)
+		assert.Equal(t, &abandonedOrdersResult{Purged: 1}, result)
+
+		for _, model := range []interface{}{
+			&models.Order{}, &models.LineItem{}, &models.Transaction{}, &models.Event{},
+			&models.ActionLink{}, &models.PriceOverride{}, &models.FunnelEvent{},
+		} {
+			var count int
+			column := "order_id"
+			if _, ok := model.(*models.Order); ok {
+				column = "id"
+			}
+			require.NoError(t, test.DB.Unscoped().Model(model).Where(column+" = ?", test.Data.firstOrder.ID).Count(&count).Error)
+			assert.Zero(t, count, "%T", model)
+		}
+		assert.NoError(t, test.DB.First(&models.Order{}, "id = ?", test.Data.secondOrder.ID).Error)
+
+		jobs := []models.Job{}
+		require.NoError(t, test.DB.Find(&jobs).Error)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, kept.ID, jobs[0].ID)
+	})
+}
@@ -0,0 +1,422 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// errActionLinksURLMissing is returned when links are issued without the
+// public URL of the API. Links aren't built from the Host of the request, as
+// a spoofed Host would sign and mail links to another site.
+var errActionLinksURLMissing = errors.New("action_links.url is not configured")
+
+const (
+	defaultActionLinkTTL = 72 * time.Hour
+	actionLinkAudience   = "gocommerce-action"
+)
+
+// ActionLinkParams holds the parameters for issuing an action link.
+type ActionLinkParams struct {
+	Action        string `json:"action"`
+	TransactionID string `json:"transaction_id"`
+	OverrideID    string `json:"override_id"`
+	Amount        uint64 `json:"amount"`
+}
+
+type actionLinkResponse struct {
+	*models.ActionLink
+	URL string `json:"url"`
+}
+
+// ActionLinkList lists the action links issued for an order, with when and
+// from where they were used. It is only available to admins.
+func (a *API) ActionLinkList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	orderID := gcontext.GetOrderID(ctx)
+
+	links := []models.ActionLink{}
+	if rsp := a.db.Where("order_id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx)).Order("created_at asc").Find(&links); rsp.Error != nil {
+		return internalServerError("Error while querying for action links").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, links)
+}
+
+// ActionLinkCreate issues a signed link that takes an action on an order when
+// it is followed, on behalf of the admin issuing it. Links expire after the
+// configured TTL and can only be used once. It is only available to admins.
+func (a *API) ActionLinkCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := gcontext.GetClaims(ctx)
+
+	params := &ActionLinkParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+
+	order := &models.Order{}
+	if rsp := a.db.First(order, "id = ? AND instance_id = ?", gcontext.GetOrderID(ctx), gcontext.GetInstanceID(ctx)); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	link := &models.ActionLink{
+		Action:        params.Action,
+		TransactionID: params.TransactionID,
+		OverrideID:    params.OverrideID,
+		Amount:        params.Amount,
+		IssuedBy:      claims.Subject,
+	}
+	if httpErr := a.checkActionLink(a.db, order, link); httpErr != nil {
+		return httpErr
+	}
+
+	url, err := issueActionLink(a.db, r, order, link)
+	if err == errActionLinksURLMissing {
+		return unprocessableEntityError("Action links require the public URL of the API in action_links.url")
+	}
+	if err != nil {
+		return internalServerError("Error issuing action link").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusCreated, &actionLinkResponse{ActionLink: link, URL: url})
+}
+
+// ActionLinkConfirm shows the action of a link with a button to take it.
+// Links are only used with a POST, so mail clients that open the links in a
+// mail to scan them don't take the action.
+func (a *API) ActionLinkConfirm(w http.ResponseWriter, r *http.Request) error {
+	link, httpErr := a.loadActionLink(r)
+	if httpErr != nil {
+		return renderActionPage(w, httpErr.Code, "This link can't be used", httpErr.Message, false)
+	}
+	return renderActionPage(w, http.StatusOK, actionTitle(link), "Order "+link.OrderID, true)
+}
+
+// ActionLinkUse takes the action of a link. The action is recorded in the
+// events of the order as taken by the admin the link was issued by.
+func (a *API) ActionLinkUse(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	link, httpErr := a.loadActionLink(r)
+	if httpErr != nil {
+		return renderActionPage(w, httpErr.Code, "This link can't be used", httpErr.Message, false)
+	}
+
+	used, err := models.UseActionLink(a.db, link, r.RemoteAddr)
+	if err != nil {
+		return internalServerError("Error updating action link").WithInternalError(err)
+	}
+	if !used {
+		return renderActionPage(w, http.StatusGone, "This link can't be used", "The link was used already", false)
+	}
+
+	// the action runs with the issuing admin as the user of the request
+	token := &jwt.Token{Claims: &claims.JWTClaims{StandardClaims: jwt.StandardClaims{Subject: link.IssuedBy}}}
+	r = r.WithContext(gcontext.WithToken(r.Context(), token))
+
+	httpErr = a.takeAction(r, link)
+	link.Result = "ok"
+	if httpErr != nil {
+		link.Result = httpErr.Message
+	}
+	if rsp := a.db.Model(link).UpdateColumn("result", link.Result); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to store the result of an action link")
+	}
+	log.WithFields(map[string]interface{}{
+		"action_link_id": link.ID,
+		"action":         link.Action,
+		"order_id":       link.OrderID,
+		"issued_by":      link.IssuedBy,
+	}).Infof("Action link used: %s", link.Result)
+
+	if httpErr != nil {
+		return renderActionPage(w, httpErr.Code, actionTitle(link)+" failed", httpErr.Message, false)
+	}
+	return renderActionPage(w, http.StatusOK, actionTitle(link)+": done", "Order "+link.OrderID, false)
+}
+
+// checkActionLink makes sure the action of a link can be taken on the order
+// when it is issued.
+func (a *API) checkActionLink(db *gorm.DB, order *models.Order, link *models.ActionLink) *HTTPError {
+	switch link.Action {
+	case models.RefundAction:
+		trans, httpErr := a.getTransaction(link.InstanceID, link.TransactionID)
+		if httpErr != nil {
+			return httpErr
+		}
+		if trans.OrderID != order.ID {
+			return notFoundError("Transaction not found")
+		}
+		if trans.Type != models.ChargeTransactionType || trans.Status != models.PaidState {
+			return badRequestError("Only paid charges can be refunded")
+		}
+		if link.Amount == 0 {
+			link.Amount = trans.Amount
+		}
+		if link.Amount > trans.Amount {
+			return badRequestError("The balance of the refund must be between 0 and the total amount")
+		}
+	case models.MarkPaidAction:
+		if order.PaymentState == models.PaidState {
+			return badRequestError("This order has already been paid")
+		}
+	case models.ApprovePriceOverrideAction:
+		override := &models.PriceOverride{}
+		if rsp := db.Where("order_id = ?", order.ID).First(override, "id = ?", link.OverrideID); rsp.Error != nil {
+			if rsp.RecordNotFound() {
+				return notFoundError("Price override not found")
+			}
+			return internalServerError("Error during database query").WithInternalError(rsp.Error)
+		}
+		if override.Status != models.PendingState {
+			return badRequestError("The price override is already %s", override.Status)
+		}
+		if override.RequestedBy == link.IssuedBy {
+			return badRequestError("A price override must be reviewed by another admin")
+		}
+	default:
+		return badRequestError("Unknown action '%v', use %v, %v or %v", link.Action, models.RefundAction, models.MarkPaidAction, models.ApprovePriceOverrideAction)
+	}
+	return nil
+}
+
+// takeAction takes the action of a link on its order.
+func (a *API) takeAction(r *http.Request, link *models.ActionLink) *HTTPError {
+	ctx := r.Context()
+	order := &models.Order{}
+	if rsp := orderQuery(a.db).First(order, "id = ? AND instance_id = ?", link.OrderID, link.InstanceID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	switch link.Action {
+	case models.RefundAction:
+		trans, httpErr := a.getTransaction(link.InstanceID, link.TransactionID)
+		if httpErr != nil {
+			return httpErr
+		}
+		_, httpErr = a.refundTransaction(ctx, r, order, trans, link.Amount, nil)
+		return httpErr
+	case models.MarkPaidAction:
+		tx := a.db.Begin()
+		tr, httpErr := markOrderPaid(tx, r, gcontext.GetConfig(ctx), order, link.IssuedBy)
+		if httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		log := getLogEntry(r)
+		enqueueMail(ctx, tx, log, models.OrderConfirmationMailJob, &mailJob{TransactionID: tr.ID})
+		tx.Commit()
+
+		a.enqueueAutomations(ctx, log, order)
+		return nil
+	case models.ApprovePriceOverrideAction:
+		tx := a.db.Begin()
+		if _, httpErr := reviewPriceOverrideAs(tx, r, order.ID, link.OverrideID, link.IssuedBy, true); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		tx.Commit()
+		return nil
+	}
+	return badRequestError("Unknown action '%v'", link.Action)
+}
+
+// markOrderPaid marks an unpaid order as paid by an admin, for payments that
+// were made outside of the payment providers.
+func markOrderPaid(tx *gorm.DB, r *http.Request, config *conf.Configuration, order *models.Order, adminID string) (*models.Transaction, *HTTPError) {
+	if order.PaymentState == models.PaidState {
+		return nil, badRequestError("This order has already been paid")
+	}
+
+	tr := models.NewTransaction(order)
+	tr.ID = models.NewID(config.IDFormat)
+	tr.Status = models.PaidState
+	if rsp := tx.Create(tr); rsp.Error != nil {
+		return nil, internalServerError("Error saving transaction").WithInternalError(rsp.Error)
+	}
+	order.PaymentProcessor = models.ManualProcessor
+	if httpErr := settleOrder(tx, r, config, order, tr, adminID); httpErr != nil {
+		return nil, httpErr
+	}
+	return tr, nil
+}
+
+// settleOrder marks an order as paid by a paid transaction, gives it an
+// invoice number if it has none yet, takes its items out of the inventory
+// and queues the payment webhook.
+func settleOrder(tx *gorm.DB, r *http.Request, config *conf.Configuration, order *models.Order, tr *models.Transaction, actorID string) *HTTPError {
+	if order.InvoiceNumber == 0 {
+		invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+		if err != nil {
+			return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+		}
+		order.InvoiceNumber = invoiceNumber
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, actorID, order.ID, models.EventPaid, []string{"payment_state"}, map[string]models.Change{
+		"payment_state": {From: order.PaymentState, To: models.PaidState},
+		"transaction":   {To: tr.ID},
+		"amount":        {To: tr.Amount},
+	})
+	order.PaymentState = models.PaidState
+	previousState := order.State
+	if order.TransitionState(models.PaidState) {
+		models.LogTransition(tx, r.RemoteAddr, actorID, order.ID, "state", previousState, order.State)
+	}
+	if rsp := tx.Save(order); rsp.Error != nil {
+		return internalServerError("Error saving order").WithInternalError(rsp.Error)
+	}
+	log := getLogEntry(r)
+	recordFunnelStep(tx, order, models.PaidStep, log)
+	if err := adjustInventory(tx, order, nil, -1); err != nil {
+		log.WithError(err).Error("Error updating the inventory of a paid order")
+	}
+	if config.Webhooks.Payment != "" && !order.SuppressNotifications {
+		hook := newHook(r.Context(), log, order.InstanceID, models.PaymentSucceededHook, config.Webhooks.Payment, actorID, order)
+		tx.Save(hook)
+	}
+	return nil
+}
+
+// issueActionLink saves a link and returns its URL. The URL holds a token
+// signed with a key derived from the JWT secret, so it can't be used as an
+// access token.
+func issueActionLink(db *gorm.DB, r *http.Request, order *models.Order, link *models.ActionLink) (string, error) {
+	config := gcontext.GetConfig(r.Context())
+	if config.ActionLinks.URL == "" {
+		return "", errActionLinksURLMissing
+	}
+	ttl := defaultActionLinkTTL
+	if config.ActionLinks.TTL > 0 {
+		ttl = time.Duration(config.ActionLinks.TTL) * time.Hour
+	}
+	link.InstanceID = order.InstanceID
+	link.ID = uuid.NewRandom().String()
+	link.OrderID = order.ID
+	link.ExpiresAt = time.Now().Add(ttl)
+	if rsp := db.Create(link); rsp.Error != nil {
+		return "", rsp.Error
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
+		Id:        link.ID,
+		Subject:   link.IssuedBy,
+		Audience:  actionLinkAudience,
+		ExpiresAt: link.ExpiresAt.Unix(),
+	}).SignedString(actionLinkKey(config))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(config.ActionLinks.URL, "/") + "/actions/" + token, nil
+}
+
+// loadActionLink returns the unused link of the token in the URL.
+func (a *API) loadActionLink(r *http.Request) (*models.ActionLink, *HTTPError) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+
+	claims := &jwt.StandardClaims{}
+	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
+	_, err := p.ParseWithClaims(chi.URLParam(r, "token"), claims, func(token *jwt.Token) (interface{}, error) {
+		return actionLinkKey(config), nil
+	})
+	if err != nil || !claims.VerifyAudience(actionLinkAudience, true) {
+		return nil, httpError(http.StatusForbidden, "The link is invalid or expired")
+	}
+
+	link := &models.ActionLink{}
+	if rsp := a.db.First(link, "id = ? AND instance_id = ?", claims.Id, gcontext.GetInstanceID(ctx)); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("The link doesn't exist")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if link.Expired() {
+		return nil, httpError(http.StatusForbidden, "The link is invalid or expired")
+	}
+	if link.UsedAt != nil {
+		return nil, httpError(http.StatusGone, "The link was used already")
+	}
+	return link, nil
+}
+
+// orderReceivedActionLinks issues the links included in the mail notifying
+// the admin of a new order, if they are enabled.
+func (a *API) orderReceivedActionLinks(ctx context.Context, db *gorm.DB, r *http.Request, order *models.Order, tr *models.Transaction) map[string]string {
+	config := gcontext.GetConfig(ctx)
+	if !config.ActionLinks.InMails || tr.Type != models.ChargeTransactionType || tr.Status != models.PaidState {
+		return nil
+	}
+	link := &models.ActionLink{Action: models.RefundAction, TransactionID: tr.ID, Amount: tr.Amount}
+	url, err := issueActionLink(db, r, order, link)
+	if err != nil {
+		getLogEntry(r).WithError(err).Error("Error issuing action link for the order received mail")
+		return nil
+	}
+	return map[string]string{models.RefundAction: url}
+}
+
+func actionLinkKey(config *conf.Configuration) []byte {
+	mac := hmac.New(sha256.New, []byte(config.JWT.Secret))
+	mac.Write([]byte(actionLinkAudience))
+	return mac.Sum(nil)
+}
+
+func actionTitle(link *models.ActionLink) string {
+	switch link.Action {
+	case models.RefundAction:
+		return "Refund payment"
+	case models.MarkPaidAction:
+		return "Mark order as paid"
+	case models.ApprovePriceOverrideAction:
+		return "Approve price override"
+	}
+	return link.Action
+}
+
+var actionPageTemplate = template.Must(template.New("action").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{ .Title }}</title>
+</head>
+<body style="font-family: sans-serif; max-width: 480px; margin: 48px auto;">
+<h2>{{ .Title }}</h2>
+<p>{{ .Message }}</p>
+{{ if .Confirm }}<form method="post"><button type="submit">Confirm</button></form>{{ end }}
+</body>
+</html>
+`))
+
+func renderActionPage(w http.ResponseWriter, status int, title, message string, confirm bool) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	return actionPageTemplate.Execute(w, map[string]interface{}{
+		"Title":   title,
+		"Message": message,
+		"Confirm": confirm,
+	})
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func createActionLink(test *RouteTest, body string) *actionLinkResponse {
+	token := testAdminToken("magical-unicorn", "")
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/action-links", strings.NewReader(body), token)
+	link := &actionLinkResponse{}
+	extractPayload(test.T, http.StatusCreated, recorder, link)
+	return link
+}
+
+func actionPath(link *actionLinkResponse) string {
+	return link.URL[strings.Index(link.URL, "/actions/"):]
+}
+
+func unpaidFirstOrder(test *RouteTest) {
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(test.T, test.DB.Save(test.Data.firstOrder).Error)
+}
+
+func TestActionLinkCreate(t *testing.T) {
+	// the route tests lower the global log level, the tests that sort after
+	// this file expect it back
+	defer logrus.SetLevel(logrus.GetLevel())
+	t.Run("Refund", func(t *testing.T) {
+		test := NewRouteTest(t)
+		link := createActionLink(test, `{"action": "refund", "transaction_id": "first-trans"}`)
+		assert.Equal(t, models.RefundAction, link.Action)
+		assert.Equal(t, test.Data.firstTransaction.Amount, link.Amount)
+		assert.Equal(t, "magical-unicorn", link.IssuedBy)
+		assert.True(t, strings.HasPrefix(link.URL, "https://api.example.com/actions/"), link.URL)
+		assert.True(t, link.ExpiresAt.After(time.Now().Add(71*time.Hour)))
+	})
+	t.Run("RefundTooMuch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/action-links", strings.NewReader(`{"action": "refund", "transaction_id": "first-trans", "amount": 1000}`), token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("MarkPaidWhenPaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/action-links", strings.NewReader(`{"action": "mark_paid"}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "already been paid")
+	})
+	t.Run("UnknownAction", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/action-links", strings.NewReader(`{"action": "delete"}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown action")
+	})
+	t.Run("WithoutURL", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.ActionLinks.URL = ""
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/action-links", strings.NewReader(`{"action": "refund", "transaction_id": "first-trans"}`), token)
+		validateError(t, http.StatusUnprocessableEntity, recorder, "action_links.url")
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/action-links", strings.NewReader(`{"action": "mark_paid"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestActionLinkUse(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+	t.Run("MarkPaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpaidFirstOrder(test)
+		link := createActionLink(test, `{"action": "mark_paid"}`)
+
+		recorder := test.TestEndpoint(http.MethodGet, actionPath(link), nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "Mark order as paid")
+		assert.Contains(t, recorder.Body.String(), `<form method="post">`)
+
+		// showing the link doesn't take the action
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+
+		recorder = test.TestEndpoint(http.MethodPost, actionPath(link), nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, models.ManualProcessor, order.PaymentProcessor)
+
+		stored := &models.ActionLink{}
+		require.NoError(t, test.DB.First(stored, "id = ?", link.ID).Error)
+		require.NotNil(t, stored.UsedAt)
+		assert.Equal(t, "ok", stored.Result)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", "first-order", models.EventPaid).Find(&events).Error)
+		require.Len(t, events, 1)
+		assert.Equal(t, "magical-unicorn", events[0].UserID)
+	})
+	t.Run("SingleUse", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpaidFirstOrder(test)
+		link := createActionLink(test, `{"action": "mark_paid"}`)
+
+		recorder := test.TestEndpoint(http.MethodPost, actionPath(link), nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		recorder = test.TestEndpoint(http.MethodPost, actionPath(link), nil, nil)
+		assert.Equal(t, http.StatusGone, recorder.Code)
+	})
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpaidFirstOrder(test)
+		link := createActionLink(test, `{"action": "mark_paid"}`)
+		require.NoError(t, test.DB.Model(&models.ActionLink{}).Where("id = ?", link.ID).UpdateColumn("expires_at", time.Now().Add(-time.Hour)).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, actionPath(link), nil, nil)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+	t.Run("Tampered", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpaidFirstOrder(test)
+		link := createActionLink(test, `{"action": "mark_paid"}`)
+
+		recorder := test.TestEndpoint(http.MethodPost, actionPath(link)+"x", nil, nil)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/addresses"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// verifyShippingAddress verifies a new shipping address with the address
+// validation provider of the instance, and replaces it with the normalized
+// address. Invalid addresses are rejected in blocking mode, and otherwise
+// accepted as entered and marked unverified. When the provider fails, the
+// address is accepted without verification.
+func verifyShippingAddress(ctx context.Context, log logrus.FieldLogger, order *models.Order, address *models.Address) *HTTPError {
+	settings := gcontext.GetConfig(ctx).AddressValidation
+	if settings.Provider == "" || address == nil {
+		return nil
+	}
+	if err := address.Validate(); err != nil {
+		// processAddress reports the missing fields
+		return nil
+	}
+
+	validator, err := addresses.NewValidator(settings.Provider, addresses.Config{
+		APIKey:    settings.APIKey,
+		AuthID:    settings.AuthID,
+		AuthToken: settings.AuthToken,
+		URL:       settings.URL,
+	})
+	if err != nil {
+		log.WithError(err).Error("Address validation is misconfigured")
+		return nil
+	}
+	result, err := validator.Verify(ctx, address.AddressRequest)
+	if err != nil {
+		log.WithError(err).WithField("provider", validator.Name()).Warn("Accepting a shipping address that couldn't be verified")
+		return nil
+	}
+
+	if !result.Valid {
+		if settings.Mode == addresses.Blocking {
+			return badRequestError("Failed to verify Shipping Address: %v", strings.Join(result.Messages, ", ")).WithData(map[string]interface{}{
+				"messages": result.Messages,
+			})
+		}
+		log.WithField("messages", result.Messages).Info("Accepting a shipping address that is not valid")
+		order.AddressVerification = models.AddressUnverified
+		return nil
+	}
+	address.AddressRequest = result.Address
+	order.AddressVerification = models.AddressVerified
+	return nil
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/addresses"
+	"github.com/netlify/gocommerce/models"
+)
+
+func addressOrderBody(country, zip string) *strings.Reader {
+	return strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_address": {
+			"name": "Test User",
+			"address1": "417  Montgomery Street",
+			"city": "San Francisco", "country": "` + country + `", "zip": "` + zip + `"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`)
+}
+
+func TestOrderCreateAddressValidation(t *testing.T) {
+	// the route tests lower the global log level, the tests that sort after
+	// this file expect it back
+	defer logrus.SetLevel(logrus.GetLevel())
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("Disabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", addressOrderBody("USA", "941"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Empty(t, order.AddressVerification)
+		assert.Equal(t, "417  Montgomery Street", order.ShippingAddress.Address1)
+	})
+
+	t.Run("Normalized", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.AddressValidation.Provider = addresses.Regex
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", addressOrderBody("USA", "941041129"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, models.AddressVerified, order.AddressVerification)
+		assert.Equal(t, "417 Montgomery Street", order.ShippingAddress.Address1)
+		assert.Equal(t, "94104-1129", order.ShippingAddress.Zip)
+		assert.Equal(t, "94104-1129", order.BillingAddress.Zip, "the billing address defaults to the normalized address")
+
+		saved := &models.Address{}
+		assert.NoError(t, test.DB.First(saved, "id = ?", order.ShippingAddressID).Error)
+		assert.Equal(t, "94104-1129", saved.Zip)
+	})
+
+	t.Run("Advisory", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.AddressValidation.Provider = addresses.Regex
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", addressOrderBody("USA", "941"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, models.AddressUnverified, order.AddressVerification)
+		assert.Equal(t, "941", order.ShippingAddress.Zip)
+	})
+
+	t.Run("Blocking", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.AddressValidation.Provider = addresses.Regex
+		test.Config.AddressValidation.Mode = addresses.Blocking
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", addressOrderBody("USA", "941"), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "941 is not a valid postal code in USA")
+	})
+
+	t.Run("ProviderDown", func(t *testing.T) {
+		provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "down")
+		}))
+		defer provider.Close()
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.AddressValidation.Provider = addresses.EasyPost
+		test.Config.AddressValidation.Mode = addresses.Blocking
+		test.Config.AddressValidation.APIKey = "secret"
+		test.Config.AddressValidation.URL = provider.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", addressOrderBody("USA", "941"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Empty(t, order.AddressVerification)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/sebest/xff"
@@ -13,8 +14,12 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/go-chi/chi"
+	"github.com/netlify/gocommerce/admin"
+	"github.com/netlify/gocommerce/cache"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/tracing"
 	"github.com/netlify/netlify-commons/graceful"
 )
 
@@ -30,9 +35,18 @@ var (
 type API struct {
 	handler    http.Handler
 	db         *gorm.DB
+	replica    *gorm.DB
 	config     *conf.GlobalConfiguration
 	httpClient *http.Client
+	settings   *settingsCache
+	products   cache.Store
+	vatNumbers cache.Store
+	limiter    cache.Limiter
 	version    string
+
+	// baseContext has the configuration of the instance in single instance
+	// mode, for the background jobs.
+	baseContext context.Context
 }
 
 // ListenAndServe starts the REST API.
@@ -59,7 +73,40 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 		config:     globalConfig,
 		db:         db,
 		httpClient: &http.Client{},
+		settings:   &settingsCache{},
+		products:   cache.NewMemory(),
+		vatNumbers: cache.NewMemory(),
+		limiter:    cache.NewMemoryLimiter(),
 		version:    version,
+
+		baseContext: ctx,
+	}
+	if globalConfig.ProductCache.RedisURL != "" {
+		store, err := cache.NewRedis(globalConfig.ProductCache.RedisURL)
+		if err != nil {
+			logrus.WithError(err).Error("Falling back to the in-process product cache")
+		} else {
+			api.products = store
+			api.vatNumbers = store
+		}
+	}
+	if globalConfig.RateLimits.RedisURL != "" {
+		limiter, err := cache.NewRedisLimiter(globalConfig.RateLimits.RedisURL)
+		if err != nil {
+			logrus.WithError(err).Error("Falling back to in-process rate limits")
+		} else {
+			api.limiter = limiter
+		}
+	}
+	if replica, err := models.ConnectReplica(globalConfig); err != nil {
+		logrus.WithError(err).Error("Falling back to reading from the primary database")
+	} else {
+		api.replica = replica
+	}
+
+	configureBreakers(globalConfig)
+	if globalConfig.Tracing.Enabled {
+		tracing.SetReporter(logSpan)
 	}
 
 	xffmw, _ := xff.Default()
@@ -67,16 +114,29 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 	r := newRouter()
 	r.UseBypass(xffmw.Handler)
 	r.Use(withRequestID)
+	r.UseBypass(traceRequest)
 	r.UseBypass(newStructuredLogger(logrus.StandardLogger()))
 	r.Use(recoverer)
+	if globalConfig.LoadShedding.MaxInFlight > 0 {
+		shedder := newLoadShedder(globalConfig.LoadShedding.MaxInFlight, time.Duration(globalConfig.LoadShedding.TargetLatency)*time.Millisecond)
+		r.UseBypass(shedder.handler)
+	}
 
 	r.Get("/health", api.HealthCheck)
+	r.Get("/ready", api.ReadinessCheck)
+	if globalConfig.Admin.Enabled {
+		r.Handle("/admin", admin.Handler())
+		r.Handle("/admin/*", admin.Handler())
+	}
 
 	r.Route("/", func(r *router) {
 		if globalConfig.MultiInstanceMode {
 			r.Use(api.loadInstanceConfig)
 		}
 		r.Use(api.withToken)
+		if api.replica != nil {
+			r.Use(api.stickToPrimary)
+		}
 
 		r.Route("/orders", api.orderRoutes)
 		r.Route("/users", api.userRoutes)
@@ -84,35 +144,105 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 		r.Route("/downloads", func(r *router) {
 			r.With(authRequired).Get("/", api.DownloadList)
 			r.Get("/{download_id}", api.DownloadURL)
+			r.Get("/{download_id}/stats", api.DownloadStats)
+			r.With(adminRequired).Delete("/{download_id}/pinned-ip", api.DownloadUnpin)
 		})
 
+		r.Get("/rates", api.ExchangeRatesView)
+
 		r.Route("/vatnumbers", func(r *router) {
 			r.Get("/{vat_number}", api.VatNumberLookup)
 		})
 
 		r.Route("/payments", func(r *router) {
-			r.Use(adminRequired)
-
-			r.Get("/", api.PaymentList)
+			r.With(scopeRequired(paymentsReadScope)).Get("/", api.PaymentList)
 			r.Route("/{payment_id}", func(r *router) {
-				r.Get("/", api.PaymentView)
-				r.With(addGetBody).Post("/refund", api.PaymentRefund)
+				r.With(scopeRequired(paymentsReadScope)).Get("/", api.PaymentView)
+				r.With(scopeRequired(paymentsRefundScope)).With(addGetBody).Post("/refund", api.PaymentRefund)
 			})
 		})
 
+		r.Route("/bulk-refunds", func(r *router) {
+			r.Use(scopeRequired(paymentsRefundScope))
+
+			r.Get("/", api.BulkRefundList)
+			r.With(addGetBody).Post("/", api.BulkRefundCreate)
+			r.Get("/{bulk_refund_id}", api.BulkRefundView)
+		})
+
+		r.With(scopeRequired(ordersReadScope)).Get("/events", api.EventList)
+		r.With(adminRequired).Get("/breakers", api.BreakerList)
+		r.Route("/jobs", func(r *router) {
+			r.Use(adminRequired)
+
+			r.Get("/", api.JobList)
+			r.Post("/{job_id}/retry", api.JobRetry)
+		})
+		r.With(adminRequired).Get("/metrics/payments", api.PaymentMetrics)
+
+		r.Route("/inventory", func(r *router) {
+			r.With(scopeRequired(inventoryReadScope)).Get("/", api.InventoryList)
+			r.With(scopeRequired(inventoryReadScope)).Get("/{sku}", api.InventoryView)
+			r.With(scopeRequired(inventoryWriteScope)).Put("/{sku}", api.InventoryUpdate)
+		})
+
+		r.Route("/cache", func(r *router) {
+			r.Use(adminRequired)
+
+			r.Delete("/products", api.ProductCachePurge)
+		})
+
+		r.Route("/hooks", func(r *router) {
+			r.Use(adminRequired)
+
+			r.Get("/", api.HookList)
+			r.Get("/{hook_id}", api.HookView)
+		})
+
 		r.Route("/paypal", func(r *router) {
-			r.With(addGetBody).Post("/", api.PreauthorizePayment)
+			r.With(api.rateLimited("payments", globalConfig.RateLimits.Payments)).With(addGetBody).Post("/", api.PreauthorizePayment)
 		})
 
 		r.Route("/reports", func(r *router) {
-			r.Use(adminRequired)
+			r.Use(scopeRequired(reportsReadScope))
 
 			r.Get("/sales", api.SalesReport)
 			r.Get("/products", api.ProductsReport)
+			r.Get("/funnel", api.FunnelReport)
 		})
 
+		r.Post("/graphql", api.GraphQL)
+		r.Get("/settings", api.SettingsView)
+		r.With(adminRequired).Post("/settings/branding/preview", api.BrandingPreview)
+		r.Get("/checkout/socket", api.CheckoutSocket)
+
 		r.Route("/coupons", func(r *router) {
-			r.Get("/{coupon_code}", api.CouponView)
+			r.With(api.rateLimited("coupons", globalConfig.RateLimits.Coupons)).Get("/{coupon_code}", api.CouponView)
+		})
+
+		r.Route("/gift-cards", func(r *router) {
+			r.With(scopeRequired(giftCardsReadScope)).Get("/", api.GiftCardList)
+			r.With(scopeRequired(giftCardsWriteScope)).With(addGetBody).Post("/", api.GiftCardCreate)
+			r.With(api.rateLimited("gift_cards", globalConfig.RateLimits.GiftCards)).Get("/{code}", api.GiftCardView)
+		})
+
+		r.Route("/subscriptions", func(r *router) {
+			r.Use(authRequired)
+
+			r.Get("/", api.SubscriptionList)
+			r.With(addGetBody).Post("/", api.SubscriptionCreate)
+			r.Get("/{subscription_id}", api.SubscriptionView)
+			r.Delete("/{subscription_id}", api.SubscriptionCancel)
+		})
+
+		r.Route("/webhooks", func(r *router) {
+			r.Post("/stripe", api.StripeWebhook)
+			r.Post("/paypal", api.PayPalWebhook)
+		})
+
+		r.Route("/actions/{token}", func(r *router) {
+			r.Get("/", api.ActionLinkConfirm)
+			r.Post("/", api.ActionLinkUse)
 		})
 
 		r.With(authRequired).Post("/claim", api.ClaimOrders)
@@ -137,8 +267,8 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 	corsHandler := cors.New(cors.Options{
 		AllowedMethods:   []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link", "X-Total-Count"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", idempotencyKeyHeader, instanceHeaderName},
+		ExposedHeaders:   []string{"Link", "X-Total-Count", "Retry-After", idempotentReplayedHeader},
 		AllowCredentials: true,
 	})
 
@@ -147,53 +277,105 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 }
 
 func (a *API) orderRoutes(r *router) {
-	r.With(authRequired).Get("/", a.OrderList)
-	r.Post("/", a.OrderCreate)
+	r.Get("/", a.OrderList)
+	r.With(a.rateLimited("orders", a.config.RateLimits.Orders)).Post("/", a.idempotent(a.OrderCreate))
+	r.With(scopeRequired(ordersReadScope)).Get("/export", a.OrderExport)
+	r.Post("/preview", a.OrderPreview)
+	r.With(scopeRequired(ordersWriteScope)).Post("/abandoned/cleanup", a.AbandonedOrdersCleanUp)
+	r.With(scopeRequired(ordersReadScope)).Get("/integrity", a.OrderIntegrityCheck)
 
 	r.Route("/{order_id}", func(r *router) {
 		r.Use(a.withOrderID)
 		r.Get("/", a.OrderView)
-		r.With(adminRequired).Put("/", a.OrderUpdate)
+		r.With(scopeRequired(ordersWriteScope)).Put("/", a.OrderUpdate)
+		r.Delete("/", a.OrderDelete)
+		r.Patch("/data", a.OrderDataUpdate)
+		r.Put("/invoice-details", a.OrderInvoiceDetailsUpdate)
+		r.With(scopeRequired(ordersWriteScope)).Put("/owner", a.OrderOwnerUpdate)
 
 		r.Route("/payments", func(r *router) {
 			r.With(authRequired).Get("/", a.PaymentListForOrder)
-			r.With(addGetBody).Post("/", a.PaymentCreate)
+			r.With(a.rateLimited("payments", a.config.RateLimits.Payments)).With(addGetBody).Post("/", a.idempotent(a.PaymentCreate))
+		})
+
+		r.Route("/transactions/{transaction_id}", func(r *router) {
+			r.Use(scopeRequired(paymentsRefundScope))
+			r.With(addGetBody).Post("/refund", a.OrderTransactionRefund)
 		})
 
 		r.Get("/downloads", a.DownloadList)
+		r.With(scopeRequired(paymentsReadScope)).Get("/transfers", a.TransferListForOrder)
+		r.With(scopeRequired(ordersReadScope)).Get("/events", a.OrderEventList)
+
+		r.Route("/price-overrides", func(r *router) {
+			r.With(scopeRequired(ordersReadScope)).Get("/", a.PriceOverrideList)
+			r.With(scopeRequired(ordersWriteScope)).Post("/", a.PriceOverrideCreate)
+			r.With(scopeRequired(ordersWriteScope)).Post("/{override_id}/approve", a.PriceOverrideApprove)
+			r.With(scopeRequired(ordersWriteScope)).Post("/{override_id}/reject", a.PriceOverrideReject)
+		})
+
+		r.Route("/action-links", func(r *router) {
+			r.Use(adminRequired)
+
+			r.Get("/", a.ActionLinkList)
+			r.Post("/", a.ActionLinkCreate)
+		})
 		r.Get("/receipt", a.ReceiptView)
 		r.Post("/receipt", a.ResendOrderReceipt)
+
+		r.Route("/returns", func(r *router) {
+			r.Get("/", a.ReturnList)
+			r.Get("/eligibility", a.ReturnEligibility)
+			r.Post("/", a.ReturnCreate)
+			r.With(scopeRequired(paymentsRefundScope)).With(addGetBody).Post("/{return_id}/refund", a.ReturnRefund)
+			r.With(scopeRequired(ordersWriteScope)).Post("/{return_id}/reject", a.ReturnReject)
+		})
+		r.With(scopeRequired(ordersWriteScope)).Post("/recalculate", a.OrderRecalculate)
 	})
 }
 
 func (a *API) userRoutes(r *router) {
 	r.Use(authRequired)
-	r.With(adminRequired).Get("/", a.UserList)
+	r.With(scopeRequired(usersReadScope)).Get("/", a.UserList)
 
 	r.Route("/{user_id}", func(r *router) {
 		r.Use(a.withUser)
 		r.Use(ensureUserAccess)
 
 		r.Get("/", a.UserView)
-		r.With(adminRequired).Delete("/", a.UserDelete)
+		r.With(scopeRequired(usersWriteScope)).Delete("/", a.UserDelete)
 
 		r.Get("/payments", a.PaymentListForUser)
 		r.Get("/orders", a.OrderList)
+		r.With(scopeRequired(usersWriteScope)).Put("/groups", a.CustomerGroupsUpdate)
+		r.With(scopeRequired(usersWriteScope)).Put("/tax-exemption", a.UserTaxExemptionUpdate)
+		r.Get("/email-changes", a.UserEmailChangeList)
 
 		r.Route("/addresses", func(r *router) {
 			r.Get("/", a.AddressList)
-			r.With(adminRequired).Post("/", a.CreateNewAddress)
+			r.Post("/", a.CreateNewAddress)
 			r.Route("/{addr_id}", func(r *router) {
 				r.Get("/", a.AddressView)
-				r.With(adminRequired).Delete("/", a.AddressDelete)
+				r.Put("/", a.AddressUpdate)
+				r.Delete("/", a.AddressDelete)
 			})
 		})
 	})
 }
 
+// requestIDRegexp limits the request IDs taken from clients and proxies to
+// ones that are safe to log and send on.
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID keeps the X-Request-ID of the request, or gives it a new one,
+// and sends it back with the response. It is the trace ID of the spans of the
+// request.
 func withRequestID(w http.ResponseWriter, r *http.Request) (context.Context, error) {
-	id := uuid.NewRandom().String()
-	ctx := r.Context()
-	ctx = gcontext.WithRequestID(ctx, id)
-	return ctx, nil
+	id := r.Header.Get(tracing.Header)
+	if !requestIDRegexp.MatchString(id) {
+		id = uuid.NewRandom().String()
+	}
+	w.Header().Set(tracing.Header, id)
+	ctx := gcontext.WithRequestID(r.Context(), id)
+	return tracing.WithTraceID(ctx, id), nil
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
 )
 
 func TestTraceWrapper(t *testing.T) {
@@ -50,3 +51,101 @@ func TestTraceWrapper(t *testing.T) {
 		}
 	}
 }
+
+func TestAdminUI(t *testing.T) {
+	test := NewRouteTest(t)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/admin/", nil, nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	test.GlobalConfig.Admin.Enabled = true
+	recorder = test.TestEndpoint(http.MethodGet, "/admin/", nil, nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "GoCommerce Admin")
+}
+
+func TestMigrations(t *testing.T) {
+	test := NewRouteTest(t)
+	applied, err := models.AppliedMigrations(test.DB)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(models.Migrations))
+
+	ran, err := models.Migrate(test.DB)
+	require.NoError(t, err)
+	assert.Empty(t, ran)
+
+	rolledBack, err := models.MigrateDown(test.DB, len(models.Migrations))
+	require.NoError(t, err)
+	assert.Len(t, rolledBack, len(models.Migrations))
+	assert.False(t, test.DB.HasTable(&models.Order{}))
+
+	ran, err = models.Migrate(test.DB)
+	require.NoError(t, err)
+	assert.Len(t, ran, len(models.Migrations))
+	assert.True(t, test.DB.HasTable(&models.Order{}))
+}
+
+func TestAddressSnapshotMigration(t *testing.T) {
+	test := NewRouteTest(t)
+	addressID := test.Data.testAddress.ID
+	steps := 0
+	for i, m := range models.Migrations {
+		if m.Name == "snapshot order addresses" {
+			steps = len(models.Migrations) - i
+		}
+	}
+	require.NotZero(t, steps)
+
+	// the orders of the test data share an address with the address book
+	rolledBack, err := models.MigrateDown(test.DB, steps)
+	require.NoError(t, err)
+	require.Len(t, rolledBack, steps)
+	_, err = models.Migrate(test.DB)
+	require.NoError(t, err)
+
+	first, second := &models.Order{}, &models.Order{}
+	require.NoError(t, test.DB.First(first, "id = ?", test.Data.firstOrder.ID).Error)
+	require.NoError(t, test.DB.First(second, "id = ?", test.Data.secondOrder.ID).Error)
+	assert.NotEqual(t, addressID, first.ShippingAddressID)
+	assert.Equal(t, first.ShippingAddressID, first.BillingAddressID)
+	assert.NotEqual(t, first.ShippingAddressID, second.ShippingAddressID, "every order gets its own snapshot")
+	snapshot := &models.Address{}
+	require.NoError(t, test.DB.First(snapshot, "id = ?", first.ShippingAddressID).Error)
+	assert.True(t, snapshot.Snapshot)
+	assert.Equal(t, addressID, snapshot.SourceID)
+	assert.Equal(t, test.Data.testAddress.Address1, snapshot.Address1)
+	assert.Equal(t, test.Data.testUser.ID, snapshot.UserID)
+
+	// a snapshot taken at checkout after the migration
+	checkout := &models.Address{AddressRequest: test.Data.testAddress.AddressRequest, ID: "checkout-snapshot", UserID: test.Data.testUser.ID, Snapshot: true, SourceID: addressID}
+	require.NoError(t, test.DB.Create(checkout).Error)
+	require.NoError(t, test.DB.Model(second).UpdateColumn("billing_address_id", checkout.ID).Error)
+
+	_, err = models.MigrateDown(test.DB, steps)
+	require.NoError(t, err)
+	require.NoError(t, test.DB.First(first, "id = ?", test.Data.firstOrder.ID).Error)
+	assert.Equal(t, addressID, first.ShippingAddressID)
+	assert.Equal(t, addressID, first.BillingAddressID)
+	assert.True(t, test.DB.First(&models.Address{}, "id = ?", snapshot.ID).RecordNotFound())
+	require.NoError(t, test.DB.First(second, "id = ?", test.Data.secondOrder.ID).Error)
+	assert.Equal(t, checkout.ID, second.BillingAddressID, "snapshots taken at checkout are kept")
+	assert.False(t, test.DB.First(&models.Address{}, "id = ?", checkout.ID).RecordNotFound())
+}
+
+func TestDialect(t *testing.T) {
+	for driver, expected := range map[string]string{
+		"sqlite3":          "sqlite3",
+		"mysql":            "mysql",
+		"postgres":         "postgres",
+		"cloudsqlpostgres": "postgres",
+	} {
+		dialect, err := models.Dialect(&conf.DBConfiguration{Driver: driver})
+		require.NoError(t, err)
+		assert.Equal(t, expected, dialect)
+	}
+
+	_, err := models.Dialect(&conf.DBConfiguration{Driver: "mssql"})
+	assert.Error(t, err)
+	_, err = models.Dialect(&conf.DBConfiguration{Driver: "postgres", Dialect: "oracle"})
+	assert.Error(t, err)
+}
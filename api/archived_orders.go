@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// Orders that were moved to the archive by `gocommerce archive` are only
+// returned when archived=true is given. Archived orders are stored as JSON, so
+// they can only be filtered by email, user and date.
+
+func (a *API) archivedOrderList(w http.ResponseWriter, r *http.Request, userID string) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	params := r.URL.Query()
+
+	query := a.readDB(r).Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	if userID != "all" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if email := params.Get("email"); email != "" {
+		query = addEmailFilter(query, query.NewScope(models.ArchivedOrder{}).QuotedTableName(), email)
+	}
+	query, err := parseTimeQueryParams(query, params)
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.ArchivedOrder{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+	archives := []models.ArchivedOrder{}
+	if result := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&archives); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	orders := make([]*models.Order, len(archives))
+	for i, archive := range archives {
+		orders[i] = archive.Order
+	}
+	log.WithField("order_count", len(orders)).Debugf("Successfully retrieved %d archived orders", len(orders))
+	return sendJSON(w, http.StatusOK, orders)
+}
+
+func (a *API) archivedOrderView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+
+	archive := &models.ArchivedOrder{}
+	if result := a.readDB(r).First(archive, "id = ? AND instance_id = ?", id, gcontext.GetInstanceID(ctx)); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	if !hasOrderAccess(ctx, archive.Order) {
+		return unauthorizedError("You don't have access to this order")
+	}
+	return sendJSON(w, http.StatusOK, archive.Order)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestArchivedOrders(t *testing.T) {
+	test := NewRouteTest(t)
+	old := time.Now().AddDate(-4, 0, 0)
+	require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("created_at", old).Error)
+	link := &models.ActionLink{ID: "archived-link", OrderID: test.Data.firstOrder.ID, Action: models.RefundAction, ExpiresAt: time.Now()}
+	require.NoError(t, test.DB.Create(link).Error)
+
+	archived, err := models.ArchiveOrders(test.DB, time.Now().AddDate(-3, 0, 0), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, archived)
+
+	var count int
+	require.NoError(t, test.DB.Model(&models.LineItem{}).Where("order_id = ?", test.Data.firstOrder.ID).Count(&count).Error)
+	assert.Zero(t, count)
+	require.NoError(t, test.DB.Model(&models.ActionLink{}).Where("order_id = ?", test.Data.firstOrder.ID).Count(&count).Error)
+	assert.Zero(t, count, "the rows of the order are archived with it")
+
+	t.Run("NotInList", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders", nil, test.Data.testUserToken)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+	})
+	t.Run("List", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?archived=true", nil, test.Data.testUserToken)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+		assert.Equal(t, test.Data.firstOrder.Total, orders[0].Total)
+		require.Len(t, orders[0].LineItems, 1)
+		assert.Equal(t, test.Data.firstLineItem.Sku, orders[0].LineItems[0].Sku)
+	})
+	t.Run("EmailFilter", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?archived=true&email=nobody", nil, test.Data.testUserToken)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		assert.Len(t, orders, 0)
+	})
+	t.Run("View", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID, nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"?archived=true", nil, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, test.Data.firstOrder.ID, order.ID)
+		assert.Equal(t, test.Data.firstOrder.Email, order.Email)
+	})
+	t.Run("ViewAsStranger", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"?archived=true", nil, testToken("stranger", "stranger@example.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("Restore", func(t *testing.T) {
+		restored, err := models.RestoreArchivedOrder(test.DB, test.Data.firstOrder.ID)
+		require.NoError(t, err)
+		assert.Equal(t, test.Data.firstOrder.ID, restored.ID)
+
+		order := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, test.Data.firstOrder.NormalizedEmail, order.NormalizedEmail, "columns left out of the JSON are restored")
+		assert.Equal(t, test.Data.firstOrder.Total, order.Total)
+		assert.Equal(t, old.Unix(), order.CreatedAt.Unix())
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, test.Data.firstLineItem.Sku, order.LineItems[0].Sku)
+		require.Len(t, order.Transactions, 1)
+		assert.Equal(t, test.Data.firstOrder.ShippingAddress.Address1, order.ShippingAddress.Address1)
+		require.NoError(t, test.DB.First(&models.ActionLink{}, "id = ?", link.ID).Error)
+
+		require.NoError(t, test.DB.Model(&models.ArchivedOrder{}).Where("id = ?", order.ID).Count(&count).Error)
+		assert.Zero(t, count)
+	})
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"net/http"
+	"strings"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/netlify/gocommerce/claims"
@@ -11,6 +12,22 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Permission scopes that roles can be granted with the roles of the JWT
+// configuration.
+const (
+	ordersReadScope     = "orders:read"
+	ordersWriteScope    = "orders:write"
+	paymentsReadScope   = "payments:read"
+	paymentsRefundScope = "payments:refund"
+	usersReadScope      = "users:read"
+	usersWriteScope     = "users:write"
+	inventoryReadScope  = "inventory:read"
+	inventoryWriteScope = "inventory:write"
+	giftCardsReadScope  = "gift_cards:read"
+	giftCardsWriteScope = "gift_cards:write"
+	reportsReadScope    = "reports:read"
+)
+
 func extractBearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
@@ -53,6 +70,7 @@ func (a *API) withToken(w http.ResponseWriter, r *http.Request) (context.Context
 	}
 
 	isAdmin := false
+	scopes := []string{}
 	roles, ok := claims.AppMetaData["roles"]
 	if ok {
 		roleStrings, _ := roles.([]interface{})
@@ -60,8 +78,8 @@ func (a *API) withToken(w http.ResponseWriter, r *http.Request) (context.Context
 			role, _ := data.(string)
 			if role == config.JWT.AdminGroupName {
 				isAdmin = true
-				break
 			}
+			scopes = append(scopes, strings.Fields(config.JWT.Roles[role])...)
 		}
 	}
 
@@ -70,9 +88,15 @@ func (a *API) withToken(w http.ResponseWriter, r *http.Request) (context.Context
 		"claims_email": claims.Email,
 		"roles":        roles,
 		"is_admin":     isAdmin,
+		"scopes":       scopes,
 	}).Debug("successfully parsed claims")
 
+	if config.Users.SyncEmails {
+		a.syncUserEmail(ctx, log, &claims)
+	}
+
 	ctx = gcontext.WithAdminFlag(ctx, isAdmin)
+	ctx = gcontext.WithScopes(ctx, scopes)
 	ctx = gcontext.WithToken(ctx, token)
 	return ctx, nil
 }
@@ -100,12 +124,31 @@ func adminRequired(w http.ResponseWriter, r *http.Request) (context.Context, err
 	return ctx, nil
 }
 
+// scopeRequired only lets users through that have a permission scope, like
+// admins.
+func scopeRequired(scope string) middlewareHandler {
+	return func(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+		ctx := r.Context()
+		claims := gcontext.GetClaims(ctx)
+		if claims == nil || !gcontext.HasScope(ctx, scope) {
+			return nil, unauthorizedError("The %v permission is required", scope)
+		}
+
+		logEntrySetField(r, "admin_id", claims.Subject)
+		return ctx, nil
+	}
+}
+
 func ensureUserAccess(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx := r.Context()
 
-	// ensure userID matches authenticated user OR is admin
+	// ensure userID matches authenticated user OR is allowed to access users
 	claims := gcontext.GetClaims(ctx)
-	if gcontext.IsAdmin(ctx) {
+	scope := usersReadScope
+	if r.Method != http.MethodGet {
+		scope = usersWriteScope
+	}
+	if gcontext.HasScope(ctx, scope) {
 		logEntrySetField(r, "admin_id", claims.Subject)
 		return ctx, nil
 	}
@@ -118,11 +161,26 @@ func ensureUserAccess(w http.ResponseWriter, r *http.Request) (context.Context,
 	return ctx, nil
 }
 
+// actorID returns the ID of the user making a request, or an empty string for
+// anonymous requests.
+func actorID(ctx context.Context) string {
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		return claims.Subject
+	}
+	return ""
+}
+
+// hasOrderAccess tells whether a request may see an order: its instance must
+// be the one of the order, and anonymous orders are open to anyone with their
+// ID.
 func hasOrderAccess(ctx context.Context, order *models.Order) bool {
+	if order.InstanceID != gcontext.GetInstanceID(ctx) {
+		return false
+	}
 	if order.UserID == "" {
 		return true
 	}
-	if gcontext.IsAdmin(ctx) {
+	if gcontext.HasScope(ctx, ordersReadScope) {
 		return true
 	}
 
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestScopedRoles(t *testing.T) {
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.JWT.Roles = map[string]string{
+			"support": "orders:read users:read",
+			"finance": "orders:read payments:read payments:refund",
+		}
+		return test
+	}
+	support := testRoleToken("support-user", "support@example.com", "support")
+	finance := testRoleToken("finance-user", "finance@example.com", "finance")
+
+	t.Run("ViewOrders", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID, nil, support)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, test.Data.firstOrder.ID, order.ID)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/users/all/orders", nil, support)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		assert.Len(t, orders, 2)
+	})
+	t.Run("UpdateOrder", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/"+test.Data.firstOrder.ID, strings.NewReader(`{"email": "other@example.com"}`), support)
+		validateError(t, http.StatusUnauthorized, recorder, "orders:write")
+	})
+	t.Run("Refund", func(t *testing.T) {
+		test := setup(t)
+		url := "/orders/" + test.Data.firstOrder.ID + "/transactions/" + test.Data.firstTransaction.ID + "/refund"
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"amount": 10}`), support)
+		validateError(t, http.StatusUnauthorized, recorder, "payments:refund")
+
+		recorder = test.TestEndpoint(http.MethodGet, "/payments", nil, finance)
+		trans := []models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		assert.Len(t, trans, 2)
+	})
+	t.Run("Users", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID, nil, support)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID, nil, support)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID, nil, finance)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("UnknownRole", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payments", nil, testRoleToken("someone", "someone@example.com", "marketing"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
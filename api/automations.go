@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// automationsJob is the payload of the jobs that run the automations of the
+// site settings on an order.
+type automationsJob struct {
+	OrderID string `json:"order_id"`
+}
+
+// automationMailJob is the payload of the jobs that send the mails of
+// automations.
+type automationMailJob struct {
+	OrderID  string `json:"order_id"`
+	To       string `json:"to,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Template string `json:"template,omitempty"`
+}
+
+// enqueueAutomations queues a run of the automations of the site settings on
+// an order that changed. The change is saved already, so failing to queue
+// the run is only logged.
+func (a *API) enqueueAutomations(ctx context.Context, log logrus.FieldLogger, order *models.Order) {
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Not running automations, the site settings can't be loaded")
+		return
+	}
+	if len(settings.Automations) == 0 {
+		return
+	}
+	if _, err := models.EnqueueJob(a.db, order.InstanceID, models.OrderAutomationsJob, &automationsJob{OrderID: order.ID}); err != nil {
+		log.WithError(err).Error("Error queueing automations")
+	}
+}
+
+// runOrderAutomations takes the actions of the automations that match an
+// order and didn't run on it yet. Actions can make more automations match,
+// like by adding a tag, so the automations are checked again until none
+// runs.
+func (a *API) runOrderAutomations(ctx context.Context, db *gorm.DB, job *models.Job) error {
+	payload := &automationsJob{}
+	if err := job.DecodePayload(payload); err != nil {
+		return err
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	order := &models.Order{}
+	// the lock keeps concurrent automations and admin edits from losing tags
+	if rsp := orderQuery(models.ForUpdate(tx)).First(order, "id = ?", payload.OrderID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return nil
+		}
+		return rsp.Error
+	}
+	events := []models.Event{}
+	if rsp := tx.Where("order_id = ? AND type = ?", order.ID, models.EventAutomated).Find(&events); rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+	ran := map[string]bool{}
+	for _, event := range events {
+		ran[event.Changes] = true
+	}
+
+	log := logrus.WithFields(logrus.Fields{"component": "automations", "order_id": order.ID})
+	changed := false
+	for {
+		matched := false
+		for _, automation := range settings.Automations {
+			if automation.Name == "" || ran[automation.Name] || !automationMatches(automation.When, order) {
+				continue
+			}
+			if err := takeAutomationActions(ctx, tx, log, order, automation); err != nil {
+				tx.Rollback()
+				return err
+			}
+			models.LogEvent(tx, "", "", order.ID, models.EventAutomated, []string{automation.Name})
+			log.WithField("automation", automation.Name).Info("Ran automation")
+			ran[automation.Name] = true
+			matched = true
+		}
+		if !matched {
+			break
+		}
+		changed = true
+	}
+	if !changed {
+		tx.Rollback()
+		return nil
+	}
+
+	if err := order.SaveTagsAndHold(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// automationMatches tells whether an order meets all the conditions of an
+// automation.
+func automationMatches(when calculator.AutomationCondition, order *models.Order) bool {
+	if when.PaymentState != "" && when.PaymentState != order.PaymentState {
+		return false
+	}
+	if when.FulfillmentState != "" && when.FulfillmentState != order.FulfillmentState {
+		return false
+	}
+	if when.Tag != "" && !order.HasTag(when.Tag) {
+		return false
+	}
+	if when.TotalOver != nil {
+		if when.Currency != "" && when.Currency != order.Currency {
+			return false
+		}
+		if order.Total <= *when.TotalOver {
+			return false
+		}
+	}
+	return true
+}
+
+// takeAutomationActions applies the actions of an automation to an order,
+// which is saved by the caller. Mails and webhooks are queued, so they are
+// only sent when the order is saved.
+func takeAutomationActions(ctx context.Context, tx *gorm.DB, log logrus.FieldLogger, order *models.Order, automation *calculator.Automation) error {
+	for _, action := range automation.Actions {
+		switch action.Type {
+		case calculator.AddTagAction:
+			if action.Tag != "" {
+				order.AddTag(action.Tag)
+			}
+		case calculator.HoldAction:
+			order.OnHold = true
+			order.HoldReason = action.Reason
+			if order.HoldReason == "" {
+				order.HoldReason = automation.Name
+			}
+		case calculator.EmailAction:
+			mail := &automationMailJob{OrderID: order.ID, To: action.To, Subject: action.Subject, Template: action.Template}
+			if _, err := models.EnqueueJob(tx, order.InstanceID, models.AutomationMailJob, mail); err != nil {
+				return err
+			}
+		case calculator.WebhookAction:
+			if order.SuppressNotifications {
+				log.WithField("automation", automation.Name).Info("Not calling the webhook of the automation, the order suppresses notifications")
+				continue
+			}
+			hook := newHook(ctx, log, order.InstanceID, models.OrderAutomatedHook, action.URL, order.UserID, order)
+			if rsp := tx.Save(hook); rsp.Error != nil {
+				return rsp.Error
+			}
+		default:
+			log.WithField("automation", automation.Name).Warnf("Skipping unknown automation action %v", action.Type)
+		}
+	}
+	return nil
+}
+
+// sendAutomationMail sends a mail of an automation to the customer, the
+// admin or another address.
+func sendAutomationMail(a *API, ctx context.Context, db *gorm.DB, job *models.Job) error {
+	payload := &automationMailJob{}
+	if err := job.DecodePayload(payload); err != nil {
+		return err
+	}
+	order := &models.Order{}
+	if rsp := orderQuery(db).First(order, "id = ?", payload.OrderID); rsp.Error != nil {
+		return rsp.Error
+	}
+	log := logrus.WithFields(logrus.Fields{"job_id": job.ID, "job_type": job.Type})
+	if order.SuppressNotifications {
+		log.WithField("order_id", order.ID).Info("Not sending the mail, the order suppresses notifications")
+		return nil
+	}
+
+	to := payload.To
+	switch to {
+	case "", "customer":
+		to = order.Email
+	case "admin":
+		to = gcontext.GetConfig(ctx).Mailer.AdminEmail
+	}
+	if to == "" {
+		return fmt.Errorf("No email address to send the mail of order %v to", order.ID)
+	}
+	return a.brandedMailer(ctx, log).OrderMail(order, to, payload.Subject, payload.Template)
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderAutomations(t *testing.T) {
+	log := logrus.WithField("test", t.Name())
+	sent := []string{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gocommerce/settings.json":
+			fmt.Fprintf(w, `{"automations": [
+				{"name": "rush", "when": {"tag": "rush"}, "actions": [
+					{"type": "add_tag", "tag": "priority"},
+					{"type": "email", "to": "admin", "subject": "Rush order"},
+					{"type": "webhook", "url": "%s/hook"}
+				]},
+				{"name": "check-priority", "when": {"tag": "priority", "total_over": 10, "currency": "USD"}, "actions": [
+					{"type": "hold", "reason": "Check the address"}
+				]},
+				{"name": "big", "when": {"total_over": 100000}, "actions": [
+					{"type": "add_tag", "tag": "big"}
+				]}
+			]}`, server.URL)
+		default:
+			require.NoError(t, r.ParseForm())
+			sent = append(sent, r.PostForm.Get("to")+": "+r.PostForm.Get("subject"))
+			fmt.Fprint(w, `{"id":"<msg@example.com>","message":"Queued. Thank you."}`)
+		}
+	}))
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	api := jobTestAPI(t, test, server.URL, "automations.example.com")
+	token := testAdminToken("admin", "")
+	url := "/orders/" + test.Data.firstOrder.ID
+
+	recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"tags": ["rush"]}`), token)
+	order := &models.Order{}
+	extractPayload(t, http.StatusOK, recorder, order)
+	assert.Equal(t, []string{"rush"}, order.Tags)
+
+	assert.Equal(t, 1, api.runJobs(test.DB, "worker", log), "the automations run in the background")
+	assert.Equal(t, 1, api.runJobs(test.DB, "worker", log), "the mail is queued by the automation")
+	assert.Equal(t, []string{"shop@example.com: Rush order"}, sent)
+
+	require.NoError(t, test.DB.First(order, "id = ?", order.ID).Error)
+	assert.Equal(t, []string{"rush", "priority"}, order.Tags)
+	assert.True(t, order.OnHold)
+	assert.Equal(t, "Check the address", order.HoldReason)
+
+	hook := &models.Hook{}
+	require.NoError(t, test.DB.First(hook, "type = ?", models.OrderAutomatedHook).Error)
+	assert.Equal(t, server.URL+"/hook", hook.URL)
+
+	events := []models.Event{}
+	require.NoError(t, test.DB.Order("id asc").Find(&events, "order_id = ? AND type = ?", order.ID, models.EventAutomated).Error)
+	require.Len(t, events, 2)
+	assert.Equal(t, "rush", events[0].Changes)
+	assert.Equal(t, "check-priority", events[1].Changes)
+
+	t.Run("RunOnce", func(t *testing.T) {
+		_, err := models.EnqueueJob(test.DB, "", models.OrderAutomationsJob, &automationsJob{OrderID: order.ID})
+		require.NoError(t, err)
+		assert.Equal(t, 1, api.runJobs(test.DB, "worker", log))
+		assert.Equal(t, 0, api.runJobs(test.DB, "worker", log), "no mail is queued again")
+		assert.Len(t, sent, 1)
+	})
+
+	t.Run("Hold", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "Can't ship an order that is on hold: Check the address")
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"on_hold": false, "fulfillment_state": "shipped"}`), token)
+		shipped := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, shipped)
+		assert.False(t, shipped.OnHold)
+		assert.Equal(t, models.ShippedState, shipped.FulfillmentState)
+	})
+}
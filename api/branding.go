@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/invoice"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+// siteBranding returns the branding of the site settings with the logo as an
+// absolute URL, or nil when the site has none. Invalid branding is left out,
+// so a typo in the settings doesn't break receipts and mails.
+func siteBranding(config *conf.Configuration, settings *calculator.Settings, log logrus.FieldLogger) *calculator.Branding {
+	if settings == nil || settings.Branding == nil {
+		return nil
+	}
+	if invalid := settings.Branding.Validate(); invalid != nil {
+		log.WithField("invalid", invalid).Warn("Ignoring the invalid branding of the site settings")
+		return nil
+	}
+	return resolveBranding(config, settings.Branding)
+}
+
+// resolveBranding returns a copy of the branding with a logo on the site
+// turned into an absolute URL, as documents and mails are viewed elsewhere.
+func resolveBranding(config *conf.Configuration, branding *calculator.Branding) *calculator.Branding {
+	resolved := *branding
+	if strings.HasPrefix(resolved.LogoURL, "/") {
+		resolved.LogoURL = strings.TrimSuffix(config.SiteURL, "/") + resolved.LogoURL
+	}
+	return &resolved
+}
+
+// brandedMailer returns the mailer of the instance with the branding of the
+// site. Mails are still sent without it when the settings can't be loaded.
+func (a *API) brandedMailer(ctx context.Context, log logrus.FieldLogger) mailer.Mailer {
+	m := gcontext.GetMailer(ctx)
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Sending mail without branding, the site settings can't be loaded")
+		return m
+	}
+	return m.WithBranding(siteBranding(gcontext.GetConfig(ctx), settings, log))
+}
+
+// BrandingPreview renders a sample receipt with a branding, to try it out
+// before publishing it in the site settings. The body is the branding, and
+// without one the branding of the site is used. With document=email the
+// order confirmation mail is rendered instead, and with format=pdf the PDF
+// invoice.
+func (a *API) BrandingPreview(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	params := r.URL.Query()
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	branding := &calculator.Branding{}
+	if err := json.NewDecoder(r.Body).Decode(branding); err == io.EOF {
+		if settings.Branding != nil {
+			branding = settings.Branding
+		}
+	} else if err != nil {
+		return badRequestError("Could not read branding: %v", err)
+	}
+	if invalid := branding.Validate(); invalid != nil {
+		return unprocessableEntityError("Invalid branding").WithData(invalid)
+	}
+	branding = resolveBranding(config, branding)
+
+	order := sampleOrder(params.Get("locale"))
+	switch params.Get("document") {
+	case "", "receipt":
+	case "email":
+		tr := models.NewTransaction(order)
+		tr.Order = order
+		html, err := gcontext.GetMailer(ctx).WithBranding(branding).OrderConfirmationMailBody(tr, "")
+		if err != nil {
+			return internalServerError("Error rendering mail").WithInternalError(err)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(html))
+		return nil
+	default:
+		return badRequestError("Unknown document %q, only receipt and email are supported", params.Get("document"))
+	}
+
+	inv, err := invoice.New(order, settings)
+	if err != nil {
+		return internalServerError("Error creating invoice").WithInternalError(err)
+	}
+	inv.Branding = branding
+	if params.Get("format") == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.WriteHeader(http.StatusOK)
+		w.Write(invoice.PDF(inv))
+		return nil
+	}
+	html, err := invoice.HTML(inv, "")
+	if err != nil {
+		return internalServerError("Error creating invoice").WithInternalError(err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(html)
+	return nil
+}
+
+// sampleOrder is a paid order to preview documents with.
+func sampleOrder(locale string) *models.Order {
+	order := models.NewOrder("", "", "customer@example.com", "USD")
+	order.Locale = locale
+	order.InvoiceNumber = 1001
+	order.CreatedAt = time.Now()
+	order.PaymentState = models.PaidState
+	order.BillingAddress = models.Address{AddressRequest: models.AddressRequest{
+		Name: "Jane Doe", Address1: "610 22nd Street", City: "San Francisco", State: "CA", Zip: "94107", Country: "USA",
+	}}
+	order.ShippingAddress = order.BillingAddress
+	order.LineItems = []*models.LineItem{
+		{Sku: "sample-book", Title: "Sample book", Type: "Book", Price: 1999, Quantity: 2},
+		{Sku: "sample-poster", Title: "Sample poster", Type: "Poster", Price: 1500, Quantity: 1},
+	}
+	order.CalculateTotal(&calculator.Settings{}, nil)
+	return order
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrandingPreview(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gocommerce/settings.json":
+			fmt.Fprint(w, `{"branding": {"logo_url": "/logo.png", "primary_color": "#336699", "support_email": "help@example.com"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	token := testAdminToken("admin", "")
+
+	t.Run("SiteBranding", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/settings/branding/preview", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+		body := recorder.Body.String()
+		assert.Contains(t, body, `src="`+server.URL+`/logo.png"`)
+		assert.Contains(t, body, "#336699")
+		assert.Contains(t, body, "help@example.com")
+		assert.Contains(t, body, "Sample book")
+	})
+
+	t.Run("RequestBranding", func(t *testing.T) {
+		body := strings.NewReader(`{"primary_color": "#aa0000", "legal_text": "Example Inc."}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/settings/branding/preview", body, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "#aa0000")
+		assert.Contains(t, recorder.Body.String(), "Example Inc.")
+		assert.NotContains(t, recorder.Body.String(), "logo.png")
+	})
+
+	t.Run("PDF", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/settings/branding/preview?format=pdf", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "application/pdf", recorder.Header().Get("Content-Type"))
+		assert.True(t, strings.HasPrefix(recorder.Body.String(), "%PDF-"))
+	})
+
+	t.Run("Email", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/settings/branding/preview?document=email", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+	})
+
+	t.Run("UnknownDocument", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/settings/branding/preview?document=packing-slip", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, `Unknown document "packing-slip", only receipt and email are supported`)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		body := strings.NewReader(`{"primary_color": "red", "support_url": "ftp://example.com"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/settings/branding/preview", body, token)
+		assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+		payload := &HTTPError{}
+		extractPayload(t, http.StatusUnprocessableEntity, recorder, payload)
+		assert.Equal(t, "Invalid branding", payload.Message)
+		assert.Equal(t, map[string]interface{}{
+			"primary_color": "must be a hex color like #1a73e8",
+			"support_url":   "must be an http or https URL",
+		}, payload.Data)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/settings/branding/preview", nil, testToken("magical-unicorn", ""))
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
+	"github.com/mattes/vat"
+	"github.com/pkg/errors"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/breaker"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// configureBreakers sets the settings of the circuit breakers of the external
+// services from the configuration.
+func configureBreakers(config *conf.GlobalConfiguration) {
+	breaker.Configure(breaker.Payments, breakerSettings(config.CircuitBreakers.Payments, isPaymentFailure))
+	breaker.Configure(breaker.Site, breakerSettings(config.CircuitBreakers.Site, nil))
+	breaker.Configure(breaker.Mail, breakerSettings(config.CircuitBreakers.Mail, nil))
+	breaker.Configure(breaker.VAT, breakerSettings(config.CircuitBreakers.VAT, isVATFailure))
+}
+
+func breakerSettings(config conf.BreakerConfiguration, isFailure func(error) bool) breaker.Settings {
+	return breaker.Settings{
+		FailureThreshold: config.FailureThreshold,
+		OpenTimeout:      time.Duration(config.OpenTimeout) * time.Second,
+		SlowCall:         time.Duration(config.SlowCall) * time.Millisecond,
+		IsFailure:        isFailure,
+	}
+}
+
+// isPaymentFailure tells apart payment providers failing from payments being
+// rejected, like declined cards, which say nothing about the provider.
+func isPaymentFailure(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *stripe.Error:
+		return e.HTTPStatusCode == 0 || e.HTTPStatusCode >= http.StatusInternalServerError
+	case *paypalsdk.ErrorResponse:
+		return e.Response == nil || e.Response.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// isVATFailure doesn't count malformed VAT numbers as failures of VIES.
+func isVATFailure(err error) bool {
+	return err != vat.ErrVATnumberNotValid
+}
+
+// siteOrigin returns the scheme and host of a URL, which the breakers of sites
+// are keyed by.
+func siteOrigin(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// BreakerList returns the state and metrics of the circuit breakers of the
+// external services. In multi instance mode, only the breaker of the site of
+// the instance is included.
+func (a *API) BreakerList(w http.ResponseWriter, r *http.Request) error {
+	ownSite := breaker.Site + ":" + siteOrigin(gcontext.GetConfig(r.Context()).SiteURL)
+	stats := []breaker.Stats{}
+	for _, s := range breaker.All() {
+		if a.config.MultiInstanceMode && strings.HasPrefix(s.Name, breaker.Site+":") && s.Name != ownSite {
+			continue
+		}
+		stats = append(stats, s)
+	}
+	return sendJSON(w, http.StatusOK, stats)
+}
+
+// withBreaker suspends the calls to a payment provider while it is failing,
+// and records their outcomes in the payment metrics.
+func withBreaker(provider payments.Provider) payments.Provider {
+	p := &breakerProvider{Provider: provider, breaker: breaker.Get(breaker.Payments, provider.Name())}
+	tp, transfers := provider.(payments.TransferProvider)
+	sp, subscriptions := provider.(payments.SubscriptionProvider)
+	switch {
+	case transfers && subscriptions:
+		return &breakerTransferSubscriptionProvider{&breakerTransferProvider{breakerProvider: p, transfers: tp}, &breakerSubscriptions{breaker: p.breaker, name: provider.Name(), subscriptions: sp}}
+	case transfers:
+		return &breakerTransferProvider{breakerProvider: p, transfers: tp}
+	case subscriptions:
+		return &breakerSubscriptionProvider{p, &breakerSubscriptions{breaker: p.breaker, name: provider.Name(), subscriptions: sp}}
+	}
+	return p
+}
+
+type breakerProvider struct {
+	payments.Provider
+	breaker *breaker.Breaker
+}
+
+func (p *breakerProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
+	charge, err := p.Provider.NewCharger(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return func(amount uint64, currency string) (id string, err error) {
+		err = callProvider(ctx, p.breaker, p.Name(), "charge", func() error {
+			id, err = charge(amount, currency)
+			return err
+		})
+		return id, err
+	}, nil
+}
+
+func (p *breakerProvider) NewRefunder(ctx context.Context, r *http.Request) (payments.Refunder, error) {
+	refund, err := p.Provider.NewRefunder(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return func(transactionID string, amount uint64, currency string) (id string, err error) {
+		err = callProvider(ctx, p.breaker, p.Name(), "refund", func() error {
+			id, err = refund(transactionID, amount, currency)
+			return err
+		})
+		return id, err
+	}, nil
+}
+
+func (p *breakerProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
+	preauthorize, err := p.Provider.NewPreauthorizer(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return func(amount uint64, currency string, description string) (result *payments.PreauthorizationResult, err error) {
+		err = callProvider(ctx, p.breaker, p.Name(), "preauthorize", func() error {
+			result, err = preauthorize(amount, currency, description)
+			return err
+		})
+		return result, err
+	}, nil
+}
+
+// Ping checks the provider without going through its breaker, so health
+// checks don't count as payment calls.
+func (p *breakerProvider) Ping(ctx context.Context) error {
+	checker, ok := p.Provider.(payments.HealthChecker)
+	if !ok {
+		return errNoHealthCheck
+	}
+	return checker.Ping(ctx)
+}
+
+type breakerTransferProvider struct {
+	*breakerProvider
+	transfers payments.TransferProvider
+}
+
+func (p *breakerTransferProvider) NewTransferrer(ctx context.Context, r *http.Request) (payments.Transferrer, error) {
+	transfer, err := p.transfers.NewTransferrer(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return func(chargeID string, destination string, amount uint64, currency string) (id string, err error) {
+		err = callProvider(ctx, p.breaker, p.Name(), "transfer", func() error {
+			id, err = transfer(chargeID, destination, amount, currency)
+			return err
+		})
+		return id, err
+	}, nil
+}
+
+func (p *breakerTransferProvider) NewTransferReverser(ctx context.Context, r *http.Request) (payments.TransferReverser, error) {
+	reverse, err := p.transfers.NewTransferReverser(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return func(transferID string, amount uint64) (id string, err error) {
+		err = callProvider(ctx, p.breaker, p.Name(), "reverse_transfer", func() error {
+			id, err = reverse(transferID, amount)
+			return err
+		})
+		return id, err
+	}, nil
+}
+
+type breakerSubscriptionProvider struct {
+	*breakerProvider
+	*breakerSubscriptions
+}
+
+type breakerTransferSubscriptionProvider struct {
+	*breakerTransferProvider
+	*breakerSubscriptions
+}
+
+// breakerSubscriptions adds the subscription methods of a provider to its
+// breaker.
+type breakerSubscriptions struct {
+	breaker       *breaker.Breaker
+	name          string
+	subscriptions payments.SubscriptionProvider
+}
+
+func (p *breakerSubscriptions) NewSubscriber(ctx context.Context, r *http.Request) (payments.Subscriber, error) {
+	subscribe, err := p.subscriptions.NewSubscriber(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return func(plan string, quantity uint64, email string) (result *payments.SubscriptionResult, err error) {
+		err = callProvider(ctx, p.breaker, p.name, "subscribe", func() error {
+			result, err = subscribe(plan, quantity, email)
+			return err
+		})
+		return result, err
+	}, nil
+}
+
+func (p *breakerSubscriptions) NewSubscriptionCanceler(ctx context.Context, r *http.Request) (payments.SubscriptionCanceler, error) {
+	cancel, err := p.subscriptions.NewSubscriptionCanceler(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return func(subscriptionID string, atPeriodEnd bool) (result *payments.SubscriptionResult, err error) {
+		err = callProvider(ctx, p.breaker, p.name, "cancel_subscription", func() error {
+			result, err = cancel(subscriptionID, atPeriodEnd)
+			return err
+		})
+		return result, err
+	}, nil
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/breaker"
+	"github.com/netlify/gocommerce/conf"
+)
+
+func TestIsPaymentFailure(t *testing.T) {
+	assert.False(t, isPaymentFailure(&stripe.Error{Type: stripe.ErrorTypeCard, HTTPStatusCode: http.StatusPaymentRequired}))
+	assert.True(t, isPaymentFailure(&stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: http.StatusBadGateway}))
+	assert.True(t, isPaymentFailure(errors.New("connection refused")))
+}
+
+func TestSiteBreaker(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.GlobalConfig.CircuitBreakers.Site.FailureThreshold = 2
+	defer configureBreakers(&conf.GlobalConfiguration{})
+
+	createOrder := func() *httptest.ResponseRecorder {
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+	}
+	assert.Equal(t, http.StatusInternalServerError, createOrder().Code)
+	assert.Equal(t, http.StatusInternalServerError, createOrder().Code)
+	validateError(t, http.StatusServiceUnavailable, createOrder())
+	assert.Equal(t, 2, calls)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/breakers", nil, testAdminToken("admin", "admin@example.com"))
+	stats := []breaker.Stats{}
+	extractPayload(t, http.StatusOK, recorder, &stats)
+	var site *breaker.Stats
+	for i := range stats {
+		if stats[i].Name == breaker.Site+":"+server.URL {
+			site = &stats[i]
+		}
+	}
+	require.NotNil(t, site)
+	assert.Equal(t, breaker.Open, site.State)
+	assert.EqualValues(t, 2, site.Failures)
+	assert.EqualValues(t, 1, site.Rejections)
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/claims"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// BulkRefundParams holds the parameters for refunding a SKU from all paid orders
+// created between from and to (unix timestamps, both optional).
+type BulkRefundParams struct {
+	Sku    string `json:"sku"`
+	From   int64  `json:"from"`
+	To     int64  `json:"to"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// bulkRefundOrder is a planned refund of the line items of one order.
+type bulkRefundOrder struct {
+	order      *models.Order
+	charge     *models.Transaction
+	quantities map[int64]uint64
+	item       *models.BulkRefundItem
+}
+
+// bulkRefundJob is the payload of the jobs that make the refunds of a bulk
+// refund.
+type bulkRefundJob struct {
+	BulkRefundID string `json:"bulk_refund_id"`
+	// ActorID is the admin who started the bulk refund, who the refunds
+	// are logged for.
+	ActorID string `json:"actor_id,omitempty"`
+}
+
+// BulkRefundCreate refunds all the not yet refunded line items with a SKU from
+// the paid orders in a period, e.g. for a product recall. With dry_run the
+// planned refunds are returned without refunding anything. Otherwise the refunds
+// are made by a background job and their results can be followed with
+// BulkRefundView. It is only available to admins.
+func (a *API) BulkRefundCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	params := &BulkRefundParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Sku == "" {
+		return badRequestError("A bulk refund requires a sku")
+	}
+
+	bulk := &models.BulkRefund{
+		InstanceID: gcontext.GetInstanceID(ctx),
+		ID:         uuid.NewRandom().String(),
+		Sku:        params.Sku,
+		Status:     models.PendingState,
+	}
+	if params.From != 0 {
+		from := time.Unix(params.From, 0)
+		bulk.From = &from
+	}
+	if params.To != 0 {
+		to := time.Unix(params.To, 0)
+		bulk.To = &to
+	}
+
+	planned, httpErr := a.planBulkRefund(ctx, bulk)
+	if httpErr != nil {
+		return httpErr
+	}
+	log.WithField("order_count", len(planned)).Debugf("Planned bulk refund of %s", bulk.Sku)
+
+	if params.DryRun {
+		return sendJSON(w, http.StatusOK, bulk)
+	}
+
+	tx := a.db.Begin()
+	if result := tx.Create(bulk); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving bulk refund").WithInternalError(result.Error)
+	}
+	if _, err := models.EnqueueJob(tx, bulk.InstanceID, models.BulkRefundJob, &bulkRefundJob{BulkRefundID: bulk.ID, ActorID: actorID(ctx)}); err != nil {
+		tx.Rollback()
+		return internalServerError("Error queueing bulk refund").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error saving bulk refund").WithInternalError(result.Error)
+	}
+
+	return sendJSON(w, http.StatusAccepted, bulk)
+}
+
+// BulkRefundList lists the bulk refunds of the instance, newest first. It is only
+// available to admins.
+func (a *API) BulkRefundList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	query := a.db.Where("instance_id = ?", instanceID)
+
+	offset, limit, err := paginate(w, r, query.Model(&models.BulkRefund{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	bulks := []models.BulkRefund{}
+	if result := query.Preload("Items").Order("created_at desc").Offset(offset).Limit(limit).Find(&bulks); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, bulks)
+}
+
+// BulkRefundView returns the report of a bulk refund. It is only available to admins.
+func (a *API) BulkRefundView(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	bulkID := chi.URLParam(r, "bulk_refund_id")
+
+	bulk := &models.BulkRefund{}
+	if result := a.db.Preload("Items").Where("instance_id = ?", instanceID).First(bulk, "id = ?", bulkID); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Bulk refund not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, bulk)
+}
+
+// planBulkRefund finds the paid orders with refundable line items for the SKU of
+// the bulk refund and prices their refunds. A report item is added to the bulk
+// refund for each of them.
+func (a *API) planBulkRefund(ctx context.Context, bulk *models.BulkRefund) ([]*bulkRefundOrder, *HTTPError) {
+	orderTable := a.db.NewScope(models.Order{}).QuotedTableName()
+	itemTable := a.db.NewScope(models.LineItem{}).QuotedTableName()
+
+	query := a.db.Model(&models.LineItem{}).
+		Joins("JOIN "+orderTable+" ON "+orderTable+".id = "+itemTable+".order_id").
+		Where(orderTable+".instance_id = ? AND "+orderTable+".payment_state = ? AND "+orderTable+".deleted_at IS NULL", bulk.InstanceID, models.PaidState).
+		Where(itemTable+".sku = ?", bulk.Sku)
+	if bulk.From != nil {
+		query = query.Where(orderTable+".created_at >= ?", bulk.From)
+	}
+	if bulk.To != nil {
+		query = query.Where(orderTable+".created_at <= ?", bulk.To)
+	}
+
+	orderIDs := []string{}
+	if result := query.Pluck("DISTINCT "+itemTable+".order_id", &orderIDs); result.Error != nil {
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	bulk.Items = []*models.BulkRefundItem{}
+	if len(orderIDs) == 0 {
+		return nil, nil
+	}
+
+	orders := []*models.Order{}
+	if result := orderQuery(a.db).Preload("LineItems.PriceItems").Where("id in (?)", orderIDs).Order("created_at asc").Find(&orders); result.Error != nil {
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return nil, internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	planned := []*bulkRefundOrder{}
+	for _, order := range orders {
+		p, httpErr := a.planOrderRefund(ctx, settings, bulk.Sku, order)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		if p == nil {
+			continue
+		}
+		bulk.Items = append(bulk.Items, p.item)
+		planned = append(planned, p)
+	}
+	return planned, nil
+}
+
+// planOrderRefund prices the refund of the line items with a SKU that are left
+// to refund in an order. It returns nil if there is nothing to refund.
+func (a *API) planOrderRefund(ctx context.Context, settings *calculator.Settings, sku string, order *models.Order) (*bulkRefundOrder, *HTTPError) {
+	items := []*refundLineItem{}
+	for _, item := range order.LineItems {
+		if item.Sku == sku && item.Quantity > item.RefundedQuantity {
+			items = append(items, &refundLineItem{ID: item.ID, Quantity: item.Quantity - item.RefundedQuantity})
+		}
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	var charge *models.Transaction
+	var paid uint64
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.PaidState {
+			if charge == nil {
+				charge = t
+			}
+			paid += t.Amount
+		}
+	}
+	if charge == nil || paid <= order.TotalRefunded {
+		return nil, nil
+	}
+
+	refunded, quantities, httpErr := refundedLineItems(order, items)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	amount, err := a.refundedItemsTotal(ctx, settings, order, refunded)
+	if err != nil {
+		return nil, internalServerError("Error pricing the refunded items").WithInternalError(err)
+	}
+	// never refund more than what is left of the order or the charge
+	if remaining := paid - order.TotalRefunded; amount > remaining {
+		amount = remaining
+	}
+	if amount > charge.Amount {
+		amount = charge.Amount
+	}
+
+	item := &models.BulkRefundItem{
+		OrderID:       order.ID,
+		TransactionID: charge.ID,
+		Amount:        amount,
+		Currency:      charge.Currency,
+		Status:        models.PendingState,
+	}
+	for _, qty := range quantities {
+		item.Quantity += qty
+	}
+	return &bulkRefundOrder{order: order, charge: charge, quantities: quantities, item: item}, nil
+}
+
+// runBulkRefund is the job that makes the pending refunds of a bulk refund one
+// by one, recording the outcome of each in the bulk refund report.
+func (a *API) runBulkRefund(ctx context.Context, db *gorm.DB, job *models.Job) error {
+	payload := &bulkRefundJob{}
+	if err := job.DecodePayload(payload); err != nil {
+		return err
+	}
+	bulk := &models.BulkRefund{}
+	if rsp := db.Preload("Items").First(bulk, "id = ? AND instance_id = ?", payload.BulkRefundID, job.InstanceID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil
+		}
+		return rsp.Error
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return err
+	}
+	log := logrus.WithFields(logrus.Fields{"component": "bulk_refunds", "bulk_refund_id": bulk.ID})
+	if payload.ActorID != "" {
+		ctx = gcontext.WithToken(ctx, &jwt.Token{Claims: &claims.JWTClaims{StandardClaims: jwt.StandardClaims{Subject: payload.ActorID}}})
+	}
+	// refunds take the request for the payment providers, which a job has
+	// none of
+	r := (&http.Request{Header: http.Header{}}).WithContext(ctx)
+
+	for _, item := range bulk.Items {
+		if item.Status != models.PendingState {
+			continue
+		}
+		p, err := a.claimBulkRefundItem(ctx, db, settings, bulk, item)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			continue
+		}
+
+		refund, httpErr := a.refundTransaction(ctx, r, p.order, p.charge, item.Amount, p.quantities)
+		switch {
+		case httpErr != nil:
+			item.Status = models.FailedState
+			item.FailureDescription = httpErr.Message
+		case refund.Status != models.PaidState:
+			item.RefundID = refund.ID
+			item.Status = models.FailedState
+			item.FailureDescription = refund.FailureDescription
+		default:
+			item.RefundID = refund.ID
+			item.Status = models.PaidState
+		}
+		if rsp := db.Save(item); rsp.Error != nil {
+			log.WithError(rsp.Error).Errorf("Failed to save bulk refund of order %s", item.OrderID)
+		}
+	}
+
+	now := time.Now()
+	if rsp := db.Model(bulk).Updates(map[string]interface{}{"status": models.CompletedState, "completed_at": &now}); rsp.Error != nil {
+		return rsp.Error
+	}
+	log.Infof("Finished bulk refund of %d orders", len(bulk.Items))
+	return nil
+}
+
+// claimBulkRefundItem marks an item of a bulk refund as refunding, with the
+// order locked, and plans its refund again with what is left to refund of the
+// order now. Items of orders that another bulk refund is refunding, or that
+// have nothing left to refund, fail instead. It returns nil if the item
+// isn't refunded.
+func (a *API) claimBulkRefundItem(ctx context.Context, db *gorm.DB, settings *calculator.Settings, bulk *models.BulkRefund, item *models.BulkRefundItem) (*bulkRefundOrder, error) {
+	tx := db.Begin()
+	order := &models.Order{}
+	if rsp := orderQuery(models.ForUpdate(tx)).Preload("LineItems.PriceItems").First(order, "id = ?", item.OrderID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return nil, failBulkRefundItem(db, item, "The order was deleted")
+		}
+		return nil, rsp.Error
+	}
+	var busy int
+	if rsp := tx.Model(&models.BulkRefundItem{}).Where("order_id = ? AND status = ? AND id <> ?", order.ID, models.RefundingState, item.ID).Count(&busy); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	if busy > 0 {
+		tx.Rollback()
+		return nil, failBulkRefundItem(db, item, "Another bulk refund is refunding the order")
+	}
+	p, httpErr := a.planOrderRefund(ctx, settings, bulk.Sku, order)
+	if httpErr != nil || p == nil {
+		tx.Rollback()
+		if httpErr != nil {
+			return nil, failBulkRefundItem(db, item, httpErr.Message)
+		}
+		return nil, failBulkRefundItem(db, item, "The order has nothing left to refund")
+	}
+
+	rsp := tx.Model(item).Where("status = ?", models.PendingState).UpdateColumns(map[string]interface{}{
+		"status":         models.RefundingState,
+		"transaction_id": p.item.TransactionID,
+		"quantity":       p.item.Quantity,
+		"amount":         p.item.Amount,
+	})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		// another worker claimed it
+		tx.Rollback()
+		return nil, nil
+	}
+	return p, tx.Commit().Error
+}
+
+func failBulkRefundItem(db *gorm.DB, item *models.BulkRefundItem, reason string) error {
+	item.Status = models.FailedState
+	item.FailureDescription = reason
+	return db.Model(item).Where("status = ?", models.PendingState).UpdateColumns(map[string]interface{}{
+		"status":              item.Status,
+		"failure_description": item.FailureDescription,
+	}).Error
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestBulkRefundCreate(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("DryRun", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runBulkRefund(test, bulkRefundAPI(test, provider), &BulkRefundParams{Sku: test.Data.firstLineItem.Sku, DryRun: true})
+
+		bulk := new(models.BulkRefund)
+		extractPayload(t, http.StatusOK, w, bulk)
+		require.Len(t, bulk.Items, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, bulk.Items[0].OrderID)
+		assert.Equal(t, test.Data.firstTransaction.ID, bulk.Items[0].TransactionID)
+		assert.EqualValues(t, 2, bulk.Items[0].Quantity)
+		assert.EqualValues(t, 2*test.Data.firstLineItem.Price, bulk.Items[0].Amount)
+		assert.Equal(t, models.PendingState, bulk.Items[0].Status)
+
+		assert.Empty(t, provider.refundCalls)
+		assert.True(t, test.DB.First(&models.BulkRefund{}, "id = ?", bulk.ID).RecordNotFound())
+	})
+	t.Run("Refund", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		provider := &memProvider{name: payments.StripeProvider}
+		api := bulkRefundAPI(test, provider)
+		w := runBulkRefund(test, api, &BulkRefundParams{Sku: test.Data.firstLineItem.Sku})
+
+		bulk := new(models.BulkRefund)
+		extractPayload(t, http.StatusAccepted, w, bulk)
+		require.Len(t, bulk.Items, 1)
+		assert.Empty(t, provider.refundCalls, "the refunds are made by a job")
+
+		assert.Equal(t, 1, api.runJobs(test.DB, "worker", logrus.WithField("test", t.Name())))
+		require.NoError(t, test.DB.Preload("Items").First(bulk, "id = ?", bulk.ID).Error)
+		require.Equal(t, models.CompletedState, bulk.Status)
+		require.Len(t, bulk.Items, 1)
+		assert.Equal(t, models.PaidState, bulk.Items[0].Status)
+		assert.NotEmpty(t, bulk.Items[0].RefundID)
+		require.Len(t, provider.refundCalls, 1)
+		assert.Equal(t, test.Data.firstTransaction.ProcessorID, provider.refundCalls[0].id)
+
+		item := &models.LineItem{ID: test.Data.firstLineItem.ID}
+		require.NoError(t, test.DB.First(item).Error)
+		assert.EqualValues(t, 2, item.RefundedQuantity)
+
+		// everything was refunded, so a second run has nothing left to do
+		w = runBulkRefund(test, api, &BulkRefundParams{Sku: test.Data.firstLineItem.Sku, DryRun: true})
+		extractPayload(t, http.StatusOK, w, bulk)
+		assert.Empty(t, bulk.Items)
+	})
+	t.Run("Overlapping", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		provider := &memProvider{name: payments.StripeProvider}
+		api := bulkRefundAPI(test, provider)
+
+		// both bulk refunds plan to refund the order before either ran
+		first, second := new(models.BulkRefund), new(models.BulkRefund)
+		extractPayload(t, http.StatusAccepted, runBulkRefund(test, api, &BulkRefundParams{Sku: test.Data.firstLineItem.Sku}), first)
+		extractPayload(t, http.StatusAccepted, runBulkRefund(test, api, &BulkRefundParams{Sku: test.Data.firstLineItem.Sku}), second)
+		assert.Equal(t, 2, api.runJobs(test.DB, "worker", logrus.WithField("test", t.Name())))
+
+		require.Len(t, provider.refundCalls, 1, "the order is refunded once")
+		items := []models.BulkRefundItem{}
+		require.NoError(t, test.DB.Where("order_id = ?", test.Data.firstOrder.ID).Order("status").Find(&items).Error)
+		require.Len(t, items, 2)
+		assert.Equal(t, models.FailedState, items[0].Status)
+		assert.Equal(t, models.PaidState, items[1].Status)
+	})
+	t.Run("OutOfRange", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runBulkRefund(test, bulkRefundAPI(test, provider), &BulkRefundParams{
+			Sku:    test.Data.firstLineItem.Sku,
+			To:     test.Data.firstOrder.CreatedAt.Add(-time.Hour).Unix(),
+			DryRun: true,
+		})
+
+		bulk := new(models.BulkRefund)
+		extractPayload(t, http.StatusOK, w, bulk)
+		assert.Empty(t, bulk.Items)
+	})
+	t.Run("MissingSku", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runBulkRefund(test, bulkRefundAPI(test, provider), &BulkRefundParams{DryRun: true})
+		validateError(t, http.StatusBadRequest, w)
+	})
+	t.Run("NotWithAdminRights", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body, err := json.Marshal(&BulkRefundParams{Sku: test.Data.firstLineItem.Sku})
+		require.NoError(t, err)
+		w := test.TestEndpoint(http.MethodPost, "/bulk-refunds", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, w)
+	})
+}
+
+func bulkRefundAPI(test *RouteTest, provider payments.Provider) *API {
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(test.T, err)
+	ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{provider.Name(): provider})
+	return NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion)
+}
+
+func runBulkRefund(test *RouteTest, api *API, params *BulkRefundParams) *httptest.ResponseRecorder {
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/bulk-refunds", bytes.NewBuffer(body))
+	require.NoError(test.T, signHTTPRequest(r, testAdminToken("magical-unicorn", ""), test.Config.JWT.Secret))
+
+	api.handler.ServeHTTP(w, r)
+	return w
+}
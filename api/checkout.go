@@ -0,0 +1,208 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	checkoutIdleTimeout = 10 * time.Minute
+	maxCartUpdateBytes  = 64 << 10
+)
+
+// cartUpdate is a change of the cart on a checkout page. Fields that are left
+// out keep the value of the previous update on the same connection.
+type cartUpdate struct {
+	ID             string           `json:"id,omitempty"`
+	SessionID      *string          `json:"session_id"`
+	Currency       *string          `json:"currency"`
+	Country        *string          `json:"country"`
+	CouponCode     *string          `json:"coupon"`
+	ShippingMethod *string          `json:"shipping_method"`
+	LineItems      []*orderLineItem `json:"line_items"`
+}
+
+// cartTotals are the prices of the cart after an update.
+type cartTotals struct {
+	ID          string                   `json:"id,omitempty"`
+	Currency    string                   `json:"currency"`
+	Country     string                   `json:"country"`
+	Coupon      *models.Coupon           `json:"coupon,omitempty"`
+	Items       []cartItemTotals         `json:"items"`
+	Subtotal    uint64                   `json:"subtotal"`
+	Discount    uint64                   `json:"discount"`
+	Taxes       uint64                   `json:"taxes"`
+	Shipping    uint64                   `json:"shipping"`
+	Total       uint64                   `json:"total"`
+	Adjustments []*calculator.Adjustment `json:"adjustments,omitempty"`
+	Error       string                   `json:"error,omitempty"`
+
+	// NextTier is the spend tier with a higher discount the cart can reach
+	// by adding the amount left, for upselling.
+	NextTier *calculator.NextSpendTier `json:"next_tier,omitempty"`
+}
+
+type cartItemTotals struct {
+	Sku      string `json:"sku"`
+	Title    string `json:"title"`
+	Quantity uint64 `json:"quantity"`
+	Subtotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
+	Taxes    uint64 `json:"taxes"`
+	Total    uint64 `json:"total"`
+
+	PromotionDiscount uint64                      `json:"promotion_discount,omitempty"`
+	Promotions        []*calculator.ItemPromotion `json:"promotions,omitempty"`
+	TierDiscount      uint64                      `json:"tier_discount,omitempty"`
+}
+
+// CheckoutSocket accepts a WebSocket connection from a checkout page. The page
+// sends a JSON cartUpdate whenever the country, items or coupon of the cart
+// change, and gets the recalculated cartTotals back for every update. Carts
+// with the session_id of the order they become count in the checkout funnel.
+func (a *API) CheckoutSocket(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	websocket.Handler(func(ws *websocket.Conn) {
+		ws.MaxPayloadBytes = maxCartUpdateBytes
+		a.streamCartTotals(r, ws, log)
+	}).ServeHTTP(w, r)
+	return nil
+}
+
+func (a *API) streamCartTotals(r *http.Request, ws *websocket.Conn, log logrus.FieldLogger) {
+	defer ws.Close()
+
+	cart := &cartUpdate{}
+	previewed := false
+	for {
+		ws.SetReadDeadline(time.Now().Add(checkoutIdleTimeout))
+		update := &cartUpdate{}
+		if err := websocket.JSON.Receive(ws, update); err != nil {
+			log.WithError(err).Debug("Closing checkout socket")
+			return
+		}
+		cart.merge(update)
+
+		totals, httpError := a.calculateCart(r, cart)
+		if httpError != nil {
+			totals = &cartTotals{Error: httpError.Message}
+		} else if !previewed && cart.SessionID != nil && *cart.SessionID != "" {
+			instanceID := gcontext.GetInstanceID(r.Context())
+			if err := models.RecordFunnelStep(a.db, instanceID, *cart.SessionID, "", models.CartPreviewedStep); err != nil {
+				log.WithError(err).Error("Error recording cart preview")
+			}
+			previewed = true
+		}
+		totals.ID = update.ID
+		if err := websocket.JSON.Send(ws, totals); err != nil {
+			log.WithError(err).Debug("Failed to send cart totals")
+			return
+		}
+	}
+}
+
+func (c *cartUpdate) merge(update *cartUpdate) {
+	if update.SessionID != nil {
+		c.SessionID = update.SessionID
+	}
+	if update.Currency != nil {
+		c.Currency = update.Currency
+	}
+	if update.Country != nil {
+		c.Country = update.Country
+	}
+	if update.CouponCode != nil {
+		c.CouponCode = update.CouponCode
+	}
+	if update.ShippingMethod != nil {
+		c.ShippingMethod = update.ShippingMethod
+	}
+	if update.LineItems != nil {
+		c.LineItems = update.LineItems
+	}
+}
+
+// calculateCart prices the cart the same way a new order is priced, without
+// saving anything.
+func (a *API) calculateCart(r *http.Request, cart *cartUpdate) (*cartTotals, *HTTPError) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+
+	var currency, country string
+	if cart.Currency != nil {
+		currency = *cart.Currency
+	}
+	if cart.Country != nil {
+		country = *cart.Country
+	}
+	inferred := inferLocale(r, config, country, currency, "")
+
+	order := models.NewOrder(gcontext.GetInstanceID(ctx), "", "", inferred.Currency)
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		order.UserID = claims.Subject
+	}
+	order.Locale = inferred.Locale
+	order.ShippingAddress.Country = inferred.Country
+	order.BillingAddress.Country = inferred.Country
+	if cart.ShippingMethod != nil {
+		order.ShippingMethod = *cart.ShippingMethod
+	}
+
+	if cart.CouponCode != nil && *cart.CouponCode != "" {
+		coupon, err := a.lookupCoupon(ctx, nil, *cart.CouponCode)
+		if err != nil {
+			if httpError, ok := err.(*HTTPError); ok {
+				return nil, httpError
+			}
+			return nil, internalServerError("Error fetching coupon").WithInternalError(err)
+		}
+		if !coupon.Valid() {
+			return nil, badRequestError("This coupon is not valid at this time")
+		}
+		order.CouponCode = coupon.Code
+		order.Coupon = coupon
+	}
+
+	price, httpError := a.priceOrder(ctx, a.readDB(r), order, cart.LineItems)
+	if httpError != nil {
+		return nil, httpError
+	}
+
+	totals := &cartTotals{
+		Currency: order.Currency,
+		Country:  inferred.Country,
+		Coupon:   order.Coupon,
+		Items:    make([]cartItemTotals, len(order.LineItems)),
+		Subtotal: price.Subtotal,
+		Discount: price.Discount,
+		Taxes:    price.Taxes,
+		Shipping: price.Shipping,
+		Total:    price.Total,
+
+		Adjustments: order.Adjustments,
+		NextTier:    price.NextTier,
+	}
+	for i, item := range order.LineItems {
+		totals.Items[i] = cartItemTotals{
+			Sku:      item.Sku,
+			Title:    item.Title,
+			Quantity: item.Quantity,
+			Subtotal: price.Items[i].Subtotal,
+			Discount: price.Items[i].Discount,
+			Taxes:    price.Items[i].Taxes,
+			Total:    price.Items[i].Total,
+
+			PromotionDiscount: price.Items[i].PromotionDiscount,
+			Promotions:        price.Items[i].Promotions,
+			TierDiscount:      price.Items[i].TierDiscount,
+		}
+	}
+	return totals, nil
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestCheckoutSocket(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = site.URL
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(t, err)
+	server := httptest.NewServer(NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler)
+	defer server.Close()
+
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/checkout/socket", "", server.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	send := func(update string) *cartTotals {
+		_, err := ws.Write([]byte(update))
+		require.NoError(t, err)
+		totals := &cartTotals{}
+		require.NoError(t, websocket.JSON.Receive(ws, totals))
+		return totals
+	}
+
+	totals := send(`{"id": "1", "session_id": "checkout-1", "currency": "USD", "country": "USA", "line_items": [{"path": "/simple-product", "quantity": 2}]}`)
+	assert.Empty(t, totals.Error)
+	assert.Equal(t, "1", totals.ID)
+	require.Len(t, totals.Items, 1)
+	assert.Equal(t, "product-1", totals.Items[0].Sku)
+	assert.EqualValues(t, 1998, totals.Subtotal)
+	assert.EqualValues(t, 0, totals.Taxes)
+	assert.EqualValues(t, 1998, totals.Total)
+
+	totals = send(`{"id": "2", "country": "Germany"}`)
+	assert.Empty(t, totals.Error)
+	assert.Equal(t, "Germany", totals.Country)
+	assert.EqualValues(t, 1998, totals.Subtotal)
+	assert.EqualValues(t, 140, totals.Taxes)
+	assert.EqualValues(t, 2138, totals.Total)
+
+	totals = send(`{"id": "3", "coupon": "unknown"}`)
+	assert.Equal(t, "3", totals.ID)
+	assert.NotEmpty(t, totals.Error)
+
+	totals = send(`{"id": "4", "coupon": ""}`)
+	assert.Empty(t, totals.Error)
+	assert.EqualValues(t, 2138, totals.Total)
+
+	count := 0
+	require.NoError(t, test.DB.Model(models.FunnelEvent{}).Where("checkout_id = ? AND step = ?", "checkout-1", models.CartPreviewedStep).Count(&count).Error)
+	assert.Equal(t, 1, count, "the cart preview is recorded once")
+}
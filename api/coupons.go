@@ -6,6 +6,7 @@ import (
 	"context"
 
 	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/coupons"
 	"github.com/netlify/gocommerce/models"
@@ -30,7 +31,25 @@ func (a *API) lookupCoupon(ctx context.Context, w http.ResponseWriter, code stri
 	return coupon, nil
 }
 
-// CouponView returns information about a single coupon code.
+// checkCouponRedemptions returns an error if the coupon of an order can't be
+// redeemed anymore, in total or by the buyer of the order. The redemption is
+// only counted when the order is paid.
+func checkCouponRedemptions(db *gorm.DB, order *models.Order) *HTTPError {
+	if order.Coupon == nil {
+		return nil
+	}
+	total, user, err := models.CouponRedemptions(db, order)
+	if err != nil {
+		return internalServerError("Error loading coupon redemptions").WithInternalError(err)
+	}
+	if order.Coupon.Exhausted(total, user) {
+		return badRequestError("This coupon was redeemed the maximum number of times")
+	}
+	return nil
+}
+
+// CouponView returns information about a single coupon code, so clients can
+// validate it and preview the discount before checkout.
 func (a *API) CouponView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
@@ -40,6 +59,13 @@ func (a *API) CouponView(w http.ResponseWriter, r *http.Request) error {
 		log.WithError(err).Infof("error loading coupon %v", err)
 		return err
 	}
+	if !coupon.Valid() {
+		return badRequestError("This coupon is not valid at this time")
+	}
+	order := &models.Order{InstanceID: gcontext.GetInstanceID(ctx), CouponCode: coupon.Code, Coupon: coupon}
+	if httpErr := checkCouponRedemptions(a.readDB(r), order); httpErr != nil {
+		return httpErr
+	}
 
 	return sendJSON(w, http.StatusOK, coupon)
 }
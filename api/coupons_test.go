@@ -6,8 +6,10 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/netlify/gocommerce/coupons"
 	"github.com/netlify/gocommerce/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCouponView(t *testing.T) {
@@ -28,17 +30,118 @@ func TestCouponView(t *testing.T) {
 		assert.Equal(t, uint64(15), coupon.Percentage, "Expected coupon percetage to be 15")
 		assert.Equal(t, "coupon-code", coupon.Code, "Expected coupon code to be 'coupon-code'")
 	})
+	t.Run("Signed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startSignedTestCouponURLs("coupon-secret")
+		defer server.Close()
+		test.Config.Coupons.URL = server.URL
+		test.Config.Coupons.Secret = "coupon-secret"
+
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil)
+		coupon := &models.Coupon{}
+		extractPayload(t, http.StatusOK, recorder, coupon)
+		assert.Equal(t, uint64(15), coupon.Percentage)
+	})
+	t.Run("BadSignature", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startSignedTestCouponURLs("other-secret")
+		defer server.Close()
+		test.Config.Coupons.URL = server.URL
+		test.Config.Coupons.Secret = "coupon-secret"
+
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil)
+		validateError(t, http.StatusInternalServerError, recorder)
+
+		unsigned := startTestCouponURLs()
+		defer unsigned.Close()
+		test.Config.Coupons.URL = unsigned.URL
+		recorder = test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil)
+		validateError(t, http.StatusInternalServerError, recorder)
+	})
+	t.Run("UnknownCode", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestCouponURLs()
+		defer server.Close()
+		test.Config.Coupons.URL = server.URL
+
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/unknown-code", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestCouponURLs()
+		defer server.Close()
+		test.Config.Coupons.URL = server.URL
+
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/expired-code", nil, nil)
+		validateError(t, http.StatusBadRequest, recorder)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/coupons/ended-code", nil, nil)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("Exhausted", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestCouponURLs()
+		defer server.Close()
+		test.Config.Coupons.URL = server.URL
+
+		coupon := &models.Coupon{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons/limited-code", nil, nil), coupon)
+		assert.EqualValues(t, 2, coupon.MaxRedemptions)
+
+		for _, email := range []string{"one@example.com", "two@example.com"} {
+			order := &models.Order{CouponCode: "limited-code", Coupon: coupon, Email: email}
+			require.NoError(t, models.RedeemCoupon(test.DB, order))
+		}
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/limited-code", nil, nil)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
 }
 
 func startTestCouponURLs() *httptest.Server {
+	return startSignedTestCouponURLs("")
+}
+
+// startSignedTestCouponURLs serves the test coupons signed with a secret, or
+// unsigned without one.
+func startSignedTestCouponURLs(secret string) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintln(w, `{
+		if secret != "" {
+			w.Header().Set(coupons.SignatureHeader, coupons.Sign(secret, []byte(testCoupons)))
+		}
+		fmt.Fprint(w, testCoupons)
+	}))
+}
+
+const testCoupons = `{
       "coupons": {
         "coupon-code": {
           "percentage": 15
+        },
+        "expired-code": {
+          "percentage": 15,
+          "end_date": "2017-01-01T00:00:00Z"
+        },
+        "gift-code": {
+          "product_types": ["Book"],
+          "gift": {"path": "/shipped-product", "minimum": [{"amount": "5.00", "currency": "USD"}]}
+        },
+        "big-gift-code": {
+          "gift": {"path": "/shipped-product", "minimum": [{"amount": "50.00", "currency": "USD"}]}
+        },
+        "ended-code": {
+          "percentage": 15,
+          "ends_at": "2017-01-01T00:00:00Z"
+        },
+        "minimum-code": {
+          "percentage": 15,
+          "minimum": [{"amount": "50.00", "currency": "USD"}]
+        },
+        "limited-code": {
+          "percentage": 15,
+          "max_redemptions": 2,
+          "max_redemptions_per_user": 1
         }
       }
-    }`)
-	}))
-}
+    }`
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/claims"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type customerGroupsParams struct {
+	Groups []string `json:"groups"`
+}
+
+// CustomerGroupsUpdate replaces the customer groups of a user. The user
+// doesn't have to have ordered yet, so groups can be set up before the first
+// order.
+func (a *API) CustomerGroupsUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+	userID := gcontext.GetUserID(ctx)
+
+	params := &customerGroupsParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	groups := []string{}
+	seen := map[string]bool{}
+	for _, name := range params.Groups {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return badRequestError("Customer groups must have a name")
+		}
+		if !seen[name] {
+			seen[name] = true
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+
+	tx := a.db.Begin()
+	if rsp := tx.Where("instance_id = ? AND user_id = ?", instanceID, userID).Delete(&models.CustomerGroup{}); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error removing customer groups").WithInternalError(rsp.Error)
+	}
+	for _, name := range groups {
+		group := &models.CustomerGroup{
+			InstanceID: instanceID,
+			UserID:     userID,
+			Name:       name,
+			CreatedBy:  actorID(ctx),
+		}
+		if rsp := tx.Create(group); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error saving customer group").WithInternalError(rsp.Error)
+		}
+	}
+	tx.Commit()
+
+	log.WithField("groups", groups).Info("Updated customer groups")
+	return sendJSON(w, http.StatusOK, &customerGroupsParams{Groups: groups})
+}
+
+// priceClaims returns the claims prices are calculated with: the claims of
+// the JWT of the request, with the customer groups of the user added to them.
+func (a *API) priceClaims(ctx context.Context, db *gorm.DB) (map[string]interface{}, error) {
+	jwtClaims := gcontext.GetClaimsAsMap(ctx)
+	if jwtClaims == nil {
+		return nil, nil
+	}
+	subject, _ := jwtClaims["sub"].(string)
+	groups := []string{}
+	if subject != "" {
+		var err error
+		groups, err = models.GetCustomerGroups(db, gcontext.GetInstanceID(ctx), subject)
+		if err != nil {
+			return nil, err
+		}
+	}
+	jwtClaims[claims.CustomerGroupsKey] = groups
+	return jwtClaims, nil
+}
+
+// orderPriceClaims returns the claims the prices of an order are calculated
+// with, which are the ones of its buyer. They are the claims of the request
+// when the buyer makes it. When an admin prices the order of a user, the ID
+// and customer groups of the user are used, and anonymous orders are priced
+// without claims. Every price of an order is calculated with them, so the
+// order is priced the same when it is created, recalculated and paid.
+func (a *API) orderPriceClaims(ctx context.Context, db *gorm.DB, order *models.Order) (map[string]interface{}, error) {
+	if order.UserID == "" {
+		return nil, nil
+	}
+	if c := gcontext.GetClaims(ctx); c != nil && c.Subject == order.UserID {
+		return a.priceClaims(ctx, db)
+	}
+	groups, err := models.GetCustomerGroups(db, gcontext.GetInstanceID(ctx), order.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"sub": order.UserID, "email": order.Email, claims.CustomerGroupsKey: groups}, nil
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomerGroupsUpdate(t *testing.T) {
+	test := NewRouteTest(t)
+	userID := test.Data.testUser.ID
+	url := "/users/" + userID + "/groups"
+
+	recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"groups": ["vip"]}`), test.Data.testUserToken)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code, "users can't pick their own groups")
+
+	token := testAdminToken("admin-yo", "admin@wayne.com")
+	recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"groups": ["wholesale", " vip", "wholesale"]}`), token)
+	params := &customerGroupsParams{}
+	extractPayload(t, http.StatusOK, recorder, params)
+	assert.Equal(t, []string{"vip", "wholesale"}, params.Groups)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/users/"+userID, nil, test.Data.testUserToken)
+	user := &models.User{}
+	extractPayload(t, http.StatusOK, recorder, user)
+	assert.Equal(t, []string{"vip", "wholesale"}, user.Groups)
+
+	recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"groups": ["wholesale"]}`), token)
+	extractPayload(t, http.StatusOK, recorder, params)
+	groups, err := models.GetCustomerGroups(test.DB, "", userID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"wholesale"}, groups)
+
+	recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"groups": [""]}`), token)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestCustomerGroupPrices(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	createOrder := func(test *RouteTest) *models.Order {
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address_id": "` + test.Data.testAddress.ID + `",
+			"line_items": [{"path": "/wholesale-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		return order
+	}
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	assert.EqualValues(t, 2000, createOrder(test).Total)
+
+	group := &models.CustomerGroup{UserID: test.Data.testUser.ID, Name: "wholesale"}
+	require.NoError(t, test.DB.Create(group).Error)
+	defer test.DB.Delete(group)
+	assert.EqualValues(t, 1200, createOrder(test).Total)
+}
+
+func TestCustomerGroupPriceLists(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	createOrder := func() *models.Order {
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address_id": "` + test.Data.testAddress.ID + `",
+			"line_items": [{"path": "/price-list-product", "quantity": 1}, {"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		return order
+	}
+
+	order := createOrder()
+	assert.Equal(t, models.DefaultPriceList, order.PriceList)
+	require.Len(t, order.LineItems, 2)
+	assert.EqualValues(t, 2000, order.LineItems[0].Price)
+	assert.Equal(t, models.DefaultPriceList, order.LineItems[0].PriceList)
+
+	group := &models.CustomerGroup{UserID: test.Data.testUser.ID, Name: "wholesale"}
+	require.NoError(t, test.DB.Create(group).Error)
+	defer test.DB.Delete(group)
+
+	order = createOrder()
+	assert.Equal(t, "wholesale", order.PriceList)
+	require.Len(t, order.LineItems, 2)
+	assert.EqualValues(t, 1100, order.LineItems[0].Price)
+	assert.Equal(t, "wholesale", order.LineItems[0].PriceList)
+	// products without a wholesale list are sold at retail prices
+	assert.Equal(t, models.DefaultPriceList, order.LineItems[1].PriceList)
+
+	saved := &models.Order{}
+	require.NoError(t, test.DB.First(saved, "id = ?", order.ID).Error)
+	assert.Equal(t, "wholesale", saved.PriceList)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var isoDuration = regexp.MustCompile(`^([+-])?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseTimeParam parses a unix timestamp or an ISO 8601 duration. A duration
+// is added to now, so -P7D is a week ago and P1D is tomorrow.
+func parseTimeParam(value string, now time.Time) (time.Time, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	if !strings.Contains(value, "P") {
+		return time.Time{}, fmt.Errorf("'%v' is neither a unix timestamp nor an ISO 8601 duration", value)
+	}
+	return addISODuration(now, value)
+}
+
+// addISODuration adds an ISO 8601 duration like P1Y2M3DT4H5M6S to a time.
+// Years, months, weeks and days are calendar based, so -P1M on March 31st is
+// March 3rd or 2nd, the same as time.AddDate.
+func addISODuration(t time.Time, value string) (time.Time, error) {
+	parts := isoDuration.FindStringSubmatch(value)
+	if parts == nil || value == "P" || strings.HasSuffix(value, "T") || strings.HasSuffix(value, "P") {
+		return time.Time{}, fmt.Errorf("'%v' is not a valid ISO 8601 duration", value)
+	}
+
+	n := make([]int, len(parts))
+	for i := 2; i < len(parts); i++ {
+		if parts[i] == "" {
+			continue
+		}
+		v, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("'%v' is not a valid ISO 8601 duration", value)
+		}
+		n[i] = v
+	}
+	sign := 1
+	if parts[1] == "-" {
+		sign = -1
+	}
+
+	t = t.AddDate(sign*n[2], sign*n[3], sign*(7*n[4]+n[5]))
+	clock := time.Duration(n[6])*time.Hour + time.Duration(n[7])*time.Minute + time.Duration(n[8])*time.Second
+	return t.Add(time.Duration(sign) * clock), nil
+}
+
+// periodRange returns the first and last instant of a named calendar period
+// relative to now. Weeks start on Monday. The end is the last microsecond of
+// the period, the finest resolution all supported databases store.
+func periodRange(period string, now time.Time) (time.Time, time.Time, error) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	week := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	year := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+
+	var start, end time.Time
+	switch period {
+	case "today":
+		start, end = day, day.AddDate(0, 0, 1)
+	case "yesterday":
+		start, end = day.AddDate(0, 0, -1), day
+	case "this_week":
+		start, end = week, week.AddDate(0, 0, 7)
+	case "last_week":
+		start, end = week.AddDate(0, 0, -7), week
+	case "this_month":
+		start, end = month, month.AddDate(0, 1, 0)
+	case "last_month":
+		start, end = month.AddDate(0, -1, 0), month
+	case "this_year":
+		start, end = year, year.AddDate(1, 0, 0)
+	case "last_year":
+		start, end = year.AddDate(-1, 0, 0), year
+	case "last_7_days":
+		start, end = day.AddDate(0, 0, -7), day
+	case "last_30_days":
+		start, end = day.AddDate(0, 0, -30), day
+	default:
+		return start, end, fmt.Errorf("unknown period '%v'", period)
+	}
+	return start, end.Add(-time.Microsecond), nil
+}
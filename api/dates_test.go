@@ -0,0 +1,57 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimeParam(t *testing.T) {
+	now := time.Date(2018, 3, 14, 15, 9, 26, 0, time.UTC)
+	cases := map[string]time.Time{
+		"1514764800":   time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		"-P7D":         time.Date(2018, 3, 7, 15, 9, 26, 0, time.UTC),
+		"P1D":          time.Date(2018, 3, 15, 15, 9, 26, 0, time.UTC),
+		"+P1W":         time.Date(2018, 3, 21, 15, 9, 26, 0, time.UTC),
+		"-P1M":         time.Date(2018, 2, 14, 15, 9, 26, 0, time.UTC),
+		"-P1Y2M3D":     time.Date(2017, 1, 11, 15, 9, 26, 0, time.UTC),
+		"-PT12H":       time.Date(2018, 3, 14, 3, 9, 26, 0, time.UTC),
+		"-P1DT1H1M26S": time.Date(2018, 3, 13, 14, 8, 0, 0, time.UTC),
+	}
+	for value, expected := range cases {
+		actual, err := parseTimeParam(value, now)
+		require.NoError(t, err, value)
+		assert.True(t, expected.Equal(actual), "%v: expected %v, got %v", value, expected, actual)
+	}
+
+	for _, value := range []string{"", "P", "-PT", "P1DT", "7D", "-P1.5D", "yesterday"} {
+		_, err := parseTimeParam(value, now)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPeriodRange(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2018, 3, 14, 15, 9, 26, 0, time.UTC)
+	cases := map[string][2]time.Time{
+		"today":        {time.Date(2018, 3, 14, 0, 0, 0, 0, time.UTC), time.Date(2018, 3, 15, 0, 0, 0, 0, time.UTC)},
+		"yesterday":    {time.Date(2018, 3, 13, 0, 0, 0, 0, time.UTC), time.Date(2018, 3, 14, 0, 0, 0, 0, time.UTC)},
+		"this_week":    {time.Date(2018, 3, 12, 0, 0, 0, 0, time.UTC), time.Date(2018, 3, 19, 0, 0, 0, 0, time.UTC)},
+		"last_week":    {time.Date(2018, 3, 5, 0, 0, 0, 0, time.UTC), time.Date(2018, 3, 12, 0, 0, 0, 0, time.UTC)},
+		"this_month":   {time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)},
+		"last_month":   {time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)},
+		"last_year":    {time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"last_30_days": {time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC), time.Date(2018, 3, 14, 0, 0, 0, 0, time.UTC)},
+	}
+	for period, expected := range cases {
+		start, end, err := periodRange(period, now)
+		require.NoError(t, err, period)
+		assert.True(t, expected[0].Equal(start), "%v: expected start %v, got %v", period, expected[0], start)
+		assert.True(t, expected[1].Add(-time.Microsecond).Equal(end), "%v: expected end before %v, got %v", period, expected[1], end)
+	}
+
+	_, _, err := periodRange("next_month", now)
+	assert.Error(t, err)
+}
@@ -12,36 +12,90 @@ import (
 
 const maxIPsPerDay = 50
 
-// DownloadURL returns a signed URL to download a purchased asset.
-func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
+// downloadStats is the access that is left to a download.
+type downloadStats struct {
+	ID                 string     `json:"id"`
+	Downloads          uint64     `json:"downloads"`
+	MaxDownloads       uint64     `json:"max_downloads,omitempty"`
+	RemainingDownloads *uint64    `json:"remaining_downloads,omitempty"`
+	ExpiresAt          *time.Time `json:"expires_at,omitempty"`
+	Expired            bool       `json:"expired"`
+	PinnedIP           string     `json:"pinned_ip,omitempty"`
+}
+
+// newDownloadStats returns the access left to a download of a paid order.
+// Downloads expire the given number of days after the order was paid, or was
+// created when it was free. The transactions of the order must be loaded.
+func newDownloadStats(download *models.Download, order *models.Order, now time.Time) *downloadStats {
+	stats := &downloadStats{
+		ID:           download.ID,
+		Downloads:    download.DownloadCount,
+		MaxDownloads: download.MaxDownloads,
+		PinnedIP:     download.PinnedIP,
+	}
+	if download.MaxDownloads > 0 {
+		var remaining uint64
+		if download.DownloadCount < download.MaxDownloads {
+			remaining = download.MaxDownloads - download.DownloadCount
+		}
+		stats.RemainingDownloads = &remaining
+	}
+	if download.ExpiryDays > 0 {
+		paidAt := orderPaidAt(order)
+		if paidAt == nil {
+			paidAt = &order.CreatedAt
+		}
+		expiresAt := paidAt.AddDate(0, 0, download.ExpiryDays)
+		stats.ExpiresAt = &expiresAt
+		stats.Expired = now.After(expiresAt)
+	}
+	return stats
+}
+
+// loadDownload loads the download of the request and its paid order, with
+// the transactions, if the client has access to it.
+func (a *API) loadDownload(r *http.Request) (*models.Download, *models.Order, *HTTPError) {
 	ctx := r.Context()
 	downloadID := chi.URLParam(r, "download_id")
 	logEntrySetField(r, "download_id", downloadID)
-	claims := gcontext.GetClaims(ctx)
-	assets := gcontext.GetAssetStore(ctx)
 
 	download := &models.Download{}
 	if result := a.db.Where("id = ?", downloadID).First(download); result.Error != nil {
 		if result.RecordNotFound() {
-			return notFoundError("Download not found")
+			return nil, nil, notFoundError("Download not found")
 		}
-		return internalServerError("Error during database query").WithInternalError(result.Error)
+		return nil, nil, internalServerError("Error during database query").WithInternalError(result.Error)
 	}
 
 	order := &models.Order{}
-	if result := a.db.Where("id = ?", download.OrderID).First(order); result.Error != nil {
+	if result := a.db.Preload("Transactions").Where("id = ? AND instance_id = ?", download.OrderID, gcontext.GetInstanceID(ctx)).First(order); result.Error != nil {
 		if result.RecordNotFound() {
-			return notFoundError("Download order not found")
+			return nil, nil, notFoundError("Download order not found")
 		}
-		return internalServerError("Error during database query").WithInternalError(result.Error)
+		return nil, nil, internalServerError("Error during database query").WithInternalError(result.Error)
 	}
 
 	if !hasOrderAccess(ctx, order) {
-		return unauthorizedError("Not Authorized to access this download")
+		return nil, nil, unauthorizedError("Not Authorized to access this download")
 	}
 
 	if order.PaymentState != models.PaidState {
-		return unauthorizedError("This download has not been paid yet")
+		return nil, nil, unauthorizedError("This download has not been paid yet")
+	}
+	return download, order, nil
+}
+
+// DownloadURL returns a signed URL to download a purchased asset. The limits
+// of the download apply to the buyer, admins can always download it without
+// using any of them up.
+func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := gcontext.GetClaims(ctx)
+	assets := gcontext.GetAssetStore(ctx)
+
+	download, order, httpError := a.loadDownload(r)
+	if httpError != nil {
+		return httpError
 	}
 
 	rows, err := a.db.Model(&models.Event{}).
@@ -62,18 +116,83 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 		return unauthorizedError("This download has been accessed from too many IPs within the last day")
 	}
 
+	limited := !gcontext.IsAdmin(ctx)
+	ip := a.clientIP(r)
+	if limited {
+		stats := newDownloadStats(download, order, time.Now())
+		if stats.Expired {
+			return unauthorizedError("This download expired on %v", stats.ExpiresAt.Format("2006-01-02"))
+		}
+		if stats.RemainingDownloads != nil && *stats.RemainingDownloads == 0 {
+			return unauthorizedError("This download can only be downloaded %d times", download.MaxDownloads)
+		}
+		if download.PinIP && download.PinnedIP != "" && download.PinnedIP != ip {
+			return unauthorizedError("This download can only be downloaded from the IP address it was first downloaded from")
+		}
+	}
+
 	if err := download.SignURL(assets); err != nil {
 		return internalServerError("Error signing download").WithInternalError(err)
 	}
 
 	tx := a.db.Begin()
-	tx.Model(download).Updates(map[string]interface{}{"download_count": gorm.Expr("download_count + 1")})
+	if limited {
+		// the limits are checked again in the update, in case of concurrent
+		// downloads
+		updates := map[string]interface{}{"download_count": gorm.Expr("download_count + 1")}
+		query := tx.Model(download).Where("max_downloads = 0 OR download_count < max_downloads")
+		if download.PinIP {
+			updates["pinned_ip"] = ip
+			query = query.Where("pinned_ip = '' OR pinned_ip = ?", ip)
+		}
+		rsp := query.Updates(updates)
+		if rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error signing download").WithInternalError(rsp.Error)
+		}
+		if rsp.RowsAffected == 0 {
+			tx.Rollback()
+			return unauthorizedError("This download can't be downloaded anymore")
+		}
+	}
 	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"download"})
 	tx.Commit()
 
 	return sendJSON(w, http.StatusOK, download)
 }
 
+// DownloadStats returns how many times a purchased asset was downloaded, and
+// how much access to it is left.
+func (a *API) DownloadStats(w http.ResponseWriter, r *http.Request) error {
+	download, order, httpError := a.loadDownload(r)
+	if httpError != nil {
+		return httpError
+	}
+	return sendJSON(w, http.StatusOK, newDownloadStats(download, order, time.Now()))
+}
+
+// DownloadUnpin lets an admin unpin a download from the IP address it was
+// first downloaded from, for buyers that moved. The next download pins it
+// again.
+func (a *API) DownloadUnpin(w http.ResponseWriter, r *http.Request) error {
+	claims := gcontext.GetClaims(r.Context())
+	download, order, httpError := a.loadDownload(r)
+	if httpError != nil {
+		return httpError
+	}
+
+	tx := a.db.Begin()
+	if rsp := tx.Model(download).UpdateColumn("pinned_ip", ""); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error unpinning download").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"download_pinned_ip"})
+	tx.Commit()
+	download.PinnedIP = ""
+
+	return sendJSON(w, http.StatusOK, newDownloadStats(download, order, time.Now()))
+}
+
 // DownloadList lists all purchased downloads for an order or a user.
 func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -83,7 +202,7 @@ func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 
 	order := &models.Order{}
 	if orderID != "" {
-		if result := a.db.Where("id = ?", orderID).First(order); result.Error != nil {
+		if result := a.db.Where("id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx)).First(order); result.Error != nil {
 			if result.RecordNotFound() {
 				return notFoundError("Download order not found")
 			}
@@ -3,9 +3,12 @@ package api
 import (
 	"net/http"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/netlify/gocommerce/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDownloadList(t *testing.T) {
@@ -19,3 +22,75 @@ func TestDownloadList(t *testing.T) {
 		assert.Len(t, downloads, 1)
 	})
 }
+
+func TestDownloadLimits(t *testing.T) {
+	test := NewRouteTest(t)
+	token := test.Data.testUserToken
+	url := "/downloads/" + "first-download"
+	limit := func(t *testing.T, columns map[string]interface{}) {
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").UpdateColumns(columns).Error)
+	}
+	stats := func(t *testing.T, token *jwt.Token) *downloadStats {
+		recorder := test.TestEndpoint(http.MethodGet, url+"/stats", nil, token)
+		stats := &downloadStats{}
+		extractPayload(t, http.StatusOK, recorder, stats)
+		return stats
+	}
+
+	t.Run("MaxDownloads", func(t *testing.T) {
+		limit(t, map[string]interface{}{"download_count": 0, "max_downloads": 2})
+		for i := 0; i < 2; i++ {
+			recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+			assert.Equal(t, http.StatusOK, recorder.Code, "download %d", i)
+		}
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder, "This download can only be downloaded 2 times")
+
+		s := stats(t, token)
+		assert.Equal(t, uint64(2), s.Downloads)
+		require.NotNil(t, s.RemainingDownloads)
+		assert.Equal(t, uint64(0), *s.RemainingDownloads)
+
+		admin := testAdminToken("admin", "")
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, admin)
+		assert.Equal(t, http.StatusOK, recorder.Code, "admins aren't limited")
+		assert.Equal(t, uint64(2), stats(t, admin).Downloads, "and don't use up downloads")
+	})
+	t.Run("Expiry", func(t *testing.T) {
+		limit(t, map[string]interface{}{"max_downloads": 0, "expiry_days": 1})
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("created_at", time.Now().AddDate(0, 0, -2)).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		s := stats(t, token)
+		assert.True(t, s.Expired)
+		require.NotNil(t, s.ExpiresAt)
+		assert.Nil(t, s.RemainingDownloads)
+	})
+	t.Run("PinIP", func(t *testing.T) {
+		limit(t, map[string]interface{}{"expiry_days": 0, "pin_ip": true})
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		pinned := stats(t, token).PinnedIP
+		assert.NotEmpty(t, pinned)
+
+		limit(t, map[string]interface{}{"pinned_ip": "10.9.9.9"})
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder, "This download can only be downloaded from the IP address it was first downloaded from")
+
+		recorder = test.TestEndpoint(http.MethodDelete, url+"/pinned-ip", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder, "Admin permissions required")
+		recorder = test.TestEndpoint(http.MethodDelete, url+"/pinned-ip", nil, testAdminToken("admin", ""))
+		s := &downloadStats{}
+		extractPayload(t, http.StatusOK, recorder, s)
+		assert.Empty(t, s.PinnedIP)
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code, "unpinned downloads pin the next address")
+		assert.Equal(t, pinned, stats(t, token).PinnedIP)
+	})
+	t.Run("Stranger", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, url+"/stats", nil, testToken("stranger", "stranger@example.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
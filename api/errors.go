@@ -22,17 +22,30 @@ func notFoundError(fmtString string, args ...interface{}) *HTTPError {
 	return httpError(http.StatusNotFound, fmtString, args...)
 }
 
+func unprocessableEntityError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusUnprocessableEntity, fmtString, args...)
+}
+
+func conflictError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusConflict, fmtString, args...)
+}
+
 func unauthorizedError(fmtString string, args ...interface{}) *HTTPError {
 	return httpError(http.StatusUnauthorized, fmtString, args...)
 }
 
+func serviceUnavailableError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusServiceUnavailable, fmtString, args...)
+}
+
 // HTTPError is an error with a message and an HTTP status code.
 type HTTPError struct {
-	Code            int    `json:"code"`
-	Message         string `json:"msg"`
-	InternalError   error  `json:"-"`
-	InternalMessage string `json:"-"`
-	ErrorID         string `json:"error_id,omitempty"`
+	Code            int         `json:"code"`
+	Message         string      `json:"msg"`
+	InternalError   error       `json:"-"`
+	InternalMessage string      `json:"-"`
+	ErrorID         string      `json:"error_id,omitempty"`
+	Data            interface{} `json:"data,omitempty"`
 }
 
 func (e *HTTPError) Error() string {
@@ -58,7 +71,13 @@ func (e *HTTPError) WithInternalError(err error) *HTTPError {
 
 // WithInternalMessage adds internal message information to the error
 func (e *HTTPError) WithInternalMessage(fmtString string, args ...interface{}) *HTTPError {
-	e.InternalMessage = fmt.Sprintf(fmtString, args)
+	e.InternalMessage = fmt.Sprintf(fmtString, args...)
+	return e
+}
+
+// WithData adds details that are sent along with the error message
+func (e *HTTPError) WithData(data interface{}) *HTTPError {
+	e.Data = data
 	return e
 }
 
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// EventList is the feed of changes to the orders of the instance, newest first.
+// It can be filtered by order_id, user_id and type and is paged with cursors so
+// it can be consumed and resumed reliably. With direction=asc it is read oldest
+// first, and the last cursor picks up the events added since. It is only
+// available to admins.
+func (a *API) EventList(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	eventTable := a.db.NewScope(models.Event{}).QuotedTableName()
+	orderTable := a.db.NewScope(models.Order{}).QuotedTableName()
+	query := a.readDB(r).
+		Select(eventTable+".*").
+		Joins("JOIN "+orderTable+" as orders ON orders.id = "+eventTable+".order_id").
+		Where("orders.instance_id = ?", instanceID)
+
+	params := r.URL.Query()
+	query = addFilters(query, eventTable, params, []string{
+		"order_id",
+		"user_id",
+		"type",
+	})
+	from, to, err := getTimeQueryParams(params)
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+	if from != nil {
+		query = query.Where(eventTable+".created_at >= ?", from)
+	}
+	if to != nil {
+		query = query.Where(eventTable+".created_at <= ?", to)
+	}
+
+	query, page, err := keysetPaginate(r, query, eventTable)
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	events := []models.Event{}
+	if result := query.Find(&events); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	var last *keysetCursor
+	if len(events) > 0 {
+		event := events[len(events)-1]
+		last = &keysetCursor{CreatedAt: event.CreatedAt, ID: strconv.FormatUint(event.ID, 10)}
+	}
+	if next := page.next(len(events), last); next != nil {
+		addKeysetHeaders(w, r, next)
+	}
+
+	log.WithField("event_count", len(events)).Debugf("Successfully retrieved %d events", len(events))
+	return sendJSON(w, http.StatusOK, events)
+}
+
+// OrderEventList lists every change to an order, oldest first, with who made
+// it and the old and new values, so disputes can be investigated. It is only
+// available to admins.
+func (a *API) OrderEventList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	orderID := gcontext.GetOrderID(ctx)
+
+	order := &models.Order{}
+	if result := a.db.First(order, "id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx)); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	events := []models.Event{}
+	if result := a.db.Where("order_id = ?", order.ID).Order("created_at asc, id asc").Find(&events); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, events)
+}
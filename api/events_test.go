@@ -0,0 +1,143 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventList(t *testing.T) {
+	t.Run("Cursor", func(t *testing.T) {
+		test := NewRouteTest(t)
+		start := time.Now().Add(-time.Hour)
+		for i := 0; i < 3; i++ {
+			event := &models.Event{
+				OrderID:   test.Data.firstOrder.ID,
+				Type:      string(models.EventUpdated),
+				CreatedAt: start.Add(time.Duration(i) * time.Minute),
+			}
+			require.NoError(t, test.DB.Create(event).Error)
+		}
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodGet, "/events?per_page=2", nil, token)
+		first := []models.Event{}
+		extractPayload(t, http.StatusOK, recorder, &first)
+		require.Len(t, first, 2)
+		assert.True(t, first[0].CreatedAt.After(first[1].CreatedAt))
+		cursor := recorder.Header().Get("X-Next-Cursor")
+		require.NotEmpty(t, cursor)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/events?per_page=2&cursor="+cursor, nil, token)
+		second := []models.Event{}
+		extractPayload(t, http.StatusOK, recorder, &second)
+		require.Len(t, second, 1)
+		assert.True(t, first[1].CreatedAt.After(second[0].CreatedAt))
+		assert.Empty(t, recorder.Header().Get("X-Next-Cursor"))
+	})
+	t.Run("Ascending", func(t *testing.T) {
+		test := NewRouteTest(t)
+		start := time.Now().Add(-time.Hour)
+		for i := 0; i < 3; i++ {
+			event := &models.Event{
+				OrderID:   test.Data.firstOrder.ID,
+				Type:      string(models.EventUpdated),
+				CreatedAt: start.Add(time.Duration(i) * time.Minute),
+			}
+			require.NoError(t, test.DB.Create(event).Error)
+		}
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodGet, "/events?direction=asc&per_page=3", nil, token)
+		first := []models.Event{}
+		extractPayload(t, http.StatusOK, recorder, &first)
+		require.Len(t, first, 3)
+		assert.True(t, first[0].CreatedAt.Before(first[2].CreatedAt))
+		cursor := recorder.Header().Get("X-Next-Cursor")
+		require.NotEmpty(t, cursor)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/events?per_page=3&cursor="+cursor, nil, token)
+		none := []models.Event{}
+		extractPayload(t, http.StatusOK, recorder, &none)
+		assert.Empty(t, none)
+		assert.Equal(t, cursor, recorder.Header().Get("X-Next-Cursor"), "the feed is resumed from the same event")
+
+		later := &models.Event{OrderID: test.Data.firstOrder.ID, Type: string(models.EventUpdated), CreatedAt: time.Now()}
+		require.NoError(t, test.DB.Create(later).Error)
+		recorder = test.TestEndpoint(http.MethodGet, "/events?per_page=3&cursor="+cursor, nil, token)
+		next := []models.Event{}
+		extractPayload(t, http.StatusOK, recorder, &next)
+		require.Len(t, next, 1)
+		assert.Equal(t, later.ID, next[0].ID)
+	})
+	t.Run("EmptyPage", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodGet, "/events?per_page=0&type=nothing", nil, token)
+		events := []models.Event{}
+		extractPayload(t, http.StatusOK, recorder, &events)
+		assert.Empty(t, events)
+		assert.Empty(t, recorder.Header().Get("X-Next-Cursor"))
+	})
+	t.Run("BadCursor", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodGet, "/events?cursor=nope", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "malformed cursor")
+	})
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/events", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestOrderEventList(t *testing.T) {
+	t.Run("History", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("payment_state", models.PendingState).Error)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{
+			Email: "mrfreeze@dc.com",
+			State: models.PaidState,
+		}, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		w := runOrderTransactionRefund(test, &memProvider{name: payments.StripeProvider}, test.Data.firstTransaction, &RefundParams{Amount: 10})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"/events", nil, token)
+		events := []models.Event{}
+		extractPayload(t, http.StatusOK, recorder, &events)
+		require.Len(t, events, 3)
+
+		updated := events[0]
+		assert.Equal(t, string(models.EventUpdated), updated.Type)
+		assert.Equal(t, "admin-yo", updated.UserID)
+		assert.Equal(t, models.Change{From: "bruce@wayneindustries.com", To: "mrfreeze@dc.com"}, updated.Diff["email"])
+		assert.Equal(t, models.Change{From: models.PendingState, To: models.PaidState}, updated.Diff["state"])
+
+		assert.Equal(t, string(models.EventTransitioned), events[1].Type)
+
+		refunded := events[2]
+		assert.Equal(t, string(models.EventRefunded), refunded.Type)
+		assert.Equal(t, "magical-unicorn", refunded.UserID)
+		assert.EqualValues(t, 0, refunded.Diff["total_refunded"].From)
+		assert.EqualValues(t, 10, refunded.Diff["total_refunded"].To)
+	})
+	t.Run("MissingOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/does-not-exist/events", nil, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"/events", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/rates"
+)
+
+type exchangeRatesResponse struct {
+	Source string `json:"source"`
+	*rates.Snapshot
+}
+
+// ExchangeRatesView returns the exchange rates in effect on the day of the
+// date parameter, today by default. The base parameter changes the currency
+// the rates are for.
+func (a *API) ExchangeRatesView(w http.ResponseWriter, r *http.Request) error {
+	source := a.config.ExchangeRates.Source
+	if source == "" {
+		return notFoundError("Exchange rates are not set up")
+	}
+
+	params := r.URL.Query()
+	date := params.Get("date")
+	if date == "" {
+		date = time.Now().UTC().Format(rates.DateFormat)
+	} else if _, err := time.Parse(rates.DateFormat, date); err != nil {
+		return badRequestError("bad value for 'date' parameter, expected YYYY-MM-DD")
+	}
+
+	snapshot, err := models.GetExchangeRates(a.readDB(r), source, date)
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	if snapshot == nil {
+		return notFoundError("No exchange rates for %v", date)
+	}
+	if base := strings.ToUpper(params.Get("base")); base != "" {
+		snapshot, err = snapshot.Rebase(base)
+		if err != nil {
+			return badRequestError(err.Error())
+		}
+	}
+
+	return sendJSON(w, http.StatusOK, &exchangeRatesResponse{Source: source, Snapshot: snapshot})
+}
+
+// salesConverter converts rows of sales to one currency, with the exchange
+// rates of the day the sales were made on.
+type salesConverter struct {
+	a         *API
+	r         *http.Request
+	currency  string
+	snapshots map[string]*rates.Snapshot
+}
+
+func (c *salesConverter) convert(row *salesRow, day string) *HTTPError {
+	snapshot, ok := c.snapshots[day]
+	if !ok {
+		var err error
+		snapshot, err = models.GetExchangeRates(c.a.readDB(c.r), c.a.config.ExchangeRates.Source, day)
+		if err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		c.snapshots[day] = snapshot
+	}
+	if snapshot == nil {
+		return unprocessableEntityError("No exchange rates for %v", day)
+	}
+	for _, amount := range []*uint64{&row.Total, &row.SubTotal, &row.Taxes, &row.Shipping, &row.Refunded, &row.Cost} {
+		converted, err := snapshot.Convert(*amount, row.Currency, c.currency)
+		if err != nil {
+			return unprocessableEntityError("%v", err)
+		}
+		*amount = converted
+	}
+	row.Currency = c.currency
+	return nil
+}
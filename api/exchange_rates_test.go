@@ -0,0 +1,88 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/rates"
+)
+
+func saveTestExchangeRates(t *testing.T, test *RouteTest) {
+	test.GlobalConfig.ExchangeRates.Source = rates.ECB
+	require.NoError(t, models.SaveExchangeRates(test.DB, rates.ECB, &rates.Snapshot{Date: "2018-01-01", Base: "EUR", Rates: map[string]float64{"USD": 1.25, "GBP": 0.9}}))
+	require.NoError(t, models.SaveExchangeRates(test.DB, rates.ECB, &rates.Snapshot{Date: "2018-01-15", Base: "EUR", Rates: map[string]float64{"USD": 1.2}}))
+}
+
+func TestExchangeRates(t *testing.T) {
+	t.Run("NotSetUp", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/rates", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("ByDate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		saveTestExchangeRates(t, test)
+
+		result := &exchangeRatesResponse{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/rates?date=2018-01-06", nil, nil), result)
+		assert.Equal(t, "ecb", result.Source)
+		assert.Equal(t, "2018-01-01", result.Date, "the latest rates before the date apply")
+		assert.Equal(t, "EUR", result.Base)
+		assert.Equal(t, map[string]float64{"USD": 1.25, "GBP": 0.9}, result.Rates)
+
+		result = &exchangeRatesResponse{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/rates", nil, nil), result)
+		assert.Equal(t, "2018-01-15", result.Date)
+
+		// rates saved again for a day replace the earlier ones
+		require.NoError(t, models.SaveExchangeRates(test.DB, rates.ECB, &rates.Snapshot{Date: "2018-01-15", Base: "EUR", Rates: map[string]float64{"USD": 1.21}}))
+		result = &exchangeRatesResponse{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/rates?date=2018-01-15", nil, nil), result)
+		assert.Equal(t, map[string]float64{"USD": 1.21}, result.Rates)
+	})
+	t.Run("Base", func(t *testing.T) {
+		test := NewRouteTest(t)
+		saveTestExchangeRates(t, test)
+
+		result := &exchangeRatesResponse{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/rates?date=2018-01-01&base=usd", nil, nil), result)
+		assert.Equal(t, "USD", result.Base)
+		assert.InDelta(t, 0.8, result.Rates["EUR"], 0.0001)
+
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodGet, "/rates?date=2018-01-01&base=JPY", nil, nil))
+	})
+	t.Run("BadDate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		saveTestExchangeRates(t, test)
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodGet, "/rates?date=yesterday", nil, nil))
+		validateError(t, http.StatusNotFound, test.TestEndpoint(http.MethodGet, "/rates?date=2017-12-31", nil, nil))
+	})
+}
+
+func TestSalesReportConverted(t *testing.T) {
+	test := newReportTest(t)
+	validateError(t, http.StatusBadRequest, runReport(test, "/reports/sales?convert_to=EUR"))
+
+	saveTestExchangeRates(t, test)
+	rows := []*salesRow{}
+	extractPayload(t, http.StatusOK, runReport(test, "/reports/sales?convert_to=eur"), &rows)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "EUR", rows[0].Currency)
+	assert.EqualValues(t, 2, rows[0].Count)
+	first := uint64(math.Floor(float64(test.Data.firstOrder.Total)/1.25 + 0.5))
+	second := uint64(math.Floor(float64(test.Data.secondOrder.Total)/1.2 + 0.5))
+	assert.Equal(t, first+second, rows[0].Total, "each order is converted with the rates of its day")
+
+	rows = []*salesRow{}
+	extractPayload(t, http.StatusOK, runReport(test, "/reports/sales?convert_to=EUR&interval=week"), &rows)
+	require.Len(t, rows, 2)
+	assert.Equal(t, first, rows[0].Total)
+	assert.Equal(t, second, rows[1].Total)
+
+	validateError(t, http.StatusUnprocessableEntity, runReport(test, "/reports/sales?convert_to=JPY"))
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// exportBatchSize is the number of orders loaded at a time by exports.
+var exportBatchSize = 500
+
+var orderExportColumns = []string{
+	"id", "invoice_number", "created_at", "email", "user_id",
+	"state", "payment_state", "fulfillment_state", "payment_processor",
+	"currency", "subtotal", "discount", "taxes", "total", "total_refunded",
+	"coupon_code", "vatnumber",
+	"billing_name", "billing_company", "billing_country",
+	"shipping_name", "shipping_country", "delivery_instructions",
+}
+
+// OrderExport streams all orders matching the filters of the order list, oldest
+// first. With format=csv (the default) every order is a row of totals and
+// addresses, with format=ndjson every line is the full JSON of an order. The
+// orders are loaded in batches, so exports of any size use little memory.
+// Amounts are in the lowest unit of the currency, like everywhere else.
+func (a *API) OrderExport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	params := r.URL.Query()
+
+	format := params.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		return badRequestError("Unknown export format '%v', use csv or ndjson", format)
+	}
+	if _, exists := params["sort"]; exists {
+		return badRequestError("Sorting is not supported for exports")
+	}
+
+	db := a.readDB(r)
+	orderTable := db.NewScope(models.Order{}).QuotedTableName()
+	query, err := parseOrderParams(orderQuery(db), params)
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+	query = query.Where(orderTable+".instance_id = ?", gcontext.GetInstanceID(ctx))
+	if userID := params.Get("user_id"); userID != "" {
+		query = query.Where(orderTable+".user_id = ?", userID)
+	}
+	query = query.Order(orderTable+".created_at asc", true).Order(orderTable + ".id asc").Limit(exportBatchSize)
+
+	var write func(order *models.Order) error
+	var flush func()
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="orders.csv"`)
+		out := csv.NewWriter(w)
+		write = func(order *models.Order) error {
+			return out.Write(orderExportRow(order))
+		}
+		flush = out.Flush
+		if err := out.Write(orderExportColumns); err != nil {
+			return err
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="orders.ndjson"`)
+		enc := json.NewEncoder(w)
+		write = func(order *models.Order) error {
+			return enc.Encode(order)
+		}
+		flush = func() {}
+	}
+
+	count, err := exportOrders(query, orderTable, write, func() {
+		flush()
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	})
+	if err != nil {
+		// The response has started already, so the client only notices the
+		// truncated export.
+		log.WithError(err).Errorf("Order export failed after %d orders", count)
+		return nil
+	}
+	log.WithField("order_count", count).Debug("Exported orders")
+	return nil
+}
+
+// exportOrders calls write for every order of the query, fetching the orders
+// in batches following their creation date. flush is called after every batch.
+func exportOrders(query *gorm.DB, table string, write func(*models.Order) error, flush func()) (int, error) {
+	count := 0
+	var last *models.Order
+	for {
+		batch := query
+		if last != nil {
+			batch = batch.Where(
+				table+".created_at > ? OR ("+table+".created_at = ? AND "+table+".id > ?)",
+				last.CreatedAt, last.CreatedAt, last.ID,
+			)
+		}
+		orders := []*models.Order{}
+		if rsp := batch.Find(&orders); rsp.Error != nil {
+			return count, rsp.Error
+		}
+		for _, order := range orders {
+			if err := write(order); err != nil {
+				return count, err
+			}
+			count++
+		}
+		flush()
+		if len(orders) < exportBatchSize {
+			return count, nil
+		}
+		last = orders[len(orders)-1]
+	}
+}
+
+func orderExportRow(order *models.Order) []string {
+	var invoiceNumber string
+	if order.InvoiceNumber != 0 {
+		invoiceNumber = strconv.FormatInt(order.InvoiceNumber, 10)
+	}
+	amount := func(value uint64) string {
+		return strconv.FormatUint(value, 10)
+	}
+	return []string{
+		order.ID, invoiceNumber, order.CreatedAt.UTC().Format(time.RFC3339), csvText(order.Email), order.UserID,
+		order.State, order.PaymentState, order.FulfillmentState, order.PaymentProcessor,
+		order.Currency, amount(order.SubTotal), amount(order.Discount), amount(order.Taxes), amount(order.Total), amount(order.TotalRefunded),
+		csvText(order.CouponCode), csvText(order.VATNumber),
+		csvText(order.BillingAddress.Name), csvText(order.BillingAddress.Company), csvText(order.BillingAddress.Country),
+		csvText(order.ShippingAddress.Name), csvText(order.ShippingAddress.Country), csvText(order.DeliveryInstructions),
+	}
+}
+
+// csvText keeps spreadsheets from evaluating text entered by buyers as a
+// formula.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
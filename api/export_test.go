@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderExport(t *testing.T) {
+	t.Run("CSV", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/export?format=csv", nil, testAdminToken("admin", ""))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "text/csv; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+		rows, err := csv.NewReader(recorder.Body).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, rows, 3)
+		assert.Equal(t, orderExportColumns, rows[0])
+		ids := []string{rows[1][0], rows[2][0]}
+		assert.Contains(t, ids, test.Data.firstOrder.ID)
+		assert.Contains(t, ids, test.Data.secondOrder.ID)
+	})
+	t.Run("NDJSON", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/export?format=ndjson&payment_state=paid", nil, testAdminToken("admin", ""))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+		for _, line := range lines {
+			order := &models.Order{}
+			require.NoError(t, json.Unmarshal([]byte(line), order))
+			assert.Equal(t, models.PaidState, order.PaymentState)
+		}
+	})
+	t.Run("Batches", func(t *testing.T) {
+		defer func(size int) { exportBatchSize = size }(exportBatchSize)
+		exportBatchSize = 1
+
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/export?format=ndjson", nil, testAdminToken("admin", ""))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+		assert.Len(t, lines, 2)
+	})
+	t.Run("UserFilter", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/export?user_id=nobody", nil, testAdminToken("admin", ""))
+		rows, err := csv.NewReader(recorder.Body).ReadAll()
+		require.NoError(t, err)
+		assert.Len(t, rows, 1)
+	})
+	t.Run("Formulas", func(t *testing.T) {
+		assert.Equal(t, "'=HYPERLINK(\"x\")", csvText("=HYPERLINK(\"x\")"))
+		assert.Equal(t, "Bruce Wayne", csvText("Bruce Wayne"))
+	})
+	t.Run("BadFormat", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/export?format=xml", nil, testAdminToken("admin", ""))
+		validateError(t, http.StatusBadRequest, recorder, "csv or ndjson")
+	})
+	t.Run("NotWithAdminRights", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/export", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
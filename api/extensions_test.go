@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/extensions"
+	"github.com/netlify/gocommerce/models"
+)
+
+type testExtension struct {
+	validated *models.Order
+}
+
+func (e *testExtension) Name() string { return "test" }
+
+func (e *testExtension) ValidateOrder(ctx context.Context, order *models.Order) error {
+	if order.Email == "blocked@example.com" {
+		return errors.New("This email address is blocked")
+	}
+	e.validated = order
+	return nil
+}
+
+func (e *testExtension) AdjustPrice(ctx context.Context, order *models.Order, item *models.LineItem) error {
+	item.Price = 1
+	return nil
+}
+
+func (e *testExtension) EnrichWebhook(ctx context.Context, hookType string, payload map[string]interface{}) error {
+	payload["erp_reference"] = "ERP-" + hookType
+	return nil
+}
+
+func TestExtensions(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	ext := &testExtension{}
+	extensions.Register(ext)
+	defer extensions.Unregister(ext.Name())
+
+	orderBody := func(email string) *strings.Reader {
+		return strings.NewReader(`{
+			"email": "` + email + `",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 2}]
+		}`)
+	}
+
+	t.Run("OrderCreate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Webhooks.Order = "https://example.com/hooks/order"
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", orderBody("info@example.com"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.EqualValues(t, 2, order.SubTotal)
+		require.NotNil(t, ext.validated)
+		assert.Equal(t, order.ID, ext.validated.ID)
+
+		hook := &models.Hook{}
+		require.NoError(t, test.DB.First(hook, "type = ?", models.OrderCreatedHook).Error)
+		payload := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(hook.Payload), &payload))
+		assert.Equal(t, "ERP-"+models.OrderCreatedHook, payload["erp_reference"])
+		assert.Equal(t, order.ID, payload["id"])
+	})
+	t.Run("OrderRejected", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", orderBody("blocked@example.com"), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "This email address is blocked")
+		assert.True(t, test.DB.First(&models.Order{}, "email = ?", "blocked@example.com").RecordNotFound())
+	})
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type funnelRow struct {
+	Step       string  `json:"step"`
+	Checkouts  uint64  `json:"checkouts"`
+	Conversion float64 `json:"conversion"`
+	// TotalConversion is the share of all checkouts that reached the step.
+	TotalConversion float64 `json:"total_conversion"`
+	// MedianSeconds is the median time since the previous step, of the
+	// checkouts that reached both.
+	MedianSeconds *float64 `json:"median_seconds,omitempty"`
+}
+
+// FunnelReport lists how many checkouts reached each step, from previewing
+// the cart to paying the order, with the conversion from the step before and
+// the median time it took. Checkouts count in the period they started in. A
+// checkout that reached a step counts for the steps before it too, since
+// orders can be created without previewing the cart first.
+func (a *API) FunnelReport(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	from, to, err := getTimeQueryParams(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	db := a.readDB(r)
+	table := db.NewScope(models.FunnelEvent{}).QuotedTableName()
+	started := "SELECT checkout_id FROM " + table + " WHERE instance_id = ? GROUP BY checkout_id"
+	args := []interface{}{instanceID}
+	having := []string{}
+	if from != nil {
+		having = append(having, "min(created_at) >= ?")
+		args = append(args, from)
+	}
+	if to != nil {
+		having = append(having, "min(created_at) <= ?")
+		args = append(args, to)
+	}
+	if len(having) > 0 {
+		started += " HAVING " + strings.Join(having, " AND ")
+	}
+
+	events := []*models.FunnelEvent{}
+	query := db.Where("instance_id = ?", instanceID).Where("checkout_id IN ("+started+")", args...).Order("created_at asc")
+	if rsp := query.Find(&events); rsp.Error != nil {
+		return internalServerError("Database error").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, funnelReport(events))
+}
+
+func funnelReport(events []*models.FunnelEvent) []*funnelRow {
+	index := map[string]int{}
+	for i, step := range models.FunnelSteps {
+		index[step] = i
+	}
+	checkouts := map[string][]*time.Time{}
+	for _, event := range events {
+		i, ok := index[event.Step]
+		if !ok {
+			continue
+		}
+		reached := checkouts[event.CheckoutID]
+		if reached == nil {
+			reached = make([]*time.Time, len(models.FunnelSteps))
+			checkouts[event.CheckoutID] = reached
+		}
+		createdAt := event.CreatedAt
+		reached[i] = &createdAt
+	}
+
+	counts := make([]uint64, len(models.FunnelSteps))
+	durations := make([][]float64, len(models.FunnelSteps))
+	for _, reached := range checkouts {
+		last := 0
+		for i, at := range reached {
+			if at == nil {
+				continue
+			}
+			last = i
+			if i > 0 && reached[i-1] != nil {
+				durations[i] = append(durations[i], at.Sub(*reached[i-1]).Seconds())
+			}
+		}
+		for i := 0; i <= last; i++ {
+			counts[i]++
+		}
+	}
+
+	result := make([]*funnelRow, len(models.FunnelSteps))
+	for i, step := range models.FunnelSteps {
+		row := &funnelRow{Step: step, Checkouts: counts[i], MedianSeconds: median(durations[i])}
+		if counts[0] > 0 {
+			row.TotalConversion = float64(counts[i]) / float64(counts[0])
+		}
+		if i == 0 {
+			row.Conversion = row.TotalConversion
+		} else if counts[i-1] > 0 {
+			row.Conversion = float64(counts[i]) / float64(counts[i-1])
+		}
+		result[i] = row
+	}
+	return result
+}
+
+func median(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	m := values[len(values)/2]
+	if len(values)%2 == 0 {
+		m = (values[len(values)/2-1] + m) / 2
+	}
+	return &m
+}
+
+// recordFunnelStep records a step of the checkout of an order. Failing to
+// record it doesn't fail the request.
+func recordFunnelStep(db *gorm.DB, order *models.Order, step string, log logrus.FieldLogger) {
+	if err := models.RecordOrderFunnelStep(db, order, step); err != nil {
+		log.WithError(err).WithField("step", step).Error("Error recording checkout step")
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestFunnelReport(t *testing.T) {
+	test := NewRouteTest(t)
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	record := func(instanceID, checkoutID, step string, after time.Duration) {
+		event := &models.FunnelEvent{InstanceID: instanceID, CheckoutID: checkoutID, Step: step}
+		require.NoError(t, test.DB.Create(event).Error)
+		require.NoError(t, test.DB.Model(event).UpdateColumn("created_at", start.Add(after)).Error)
+	}
+	record("", "a", models.CartPreviewedStep, 0)
+	record("", "a", models.OrderCreatedStep, time.Minute)
+	record("", "a", models.PaymentAttemptedStep, 90*time.Second)
+	record("", "a", models.PaidStep, 100*time.Second)
+	record("", "b", models.CartPreviewedStep, 0)
+	record("", "b", models.OrderCreatedStep, 3*time.Minute)
+	record("", "c", models.CartPreviewedStep, time.Hour)
+	// orders can be created without previewing the cart
+	record("", "d", models.OrderCreatedStep, 0)
+	record("other", "e", models.CartPreviewedStep, 0)
+	record("", "f", models.CartPreviewedStep, -48*time.Hour)
+	record("", "f", models.OrderCreatedStep, time.Minute)
+
+	rows := []*funnelRow{}
+	extractPayload(t, http.StatusOK, runReport(test, fmt.Sprintf("/reports/funnel?from=%d", start.Add(-time.Hour).Unix())), &rows)
+	require.Len(t, rows, 4)
+	assert.Equal(t, models.CartPreviewedStep, rows[0].Step)
+	assert.EqualValues(t, 4, rows[0].Checkouts, "checkouts started before the period don't count")
+	assert.Nil(t, rows[0].MedianSeconds)
+	assert.Equal(t, models.OrderCreatedStep, rows[1].Step)
+	assert.EqualValues(t, 3, rows[1].Checkouts)
+	assert.InDelta(t, 0.75, rows[1].Conversion, 0.0001)
+	require.NotNil(t, rows[1].MedianSeconds)
+	assert.InDelta(t, 120, *rows[1].MedianSeconds, 0.0001)
+	assert.EqualValues(t, 1, rows[2].Checkouts)
+	assert.InDelta(t, 1.0/3, rows[2].Conversion, 0.0001)
+	assert.InDelta(t, 30, *rows[2].MedianSeconds, 0.0001)
+	assert.Equal(t, models.PaidStep, rows[3].Step)
+	assert.EqualValues(t, 1, rows[3].Checkouts)
+	assert.InDelta(t, 1, rows[3].Conversion, 0.0001)
+	assert.InDelta(t, 0.25, rows[3].TotalConversion, 0.0001)
+	assert.InDelta(t, 10, *rows[3].MedianSeconds, 0.0001)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/reports/funnel", nil, test.Data.testUserToken)
+	validateError(t, http.StatusUnauthorized, recorder)
+}
+
+func TestFunnelSteps(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	body := strings.NewReader(`{
+		"session_id": "checkout-1",
+		"email": "info@example.com",
+		"shipping_address": {
+			"name": "Test User",
+			"address1": "610 22nd Street",
+			"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, test.TestEndpoint(http.MethodPost, "/orders", body, nil), order)
+
+	events := []*models.FunnelEvent{}
+	require.NoError(t, test.DB.Where("checkout_id = ?", "checkout-1").Find(&events).Error)
+	require.Len(t, events, 1)
+	assert.Equal(t, models.OrderCreatedStep, events[0].Step)
+	assert.Equal(t, order.ID, events[0].OrderID)
+
+	// steps are only recorded the first time
+	require.NoError(t, models.RecordOrderFunnelStep(test.DB, order, models.OrderCreatedStep))
+	count := 0
+	require.NoError(t, test.DB.Model(models.FunnelEvent{}).Where("checkout_id = ?", "checkout-1").Count(&count).Error)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// giftCardAlphabet leaves out characters that are easily mistaken for each
+// other, like 0 and O.
+const giftCardAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const giftCardCodeLength = 16
+
+// GiftCardParams holds the parameters for issuing a gift card.
+type GiftCardParams struct {
+	Code      string     `json:"code"`
+	Balance   uint64     `json:"balance"`
+	Currency  string     `json:"currency"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Note      string     `json:"note"`
+}
+
+// giftCardBalance is what buyers get to see of a gift card.
+type giftCardBalance struct {
+	Code      string     `json:"code"`
+	Balance   uint64     `json:"balance"`
+	Currency  string     `json:"currency"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Expired   bool       `json:"expired"`
+}
+
+// GiftCardList lists the issued gift cards, newest first. It is only
+// available to admins.
+func (a *API) GiftCardList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	query := a.readDB(r).Where("instance_id = ?", instanceID)
+
+	offset, limit, err := paginate(w, r, query.Model(&models.GiftCard{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	cards := []models.GiftCard{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&cards); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, cards)
+}
+
+// GiftCardCreate issues a gift card with a balance. Without a code, a random
+// one is generated. It is only available to admins.
+func (a *API) GiftCardCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+	claims := gcontext.GetClaims(ctx)
+	log := getLogEntry(r)
+
+	params := &GiftCardParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Balance == 0 {
+		return badRequestError("A gift card requires a balance")
+	}
+	if params.Currency == "" {
+		return badRequestError("A gift card requires a currency")
+	}
+
+	code := normalizeGiftCardCode(params.Code)
+	if code == "" {
+		var err error
+		if code, err = generateGiftCardCode(); err != nil {
+			return internalServerError("Error generating gift card code").WithInternalError(err)
+		}
+	}
+	existing, err := models.GetGiftCard(a.db, instanceID, code)
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if existing != nil {
+		return conflictError("A gift card with the code %v already exists", code)
+	}
+
+	card := &models.GiftCard{
+		InstanceID:     instanceID,
+		ID:             uuid.NewRandom().String(),
+		Code:           code,
+		Currency:       strings.ToUpper(params.Currency),
+		InitialBalance: params.Balance,
+		Balance:        params.Balance,
+		ExpiresAt:      params.ExpiresAt,
+		Note:           params.Note,
+		IssuedBy:       claims.Subject,
+	}
+	if rsp := a.db.Create(card); rsp.Error != nil {
+		return internalServerError("Error saving gift card").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("gift_card_id", card.ID).Infof("Issued gift card of %d %s", card.Balance, card.Currency)
+	return sendJSON(w, http.StatusCreated, card)
+}
+
+// GiftCardView returns the remaining balance of a gift card. Admins get the
+// full gift card.
+func (a *API) GiftCardView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	code := normalizeGiftCardCode(chi.URLParam(r, "code"))
+
+	card, err := models.GetGiftCard(a.db, gcontext.GetInstanceID(ctx), code)
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if card == nil {
+		return notFoundError("Gift card not found")
+	}
+	if gcontext.HasScope(ctx, giftCardsReadScope) {
+		return sendJSON(w, http.StatusOK, card)
+	}
+	return sendJSON(w, http.StatusOK, &giftCardBalance{
+		Code:      card.Code,
+		Balance:   card.Balance,
+		Currency:  card.Currency,
+		ExpiresAt: card.ExpiresAt,
+		Expired:   card.Expired(),
+	})
+}
+
+// redeemGiftCard takes up to amount off the balance of a gift card to pay for
+// an order. It returns the gift card and the amount that was taken off.
+func redeemGiftCard(tx *gorm.DB, order *models.Order, code string, amount uint64) (*models.GiftCard, uint64, *HTTPError) {
+	card, err := models.GetGiftCard(tx, order.InstanceID, normalizeGiftCardCode(code))
+	if err != nil {
+		return nil, 0, internalServerError("Error during database query").WithInternalError(err)
+	}
+	if card == nil {
+		return nil, 0, badRequestError("Unknown gift card %v", code)
+	}
+	if card.Expired() {
+		return nil, 0, badRequestError("The gift card expired at %v", card.ExpiresAt.Format(time.RFC3339))
+	}
+	if card.Currency != order.Currency {
+		return nil, 0, badRequestError("The gift card is in %v, but the order is in %v", card.Currency, order.Currency)
+	}
+	if card.Balance == 0 {
+		return nil, 0, badRequestError("The gift card has no balance left")
+	}
+
+	if card.Balance < amount {
+		amount = card.Balance
+	}
+	redeemed, err := models.RedeemGiftCard(tx, card, amount)
+	if err != nil {
+		return nil, 0, internalServerError("Error updating gift card balance").WithInternalError(err)
+	}
+	if !redeemed {
+		return nil, 0, conflictError("The balance of the gift card changed, please try again")
+	}
+	return card, amount, nil
+}
+
+func normalizeGiftCardCode(code string) string {
+	return strings.ToUpper(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+func generateGiftCardCode() (string, error) {
+	data := make([]byte, giftCardCodeLength)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	for i, b := range data {
+		data[i] = giftCardAlphabet[int(b)%len(giftCardAlphabet)]
+	}
+	return string(data), nil
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func issueGiftCard(test *RouteTest, code string, balance uint64) *models.GiftCard {
+	card := &models.GiftCard{
+		ID:             "card-" + code,
+		Code:           code,
+		Currency:       "USD",
+		InitialBalance: balance,
+		Balance:        balance,
+	}
+	require.NoError(test.T, test.DB.Create(card).Error)
+	return card
+}
+
+func giftCardBalanceOf(test *RouteTest, code string) uint64 {
+	card, err := models.GetGiftCard(test.DB, "", code)
+	require.NoError(test.T, err)
+	require.NotNil(test.T, card)
+	return card.Balance
+}
+
+func payWithGiftCard(test *RouteTest, params map[string]interface{}) *httptest.ResponseRecorder {
+	site := startTestSite()
+	defer site.Close()
+	test.Config.SiteURL = site.URL
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(test.T, test.DB.Save(test.Data.firstOrder).Error)
+
+	params["amount"] = test.Data.firstOrder.Total
+	params["currency"] = test.Data.firstOrder.Currency
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+	return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+}
+
+func TestGiftCardCreate(t *testing.T) {
+	t.Run("GeneratedCode", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/gift-cards", strings.NewReader(`{"balance": 5000, "currency": "usd"}`), token)
+
+		card := &models.GiftCard{}
+		extractPayload(t, http.StatusCreated, recorder, card)
+		assert.Len(t, card.Code, giftCardCodeLength)
+		assert.Equal(t, "USD", card.Currency)
+		assert.EqualValues(t, 5000, card.Balance)
+		assert.Equal(t, "magical-unicorn", card.IssuedBy)
+	})
+	t.Run("DuplicateCode", func(t *testing.T) {
+		test := NewRouteTest(t)
+		issueGiftCard(test, "WELCOME", 1000)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/gift-cards", strings.NewReader(`{"code": "welcome", "balance": 5000, "currency": "USD"}`), token)
+		validateError(t, http.StatusConflict, recorder)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/gift-cards", strings.NewReader(`{"balance": 5000, "currency": "USD"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestGiftCardView(t *testing.T) {
+	test := NewRouteTest(t)
+	issueGiftCard(test, "ABCD2345", 1500)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/gift-cards/abcd-2345", nil, nil)
+	balance := &giftCardBalance{}
+	extractPayload(t, http.StatusOK, recorder, balance)
+	assert.Equal(t, "ABCD2345", balance.Code)
+	assert.EqualValues(t, 1500, balance.Balance)
+	assert.False(t, balance.Expired)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/gift-cards/UNKNOWN", nil, nil)
+	validateError(t, http.StatusNotFound, recorder)
+}
+
+func TestGiftCardPayment(t *testing.T) {
+	t.Run("FullyCovered", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(test, "COVERSALL", 1000)
+
+		recorder := payWithGiftCard(test, map[string]interface{}{"gift_card": "coversall"})
+		trans := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, trans)
+		assert.Equal(t, card.ID, trans.GiftCardID)
+		assert.Equal(t, test.Data.firstOrder.Total, trans.Amount)
+		assert.Equal(t, 1000-test.Data.firstOrder.Total, giftCardBalanceOf(test, "COVERSALL"))
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, models.GiftCardProcessor, order.PaymentProcessor)
+	})
+	t.Run("Remainder", func(t *testing.T) {
+		var charged []string
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {
+			if path == "/charges" {
+				charged = append(charged, body.Get("amount")...)
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		test := NewRouteTest(t)
+		issueGiftCard(test, "PARTIAL", 10)
+
+		recorder := payWithGiftCard(test, map[string]interface{}{
+			"gift_card":    "PARTIAL",
+			"provider":     payments.StripeProvider,
+			"stripe_token": "123456",
+		})
+		trans := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, trans)
+		assert.Empty(t, trans.GiftCardID)
+		assert.Equal(t, test.Data.firstOrder.Total-10, trans.Amount)
+		assert.Equal(t, []string{"14"}, charged)
+		assert.EqualValues(t, 0, giftCardBalanceOf(test, "PARTIAL"))
+
+		transactions := []models.Transaction{}
+		require.NoError(t, test.DB.Where("order_id = ? AND status = ?", test.Data.firstOrder.ID, models.PaidState).Find(&transactions).Error)
+		var paid uint64
+		for _, t := range transactions {
+			if t.ID != test.Data.firstTransaction.ID {
+				paid += t.Amount
+			}
+		}
+		assert.Equal(t, test.Data.firstOrder.Total, paid)
+	})
+	t.Run("RemainderWithoutProvider", func(t *testing.T) {
+		test := NewRouteTest(t)
+		issueGiftCard(test, "PARTIAL", 10)
+
+		recorder := payWithGiftCard(test, map[string]interface{}{"gift_card": "PARTIAL"})
+		validateError(t, http.StatusBadRequest, recorder, "requires specifying a 'provider'")
+		assert.EqualValues(t, 10, giftCardBalanceOf(test, "PARTIAL"))
+	})
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(test, "OLD", 1000)
+		require.NoError(t, test.DB.Model(card).UpdateColumn("expires_at", "2001-01-01 00:00:00").Error)
+
+		recorder := payWithGiftCard(test, map[string]interface{}{"gift_card": "OLD"})
+		validateError(t, http.StatusBadRequest, recorder, "expired")
+		assert.EqualValues(t, 1000, giftCardBalanceOf(test, "OLD"))
+	})
+}
+
+func TestGiftCardRefund(t *testing.T) {
+	test := NewRouteTest(t)
+	card := issueGiftCard(test, "REFUNDME", 0)
+	trans := models.NewTransaction(test.Data.firstOrder)
+	trans.ID = "gift-card-trans"
+	trans.Amount = 20
+	trans.Status = models.PaidState
+	trans.GiftCardID = card.ID
+	trans.ProcessorID = card.Code
+	require.NoError(t, test.DB.Create(trans).Error)
+
+	provider := &memProvider{name: payments.StripeProvider}
+	w := runOrderTransactionRefund(test, provider, trans, &RefundParams{Amount: 15})
+
+	rsp := new(models.Transaction)
+	extractPayload(t, http.StatusOK, w, rsp)
+	assert.Equal(t, models.PaidState, rsp.Status)
+	assert.Equal(t, card.ID, rsp.GiftCardID)
+	assert.Empty(t, provider.refundCalls)
+	assert.EqualValues(t, 15, giftCardBalanceOf(test, "REFUNDME"))
+	assert.Equal(t, trans.ID, rsp.ChargeID)
+
+	// the order was paid for with more than the gift card
+	w = runOrderTransactionRefund(test, provider, trans, &RefundParams{Amount: 15})
+	validateError(t, http.StatusBadRequest, w, "remaining balance of 5 on the transaction")
+	assert.EqualValues(t, 15, giftCardBalanceOf(test, "REFUNDME"))
+
+	w = runOrderTransactionRefund(test, provider, trans, &RefundParams{Amount: 5})
+	extractPayload(t, http.StatusOK, w, rsp)
+	assert.EqualValues(t, 20, giftCardBalanceOf(test, "REFUNDME"))
+}
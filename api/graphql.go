@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/graphql"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	maxGraphQLOrders = 100
+	// maxGraphQLDepth and maxGraphQLCost keep nested lists, like the orders
+	// of the users of orders, from loading a large part of the database in
+	// one request.
+	maxGraphQLDepth = 6
+	maxGraphQLCost  = 10000
+)
+
+var errGraphQLDatabase = errors.New("Error during database query")
+
+// graphqlLineItem is a line item with the downloads of its order, which are
+// stored on the order.
+type graphqlLineItem struct {
+	*models.LineItem
+	order *models.Order
+}
+
+// GraphQL runs a GraphQL query against orders, their line items, downloads
+// and transactions, and users. The same rules apply as to the REST endpoints
+// of the data: users see their own orders and anonymous orders by ID, and
+// other users' data takes the matching permission scopes.
+func (a *API) GraphQL(w http.ResponseWriter, r *http.Request) error {
+	req := &graphql.Request{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return badRequestError("Could not read GraphQL request: %v", err)
+	}
+	if req.Query == "" {
+		return badRequestError("A GraphQL request must have a query")
+	}
+
+	rsp := graphql.Execute(r.Context(), a.graphqlSchema(r), req)
+	return sendJSON(w, http.StatusOK, rsp)
+}
+
+// graphqlSchema returns the schema of the GraphQL API, with resolvers that
+// read from the database of a request.
+func (a *API) graphqlSchema(r *http.Request) *graphql.Schema {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+	db := a.readDB(r)
+
+	download := &graphql.Object{Name: "Download", Fields: scalarFields(
+		"id", "order_id", "line_item_id", "title", "sku", "format", "url", "downloads", "created_at",
+	)}
+	transaction := &graphql.Object{Name: "Transaction", Fields: scalarFields(
+		"id", "order_id", "processor_id", "user_id", "amount", "currency", "status", "type",
+		"failure_code", "failure_description", "dispute_id", "dispute_reason", "disputed_at", "created_at",
+	)}
+	address := &graphql.Object{Name: "Address", Fields: scalarFields(
+		"id", "name", "first_name", "last_name", "company", "address1", "address2", "city", "country",
+		"state", "zip", "created_at",
+	)}
+	lineItem := &graphql.Object{Name: "LineItem", Fields: scalarFields(
+		"id", "title", "sku", "type", "description", "path", "price", "vat", "price_items", "addons",
+		"addon_price", "price_list", "quantity", "refunded_quantity", "gift", "vendor", "meta",
+	)}
+	order := &graphql.Object{Name: "Order", Fields: scalarFields(
+		"id", "invoice_number", "user_id", "email", "currency", "locale", "taxes", "shipping",
+		"subtotal", "discount", "manual_discount", "adjustments", "total", "total_refunded",
+		"payment_state", "fulfillment_state", "state", "payment_processor", "shipping_method", "delivery_instructions",
+		"vatnumber", "reverse_charge", "meta", "coupon_code", "subscription_id", "price_list",
+		"created_at", "updated_at",
+	)}
+	user := &graphql.Object{Name: "User", Fields: scalarFields(
+		"id", "email", "groups", "created_at", "updated_at",
+	)}
+
+	orders := func(userID string, args map[string]interface{}) (interface{}, error) {
+		claims := gcontext.GetClaims(ctx)
+		if (claims == nil || claims.Subject != userID) && !gcontext.HasScope(ctx, ordersReadScope) {
+			return nil, errors.New("You don't have access to the orders of this user")
+		}
+		limit, err := graphql.IntArg(args, "limit", 50)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := graphql.IntArg(args, "offset", 0)
+		if err != nil {
+			return nil, err
+		}
+		if limit < 1 || limit > maxGraphQLOrders || offset < 0 {
+			return nil, errors.New("The limit must be between 1 and 100, and the offset can't be negative")
+		}
+
+		query := orderQuery(db).Where("instance_id = ?", instanceID)
+		if userID != "all" {
+			query = query.Where("user_id = ?", userID)
+		}
+		result := []*models.Order{}
+		if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&result); rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Error loading orders for GraphQL")
+			return nil, errGraphQLDatabase
+		}
+		return result, nil
+	}
+	findUser := func(userID string) (interface{}, error) {
+		u, err := models.GetUser(db, userID)
+		if err != nil {
+			log.WithError(err).Error("Error loading user for GraphQL")
+			return nil, errGraphQLDatabase
+		}
+		if u == nil || u.InstanceID != instanceID {
+			return nil, nil
+		}
+		if u.Groups, err = models.GetCustomerGroups(db, instanceID, u.ID); err != nil {
+			log.WithError(err).Error("Error loading customer groups for GraphQL")
+			return nil, errGraphQLDatabase
+		}
+		return u, nil
+	}
+
+	order.Fields["shipping_address"] = &graphql.Field{Type: address}
+	order.Fields["billing_address"] = &graphql.Field{Type: address}
+	order.Fields["line_items"] = &graphql.Field{Type: lineItem, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		o := p.Source.(*models.Order)
+		items := []*graphqlLineItem{}
+		for _, item := range o.LineItems {
+			items = append(items, &graphqlLineItem{LineItem: item, order: o})
+		}
+		return items, nil
+	}}
+	order.Fields["downloads"] = &graphql.Field{Type: download, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		o := p.Source.(*models.Order)
+		if o.PaymentState != models.PaidState {
+			return nil, errors.New("This order has not been completed yet")
+		}
+		return o.Downloads, nil
+	}}
+	order.Fields["transactions"] = &graphql.Field{Type: transaction, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		o := p.Source.(*models.Order)
+		if o.UserID == "" && !gcontext.HasScope(ctx, paymentsReadScope) {
+			return nil, errors.New("Anonymous orders must be accessed by admins")
+		}
+		return o.Transactions, nil
+	}}
+	order.Fields["user"] = &graphql.Field{Type: user, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		o := p.Source.(*models.Order)
+		if o.UserID == "" {
+			return nil, nil
+		}
+		claims := gcontext.GetClaims(ctx)
+		if (claims == nil || claims.Subject != o.UserID) && !gcontext.HasScope(ctx, usersReadScope) {
+			return nil, errors.New("You don't have access to this user")
+		}
+		return findUser(o.UserID)
+	}}
+
+	lineItem.Fields["downloads"] = &graphql.Field{Type: download, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		item := p.Source.(*graphqlLineItem)
+		if item.order.PaymentState != models.PaidState {
+			return nil, errors.New("This order has not been completed yet")
+		}
+		downloads := []models.Download{}
+		for _, d := range item.order.Downloads {
+			if d.LineItemID == item.ID {
+				downloads = append(downloads, d)
+			}
+		}
+		return downloads, nil
+	}}
+
+	user.Fields["orders"] = &graphql.Field{Type: order, ListSize: ordersListSize, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		return orders(p.Source.(*models.User).ID, p.Args)
+	}}
+
+	query := &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"order": {Type: order, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			id, err := graphql.StringArg(p.Args, "id")
+			if err != nil {
+				return nil, err
+			}
+			o := &models.Order{}
+			if rsp := orderQuery(db).Where("instance_id = ?", instanceID).First(o, "id = ?", id); rsp.Error != nil {
+				if rsp.RecordNotFound() {
+					return nil, errors.New("Order not found")
+				}
+				log.WithError(rsp.Error).Error("Error loading order for GraphQL")
+				return nil, errGraphQLDatabase
+			}
+			if !hasOrderAccess(ctx, o) {
+				return nil, errors.New("You don't have access to this order")
+			}
+			return o, nil
+		}},
+		// orders lists the orders of the user, or of any user, or all users
+		// with "all", with the users:read and orders:read scopes.
+		"orders": {Type: order, ListSize: ordersListSize, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			claims := gcontext.GetClaims(ctx)
+			if claims == nil {
+				return nil, errors.New("No claims provided")
+			}
+			userID, err := graphql.StringArg(p.Args, "user_id")
+			if err != nil {
+				return nil, err
+			}
+			if userID == "" {
+				userID = claims.Subject
+			}
+			if userID != claims.Subject && !gcontext.HasScope(ctx, usersReadScope) {
+				return nil, errors.New("Can't access a different user unless you're an admin")
+			}
+			return orders(userID, p.Args)
+		}},
+		// user returns a user by ID, or the user making the request.
+		"user": {Type: user, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			claims := gcontext.GetClaims(ctx)
+			if claims == nil {
+				return nil, errors.New("No claims provided")
+			}
+			userID, err := graphql.StringArg(p.Args, "id")
+			if err != nil {
+				return nil, err
+			}
+			if userID == "" {
+				userID = claims.Subject
+			}
+			if userID != claims.Subject && !gcontext.HasScope(ctx, usersReadScope) {
+				return nil, errors.New("Can't access a different user unless you're an admin")
+			}
+			return findUser(userID)
+		}},
+	}}
+	return &graphql.Schema{Query: query, MaxDepth: maxGraphQLDepth, MaxCost: maxGraphQLCost}
+}
+
+// ordersListSize is the number of orders a list of orders returns at most
+// with the limit of a query.
+func ordersListSize(args map[string]interface{}) int {
+	limit, err := graphql.IntArg(args, "limit", 50)
+	if err != nil || limit < 1 || limit > maxGraphQLOrders {
+		return maxGraphQLOrders
+	}
+	return limit
+}
+
+// scalarFields returns fields that hold the properties of the JSON of their
+// object.
+func scalarFields(names ...string) map[string]*graphql.Field {
+	fields := map[string]*graphql.Field{}
+	for _, name := range names {
+		fields[name] = &graphql.Field{}
+	}
+	return fields
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type graphqlTestResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message string        `json:"message"`
+		Path    []interface{} `json:"path"`
+	} `json:"errors"`
+}
+
+func graphqlQuery(t *testing.T, test *RouteTest, query string, token *jwt.Token) *graphqlTestResponse {
+	body, err := json.Marshal(map[string]string{"query": query})
+	require.NoError(t, err)
+	recorder := test.TestEndpoint(http.MethodPost, "/graphql", strings.NewReader(string(body)), token)
+	rsp := &graphqlTestResponse{}
+	extractPayload(t, http.StatusOK, recorder, rsp)
+	return rsp
+}
+
+func TestGraphQL(t *testing.T) {
+	t.Run("NestedOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		rsp := graphqlQuery(t, test, `{
+			order(id: "first-order") {
+				id
+				total
+				line_items { sku quantity downloads { id } }
+				downloads { id title }
+				transactions { id amount status }
+				user { email }
+			}
+		}`, test.Data.testUserToken)
+		require.Empty(t, rsp.Errors)
+
+		order := rsp.Data["order"].(map[string]interface{})
+		assert.Equal(t, "first-order", order["id"])
+		assert.EqualValues(t, test.Data.firstOrder.Total, order["total"])
+		items := order["line_items"].([]interface{})
+		require.Len(t, items, 1)
+		assert.Equal(t, map[string]interface{}{"sku": "123-i-can-fly-456", "quantity": 2.0, "downloads": []interface{}{}}, items[0])
+		assert.Equal(t, []interface{}{map[string]interface{}{"id": "first-download", "title": "batwing"}}, order["downloads"])
+		assert.Equal(t, []interface{}{map[string]interface{}{"id": "first-trans", "amount": 100.0, "status": "paid"}}, order["transactions"])
+		assert.Equal(t, map[string]interface{}{"email": "bruce@wayneindustries.com"}, order["user"])
+	})
+
+	t.Run("OtherUsers", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken("stranger", "stranger@example.com")
+		rsp := graphqlQuery(t, test, `{ order(id: "first-order") { id } user(id: "i-am-batman") { id } orders { id } }`, token)
+		assert.Nil(t, rsp.Data["order"])
+		assert.Nil(t, rsp.Data["user"])
+		assert.Equal(t, []interface{}{}, rsp.Data["orders"])
+		require.Len(t, rsp.Errors, 2)
+		assert.Equal(t, "You don't have access to this order", rsp.Errors[0].Message)
+		assert.Equal(t, []interface{}{"user"}, rsp.Errors[1].Path)
+
+		rsp = graphqlQuery(t, test, `{ orders(user_id: "i-am-batman") { id } }`, testRoleToken("support-yo", "", "support"))
+		require.Len(t, rsp.Errors, 1, "roles need the users:read scope")
+
+		test.Config.JWT.Roles = map[string]string{"support": "users:read"}
+		rsp = graphqlQuery(t, test, `{ orders(user_id: "all") { id } }`, testRoleToken("support-yo", "", "support"))
+		require.Len(t, rsp.Errors, 1, "roles need the orders:read scope")
+		assert.Equal(t, "You don't have access to the orders of this user", rsp.Errors[0].Message)
+
+		test.Config.JWT.Roles = map[string]string{"support": "users:read orders:read"}
+		rsp = graphqlQuery(t, test, `{ orders(user_id: "i-am-batman") { id } }`, testRoleToken("support-yo", "", "support"))
+		require.Empty(t, rsp.Errors)
+		assert.Len(t, rsp.Data["orders"], 2)
+	})
+
+	t.Run("OtherInstance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		other := &models.User{InstanceID: "other-instance", ID: "robin", Email: "robin@example.com"}
+		require.NoError(t, test.DB.Create(other).Error)
+
+		rsp := graphqlQuery(t, test, `{ user(id: "robin") { id email } }`, testAdminToken("magical-unicorn", ""))
+		require.Empty(t, rsp.Errors)
+		assert.Nil(t, rsp.Data["user"])
+	})
+
+	t.Run("CurrentUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		rsp := graphqlQuery(t, test, `{ user { id orders(limit: 1) { id } } }`, test.Data.testUserToken)
+		require.Empty(t, rsp.Errors)
+		user := rsp.Data["user"].(map[string]interface{})
+		assert.Equal(t, "i-am-batman", user["id"])
+		assert.Len(t, user["orders"], 1)
+
+		rsp = graphqlQuery(t, test, `{ user { id } }`, nil)
+		assert.Equal(t, "No claims provided", rsp.Errors[0].Message)
+	})
+
+	t.Run("InvalidRequests", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/graphql", strings.NewReader(`{}`), nil)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		rsp := graphqlQuery(t, test, `{ order(id: "first-order") { id `, nil)
+		assert.Nil(t, rsp.Data)
+		require.Len(t, rsp.Errors, 1)
+	})
+}
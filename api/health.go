@@ -1,9 +1,33 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// readyTimeout limits how long each dependency check of the readiness probe
+// can take.
+const readyTimeout = 5 * time.Second
+
+// Statuses of dependencies in readiness checks.
+const (
+	dependencyOK      = "ok"
+	dependencyError   = "error"
+	dependencySkipped = "skipped"
 )
 
+var errNoHealthCheck = errors.New("The payment provider has no health check")
+
 // HealthCheck endpoint
 func (a *API) HealthCheck(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, map[string]string{
@@ -12,3 +36,134 @@ func (a *API) HealthCheck(w http.ResponseWriter, r *http.Request) error {
 		"description": "GoCommerce is a flexible Ecommerce API for JAMStack sites",
 	})
 }
+
+type dependencyStatus struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+	Error    string `json:"error,omitempty"`
+	Latency  int64  `json:"latency_ms"`
+}
+
+type readinessResponse struct {
+	Ready        bool                `json:"ready"`
+	Dependencies []*dependencyStatus `json:"dependencies"`
+}
+
+type dependencyCheck struct {
+	name     string
+	required bool
+	check    func(ctx context.Context) error
+}
+
+// ReadinessCheck checks the dependencies of gocommerce: the database, the
+// settings of the site and the payment providers. It responds with 503 when a
+// required dependency fails; payment providers aren't required, since orders
+// can still be placed and viewed while one of them is down. The site and the
+// payment providers are only checked when there is a single instance.
+func (a *API) ReadinessCheck(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	checks := []dependencyCheck{{name: "database", required: true, check: pingDB(a.db)}}
+	if a.replica != nil {
+		checks = append(checks, dependencyCheck{name: "database_replica", check: pingDB(a.replica)})
+	}
+	if config := gcontext.GetConfig(ctx); config != nil && !a.config.MultiInstanceMode {
+		url := config.SiteURL + settingsPath(config)
+		checks = append(checks, dependencyCheck{name: "settings", required: true, check: a.fetchSettings(url)})
+	}
+	providers := gcontext.GetPaymentProviders(ctx)
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		provider := providers[name]
+		checks = append(checks, dependencyCheck{name: "payments:" + name, check: func(ctx context.Context) error {
+			checker, ok := provider.(payments.HealthChecker)
+			if !ok {
+				return errNoHealthCheck
+			}
+			return checker.Ping(ctx)
+		}})
+	}
+
+	rsp := &readinessResponse{Ready: true, Dependencies: make([]*dependencyStatus, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c dependencyCheck) {
+			defer wg.Done()
+			rsp.Dependencies[i] = runDependencyCheck(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, d := range rsp.Dependencies {
+		if d.Required && d.Status == dependencyError {
+			rsp.Ready = false
+			status = http.StatusServiceUnavailable
+		}
+	}
+	return sendJSON(w, status, rsp)
+}
+
+func runDependencyCheck(ctx context.Context, c dependencyCheck) *dependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("No response after %v", readyTimeout)
+	}
+
+	status := &dependencyStatus{
+		Name:     c.name,
+		Status:   dependencyOK,
+		Required: c.required,
+		Latency:  int64(time.Since(start) / time.Millisecond),
+	}
+	switch err {
+	case nil:
+	case errNoHealthCheck:
+		status.Status = dependencySkipped
+	default:
+		status.Status = dependencyError
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func pingDB(db *gorm.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return db.DB().PingContext(ctx)
+	}
+}
+
+// fetchSettings checks the settings of the site can be fetched. Sites without
+// a settings file are fine, only failed requests and server errors count.
+func (a *API) fetchSettings(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := a.httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%v responded with %v", url, resp.Status)
+		}
+		return nil
+	}
+}
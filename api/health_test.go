@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+)
+
+func TestReadinessCheck(t *testing.T) {
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	statuses := func(rsp *readinessResponse) map[string]string {
+		result := map[string]string{}
+		for _, d := range rsp.Dependencies {
+			result[d.Name] = d.Status
+		}
+		return result
+	}
+
+	t.Run("Ready", func(t *testing.T) {
+		site := startTestSite()
+		defer site.Close()
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+
+		rsp := &readinessResponse{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/ready", nil, nil), rsp)
+		assert.True(t, rsp.Ready)
+		assert.Equal(t, map[string]string{
+			"database":        dependencyOK,
+			"settings":        dependencyOK,
+			"payments:stripe": dependencyOK,
+		}, statuses(rsp))
+	})
+
+	t.Run("SiteDown", func(t *testing.T) {
+		site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer site.Close()
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+
+		rsp := &readinessResponse{}
+		extractPayload(t, http.StatusServiceUnavailable, test.TestEndpoint(http.MethodGet, "/ready", nil, nil), rsp)
+		assert.False(t, rsp.Ready)
+		assert.Equal(t, dependencyError, statuses(rsp)["settings"])
+		assert.Equal(t, dependencyOK, statuses(rsp)["database"])
+	})
+
+	t.Run("DatabaseDown", func(t *testing.T) {
+		site := startTestSite()
+		defer site.Close()
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		require.NoError(t, test.DB.Close())
+
+		rsp := &readinessResponse{}
+		extractPayload(t, http.StatusServiceUnavailable, test.TestEndpoint(http.MethodGet, "/ready", nil, nil), rsp)
+		assert.Equal(t, dependencyError, statuses(rsp)["database"])
+	})
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/extensions"
+	"github.com/netlify/gocommerce/models"
+)
+
+const defaultValidationTimeout = 10 * time.Second
+
+// HookList lists the webhook deliveries of the instance, newest first. It can be
+// filtered by type, user_id, done and failed. It is only available to admins.
+func (a *API) HookList(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+	query := a.db.Where("instance_id = ?", instanceID)
+
+	params := r.URL.Query()
+	query = addFilters(query, a.db.NewScope(models.Hook{}).QuotedTableName(), params, []string{
+		"type",
+		"user_id",
+	})
+	for _, flag := range []string{"done", "failed"} {
+		if value := params.Get(flag); value != "" {
+			query = query.Where(flag+" = ?", value == "true")
+		}
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Hook{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	hooks := []models.Hook{}
+	if result := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&hooks); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	log.WithField("hook_count", len(hooks)).Debugf("Successfully retrieved %d hooks", len(hooks))
+	return sendJSON(w, http.StatusOK, hooks)
+}
+
+// HookView returns a single webhook delivery. It is only available to admins.
+func (a *API) HookView(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	hookID := chi.URLParam(r, "hook_id")
+
+	hook := &models.Hook{}
+	if result := a.db.Where("instance_id = ?", instanceID).First(hook, "id = ?", hookID); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Hook not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, hook)
+}
+
+// runOrderValidation calls the validation webhook of the instance, if any, with a new
+// order. A 4xx response rejects the order with the message of the response. When
+// the webhook can't be reached the order is rejected as well.
+func runOrderValidation(ctx context.Context, order *models.Order, log logrus.FieldLogger) *HTTPError {
+	config := gcontext.GetConfig(ctx)
+	if config.Webhooks.Validation == "" {
+		return nil
+	}
+
+	timeout := defaultValidationTimeout
+	if config.Webhooks.ValidationTimeout > 0 {
+		timeout = time.Duration(config.Webhooks.ValidationTimeout) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	hook := newHook(ctx, log, order.InstanceID, models.OrderValidateHook, config.Webhooks.Validation, order.UserID, order)
+	resp, err := hook.Trigger(client, log)
+	if err != nil {
+		return internalServerError("Error validating order").WithInternalError(err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		rejection := struct {
+			Message string `json:"message"`
+		}{}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if err := json.Unmarshal(body, &rejection); err != nil || rejection.Message == "" {
+			rejection.Message = "The order was rejected"
+		}
+		return badRequestError("%s", rejection.Message)
+	default:
+		return internalServerError("Error validating order").WithInternalMessage("Validation webhook responded with %v", resp.Status)
+	}
+}
+
+// newHook creates a webhook with the secret of the instance. The payload is
+// enriched by the registered extensions first.
+func newHook(ctx context.Context, log logrus.FieldLogger, instanceID, hookType, url, userID string, payload interface{}) *models.Hook {
+	config := gcontext.GetConfig(ctx)
+	enriched, err := extensions.EnrichWebhook(ctx, hookType, payload)
+	if err != nil {
+		log.WithError(err).Warnf("Sending %v webhook without extension fields", hookType)
+	}
+	return models.NewHook(instanceID, hookType, url, userID, config.Webhooks.Secret, enriched)
+}
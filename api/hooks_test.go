@@ -0,0 +1,76 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookList(t *testing.T) {
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Create(models.NewHook("", models.OrderCreatedHook, "https://example.com/hook", test.Data.testUser.ID, "", test.Data.firstOrder)).Error)
+		require.NoError(t, test.DB.Create(models.NewHook("", models.PaymentSucceededHook, "https://example.com/hook", test.Data.testUser.ID, "", test.Data.firstOrder)).Error)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodGet, "/hooks", nil, token)
+		hooks := []models.Hook{}
+		extractPayload(t, http.StatusOK, recorder, &hooks)
+		assert.Len(t, hooks, 2)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/hooks?type="+models.PaymentSucceededHook, nil, token)
+		hooks = []models.Hook{}
+		extractPayload(t, http.StatusOK, recorder, &hooks)
+		require.Len(t, hooks, 1)
+		assert.Equal(t, models.PaymentSucceededHook, hooks[0].Type)
+		assert.False(t, hooks[0].Done)
+	})
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/hooks", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestHookTrigger(t *testing.T) {
+	var event, signature, webhookID string
+	var header http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event = r.Header.Get("X-Commerce-Event")
+		signature = r.Header.Get("X-Commerce-Signature-256")
+		webhookID = r.Header.Get(webhooks.IDHeader)
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	hook := models.NewHook("", models.RefundIssuedHook, server.URL, "user", "hook-secret", map[string]string{"id": "refund"})
+	resp, err := hook.Trigger(http.DefaultClient, testLogger)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write(body)
+	assert.Equal(t, models.RefundIssuedHook, event)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature)
+
+	verifier := webhooks.NewVerifier("hook-secret")
+	assert.NoError(t, verifier.Verify(header, body))
+	assert.Empty(t, webhookID, "the hook wasn't stored")
+
+	hook.ID = 42
+	_, err = hook.Trigger(http.DefaultClient, testLogger)
+	require.NoError(t, err)
+	assert.Equal(t, "42", webhookID)
+	assert.NoError(t, verifier.Verify(header, body), "retries are signed with a new nonce")
+}
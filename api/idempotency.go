@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	defaultIdempotencyWindow = 24 * time.Hour
+	maxIdempotencyKeyLength  = 255
+	// idempotencyLease is how long the first request with a key is waited
+	// for. Keys without a response after that were left behind by a request
+	// that never finished, and are taken over by the next retry.
+	idempotencyLease = 2 * time.Minute
+)
+
+// idempotent makes a handler safe to retry. When a request carries an
+// Idempotency-Key header, the response is stored with the key, and later
+// requests with the same key get the stored response without calling the
+// handler again. Server errors aren't stored, so those requests can be
+// retried with the same key, and so can requests that didn't store their
+// response within the lease.
+func (a *API) idempotent(fn apiHandler) apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			return fn(w, r)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return badRequestError("%s can't be longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+		}
+
+		ctx := r.Context()
+		log := getLogEntry(r).WithField("idempotency_key", key)
+		instanceID := gcontext.GetInstanceID(ctx)
+		window := defaultIdempotencyWindow
+		if config := gcontext.GetConfig(ctx); config.Idempotency.Window > 0 {
+			window = time.Duration(config.Idempotency.Window) * time.Hour
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return internalServerError("Error reading body").WithInternalError(err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+
+		var userID string
+		if claims := gcontext.GetClaims(ctx); claims != nil {
+			userID = claims.Subject
+		}
+		record := &models.IdempotencyKey{
+			InstanceID:  instanceID,
+			Key:         key,
+			UserID:      userID,
+			RequestHash: hex.EncodeToString(hash.Sum(nil)),
+		}
+
+		expired := time.Now().Add(-window)
+		if rsp := a.db.Where("instance_id = ? AND created_at < ?", instanceID, expired).Delete(&models.IdempotencyKey{}); rsp.Error != nil {
+			return internalServerError("Error removing expired idempotency keys").WithInternalError(rsp.Error)
+		}
+		if rsp := a.db.Create(record); rsp.Error != nil {
+			existing := &models.IdempotencyKey{}
+			if rsp := a.db.First(existing, "instance_id = ? AND idempotency_key = ?", instanceID, key); rsp.Error != nil {
+				return internalServerError("Error storing idempotency key").WithInternalError(rsp.Error)
+			}
+			takenOver, err := takeOverIdempotencyKey(a.db, existing, record)
+			if err != nil {
+				return internalServerError("Error storing idempotency key").WithInternalError(err)
+			}
+			if !takenOver {
+				return replayIdempotentResponse(w, existing, record)
+			}
+			log.Info("Retrying the abandoned request of the idempotency key")
+			record = existing
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		if err := fn(recorder, r); err != nil {
+			handleError(err, recorder, r)
+		}
+
+		if recorder.status >= http.StatusInternalServerError {
+			if rsp := a.db.Delete(record); rsp.Error != nil {
+				log.WithError(rsp.Error).Error("Failed to release idempotency key")
+			}
+			return nil
+		}
+		rsp := a.db.Model(record).Updates(map[string]interface{}{
+			"status_code": recorder.status,
+			"response":    recorder.body.String(),
+		})
+		if rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Failed to store response for idempotency key")
+		}
+		return nil
+	}
+}
+
+// takeOverIdempotencyKey claims a key for a retry when the request it was
+// first used with didn't store a response within the lease. Only one retry
+// gets to take it over.
+func takeOverIdempotencyKey(db *gorm.DB, existing, retry *models.IdempotencyKey) (bool, error) {
+	if existing.Completed() || existing.UserID != retry.UserID || existing.RequestHash != retry.RequestHash {
+		return false, nil
+	}
+	cutoff := time.Now().Add(-idempotencyLease)
+	if !existing.UpdatedAt.Before(cutoff) {
+		return false, nil
+	}
+	rsp := db.Model(&models.IdempotencyKey{}).
+		Where("id = ? AND status_code = ? AND updated_at < ?", existing.ID, 0, cutoff).
+		UpdateColumn("updated_at", time.Now())
+	return rsp.RowsAffected == 1, rsp.Error
+}
+
+// replayIdempotentResponse answers a retry with the stored response of the
+// first request with the same key.
+func replayIdempotentResponse(w http.ResponseWriter, existing, retry *models.IdempotencyKey) error {
+	if existing.UserID != retry.UserID || existing.RequestHash != retry.RequestHash {
+		return unprocessableEntityError("%s was already used for a different request", idempotencyKeyHeader)
+	}
+	if !existing.Completed() {
+		return conflictError("A request with this %s is still being processed", idempotencyKeyHeader)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(existing.StatusCode)
+	_, err := w.Write([]byte(existing.Response))
+	return err
+}
+
+// responseRecorder passes a response on to the client while keeping a copy of
+// its status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
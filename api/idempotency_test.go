@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestIdempotentOrderCreate(t *testing.T) {
+	orderBody := `{
+		"email": "retry@example.com",
+		"shipping_address": {"name": "Test User", "address1": "Branengebranen", "city": "Berlin", "country": "Germany", "zip": "94107"},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`
+
+	t.Run("Replayed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		first := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		created := &models.Order{}
+		extractPayload(t, http.StatusCreated, first, created)
+		assert.Empty(t, first.Header().Get(idempotentReplayedHeader))
+
+		retry := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		replayed := &models.Order{}
+		extractPayload(t, http.StatusCreated, retry, replayed)
+		assert.Equal(t, "true", retry.Header().Get(idempotentReplayedHeader))
+		assert.Equal(t, created.ID, replayed.ID)
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("email = ?", "retry@example.com").Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+	t.Run("DifferentRequest", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		first := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		require.Equal(t, http.StatusCreated, first.Code)
+
+		other := strings.Replace(orderBody, `"quantity": 1`, `"quantity": 2`, 1)
+		retry := runIdempotent(test, http.MethodPost, "/orders", other, "retry-1", nil)
+		validateError(t, http.StatusUnprocessableEntity, retry, "different request")
+
+		retry = runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", test.Data.testUserToken)
+		validateError(t, http.StatusUnprocessableEntity, retry, "different request")
+	})
+	t.Run("InProgress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		first := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		require.Equal(t, http.StatusCreated, first.Code)
+
+		key := &models.IdempotencyKey{}
+		require.NoError(t, test.DB.First(key, "idempotency_key = ?", "retry-1").Error)
+		require.NoError(t, test.DB.Model(key).UpdateColumn("status_code", 0).Error)
+
+		retry := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		validateError(t, http.StatusConflict, retry, "still being processed")
+	})
+	t.Run("Abandoned", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		first := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		require.Equal(t, http.StatusCreated, first.Code)
+
+		// the first request never stored its response
+		key := &models.IdempotencyKey{}
+		require.NoError(t, test.DB.First(key, "idempotency_key = ?", "retry-1").Error)
+		require.NoError(t, test.DB.Model(key).UpdateColumns(map[string]interface{}{
+			"status_code": 0,
+			"updated_at":  time.Now().Add(-2 * idempotencyLease),
+		}).Error)
+
+		retry := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		require.Equal(t, http.StatusCreated, retry.Code)
+		assert.Empty(t, retry.Header().Get(idempotentReplayedHeader))
+
+		replayed := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		require.Equal(t, http.StatusCreated, replayed.Code)
+		assert.Equal(t, "true", replayed.Header().Get(idempotentReplayedHeader), "the retry stored its response")
+	})
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+		test.Config.Idempotency.Window = 1
+
+		first := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		require.Equal(t, http.StatusCreated, first.Code)
+		require.NoError(t, test.DB.Model(&models.IdempotencyKey{}).UpdateColumn("created_at", time.Now().Add(-2*time.Hour)).Error)
+
+		retry := runIdempotent(test, http.MethodPost, "/orders", orderBody, "retry-1", nil)
+		require.Equal(t, http.StatusCreated, retry.Code)
+		assert.Empty(t, retry.Header().Get(idempotentReplayedHeader))
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("email = ?", "retry@example.com").Count(&count).Error)
+		assert.Equal(t, 2, count)
+	})
+}
+
+func TestIdempotentPaymentCreate(t *testing.T) {
+	callCount := 0
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {
+		if path == "/charges" {
+			callCount++
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	test := NewRouteTest(t)
+	site := startTestSite()
+	defer site.Close()
+	test.Config.SiteURL = site.URL
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	body, err := json.Marshal(&stripePaymentParams{
+		Amount:      test.Data.firstOrder.Total,
+		Currency:    test.Data.firstOrder.Currency,
+		StripeToken: "123456",
+		Provider:    payments.StripeProvider,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		recorder := runIdempotent(test, http.MethodPost, "/orders/first-order/payments", string(body), "pay-1", test.Data.testUserToken)
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+	}
+	assert.Equal(t, 1, callCount)
+
+	var count int
+	require.NoError(t, test.DB.Model(&models.Transaction{}).Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, models.ChargeTransactionType).Count(&count).Error)
+	assert.Equal(t, 2, count, "the fixture charge and the new one")
+}
+
+func runIdempotent(test *RouteTest, method, url, body, key string, token *jwt.Token) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, baseURL+url, strings.NewReader(body))
+	req.Header.Set(idempotencyKeyHeader, key)
+	if token != nil {
+		require.NoError(test.T, signHTTPRequest(req, token, test.Config.JWT.Secret))
+	}
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(test.T, err)
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler.ServeHTTP(recorder, req)
+	return recorder
+}
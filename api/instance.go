@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/imdario/mergo"
@@ -38,9 +39,30 @@ func (a *API) GetAppManifest(w http.ResponseWriter, r *http.Request) error {
 
 type InstanceRequestParams struct {
 	UUID       string              `json:"uuid"`
+	Domain     *string             `json:"domain"`
 	BaseConfig *conf.Configuration `json:"config"`
 }
 
+// setInstanceDomain sets the domain requests for an instance are routed by,
+// which no other instance may have.
+func (a *API) setInstanceDomain(i *models.Instance, domain *string) error {
+	if domain == nil {
+		return nil
+	}
+	d := strings.ToLower(strings.TrimSpace(*domain))
+	if d != "" {
+		other, err := models.GetInstanceByDomain(a.db, d)
+		if err != nil && !models.IsNotFoundError(err) {
+			return internalServerError("Database error looking up instance").WithInternalError(err)
+		}
+		if other != nil && other.ID != i.ID {
+			return conflictError("Another instance has the domain %v", d)
+		}
+	}
+	i.Domain = d
+	return nil
+}
+
 type InstanceResponse struct {
 	models.Instance
 	Endpoint string `json:"endpoint"`
@@ -67,6 +89,9 @@ func (a *API) CreateInstance(w http.ResponseWriter, r *http.Request) error {
 		UUID:       params.UUID,
 		BaseConfig: params.BaseConfig,
 	}
+	if err := a.setInstanceDomain(&i, params.Domain); err != nil {
+		return err
+	}
 	if err = models.CreateInstance(a.db, &i); err != nil {
 		return internalServerError("Database error creating instance").WithInternalError(err)
 	}
@@ -97,6 +122,9 @@ func (a *API) UpdateInstance(w http.ResponseWriter, r *http.Request) error {
 			return internalServerError("Error merging instance configurations").WithInternalError(err)
 		}
 	}
+	if err := a.setInstanceDomain(i, params.Domain); err != nil {
+		return err
+	}
 
 	if err := models.UpdateInstance(a.db, i); err != nil {
 		return internalServerError("Database error updating instance").WithInternalError(err)
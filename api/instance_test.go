@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/pborman/uuid"
@@ -137,3 +138,79 @@ func (ts *InstanceTestSuite) TestUpdate() {
 func TestInstance(t *testing.T) {
 	suite.Run(t, new(InstanceTestSuite))
 }
+
+func (ts *InstanceTestSuite) TestRouting() {
+	t := ts.T()
+	newInstance := func(domain string) *models.Instance {
+		i := &models.Instance{
+			ID:     uuid.NewRandom().String(),
+			Domain: domain,
+			BaseConfig: &conf.Configuration{
+				SiteURL: "https://" + domain,
+				JWT:     conf.JWTConfiguration{Secret: "secret-of-" + domain},
+			},
+		}
+		i.BaseConfig.Payment.Stripe.Enabled = true
+		i.BaseConfig.Payment.Stripe.SecretKey = "sk_test"
+		require.NoError(t, models.CreateInstance(ts.API.db, i))
+		return i
+	}
+	shop := newInstance(uuid.NewRandom().String() + ".shop.example.com")
+	other := newInstance(uuid.NewRandom().String() + ".other.example.com")
+
+	order := models.NewOrder("", "session", "buyer@example.com", "USD")
+	order.InstanceID = shop.ID
+	require.NoError(t, ts.API.db.Create(order).Error)
+
+	request := func(host, instanceID, secret, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		if instanceID != "" {
+			req.Header.Set(instanceHeaderName, instanceID)
+		}
+		require.NoError(t, signHTTPRequest(req, testAdminToken("admin", ""), secret))
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(shop.Domain, "", "secret-of-"+shop.Domain, "/orders/"+order.ID+"/payments")
+	assert.Equal(t, http.StatusOK, w.Code, "routed by hostname")
+	w = request(shop.Domain+":8080", "", "secret-of-"+shop.Domain, "/orders/"+order.ID+"/payments")
+	assert.Equal(t, http.StatusOK, w.Code, "the port doesn't matter")
+	w = request("localhost", shop.ID, "secret-of-"+shop.Domain, "/orders/"+order.ID+"/payments")
+	assert.Equal(t, http.StatusOK, w.Code, "routed by header")
+
+	w = request("localhost", other.ID, "secret-of-"+other.Domain, "/orders/"+order.ID+"/payments")
+	assert.Equal(t, http.StatusNotFound, w.Code, "orders of other instances can't be seen")
+	w = request("localhost", shop.ID, "secret-of-"+other.Domain, "/orders/"+order.ID+"/payments")
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "tokens are signed with the secret of the instance")
+	w = request("unknown.example.com", "", "secret-of-"+shop.Domain, "/orders")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func (ts *InstanceTestSuite) TestDomain() {
+	t := ts.T()
+	domain := uuid.NewRandom().String() + ".example.com"
+	create := func(uuid, domain string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(t, json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"uuid":   uuid,
+			"domain": domain,
+			"config": map[string]interface{}{"jwt": map[string]interface{}{"secret": "testsecret"}},
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/instances", &buffer)
+		req.Header.Set("Authorization", "Bearer "+operatorToken)
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := create(testUUID, strings.ToUpper(domain))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	i, err := models.GetInstanceByDomain(ts.API.db, domain)
+	require.NoError(t, err)
+	assert.Equal(t, testUUID, i.UUID)
+
+	w = create(uuid.NewRandom().String(), domain)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
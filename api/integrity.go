@@ -0,0 +1,175 @@
+package api
+
+import (
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// maxIntegrityPerPage is the most orders one request checks, so a check
+// never holds a connection for long.
+const maxIntegrityPerPage = 500
+
+// The checks of the integrity report.
+const (
+	totalCheck        = "total"
+	subtotalCheck     = "subtotal"
+	chargesCheck      = "charges"
+	refundsCheck      = "refunds"
+	paymentStateCheck = "payment_state"
+)
+
+// The actions of an integrityRepair.
+const (
+	updateRepair      = "update"
+	recalculateRepair = "recalculate"
+	reviewRepair      = "review"
+)
+
+// integrityReport is the result of checking a page of the orders of an
+// instance.
+type integrityReport struct {
+	Checked int               `json:"checked"`
+	Issues  []*integrityIssue `json:"issues"`
+}
+
+// integrityIssue is an order whose amounts don't add up.
+type integrityIssue struct {
+	OrderID  string           `json:"order_id"`
+	Check    string           `json:"check"`
+	Current  interface{}      `json:"current"`
+	Expected interface{}      `json:"expected"`
+	Repair   *integrityRepair `json:"repair"`
+}
+
+// integrityRepair is the proposed fix of an integrityIssue. An update sets
+// Field to Value, a recalculation prices the unpaid order again with
+// POST /orders/:id/recalculate, and a review needs someone to compare the
+// order with the payment provider.
+type integrityRepair struct {
+	Action string      `json:"action"`
+	Field  string      `json:"field,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+// OrderIntegrityCheck verifies that the totals of the orders of the instance
+// add up, to find drift from manual database edits or bugs. It checks the
+// total against its parts, the subtotal against the line items, and the paid
+// and refunded totals against the transactions, and proposes a repair for
+// every issue without changing anything. The orders are read from the
+// replica, if there is one, and can be limited with from and to. Each
+// request checks a page of orders, newest first, and links to the next
+// page like the order list.
+func (a *API) OrderIntegrityCheck(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	db := a.readDB(r)
+	query := db.
+		Preload("LineItems").
+		Preload("Transactions").
+		Where("instance_id = ?", instanceID)
+	query, err := parseTimeQueryParams(query, r.URL.Query())
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+	query, page, err := keysetPaginate(r, query, db.NewScope(models.Order{}).QuotedTableName())
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+	if page.limit > maxIntegrityPerPage {
+		return badRequestError("Bad Pagination Parameters: per_page can be at most %d", maxIntegrityPerPage)
+	}
+
+	orders := []*models.Order{}
+	if rsp := query.Find(&orders); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	report := &integrityReport{Checked: len(orders), Issues: []*integrityIssue{}}
+	for _, order := range orders {
+		report.Issues = append(report.Issues, checkOrderIntegrity(order)...)
+	}
+	var last *keysetCursor
+	if len(orders) > 0 {
+		order := orders[len(orders)-1]
+		last = &keysetCursor{CreatedAt: order.CreatedAt, ID: order.ID}
+	}
+	if next := page.next(len(orders), last); next != nil {
+		addKeysetHeaders(w, r, next)
+	}
+
+	getLogEntry(r).WithField("checked", report.Checked).WithField("issues", len(report.Issues)).Info("Checked order integrity")
+	return sendJSON(w, http.StatusOK, report)
+}
+
+// checkOrderIntegrity returns the issues of an order.
+func checkOrderIntegrity(order *models.Order) []*integrityIssue {
+	issues := []*integrityIssue{}
+	issue := func(check string, current, expected interface{}, repair *integrityRepair) {
+		issues = append(issues, &integrityIssue{OrderID: order.ID, Check: check, Current: current, Expected: expected, Repair: repair})
+	}
+	paid := order.PaymentState == models.PaidState
+	recalculate := &integrityRepair{Action: recalculateRepair}
+
+	total := int64(order.SubTotal) - int64(order.Discount) + int64(order.Taxes) + int64(order.Shipping)
+	if total < 0 {
+		total = 0
+	}
+	if int64(order.Total) != total {
+		repair := recalculate
+		if paid {
+			repair = &integrityRepair{Action: updateRepair, Field: "total", Value: total}
+		}
+		issue(totalCheck, order.Total, total, repair)
+	}
+
+	// prices rounded per line or for the whole order differ from the unit
+	// prices of the line items by less than a unit per item, and orders
+	// from before price breakdowns can't be checked
+	var subtotal, quantity uint64
+	breakdowns := true
+	for _, item := range order.LineItems {
+		if item.PriceBreakdown == nil {
+			breakdowns = false
+			break
+		}
+		subtotal += item.PriceBreakdown.Subtotal * item.Quantity
+		quantity += item.Quantity
+	}
+	if breakdowns && absDiff(order.SubTotal, subtotal) > quantity {
+		repair := recalculate
+		if paid {
+			repair = &integrityRepair{Action: reviewRepair}
+		}
+		issue(subtotalCheck, order.SubTotal, subtotal, repair)
+	}
+
+	var charged, refunded uint64
+	for _, t := range order.Transactions {
+		if t.Status != models.PaidState {
+			continue
+		}
+		switch t.Type {
+		case models.ChargeTransactionType:
+			charged += t.Amount
+		case models.RefundTransactionType:
+			refunded += t.Amount
+		}
+	}
+	switch {
+	case paid && charged != order.Total:
+		issue(chargesCheck, order.Total, charged, &integrityRepair{Action: reviewRepair})
+	case order.PaymentState == models.PendingState && charged > 0:
+		issue(paymentStateCheck, order.PaymentState, models.PaidState, &integrityRepair{Action: updateRepair, Field: "payment_state", Value: models.PaidState})
+	}
+	if refunded != order.TotalRefunded {
+		issue(refundsCheck, order.TotalRefunded, refunded, &integrityRepair{Action: updateRepair, Field: "total_refunded", Value: refunded})
+	}
+	return issues
+}
+
+func absDiff(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
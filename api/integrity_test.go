@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderIntegrityCheck(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin", "")
+	check := func() *integrityReport {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/integrity", nil, token)
+		report := &integrityReport{}
+		extractPayload(t, http.StatusOK, recorder, report)
+		return report
+	}
+	first, second := test.Data.firstOrder, test.Data.secondOrder
+
+	t.Run("Charges", func(t *testing.T) {
+		report := check()
+		assert.Equal(t, 2, report.Checked)
+		require.Len(t, report.Issues, 1)
+		issue := report.Issues[0]
+		assert.Equal(t, first.ID, issue.OrderID)
+		assert.Equal(t, chargesCheck, issue.Check)
+		assert.EqualValues(t, first.Total, issue.Current)
+		assert.EqualValues(t, 100, issue.Expected)
+		assert.Equal(t, reviewRepair, issue.Repair.Action)
+	})
+
+	t.Run("Drift", func(t *testing.T) {
+		total := second.Total
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", second.ID).UpdateColumns(map[string]interface{}{"total": total + 1, "total_refunded": 5}).Error)
+		require.NoError(t, test.DB.Model(first).UpdateColumn("payment_state", models.PendingState).Error)
+
+		report := check()
+		checks := map[string]*integrityIssue{}
+		for _, issue := range report.Issues {
+			checks[issue.OrderID+" "+issue.Check] = issue
+		}
+		require.Len(t, checks, 4)
+
+		issue := checks[second.ID+" "+totalCheck]
+		require.NotNil(t, issue)
+		assert.Equal(t, &integrityRepair{Action: updateRepair, Field: "total", Value: float64(total)}, issue.Repair)
+		assert.NotNil(t, checks[second.ID+" "+chargesCheck])
+		refunds := checks[second.ID+" "+refundsCheck]
+		require.NotNil(t, refunds)
+		assert.Equal(t, &integrityRepair{Action: updateRepair, Field: "total_refunded", Value: float64(0)}, refunds.Repair)
+		state := checks[first.ID+" "+paymentStateCheck]
+		require.NotNil(t, state)
+		assert.Equal(t, &integrityRepair{Action: updateRepair, Field: "payment_state", Value: models.PaidState}, state.Repair)
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/integrity?per_page=1", nil, token)
+		report := &integrityReport{}
+		extractPayload(t, http.StatusOK, recorder, report)
+		assert.Equal(t, 1, report.Checked)
+		cursor := recorder.Header().Get("X-Next-Cursor")
+		require.NotEmpty(t, cursor)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/integrity?per_page=1&cursor="+cursor, nil, token)
+		next := &integrityReport{}
+		extractPayload(t, http.StatusOK, recorder, next)
+		assert.Equal(t, 1, next.Checked)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/integrity?per_page=1000", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("NonAdmin", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/integrity", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
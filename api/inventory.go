@@ -0,0 +1,219 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// InventoryParams holds the new stock level of a SKU.
+type InventoryParams struct {
+	Stock *int64 `json:"stock"`
+}
+
+// InventoryList lists the stock levels of all tracked SKUs. It is only
+// available to admins.
+func (a *API) InventoryList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	query := a.db.Where("instance_id = ?", instanceID)
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Inventory{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	inventory := []models.Inventory{}
+	if rsp := query.Order("sku asc").Offset(offset).Limit(limit).Find(&inventory); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, inventory)
+}
+
+// InventoryView returns the stock level of a single SKU. It is only available
+// to admins.
+func (a *API) InventoryView(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	inventory, err := models.GetInventory(a.db, instanceID, chi.URLParam(r, "sku"))
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if inventory == nil {
+		return notFoundError("Inventory not found")
+	}
+	return sendJSON(w, http.StatusOK, inventory)
+}
+
+// InventoryUpdate sets the stock level of a SKU, and starts tracking it if it
+// isn't tracked yet. It is only available to admins.
+func (a *API) InventoryUpdate(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	sku := chi.URLParam(r, "sku")
+	log := getLogEntry(r)
+
+	params := &InventoryParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Stock == nil || *params.Stock < 0 {
+		return badRequestError("The stock must be zero or more")
+	}
+
+	tx := a.db.Begin()
+	inventory, err := models.GetInventory(tx, instanceID, sku)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if inventory == nil {
+		inventory = &models.Inventory{InstanceID: instanceID, Sku: sku}
+	}
+	inventory.Stock = *params.Stock
+	if rsp := tx.Save(inventory); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving inventory").WithInternalError(rsp.Error)
+	}
+	tx.Commit()
+
+	log.WithField("sku", sku).Infof("Set stock to %d", inventory.Stock)
+	return sendJSON(w, http.StatusOK, inventory)
+}
+
+// Policies for orders whose stock ran out before they were paid, see
+// conf.Configuration.Inventory.
+const (
+	oversellReject    = "reject"
+	oversellBackorder = "backorder"
+)
+
+// stockShortage is a tracked SKU an order has more of than is in stock.
+type stockShortage struct {
+	Sku       string `json:"sku"`
+	Requested uint64 `json:"requested"`
+	Available uint64 `json:"available"`
+}
+
+// orderQuantities returns the SKUs of an order, in the order of its line
+// items, and the total quantity of each.
+func orderQuantities(order *models.Order) ([]string, map[string]uint64) {
+	quantities := map[string]uint64{}
+	var skus []string
+	for _, item := range order.LineItems {
+		if _, ok := quantities[item.Sku]; !ok {
+			skus = append(skus, item.Sku)
+		}
+		quantities[item.Sku] += item.Quantity
+	}
+	return skus, quantities
+}
+
+// checkInventory verifies there is enough stock of every tracked SKU in a new
+// order. SKUs that aren't tracked yet start being tracked when their product
+// metadata publishes an inventory.
+func checkInventory(tx *gorm.DB, order *models.Order) *HTTPError {
+	skus, quantities := orderQuantities(order)
+	for _, sku := range skus {
+		inventory, err := models.GetInventory(tx, order.InstanceID, sku)
+		if err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if inventory == nil {
+			for _, item := range order.LineItems {
+				if item.Sku == sku && item.InitialStock != nil {
+					if inventory, err = models.SeedInventory(tx, order.InstanceID, sku, *item.InitialStock); err != nil {
+						return internalServerError("Error saving inventory").WithInternalError(err)
+					}
+					break
+				}
+			}
+		}
+		if inventory != nil && int64(quantities[sku]) > inventory.Stock {
+			stock := inventory.Stock
+			if stock < 0 {
+				stock = 0
+			}
+			return conflictError("Only %d of %v left in stock", stock, sku).WithData(map[string]interface{}{
+				"sku":   sku,
+				"stock": stock,
+			})
+		}
+	}
+	return nil
+}
+
+// findStockShortages checks the stock of the tracked SKUs of an order again
+// when it's paid, since other orders may have been paid in the meantime. The
+// stock of the SKUs stays locked until the transaction of the payment ends, so
+// concurrent payments can't sell the same units. The SKUs are locked in the
+// same order by every payment, so they don't deadlock.
+func findStockShortages(tx *gorm.DB, order *models.Order) ([]*stockShortage, error) {
+	shortages := []*stockShortage{}
+	skus, quantities := orderQuantities(order)
+	sorted := append([]string{}, skus...)
+	sort.Strings(sorted)
+	inventories := map[string]*models.Inventory{}
+	for _, sku := range sorted {
+		inventory, err := models.GetInventory(models.ForUpdate(tx), order.InstanceID, sku)
+		if err != nil {
+			return nil, err
+		}
+		inventories[sku] = inventory
+	}
+	for _, sku := range skus {
+		inventory := inventories[sku]
+		if inventory == nil || int64(quantities[sku]) <= inventory.Stock {
+			continue
+		}
+		shortage := &stockShortage{Sku: sku, Requested: quantities[sku]}
+		if inventory.Stock > 0 {
+			shortage.Available = uint64(inventory.Stock)
+		}
+		shortages = append(shortages, shortage)
+	}
+	return shortages, nil
+}
+
+// backorderShortages records the missing quantities of the line items of an
+// order as backordered, starting with the last line item of a SKU.
+func backorderShortages(order *models.Order, shortages []*stockShortage) {
+	for _, shortage := range shortages {
+		missing := shortage.Requested - shortage.Available
+		for i := len(order.LineItems) - 1; i >= 0 && missing > 0; i-- {
+			item := order.LineItems[i]
+			if item.Sku != shortage.Sku {
+				continue
+			}
+			backordered := item.Quantity
+			if backordered > missing {
+				backordered = missing
+			}
+			item.BackorderedQuantity = backordered
+			missing -= backordered
+		}
+	}
+}
+
+// adjustInventory changes the stock of the tracked SKUs of an order by the
+// quantities of its line items, taken out when sign is negative and put back
+// when it is positive. When quantities is given only those line items are
+// adjusted, by the quantity given.
+func adjustInventory(tx *gorm.DB, order *models.Order, quantities map[int64]uint64, sign int64) error {
+	for _, item := range order.LineItems {
+		qty := item.Quantity
+		if quantities != nil {
+			var ok bool
+			if qty, ok = quantities[item.ID]; !ok {
+				continue
+			}
+		}
+		if err := models.AdjustInventory(tx, order.InstanceID, item.Sku, sign*int64(qty)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
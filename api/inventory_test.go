@@ -0,0 +1,61 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestInventory(t *testing.T) {
+	t.Run("Update", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		body, err := json.Marshal(map[string]int{"stock": 12})
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodPut, "/inventory/"+test.Data.firstLineItem.Sku, bytes.NewBuffer(body), token)
+		inventory := &models.Inventory{}
+		extractPayload(t, http.StatusOK, recorder, inventory)
+		assert.Equal(t, test.Data.firstLineItem.Sku, inventory.Sku)
+		assert.EqualValues(t, 12, inventory.Stock)
+
+		body, err = json.Marshal(map[string]int{"stock": 4})
+		require.NoError(t, err)
+		recorder = test.TestEndpoint(http.MethodPut, "/inventory/"+test.Data.firstLineItem.Sku, bytes.NewBuffer(body), token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/inventory/"+test.Data.firstLineItem.Sku, nil, token)
+		extractPayload(t, http.StatusOK, recorder, inventory)
+		assert.EqualValues(t, 4, inventory.Stock)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/inventory", nil, token)
+		list := []models.Inventory{}
+		extractPayload(t, http.StatusOK, recorder, &list)
+		assert.Len(t, list, 1)
+	})
+	t.Run("NegativeStock", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body, err := json.Marshal(map[string]int{"stock": -1})
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPut, "/inventory/some-sku", bytes.NewBuffer(body), testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder, "zero or more")
+	})
+	t.Run("Untracked", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/inventory/some-sku", nil, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("NotWithAdminRights", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body, err := json.Marshal(map[string]int{"stock": 12})
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPut, "/inventory/some-sku", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// invoiceDetailsParams are the details of the buyer printed on the invoice.
+// Fields that are left out are kept, and an empty VAT number or company
+// clears it.
+type invoiceDetailsParams struct {
+	Company   *string `json:"company"`
+	VATNumber *string `json:"vatnumber"`
+
+	BillingAddressID  string          `json:"billing_address_id"`
+	BillingAddress    *models.Address `json:"billing_address"`
+	SaveToAddressBook bool            `json:"save_to_address_book"`
+}
+
+// OrderInvoiceDetailsUpdate lets buyers fix the company, VAT number and
+// billing address of their unpaid orders before paying them. New VAT numbers
+// are validated again, and the taxes of the order are calculated again, as
+// a VAT number can make the order reverse charged. Buyers of anonymous orders
+// need to pass the email of the order.
+func (a *API) OrderInvoiceDetailsUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+	config := gcontext.GetConfig(ctx)
+
+	params := &invoiceDetailsParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read invoice details: %v", err)
+	}
+	if params.BillingAddress != nil && params.BillingAddressID != "" {
+		return badRequestError("Use either a billing_address or a billing_address_id, not both")
+	}
+
+	tx := a.db.Begin()
+	order := &models.Order{}
+	if rsp := orderQuery(models.ForUpdate(tx)).First(order, "id = ? AND instance_id = ?", gcontext.GetOrderID(ctx), gcontext.GetInstanceID(ctx)); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if !gcontext.HasScope(ctx, ordersWriteScope) {
+		if order.UserID != "" && (claims == nil || claims.Subject != order.UserID) {
+			tx.Rollback()
+			return unauthorizedError("You don't have access to this order")
+		}
+		if order.UserID == "" && !hasOrderEmail(r, order) {
+			tx.Rollback()
+			return unauthorizedError("Changing the invoice details of an anonymous order requires the email of the order")
+		}
+	}
+	if order.PaymentState != models.PendingState {
+		tx.Rollback()
+		return badRequestError("The invoice details can only be changed before the order is paid")
+	}
+	for _, t := range order.Transactions {
+		if t.Status == models.PendingState {
+			tx.Rollback()
+			return conflictError("This order has a payment in progress and its invoice details can't be changed")
+		}
+	}
+
+	changes := []string{}
+	diff := map[string]models.Change{}
+
+	// unverified VAT numbers are validated again when they are sent again
+	if params.VATNumber != nil && (*params.VATNumber != order.VATNumber || order.VATNumberUnverified) {
+		verified := true
+		if *params.VATNumber != "" {
+			var httpError *HTTPError
+			if verified, httpError = a.verifyVATNumber(ctx, log, *params.VATNumber); httpError != nil {
+				tx.Rollback()
+				return httpError
+			}
+		}
+		if *params.VATNumber != order.VATNumber || verified == order.VATNumberUnverified {
+			diff["vatnumber"] = models.Change{From: order.VATNumber, To: *params.VATNumber}
+			order.VATNumber = *params.VATNumber
+			order.VATNumberUnverified = !verified
+			changes = append(changes, "vatnumber")
+		}
+	}
+
+	billing, fresh := order.BillingAddress, false
+	if params.BillingAddress != nil || params.BillingAddressID != "" {
+		if params.BillingAddress != nil && params.Company != nil {
+			params.BillingAddress.Company = *params.Company
+		}
+		addr, httpError := a.processAddress(tx, order, "Billing Address", params.BillingAddress, params.BillingAddressID, params.SaveToAddressBook)
+		if httpError != nil {
+			tx.Rollback()
+			return httpError
+		}
+		billing, fresh = *addr, true
+	}
+	if params.Company != nil && *params.Company != billing.Company {
+		billing.Company = *params.Company
+		var rsp *gorm.DB
+		if fresh {
+			rsp = tx.Model(&billing).UpdateColumn("company", billing.Company)
+		} else {
+			// the snapshot of the order can be shared with its shipping
+			// address, so the company goes on a copy of it
+			billing.ID = uuid.NewRandom().String()
+			rsp = tx.Create(&billing)
+		}
+		if rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error saving Billing Address").WithInternalError(rsp.Error)
+		}
+	}
+	if billing.ID != order.BillingAddressID {
+		diff["billing_address"] = models.Change{From: order.BillingAddress, To: billing}
+		order.BillingAddress = billing
+		order.BillingAddressID = billing.ID
+		changes = append(changes, "billing_address")
+	}
+
+	if len(changes) == 0 {
+		tx.Rollback()
+		return sendJSON(w, http.StatusOK, order)
+	}
+
+	if changesPrice(changes) {
+		from := order.Total
+		if httpError := a.recalculateOrder(ctx, tx, order); httpError != nil {
+			tx.Rollback()
+			return httpError
+		}
+		if order.Total != from {
+			diff["total"] = models.Change{From: from, To: order.Total}
+			changes = append(changes, "total")
+		}
+	}
+
+	if rsp := tx.Save(order); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving invoice details").WithInternalError(rsp.Error)
+	}
+	var userID string
+	if claims != nil {
+		userID = claims.Subject
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, userID, order.ID, models.EventUpdated, changes, diff)
+	if config.Webhooks.Update != "" && !order.SuppressNotifications {
+		hook := newHook(ctx, log, order.InstanceID, models.OrderUpdatedHook, config.Webhooks.Update, userID, order)
+		tx.Save(hook)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving invoice details").WithInternalError(rsp.Error)
+	}
+
+	log.WithFields(logrus.Fields{"order_id": order.ID, "changes": changes}).Info("Updated invoice details")
+	return sendJSON(w, http.StatusOK, order)
+}
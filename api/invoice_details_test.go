@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mattes/vat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderInvoiceDetailsUpdate(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	defer func() { checkVAT = vat.CheckVAT }()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	stubVIES(&vat.VATresponse{CountryCode: "AT", Valid: true})
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", vatOrderBody(""), test.Data.testUserToken)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	require.Equal(t, uint64(70), order.Taxes)
+	url := "/orders/" + order.ID + "/invoice-details"
+
+	t.Run("VATNumberAndCompany", func(t *testing.T) {
+		body := strings.NewReader(`{"vatnumber": "ATU12345678", "company": "Example GmbH"}`)
+		recorder := test.TestEndpoint(http.MethodPut, url, body, test.Data.testUserToken)
+		updated := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.Equal(t, "ATU12345678", updated.VATNumber)
+		assert.True(t, updated.ReverseCharge)
+		assert.Equal(t, uint64(0), updated.Taxes)
+		assert.Equal(t, uint64(999), updated.Total)
+		assert.Equal(t, "Example GmbH", updated.BillingAddress.Company)
+		assert.NotEqual(t, order.BillingAddressID, updated.BillingAddressID)
+
+		shipping := &models.Address{}
+		require.NoError(t, test.DB.First(shipping, "id = ?", order.ShippingAddressID).Error)
+		assert.Empty(t, shipping.Company, "the shipping address is left alone")
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.Last(event, "order_id = ? AND type = ?", order.ID, models.EventUpdated).Error)
+		assert.Equal(t, "vatnumber,billing_address,total", event.Changes)
+	})
+
+	t.Run("BillingAddress", func(t *testing.T) {
+		body := strings.NewReader(`{"vatnumber": "", "billing_address": {
+			"name": "Accounts Payable", "company": "Example AG",
+			"address1": "Bahnhofstrasse 1", "city": "Berlin", "country": "Germany", "zip": "10115"
+		}}`)
+		recorder := test.TestEndpoint(http.MethodPut, url, body, test.Data.testUserToken)
+		updated := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.Empty(t, updated.VATNumber)
+		assert.False(t, updated.ReverseCharge)
+		assert.Equal(t, uint64(70), updated.Taxes)
+		assert.Equal(t, "Accounts Payable", updated.BillingAddress.Name)
+		assert.Equal(t, "Example AG", updated.BillingAddress.Company)
+	})
+
+	t.Run("InvalidVATNumber", func(t *testing.T) {
+		stubVIES(&vat.VATresponse{CountryCode: "AT", Valid: false})
+		body := strings.NewReader(`{"vatnumber": "ATU00000000"}`)
+		recorder := test.TestEndpoint(http.MethodPut, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		body := strings.NewReader(`{"company": "Someone Else Ltd"}`)
+		recorder := test.TestEndpoint(http.MethodPut, url, body, testToken("stranger", "stranger@example.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", vatOrderBody(""), nil)
+		anonymous := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, anonymous)
+		url := "/orders/" + anonymous.ID + "/invoice-details"
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"company": "Example GmbH"}`), nil)
+		validateError(t, http.StatusUnauthorized, recorder, "Changing the invoice details of an anonymous order requires the email of the order")
+		recorder = test.TestEndpoint(http.MethodPut, url+"?email=someone@example.com", strings.NewReader(`{"company": "Example GmbH"}`), nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPut, url+"?email=Info@Example.com", strings.NewReader(`{"company": "Example GmbH"}`), nil)
+		updated := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.Equal(t, "Example GmbH", updated.BillingAddress.Company)
+	})
+
+	t.Run("Paid", func(t *testing.T) {
+		body := strings.NewReader(`{"company": "Example GmbH"}`)
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/"+test.Data.firstOrder.ID+"/invoice-details", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "The invoice details can only be changed before the order is paid")
+	})
+}
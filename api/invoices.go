@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/invoice"
+	"github.com/netlify/gocommerce/models"
+)
+
+// maxInvoiceTemplateSize limits the size of invoice templates loaded from the
+// site.
+const maxInvoiceTemplateSize = 1 << 20
+
+// renderInvoice writes the invoice of a paid order as HTML or PDF. The seller
+// details and the HTML template come from the invoice settings of the site,
+// and the labels from the locale of the order.
+func (a *API) renderInvoice(w http.ResponseWriter, r *http.Request, order *models.Order, format string) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	if format != "html" && format != "pdf" {
+		return badRequestError("Unknown receipt format %q, only html and pdf are supported", format)
+	}
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	inv, err := invoice.New(order, settings)
+	if err == invoice.ErrNoInvoiceNumber {
+		return notFoundError("Invoices are only available for paid orders")
+	}
+	if err != nil {
+		return internalServerError("Error creating invoice").WithInternalError(err)
+	}
+	inv.Branding = &calculator.Branding{}
+	if branding := siteBranding(gcontext.GetConfig(ctx), settings, log); branding != nil {
+		inv.Branding = branding
+	}
+
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", "invoice-"+inv.Number+".pdf"))
+		w.WriteHeader(http.StatusOK)
+		w.Write(invoice.PDF(inv))
+		return nil
+	}
+
+	var tmpl string
+	if inv.Seller.Template != "" {
+		if tmpl, err = a.loadInvoiceTemplate(ctx, inv.Seller.Template); err != nil {
+			log.WithError(err).Warn("Error loading invoice template, using the default template")
+		}
+	}
+	html, err := invoice.HTML(inv, tmpl)
+	if err != nil {
+		return internalServerError("Error creating invoice").WithInternalError(err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(html)
+	return nil
+}
+
+// loadInvoiceTemplate loads an invoice template from a path on the site, or
+// from an absolute URL.
+func (a *API) loadInvoiceTemplate(ctx context.Context, path string) (string, error) {
+	url := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		url = gcontext.GetConfig(ctx).SiteURL + path
+	}
+	resp, err := a.httpClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Invoice template %v responded with %v", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxInvoiceTemplateSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxInvoiceTemplateSize {
+		return "", fmt.Errorf("Invoice template %v is larger than %d bytes", url, maxInvoiceTemplateSize)
+	}
+	return string(data), nil
+}
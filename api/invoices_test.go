@@ -0,0 +1,120 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiptInvoice(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gocommerce/settings.json":
+			fmt.Fprint(w, `{"invoice": {
+				"seller": "Wayne Enterprises GmbH",
+				"address": ["Hauptstraße 1", "10115 Berlin"],
+				"vat_number": "DE123456789",
+				"number_prefix": "INV-",
+				"template": "/invoice.html"
+			}}`)
+		case "/invoice.html":
+			fmt.Fprint(w, `<h1>{{ .Labels.invoice }} {{ .Number }} {{ .Amount .Total }}</h1>`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer site.Close()
+
+	newTest := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		order := test.Data.firstOrder
+		order.InvoiceNumber = 42
+		order.Locale = "de-DE"
+		order.SubTotal = 2000
+		order.Taxes = 380
+		order.Total = 2380
+		order.Adjustments = []*calculator.Adjustment{
+			{Type: calculator.TaxAdjustment, Percentage: 19, Amount: 380, Skus: []string{test.Data.firstLineItem.Sku}},
+		}
+		require.NoError(t, test.DB.Save(order).Error)
+		return test
+	}
+	url := "/orders/first-order/receipt"
+
+	t.Run("PDF", func(t *testing.T) {
+		test := newTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url+"?format=pdf", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "application/pdf", recorder.Header().Get("Content-Type"))
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "invoice-INV-42.pdf")
+		body := recorder.Body.Bytes()
+		assert.True(t, bytes.HasPrefix(body, []byte("%PDF-1.4")))
+		assert.Contains(t, string(body), "(Rechnung)")
+		assert.Contains(t, string(body), "Hauptstra\xdfe 1")
+	})
+
+	t.Run("HTMLTemplate", func(t *testing.T) {
+		test := newTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url+"?format=html", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "<h1>Rechnung INV-42 23,80 USD</h1>", recorder.Body.String())
+	})
+
+	t.Run("DefaultHTMLTemplate", func(t *testing.T) {
+		plainSite := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/gocommerce/settings.json" {
+				fmt.Fprint(w, `{"invoice": {"seller": "Wayne Enterprises", "vat_number": "US-1"}}`)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer plainSite.Close()
+
+		test := newTest(t)
+		test.Config.SiteURL = plainSite.URL
+		test.Data.firstOrder.Locale = "en"
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		recorder := test.TestEndpoint(http.MethodGet, url+"?format=html", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		html := recorder.Body.String()
+		assert.Contains(t, html, "Invoice number: <strong>42</strong>")
+		assert.Contains(t, html, "Wayne Enterprises")
+		assert.Contains(t, html, "VAT number: US-1")
+		assert.Contains(t, html, test.Data.firstLineItem.Title)
+		assert.Contains(t, html, "USD 23.80")
+	})
+
+	t.Run("Unpaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		recorder := test.TestEndpoint(http.MethodGet, url+"?format=pdf", nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder, "paid orders")
+	})
+
+	t.Run("UnknownFormat", func(t *testing.T) {
+		test := newTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url+"?format=docx", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "format")
+	})
+
+	t.Run("OtherUsers", func(t *testing.T) {
+		test := newTest(t)
+		token := testToken("villain", "villain@example.com")
+		recorder := test.TestEndpoint(http.MethodGet, url+"?format=pdf", nil, token)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("Receipt", func(t *testing.T) {
+		test := newTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "Order Confirmed", recorder.Body.String())
+	})
+}
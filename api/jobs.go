@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	maxConcurrentJobs = 5
+	jobPollInterval   = 5 * time.Second
+	// jobs that ran are kept for jobRetention, and purged every
+	// jobPurgeInterval
+	jobRetention     = 7 * 24 * time.Hour
+	jobPurgeInterval = time.Hour
+)
+
+// redactedValue replaces the values of job payloads that aren't IDs when
+// jobs are listed, since payloads can hold emails and action links.
+const redactedValue = "[redacted]"
+
+// mailJob is the payload of the jobs that send the mails of a transaction.
+type mailJob struct {
+	TransactionID string `json:"transaction_id"`
+	// Email replaces the email of the order, for receipts resent to
+	// another address.
+	Email       string            `json:"email,omitempty"`
+	ActionLinks map[string]string `json:"action_links,omitempty"`
+}
+
+type jobHandler func(a *API, ctx context.Context, db *gorm.DB, job *models.Job) error
+
+// jobHandlers run the jobs by their type.
+var jobHandlers = map[string]jobHandler{
+	models.OrderAutomationsJob: (*API).runOrderAutomations,
+	models.BulkRefundJob:       (*API).runBulkRefund,
+	models.AutomationMailJob:   sendAutomationMail,
+	models.OrderConfirmationMailJob: mailJobHandler(func(m mailer.Mailer, tr *models.Transaction, p *mailJob) error {
+		return m.OrderConfirmationMail(tr)
+	}),
+	models.OrderReceivedMailJob: mailJobHandler(func(m mailer.Mailer, tr *models.Transaction, p *mailJob) error {
+		return m.OrderReceivedMail(tr, p.ActionLinks)
+	}),
+	models.OrderBackorderedMailJob: mailJobHandler(func(m mailer.Mailer, tr *models.Transaction, p *mailJob) error {
+		return m.OrderBackorderedMail(tr)
+	}),
+	models.OrderRefundMailJob: mailJobHandler(func(m mailer.Mailer, tr *models.Transaction, p *mailJob) error {
+		return m.OrderRefundMail(tr)
+	}),
+}
+
+// mailJobHandler loads the transaction of a mail job with its order, and
+// sends the mail with the mailer of the instance.
+func mailJobHandler(send func(m mailer.Mailer, tr *models.Transaction, p *mailJob) error) jobHandler {
+	return func(a *API, ctx context.Context, db *gorm.DB, job *models.Job) error {
+		payload := &mailJob{}
+		if err := job.DecodePayload(payload); err != nil {
+			return err
+		}
+		tr := &models.Transaction{}
+		if rsp := db.First(tr, "id = ?", payload.TransactionID); rsp.Error != nil {
+			return rsp.Error
+		}
+		order := &models.Order{}
+		if rsp := orderQuery(db).First(order, "id = ?", tr.OrderID); rsp.Error != nil {
+			return rsp.Error
+		}
+		log := logrus.WithFields(logrus.Fields{"job_id": job.ID, "job_type": job.Type})
+		if order.SuppressNotifications {
+			log.WithField("order_id", order.ID).Info("Not sending the mail, the order suppresses notifications")
+			return nil
+		}
+		if payload.Email != "" {
+			order.Email = payload.Email
+		}
+		tr.Order = order
+		return send(a.brandedMailer(ctx, log), tr, payload)
+	}
+}
+
+// enqueueMail queues a mail of a transaction. Mails about a change are queued
+// in the database transaction that saves it, so they are only sent once the
+// change is saved. Failing to queue a mail is only logged.
+func enqueueMail(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, jobType string, payload *mailJob) {
+	if _, err := models.EnqueueJob(db, gcontext.GetInstanceID(ctx), jobType, payload); err != nil {
+		log.WithError(err).WithField("job_type", jobType).Error("Error queueing mail")
+	}
+}
+
+// RunJobs runs the queued jobs in the background, checking for new ones
+// every few seconds, and purges the jobs that ran every hour.
+func (a *API) RunJobs(db *gorm.DB, log *logrus.Entry) {
+	go func() {
+		workerID := uuid.NewRandom().String()
+		var purgedAt time.Time
+		for {
+			if time.Since(purgedAt) > jobPurgeInterval {
+				purgedAt = time.Now()
+				purgeJobs(db, log)
+			}
+			if ran := a.runJobs(db, workerID, log); ran == 0 {
+				time.Sleep(jobPollInterval)
+			}
+		}
+	}()
+}
+
+func purgeJobs(db *gorm.DB, log *logrus.Entry) {
+	purged, err := models.PurgeJobs(db, time.Now().Add(-jobRetention))
+	if err != nil {
+		log.WithError(err).Error("Error purging jobs")
+		return
+	}
+	if purged > 0 {
+		log.WithField("purged", purged).Info("Purged jobs that ran")
+	}
+}
+
+// runJobs claims the due jobs and runs them, and returns how many ran.
+func (a *API) runJobs(db *gorm.DB, workerID string, log *logrus.Entry) int {
+	jobs, err := models.ClaimJobs(db, workerID, maxConcurrentJobs)
+	if err != nil {
+		log.WithError(err).Error("Error claiming jobs")
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *models.Job) {
+			defer wg.Done()
+			jobLog := log.WithFields(logrus.Fields{"job_id": job.ID, "job_type": job.Type, "instance_id": job.InstanceID})
+			if err := a.runJob(db, job); err != nil {
+				jobLog.WithError(err).Warn("Job failed")
+				if err := job.Fail(db, err); err != nil {
+					jobLog.WithError(err).Error("Error saving failed job")
+				} else if job.Dead {
+					jobLog.Errorf("Job failed %v times, giving up", job.Tries)
+				}
+				return
+			}
+			if err := job.Complete(db); err != nil {
+				jobLog.WithError(err).Error("Error saving completed job")
+			}
+		}(job)
+	}
+	wg.Wait()
+	return len(jobs)
+}
+
+func (a *API) runJob(db *gorm.DB, job *models.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Job panicked: %v", r)
+		}
+	}()
+	handler, ok := jobHandlers[job.Type]
+	if !ok {
+		return fmt.Errorf("Unknown job type: %v", job.Type)
+	}
+	ctx, err := a.instanceContext(db, job.InstanceID)
+	if err != nil {
+		return err
+	}
+	return handler(a, ctx, db, job)
+}
+
+// instanceContext returns the context with the configuration of an instance,
+// for work done in the background. In single instance mode that's the
+// configuration the API was started with.
+func (a *API) instanceContext(db *gorm.DB, instanceID string) (context.Context, error) {
+	if !a.config.MultiInstanceMode {
+		return a.baseContext, nil
+	}
+	instance, err := models.GetInstance(db, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	config, err := instance.Config()
+	if err != nil {
+		return nil, err
+	}
+	return WithInstanceConfig(context.Background(), config, instance.ID)
+}
+
+// JobList lists the jobs of the instance, newest first. With dead=true only
+// the jobs that failed for good are listed, and with pending=true the ones
+// that didn't run yet. Only the IDs of the payloads are listed.
+func (a *API) JobList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	query := a.readDB(r).Where("instance_id = ?", instanceID)
+	params := r.URL.Query()
+	if params.Get("dead") == "true" {
+		query = query.Where("dead = ?", true)
+	}
+	if params.Get("pending") == "true" {
+		query = query.Where("done = ?", false)
+	}
+	if jobType := params.Get("type"); jobType != "" {
+		query = query.Where("type = ?", jobType)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Job{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+	jobs := []*models.Job{}
+	if rsp := query.Order("id desc").Offset(offset).Limit(limit).Find(&jobs); rsp.Error != nil {
+		return internalServerError("Database error").WithInternalError(rsp.Error)
+	}
+	for _, job := range jobs {
+		redactJobPayload(job)
+	}
+	return sendJSON(w, http.StatusOK, jobs)
+}
+
+// redactJobPayload replaces the values of the payload of a job with
+// redactedValue, except for the IDs, which are all admins need to tell what
+// a job is about.
+func redactJobPayload(job *models.Job) {
+	payload := map[string]interface{}{}
+	if err := job.DecodePayload(&payload); err != nil {
+		job.Payload = strconv.Quote(redactedValue)
+		return
+	}
+	for key := range payload {
+		if !strings.HasSuffix(key, "_id") {
+			payload[key] = redactedValue
+		}
+	}
+	data, _ := json.Marshal(payload)
+	job.Payload = string(data)
+}
+
+// JobRetry queues a dead job to run again.
+func (a *API) JobRetry(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	id, err := strconv.ParseUint(chi.URLParam(r, "job_id"), 10, 64)
+	if err != nil {
+		return notFoundError("Job not found")
+	}
+
+	job := &models.Job{}
+	if rsp := a.db.First(job, "id = ? AND instance_id = ?", id, instanceID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Job not found")
+		}
+		return internalServerError("Database error").WithInternalError(rsp.Error)
+	}
+	if !job.Dead {
+		return badRequestError("Only dead jobs can be retried")
+	}
+	if err := job.Retry(a.db); err != nil {
+		return internalServerError("Error saving job").WithInternalError(err)
+	}
+	getLogEntry(r).WithField("job_id", job.ID).Info("Retrying dead job")
+	redactJobPayload(job)
+	return sendJSON(w, http.StatusOK, job)
+}
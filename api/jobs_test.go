@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// jobTestAPI returns an API whose mails go to a fake Mailgun at url.
+func jobTestAPI(t *testing.T, test *RouteTest, url, domain string) *API {
+	test.Config.Mailer.AdminEmail = "shop@example.com"
+	test.Config.Mailer.Provider = "mailgun"
+	test.Config.Mailer.Mailgun.Domain = domain
+	test.Config.Mailer.Mailgun.APIKey = "key-123"
+	test.Config.Mailer.Mailgun.URL = url
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(t, err)
+	return NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "")
+}
+
+func TestJobs(t *testing.T) {
+	log := logrus.WithField("test", t.Name())
+
+	t.Run("ResendReceipt", func(t *testing.T) {
+		sent := []string{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, r.ParseForm())
+			sent = append(sent, r.PostForm.Get("to"))
+			fmt.Fprint(w, `{"id":"<msg@example.com>","message":"Queued. Thank you."}`)
+		}))
+		defer server.Close()
+
+		test := NewRouteTest(t)
+		api := jobTestAPI(t, test, server.URL, "jobs.example.com")
+
+		body := strings.NewReader(`{"email": "other@example.com"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/receipt", body, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, sent, "the mail is sent in the background")
+
+		job := &models.Job{}
+		require.NoError(t, test.DB.First(job).Error)
+		assert.Equal(t, models.OrderConfirmationMailJob, job.Type)
+		assert.False(t, job.Done)
+
+		assert.Equal(t, 1, api.runJobs(test.DB, "worker", log))
+		assert.Equal(t, []string{"other@example.com"}, sent)
+		require.NoError(t, test.DB.First(job, "id = ?", job.ID).Error)
+		assert.True(t, job.Done)
+		assert.Equal(t, 1, job.Tries)
+		assert.Equal(t, 0, api.runJobs(test.DB, "worker", log))
+	})
+
+	t.Run("RetryAndDeadLetter", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		test := NewRouteTest(t)
+		api := jobTestAPI(t, test, server.URL, "jobs-down.example.com")
+		job, err := models.EnqueueJob(test.DB, "", models.OrderConfirmationMailJob, &mailJob{TransactionID: test.Data.firstTransaction.ID})
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, api.runJobs(test.DB, "worker", log))
+		require.NoError(t, test.DB.First(job, "id = ?", job.ID).Error)
+		assert.False(t, job.Done)
+		assert.Equal(t, 1, job.Tries)
+		assert.NotNil(t, job.ErrorMessage)
+		require.NotNil(t, job.RunAfter)
+		assert.True(t, job.RunAfter.After(time.Now()))
+		assert.Equal(t, 0, api.runJobs(test.DB, "worker", log), "retries wait for the backoff")
+
+		require.NoError(t, test.DB.Model(job).UpdateColumns(map[string]interface{}{"tries": models.MaxJobTries - 1, "run_after": nil}).Error)
+		assert.Equal(t, 1, api.runJobs(test.DB, "worker", log))
+		require.NoError(t, test.DB.First(job, "id = ?", job.ID).Error)
+		assert.True(t, job.Dead)
+		assert.True(t, job.Done)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/jobs?dead=true", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		token := testAdminToken("admin", "")
+		recorder = test.TestEndpoint(http.MethodGet, "/jobs?dead=true", nil, token)
+		jobs := []*models.Job{}
+		extractPayload(t, http.StatusOK, recorder, &jobs)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, job.ID, jobs[0].ID)
+		assert.Equal(t, models.MaxJobTries, jobs[0].Tries)
+
+		url := fmt.Sprintf("/jobs/%d/retry", job.ID)
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, token)
+		retried := &models.Job{}
+		extractPayload(t, http.StatusOK, recorder, retried)
+		assert.False(t, retried.Dead)
+		assert.Equal(t, 0, retried.Tries)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/jobs?dead=true", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &jobs)
+		assert.Empty(t, jobs)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "Only dead jobs can be retried")
+		recorder = test.TestEndpoint(http.MethodPost, "/jobs/9999/retry", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("UnknownType", func(t *testing.T) {
+		test := NewRouteTest(t)
+		api := jobTestAPI(t, test, "", "jobs.example.com")
+		job, err := models.EnqueueJob(test.DB, "", "unknown", map[string]string{})
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, api.runJobs(test.DB, "worker", log))
+		require.NoError(t, test.DB.First(job, "id = ?", job.ID).Error)
+		require.NotNil(t, job.ErrorMessage)
+		assert.Equal(t, "Unknown job type: unknown", *job.ErrorMessage)
+	})
+
+	t.Run("RedactedPayloads", func(t *testing.T) {
+		test := NewRouteTest(t)
+		_, err := models.EnqueueJob(test.DB, "", models.OrderReceivedMailJob, &mailJob{
+			TransactionID: test.Data.firstTransaction.ID,
+			Email:         "buyer@example.com",
+			ActionLinks:   map[string]string{models.RefundAction: "https://example.com/actions/secret"},
+		})
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/jobs", nil, testAdminToken("admin", ""))
+		jobs := []*models.Job{}
+		extractPayload(t, http.StatusOK, recorder, &jobs)
+		require.Len(t, jobs, 1)
+		assert.JSONEq(t, `{"transaction_id":"`+test.Data.firstTransaction.ID+`","email":"[redacted]","action_links":"[redacted]"}`, jobs[0].Payload)
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		old := time.Now().Add(-2 * jobRetention)
+		ran, err := models.EnqueueJob(test.DB, "", models.OrderConfirmationMailJob, &mailJob{})
+		require.NoError(t, err)
+		dead, err := models.EnqueueJob(test.DB, "", models.OrderConfirmationMailJob, &mailJob{})
+		require.NoError(t, err)
+		recent, err := models.EnqueueJob(test.DB, "", models.OrderConfirmationMailJob, &mailJob{})
+		require.NoError(t, err)
+		require.NoError(t, test.DB.Model(ran).UpdateColumns(map[string]interface{}{"done": true, "completed_at": old}).Error)
+		require.NoError(t, test.DB.Model(dead).UpdateColumns(map[string]interface{}{"done": true, "dead": true, "completed_at": old}).Error)
+		require.NoError(t, test.DB.Model(recent).UpdateColumns(map[string]interface{}{"done": true, "completed_at": time.Now()}).Error)
+
+		purgeJobs(test.DB, log)
+		ids := []uint64{}
+		require.NoError(t, test.DB.Model(&models.Job{}).Order("id asc").Pluck("id", &ids).Error)
+		assert.Equal(t, []uint64{dead.ID, recent.ID}, ids)
+	})
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+const defaultCurrency = "USD"
+
+// inferLocale determines the country, currency and locale for an order. Values
+// given by the buyer win, then the GeoIP country set by a proxy in front of
+// gocommerce, then the Accept-Language header and finally the instance defaults.
+func inferLocale(r *http.Request, config *conf.Configuration, country, currency, locale string) *models.LocaleInference {
+	inferred := &models.LocaleInference{}
+	languages := acceptedLanguages(r.Header.Get("Accept-Language"))
+
+	switch {
+	case country != "":
+		inferred.Country, inferred.CountrySource = country, models.LocaleSourceRequest
+	case config.Defaults.GeoIPHeader != "" && r.Header.Get(config.Defaults.GeoIPHeader) != "":
+		inferred.Country, inferred.CountrySource = strings.ToUpper(r.Header.Get(config.Defaults.GeoIPHeader)), models.LocaleSourceGeoIP
+	case languageRegion(languages) != "":
+		inferred.Country, inferred.CountrySource = languageRegion(languages), models.LocaleSourceAcceptLanguage
+	case config.Defaults.Country != "":
+		inferred.Country, inferred.CountrySource = config.Defaults.Country, models.LocaleSourceInstance
+	}
+
+	switch {
+	case currency != "":
+		inferred.Currency, inferred.CurrencySource = currency, models.LocaleSourceRequest
+	case config.Defaults.Currency != "":
+		inferred.Currency, inferred.CurrencySource = config.Defaults.Currency, models.LocaleSourceInstance
+	default:
+		inferred.Currency, inferred.CurrencySource = defaultCurrency, models.LocaleSourceFallback
+	}
+
+	switch {
+	case locale != "":
+		inferred.Locale, inferred.LocaleSource = locale, models.LocaleSourceRequest
+	case len(languages) > 0:
+		inferred.Locale, inferred.LocaleSource = languages[0], models.LocaleSourceAcceptLanguage
+	case config.Defaults.Locale != "":
+		inferred.Locale, inferred.LocaleSource = config.Defaults.Locale, models.LocaleSourceInstance
+	}
+
+	return inferred
+}
+
+// acceptedLanguages returns the language tags of an Accept-Language header
+// ordered by their quality.
+func acceptedLanguages(header string) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	languages := []language{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	tags := make([]string, len(languages))
+	for i, l := range languages {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// languageRegion returns the region of the first language tag that has one.
+func languageRegion(tags []string) string {
+	for _, tag := range tags {
+		parts := strings.Split(tag, "-")
+		for _, part := range parts[1:] {
+			if len(part) == 2 {
+				return strings.ToUpper(part)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptedLanguages(t *testing.T) {
+	assert.Equal(t, []string{"fr-CH", "fr", "en"}, acceptedLanguages("fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5"))
+	assert.Equal(t, []string{"de", "en-US"}, acceptedLanguages("en-US;q=0.5,de"))
+	assert.Empty(t, acceptedLanguages(""))
+}
+
+func TestInferLocale(t *testing.T) {
+	config := new(conf.Configuration)
+	config.Defaults.Country = "US"
+	config.Defaults.Currency = "EUR"
+	config.Defaults.Locale = "en-US"
+	config.Defaults.GeoIPHeader = "CF-IPCountry"
+
+	t.Run("Request", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/orders", nil)
+		r.Header.Set("CF-IPCountry", "fr")
+		r.Header.Set("Accept-Language", "de-DE")
+		inferred := inferLocale(r, config, "Germany", "USD", "de")
+		assert.Equal(t, &models.LocaleInference{
+			Country: "Germany", CountrySource: models.LocaleSourceRequest,
+			Currency: "USD", CurrencySource: models.LocaleSourceRequest,
+			Locale: "de", LocaleSource: models.LocaleSourceRequest,
+		}, inferred)
+	})
+	t.Run("GeoIP", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/orders", nil)
+		r.Header.Set("CF-IPCountry", "fr")
+		r.Header.Set("Accept-Language", "de-DE")
+		inferred := inferLocale(r, config, "", "", "")
+		assert.Equal(t, "FR", inferred.Country)
+		assert.Equal(t, models.LocaleSourceGeoIP, inferred.CountrySource)
+		assert.Equal(t, "de-DE", inferred.Locale)
+		assert.Equal(t, models.LocaleSourceAcceptLanguage, inferred.LocaleSource)
+	})
+	t.Run("AcceptLanguage", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/orders", nil)
+		r.Header.Set("Accept-Language", "de;q=0.9, de-AT")
+		inferred := inferLocale(r, config, "", "", "")
+		assert.Equal(t, "AT", inferred.Country)
+		assert.Equal(t, models.LocaleSourceAcceptLanguage, inferred.CountrySource)
+		assert.Equal(t, "de-AT", inferred.Locale)
+	})
+	t.Run("Instance", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/orders", nil)
+		inferred := inferLocale(r, config, "", "", "")
+		assert.Equal(t, &models.LocaleInference{
+			Country: "US", CountrySource: models.LocaleSourceInstance,
+			Currency: "EUR", CurrencySource: models.LocaleSourceInstance,
+			Locale: "en-US", LocaleSource: models.LocaleSourceInstance,
+		}, inferred)
+	})
+}
+
+func TestOrderCreateTranslatedItems(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	for _, c := range []struct {
+		locale, title, description string
+	}{
+		{"de", "Kochbuch", "Rezepte"},
+		{"de_AT", "Kochbuch (Österreich)", "Recipes"},
+		{"de-CH", "Kochbuch", "Rezepte"},
+		{"FR", "Livre de cuisine", "Recipes"},
+		{"es", "Cookbook", "Recipes"},
+		{"", "Cookbook", "Recipes"},
+	} {
+		t.Run(c.locale, func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = site.URL
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"locale": "` + c.locale + `",
+				"shipping_address": {"name": "Test User", "address1": "610 22nd Street", "city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"},
+				"line_items": [{"path": "/translated-product", "sku": "translated-1", "quantity": 1}]
+			}`)
+			recorder := test.TestEndpoint(http.MethodPost, "/orders", body, nil)
+			order := &models.Order{}
+			extractPayload(t, http.StatusCreated, recorder, order)
+			require.Len(t, order.LineItems, 1)
+			assert.Equal(t, c.title, order.LineItems[0].Title)
+			assert.Equal(t, c.description, order.LineItems[0].Description)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
+	"github.com/pkg/errors"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/breaker"
+	"github.com/netlify/gocommerce/metrics"
+	"github.com/netlify/gocommerce/tracing"
+)
+
+// callProvider calls a payment provider through its breaker, and records the
+// outcome and latency of the call in the metrics and in a span of the request.
+func callProvider(ctx context.Context, b *breaker.Breaker, provider, operation string, fn func() error) error {
+	span, _ := tracing.StartSpan(ctx, "payments."+operation)
+	span.SetTag("provider", provider)
+	defer span.Finish()
+
+	start := time.Now()
+	err := b.Do(fn)
+	outcome := paymentOutcome(err)
+	metrics.Record(provider, operation, outcome, time.Since(start))
+	span.SetTag("outcome", outcome)
+	span.SetError(err)
+	return err
+}
+
+// paymentOutcome classifies the error of a call to a payment provider. Errors
+// the provider answered with a client error for, other than declines, mean
+// gocommerce sent a request it shouldn't have.
+func paymentOutcome(err error) string {
+	if err == nil {
+		return metrics.Success
+	}
+	if err == breaker.ErrOpen {
+		return metrics.Unavailable
+	}
+	switch e := errors.Cause(err).(type) {
+	case *stripe.Error:
+		switch {
+		case e.Type == stripe.ErrorTypeCard:
+			return metrics.Declined
+		case e.Type == stripe.ErrorTypeAPIConnection || e.HTTPStatusCode == 0:
+			return metrics.NetworkError
+		case e.Type == stripe.ErrorTypeRateLimit || e.HTTPStatusCode >= http.StatusInternalServerError:
+			return metrics.ProviderError
+		}
+		return metrics.InternalError
+	case *paypalsdk.ErrorResponse:
+		switch {
+		case e.Response == nil:
+			return metrics.NetworkError
+		case e.Response.StatusCode >= http.StatusInternalServerError:
+			return metrics.ProviderError
+		case strings.Contains(e.Name, "DECLINED") || strings.Contains(e.Name, "REFUSED"):
+			return metrics.Declined
+		}
+		return metrics.InternalError
+	case net.Error:
+		return metrics.NetworkError
+	}
+	return metrics.InternalError
+}
+
+// PaymentMetrics returns the metrics of the calls to the payment providers of
+// this process, as JSON or, with format=prometheus, in the Prometheus text
+// format.
+func (a *API) PaymentMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Query().Get("format") == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+		metrics.WritePrometheus(w)
+		return nil
+	}
+	return sendJSON(w, http.StatusOK, metrics.Payments())
+}
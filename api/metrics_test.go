@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/breaker"
+	"github.com/netlify/gocommerce/metrics"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestPaymentOutcome(t *testing.T) {
+	assert.Equal(t, metrics.Success, paymentOutcome(nil))
+	assert.Equal(t, metrics.Unavailable, paymentOutcome(breaker.ErrOpen))
+	assert.Equal(t, metrics.Declined, paymentOutcome(&stripe.Error{Type: stripe.ErrorTypeCard, HTTPStatusCode: http.StatusPaymentRequired}))
+	assert.Equal(t, metrics.NetworkError, paymentOutcome(&stripe.Error{Type: stripe.ErrorTypeAPIConnection}))
+	assert.Equal(t, metrics.ProviderError, paymentOutcome(&stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: http.StatusBadGateway}))
+	assert.Equal(t, metrics.InternalError, paymentOutcome(&stripe.Error{Type: stripe.ErrorTypeInvalidRequest, HTTPStatusCode: http.StatusBadRequest}))
+	assert.Equal(t, metrics.Declined, paymentOutcome(&paypalsdk.ErrorResponse{Name: "INSTRUMENT_DECLINED", Response: &http.Response{StatusCode: http.StatusBadRequest}}))
+	assert.Equal(t, metrics.ProviderError, paymentOutcome(&paypalsdk.ErrorResponse{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}}))
+	assert.Equal(t, metrics.NetworkError, paymentOutcome(&url.Error{Op: "Post", URL: "https://api.stripe.com", Err: &timeoutError{}}))
+	assert.Equal(t, metrics.InternalError, paymentOutcome(errors.New("unexpected")))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestPaymentMetrics(t *testing.T) {
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+	site := startTestSite()
+	defer site.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = site.URL
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	before := stripeCharges()
+	body, err := json.Marshal(&stripePaymentParams{
+		Amount:      test.Data.firstOrder.Total,
+		Currency:    test.Data.firstOrder.Currency,
+		StripeToken: "123456",
+		Provider:    payments.StripeProvider,
+	})
+	require.NoError(t, err)
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	token := testAdminToken("admin", "admin@example.com")
+	stats := []metrics.PaymentStats{}
+	extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/metrics/payments", nil, token), &stats)
+	var charges *metrics.PaymentStats
+	for i := range stats {
+		if stats[i].Provider == payments.StripeProvider && stats[i].Operation == "charge" {
+			charges = &stats[i]
+		}
+	}
+	require.NotNil(t, charges)
+	assert.Equal(t, before+1, charges.Calls[metrics.Success])
+	assert.NotEmpty(t, charges.Rates)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/metrics/payments?format=prometheus", nil, token)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, strings.Contains(recorder.Body.String(), `gocommerce_payment_calls_total{provider="stripe",operation="charge",outcome="success"}`))
+
+	validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/metrics/payments", nil, test.Data.testUserToken))
+}
+
+func stripeCharges() uint64 {
+	for _, s := range metrics.Payments() {
+		if s.Provider == payments.StripeProvider && s.Operation == "charge" {
+			return s.Calls[metrics.Success]
+		}
+	}
+	return 0
+}
@@ -5,10 +5,11 @@ import (
 	"context"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/imdario/mergo"
 	"github.com/netlify/gocommerce/assetstores"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
@@ -19,6 +20,9 @@ import (
 
 const (
 	jwsSignatureHeaderName = "x-nf-sign"
+	// instanceHeaderName picks the instance of a request in multi instance
+	// mode, when it isn't signed by the Netlify microservice proxy.
+	instanceHeaderName = "X-Commerce-Instance"
 )
 
 type NetlifyMicroserviceClaims struct {
@@ -60,51 +64,56 @@ func (api *API) extractOperatorRequest(w http.ResponseWriter, req *http.Request)
 	return req.Context(), token, nil
 }
 
+// loadInstanceConfig loads the configuration of the instance a request is
+// for. Requests through the Netlify microservice proxy are signed with the
+// instance ID, others pick it with the X-Commerce-Instance header, or are for
+// the instance whose domain is the host of the request.
 func (api *API) loadInstanceConfig(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx := r.Context()
 
-	signature := r.Header.Get(jwsSignatureHeaderName)
-	if signature == "" {
-		return nil, badRequestError("Netlify microservice headers missing")
+	var instance *models.Instance
+	var siteURL string
+	var err error
+	if signature := r.Header.Get(jwsSignatureHeaderName); signature != "" {
+		claims := NetlifyMicroserviceClaims{}
+		p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
+		_, err := p.ParseWithClaims(signature, &claims, func(token *jwt.Token) (interface{}, error) {
+			return []byte(api.config.OperatorToken), nil
+		})
+		if err != nil {
+			return nil, badRequestError("Operator microservice headers are invalid: %v", err)
+		}
+		if claims.InstanceID == "" {
+			return nil, badRequestError("Instance ID is missing")
+		}
+		logEntrySetField(r, "netlify_id", claims.NetlifyID)
+		siteURL = claims.SiteURL
+		instance, err = models.GetInstance(api.db, claims.InstanceID)
+	} else if instanceID := r.Header.Get(instanceHeaderName); instanceID != "" {
+		instance, err = models.GetInstance(api.db, instanceID)
+	} else if host := requestHostname(r); host != "" {
+		instance, err = models.GetInstanceByDomain(api.db, host)
+	} else {
+		return nil, badRequestError("Instance is missing, send the %v header", instanceHeaderName)
 	}
-
-	claims := NetlifyMicroserviceClaims{}
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-	_, err := p.ParseWithClaims(signature, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(api.config.OperatorToken), nil
-	})
-	if err != nil {
-		return nil, badRequestError("Operator microservice headers are invalid: %v", err)
-	}
-
-	instanceID := claims.InstanceID
-	if instanceID == "" {
-		return nil, badRequestError("Instance ID is missing")
-	}
-
-	logEntrySetField(r, "instance_id", instanceID)
-	logEntrySetField(r, "netlify_id", claims.NetlifyID)
-	instance, err := models.GetInstance(api.db, instanceID)
 	if err != nil {
 		if models.IsNotFoundError(err) {
 			return nil, notFoundError("Unable to locate site configuration")
 		}
 		return nil, internalServerError("Database error loading instance").WithInternalError(err)
 	}
+	instanceID := instance.ID
+	logEntrySetField(r, "instance_id", instanceID)
 
 	config, err := instance.Config()
 	if err != nil {
 		return nil, internalServerError("Error loading environment config").WithInternalError(err)
 	}
-	if claims.SiteURL != "" {
-		config.SiteURL = claims.SiteURL
+	if siteURL != "" {
+		config.SiteURL = siteURL
 	}
 	logEntrySetField(r, "site_url", config.SiteURL)
 
-	if err = mergo.MergeWithOverwrite(config, api.config); err != nil {
-		return nil, internalServerError("Failed to instantiate instance config").WithInternalError(err)
-	}
-
 	ctx, err = WithInstanceConfig(ctx, config, instanceID)
 	if err != nil {
 		return nil, internalServerError("Error loading instance config").WithInternalError(err)
@@ -113,6 +122,15 @@ func (api *API) loadInstanceConfig(w http.ResponseWriter, r *http.Request) (cont
 	return ctx, nil
 }
 
+// requestHostname returns the host of a request without its port.
+func requestHostname(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
 func WithInstanceConfig(ctx context.Context, config *conf.Configuration, instanceID string) (context.Context, error) {
 	ctx = gcontext.WithInstanceID(ctx, instanceID)
 	ctx = gcontext.WithConfig(ctx, config)
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestSuppressNotifications(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	hooks := func(t *testing.T, test *RouteTest, hookType string) int {
+		var n int
+		require.NoError(t, test.DB.Model(&models.Hook{}).Where("type = ?", hookType).Count(&n).Error)
+		return n
+	}
+	orderBody := func(suppress string) *strings.Reader {
+		return strings.NewReader(`{
+			"email": "imported@example.com",` + suppress + `
+			"shipping_address": {
+				"name": "Test User", "address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+	}
+
+	t.Run("Import", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		test.Config.Webhooks.Order = "https://example.com/hooks/order"
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", orderBody(`"suppress_notifications": true,`), testAdminToken("admin", ""))
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.True(t, order.SuppressNotifications)
+		assert.Equal(t, 0, hooks(t, test, models.OrderCreatedHook))
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", orderBody(""), testAdminToken("admin", ""))
+		notified := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, notified)
+		assert.False(t, notified.SuppressNotifications)
+		assert.Equal(t, 1, hooks(t, test, models.OrderCreatedHook))
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", orderBody(`"suppress_notifications": true,`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder, "Only admins can suppress the notifications of orders")
+	})
+
+	t.Run("TestMode", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		test.Config.TestMode = true
+		test.Config.Webhooks.Order = "https://example.com/hooks/order"
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", orderBody(""), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.True(t, order.SuppressNotifications)
+		assert.Equal(t, 0, hooks(t, test, models.OrderCreatedHook))
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Update = "https://example.com/hooks/update"
+		url := "/orders/" + test.Data.firstOrder.ID
+
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"suppress_notifications": true}`), testAdminToken("admin", ""))
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.True(t, order.SuppressNotifications)
+		assert.Equal(t, 0, hooks(t, test, models.OrderUpdatedHook))
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"suppress_notifications": false}`), testAdminToken("admin", ""))
+		notified := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, notified)
+		assert.False(t, notified.SuppressNotifications)
+		assert.Equal(t, 1, hooks(t, test, models.OrderUpdatedHook))
+	})
+
+	t.Run("Mails", func(t *testing.T) {
+		sent := []string{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, r.ParseForm())
+			sent = append(sent, r.PostForm.Get("to"))
+			fmt.Fprint(w, `{"id":"<msg@example.com>","message":"Queued. Thank you."}`)
+		}))
+		defer server.Close()
+
+		test := NewRouteTest(t)
+		api := jobTestAPI(t, test, server.URL, "suppressed.example.com")
+		log := logrus.WithField("test", t.Name())
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("suppress_notifications", true).Error)
+
+		job, err := models.EnqueueJob(test.DB, "", models.OrderConfirmationMailJob, &mailJob{TransactionID: test.Data.firstTransaction.ID})
+		require.NoError(t, err)
+		_, err = models.EnqueueJob(test.DB, "", models.AutomationMailJob, &automationMailJob{OrderID: test.Data.firstOrder.ID, To: "admin", Subject: "Hello"})
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, api.runJobs(test.DB, "worker", log))
+		assert.Empty(t, sent)
+		require.NoError(t, test.DB.First(job, "id = ?", job.ID).Error)
+		assert.True(t, job.Done, "the job is done without sending the mail")
+	})
+}
@@ -5,18 +5,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sync"
+	"net/url"
+	"time"
 
-	"github.com/PuerkitoBio/goquery"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/gorm"
-	"github.com/mattes/vat"
+	"github.com/netlify/gocommerce/breaker"
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/extensions"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/rates"
+	"github.com/netlify/gocommerce/tracing"
 	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
 // MaxConcurrentLookups controls the number of simultaneous HTTP Order lookups
@@ -28,6 +34,15 @@ type orderLineItem struct {
 	Quantity uint64                 `json:"quantity"`
 	Addons   []orderAddon           `json:"addons"`
 	MetaData map[string]interface{} `json:"meta"`
+
+	// Price can only be set by admins. Line items with a price are not
+	// looked up on the site, and take their title, type and VAT from
+	// the params too.
+	Price       *uint64 `json:"price"`
+	Title       string  `json:"title"`
+	Type        string  `json:"type"`
+	Description string  `json:"description"`
+	VAT         uint64  `json:"vat"`
 }
 
 type orderAddon struct {
@@ -47,32 +62,48 @@ type orderRequestParams struct {
 	BillingAddressID string          `json:"billing_address_id"`
 	BillingAddress   *models.Address `json:"billing_address"`
 
+	// SaveToAddressBook adds new addresses to the address book of the user.
+	// Orders use snapshots of their addresses either way.
+	SaveToAddressBook bool `json:"save_to_address_book"`
+
 	VATNumber string `json:"vatnumber"`
 
+	ShippingMethod string `json:"shipping_method"`
+
+	// DeliveryInstructions is a pointer so updates can clear the
+	// instructions with an empty string.
+	DeliveryInstructions *string `json:"delivery_instructions"`
+
 	MetaData map[string]interface{} `json:"meta"`
 
 	LineItems []*orderLineItem `json:"line_items"`
 
 	Currency string `json:"currency"`
 
+	Locale string `json:"locale"`
+
+	State            string `json:"state"`
 	FulfillmentState string `json:"fulfillment_state"`
 
 	CouponCode string `json:"coupon"`
-}
 
-type receiptParams struct {
-	Email string `json:"email"`
-}
+	// TaxExempt and TaxExemptReason can only be set by admins.
+	TaxExempt       *bool  `json:"tax_exempt"`
+	TaxExemptReason string `json:"tax_exempt_reason"`
 
-type verificationError struct {
-	err   error
-	mutex sync.Mutex
+	// Tags replace the tags of an order, and OnHold holds or releases it.
+	// Both are only updated by admins.
+	Tags       []string `json:"tags"`
+	OnHold     *bool    `json:"on_hold"`
+	HoldReason string   `json:"hold_reason"`
+
+	// SuppressNotifications keeps the mails and webhooks about the order
+	// from being sent, for imports. Only admins can set it.
+	SuppressNotifications *bool `json:"suppress_notifications"`
 }
 
-func (e *verificationError) setError(err error) {
-	e.mutex.Lock()
-	e.err = err
-	e.mutex.Unlock()
+type receiptParams struct {
+	Email string `json:"email"`
 }
 
 func (a *API) withOrderID(w http.ResponseWriter, r *http.Request) (context.Context, error) {
@@ -83,7 +114,9 @@ func (a *API) withOrderID(w http.ResponseWriter, r *http.Request) (context.Conte
 	return ctx, nil
 }
 
-// ClaimOrders will look for any orders with no user id belonging to an email and claim them
+// ClaimOrders will look for any orders with no user id belonging to an email and claim them.
+// The orders, their addresses and their transactions are moved to the user, so
+// they show up in the user's order and payment history.
 func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
@@ -103,13 +136,11 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 		"user_email": claims.Email,
 	})
 
-	// now find all the order associated with that email
+	// now find all the anonymous orders associated with that email. The
+	// conditions can't be given as a struct, since gorm leaves out zero values
+	// like the empty user ID.
 	query := orderQuery(a.db)
-	query = query.Where(&models.Order{
-		InstanceID: instanceID,
-		UserID:     "",
-		Email:      claims.Email,
-	})
+	query = query.Where("instance_id = ? AND normalized_email = ? AND (user_id = ? OR user_id IS NULL)", instanceID, models.NormalizeEmail(claims.Email), "")
 
 	orders := []models.Order{}
 	if res := query.Find(&orders); res.Error != nil {
@@ -133,29 +164,37 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 		o.UserID = user.ID
 		o.BillingAddress.UserID = user.ID
 		o.ShippingAddress.UserID = user.ID
+		for _, t := range o.Transactions {
+			t.UserID = user.ID
+		}
 
 		if res := tx.Save(&o); res.Error != nil {
 			tx.Rollback()
 			return internalServerError("Failed to update an order with user ID %s", user.ID).WithInternalError(res.Error).WithInternalMessage("Failed to update order ID %s", o.ID)
 		}
+		models.LogEventWithDiff(tx, r.RemoteAddr, user.ID, o.ID, models.EventClaimed, []string{"user_id"}, map[string]models.Change{
+			"user_id": {From: "", To: user.ID},
+		})
 	}
 
 	if rsp := tx.Commit(); rsp.Error != nil {
 		return internalServerError("Failed to update all the orders").WithInternalError(rsp.Error)
 	}
 
-	log.Info("Finished updating")
+	log.WithField("claimed_orders", len(orders)).Info("Finished updating")
 	return sendJSON(w, http.StatusNoContent, "")
 }
 
-// ReceiptView renders an HTML receipt for an order
+// ReceiptView renders an HTML receipt for an order. With format=html or
+// format=pdf it renders the invoice of the order instead, see
+// renderInvoice.
 func (a *API) ReceiptView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	id := gcontext.GetOrderID(ctx)
 	logEntrySetField(r, "order_id", id)
 
 	order := &models.Order{}
-	if result := orderQuery(a.db).Preload("Transactions").First(order, "id = ?", id); result.Error != nil {
+	if result := orderQuery(a.db).Preload("Transactions").First(order, "id = ? AND instance_id = ?", id, gcontext.GetInstanceID(ctx)); result.Error != nil {
 		if result.RecordNotFound() {
 			return notFoundError("Order not found")
 		}
@@ -165,9 +204,12 @@ func (a *API) ReceiptView(w http.ResponseWriter, r *http.Request) error {
 	if !hasOrderAccess(ctx, order) {
 		return unauthorizedError("Order History Requires Authentication")
 	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		return a.renderInvoice(w, r, order, format)
+	}
 	template := r.URL.Query().Get("template")
 
-	mailer := gcontext.GetMailer(ctx)
+	mailer := a.brandedMailer(ctx, getLogEntry(r))
 	for _, transaction := range order.Transactions {
 		if transaction.Type == models.ChargeTransactionType {
 			transaction.Order = order
@@ -199,7 +241,7 @@ func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	order := &models.Order{}
-	if result := orderQuery(a.db).Preload("Transactions").First(order, "id = ?", id); result.Error != nil {
+	if result := orderQuery(a.db).Preload("Transactions").First(order, "id = ? AND instance_id = ?", id, gcontext.GetInstanceID(ctx)); result.Error != nil {
 		if result.RecordNotFound() {
 			return notFoundError("Order not found")
 		}
@@ -210,17 +252,9 @@ func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 		return unauthorizedError("Order History Requires Authentication")
 	}
 
-	if params.Email != "" {
-		order.Email = params.Email
-	}
-
-	mailer := gcontext.GetMailer(ctx)
 	for _, transaction := range order.Transactions {
 		if transaction.Type == models.ChargeTransactionType {
-			transaction.Order = order
-			if mailErr := mailer.OrderConfirmationMail(transaction); mailErr != nil {
-				log.WithError(mailErr).Errorf("Error sending order confirmation mail")
-			}
+			enqueueMail(ctx, a.db, log, models.OrderConfirmationMailJob, &mailJob{TransactionID: transaction.ID, Email: params.Email})
 		}
 	}
 
@@ -237,6 +271,11 @@ func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 //  - type=book  - filter on product type
 //  - email
 //  - items
+// Large result sets can be paged through with cursor= instead of page=, starting
+// with an empty cursor and following the next link.
+// With aggregates=true the orders are returned along with the sums of the
+// totals, taxes and discounts of all matching orders per currency.
+// With archived=true the archived orders are listed instead.
 
 // OrderList lists orders selected by the query parameters provided.
 func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
@@ -247,47 +286,139 @@ func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
 
 	var err error
 	params := r.URL.Query()
-	query := orderQuery(a.db)
+	userID := gcontext.GetUserID(ctx)
+	if userID == "" && claims == nil {
+		// anonymous browser sessions can only list their own carts
+		if params.Get("session_id") == "" || params.Get("archived") == "true" {
+			return unauthorizedError("No claims provided")
+		}
+	} else if userID == "" {
+		userID = claims.Subject
+		// admins look orders up by invoice number or by the charge ID of the
+		// payment provider without knowing whose they are
+		if isOrderLookup(params) && gcontext.HasScope(ctx, ordersReadScope) {
+			userID = "all"
+		}
+	}
+
+	if params.Get("archived") == "true" {
+		return a.archivedOrderList(w, r, userID)
+	}
+	query := orderQuery(a.readDB(r))
+	if params.Get("include_deleted") == "true" && gcontext.HasScope(ctx, ordersReadScope) {
+		query = query.Unscoped()
+	}
 	query, err = parseOrderParams(query, params)
 	if err != nil {
 		return badRequestError("Bad parameters in query: %v", err)
 	}
 	query = query.Where("instance_id = ?", instanceID)
 
-	userID := gcontext.GetUserID(ctx)
-	if userID == "" {
-		userID = claims.Subject
-	}
-	if userID != "all" {
-		orderTable := query.NewScope(models.Order{}).QuotedTableName()
+	orderTable := query.NewScope(models.Order{}).QuotedTableName()
+	if claims == nil {
+		query = query.Where(orderTable+".user_id = ? AND "+orderTable+".payment_state = ?", "", models.PendingState)
+	} else if userID != "all" {
 		query = query.Where(orderTable+".user_id = ?", userID)
 	}
 	log.WithField("query_user_id", userID).Debug("URL parsed and query perpared")
 
-	offset, limit, err := paginate(w, r, query.Model(&models.Order{}))
-	if err != nil {
-		return badRequestError("Bad Pagination Parameters: %v", err)
-	}
-
 	var orders []models.Order
-	result := query.Offset(offset).Limit(limit).Find(&orders)
-	if result.Error != nil {
-		return internalServerError("Error during database query").WithInternalError(result.Error)
+	if _, exists := params["cursor"]; exists {
+		if _, exists := params["sort"]; exists {
+			return badRequestError("Sorting is not supported with cursor pagination")
+		}
+		pageQuery, page, err := keysetPaginate(r, query, query.NewScope(models.Order{}).QuotedTableName())
+		if err != nil {
+			return badRequestError("Bad Pagination Parameters: %v", err)
+		}
+		if result := pageQuery.Find(&orders); result.Error != nil {
+			return internalServerError("Error during database query").WithInternalError(result.Error)
+		}
+		var last *keysetCursor
+		if len(orders) > 0 {
+			order := orders[len(orders)-1]
+			last = &keysetCursor{CreatedAt: order.CreatedAt, ID: order.ID}
+		}
+		if next := page.next(len(orders), last); next != nil {
+			addKeysetHeaders(w, r, next)
+		}
+	} else {
+		offset, limit, err := paginate(w, r, query.Model(&models.Order{}))
+		if err != nil {
+			return badRequestError("Bad Pagination Parameters: %v", err)
+		}
+		if result := query.Offset(offset).Limit(limit).Find(&orders); result.Error != nil {
+			return internalServerError("Error during database query").WithInternalError(result.Error)
+		}
 	}
 
 	log.WithField("order_count", len(orders)).Debugf("Successfully retrieved %d orders", len(orders))
+
+	if params.Get("aggregates") == "true" {
+		aggregates, err := aggregateOrders(query)
+		if err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		return sendJSON(w, http.StatusOK, &orderListResponse{Orders: orders, Aggregates: aggregates})
+	}
 	return sendJSON(w, http.StatusOK, orders)
 }
 
+type orderAggregate struct {
+	Currency string `json:"currency"`
+	Count    uint64 `json:"count"`
+	Total    uint64 `json:"total"`
+	Taxes    uint64 `json:"taxes"`
+	Discount uint64 `json:"discount"`
+}
+
+type orderListResponse struct {
+	Orders     []models.Order    `json:"orders"`
+	Aggregates []*orderAggregate `json:"aggregates"`
+}
+
+// aggregateOrders sums up the orders matched by query per currency.
+func aggregateOrders(query *gorm.DB) ([]*orderAggregate, error) {
+	orderTable := query.NewScope(models.Order{}).QuotedTableName()
+	rows, err := query.Model(&models.Order{}).
+		Select(orderTable+".currency, count(*), coalesce(sum("+orderTable+".total), 0), coalesce(sum("+orderTable+".taxes), 0), coalesce(sum("+orderTable+".discount), 0)").
+		Group(orderTable+".currency").
+		Order(orderTable+".currency", true).
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []*orderAggregate{}
+	for rows.Next() {
+		aggregate := &orderAggregate{}
+		if err := rows.Scan(&aggregate.Currency, &aggregate.Count, &aggregate.Total, &aggregate.Taxes, &aggregate.Discount); err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates, rows.Err()
+}
+
 // OrderView will request a specific order using the 'id' parameter.
-// Only the owner of the order, an admin, or an anon order are allowed to be seen
+// Only the owner of the order, an admin, or an anon order are allowed to be seen.
+// Archived orders are looked up with archived=true.
 func (a *API) OrderView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	id := gcontext.GetOrderID(ctx)
 	log := getLogEntry(r)
 
+	if r.URL.Query().Get("archived") == "true" {
+		return a.archivedOrderView(w, r)
+	}
+
+	query := orderQuery(a.readDB(r))
+	if r.URL.Query().Get("include_deleted") == "true" && gcontext.HasScope(ctx, ordersReadScope) {
+		query = query.Unscoped()
+	}
 	order := &models.Order{}
-	if result := orderQuery(a.db).First(order, "id = ?", id); result.Error != nil {
+	if result := query.First(order, "id = ? AND instance_id = ?", id, gcontext.GetInstanceID(ctx)); result.Error != nil {
 		if result.RecordNotFound() {
 			return notFoundError("Order not found")
 		}
@@ -308,15 +439,45 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	config := gcontext.GetConfig(ctx)
 	instanceID := gcontext.GetInstanceID(ctx)
 
-	params := &orderRequestParams{Currency: "USD"}
+	params := &orderRequestParams{}
 	jsonDecoder := json.NewDecoder(r.Body)
 	err := jsonDecoder.Decode(params)
 	if err != nil {
 		return badRequestError("Could not read Order params: %v", err)
 	}
 
+	var country string
+	if params.ShippingAddress != nil {
+		country = params.ShippingAddress.Country
+	} else if params.ShippingAddressID != "" {
+		saved := new(models.Address)
+		if !a.db.First(saved, "id = ?", params.ShippingAddressID).RecordNotFound() {
+			country = saved.Country
+		}
+	}
+	inferred := inferLocale(r, config, country, params.Currency, params.Locale)
+	params.Currency = inferred.Currency
+	for _, address := range []*models.Address{params.ShippingAddress, params.BillingAddress} {
+		if address != nil && address.Country == "" {
+			address.Country = inferred.Country
+		}
+	}
+
+	// admins can create orders for a customer, like phone orders
 	claims := gcontext.GetClaims(ctx)
+	actor := ""
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		if !gcontext.HasScope(ctx, ordersWriteScope) {
+			return unauthorizedError("Only admins can create orders for other users")
+		}
+		actor = actorID(ctx)
+		claims = customerClaims(userID, params.Email)
+	}
+
 	order := models.NewOrder(instanceID, params.SessionID, params.Email, params.Currency)
+	order.ID = models.NewID(config.IDFormat)
+	order.Locale = inferred.Locale
+	order.Inferred = inferred
 
 	if params.CouponCode != "" {
 		coupon, err := a.lookupCoupon(ctx, w, params.CouponCode)
@@ -339,10 +500,32 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 		"email":    params.Email,
 		"currency": params.Currency,
 	}).Debug("Created order, starting to process request")
+
+	// the address is verified before the transaction, which would
+	// otherwise wait on the provider
+	if params.ShippingAddressID == "" {
+		if httpError := verifyShippingAddress(ctx, log, order, params.ShippingAddress); httpError != nil {
+			return httpError
+		}
+	}
+
+	span, ctx := tracing.StartSpan(ctx, "order.create")
+	span.SetTag("order_id", order.ID)
+	defer span.Finish()
+	txSpan, _ := tracing.StartSpan(ctx, "db.transaction")
+	defer txSpan.Finish()
 	tx := a.db.Begin()
 
 	order.IP = r.RemoteAddr
 	order.MetaData = params.MetaData
+	if params.DeliveryInstructions != nil {
+		instructions, err := models.CleanDeliveryInstructions(*params.DeliveryInstructions)
+		if err != nil {
+			tx.Rollback()
+			return badRequestError(err.Error())
+		}
+		order.DeliveryInstructions = instructions
+	}
 	httpError := setOrderEmail(tx, order, claims, log)
 	if httpError != nil {
 		log.WithError(httpError).Info("Failed to set the order email from the token")
@@ -352,7 +535,20 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 
 	log.WithField("order_user_id", order.UserID).Debug("Successfully set the order's ID")
 
-	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID)
+	if httpError := setOrderTaxExemption(ctx, tx, order, params); httpError != nil {
+		tx.Rollback()
+		return httpError
+	}
+	order.SuppressNotifications = config.TestMode
+	if params.SuppressNotifications != nil {
+		if !gcontext.HasScope(ctx, ordersWriteScope) {
+			tx.Rollback()
+			return unauthorizedError("Only admins can suppress the notifications of orders")
+		}
+		order.SuppressNotifications = order.SuppressNotifications || *params.SuppressNotifications
+	}
+
+	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID, params.SaveToAddressBook)
 	if httpError != nil {
 		tx.Rollback()
 		return httpError
@@ -364,7 +560,7 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	order.ShippingAddress = *shipping
 	order.ShippingAddressID = shipping.ID
 
-	billing, httpError := a.processAddress(tx, order, "Billing Address", params.BillingAddress, params.BillingAddressID)
+	billing, httpError := a.processAddress(tx, order, "Billing Address", params.BillingAddress, params.BillingAddressID, params.SaveToAddressBook)
 	if httpError != nil {
 		tx.Rollback()
 		return httpError
@@ -378,17 +574,15 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if params.VATNumber != "" {
-		valid, err := vat.IsValidVAT(params.VATNumber)
-		if err != nil {
+		verified, httpError := a.verifyVATNumber(ctx, log, params.VATNumber)
+		if httpError != nil {
 			tx.Rollback()
-			return internalServerError("Error verifying VAT number").WithInternalError(err)
-		}
-		if !valid {
-			tx.Rollback()
-			return badRequestError("Vat number %v is not valid", order.VATNumber)
+			return httpError
 		}
 		order.VATNumber = params.VATNumber
+		order.VATNumberUnverified = !verified
 	}
+	order.ShippingMethod = params.ShippingMethod
 
 	if httpError := a.createLineItems(ctx, tx, order, params.LineItems); httpError != nil {
 		log.WithError(httpError).Error("Failed to create order line items")
@@ -398,13 +592,40 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 
 	log.WithField("subtotal", order.SubTotal).Debug("Successfully processed all the line items")
 
+	if httpError := checkInventory(tx, order); httpError != nil {
+		log.WithError(httpError).Info("Not enough stock for the order")
+		tx.Rollback()
+		return httpError
+	}
+
+	a.pinPrices(tx, config, order, log)
+
+	if err := extensions.ValidateOrder(ctx, order); err != nil {
+		log.WithError(err).Info("Order was rejected by an extension")
+		tx.Rollback()
+		return badRequestError("%s", err.Error())
+	}
+
+	if httpError := runOrderValidation(ctx, order, log); httpError != nil {
+		log.WithError(httpError).Info("Order was rejected by the validation webhook")
+		tx.Rollback()
+		return httpError
+	}
+
 	tx.Create(order)
-	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
-	if config.Webhooks.Order != "" {
-		hook := models.NewHook("order", config.Webhooks.Order, order.UserID, config.Webhooks.Secret, order)
+	if actor == "" {
+		actor = order.UserID
+	} else {
+		log.WithField("actor_id", actor).Info("Admin created order for a customer")
+	}
+	models.LogEvent(tx, r.RemoteAddr, actor, order.ID, models.EventCreated, nil)
+	recordFunnelStep(tx, order, models.OrderCreatedStep, log)
+	if config.Webhooks.Order != "" && !order.SuppressNotifications {
+		hook := newHook(ctx, log, order.InstanceID, models.OrderCreatedHook, config.Webhooks.Order, order.UserID, order)
 		tx.Save(hook)
 	}
 	tx.Commit()
+	a.enqueueAutomations(ctx, log, order)
 
 	log.Infof("Successfully created order %s", order.ID)
 	return sendJSON(w, http.StatusCreated, order)
@@ -423,6 +644,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	claims := gcontext.GetClaims(ctx)
 	config := gcontext.GetConfig(ctx)
 	changes := []string{}
+	diff := map[string]models.Change{}
 
 	orderParams := new(orderRequestParams)
 	err := json.NewDecoder(r.Body).Decode(orderParams)
@@ -433,7 +655,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	// verify that the order exists
 	existingOrder := new(models.Order)
 
-	rsp := orderQuery(a.db).First(existingOrder, "id = ?", orderID)
+	rsp := orderQuery(a.db).First(existingOrder, "id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx))
 	if rsp.RecordNotFound() {
 		return notFoundError("Failed to find order with id '%s'", orderID)
 	}
@@ -453,11 +675,13 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	}
 	if orderParams.Email != "" {
 		log.Debugf("Updating email from '%s' to '%s'", existingOrder.Email, orderParams.Email)
+		diff["email"] = models.Change{From: existingOrder.Email, To: orderParams.Email}
 		existingOrder.Email = orderParams.Email
 		changes = append(changes, "email")
 	}
 
 	if orderParams.MetaData != nil {
+		diff["meta"] = models.Change{From: existingOrder.MetaData, To: orderParams.MetaData}
 		existingOrder.MetaData = orderParams.MetaData
 	}
 
@@ -466,6 +690,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			return badRequestError("Can't update the currency after payment has been processed")
 		}
 		log.Debugf("Updating currency from '%v' to '%v'", existingOrder.Currency, orderParams.Currency)
+		diff["currency"] = models.Change{From: existingOrder.Currency, To: orderParams.Currency}
 		existingOrder.Currency = orderParams.Currency
 		changes = append(changes, "currency")
 	}
@@ -473,11 +698,83 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		if alreadyPaid {
 			return badRequestError("Can't update the VAT number after payment has been processed")
 		}
+		verified, httpError := a.verifyVATNumber(ctx, log, orderParams.VATNumber)
+		if httpError != nil {
+			return httpError
+		}
+		existingOrder.VATNumberUnverified = !verified
 
 		log.Debugf("Updating vat number from '%v' to '%v'", existingOrder.VATNumber, orderParams.VATNumber)
+		diff["vatnumber"] = models.Change{From: existingOrder.VATNumber, To: orderParams.VATNumber}
 		existingOrder.VATNumber = orderParams.VATNumber
 		changes = append(changes, "vatnumber")
 	}
+	if orderParams.TaxExempt != nil {
+		exempt, reason := *orderParams.TaxExempt, orderParams.TaxExemptReason
+		if !exempt {
+			reason = ""
+		}
+		if exempt != existingOrder.TaxExempt || reason != existingOrder.TaxExemptReason {
+			if alreadyPaid {
+				return badRequestError("Can't update the tax exemption after payment has been processed")
+			}
+			if exempt && reason == "" {
+				return badRequestError("Tax exempt orders require a 'tax_exempt_reason'")
+			}
+			diff["tax_exempt"] = models.Change{From: existingOrder.TaxExempt, To: exempt}
+			diff["tax_exempt_reason"] = models.Change{From: existingOrder.TaxExemptReason, To: reason}
+			existingOrder.TaxExempt = exempt
+			existingOrder.TaxExemptReason = reason
+			changes = append(changes, "tax_exempt")
+		}
+	}
+	if orderParams.Tags != nil {
+		diff["tags"] = models.Change{From: existingOrder.Tags, To: orderParams.Tags}
+		existingOrder.Tags = orderParams.Tags
+		changes = append(changes, "tags")
+	}
+	if orderParams.OnHold != nil {
+		onHold, reason := *orderParams.OnHold, orderParams.HoldReason
+		if !onHold {
+			reason = ""
+		}
+		if onHold != existingOrder.OnHold || reason != existingOrder.HoldReason {
+			diff["on_hold"] = models.Change{From: existingOrder.OnHold, To: onHold}
+			diff["hold_reason"] = models.Change{From: existingOrder.HoldReason, To: reason}
+			existingOrder.OnHold = onHold
+			existingOrder.HoldReason = reason
+			changes = append(changes, "on_hold")
+		}
+	}
+	if orderParams.SuppressNotifications != nil && *orderParams.SuppressNotifications != existingOrder.SuppressNotifications {
+		diff["suppress_notifications"] = models.Change{From: existingOrder.SuppressNotifications, To: *orderParams.SuppressNotifications}
+		existingOrder.SuppressNotifications = *orderParams.SuppressNotifications
+		changes = append(changes, "suppress_notifications")
+	}
+	if orderParams.ShippingMethod != "" {
+		if alreadyPaid {
+			return badRequestError("Can't update the shipping method after payment has been processed")
+		}
+		log.Debugf("Updating shipping method from '%v' to '%v'", existingOrder.ShippingMethod, orderParams.ShippingMethod)
+		diff["shipping_method"] = models.Change{From: existingOrder.ShippingMethod, To: orderParams.ShippingMethod}
+		existingOrder.ShippingMethod = orderParams.ShippingMethod
+		changes = append(changes, "shipping_method")
+	}
+	if orderParams.DeliveryInstructions != nil {
+		if existingOrder.FulfillmentState == models.ShippedState || existingOrder.FulfillmentState == models.DeliveredState {
+			return badRequestError("Can't update the delivery instructions after the order has been shipped")
+		}
+		instructions, err := models.CleanDeliveryInstructions(*orderParams.DeliveryInstructions)
+		if err != nil {
+			return badRequestError(err.Error())
+		}
+		if instructions != existingOrder.DeliveryInstructions {
+			log.Debugf("Updating delivery instructions from '%v' to '%v'", existingOrder.DeliveryInstructions, instructions)
+			diff["delivery_instructions"] = models.Change{From: existingOrder.DeliveryInstructions, To: instructions}
+			existingOrder.DeliveryInstructions = instructions
+			changes = append(changes, "delivery_instructions")
+		}
+	}
 
 	tx := a.db.Begin()
 
@@ -487,13 +784,14 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	if orderParams.BillingAddress != nil || orderParams.BillingAddressID != "" {
 		log.Debugf("Updating order's billing address")
 
-		addr, httpErr := a.processAddress(tx, existingOrder, "Billing Address", orderParams.BillingAddress, orderParams.BillingAddressID)
+		addr, httpErr := a.processAddress(tx, existingOrder, "Billing Address", orderParams.BillingAddress, orderParams.BillingAddressID, orderParams.SaveToAddressBook)
 		if httpErr != nil {
 			log.WithError(httpErr).Warn("Failed to update the billing address")
 			tx.Rollback()
 			return httpErr
 		}
 		old := existingOrder.BillingAddressID
+		diff["billing_address"] = models.Change{From: existingOrder.BillingAddress, To: *addr}
 		existingOrder.BillingAddress = *addr
 		log.WithFields(logrus.Fields{
 			"address_id":     addr.ID,
@@ -505,7 +803,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	if orderParams.ShippingAddress != nil || orderParams.ShippingAddressID != "" {
 		log.Debugf("Updating order's shipping address")
 
-		addr, httpErr := a.processAddress(tx, existingOrder, "Shipping Address", orderParams.ShippingAddress, orderParams.ShippingAddressID)
+		addr, httpErr := a.processAddress(tx, existingOrder, "Shipping Address", orderParams.ShippingAddress, orderParams.ShippingAddressID, orderParams.SaveToAddressBook)
 		if httpErr != nil {
 			log.WithError(httpErr).Warn("Failed to update the shipping address")
 			tx.Rollback()
@@ -513,6 +811,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		}
 
 		old := existingOrder.ShippingAddressID
+		diff["shipping_address"] = models.Change{From: existingOrder.ShippingAddress, To: *addr}
 		existingOrder.ShippingAddress = *addr
 		log.WithFields(logrus.Fields{
 			"address_id":     addr.ID,
@@ -521,17 +820,32 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		changes = append(changes, "shipping_address")
 	}
 
-	if orderParams.FulfillmentState != "" {
-		_, ok := map[string]bool{
-			"pending":  true,
-			"shipping": true,
-			"shipped":  true,
-		}[orderParams.FulfillmentState]
-		if !ok {
+	//
+	// handle the state transitions
+	//
+	transitions := [][3]string{}
+	if orderParams.State != "" && orderParams.State != existingOrder.State {
+		from := existingOrder.State
+		if !existingOrder.TransitionState(orderParams.State) {
+			tx.Rollback()
+			return invalidTransitionError("state", from, orderParams.State, existingOrder.AllowedStateTransitions())
+		}
+		transitions = append(transitions, [3]string{"state", from, orderParams.State})
+		diff["state"] = models.Change{From: from, To: orderParams.State}
+		changes = append(changes, "state")
+	}
+	if orderParams.FulfillmentState != "" && orderParams.FulfillmentState != existingOrder.FulfillmentState {
+		if existingOrder.OnHold && (orderParams.FulfillmentState == models.ShippedState || orderParams.FulfillmentState == models.DeliveredState) {
 			tx.Rollback()
-			return badRequestError("Bad fulfillment state: " + orderParams.FulfillmentState)
+			return badRequestError("Can't ship an order that is on hold: %v", existingOrder.HoldReason)
 		}
-		existingOrder.FulfillmentState = orderParams.FulfillmentState
+		from := existingOrder.FulfillmentState
+		if !existingOrder.TransitionFulfillmentState(orderParams.FulfillmentState) {
+			tx.Rollback()
+			return invalidTransitionError("fulfillment state", from, orderParams.FulfillmentState, existingOrder.AllowedFulfillmentStateTransitions())
+		}
+		transitions = append(transitions, [3]string{"fulfillment_state", from, orderParams.FulfillmentState})
+		diff["fulfillment_state"] = models.Change{From: from, To: orderParams.FulfillmentState}
 		changes = append(changes, "fulfillment_state")
 	}
 
@@ -543,8 +857,12 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		updatedItems[item.Sku] = item
 	}
 
+	oldQuantities := map[string]uint64{}
+	newQuantities := map[string]uint64{}
 	for _, item := range existingOrder.LineItems {
 		if update, exists := updatedItems[item.Sku]; exists {
+			oldQuantities[item.Sku] = item.Quantity
+			newQuantities[item.Sku] = update.Quantity
 			item.Quantity = update.Quantity
 			if update.Path != "" {
 				item.Path = update.Path
@@ -553,8 +871,33 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if len(updatedItems) > 0 {
+		diff["line_items"] = models.Change{From: oldQuantities, To: newQuantities}
 		changes = append(changes, "line_items")
 	}
+	if len(updatedItems) > 0 || orderParams.ShippingAddress != nil || orderParams.ShippingAddressID != "" {
+		if httpError := checkShippingRegions(existingOrder); httpError != nil {
+			tx.Rollback()
+			return httpError
+		}
+	}
+
+	// payments are only taken for the stored total, so unpaid orders are
+	// priced again when something their price depends on changed, and
+	// pinned prices are pinned again for the new quote
+	if existingOrder.PaymentState == models.PendingState && changesPrice(changes) {
+		from := existingOrder.Total
+		if httpError := a.recalculateOrder(ctx, tx, existingOrder); httpError != nil {
+			tx.Rollback()
+			return httpError
+		}
+		if existingOrder.PricesExpireAt != nil {
+			a.pinPrices(tx, config, existingOrder, log)
+		}
+		if existingOrder.Total != from {
+			diff["total"] = models.Change{From: from, To: existingOrder.Total}
+			changes = append(changes, "total")
+		}
+	}
 
 	log.Info("Saving order updates")
 	if rsp := tx.Save(existingOrder); rsp.Error != nil {
@@ -562,20 +905,228 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
 	}
 
-	models.LogEvent(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, models.EventUpdated, changes)
-	if config.Webhooks.Update != "" {
+	models.LogEventWithDiff(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, models.EventUpdated, changes, diff)
+	for _, t := range transitions {
+		models.LogTransition(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, t[0], t[1], t[2])
+	}
+	if config.Webhooks.Update != "" && !existingOrder.SuppressNotifications {
 		// TODO should this be claims.Subject or existingOrder.UserID ?
-		hook := models.NewHook("update", config.Webhooks.Update, claims.Subject, config.Webhooks.Secret, existingOrder)
+		hook := newHook(ctx, log, existingOrder.InstanceID, models.OrderUpdatedHook, config.Webhooks.Update, claims.Subject, existingOrder)
 		tx.Save(hook)
 	}
 	if rsp := tx.Commit(); rsp.Error != nil {
 		tx.Rollback()
 		return internalServerError("Error committing order updates").WithInternalError(rsp.Error)
 	}
+	a.enqueueAutomations(ctx, log, existingOrder)
 
 	return sendJSON(w, http.StatusOK, existingOrder)
 }
 
+// OrderDelete cancels an unpaid order. Cancelled orders are soft deleted, so
+// they no longer show up for buyers, and admins can still list them with
+// include_deleted=true. Buyers of anonymous orders prove they placed them
+// with the email of the order in the email query parameter. The order is
+// locked like when it is paid, so it can't be paid while it is cancelled.
+func (a *API) OrderDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+
+	tx := a.db.Begin()
+	order := &models.Order{}
+	if rsp := orderQuery(models.ForUpdate(tx)).First(order, "id = ? AND instance_id = ?", gcontext.GetOrderID(ctx), gcontext.GetInstanceID(ctx)); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if !gcontext.HasScope(ctx, ordersWriteScope) {
+		if order.UserID != "" && (claims == nil || claims.Subject != order.UserID) {
+			tx.Rollback()
+			return unauthorizedError("You don't have access to this order")
+		}
+		if order.UserID == "" && !hasOrderEmail(r, order) {
+			tx.Rollback()
+			return unauthorizedError("Cancelling an anonymous order requires the email of the order")
+		}
+	}
+	if order.PaymentState != models.PendingState {
+		tx.Rollback()
+		return badRequestError("Only unpaid orders can be cancelled")
+	}
+	for _, t := range order.Transactions {
+		if t.Status == models.PendingState {
+			tx.Rollback()
+			return conflictError("This order has a payment in progress and can't be cancelled")
+		}
+	}
+
+	// stock is only taken out of the inventory when an order is paid, so the
+	// only inventory an unpaid order holds is what its pending payments
+	// would take, and those were ruled out above
+	if rsp := tx.Delete(order); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error cancelling order").WithInternalError(rsp.Error)
+	}
+	var userID string
+	if claims != nil {
+		userID = claims.Subject
+	}
+	models.LogEvent(tx, r.RemoteAddr, userID, order.ID, models.EventDeleted, nil)
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error cancelling order").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("order_id", order.ID).Info("Cancelled order")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// hasOrderEmail tells if the email query parameter of a request is the email
+// of an order, which is how buyers of anonymous orders identify themselves.
+func hasOrderEmail(r *http.Request, order *models.Order) bool {
+	email := r.URL.Query().Get("email")
+	return email != "" && models.NormalizeEmail(email) == models.NormalizeEmail(order.Email)
+}
+
+// OrderRecalculate prices an unpaid order again with the current settings and
+// saves its new total. Orders whose stored total no longer matches their
+// price can't be paid until they are recalculated. It is only available to
+// admins.
+func (a *API) OrderRecalculate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+
+	tx := a.db.Begin()
+	order := &models.Order{}
+	if rsp := orderQuery(tx).First(order, "id = ? AND instance_id = ?", gcontext.GetOrderID(ctx), gcontext.GetInstanceID(ctx)); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if order.PaymentState != models.PendingState {
+		tx.Rollback()
+		return badRequestError("Only unpaid orders can be recalculated")
+	}
+
+	from := order.Total
+	if httpError := a.recalculateOrder(ctx, tx, order); httpError != nil {
+		tx.Rollback()
+		return httpError
+	}
+	if rsp := tx.Save(order); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order").WithInternalError(rsp.Error)
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"total"}, map[string]models.Change{
+		"total": {From: from, To: order.Total},
+	})
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving order").WithInternalError(rsp.Error)
+	}
+
+	log.WithFields(logrus.Fields{"from": from, "to": order.Total}).Info("Recalculated order")
+	return sendJSON(w, http.StatusOK, order)
+}
+
+// pinPrices pins the prices an order was just priced with. The exchange rate
+// of the day is pinned with the prices of orders in another currency than the
+// default one.
+func (a *API) pinPrices(tx *gorm.DB, config *conf.Configuration, order *models.Order, log logrus.FieldLogger) {
+	var snapshot *rates.Snapshot
+	if source := a.config.ExchangeRates.Source; source != "" && config.Defaults.Currency != "" && order.Currency != config.Defaults.Currency {
+		var err error
+		snapshot, err = models.GetExchangeRates(tx, source, time.Now().UTC().Format(rates.DateFormat))
+		if err != nil {
+			log.WithError(err).Warn("Failed to load the exchange rates to pin")
+		}
+	}
+	order.PinPrices(time.Duration(config.Pricing.QuoteValidity)*time.Minute, snapshot, config.Defaults.Currency)
+}
+
+// recalculateOrder prices an order again with the current settings. The
+// claims are those of the request when it's made by the buyer, and
+// otherwise the buyer's ID and customer groups.
+func (a *API) recalculateOrder(ctx context.Context, tx *gorm.DB, order *models.Order) *HTTPError {
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+
+	jwtClaims, err := a.orderPriceClaims(ctx, tx, order)
+	if err != nil {
+		return internalServerError("Error loading customer groups").WithInternalError(err)
+	}
+
+	price := order.CalculateTotal(settings, jwtClaims)
+	if price.ShippingError != nil {
+		return badRequestError("%v", price.ShippingError)
+	}
+	return nil
+}
+
+// isOrderLookup tells whether an order list looks up an order by a reference
+// from outside the shop, like a bank statement or the dashboard of the
+// payment provider.
+func isOrderLookup(params url.Values) bool {
+	return params.Get("invoice_number") != "" || params.Get("transaction_id") != ""
+}
+
+// changesPrice tells whether changes to an order affect its price.
+func changesPrice(changes []string) bool {
+	for _, change := range changes {
+		switch change {
+		case "line_items", "currency", "vatnumber", "shipping_method", "shipping_address", "tax_exempt":
+			return true
+		}
+	}
+	return false
+}
+
+// setOrderTaxExemption exempts a new order from taxes when an admin asks for
+// it, or else when its user is exempt.
+func setOrderTaxExemption(ctx context.Context, tx *gorm.DB, order *models.Order, params *orderRequestParams) *HTTPError {
+	if params.TaxExempt != nil {
+		if !gcontext.HasScope(ctx, ordersWriteScope) {
+			return unauthorizedError("Only admins can exempt orders from taxes")
+		}
+		if *params.TaxExempt && params.TaxExemptReason == "" {
+			return badRequestError("Tax exempt orders require a 'tax_exempt_reason'")
+		}
+		if *params.TaxExempt {
+			order.TaxExempt = true
+			order.TaxExemptReason = params.TaxExemptReason
+		}
+		return nil
+	}
+	if order.UserID == "" {
+		return nil
+	}
+	user, err := models.GetUser(tx, order.UserID)
+	if err != nil {
+		return internalServerError("Error loading user").WithInternalError(err)
+	}
+	if user != nil && user.TaxExempt {
+		order.TaxExempt = true
+		order.TaxExemptReason = user.TaxExemptReason
+	}
+	return nil
+}
+
+// customerClaims are the claims of the customer an admin creates an order
+// for.
+func customerClaims(userID, email string) *claims.JWTClaims {
+	return &claims.JWTClaims{
+		StandardClaims: jwt.StandardClaims{Subject: userID},
+		Email:          email,
+	}
+}
+
 // An order's email is determined by a few things. The rules guiding it are:
 // 1 - if no claims are provided then the one in the params is used (for anon orders)
 // 2 - if claims are provided they must be a valid user id
@@ -616,51 +1167,194 @@ func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, l
 	return nil
 }
 
-func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem) *HTTPError {
-	sem := make(chan int, MaxConcurrentLookups)
-	var wg sync.WaitGroup
-	sharedErr := verificationError{}
-	for _, orderItem := range items {
-		lineItem := &models.LineItem{
+// priceLineItems adds the line items to an order with the prices and
+// metadata of the products on the site, without saving them. Line items
+// with a price set by an admin are taken as they are.
+func (a *API) priceLineItems(ctx context.Context, db *gorm.DB, order *models.Order, items []*orderLineItem) *HTTPError {
+	jwtClaims, err := a.orderPriceClaims(ctx, db, order)
+	if err != nil {
+		return internalServerError("Error loading customer groups").WithInternalError(err)
+	}
+	lineItems := make([]*models.LineItem, len(items))
+	for i, orderItem := range items {
+		lineItems[i] = &models.LineItem{
 			Sku:      orderItem.Sku,
 			Quantity: orderItem.Quantity,
 			MetaData: orderItem.MetaData,
 			Path:     orderItem.Path,
 			OrderID:  order.ID,
 		}
-		order.LineItems = append(order.LineItems, lineItem)
-		sem <- 1
-		wg.Add(1)
-		go func(item *models.LineItem, orderItem *orderLineItem) {
-			defer func() {
-				wg.Done()
-				<-sem
-			}()
-			// Stop doing any work if there's already an error
-			if sharedErr.err != nil {
-				return
+		if orderItem.Price != nil {
+			if !gcontext.HasScope(ctx, ordersWriteScope) {
+				return unauthorizedError("Only admins can set the prices of line items")
 			}
-
-			if err := a.processLineItem(ctx, order, item, orderItem); err != nil {
-				sharedErr.setError(err)
+			if orderItem.Sku == "" || orderItem.Title == "" {
+				return badRequestError("Line items with a price require a sku and a title")
+			}
+			if len(orderItem.Addons) > 0 {
+				return badRequestError("Line items with a price can't have addons")
 			}
-		}(lineItem, orderItem)
+			lineItems[i].ProcessManual(*orderItem.Price, orderItem.Title, orderItem.Type, orderItem.Description, orderItem.VAT)
+		}
+	}
+
+	// the products are fetched concurrently, and the fetches still running
+	// are canceled as soon as one fails or the client goes away
+	metas := make([]*models.LineItemMetadata, len(items))
+	g, gctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, MaxConcurrentLookups)
+launch:
+	for i, item := range lineItems {
+		if item.ManualPrice {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-gctx.Done():
+			break launch
+		}
+		i, item := i, item
+		g.Go(func() error {
+			defer func() { <-sem }()
+			meta, err := a.processLineItem(gctx, item)
+			metas[i] = meta
+			return err
+		})
+	}
+	err = g.Wait()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		return lineItemError(err)
 	}
-	wg.Wait()
 
-	if sharedErr.err != nil {
-		return internalServerError("Error processing line item").WithInternalError(sharedErr.err)
+	for i, item := range lineItems {
+		if item.ManualPrice {
+			order.LineItems = append(order.LineItems, item)
+			continue
+		}
+		for _, addon := range items[i].Addons {
+			item.AddonItems = append(item.AddonItems, &models.AddonItem{
+				Sku: addon.Sku,
+			})
+		}
+		if err := item.Process(jwtClaims, order, metas[i]); err != nil {
+			return lineItemError(err)
+		}
+		order.LineItems = append(order.LineItems, item)
+	}
+
+	order.PriceList = models.DefaultPriceList
+	for _, item := range order.LineItems {
+		if item.PriceList != "" && item.PriceList != models.DefaultPriceList {
+			order.PriceList = item.PriceList
+		}
+	}
+
+	for _, item := range order.LineItems {
+		if err := extensions.AdjustPrice(ctx, order, item); err != nil {
+			return internalServerError("Error adjusting line item price").WithInternalError(err)
+		}
 	}
 
 	for _, item := range order.LineItems {
 		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
+		order.Cost = order.Cost + item.Cost*item.Quantity
+	}
+	return a.addCouponGift(ctx, order)
+}
+
+// addCouponGift adds the gift of the coupon of an order as a free line item
+// when the order qualifies for it. Gifts that are out of stock are left out
+// rather than failing the order.
+func (a *API) addCouponGift(ctx context.Context, order *models.Order) *HTTPError {
+	coupon := order.Coupon
+	if !coupon.QualifiesForGift(order.LineItems, order.Currency, order.SubTotal) {
+		return nil
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"coupon":   coupon.Code,
+		"order_id": order.ID,
+	})
+
+	metaProducts, err := a.loadProductMetadata(ctx, coupon.Gift.Path)
+	if err != nil {
+		if err == breaker.ErrOpen {
+			return serviceUnavailableError("The products of this shop can't be loaded right now, please try again later")
+		}
+		return internalServerError("Error loading the gift of the coupon").WithInternalError(err)
+	}
+	var meta *models.LineItemMetadata
+	for _, m := range metaProducts {
+		if m.Sku == coupon.Gift.Sku || (coupon.Gift.Sku == "" && len(metaProducts) == 1) {
+			meta = m
+			break
+		}
+	}
+	if meta == nil {
+		log.Warnf("The gift %v of the coupon doesn't match a product on %v", coupon.Gift.Sku, coupon.Gift.Path)
+		return nil
+	}
+
+	quantity := coupon.Gift.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	inventory, err := models.GetInventory(a.db, order.InstanceID, meta.Sku)
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	var stock *int64
+	if inventory != nil {
+		stock = &inventory.Stock
+	} else if meta.Inventory != nil {
+		initial := int64(*meta.Inventory)
+		stock = &initial
+	}
+	if stock != nil {
+		available := *stock
+		for _, item := range order.LineItems {
+			if item.Sku == meta.Sku {
+				available -= int64(item.Quantity)
+			}
+		}
+		if available < int64(quantity) {
+			log.Infof("Leaving out the gift %v of the coupon, it is out of stock", meta.Sku)
+			return nil
+		}
+	}
+
+	item := &models.LineItem{
+		Path:     coupon.Gift.Path,
+		Quantity: quantity,
+		OrderID:  order.ID,
+	}
+	item.ProcessGift(order, meta)
+	order.LineItems = append(order.LineItems, item)
+	return nil
+}
+
+func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem) *HTTPError {
+	if _, httpError := a.priceOrder(ctx, tx, order, items); httpError != nil {
+		return httpError
+	}
+
+	for _, item := range order.LineItems {
 		if err := tx.Save(&item).Error; err != nil {
 			return internalServerError("Error creating line item").WithInternalError(err)
 		}
 	}
 
-	for _, download := range order.Downloads {
-		if err := tx.Create(&download).Error; err != nil {
+	for i := range order.Downloads {
+		download := &order.Downloads[i]
+		for _, item := range order.LineItems {
+			if item.Sku == download.Sku {
+				download.LineItemID = item.ID
+				break
+			}
+		}
+		if err := tx.Create(download).Error; err != nil {
 			return internalServerError("Error creating download item").WithInternalError(err)
 		}
 	}
@@ -669,90 +1363,113 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 	if err != nil {
 		return internalServerError(err.Error()).WithInternalError(err)
 	}
-
-	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx))
-	return nil
+	return validateOrderMetaData(settings, order.MetaData)
 }
 
-func (a *API) loadSettings(ctx context.Context) (*calculator.Settings, error) {
-	config := gcontext.GetConfig(ctx)
+// priceOrder prices the line items of an order that isn't saved yet and
+// calculates its total, checking the quantity limits, the shipping regions
+// and the coupon. New orders, previews and carts are all priced with it, so
+// they agree on the price.
+func (a *API) priceOrder(ctx context.Context, db *gorm.DB, order *models.Order, items []*orderLineItem) (calculator.Price, *HTTPError) {
+	if httpError := a.priceLineItems(ctx, db, order, items); httpError != nil {
+		return calculator.Price{}, httpError
+	}
+	if httpError := a.checkQuantityLimits(db, order); httpError != nil {
+		return calculator.Price{}, httpError
+	}
+	if httpError := checkShippingRegions(order); httpError != nil {
+		return calculator.Price{}, httpError
+	}
 
-	settings := &calculator.Settings{}
-	resp, err := a.httpClient.Get(config.SiteURL + "/gocommerce/settings.json")
+	settings, err := a.loadSettings(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Error loading site settings: %v", err)
+		return calculator.Price{}, internalServerError("Error loading site settings").WithInternalError(err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		decoder := json.NewDecoder(resp.Body)
-		if err := decoder.Decode(settings); err != nil {
-			return nil, fmt.Errorf("Error parsing site settings: %v", err)
-		}
+	jwtClaims, err := a.orderPriceClaims(ctx, db, order)
+	if err != nil {
+		return calculator.Price{}, internalServerError("Error loading customer groups").WithInternalError(err)
+	}
+	price := order.CalculateTotal(settings, jwtClaims)
+	if price.ShippingError != nil {
+		return calculator.Price{}, badRequestError("%v", price.ShippingError)
 	}
 
-	return settings, nil
+	if order.Coupon != nil {
+		if !order.Coupon.ValidForItems(order.LineItems, order.Currency) {
+			return calculator.Price{}, badRequestError("This order doesn't reach the minimum amount of the coupon")
+		}
+		if httpError := checkCouponRedemptions(db, order); httpError != nil {
+			return calculator.Price{}, httpError
+		}
+	}
+	return price, nil
 }
 
-func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, address *models.Address, id string) (*models.Address, *HTTPError) {
+// processAddress returns a snapshot of the address an order uses, either an
+// address from the address book of its user by ID, or a new address. A new
+// address is also saved to the address book when save is set.
+func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, address *models.Address, id string, save bool) (*models.Address, *HTTPError) {
 	if address == nil && id == "" {
 		return nil, nil
 	}
+	if order.UserID == "" {
+		if id != "" {
+			return nil, badRequestError("Can't use a saved %v without being logged in", name)
+		}
+		if save {
+			return nil, badRequestError("Can't save a %v to the address book without being logged in", name)
+		}
+	}
 
+	var source *models.Address
 	if id != "" {
-		loadedAddress := new(models.Address)
-		if result := tx.First(loadedAddress, "id = ?", id); result.Error != nil {
+		source = new(models.Address)
+		if result := tx.First(source, "id = ?", id); result.Error != nil {
 			return nil, badRequestError("Bad %v id: %v", name, id).WithInternalError(result.Error)
 		}
-
-		if order.UserID != loadedAddress.UserID {
+		if order.UserID != source.UserID {
 			return nil, badRequestError("Can't update the order to an %v that doesn't belong to the user", name)
 		}
-		return loadedAddress, nil
+		if source.Snapshot {
+			return nil, badRequestError("%v %v is not in the address book, use its source_id or save it to the address book", name, id)
+		}
+	} else {
+		if err := address.Validate(); err != nil {
+			return nil, badRequestError("Failed to validate %v: %v", name, err.Error())
+		}
+		if save {
+			source = &models.Address{AddressRequest: address.AddressRequest, ID: uuid.NewRandom().String(), UserID: order.UserID}
+			if rsp := tx.Create(source); rsp.Error != nil {
+				return nil, internalServerError("Error saving %v", name).WithInternalError(rsp.Error)
+			}
+		}
 	}
 
-	address.UserID = order.UserID
-	// it is a new address we're making
-	if err := address.Validate(); err != nil {
-		return nil, badRequestError("Failed to validate %v: %v", name, err.Error())
+	snapshot := &models.Address{ID: uuid.NewRandom().String(), UserID: order.UserID, Snapshot: true}
+	if source != nil {
+		snapshot.AddressRequest = source.AddressRequest
+		snapshot.SourceID = source.ID
+	} else {
+		snapshot.AddressRequest = address.AddressRequest
 	}
-
-	// is a valid id that doesn't already belong to a user
-	address.ID = uuid.NewRandom().String()
-	tx.Create(address)
-	return address, nil
+	if rsp := tx.Create(snapshot); rsp.Error != nil {
+		return nil, internalServerError("Error saving %v", name).WithInternalError(rsp.Error)
+	}
+	return snapshot, nil
 }
 
-func (a *API) processLineItem(ctx context.Context, order *models.Order, item *models.LineItem, orderItem *orderLineItem) error {
-	config := gcontext.GetConfig(ctx)
-	jwtClaims := gcontext.GetClaimsAsMap(ctx)
-	resp, err := a.httpClient.Get(config.SiteURL + item.Path)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// processLineItem fetches the product page of a line item and returns the
+// metadata of its SKU. Line items without a SKU get the SKU of the page when it
+// has a single product.
+func (a *API) processLineItem(ctx context.Context, item *models.LineItem) (*models.LineItemMetadata, error) {
+	span, ctx := tracing.StartSpan(ctx, "order.process_line_item")
+	span.SetTag("path", item.Path)
+	defer span.Finish()
 
-	doc, err := goquery.NewDocumentFromResponse(resp)
+	metaProducts, err := a.loadProductMetadata(ctx, item.Path)
 	if err != nil {
-		return err
-	}
-
-	metaTag := doc.Find(".gocommerce-product")
-	if metaTag.Length() == 0 {
-		return fmt.Errorf("No script tag with class gocommerce-product tag found for '%v'", item.Title)
-	}
-	metaProducts := []*models.LineItemMetadata{}
-	var parsingErr error
-	metaTag.EachWithBreak(func(_ int, tag *goquery.Selection) bool {
-		meta := &models.LineItemMetadata{}
-		parsingErr = json.Unmarshal([]byte(tag.Text()), meta)
-		if parsingErr != nil {
-			return false
-		}
-		metaProducts = append(metaProducts, meta)
-		return true
-	})
-	if parsingErr != nil {
-		return fmt.Errorf("Error parsing product metadata: %v", parsingErr)
+		span.SetError(err)
+		return nil, err
 	}
 
 	if len(metaProducts) == 1 && item.Sku == "" {
@@ -761,17 +1478,34 @@ func (a *API) processLineItem(ctx context.Context, order *models.Order, item *mo
 
 	for _, meta := range metaProducts {
 		if meta.Sku == item.Sku {
-			for _, addon := range orderItem.Addons {
-				item.AddonItems = append(item.AddonItems, &models.AddonItem{
-					Sku: addon.Sku,
-				})
-			}
-
-			return item.Process(jwtClaims, order, meta)
+			return meta, nil
 		}
 	}
 
-	return fmt.Errorf("No product Sku from path matched: %v", item.Sku)
+	return nil, &productNotFoundError{fmt.Sprintf("No product Sku from path matched: %v", item.Sku)}
+}
+
+// lineItemError turns an error pricing line items into the response for it.
+// Products that can't be found or priced are errors of the request, while
+// the site failing is not.
+func lineItemError(err error) *HTTPError {
+	switch e := err.(type) {
+	case *HTTPError:
+		return e
+	case *productNotFoundError:
+		return badRequestError("%v", e.Error())
+	case *models.MissingPriceError:
+		return badRequestError("%v", e.Error())
+	}
+	switch err {
+	case breaker.ErrOpen:
+		return serviceUnavailableError("The products of this shop can't be loaded right now, please try again later")
+	case context.Canceled:
+		return httpError(http.StatusRequestTimeout, "The request was canceled before the products were loaded")
+	case context.DeadlineExceeded:
+		return httpError(http.StatusGatewayTimeout, "Loading the products took too long")
+	}
+	return internalServerError("Error processing line item: %v", err).WithInternalError(err)
 }
 
 func orderQuery(db *gorm.DB) *gorm.DB {
@@ -782,3 +1516,9 @@ func orderQuery(db *gorm.DB) *gorm.DB {
 		Preload("BillingAddress").
 		Preload("Transactions")
 }
+
+func invalidTransitionError(field, from, to string, allowed []string) *HTTPError {
+	return unprocessableEntityError("Can't change the %s of the order from '%s' to '%s'", field, from, to).WithData(map[string]interface{}{
+		"allowed_transitions": allowed,
+	})
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type orderDataParams struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// OrderDataUpdate merges keys into the metadata of an order, and removes the
+// keys set to null. Every key has to be declared in the order_data of the
+// site settings, which tells its type and who can write it: buyers until
+// the order is paid, or only admins, and whether it can still change after
+// payment.
+func (a *API) OrderDataUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+
+	params := &orderDataParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read order data: %v", err)
+	}
+	if len(params.Data) == 0 {
+		return badRequestError("No order data to update")
+	}
+
+	tx := a.db.Begin()
+	order := &models.Order{}
+	if rsp := orderQuery(tx).First(order, "id = ? AND instance_id = ?", gcontext.GetOrderID(ctx), gcontext.GetInstanceID(ctx)); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	isAdmin := gcontext.HasScope(ctx, ordersWriteScope)
+	if !isAdmin && order.UserID != "" && (claims == nil || claims.Subject != order.UserID) {
+		tx.Rollback()
+		return unauthorizedError("You don't have access to this order")
+	}
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+
+	keys := make([]string, 0, len(params.Data))
+	for key := range params.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	paid := order.PaymentState != models.PendingState
+	invalid := map[string]string{}
+	forbidden := map[string]string{}
+	for _, key := range keys {
+		value := params.Data[key]
+		field := settings.OrderData[key]
+		switch {
+		case field == nil:
+			invalid[key] = "isn't declared in the order_data settings"
+		case paid && field.ImmutableAfterPayment:
+			forbidden[key] = "can't be changed after the order has been paid"
+		case !isAdmin && field.Writable != calculator.CustomerWritable:
+			forbidden[key] = "can only be changed by admins"
+		case !isAdmin && paid:
+			forbidden[key] = "can only be changed by admins after the order has been paid"
+		case value != nil && !field.Accepts(value):
+			invalid[key] = fmt.Sprintf("must be of type %v", field.Type)
+		}
+	}
+	if len(forbidden) > 0 {
+		tx.Rollback()
+		return unauthorizedError("You can't change some of the order data").WithData(forbidden)
+	}
+	if len(invalid) > 0 {
+		tx.Rollback()
+		return unprocessableEntityError("Invalid order data").WithData(invalid)
+	}
+
+	if order.MetaData == nil {
+		order.MetaData = map[string]interface{}{}
+	}
+	diff := map[string]models.Change{}
+	for _, key := range keys {
+		value := params.Data[key]
+		diff["meta."+key] = models.Change{From: order.MetaData[key], To: value}
+		if value == nil {
+			delete(order.MetaData, key)
+		} else {
+			order.MetaData[key] = value
+		}
+	}
+	if httpErr := validateOrderMetaData(settings, order.MetaData); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	if rsp := tx.Save(order); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order data").WithInternalError(rsp.Error)
+	}
+	var userID string
+	if claims != nil {
+		userID = claims.Subject
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, userID, order.ID, models.EventUpdated, []string{"meta"}, diff)
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving order data").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("keys", keys).Info("Updated order data")
+	return sendJSON(w, http.StatusOK, order)
+}
+
+// validateOrderMetaData checks the metadata of an order against the
+// order_data_schema of the site settings, and lists the fields that don't
+// match it.
+func validateOrderMetaData(settings *calculator.Settings, meta map[string]interface{}) *HTTPError {
+	if settings.OrderDataSchema == nil {
+		return nil
+	}
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	errs := settings.OrderDataSchema.Validate(meta)
+	if len(errs) == 0 {
+		return nil
+	}
+	invalid := map[string]string{}
+	for _, err := range errs {
+		field := err.Field
+		if field == "" {
+			field = "meta"
+		}
+		if invalid[field] != "" {
+			invalid[field] += ", " + err.Message
+		} else {
+			invalid[field] = err.Message
+		}
+	}
+	return unprocessableEntityError("Invalid order data").WithData(invalid)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderDataUpdate(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	setup := func(t *testing.T, paymentState string) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		test.Data.firstOrder.PaymentState = paymentState
+		test.Data.firstOrder.MetaData = map[string]interface{}{"gift_message": "Happy birthday", "po_number": "PO-1"}
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		return test
+	}
+	patch := func(test *RouteTest, body string, token *jwt.Token) *httptest.ResponseRecorder {
+		return test.TestEndpoint(http.MethodPatch, test.Data.urlForFirstOrder+"/data", strings.NewReader(body), token)
+	}
+	saved := func(t *testing.T, test *RouteTest) map[string]interface{} {
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		return order.MetaData
+	}
+	adminToken := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("CustomerBeforePayment", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, patch(test, `{"data": {"po_number": "PO-2", "gift_message": null}}`, test.Data.testUserToken), order)
+		assert.Equal(t, map[string]interface{}{"po_number": "PO-2"}, order.MetaData)
+		assert.Equal(t, map[string]interface{}{"po_number": "PO-2"}, saved(t, test))
+	})
+	t.Run("CustomerAdminKey", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		payload := &struct {
+			Data map[string]string `json:"data"`
+		}{}
+		extractPayload(t, http.StatusUnauthorized, patch(test, `{"data": {"warehouse": "berlin"}}`, test.Data.testUserToken), payload)
+		assert.Contains(t, payload.Data, "warehouse")
+	})
+	t.Run("CustomerAfterPayment", func(t *testing.T) {
+		test := setup(t, models.PaidState)
+		validateError(t, http.StatusUnauthorized, patch(test, `{"data": {"gift_message": "Hi"}}`, test.Data.testUserToken))
+	})
+	t.Run("AdminAfterPayment", func(t *testing.T) {
+		test := setup(t, models.PaidState)
+		extractPayload(t, http.StatusOK, patch(test, `{"data": {"gift_message": "Hi", "warehouse": "berlin"}}`, adminToken), &models.Order{})
+		assert.Equal(t, map[string]interface{}{"gift_message": "Hi", "po_number": "PO-1", "warehouse": "berlin"}, saved(t, test))
+
+		validateError(t, http.StatusUnauthorized, patch(test, `{"data": {"po_number": "PO-3"}}`, adminToken))
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		payload := &struct {
+			Data map[string]string `json:"data"`
+		}{}
+		extractPayload(t, http.StatusUnprocessableEntity, patch(test, `{"data": {"gift_message": 42, "color": "red"}}`, test.Data.testUserToken), payload)
+		assert.Len(t, payload.Data, 2)
+		assert.Equal(t, map[string]interface{}{"gift_message": "Happy birthday", "po_number": "PO-1"}, saved(t, test))
+	})
+	t.Run("Schema", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		payload := &struct {
+			Data map[string]string `json:"data"`
+		}{}
+		extractPayload(t, http.StatusUnprocessableEntity, patch(test, `{"data": {"po_number": "12"}}`, test.Data.testUserToken), payload)
+		assert.Equal(t, map[string]string{"po_number": "must match ^PO-[0-9]+$"}, payload.Data)
+		assert.Equal(t, map[string]interface{}{"gift_message": "Happy birthday", "po_number": "PO-1"}, saved(t, test))
+	})
+	t.Run("Stranger", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		validateError(t, http.StatusUnauthorized, patch(test, `{"data": {"gift_message": "Hi"}}`, testToken("stranger", "stranger-danger@wayneindustries.com")))
+	})
+}
+
+func TestOrderCreateDataSchema(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+	body := func(meta string) *strings.Reader {
+		return strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {"name": "Test User", "address1": "610 Beach Ave", "city": "San Francisco", "country": "USA", "zip": "94100"},
+			"line_items": [{"path": "/simple-product", "quantity": 1}],
+			"meta": ` + meta + `
+		}`)
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body(`{"po_number": "PO-7", "gift": {"email": "friend@example.com"}}`), nil)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "PO-7", order.MetaData["po_number"])
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body(`{"gift_message": "`+strings.Repeat("x", 41)+`", "gift": {"name": "Friend"}}`), nil)
+		payload := &struct {
+			Data map[string]string `json:"data"`
+		}{}
+		extractPayload(t, http.StatusUnprocessableEntity, recorder, payload)
+		assert.Equal(t, map[string]string{
+			"gift.email":   "is required",
+			"gift_message": "must be at most 40 characters",
+		}, payload.Data)
+
+		count := 0
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("email = ?", "info@example.com").Count(&count).Error)
+		assert.Equal(t, 0, count)
+	})
+}
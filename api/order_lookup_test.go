@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderLookup(t *testing.T) {
+	test := NewRouteTest(t)
+	require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("invoice_number", 42).Error)
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).Update("processor_id", "ch_123").Error)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	lookup := func(t *testing.T, query string) []models.Order {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?"+query, nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		return orders
+	}
+
+	t.Run("InvoiceNumber", func(t *testing.T) {
+		orders := lookup(t, "invoice_number=42")
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+		assert.Empty(t, lookup(t, "invoice_number=43"))
+	})
+
+	t.Run("TransactionID", func(t *testing.T) {
+		orders := lookup(t, "transaction_id=ch_123")
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+		assert.Empty(t, lookup(t, "transaction_id=ch_456"))
+	})
+
+	t.Run("Customer", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?invoice_number=42", nil, testToken("stranger", "stranger-danger@wayneindustries.com"))
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		assert.Empty(t, orders, "customers only find their own orders")
+	})
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderCreateOnBehalf(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+	adminToken := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Customer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		body := strings.NewReader(`{
+			"shipping_address_id": "first-address",
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders?user_id="+test.Data.testUser.ID, body, adminToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, test.Data.testUser.ID, order.UserID)
+		assert.Equal(t, test.Data.testUser.Email, order.Email)
+		assert.Equal(t, "123 cave way", order.ShippingAddress.Address1, "the address book of the customer is used")
+		assert.EqualValues(t, 999, order.SubTotal)
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.First(event, "order_id = ? AND type = ?", order.ID, models.EventCreated).Error)
+		assert.Equal(t, "admin-yo", event.UserID)
+	})
+
+	t.Run("NewCustomer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders?user_id=alfred", strings.NewReader(`{
+			"email": "alfred@wayneindustries.com",
+			"shipping_address": {"name": "Alfred", "address1": "1007 Mountain Drive", "city": "Gotham", "country": "USA", "zip": "10001"},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`), adminToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "alfred", order.UserID)
+
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", "alfred").Error)
+		assert.Equal(t, "alfred@wayneindustries.com", user.Email)
+	})
+
+	t.Run("ManualPrices", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		body := strings.NewReader(`{
+			"shipping_address_id": "first-address",
+			"line_items": [
+				{"sku": "repair", "title": "Batmobile repair", "type": "service", "price": 1500, "quantity": 2},
+				{"path": "/simple-product", "quantity": 1}
+			]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders?user_id="+test.Data.testUser.ID, body, adminToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 2)
+		assert.Equal(t, "Batmobile repair", order.LineItems[0].Title)
+		assert.EqualValues(t, 1500, order.LineItems[0].Price)
+		assert.True(t, order.LineItems[0].ManualPrice)
+		assert.False(t, order.LineItems[1].ManualPrice)
+		assert.EqualValues(t, 3999, order.SubTotal)
+
+		saved := &models.LineItem{}
+		require.NoError(t, test.DB.First(saved, "order_id = ? AND sku = ?", order.ID, "repair").Error)
+		assert.True(t, saved.ManualPrice)
+	})
+
+	t.Run("InvalidManualPrice", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		body := strings.NewReader(`{
+			"shipping_address_id": "first-address",
+			"line_items": [{"sku": "repair", "price": 1500, "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders?user_id="+test.Data.testUser.ID, body, adminToken)
+		validateError(t, http.StatusBadRequest, recorder, "Line items with a price require a sku and a title")
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		body := `{
+			"email": "info@example.com",
+			"shipping_address_id": "first-address",
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders?user_id=joker", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder, "Only admins can create orders for other users")
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(`{
+			"shipping_address_id": "first-address",
+			"line_items": [{"sku": "cheap", "title": "Cheap", "price": 1, "quantity": 1}]
+		}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder, "Only admins can set the prices of line items")
+	})
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type orderOwnerParams struct {
+	UserID string `json:"user_id"`
+}
+
+// OrderOwnerUpdate moves an order to another user, like an anonymous order
+// the buyer asks support to add to their account. The payments and returns of
+// the order move along, and so do the snapshots of its addresses. Orders that
+// use addresses of the address book get snapshots of them for the new user.
+func (a *API) OrderOwnerUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	params := &orderOwnerParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read owner params: %v", err)
+	}
+	if params.UserID == "" {
+		return badRequestError("A 'user_id' is required")
+	}
+
+	tx := a.db.Begin()
+	order := &models.Order{}
+	if rsp := orderQuery(models.ForUpdate(tx)).First(order, "id = ? AND instance_id = ?", gcontext.GetOrderID(ctx), instanceID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	user := &models.User{}
+	if rsp := tx.First(user, "id = ? AND instance_id = ?", params.UserID, instanceID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("No user with ID %v found", params.UserID)
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if order.UserID == user.ID {
+		tx.Rollback()
+		return sendJSON(w, http.StatusOK, order)
+	}
+
+	previous := order.UserID
+	moved := map[string]*models.Address{}
+	for _, address := range []*models.Address{&order.ShippingAddress, &order.BillingAddress} {
+		if address.ID == "" {
+			continue
+		}
+		owned, err := reassignAddress(tx, order, address, user.ID, moved)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error updating order addresses").WithInternalError(err)
+		}
+		*address = *owned
+	}
+	order.ShippingAddressID = order.ShippingAddress.ID
+	order.BillingAddressID = order.BillingAddress.ID
+	order.UserID = user.ID
+	// only the owner is written, so the rest of the order stays as the
+	// payments and refunds left it
+	if rsp := tx.Model(order).UpdateColumns(map[string]interface{}{
+		"user_id":             order.UserID,
+		"shipping_address_id": order.ShippingAddressID,
+		"billing_address_id":  order.BillingAddressID,
+	}); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order").WithInternalError(rsp.Error)
+	}
+	for _, t := range order.Transactions {
+		t.UserID = user.ID
+	}
+	if rsp := tx.Model(&models.Transaction{}).Where("order_id = ?", order.ID).UpdateColumn("user_id", user.ID); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error updating order transactions").WithInternalError(rsp.Error)
+	}
+	if rsp := tx.Model(&models.Return{}).Where("order_id = ?", order.ID).UpdateColumn("user_id", user.ID); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error updating order returns").WithInternalError(rsp.Error)
+	}
+
+	var actorID string
+	if claims != nil {
+		actorID = claims.Subject
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, actorID, order.ID, models.EventReassigned, []string{"user_id"}, map[string]models.Change{
+		"user_id": {From: previous, To: user.ID},
+	})
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving order").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("from_user_id", previous).WithField("to_user_id", user.ID).Info("Reassigned order")
+	return sendJSON(w, http.StatusOK, order)
+}
+
+// reassignAddress returns the address of an order for its new owner. The
+// snapshots of the order are given to the owner, without the address book
+// entries of the previous owner they were copied from. Addresses of the
+// address book are copied, once per address when the order ships and bills
+// to the same one.
+func reassignAddress(tx *gorm.DB, order *models.Order, address *models.Address, userID string, moved map[string]*models.Address) (*models.Address, error) {
+	if owned, ok := moved[address.ID]; ok {
+		return owned, nil
+	}
+
+	owned := &models.Address{AddressRequest: address.AddressRequest, UserID: userID, Snapshot: true}
+	var rsp *gorm.DB
+	if address.Snapshot {
+		owned.ID = address.ID
+		owned.CreatedAt = address.CreatedAt
+		rsp = tx.Model(owned).UpdateColumns(map[string]interface{}{"user_id": userID, "source_id": ""})
+	} else {
+		owned.ID = uuid.NewRandom().String()
+		rsp = tx.Create(owned)
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	moved[address.ID] = owned
+	return owned, nil
+}
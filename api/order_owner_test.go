@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderOwnerUpdate(t *testing.T) {
+	reassign := func(test *RouteTest, order *models.Order, userID string) *models.Order {
+		body := strings.NewReader(`{"user_id": "` + userID + `"}`)
+		updated := &models.Order{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodPut, "/orders/"+order.ID+"/owner", body, testAdminToken("admin", "")), updated)
+		return updated
+	}
+
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Create(&models.User{ID: "villian", Email: "villian@wayneindustries.com"}).Error)
+		previous := test.Data.firstOrder.UserID
+		addressID := test.Data.testAddress.ID
+
+		order := reassign(test, test.Data.firstOrder, "villian")
+		assert.Equal(t, "villian", order.UserID)
+
+		// the order used an address of the address book, so it gets a snapshot
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "villian", stored.UserID)
+		assert.NotEqual(t, addressID, stored.ShippingAddressID)
+		assert.Equal(t, stored.ShippingAddressID, stored.BillingAddressID)
+		copied := &models.Address{}
+		require.NoError(t, test.DB.First(copied, "id = ?", stored.ShippingAddressID).Error)
+		assert.Equal(t, "villian", copied.UserID)
+		assert.True(t, copied.Snapshot)
+		assert.Equal(t, test.Data.testAddress.Address1, copied.Address1)
+		original := &models.Address{}
+		require.NoError(t, test.DB.First(original, "id = ?", addressID).Error)
+		assert.Equal(t, previous, original.UserID)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "order_id = ?", stored.ID).Error)
+		assert.Equal(t, "villian", trans.UserID)
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.First(event, "order_id = ? AND type = ?", stored.ID, models.EventReassigned).Error)
+		assert.Equal(t, "admin", event.UserID)
+		assert.Equal(t, previous, event.Diff["user_id"].From)
+		assert.Equal(t, "villian", event.Diff["user_id"].To)
+
+		// snapshots move along
+		reassign(test, stored, previous)
+		moved := &models.Order{}
+		require.NoError(t, test.DB.First(moved, "id = ?", stored.ID).Error)
+		assert.Equal(t, stored.ShippingAddressID, moved.ShippingAddressID)
+		snapshot := &models.Address{}
+		require.NoError(t, test.DB.First(snapshot, "id = ?", stored.ShippingAddressID).Error)
+		assert.Equal(t, previous, snapshot.UserID)
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		test := NewRouteTest(t)
+		makeAnonymous(test, test.Data.firstOrder, "villian@wayneindustries.com")
+		order := reassign(test, test.Data.firstOrder, test.Data.testUser.ID)
+		assert.Equal(t, test.Data.testUser.ID, order.UserID)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/orders/" + test.Data.firstOrder.ID + "/owner"
+
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"user_id": "villian"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"user_id": "nobody"}`), testAdminToken("admin", ""))
+		validateError(t, http.StatusNotFound, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{}`), testAdminToken("admin", ""))
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// orderPreview is the price of an order that wasn't created.
+type orderPreview struct {
+	Currency  string             `json:"currency"`
+	Country   string             `json:"country"`
+	Coupon    *models.Coupon     `json:"coupon,omitempty"`
+	LineItems []*models.LineItem `json:"line_items"`
+	Price     calculator.Price   `json:"price"`
+}
+
+// OrderPreview prices an order like OrderCreate does, with the products,
+// taxes, coupon, member discounts and shipping, and returns the price
+// breakdown without saving anything. The shipping address can be left out,
+// or be just a country, while the buyer didn't fill it in yet.
+func (a *API) OrderPreview(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	log := getLogEntry(r)
+	db := a.readDB(r)
+
+	params := &orderRequestParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read Order params: %v", err)
+	}
+
+	order := models.NewOrder(gcontext.GetInstanceID(ctx), params.SessionID, params.Email, "")
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		order.UserID = claims.Subject
+		if order.Email == "" {
+			order.Email = claims.Email
+		}
+	}
+
+	shipping, httpError := previewAddress(db, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID)
+	if httpError != nil {
+		return httpError
+	}
+	billing, httpError := previewAddress(db, order, "Billing Address", params.BillingAddress, params.BillingAddressID)
+	if httpError != nil {
+		return httpError
+	}
+	var country string
+	if shipping != nil {
+		country = shipping.Country
+	}
+	inferred := inferLocale(r, config, country, params.Currency, params.Locale)
+	order.Currency = inferred.Currency
+	order.Locale = inferred.Locale
+	if shipping != nil {
+		order.ShippingAddress = *shipping
+	}
+	if order.ShippingAddress.Country == "" {
+		order.ShippingAddress.Country = inferred.Country
+	}
+	order.BillingAddress = order.ShippingAddress
+	if billing != nil {
+		order.BillingAddress = *billing
+	}
+
+	if httpError := setOrderTaxExemption(ctx, db, order, params); httpError != nil {
+		return httpError
+	}
+	if params.VATNumber != "" {
+		verified, httpError := a.verifyVATNumber(ctx, log, params.VATNumber)
+		if httpError != nil {
+			return httpError
+		}
+		order.VATNumber = params.VATNumber
+		order.VATNumberUnverified = !verified
+	}
+	order.ShippingMethod = params.ShippingMethod
+
+	if params.CouponCode != "" {
+		coupon, err := a.lookupCoupon(ctx, w, params.CouponCode)
+		if err != nil {
+			return err
+		}
+		if !coupon.Valid() {
+			return badRequestError("This coupon is not valid at this time")
+		}
+		order.CouponCode = coupon.Code
+		order.Coupon = coupon
+	}
+
+	price, httpError := a.priceOrder(ctx, db, order, params.LineItems)
+	if httpError != nil {
+		return httpError
+	}
+
+	return sendJSON(w, http.StatusOK, &orderPreview{
+		Currency:  order.Currency,
+		Country:   order.ShippingAddress.Country,
+		Coupon:    order.Coupon,
+		LineItems: order.LineItems,
+		Price:     price,
+	})
+}
+
+// previewAddress returns the address an order would use, like
+// processAddress, without saving a snapshot of it. New addresses aren't
+// validated, since a preview only needs their country.
+func previewAddress(db *gorm.DB, order *models.Order, name string, address *models.Address, id string) (*models.Address, *HTTPError) {
+	if id == "" {
+		return address, nil
+	}
+	if order.UserID == "" {
+		return nil, badRequestError("Can't use a saved %v without being logged in", name)
+	}
+	saved := new(models.Address)
+	if rsp := db.First(saved, "id = ?", id); rsp.Error != nil {
+		return nil, badRequestError("Bad %v id: %v", name, id).WithInternalError(rsp.Error)
+	}
+	if saved.UserID != order.UserID {
+		return nil, badRequestError("Can't use an %v that doesn't belong to the user", name)
+	}
+	if saved.Snapshot {
+		return nil, badRequestError("%v %v is not in the address book, use its source_id or save it to the address book", name, id)
+	}
+	return saved, nil
+}
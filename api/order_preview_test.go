@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderPreview(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+	coupons := startTestCouponURLs()
+	defer coupons.Close()
+
+	count := func(t *testing.T, test *RouteTest, model interface{}) int {
+		var n int
+		require.NoError(t, test.DB.Model(model).Count(&n).Error)
+		return n
+	}
+
+	t.Run("Price", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		test.Config.Coupons.URL = coupons.URL
+		orders, items, addresses := count(t, test, &models.Order{}), count(t, test, &models.LineItem{}), count(t, test, &models.Address{})
+
+		body := strings.NewReader(`{
+			"coupon": "coupon-code",
+			"shipping_address": {"country": "Germany"},
+			"line_items": [{"path": "/simple-product", "quantity": 2}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", body, test.Data.testUserToken)
+		preview := &orderPreview{}
+		extractPayload(t, http.StatusOK, recorder, preview)
+		assert.Equal(t, "Germany", preview.Country)
+		assert.Equal(t, "USD", preview.Currency)
+		require.NotNil(t, preview.Coupon)
+		require.Len(t, preview.LineItems, 1)
+		assert.Equal(t, "product-1", preview.LineItems[0].Sku)
+		require.Len(t, preview.Price.Items, 1)
+		assert.EqualValues(t, 1998, preview.Price.Subtotal)
+		assert.EqualValues(t, 300, preview.Price.Discount)
+		assert.NotZero(t, preview.Price.Taxes)
+		assert.Equal(t, preview.Price.Subtotal-preview.Price.Discount+preview.Price.Taxes+preview.Price.Shipping, preview.Price.Total)
+		assert.NotEmpty(t, preview.Price.Adjustments)
+
+		assert.Equal(t, orders, count(t, test, &models.Order{}), "nothing is saved")
+		assert.Equal(t, items, count(t, test, &models.LineItem{}))
+		assert.Equal(t, addresses, count(t, test, &models.Address{}))
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		body := strings.NewReader(`{"line_items": [{"path": "/simple-product", "quantity": 1}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", body, nil)
+		preview := &orderPreview{}
+		extractPayload(t, http.StatusOK, recorder, preview)
+		assert.EqualValues(t, 999, preview.Price.Subtotal)
+
+		body = strings.NewReader(`{"shipping_address_id": "first-address", "line_items": [{"path": "/simple-product", "quantity": 1}]}`)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/preview", body, nil)
+		validateError(t, http.StatusBadRequest, recorder, "Can't use a saved Shipping Address without being logged in")
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		snapshot := &models.Address{AddressRequest: test.Data.testAddress.AddressRequest, ID: "preview-snapshot", UserID: test.Data.testUser.ID, Snapshot: true}
+		require.NoError(t, test.DB.Create(snapshot).Error)
+
+		body := strings.NewReader(`{"shipping_address_id": "preview-snapshot", "line_items": [{"path": "/simple-product", "quantity": 1}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Shipping Address preview-snapshot is not in the address book")
+	})
+}
@@ -14,8 +14,10 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
 	"github.com/stretchr/testify/require"
 )
 
@@ -45,6 +47,7 @@ func TestOrderCreate(t *testing.T) {
 		order := &models.Order{}
 		extractPayload(t, http.StatusCreated, recorder, order)
 		var total uint64 = 999
+		assert.Equal(t, byte('7'), order.ID[14], "Expected a UUIDv7 order ID, got %v", order.ID)
 		assert.Equal(t, "info@example.com", order.Email, "Total should be info@example.com, was %v", order.Email)
 		assert.Equal(t, total, order.Total, fmt.Sprintf("Total should be 999, was %v", order.Total))
 		assert.Len(t, order.LineItems, 1)
@@ -58,6 +61,277 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, stored.UserID, order.UserID)
 	})
 
+	t.Run("SavedAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address_id": "` + test.Data.testAddress.ID + `",
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.NotEqual(t, test.Data.testAddress.ID, order.ShippingAddressID, "orders use a snapshot of the address")
+		assert.Equal(t, order.ShippingAddressID, order.BillingAddressID)
+		assert.Equal(t, test.Data.testAddress.ID, order.ShippingAddress.SourceID)
+		assert.Equal(t, test.Data.testAddress.Name, order.ShippingAddress.Name)
+
+		// editing the address book leaves the order alone
+		update := strings.NewReader(`{"name": "Someone Else", "address1": "1 Main St", "city": "Gotham", "country": "USA", "zip": "10001"}`)
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + test.Data.testAddress.ID
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodPut, url, update, test.Data.testUserToken), &models.Address{})
+		snapshot := &models.Address{}
+		require.NoError(t, test.DB.First(snapshot, "id = ?", order.ShippingAddressID).Error)
+		assert.Equal(t, test.Data.testAddress.Name, snapshot.Name)
+
+		// snapshots can't be reused
+		body = strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address_id": "` + order.ShippingAddressID + `",
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "not in the address book")
+	})
+
+	t.Run("SaveToAddressBook", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		create := func(save bool, token *jwt.Token) *httptest.ResponseRecorder {
+			body := strings.NewReader(fmt.Sprintf(`{
+				"email": "info@example.com",
+				"save_to_address_book": %v,
+				"shipping_address": {"name": "Test User", "address1": "610 22nd Street", "city": "San Francisco", "country": "USA", "zip": "94107"},
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`, save))
+			return test.TestEndpoint(http.MethodPost, "/orders", body, token)
+		}
+		book := func() []models.Address {
+			addrs := []models.Address{}
+			extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/addresses", nil, test.Data.testUserToken), &addrs)
+			return addrs
+		}
+		before := len(book())
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, create(false, test.Data.testUserToken), order)
+		assert.Empty(t, order.ShippingAddress.SourceID)
+		assert.Len(t, book(), before)
+
+		order = &models.Order{}
+		extractPayload(t, http.StatusCreated, create(true, test.Data.testUserToken), order)
+		require.NotEmpty(t, order.ShippingAddress.SourceID)
+		addrs := book()
+		require.Len(t, addrs, before+1)
+		saved := &models.Address{}
+		require.NoError(t, test.DB.First(saved, "id = ?", order.ShippingAddress.SourceID).Error)
+		assert.False(t, saved.Snapshot)
+		assert.Equal(t, test.Data.testUser.ID, saved.UserID)
+		assert.Equal(t, "610 22nd Street", saved.Address1)
+
+		validateError(t, http.StatusBadRequest, create(true, nil), "without being logged in")
+	})
+
+	t.Run("DeliveryInstructions", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		createOrder := func(instructions string) *httptest.ResponseRecorder {
+			data, err := json.Marshal(instructions)
+			require.NoError(t, err)
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"shipping_address_id": "` + test.Data.testAddress.ID + `",
+				"delivery_instructions": ` + string(data) + `,
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`)
+			return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		}
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder("  Leave at the <b>back</b>\tdoor\r\n\r\n\x00Gate code: 1234  "), order)
+		assert.Equal(t, "Leave at the bback/b door\nGate code: 1234", order.DeliveryInstructions)
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, order.DeliveryInstructions, saved.DeliveryInstructions)
+
+		validateError(t, http.StatusBadRequest, createOrder(strings.Repeat("a", models.MaxDeliveryInstructionsLength+1)), "Delivery instructions")
+	})
+
+	t.Run("SavedAddressAnonymous", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address_id": "` + test.Data.testAddress.ID + `",
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, nil)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("Inventory", func(t *testing.T) {
+		order := func(test *RouteTest, quantity int) *httptest.ResponseRecorder {
+			body := strings.NewReader(fmt.Sprintf(`{
+				"email": "info@example.com",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/limited-product", "quantity": %d}]
+			}`, quantity))
+			return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		}
+		t.Run("InStock", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			recorder := order(test, 3)
+			require.Equal(t, http.StatusCreated, recorder.Code)
+
+			inventory, err := models.GetInventory(test.DB, "", "product-4")
+			require.NoError(t, err)
+			require.NotNil(t, inventory)
+			assert.EqualValues(t, 3, inventory.Stock)
+		})
+		t.Run("OutOfStock", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			validateError(t, http.StatusConflict, order(test, 4), "Only 3 of product-4 left in stock")
+		})
+		t.Run("AdjustedStock", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			_, err := models.SeedInventory(test.DB, "", "product-4", 1)
+			require.NoError(t, err)
+			validateError(t, http.StatusConflict, order(test, 2), "Only 1 of product-4 left in stock")
+		})
+	})
+
+	t.Run("Currency", func(t *testing.T) {
+		order := func(test *RouteTest, currency string) *httptest.ResponseRecorder {
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"currency": "` + currency + `",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/multi-currency-product", "quantity": 1}]
+			}`)
+			return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		}
+		t.Run("PicksPrice", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			rsp := &models.Order{}
+			extractPayload(t, http.StatusCreated, order(test, "EUR"), rsp)
+			assert.Equal(t, "EUR", rsp.Currency)
+			require.Len(t, rsp.LineItems, 1)
+			assert.EqualValues(t, 899, rsp.LineItems[0].Price)
+		})
+		t.Run("PinsExchangeRate", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			test.Config.Defaults.Currency = "USD"
+			saveTestExchangeRates(t, test)
+			rsp := &models.Order{}
+			extractPayload(t, http.StatusCreated, order(test, "EUR"), rsp)
+			assert.Equal(t, "USD", rsp.ExchangeRateCurrency)
+			assert.Equal(t, "2018-01-15", rsp.ExchangeRateDate)
+			assert.InDelta(t, 1/1.2, rsp.ExchangeRate, 0.0001)
+
+			rsp = &models.Order{}
+			extractPayload(t, http.StatusCreated, order(test, "USD"), rsp)
+			assert.Zero(t, rsp.ExchangeRate, "orders in the default currency need no rate")
+		})
+		t.Run("NoPrice", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			validateError(t, http.StatusBadRequest, order(test, "GBP"), "product-3 is not available in GBP, only in USD, EUR")
+			assert.True(t, test.DB.First(&models.Order{}, "currency = ?", "GBP").RecordNotFound())
+		})
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		t.Run("Accepted", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			test.Config.Webhooks.Secret = "validation-secret"
+			validated := &models.Order{}
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, models.OrderValidateHook, r.Header.Get("X-Commerce-Event"))
+				assert.NotEmpty(t, r.Header.Get("X-Commerce-Signature-256"))
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(validated))
+			}))
+			defer hook.Close()
+			test.Config.Webhooks.Validation = hook.URL
+
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`)
+			recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+			order := &models.Order{}
+			extractPayload(t, http.StatusCreated, recorder, order)
+			assert.Equal(t, order.ID, validated.ID)
+			assert.Equal(t, order.Total, validated.Total)
+			require.Len(t, validated.LineItems, 1)
+		})
+		t.Run("Rejected", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				fmt.Fprint(w, `{"message": "Licenses can't be sold to the USA"}`)
+			}))
+			defer hook.Close()
+			test.Config.Webhooks.Validation = hook.URL
+
+			body := strings.NewReader(`{
+				"email": "rejected@example.com",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`)
+			recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+			validateError(t, http.StatusBadRequest, recorder, "Licenses can't be sold to the USA")
+			assert.True(t, test.DB.First(&models.Order{}, "email = ?", "rejected@example.com").RecordNotFound())
+		})
+		t.Run("Unavailable", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			}))
+			defer hook.Close()
+			test.Config.Webhooks.Validation = hook.URL
+
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`)
+			recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+			validateError(t, http.StatusInternalServerError, recorder)
+		})
+	})
+
 	t.Run("NameBackwardsCompatible", func(t *testing.T) {
 		test := NewRouteTest(t)
 		test.Config.SiteURL = server.URL
@@ -102,6 +376,13 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, "Germany", order.BillingAddress.Country)
 		assert.Equal(t, total, order.Total, fmt.Sprintf("Total should be 1069, was %v", order.Total))
 		assert.Equal(t, taxes, order.Taxes, fmt.Sprintf("Total should be 70, was %v", order.Total))
+
+		expected := []*calculator.Adjustment{{Type: calculator.TaxAdjustment, Name: "taxes[1]", Percentage: 7, Amount: 70, Skus: []string{"product-1"}}}
+		assert.Equal(t, expected, order.Adjustments)
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, expected, saved.Adjustments)
 	})
 
 	t.Run("BundleWithTaxes", func(t *testing.T) {
@@ -129,6 +410,247 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, total, order.Total, fmt.Sprintf("Total should be 1105, was %v", order.Total))
 		assert.Equal(t, taxes, order.Taxes, fmt.Sprintf("Total should be 106, was %v", order.Total))
 	})
+
+	t.Run("UUIDv4", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.IDFormat = models.UUIDv4Format
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, byte('4'), order.ID[14], "Expected a UUIDv4 order ID, got %v", order.ID)
+	})
+
+	t.Run("InstanceDefaults", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Defaults.Country = "Germany"
+		test.Config.Defaults.Locale = "de-DE"
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "Branengebranen",
+				"city": "Berlin", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		token := test.Data.testUserToken
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, token)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "Germany", order.ShippingAddress.Country)
+		assert.Equal(t, "de-DE", order.Locale)
+		assert.EqualValues(t, 70, order.Taxes)
+		require.NotNil(t, order.Inferred)
+		assert.Equal(t, models.LocaleSourceInstance, order.Inferred.CountrySource)
+		assert.Equal(t, "USD", order.Inferred.Currency)
+		assert.Equal(t, models.LocaleSourceFallback, order.Inferred.CurrencySource)
+	})
+
+	t.Run("WithDownloads", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/download-product", "quantity": 1}]
+		}`)
+		token := test.Data.testUserToken
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, token)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		require.Len(t, order.Downloads, 1)
+
+		stored := &models.Download{ID: order.Downloads[0].ID}
+		require.NoError(t, test.DB.First(stored).Error)
+		assert.Equal(t, order.ID, stored.OrderID)
+		assert.Equal(t, order.LineItems[0].ID, stored.LineItemID)
+		assert.Equal(t, "Product 2 PDF", stored.Title)
+	})
+
+	t.Run("Shipping", func(t *testing.T) {
+		shippedOrder := func(country, method string) *strings.Reader {
+			return strings.NewReader(`{
+				"email": "info@example.com",
+				"shipping_method": "` + method + `",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "Branengebranen",
+					"city": "Berlin", "country": "` + country + `", "zip": "94107"
+				},
+				"line_items": [{"path": "/shipped-product", "quantity": 2}]
+			}`)
+		}
+		cases := []struct {
+			country, method, expectedMethod string
+			shipping, taxes, total          uint64
+		}{
+			{"Germany", "", "standard", 490, 93, 4583},
+			{"Germany", "express", "express", 600, 114, 4714},
+			{"USA", "", "standard", 1000, 0, 5000},
+		}
+		for _, c := range cases {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			recorder := test.TestEndpoint(http.MethodPost, "/orders", shippedOrder(c.country, c.method), test.Data.testUserToken)
+
+			order := &models.Order{}
+			extractPayload(t, http.StatusCreated, recorder, order)
+			assert.Equal(t, c.expectedMethod, order.ShippingMethod)
+			assert.Equal(t, c.shipping, order.Shipping)
+			assert.Equal(t, c.taxes, order.Taxes)
+			assert.Equal(t, c.total, order.Total)
+			assert.Equal(t, uint64(500), order.LineItems[0].Weight)
+		}
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", shippedOrder("Germany", "overnight"), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("CouponGift", func(t *testing.T) {
+		coupons := startTestCouponURLs()
+		defer coupons.Close()
+		giftOrder := func(coupon string) *strings.Reader {
+			return strings.NewReader(`{
+				"email": "info@example.com",
+				"coupon": "` + coupon + `",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`)
+		}
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Coupons.URL = coupons.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", giftOrder("gift-code"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 2)
+		gift := order.LineItems[1]
+		assert.True(t, gift.Gift)
+		assert.Equal(t, "product-5", gift.Sku)
+		assert.Equal(t, uint64(1), gift.Quantity)
+		assert.Equal(t, uint64(0), gift.Price)
+		assert.Equal(t, uint64(999), order.SubTotal)
+		// the gift still weighs on the shipping costs
+		assert.Equal(t, uint64(1000), order.Shipping)
+
+		test = NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Coupons.URL = coupons.URL
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", giftOrder("big-gift-code"), test.Data.testUserToken)
+		order = &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Len(t, order.LineItems, 1)
+
+		test = NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Coupons.URL = coupons.URL
+		require.NoError(t, test.DB.Create(&models.Inventory{Sku: "product-5", Stock: 0}).Error)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", giftOrder("gift-code"), test.Data.testUserToken)
+		order = &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Len(t, order.LineItems, 1)
+	})
+	t.Run("CouponLimits", func(t *testing.T) {
+		coupons := startTestCouponURLs()
+		defer coupons.Close()
+		couponOrder := func(coupon string) *strings.Reader {
+			return strings.NewReader(`{
+				"email": "info@example.com",
+				"coupon": "` + coupon + `",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`)
+		}
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Coupons.URL = coupons.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", couponOrder("minimum-code"), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "minimum")
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, test.TestEndpoint(http.MethodPost, "/orders", couponOrder("limited-code"), test.Data.testUserToken), order)
+		assert.EqualValues(t, 150, order.Discount)
+
+		// the buyer already used the coupon once
+		require.NoError(t, models.RedeemCoupon(test.DB, order))
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", couponOrder("limited-code"), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "maximum number of times")
+	})
+
+	t.Run("UnknownProduct", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {"name": "Test User", "address1": "610 22nd Street", "city": "San Francisco", "country": "USA", "zip": "94107"},
+			"line_items": [{"path": "/simple-product", "sku": "product-404", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("CancelsFetchesOnFirstError", func(t *testing.T) {
+		released := make(chan struct{})
+		canceled := make(chan struct{}, 1)
+		site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/slow-product" {
+				http.NotFound(w, r)
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				canceled <- struct{}{}
+			case <-released:
+			}
+		}))
+		defer site.Close()
+		defer close(released)
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {"name": "Test User", "address1": "610 22nd Street", "city": "San Francisco", "country": "USA", "zip": "94107"},
+			"line_items": [{"path": "/slow-product", "quantity": 1}, {"path": "/missing-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "The fetch of the slow product wasn't canceled")
+		}
+	})
 }
 
 // ------------------------------------------------------------------------------------------------
@@ -136,6 +658,38 @@ func TestOrderCreate(t *testing.T) {
 // ------------------------------------------------------------------------------------------------
 
 func TestOrdersList(t *testing.T) {
+	t.Run("WithCursor", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := test.Data.testUserToken
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?cursor=&per_page=1", nil, token)
+
+		first := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &first)
+		require.Len(t, first, 1)
+		cursor := recorder.Header().Get("X-Next-Cursor")
+		require.NotEmpty(t, cursor)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders?per_page=1&cursor="+cursor, nil, token)
+		second := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &second)
+		require.Len(t, second, 1)
+		assert.NotEqual(t, first[0].ID, second[0].ID)
+	})
+	t.Run("WithAggregates", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := test.Data.testUserToken
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?aggregates=true", nil, token)
+
+		rsp := &orderListResponse{}
+		extractPayload(t, http.StatusOK, recorder, rsp)
+		assert.Len(t, rsp.Orders, 2)
+		require.Len(t, rsp.Aggregates, 1)
+		aggregate := rsp.Aggregates[0]
+		assert.Equal(t, "USD", aggregate.Currency)
+		assert.EqualValues(t, 2, aggregate.Count)
+		assert.Equal(t, test.Data.firstOrder.Total+test.Data.secondOrder.Total, aggregate.Total)
+		assert.Equal(t, test.Data.firstOrder.Taxes+test.Data.secondOrder.Taxes, aggregate.Taxes)
+	})
 	t.Run("AsTheUser", func(t *testing.T) {
 		test := NewRouteTest(t)
 		token := test.Data.testUserToken
@@ -146,6 +700,30 @@ func TestOrdersList(t *testing.T) {
 		assert.Len(t, orders, 2)
 		validateAllOrders(t, orders, test.Data)
 	})
+	t.Run("AsAnonymousSession", func(t *testing.T) {
+		test := NewRouteTest(t)
+		cart := models.NewOrder("", "browser-session", "joker@example.com", "USD")
+		paid := models.NewOrder("", "browser-session", "joker@example.com", "USD")
+		paid.PaymentState = models.PaidState
+		other := models.NewOrder("", "other-session", "harley@example.com", "USD")
+		users := models.NewOrder("", "browser-session", test.Data.testUser.Email, "USD")
+		users.UserID = test.Data.testUser.ID
+		for _, order := range []*models.Order{cart, paid, other, users} {
+			require.NoError(t, test.DB.Create(order).Error)
+		}
+
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/orders?session_id=browser-session", nil, nil), &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, cart.ID, orders[0].ID)
+
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/orders", nil, nil))
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/orders?session_id=browser-session&archived=true", nil, nil))
+
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/orders?session_id=browser-session", nil, test.Data.testUserToken), &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, users.ID, orders[0].ID)
+	})
 	t.Run("AsStranger", func(t *testing.T) {
 		test := NewRouteTest(t)
 		token := testToken("stranger", "stranger-danger@wayneindustries.com")
@@ -171,6 +749,14 @@ func TestOrdersList(t *testing.T) {
 			extractPayload(t, http.StatusOK, recorder, &orders)
 			assert.Len(t, orders, 2)
 		})
+		t.Run("EmailFilterIgnoresCase", func(t *testing.T) {
+			test := NewRouteTest(t)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?email=BRUCE@WayneIndustries.com", nil, test.Data.testUserToken)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 2)
+		})
 		t.Run("EmailFilterAsTheUserEmptyResponse", func(t *testing.T) {
 			test := NewRouteTest(t)
 			token := test.Data.testUserToken
@@ -216,6 +802,91 @@ func TestOrdersList(t *testing.T) {
 			extractPayload(t, http.StatusOK, recorder, &orders)
 			assert.Len(t, orders, 1)
 		})
+		t.Run("SkuFilter", func(t *testing.T) {
+			test := NewRouteTest(t)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?sku=234-fancy-belts,unknown-sku", nil, test.Data.testUserToken)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 1)
+			assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+		})
+		t.Run("StateFilter", func(t *testing.T) {
+			test := NewRouteTest(t)
+			require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("state", models.PaidState).Error)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?state=paid", nil, test.Data.testUserToken)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 1)
+			assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+
+			recorder = test.TestEndpoint(http.MethodGet, "/orders?payment_state=paid&fulfillment_state=shipped", nil, test.Data.testUserToken)
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 0)
+		})
+		t.Run("RefundFilter", func(t *testing.T) {
+			test := NewRouteTest(t)
+			require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("total_refunded", 10).Error)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?has_refund=true", nil, test.Data.testUserToken)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 1)
+			assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+
+			recorder = test.TestEndpoint(http.MethodGet, "/orders?has_refund=false", nil, test.Data.testUserToken)
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 1)
+			assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+		})
+		t.Run("ProviderFilter", func(t *testing.T) {
+			test := NewRouteTest(t)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?provider=paypal", nil, test.Data.testUserToken)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 1)
+			assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+
+			recorder = test.TestEndpoint(http.MethodGet, "/orders?provider=stripe,paypal", nil, test.Data.testUserToken)
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 2)
+		})
+		t.Run("CountryFilter", func(t *testing.T) {
+			test := NewRouteTest(t)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?country=dcland", nil, test.Data.testUserToken)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 2)
+
+			recorder = test.TestEndpoint(http.MethodGet, "/orders?country=Germany", nil, test.Data.testUserToken)
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 0)
+		})
+		t.Run("RelativeDateFilter", func(t *testing.T) {
+			test := NewRouteTest(t)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?from=-P1D", nil, test.Data.testUserToken)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 2)
+
+			recorder = test.TestEndpoint(http.MethodGet, "/orders?period=last_year", nil, test.Data.testUserToken)
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 0)
+		})
+		t.Run("MetaDataSearch", func(t *testing.T) {
+			test := NewRouteTest(t)
+			require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("raw_meta_data", `{"gift_note":"Happy birthday Alfred"}`).Error)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?q=alfred", nil, test.Data.testUserToken)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 1)
+			assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+		})
 		t.Run("CouponCodeFilterAsTheUser", func(t *testing.T) {
 			test := NewRouteTest(t)
 			token := test.Data.testUserToken
@@ -305,6 +976,101 @@ func TestOrderView(t *testing.T) {
 		validateAddress(t, test.Data.firstOrder.BillingAddress, order.BillingAddress)
 		validateAddress(t, test.Data.firstOrder.ShippingAddress, order.ShippingAddress)
 	})
+	t.Run("OtherInstance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("instance_id", "other-instance").Error)
+		recorder := test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder, nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+// -------------------------------------------------------------------------------------------------------------------
+// DELETE
+// -------------------------------------------------------------------------------------------------------------------
+
+func TestOrderDelete(t *testing.T) {
+	unpaid := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		return test
+	}
+
+	t.Run("AsTheUser", func(t *testing.T) {
+		test := unpaid(t)
+		recorder := test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder, nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder, nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/orders?include_deleted=true", nil, test.Data.testUserToken), &orders)
+		assert.Len(t, orders, 1)
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, models.EventDeleted).Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+	t.Run("IncludeDeletedAsAnAdmin", func(t *testing.T) {
+		test := unpaid(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder, nil, token)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+		order := new(models.Order)
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder+"?include_deleted=true", nil, token), order)
+		assert.NotNil(t, order.DeletedAt)
+
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/orders", nil, token), &orders)
+		assert.Len(t, orders, 1)
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/orders?include_deleted=true", nil, token), &orders)
+		assert.Len(t, orders, 2)
+	})
+	t.Run("Paid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder, nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("AsAStranger", func(t *testing.T) {
+		test := unpaid(t)
+		token := testToken("stranger", "stranger-danger@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("Anonymous", func(t *testing.T) {
+		test := unpaid(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("user_id", "").Error)
+
+		recorder := test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder, nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+		recorder = test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder+"?email=stranger-danger@wayneindustries.com", nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder+"?email="+strings.ToUpper(test.Data.firstOrder.Email), nil, nil)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+	})
+	t.Run("ThenPaid", func(t *testing.T) {
+		test := unpaid(t)
+		recorder := test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder, nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		body, err := json.Marshal(&stripePaymentParams{
+			Amount:      test.Data.firstOrder.Total,
+			Currency:    test.Data.firstOrder.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		})
+		require.NoError(t, err)
+		recorder = test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("OtherInstance", func(t *testing.T) {
+		test := unpaid(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("instance_id", "other-instance").Error)
+		recorder := test.TestEndpoint(http.MethodDelete, test.Data.urlForFirstOrder, nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
 }
 
 // --------------------------------------------------------------------------------------------------------------------
@@ -405,7 +1171,10 @@ func TestOrderSetUserIDLogic(t *testing.T) {
 
 func TestOrderUpdate(t *testing.T) {
 	t.Run("FieldsUpdate", func(t *testing.T) {
+		site := startTestSite()
+		defer site.Close()
 		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
 		test.Data.firstOrder.PaymentState = models.PendingState
 		rsp := test.DB.Save(test.Data.firstOrder)
 		require.NoError(t, rsp.Error, "Failed to update email")
@@ -541,6 +1310,76 @@ func TestOrderUpdate(t *testing.T) {
 		extractPayload(t, http.StatusOK, recorder, order)
 		assert.Equal(t, op.MetaData, order.MetaData, "Order metadata should have been updated")
 	})
+
+	t.Run("StateTransitions", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		for _, state := range []string{models.PaidState, models.ShippedState, models.DeliveredState} {
+			recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{State: state}, token)
+			order := &models.Order{}
+			extractPayload(t, http.StatusOK, recorder, order)
+			assert.Equal(t, state, order.State)
+		}
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, models.EventTransitioned).Order("id asc").Find(&events).Error)
+		require.Len(t, events, 3)
+		assert.Equal(t, "state:pending->paid", events[0].Changes)
+		assert.Equal(t, "state:shipped->delivered", events[2].Changes)
+		assert.Equal(t, "admin-yo", events[2].UserID)
+		assert.False(t, events[2].CreatedAt.IsZero())
+	})
+
+	t.Run("InvalidStateTransition", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{State: models.DeliveredState}, token)
+
+		rsp := &HTTPError{}
+		require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(rsp))
+		assert.Equal(t, map[string]interface{}{
+			"allowed_transitions": []interface{}{models.PaidState, models.FailedState},
+		}, rsp.Data)
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PendingState, saved.State)
+	})
+
+	t.Run("FulfillmentStateTransitions", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: models.ShippedState}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.ShippedState, order.FulfillmentState)
+
+		recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: models.ShippingState}, token)
+		validateError(t, http.StatusUnprocessableEntity, recorder)
+	})
+
+	t.Run("DeliveryInstructions", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		instructions := "Ring twice"
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{DeliveryInstructions: &instructions}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "Ring twice", order.DeliveryInstructions)
+
+		cleared := ""
+		recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{DeliveryInstructions: &cleared}, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Empty(t, saved.DeliveryInstructions)
+
+		recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: models.ShippedState}, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{DeliveryInstructions: &instructions}, token)
+		validateError(t, http.StatusBadRequest, recorder, "shipped")
+	})
 }
 
 // -------------------------------------------------------------------------------------------------------------------
@@ -550,10 +1389,7 @@ func TestOrderUpdate(t *testing.T) {
 func TestClaim(t *testing.T) {
 	t.Run("Simple", func(t *testing.T) {
 		test := NewRouteTest(t)
-		test.Data.firstOrder.Email = "villian@wayneindustries.com"
-		test.Data.firstOrder.UserID = ""
-		rsp := test.DB.Save(test.Data.firstOrder)
-		require.NoError(t, rsp.Error, "Failed to update email")
+		makeAnonymous(test, test.Data.firstOrder, "villian@wayneindustries.com")
 
 		token := testToken("villian", "villian@wayneindustries.com")
 		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
@@ -561,7 +1397,7 @@ func TestClaim(t *testing.T) {
 
 		// validate the DB
 		dbOrders := []models.Order{}
-		rsp = test.DB.Where("email = ?", "villian@wayneindustries.com").Find(&dbOrders)
+		rsp := test.DB.Where("email = ?", "villian@wayneindustries.com").Find(&dbOrders)
 		require.NoError(t, rsp.Error, "Failed to query DB")
 
 		assert.Len(t, dbOrders, 1)
@@ -571,6 +1407,56 @@ func TestClaim(t *testing.T) {
 		stored := &models.Address{ID: dbOrders[0].BillingAddressID}
 		require.NoError(t, test.DB.First(stored).Error)
 		assert.Equal(t, stored.UserID, dbOrders[0].UserID)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "order_id = ?", dbOrders[0].ID).Error)
+		assert.Equal(t, "villian", trans.UserID)
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.First(event, "order_id = ? AND type = ?", dbOrders[0].ID, models.EventClaimed).Error)
+		assert.Equal(t, "villian", event.UserID)
+		assert.Equal(t, "villian", event.Diff["user_id"].To)
+	})
+
+	t.Run("OtherUsersOrders", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken("impostor", test.Data.firstOrder.Email)
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, test.Data.testUser.ID, order.UserID)
+	})
+
+	t.Run("DifferentCase", func(t *testing.T) {
+		test := NewRouteTest(t)
+		makeAnonymous(test, test.Data.firstOrder, "Villian@WayneIndustries.com ")
+
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "villian", order.UserID)
+		assert.Equal(t, "Villian@WayneIndustries.com ", order.Email)
+	})
+
+	t.Run("PlusTag", func(t *testing.T) {
+		models.StripEmailPlusTags = true
+		defer func() { models.StripEmailPlusTags = false }()
+
+		test := NewRouteTest(t)
+		makeAnonymous(test, test.Data.firstOrder, "villian+gotham@wayneindustries.com")
+
+		token := testToken("villian", "Villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "villian", order.UserID)
 	})
 
 	t.Run("NoEmail", func(t *testing.T) {
@@ -589,10 +1475,7 @@ func TestClaim(t *testing.T) {
 
 	t.Run("MultipleTimes", func(t *testing.T) {
 		test := NewRouteTest(t)
-		test.Data.firstOrder.Email = "villian@wayneindustries.com"
-		test.Data.firstOrder.UserID = ""
-		rsp := test.DB.Save(test.Data.firstOrder)
-		require.NoError(t, rsp.Error, "Failed to update email")
+		makeAnonymous(test, test.Data.firstOrder, "villian@wayneindustries.com")
 
 		token := testToken("villian", "villian@wayneindustries.com")
 		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
@@ -607,6 +1490,14 @@ func TestClaim(t *testing.T) {
 // HELPERS
 // -------------------------------------------------------------------------------------------------------------------
 
+// makeAnonymous turns an order into one placed without a token.
+func makeAnonymous(test *RouteTest, order *models.Order, email string) {
+	order.Email = email
+	order.User = nil
+	order.UserID = ""
+	require.NoError(test.T, test.DB.Save(order).Error)
+}
+
 func runOrderUpdate(test *RouteTest, order *models.Order, params *orderRequestParams, token *jwt.Token) *httptest.ResponseRecorder {
 	updateBody, err := json.Marshal(params)
 	require.NoError(test.T, err, "Failed to marshal data for update")
@@ -735,12 +1626,205 @@ func startTestSite() *httptest.Server {
 					</script>
 				</body>
 				</html>`)
+		case "/translated-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "translated-1", "title": "Cookbook", "description": "Recipes", "type": "Book", "prices": [
+						{"amount": "5.00", "currency": "USD"}
+					], "translations": {
+						"de": {"title": "Kochbuch", "description": "Rezepte"},
+						"de-AT": {"title": "Kochbuch (Österreich)"},
+						"fr": {"title": "Livre de cuisine"}
+					}}
+					</script>
+				</body>
+				</html>`)
+		case "/purchase-limits-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "limited-1", "title": "Limited", "type": "Book", "min_quantity": 2, "max_quantity": 3, "prices": [
+						{"amount": "5.00", "currency": "USD"}
+					]}
+					</script>
+					<script class="gocommerce-product">
+					{"sku": "once-1", "title": "Once", "type": "Book", "one_per_customer": true, "prices": [
+						{"amount": "5.00", "currency": "USD"}
+					]}
+					</script>
+				</body>
+				</html>`)
+		case "/regional-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "usa-only", "title": "USA only", "type": "Book", "allowed_countries": ["USA"], "prices": [
+						{"amount": "5.00", "currency": "USD"}
+					]}
+					</script>
+					<script class="gocommerce-product">
+					{"sku": "not-dcland", "title": "Not in DC land", "type": "Book", "restricted_countries": ["dcland"], "prices": [
+						{"amount": "5.00", "currency": "USD"}
+					]}
+					</script>
+					<script class="gocommerce-product">
+					{"sku": "anywhere", "title": "Anywhere", "type": "Book", "prices": [
+						{"amount": "5.00", "currency": "USD"}
+					]}
+					</script>
+				</body>
+				</html>`)
+		case "/wholesale-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "product-9", "title": "Product 9", "type": "Book", "prices": [
+						{"amount": "20.00", "currency": "USD"},
+						{"amount": "12.00", "currency": "USD", "groups": ["wholesale"]}
+					]}
+					</script>
+				</body>
+				</html>`)
+		case "/price-list-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "product-10", "title": "Product 10", "type": "Book", "prices": {
+						"retail": [{"amount": "20.00", "currency": "USD"}],
+						"wholesale": [{"amount": "11.00", "currency": "USD"}]
+					}}
+					</script>
+				</body>
+				</html>`)
+		case "/download-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "product-2", "title": "Product 2", "type": "E-Book", "prices": [
+						{"amount": "4.99", "currency": "USD"}
+					], "downloads": [
+						{"title": "Product 2 PDF", "format": "pdf", "url": "/downloads/product-2.pdf"}
+					]}
+					</script>
+				</body>
+				</html>`)
+		case "/limited-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "product-4", "title": "Product 4", "type": "Book", "inventory": 3, "prices": [
+						{"amount": "19.99", "currency": "USD"}
+					]}
+					</script>
+				</body>
+				</html>`)
+		case "/shipped-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "product-5", "title": "Product 5", "type": "Poster", "weight": 500, "prices": [
+						{"amount": "20.00", "currency": "USD"}
+					]}
+					</script>
+				</body>
+				</html>`)
+		case "/subscription-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "product-box", "title": "Monthly Box", "type": "Box", "subscription": {"plan": "monthly-box"}, "prices": [
+						{"amount": "15.00", "currency": "USD"}
+					]}
+					</script>
+				</body>
+				</html>`)
+		case "/multi-currency-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "product-3", "title": "Product 3", "type": "Book", "prices": [
+						{"amount": "9.99", "currency": "USD"},
+						{"amount": "8.99", "currency": "eur"}
+					]}
+					</script>
+				</body>
+				</html>`)
+		case "/cost-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Product</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "product-cost", "title": "Product Cost", "type": "Book", "prices": [
+						{"amount": "10.00", "currency": "USD", "cost": "6.25"}
+					]}
+					</script>
+				</body>
+				</html>`)
 		case "/gocommerce/settings.json":
 			fmt.Fprintln(w, `{
+				"vat_country": "DE",
+				"order_data": {
+					"gift_message": {"type": "string", "writable": "customer"},
+					"po_number": {"type": "string", "writable": "customer", "immutable_after_payment": true},
+					"warehouse": {"type": "string", "writable": "admin"}
+				},
+				"order_data_schema": {
+					"properties": {
+						"gift_message": {"maxLength": 40},
+						"po_number": {"pattern": "^PO-[0-9]+$"},
+						"gift": {
+							"type": "object",
+							"properties": {"email": {"type": "string", "format": "email"}},
+							"required": ["email"]
+						}
+					}
+				},
+				"returns": {
+					"window_days": 30,
+					"restocking_fee_percentage": 10,
+					"product_types": {"tank": {"window_days": 0}}
+				},
 				"taxes": [
-					{"percentage": 19, "product_types": ["E-Book"], "countries": ["Germany"]},
+					{"percentage": 19, "product_types": ["E-Book", "shipping"], "countries": ["Germany"]},
 					{"percentage": 7, "product_types": ["Book"], "countries": ["Germany"]}
-				]
+				],
+				"shipping": {
+					"product_types": ["Poster"],
+					"zones": [
+						{"name": "Germany", "countries": ["Germany"], "rates": [
+							{"method": "standard", "prices": [{"amount": "4.90", "currency": "USD"}]},
+							{"method": "express", "type": "per_item", "prices": [{"amount": "3.00", "currency": "USD"}]}
+						]},
+						{"name": "World", "rates": [
+							{"method": "standard", "type": "weight", "prices": [
+								{"amount": "10.00", "currency": "USD", "up_to_weight": 1000},
+								{"amount": "25.00", "currency": "USD", "up_to_weight": 5000}
+							]}
+						]}
+					]
+				}
 			}`)
 		}
 	}))
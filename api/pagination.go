@@ -1,10 +1,13 @@
 package api
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
@@ -68,3 +71,128 @@ func paginate(w http.ResponseWriter, r *http.Request, query *gorm.DB) (offset in
 
 	return
 }
+
+// keysetCursor marks the position of the last item of a page for keyset
+// pagination, which stays fast and stable for large result sets. Ascending
+// cursors read towards newer items, so a feed can be resumed later from the
+// last item that was read.
+type keysetCursor struct {
+	CreatedAt time.Time
+	ID        string
+	Ascending bool
+}
+
+func (c *keysetCursor) String() string {
+	direction := "d"
+	if c.Ascending {
+		direction = "a"
+	}
+	value := direction + "|" + strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func parseKeysetCursor(value string) (*keysetCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	parts := strings.SplitN(string(decoded), "|", 3)
+	if len(parts) == 2 {
+		// cursors from before the direction was part of them
+		parts = append([]string{"d"}, parts...)
+	}
+	if len(parts) != 3 || (parts[0] != "a" && parts[0] != "d") {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	return &keysetCursor{CreatedAt: time.Unix(0, nanos), ID: parts[2], Ascending: parts[0] == "a"}, nil
+}
+
+// keysetPage is a page of a keyset paginated query.
+type keysetPage struct {
+	limit     int
+	ascending bool
+	cursor    *keysetCursor
+}
+
+// next returns the cursor of the page after one that ended with last, or nil
+// when there is nothing more to read. Ascending pages always have a next
+// cursor, as newer items can still be added after the last one.
+func (p *keysetPage) next(count int, last *keysetCursor) *keysetCursor {
+	if last == nil {
+		if p.ascending {
+			return p.cursor
+		}
+		return nil
+	}
+	last.Ascending = p.ascending
+	if p.ascending || count >= p.limit {
+		return last
+	}
+	return nil
+}
+
+// keysetPaginate orders the query by created_at and id and limits it to the
+// page following the cursor parameter. Pages are newest first, unless
+// direction=asc is set or the cursor was read in ascending order.
+func keysetPaginate(r *http.Request, query *gorm.DB, table string) (*gorm.DB, *keysetPage, error) {
+	params := r.URL.Query()
+	var perPage uint64 = defaultPerPage
+	if queryPerPage := params.Get("per_page"); queryPerPage != "" {
+		var err error
+		perPage, err = strconv.ParseUint(queryPerPage, 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if perPage < 1 {
+		perPage = 1
+	}
+
+	page := &keysetPage{limit: int(perPage)}
+	switch params.Get("direction") {
+	case "", "desc":
+	case "asc":
+		page.ascending = true
+	default:
+		return nil, nil, fmt.Errorf("direction must be asc or desc")
+	}
+
+	if value := params.Get("cursor"); value != "" {
+		cursor, err := parseKeysetCursor(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		page.cursor = cursor
+		page.ascending = cursor.Ascending
+		comparison := "<"
+		if cursor.Ascending {
+			comparison = ">"
+		}
+		query = query.Where(
+			table+".created_at "+comparison+" ? OR ("+table+".created_at = ? AND "+table+".id "+comparison+" ?)",
+			cursor.CreatedAt, cursor.CreatedAt, cursor.ID,
+		)
+	}
+
+	direction := " desc"
+	if page.ascending {
+		direction = " asc"
+	}
+	query = query.Order(table+".created_at"+direction, true).Order(table + ".id" + direction).Limit(page.limit)
+	return query, page, nil
+}
+
+// addKeysetHeaders links to the page after the given cursor.
+func addKeysetHeaders(w http.ResponseWriter, r *http.Request, next *keysetCursor) {
+	url, _ := url.ParseRequestURI(r.URL.String())
+	query := url.Query()
+	query.Set("cursor", next.String())
+	url.RawQuery = query.Encode()
+
+	w.Header().Add("Link", "<"+url.String()+">; rel=\"next\"")
+	w.Header().Add("X-Next-Cursor", next.String())
+}
@@ -57,9 +57,9 @@ func parseUserQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 		"id",
 	})
 
-	query = addLikeFilters(query, userTable, params, []string{
-		"email",
-	})
+	if email := params.Get("email"); email != "" {
+		query = addEmailFilter(query, userTable, email)
+	}
 
 	query, err := parseLimitQueryParam(query, params)
 	if err != nil {
@@ -99,12 +99,25 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 		}
 	}
 
+	if refund := params.Get("has_refund"); refund != "" {
+		if refund == "yes" || refund == "true" {
+			query = query.Where("total_refunded > 0")
+		} else {
+			query = query.Where("total_refunded = 0")
+		}
+	}
+
 	if invoiceNumber := params.Get("invoice_number"); invoiceNumber != "" {
 		query = query.Where("invoice_number = ?", invoiceNumber)
 	}
 
 	orderTable := query.NewScope(models.Order{}).QuotedTableName()
 
+	if transactionID := params.Get("transaction_id"); transactionID != "" {
+		transactionTable := query.NewScope(models.Transaction{}).QuotedTableName()
+		query = query.Where(orderTable+".id IN (SELECT order_id FROM "+transactionTable+" WHERE processor_id = ?)", transactionID)
+	}
+
 	query = addAddressFilter(query, params, "countries", "country")
 	query = addAddressFilter(query, params, "name", "name")
 
@@ -133,7 +146,11 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	}
 
 	if email := params.Get("email"); email != "" {
-		query = query.Where(orderTable+".email LIKE ?", "%"+email+"%")
+		query = addEmailFilter(query, orderTable, email)
+	}
+
+	if sessionID := params.Get("session_id"); sessionID != "" {
+		query = query.Where(orderTable+".session_id = ?", sessionID)
 	}
 
 	if items := params.Get("items"); items != "" {
@@ -154,6 +171,32 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 		query = query.Where(orderTable+".coupon_code LIKE ?", "%"+code+"%")
 	}
 
+	if sku := params.Get("sku"); sku != "" {
+		lineItemTable := query.NewScope(models.LineItem{}).QuotedTableName()
+		query = query.Where(orderTable+".id IN (SELECT order_id FROM "+lineItemTable+" WHERE sku IN (?))", strings.Split(sku, ","))
+	}
+
+	for _, field := range []string{"state", "payment_state", "fulfillment_state"} {
+		if value := params.Get(field); value != "" {
+			query = query.Where(orderTable+"."+field+" IN (?)", strings.Split(value, ","))
+		}
+	}
+
+	if provider := params.Get("provider"); provider != "" {
+		query = query.Where(orderTable+".payment_processor IN (?)", strings.Split(provider, ","))
+	}
+
+	if country := params.Get("country"); country != "" {
+		addressTable := query.NewScope(models.Address{}).QuotedTableName()
+		addresses := "SELECT id FROM " + addressTable + " WHERE country IN (?)"
+		countries := strings.Split(country, ",")
+		query = query.Where(orderTable+".billing_address_id IN ("+addresses+") OR "+orderTable+".shipping_address_id IN ("+addresses+")", countries, countries)
+	}
+
+	if q := params.Get("q"); q != "" {
+		query = query.Where(orderTable+".raw_meta_data LIKE ?", "%"+q+"%")
+	}
+
 	return parseTimeQueryParams(query, params)
 }
 
@@ -169,22 +212,37 @@ func parseLimitQueryParam(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	return query, nil
 }
 
+// getTimeQueryParams reads the from and to parameters of a query. Both take a
+// unix timestamp or an ISO 8601 duration relative to now, like -P7D for a week
+// ago. Alternatively the period parameter selects a whole calendar period like
+// last_month. Relative dates are calculated in UTC.
 func getTimeQueryParams(params url.Values) (from *time.Time, to *time.Time, err error) {
+	now := time.Now().UTC()
+
+	if value := params.Get("period"); value != "" {
+		if params.Get("from") != "" || params.Get("to") != "" {
+			return nil, nil, fmt.Errorf("the 'period' parameter can't be combined with 'from' or 'to'")
+		}
+		start, end, err := periodRange(value, now)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad value for 'period' parameter: %s", err)
+		}
+		return &start, &end, nil
+	}
+
 	if value := params.Get("from"); value != "" {
-		ts, err := strconv.ParseInt(value, 10, 64)
+		t, err := parseTimeParam(value, now)
 		if err != nil {
 			return from, to, fmt.Errorf("bad value for 'from' parameter: %s", err)
 		}
-		t := time.Unix(ts, 0)
 		from = &t
 	}
 
 	if value := params.Get("to"); value != "" {
-		ts, err := strconv.ParseInt(value, 10, 64)
+		t, err := parseTimeParam(value, now)
 		if err != nil {
 			return from, to, fmt.Errorf("bad value for 'to' parameter: %s", err)
 		}
-		t := time.Unix(ts, 0)
 		to = &t
 	}
 	return
@@ -204,19 +262,16 @@ func parseTimeQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	return query, nil
 }
 
-func addFilters(query *gorm.DB, table string, params url.Values, availableFilters []string) *gorm.DB {
-	for _, filter := range availableFilters {
-		if values, exists := params[filter]; exists {
-			query = query.Where(table+"."+filter+" = ?", values[0])
-		}
-	}
-	return query
+// addEmailFilter matches the emails containing a value, ignoring case and,
+// depending on models.StripEmailPlusTags, +tags.
+func addEmailFilter(query *gorm.DB, table string, email string) *gorm.DB {
+	return query.Where(table+".normalized_email LIKE ? OR "+table+".email LIKE ?", "%"+models.NormalizeEmail(email)+"%", "%"+email+"%")
 }
 
-func addLikeFilters(query *gorm.DB, table string, params url.Values, availableFilters []string) *gorm.DB {
+func addFilters(query *gorm.DB, table string, params url.Values, availableFilters []string) *gorm.DB {
 	for _, filter := range availableFilters {
 		if values, exists := params[filter]; exists {
-			query = query.Where(table+"."+filter+" LIKE ?", "%"+values[0]+"%")
+			query = query.Where(table+"."+filter+" = ?", values[0])
 		}
 	}
 	return query
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// Types of payment events
+const (
+	chargeSucceededEvent = "charge.succeeded"
+	chargeFailedEvent    = "charge.failed"
+	disputeOpenedEvent   = "dispute.opened"
+	refundCompletedEvent = "refund.completed"
+)
+
+// paymentEvent is a change of a charge that a payment provider reported to
+// its webhook, in the same form for all providers.
+type paymentEvent struct {
+	Type string
+	// ChargeIDs are the IDs the transaction of the charge can be saved with,
+	// for providers that have more than one ID for a payment.
+	ChargeIDs []string
+
+	FailureCode        string
+	FailureDescription string
+
+	DisputeID     string
+	DisputeReason string
+
+	// RefundID and Amount are the ID and the amount of a completed refund.
+	RefundID string
+	Amount   uint64
+}
+
+// applyPaymentEvent updates the transaction of the charge of an event, and
+// its order, to match the state of the payment with the provider. Events of
+// unknown charges and events that were applied before are ignored, since
+// providers send events more than once.
+func (a *API) applyPaymentEvent(r *http.Request, processor string, event *paymentEvent) *HTTPError {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	chargeIDs := []string{}
+	for _, id := range event.ChargeIDs {
+		if id != "" {
+			chargeIDs = append(chargeIDs, id)
+		}
+	}
+	if len(chargeIDs) == 0 {
+		return nil
+	}
+	trans := &models.Transaction{}
+	rsp := a.db.Where("instance_id = ? AND type = ? AND processor_id IN (?)", gcontext.GetInstanceID(ctx), models.ChargeTransactionType, chargeIDs).First(trans)
+	if rsp.RecordNotFound() {
+		log.Infof("Ignoring %v event of unknown charge %v", event.Type, chargeIDs)
+		return nil
+	}
+	if rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	// the order is locked while the event is applied, so events sent at the
+	// same time, and refunds made through the API, are applied one by one
+	tx := a.db.Begin()
+	order := &models.Order{}
+	if rsp := models.ForUpdate(tx).Preload("LineItems").Preload("Transactions").First(order, "id = ? AND instance_id = ?", trans.OrderID, trans.InstanceID); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if order.PaymentProcessor != processor {
+		tx.Rollback()
+		log.Infof("Ignoring %v event of charge %v of an order paid with %v", event.Type, trans.ProcessorID, order.PaymentProcessor)
+		return nil
+	}
+	// the order is saved with its transactions
+	for _, t := range order.Transactions {
+		if t.ID == trans.ID {
+			trans = t
+		}
+	}
+
+	log = log.WithField("order_id", order.ID).WithField("transaction_id", trans.ID)
+	var httpErr *HTTPError
+	var refund *models.Transaction
+	switch event.Type {
+	case chargeSucceededEvent:
+		httpErr = chargeSucceeded(tx, r, order, trans)
+	case chargeFailedEvent:
+		httpErr = chargeFailed(tx, r, order, trans, event)
+	case disputeOpenedEvent:
+		httpErr = disputeOpened(tx, r, order, trans, event)
+	case refundCompletedEvent:
+		refund, httpErr = refundCompleted(tx, r, order, trans, event)
+	}
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	tx.Commit()
+	log.Infof("Applied %v event of %v", event.Type, processor)
+
+	// the vendors' share of refunds made outside of the API is taken back
+	// once the refund is recorded
+	if provider := gcontext.GetPaymentProviders(ctx)[processor]; refund != nil && provider != nil {
+		a.reverseVendorTransfers(ctx, r, provider, order, trans, refund.Amount, nil, log)
+	}
+	return nil
+}
+
+// chargeSucceeded marks a charge as paid, and its order if it wasn't paid
+// yet, like when the charge timed out on our side but went through.
+func chargeSucceeded(tx *gorm.DB, r *http.Request, order *models.Order, trans *models.Transaction) *HTTPError {
+	if trans.Status == models.PaidState {
+		return nil
+	}
+	trans.Status = models.PaidState
+	trans.FailureCode = ""
+	trans.FailureDescription = ""
+	if rsp := tx.Save(trans); rsp.Error != nil {
+		return internalServerError("Error saving transaction").WithInternalError(rsp.Error)
+	}
+	if order.PaymentState == models.PaidState {
+		return nil
+	}
+	return settleOrder(tx, r, gcontext.GetConfig(r.Context()), order, trans, "")
+}
+
+// chargeFailed marks a charge as failed, and its order if it was paid by it.
+func chargeFailed(tx *gorm.DB, r *http.Request, order *models.Order, trans *models.Transaction, event *paymentEvent) *HTTPError {
+	if trans.Status == models.FailedState {
+		return nil
+	}
+	wasPaid := trans.Status == models.PaidState
+	trans.Status = models.FailedState
+	trans.FailureCode = event.FailureCode
+	trans.FailureDescription = event.FailureDescription
+	if rsp := tx.Save(trans); rsp.Error != nil {
+		return internalServerError("Error saving transaction").WithInternalError(rsp.Error)
+	}
+
+	if wasPaid && order.PaymentState == models.PaidState {
+		models.LogEventWithDiff(tx, r.RemoteAddr, "", order.ID, models.EventUpdated, []string{"payment_state"}, map[string]models.Change{
+			"payment_state": {From: order.PaymentState, To: models.FailedState},
+			"transaction":   {To: trans.ID},
+		})
+		order.PaymentState = models.FailedState
+		previousState := order.State
+		if order.TransitionState(models.FailedState) {
+			models.LogTransition(tx, r.RemoteAddr, "", order.ID, "state", previousState, order.State)
+		}
+		if rsp := tx.Save(order); rsp.Error != nil {
+			return internalServerError("Error saving order").WithInternalError(rsp.Error)
+		}
+	}
+
+	config := gcontext.GetConfig(r.Context())
+	if config.Webhooks.PaymentFailed != "" && !order.SuppressNotifications {
+		hook := newHook(r.Context(), getLogEntry(r), order.InstanceID, models.PaymentFailedHook, config.Webhooks.PaymentFailed, order.UserID, trans)
+		tx.Save(hook)
+	}
+	return nil
+}
+
+// disputeOpened records a dispute on a charge. The order keeps its state, as
+// the outcome of the dispute is up to the bank of the buyer.
+func disputeOpened(tx *gorm.DB, r *http.Request, order *models.Order, trans *models.Transaction, event *paymentEvent) *HTTPError {
+	if trans.DisputeID == event.DisputeID {
+		return nil
+	}
+	now := time.Now()
+	trans.DisputeID = event.DisputeID
+	trans.DisputeReason = event.DisputeReason
+	trans.DisputedAt = &now
+	if rsp := tx.Save(trans); rsp.Error != nil {
+		return internalServerError("Error saving transaction").WithInternalError(rsp.Error)
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, "", order.ID, models.EventDisputed, []string{"dispute_id"}, map[string]models.Change{
+		"dispute_id":  {To: event.DisputeID},
+		"reason":      {To: event.DisputeReason},
+		"transaction": {To: trans.ID},
+	})
+	return nil
+}
+
+// refundCompleted records a refund of a charge, either one that was started
+// with a refund request or one made with the dashboard of the provider.
+// Refunds are recorded once per refund ID of the provider, and the refund is
+// only returned when it was recorded by this event.
+func refundCompleted(tx *gorm.DB, r *http.Request, order *models.Order, trans *models.Transaction, event *paymentEvent) (*models.Transaction, *HTTPError) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	if event.RefundID == "" {
+		getLogEntry(r).Infof("Ignoring %v event without a refund ID", event.Type)
+		return nil, nil
+	}
+
+	m := &models.Transaction{}
+	rsp := tx.Where("order_id = ? AND type = ? AND processor_id = ?", order.ID, models.RefundTransactionType, event.RefundID).First(m)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if rsp.RecordNotFound() {
+		m = &models.Transaction{
+			InstanceID:  order.InstanceID,
+			ID:          models.NewID(config.IDFormat),
+			OrderID:     order.ID,
+			UserID:      trans.UserID,
+			ProcessorID: event.RefundID,
+			ChargeID:    trans.ID,
+			Amount:      event.Amount,
+			Currency:    trans.Currency,
+			Type:        models.RefundTransactionType,
+			Status:      models.PaidState,
+		}
+		rsp = tx.Create(m)
+	} else if m.Status == models.PaidState {
+		return nil, nil
+	} else {
+		m.Status = models.PaidState
+		m.FailureCode = ""
+		m.FailureDescription = ""
+		rsp = tx.Save(m)
+	}
+	if rsp.Error != nil {
+		return nil, internalServerError("Error saving transaction").WithInternalError(rsp.Error)
+	}
+
+	var paid uint64
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.PaidState {
+			paid += t.Amount
+		}
+	}
+	recordRefund(tx, r, "", order, m, paid)
+
+	if config.Webhooks.Refund != "" && !order.SuppressNotifications {
+		hook := newHook(ctx, getLogEntry(r), order.InstanceID, models.RefundIssuedHook, config.Webhooks.Refund, m.UserID, m)
+		tx.Save(hook)
+	}
+	return m, nil
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments/paypal"
+)
+
+func loadTestOrder(test *RouteTest, id string) *models.Order {
+	order := &models.Order{}
+	require.NoError(test.T, test.DB.Preload("Transactions").First(order, "id = ?", id).Error)
+	return order
+}
+
+func refundTransactions(order *models.Order) []*models.Transaction {
+	refunds := []*models.Transaction{}
+	for _, t := range order.Transactions {
+		if t.Type == models.RefundTransactionType {
+			refunds = append(refunds, t)
+		}
+	}
+	return refunds
+}
+
+func TestStripeWebhookCharges(t *testing.T) {
+	t.Run("Refunded", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec"
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("state", models.PaidState).Error)
+
+		event := `{"id": "evt_1", "type": "charge.refunded", "data": {"object": {
+			"id": "stripe", "amount": 100, "amount_refunded": 100, "refunded": true,
+			"refunds": {"object": "list", "data": [{"id": "re_1", "amount": 100, "status": "succeeded"}]}
+		}}}`
+		recorder := sendStripeEvent(test, event, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		recorder = sendStripeEvent(test, event, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		order := loadTestOrder(test, test.Data.firstOrder.ID)
+		assert.Equal(t, uint64(100), order.TotalRefunded)
+		assert.Equal(t, models.RefundedState, order.State)
+		refunds := refundTransactions(order)
+		require.Len(t, refunds, 1)
+		refund := refunds[0]
+		assert.Equal(t, uint64(100), refund.Amount)
+		assert.Equal(t, "re_1", refund.ProcessorID)
+		assert.Equal(t, models.PaidState, refund.Status)
+	})
+	t.Run("SucceededLate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec"
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).Updates(map[string]interface{}{"status": models.FailedState, "failure_code": "500"}).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Updates(map[string]interface{}{"payment_state": models.PendingState, "state": models.PendingState}).Error)
+
+		recorder := sendStripeEvent(test, `{"id": "evt_2", "type": "charge.succeeded", "data": {"object": {
+			"id": "stripe", "amount": 100, "paid": true, "status": "succeeded"
+		}}}`, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		order := loadTestOrder(test, test.Data.firstOrder.ID)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, models.PaidState, order.State)
+		assert.NotZero(t, order.InvoiceNumber)
+		assert.Equal(t, models.PaidState, order.Transactions[0].Status)
+		assert.Equal(t, "", order.Transactions[0].FailureCode)
+	})
+	t.Run("Failed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec"
+
+		recorder := sendStripeEvent(test, `{"id": "evt_3", "type": "charge.failed", "data": {"object": {
+			"id": "stripe", "amount": 100, "status": "failed", "failure_code": "card_declined", "failure_message": "Your card was declined."
+		}}}`, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		order := loadTestOrder(test, test.Data.firstOrder.ID)
+		assert.Equal(t, models.FailedState, order.PaymentState)
+		assert.Equal(t, models.FailedState, order.Transactions[0].Status)
+		assert.Equal(t, "card_declined", order.Transactions[0].FailureCode)
+	})
+	t.Run("Disputed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec"
+
+		recorder := sendStripeEvent(test, `{"id": "evt_4", "type": "charge.dispute.created", "data": {"object": {
+			"id": "dp_1", "charge": "stripe", "amount": 100, "reason": "fraudulent", "status": "needs_response"
+		}}}`, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		order := loadTestOrder(test, test.Data.firstOrder.ID)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, "dp_1", order.Transactions[0].DisputeID)
+		assert.Equal(t, "fraudulent", order.Transactions[0].DisputeReason)
+		assert.NotNil(t, order.Transactions[0].DisputedAt)
+	})
+	t.Run("UnknownCharge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec"
+
+		recorder := sendStripeEvent(test, `{"id": "evt_5", "type": "charge.failed", "data": {"object": {"id": "ch_unknown"}}}`, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	})
+}
+
+func sendPayPalEvent(test *RouteTest, event string) *httptest.ResponseRecorder {
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(test.T, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/paypal", strings.NewReader(event))
+	r.Header.Set("Paypal-Transmission-Sig", "signature")
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion).handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestPayPalWebhook(t *testing.T) {
+	verified := true
+	paypalVerifyWebhook = func(config paypal.Config, webhookID string, header http.Header, payload []byte) error {
+		if !verified || webhookID != "WH-1" || header.Get("Paypal-Transmission-Sig") != "signature" {
+			return errors.New("not verified")
+		}
+		return nil
+	}
+	defer func() { paypalVerifyWebhook = paypal.VerifyWebhook }()
+
+	refunded := `{"id": "WH-EVENT-1", "event_type": "PAYMENT.SALE.REFUNDED", "resource": {
+		"id": "refund-1", "sale_id": "sale-1", "parent_payment": "paypal", "state": "completed",
+		"amount": {"total": "0.50", "currency": "USD"}
+	}}`
+
+	t.Run("Refunded", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.PayPal.WebhookID = "WH-1"
+
+		recorder := sendPayPalEvent(test, refunded)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		order := loadTestOrder(test, test.Data.secondOrder.ID)
+		assert.Equal(t, uint64(50), order.TotalRefunded)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		refunds := refundTransactions(order)
+		require.Len(t, refunds, 1)
+		assert.Equal(t, "refund-1", refunds[0].ProcessorID)
+		assert.Equal(t, uint64(50), refunds[0].Amount)
+	})
+	t.Run("OtherProvider", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.PayPal.WebhookID = "WH-1"
+
+		// the charge of the first order was made with Stripe
+		recorder := sendPayPalEvent(test, strings.Replace(refunded, `"parent_payment": "paypal"`, `"parent_payment": "stripe"`, 1))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, uint64(0), loadTestOrder(test, test.Data.firstOrder.ID).TotalRefunded)
+	})
+	t.Run("NotVerified", func(t *testing.T) {
+		verified = false
+		defer func() { verified = true }()
+		test := NewRouteTest(t)
+		test.Config.Payment.PayPal.WebhookID = "WH-1"
+
+		recorder := sendPayPalEvent(test, refunded)
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Equal(t, uint64(0), loadTestOrder(test, test.Data.secondOrder.ID).TotalRefunded)
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := sendPayPalEvent(test, refunded)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestRecordRefund(t *testing.T) {
+	test := NewRouteTest(t)
+	// another refund was recorded since the order was loaded
+	stale := loadTestOrder(test, test.Data.firstOrder.ID)
+	require.NoError(t, test.DB.Model(stale).UpdateColumn("total_refunded", 30).Error)
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	recordRefund(test.DB, r, "", stale, &models.Transaction{ID: "refund", Amount: 20}, 100)
+	assert.Equal(t, uint64(50), stale.TotalRefunded)
+	assert.Equal(t, uint64(50), loadTestOrder(test, test.Data.firstOrder.ID).TotalRefunded)
+}
@@ -3,27 +3,30 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
 
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 
 	"github.com/jinzhu/gorm"
-	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
 
 	"mime"
 
+	"github.com/netlify/gocommerce/breaker"
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/extensions"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/gocommerce/payments"
 	"github.com/netlify/gocommerce/payments/paypal"
 	"github.com/netlify/gocommerce/payments/stripe"
+	"github.com/netlify/gocommerce/tracing"
 )
 
 // PaymentParams holds the parameters for creating a payment
@@ -32,6 +35,9 @@ type PaymentParams struct {
 	Currency     string `json:"currency"`
 	ProviderType string `json:"provider"`
 	Description  string `json:"description"`
+	// GiftCard is the code of a gift card that pays for as much of the
+	// amount as its balance covers. The rest is charged to the provider.
+	GiftCard string `json:"gift_card"`
 }
 
 // PaymentListForUser is the endpoint for listing transactions for a user.
@@ -45,7 +51,7 @@ func (a *API) PaymentListForUser(w http.ResponseWriter, r *http.Request) error {
 		return notFoundError("Couldn't find a record for " + userID)
 	}
 
-	trans, httpErr := queryForTransactions(a.db, log, "user_id = ?", userID)
+	trans, httpErr := queryForTransactions(a.db.Where("instance_id = ?", gcontext.GetInstanceID(ctx)), log, "user_id = ?", userID)
 	if httpErr != nil {
 		return httpErr
 	}
@@ -60,7 +66,7 @@ func (a *API) PaymentListForOrder(w http.ResponseWriter, r *http.Request) error
 	orderID := gcontext.GetOrderID(ctx)
 	claims := gcontext.GetClaims(ctx)
 
-	order, httpErr := queryForOrder(a.db, orderID, log)
+	order, httpErr := queryForOrder(ctx, a.db, orderID, log)
 	if httpErr != nil {
 		return httpErr
 	}
@@ -70,8 +76,7 @@ func (a *API) PaymentListForOrder(w http.ResponseWriter, r *http.Request) error
 	}
 
 	// additional check for anonymous orders: only allow admins
-	isAdmin := gcontext.IsAdmin(ctx)
-	if order.UserID == "" && !isAdmin {
+	if order.UserID == "" && !gcontext.HasScope(ctx, paymentsReadScope) {
 		// anon order ~ only accessible by an admin
 		return unauthorizedError("Anonymous orders must be accessed by admins")
 	}
@@ -85,31 +90,37 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
 	config := gcontext.GetConfig(ctx)
-	mailer := gcontext.GetMailer(ctx)
 
 	params := PaymentParams{Currency: "USD"}
 	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
 		return badRequestError("Could not read params: %v", err)
 	}
-	if params.ProviderType == "" {
-		return badRequestError("Creating a payment requires specifying a 'provider'")
+	if params.ProviderType == "" && params.GiftCard == "" {
+		return badRequestError("Creating a payment requires specifying a 'provider' or a 'gift_card'")
 	}
 
-	provider := gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", params.ProviderType)
-	}
-	charge, err := provider.NewCharger(ctx, r)
-	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
+	var provider payments.Provider
+	var charge payments.Charger
+	if params.ProviderType != "" {
+		provider = gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
+		if provider == nil {
+			return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+		}
+		charge, err = provider.NewCharger(ctx, r)
+		if err != nil {
+			return badRequestError("Error creating payment provider: %v", err)
+		}
 	}
 
 	orderID := gcontext.GetOrderID(ctx)
+	txSpan, _ := tracing.StartSpan(ctx, "db.transaction")
+	txSpan.SetTag("order_id", orderID)
+	defer txSpan.Finish()
 	tx := a.db.Begin()
 	order := &models.Order{}
 
-	if result := tx.Preload("LineItems").Preload("BillingAddress").First(order, "id = ?", orderID); result.Error != nil {
+	if result := models.ForUpdate(tx).Preload("LineItems").Preload("LineItems.PriceItems").Preload("BillingAddress").Preload("ShippingAddress").First(order, "id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx)); result.Error != nil {
 		tx.Rollback()
 		if result.RecordNotFound() {
 			return notFoundError("No order with this ID found")
@@ -127,6 +138,11 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Currencies doesn't match - %v vs %v", order.Currency, params.Currency)
 	}
 
+	if order.PricesExpired() {
+		tx.Rollback()
+		return badRequestError("The prices for this order expired at %v, please create a new order", order.PricesExpireAt.Format(time.RFC3339))
+	}
+
 	token := gcontext.GetToken(ctx)
 	if order.UserID == "" {
 		if token != nil {
@@ -146,10 +162,31 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	err = a.verifyAmount(ctx, order, params.Amount)
+	if httpErr := a.verifyAmount(ctx, tx, order, params.Amount); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if httpErr := checkOnePerCustomer(tx, order); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	// stock can run out between creating and paying an order
+	shortages, err := findStockShortages(tx, order)
 	if err != nil {
 		tx.Rollback()
-		return internalServerError("We failed to authorize the amount for this order: %v", err)
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if len(shortages) > 0 {
+		if config.Inventory.OversellPolicy != oversellBackorder {
+			tx.Rollback()
+			log.WithField("shortages", shortages).Info("Rejected the payment of an order that is out of stock")
+			return conflictError("Some items of this order are no longer in stock").WithData(map[string]interface{}{
+				"shortages": shortages,
+				"options":   []string{"reduce_quantities", "remove_items"},
+			})
+		}
+		backorderShortages(order, shortages)
 	}
 
 	invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
@@ -158,42 +195,131 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
 	}
 
-	tr := models.NewTransaction(order)
-	processorID, err := charge(params.Amount, params.Currency)
-	tr.ProcessorID = processorID
+	if err := models.RedeemCoupon(tx, order); err != nil {
+		tx.Rollback()
+		if err == models.ErrCouponExhausted {
+			return conflictError("The coupon of this order was redeemed the maximum number of times")
+		}
+		return internalServerError("Error redeeming coupon").WithInternalError(err)
+	}
+	recordFunnelStep(tx, order, models.PaymentAttemptedStep, log)
 
-	if err != nil {
-		tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
-		tr.FailureDescription = err.Error()
-		tr.Status = models.FailedState
-		tx.Create(tr)
-		tx.Commit()
-		return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
-	}
-
-	// mark order and transaction as paid
-	tr.Status = models.PaidState
-	tx.Create(tr)
-	order.PaymentProcessor = provider.Name()
+	chargeAmount := params.Amount
+	var giftCardTr *models.Transaction
+	if params.GiftCard != "" {
+		card, redeemed, httpErr := redeemGiftCard(tx, order, params.GiftCard, params.Amount)
+		if httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		giftCardTr = models.NewTransaction(order)
+		giftCardTr.ID = models.NewID(config.IDFormat)
+		giftCardTr.Amount = redeemed
+		giftCardTr.GiftCardID = card.ID
+		giftCardTr.ProcessorID = card.Code
+		chargeAmount -= redeemed
+	}
+	if chargeAmount > 0 && charge == nil {
+		tx.Rollback()
+		return badRequestError("The gift card only covers %d of the amount, the remaining %d requires specifying a 'provider'", params.Amount-chargeAmount, chargeAmount)
+	}
+
+	var tr *models.Transaction
+	if chargeAmount > 0 {
+		tr = models.NewTransaction(order)
+		tr.ID = models.NewID(config.IDFormat)
+		tr.Amount = chargeAmount
+		processorID, err := charge(chargeAmount, params.Currency)
+		tr.ProcessorID = processorID
+
+		if err == breaker.ErrOpen {
+			tx.Rollback()
+			return serviceUnavailableError("Payments with %v are unavailable right now, please try again later", provider.Name())
+		}
+		if err != nil {
+			if giftCardTr != nil {
+				if err := models.CreditGiftCard(tx, giftCardTr.GiftCardID, giftCardTr.Amount); err != nil {
+					tx.Rollback()
+					return internalServerError("Error updating gift card balance").WithInternalError(err)
+				}
+			}
+			tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
+			tr.FailureDescription = err.Error()
+			tr.Status = models.FailedState
+			tx.Create(tr)
+			if err := models.ReleaseCoupon(tx, order); err != nil {
+				tx.Rollback()
+				return internalServerError("Error releasing coupon").WithInternalError(err)
+			}
+			if config.Webhooks.PaymentFailed != "" && !order.SuppressNotifications {
+				hook := newHook(ctx, log, order.InstanceID, models.PaymentFailedHook, config.Webhooks.PaymentFailed, order.UserID, tr)
+				tx.Save(hook)
+			}
+			tx.Commit()
+			return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
+		}
+	}
+
+	// mark order and transactions as paid
+	order.PaymentProcessor = models.GiftCardProcessor
+	charged := tr
+	if charged != nil {
+		charged.Status = models.PaidState
+		tx.Create(charged)
+		order.PaymentProcessor = provider.Name()
+	}
+	if giftCardTr != nil {
+		giftCardTr.Status = models.PaidState
+		tx.Create(giftCardTr)
+		if tr == nil {
+			tr = giftCardTr
+		}
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, order.UserID, order.ID, models.EventPaid, []string{"payment_state"}, map[string]models.Change{
+		"payment_state": {From: order.PaymentState, To: models.PaidState},
+		"transaction":   {To: tr.ID},
+		"amount":        {To: params.Amount},
+	})
 	order.PaymentState = models.PaidState
 	order.InvoiceNumber = invoiceNumber
+	previousState := order.State
+	paid := order.TransitionState(models.PaidState)
 	tx.Save(order)
+	recordFunnelStep(tx, order, models.PaidStep, log)
+	if paid {
+		models.LogTransition(tx, r.RemoteAddr, order.UserID, order.ID, "state", previousState, order.State)
+	}
+	if err := adjustInventory(tx, order, nil, -1); err != nil {
+		log.WithError(err).Error("Error updating the inventory of a paid order")
+	}
+	if len(shortages) > 0 {
+		log.WithField("shortages", shortages).Info("Backordered the items of a paid order that are out of stock")
+		models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventBackordered, []string{"backordered_quantity"})
+	}
 
-	if config.Webhooks.Payment != "" {
-		hook := models.NewHook("payment", config.Webhooks.Payment, order.UserID, config.Webhooks.Secret, order)
+	if config.Webhooks.Payment != "" && !order.SuppressNotifications {
+		hook := newHook(ctx, log, order.InstanceID, models.PaymentSucceededHook, config.Webhooks.Payment, order.UserID, order)
 		tx.Save(hook)
 	}
 
+	actionLinks := a.orderReceivedActionLinks(ctx, tx, r, order, tr)
+	enqueueMail(ctx, tx, log, models.OrderConfirmationMailJob, &mailJob{TransactionID: tr.ID})
+	enqueueMail(ctx, tx, log, models.OrderReceivedMailJob, &mailJob{TransactionID: tr.ID, ActionLinks: actionLinks})
+	if len(shortages) > 0 {
+		enqueueMail(ctx, tx, log, models.OrderBackorderedMailJob, &mailJob{TransactionID: tr.ID})
+	}
+
 	tx.Commit()
 
-	go func() {
-		err1 := mailer.OrderConfirmationMail(tr)
-		err2 := mailer.OrderReceivedMail(tr)
+	if charged != nil {
+		a.payoutVendors(ctx, r, provider, order, charged, log)
+	}
 
-		if err1 != nil || err2 != nil {
-			log.Errorf("Error sending order confirmation mails: %v %v", err1, err2)
-		}
-	}()
+	for _, err := range extensions.OrderPaid(ctx, order, tr) {
+		log.WithError(err).Error("Error running payment extension")
+	}
+
+	a.enqueueAutomations(ctx, log, order)
 
 	return sendJSON(w, http.StatusOK, tr)
 }
@@ -202,7 +328,7 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 func (a *API) PaymentList(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
 	instanceID := gcontext.GetInstanceID(r.Context())
-	query := a.db.Where("instance_id = ?", instanceID)
+	query := a.readDB(r).Where("instance_id = ?", instanceID)
 
 	query, err := parsePaymentQueryParams(query, r.URL.Query())
 	if err != nil {
@@ -219,7 +345,7 @@ func (a *API) PaymentList(w http.ResponseWriter, r *http.Request) error {
 // PaymentView returns information about a single payment. It is only available to admins.
 func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 	payID := chi.URLParam(r, "payment_id")
-	trans, httpErr := a.getTransaction(payID)
+	trans, httpErr := a.getTransaction(gcontext.GetInstanceID(r.Context()), payID)
 	if httpErr != nil {
 		return httpErr
 	}
@@ -230,7 +356,6 @@ func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 // refunds if desired. It is only available to admins.
 func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
-	config := gcontext.GetConfig(ctx)
 	params := PaymentParams{Currency: "USD"}
 	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
@@ -238,7 +363,7 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	payID := chi.URLParam(r, "payment_id")
-	trans, httpErr := a.getTransaction(payID)
+	trans, httpErr := a.getTransaction(gcontext.GetInstanceID(r.Context()), payID)
 	if httpErr != nil {
 		return httpErr
 	}
@@ -251,66 +376,16 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("The balance of the refund must be between 0 and the total amount")
 	}
 
-	if trans.FailureCode != "" {
-		return badRequestError("Can't refund a failed transaction")
-	}
-
-	if trans.Status != models.PaidState {
-		return badRequestError("Can't refund a transaction that hasn't been paid")
-	}
-
 	log := getLogEntry(r)
-	order, httpErr := queryForOrder(a.db, trans.OrderID, log)
+	order, httpErr := queryForOrder(ctx, a.db, trans.OrderID, log)
 	if httpErr != nil {
 		return httpErr
 	}
-	if order.PaymentProcessor == "" {
-		return badRequestError("Order does not specify a payment provider")
-	}
-
-	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
-	}
-	refund, err := provider.NewRefunder(ctx, r)
-	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
-	}
-
-	// ok make the refund
-	m := &models.Transaction{
-		InstanceID: order.InstanceID,
-		ID:         uuid.NewRandom().String(),
-		Amount:     params.Amount,
-		Currency:   params.Currency,
-		UserID:     trans.UserID,
-		OrderID:    trans.OrderID,
-		Type:       models.RefundTransactionType,
-		Status:     models.PendingState,
-	}
-
-	tx := a.db.Begin()
-	tx.Create(m)
-	provID := provider.Name()
-	log.Debugf("Starting refund to %s", provID)
-	refundID, err := refund(trans.ProcessorID, params.Amount, params.Currency)
-	if err != nil {
-		log.WithError(err).Info("Failed to refund value")
-		m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
-		m.FailureDescription = err.Error()
-		m.Status = models.FailedState
-	} else {
-		m.ProcessorID = refundID
-		m.Status = models.PaidState
-	}
 
-	log.Infof("Finished transaction with %s: %s", provID, m.ProcessorID)
-	tx.Save(m)
-	if config.Webhooks.Refund != "" {
-		hook := models.NewHook("refund", config.Webhooks.Refund, m.UserID, config.Webhooks.Secret, m)
-		tx.Save(hook)
+	m, httpErr := a.refundTransaction(ctx, r, order, trans, params.Amount, nil)
+	if httpErr != nil {
+		return httpErr
 	}
-	tx.Commit()
 	return sendJSON(w, http.StatusOK, m)
 }
 
@@ -357,6 +432,9 @@ func (a *API) PreauthorizePayment(w http.ResponseWriter, r *http.Request) error
 	}
 
 	paymentResult, err := preauthorize(params.Amount, params.Currency, params.Description)
+	if err == breaker.ErrOpen {
+		return serviceUnavailableError("Payments with %v are unavailable right now, please try again later", provider.Name())
+	}
 	if err != nil {
 		return internalServerError("Error preauthorizing payment: %v", err).WithInternalError(err)
 	}
@@ -367,28 +445,102 @@ func (a *API) PreauthorizePayment(w http.ResponseWriter, r *http.Request) error
 // ------------------------------------------------------------------------------------------------
 // Helpers
 // ------------------------------------------------------------------------------------------------
-func (a *API) getTransaction(payID string) (*models.Transaction, *HTTPError) {
+// getTransaction finds a transaction of an instance.
+func (a *API) getTransaction(instanceID, payID string) (*models.Transaction, *HTTPError) {
 	trans, err := models.GetTransaction(a.db, payID)
 	if err != nil {
 		return nil, internalServerError("Error while querying for transactions").WithInternalError(err)
 	}
-	if trans == nil {
+	if trans == nil || trans.InstanceID != instanceID {
 		return nil, notFoundError("Transaction not found")
 	}
 	return trans, nil
 }
 
-func (a *API) verifyAmount(ctx context.Context, order *models.Order, amount uint64) error {
+type priceBreakdown struct {
+	Amount uint64 `json:"amount"`
+	// StoredTotal is the total the order was priced at, when the price
+	// calculated for it now is different.
+	StoredTotal uint64               `json:"stored_total,omitempty"`
+	Subtotal    uint64               `json:"subtotal"`
+	Discount    uint64               `json:"discount"`
+	Taxes       uint64               `json:"taxes"`
+	Shipping    uint64               `json:"shipping"`
+	Total       uint64               `json:"total"`
+	Items       []itemPriceBreakdown `json:"line_items,omitempty"`
+}
+
+type itemPriceBreakdown struct {
+	Sku      string `json:"sku"`
+	Quantity uint64 `json:"quantity"`
+	Subtotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
+	Taxes    uint64 `json:"taxes"`
+	Total    uint64 `json:"total"`
+
+	PromotionDiscount uint64                      `json:"promotion_discount,omitempty"`
+	Promotions        []*calculator.ItemPromotion `json:"promotions,omitempty"`
+	TierDiscount      uint64                      `json:"tier_discount,omitempty"`
+}
+
+// verifyAmount checks the amount to charge against the price of the order.
+// Prices pinned for a validity window are charged as quoted, otherwise the
+// price is recalculated with the current settings and the claims of the
+// buyer, read in the transaction the order is paid in. When that
+// price differs from the stored total, because the settings or the order
+// changed since it was priced, the order can't be paid until an admin
+// recalculates it.
+func (a *API) verifyAmount(ctx context.Context, tx *gorm.DB, order *models.Order, amount uint64) *HTTPError {
+	breakdown := &priceBreakdown{Amount: amount}
+	storedTotal := order.Total
+	if order.PricesExpireAt == nil {
+		settings, err := a.loadSettings(ctx)
+		if err != nil {
+			return internalServerError("Error loading site settings").WithInternalError(err)
+		}
+		jwtClaims, err := a.orderPriceClaims(ctx, tx, order)
+		if err != nil {
+			return internalServerError("Error loading customer groups").WithInternalError(err)
+		}
+		price := order.CalculateTotal(settings, jwtClaims)
+		if price.ShippingError != nil {
+			return badRequestError("%v", price.ShippingError)
+		}
+		for i, item := range price.Items {
+			breakdown.Items = append(breakdown.Items, itemPriceBreakdown{
+				Sku:      order.LineItems[i].Sku,
+				Quantity: item.Quantity,
+				Subtotal: item.Subtotal,
+				Discount: item.Discount,
+				Taxes:    item.Taxes,
+				Total:    item.Total,
+
+				PromotionDiscount: item.PromotionDiscount,
+				Promotions:        item.Promotions,
+				TierDiscount:      item.TierDiscount,
+			})
+		}
+	}
+	breakdown.Subtotal = order.SubTotal
+	breakdown.Discount = order.Discount
+	breakdown.Taxes = order.Taxes
+	breakdown.Shipping = order.Shipping
+	breakdown.Total = order.Total
+
+	if order.Total != storedTotal {
+		breakdown.StoredTotal = storedTotal
+		return conflictError("The total of this order changed from %d to %d since it was priced, an admin has to recalculate the order before it can be paid", storedTotal, order.Total).WithData(breakdown)
+	}
 	if order.Total != amount {
-		return fmt.Errorf("Amount calculated for order didn't match amount to charge. %v vs %v", order.Total, amount)
+		return badRequestError("Amount calculated for order didn't match amount to charge. %v vs %v", order.Total, amount).WithData(breakdown)
 	}
 
 	return nil
 }
 
-func queryForOrder(db *gorm.DB, orderID string, log logrus.FieldLogger) (*models.Order, *HTTPError) {
+func queryForOrder(ctx context.Context, db *gorm.DB, orderID string, log logrus.FieldLogger) (*models.Order, *HTTPError) {
 	order := &models.Order{}
-	if rsp := db.Preload("Transactions").Find(order, "id = ?", orderID); rsp.Error != nil {
+	if rsp := db.Preload("Transactions").Find(order, "id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx)); rsp.Error != nil {
 		if rsp.RecordNotFound() {
 			return nil, notFoundError("Order not found")
 		}
@@ -420,7 +572,7 @@ func createPaymentProviders(c *conf.Configuration) (map[string]payments.Provider
 		if err != nil {
 			return nil, err
 		}
-		provs[p.Name()] = p
+		provs[p.Name()] = withBreaker(p)
 	}
 	if c.Payment.PayPal.Enabled {
 		p, err := paypal.NewPaymentProvider(paypal.Config{
@@ -431,7 +583,7 @@ func createPaymentProviders(c *conf.Configuration) (map[string]payments.Provider
 		if err != nil {
 			return nil, err
 		}
-		provs[p.Name()] = p
+		provs[p.Name()] = withBreaker(p)
 	}
 	return provs, nil
 }
@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -315,6 +316,151 @@ func TestPaymentsRefund(t *testing.T) {
 	})
 }
 
+func TestOrderTransactionRefund(t *testing.T) {
+	t.Run("Amount", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runOrderTransactionRefund(test, provider, test.Data.firstTransaction, &RefundParams{Amount: 10})
+
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, 10, rsp.Amount)
+		assert.Equal(t, models.RefundTransactionType, rsp.Type)
+		assert.Equal(t, models.PaidState, rsp.Status)
+		require.Len(t, provider.refundCalls, 1)
+		assert.Equal(t, test.Data.firstTransaction.ProcessorID, provider.refundCalls[0].id)
+
+		order := &models.Order{ID: test.Data.firstOrder.ID}
+		require.NoError(t, test.DB.First(order).Error)
+		assert.EqualValues(t, 10, order.TotalRefunded)
+	})
+	t.Run("Hook", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Refund = "https://hooks.example.com/refunds"
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runOrderTransactionRefund(test, provider, test.Data.firstTransaction, &RefundParams{Amount: 10})
+		extractPayload(t, http.StatusOK, w, new(models.Transaction))
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", models.RefundIssuedHook).Find(&hooks).Error)
+		assert.Len(t, hooks, 1)
+
+		provider.refundErr = errors.New("card declined the refund")
+		w = runOrderTransactionRefund(test, provider, test.Data.firstTransaction, &RefundParams{Amount: 10})
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.Equal(t, models.FailedState, rsp.Status)
+		require.NoError(t, test.DB.Where("type = ?", models.RefundIssuedHook).Find(&hooks).Error)
+		assert.Len(t, hooks, 1, "failed refunds aren't announced")
+	})
+	t.Run("LineItems", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+		_, err := models.SeedInventory(test.DB, "", test.Data.firstLineItem.Sku, 5)
+		require.NoError(t, err)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runOrderTransactionRefund(test, provider, test.Data.firstTransaction, &RefundParams{
+			LineItems: []*refundLineItem{{ID: test.Data.firstLineItem.ID, Quantity: 1}},
+		})
+
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, test.Data.firstLineItem.Price, rsp.Amount)
+
+		item := &models.LineItem{ID: test.Data.firstLineItem.ID}
+		require.NoError(t, test.DB.First(item).Error)
+		assert.EqualValues(t, 1, item.RefundedQuantity)
+
+		inventory, err := models.GetInventory(test.DB, "", item.Sku)
+		require.NoError(t, err)
+		assert.EqualValues(t, 6, inventory.Stock)
+	})
+	t.Run("LineItemsWithCoupon", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+		test.Data.firstOrder.Coupon = &models.Coupon{Code: "half-off", Percentage: 50}
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runOrderTransactionRefund(test, provider, test.Data.firstTransaction, &RefundParams{
+			LineItems: []*refundLineItem{{ID: test.Data.firstLineItem.ID, Quantity: 1}},
+		})
+
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, test.Data.firstLineItem.Price/2, rsp.Amount)
+	})
+	t.Run("TooManyItems", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runOrderTransactionRefund(test, provider, test.Data.firstTransaction, &RefundParams{
+			LineItems: []*refundLineItem{{ID: test.Data.firstLineItem.ID, Quantity: 3}},
+		})
+		validateError(t, http.StatusBadRequest, w, "Can't refund 3 of line item")
+		assert.Empty(t, provider.refundCalls)
+	})
+	t.Run("ItemsRefundedMeanwhile", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+		require.NoError(t, err)
+		provider := &memProvider{name: payments.StripeProvider}
+		ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{provider.Name(): provider})
+		a := NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion)
+
+		// the order was loaded before another refund of both items was recorded
+		order := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		item := &models.LineItem{ID: test.Data.firstLineItem.ID}
+		require.NoError(t, test.DB.Model(item).UpdateColumn("refunded_quantity", 2).Error)
+
+		r := httptest.NewRequest(http.MethodPost, "/orders/first-order/transactions/first-trans/refund", nil)
+		_, httpErr := a.refundTransaction(ctx, r, order, test.Data.firstTransaction, test.Data.firstLineItem.Price, map[int64]uint64{item.ID: 1})
+		require.NotNil(t, httpErr)
+		assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+		assert.Empty(t, provider.refundCalls)
+
+		require.NoError(t, test.DB.First(item).Error)
+		assert.EqualValues(t, 2, item.RefundedQuantity)
+	})
+	t.Run("ExceedsBalance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.TotalRefunded = 95
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runOrderTransactionRefund(test, provider, test.Data.firstTransaction, &RefundParams{Amount: 10})
+		validateError(t, http.StatusBadRequest, w, "exceeds the remaining balance")
+		assert.Empty(t, provider.refundCalls)
+	})
+	t.Run("WrongOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/orders/" + test.Data.secondOrder.ID + "/transactions/" + test.Data.firstTransaction.ID + "/refund"
+		w := runPaymentRefund(test, url, &RefundParams{Amount: 1})
+		validateError(t, http.StatusNotFound, w)
+	})
+}
+
+func runOrderTransactionRefund(test *RouteTest, provider payments.Provider, trans *models.Transaction, params *RefundParams) *httptest.ResponseRecorder {
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(test.T, err)
+	ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{provider.Name(): provider})
+
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+	url := "/orders/" + trans.OrderID + "/transactions/" + trans.ID + "/refund"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+	require.NoError(test.T, signHTTPRequest(r, testAdminToken("magical-unicorn", ""), test.Config.JWT.Secret))
+
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion).handler.ServeHTTP(w, r)
+	return w
+}
+
 func runPaymentRefund(test *RouteTest, url string, params interface{}) *httptest.ResponseRecorder {
 	body, err := json.Marshal(params)
 	require.NoError(test.T, err)
@@ -326,6 +472,9 @@ func TestPaymentCreate(t *testing.T) {
 	t.Run("PayPal", func(t *testing.T) {
 		t.Run("Simple", func(t *testing.T) {
 			test := NewRouteTest(t)
+			site := startTestSite()
+			defer site.Close()
+			test.Config.SiteURL = site.URL
 			test.Data.secondOrder.PaymentState = models.PendingState
 			rsp := test.DB.Save(test.Data.secondOrder)
 			require.NoError(t, rsp.Error, "Failed to update order")
@@ -377,8 +526,63 @@ func TestPaymentCreate(t *testing.T) {
 			assert.Equal(t, models.PaidState, trans.Status)
 			assert.Equal(t, 1, loginCount, "too many login calls")
 			assert.Equal(t, 2, paymentCount, "too many payment calls")
+
+			order := &models.Order{}
+			require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+			assert.Equal(t, models.PaidState, order.State)
 		})
 	})
+	t.Run("ExpiredPrices", func(t *testing.T) {
+		test := NewRouteTest(t)
+		expired := time.Now().Add(-time.Minute)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		test.Data.firstOrder.PricesExpireAt = &expired
+		rsp := test.DB.Save(test.Data.firstOrder)
+		require.NoError(t, rsp.Error, "Failed to update order")
+
+		params := &stripePaymentParams{
+			Amount:      test.Data.firstOrder.Total,
+			Currency:    test.Data.firstOrder.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		}
+		body, err := json.Marshal(params)
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "prices for this order expired")
+	})
+	t.Run("AmountMismatch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+		test.Data.firstOrder.PaymentState = models.PendingState
+		rsp := test.DB.Save(test.Data.firstOrder)
+		require.NoError(t, rsp.Error, "Failed to update order")
+
+		params := &stripePaymentParams{
+			Amount:      test.Data.firstOrder.Total - 1,
+			Currency:    test.Data.firstOrder.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		}
+		body, err := json.Marshal(params)
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+
+		payload := &struct {
+			Code int            `json:"code"`
+			Data priceBreakdown `json:"data"`
+		}{}
+		extractPayload(t, http.StatusBadRequest, recorder, payload)
+		assert.Equal(t, test.Data.firstOrder.Total-1, payload.Data.Amount)
+		assert.Equal(t, test.Data.firstOrder.Total, payload.Data.Total)
+		require.Len(t, payload.Data.Items, 1)
+		assert.Equal(t, test.Data.firstLineItem.Sku, payload.Data.Items[0].Sku)
+		assert.Equal(t, test.Data.firstLineItem.Quantity, payload.Data.Items[0].Quantity)
+	})
 	t.Run("Stripe", func(t *testing.T) {
 		callCount := 0
 		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {
@@ -392,9 +596,14 @@ func TestPaymentCreate(t *testing.T) {
 		defer stripe.SetBackend(stripe.APIBackend, nil)
 
 		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
 		test.Data.firstOrder.PaymentState = models.PendingState
 		rsp := test.DB.Save(test.Data.firstOrder)
 		require.NoError(t, rsp.Error, "Failed to update order")
+		_, err := models.SeedInventory(test.DB, "", test.Data.firstLineItem.Sku, 10)
+		require.NoError(t, err)
 
 		params := &stripePaymentParams{
 			Amount:      test.Data.firstOrder.Total,
@@ -412,6 +621,243 @@ func TestPaymentCreate(t *testing.T) {
 		extractPayload(t, http.StatusOK, recorder, &trans)
 		assert.Equal(t, models.PaidState, trans.Status)
 		assert.Equal(t, 1, callCount)
+
+		inventory, err := models.GetInventory(test.DB, "", test.Data.firstLineItem.Sku)
+		require.NoError(t, err)
+		assert.EqualValues(t, 10-test.Data.firstLineItem.Quantity, inventory.Stock)
+	})
+	t.Run("OutOfStock", func(t *testing.T) {
+		callCount := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {
+			callCount++
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		site := startTestSite()
+		defer site.Close()
+
+		setup := func(t *testing.T) *RouteTest {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = site.URL
+			test.Data.firstOrder.PaymentState = models.PendingState
+			require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+			_, err := models.SeedInventory(test.DB, "", test.Data.firstLineItem.Sku, 1)
+			require.NoError(t, err)
+			return test
+		}
+		pay := func(test *RouteTest) *httptest.ResponseRecorder {
+			body, err := json.Marshal(&stripePaymentParams{
+				Amount:      test.Data.firstOrder.Total,
+				Currency:    test.Data.firstOrder.Currency,
+				StripeToken: "123456",
+				Provider:    payments.StripeProvider,
+			})
+			require.NoError(t, err)
+			return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		}
+
+		t.Run("Reject", func(t *testing.T) {
+			test := setup(t)
+			callCount = 0
+			payload := &struct {
+				Data struct {
+					Shortages []stockShortage `json:"shortages"`
+					Options   []string        `json:"options"`
+				} `json:"data"`
+			}{}
+			extractPayload(t, http.StatusConflict, pay(test), payload)
+			assert.Equal(t, []stockShortage{{Sku: test.Data.firstLineItem.Sku, Requested: 2, Available: 1}}, payload.Data.Shortages)
+			assert.NotEmpty(t, payload.Data.Options)
+			assert.Equal(t, 0, callCount)
+
+			order := &models.Order{}
+			require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+			assert.Equal(t, models.PendingState, order.PaymentState)
+			inventory, err := models.GetInventory(test.DB, "", test.Data.firstLineItem.Sku)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, inventory.Stock)
+		})
+
+		t.Run("Backorder", func(t *testing.T) {
+			test := setup(t)
+			test.Config.Inventory.OversellPolicy = oversellBackorder
+			callCount = 0
+			trans := models.Transaction{}
+			extractPayload(t, http.StatusOK, pay(test), &trans)
+			assert.Equal(t, models.PaidState, trans.Status)
+			assert.Equal(t, 1, callCount)
+
+			item := &models.LineItem{}
+			require.NoError(t, test.DB.First(item, test.Data.firstLineItem.ID).Error)
+			assert.EqualValues(t, 1, item.BackorderedQuantity)
+			inventory, err := models.GetInventory(test.DB, "", test.Data.firstLineItem.Sku)
+			require.NoError(t, err)
+			assert.EqualValues(t, -1, inventory.Stock)
+
+			var count int
+			require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, models.EventBackordered).Count(&count).Error)
+			assert.Equal(t, 1, count)
+		})
+	})
+	t.Run("CouponLimits", func(t *testing.T) {
+		callCount := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {
+			callCount++
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		site := startTestSite()
+		defer site.Close()
+
+		setup := func(t *testing.T) *RouteTest {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = site.URL
+			test.Data.firstOrder.PaymentState = models.PendingState
+			test.Data.firstOrder.CouponCode = "limited-code"
+			test.Data.firstOrder.Coupon = &models.Coupon{Code: "limited-code", MaxRedemptions: 2, MaxRedemptionsPerUser: 1}
+			require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+			return test
+		}
+		pay := func(test *RouteTest) *httptest.ResponseRecorder {
+			body, err := json.Marshal(&stripePaymentParams{
+				Amount:      test.Data.firstOrder.Total,
+				Currency:    test.Data.firstOrder.Currency,
+				StripeToken: "123456",
+				Provider:    payments.StripeProvider,
+			})
+			require.NoError(t, err)
+			return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		}
+
+		t.Run("Redeemed", func(t *testing.T) {
+			test := setup(t)
+			callCount = 0
+			trans := models.Transaction{}
+			extractPayload(t, http.StatusOK, pay(test), &trans)
+			assert.Equal(t, 1, callCount)
+
+			total, user, err := models.CouponRedemptions(test.DB, test.Data.firstOrder)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, total)
+			assert.EqualValues(t, 1, user)
+		})
+
+		t.Run("PerUser", func(t *testing.T) {
+			test := setup(t)
+			callCount = 0
+			require.NoError(t, models.RedeemCoupon(test.DB, test.Data.firstOrder))
+			validateError(t, http.StatusConflict, pay(test))
+			assert.Equal(t, 0, callCount)
+
+			order := &models.Order{}
+			require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+			assert.Equal(t, models.PendingState, order.PaymentState)
+			total, _, err := models.CouponRedemptions(test.DB, order)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, total, "the rejected payment isn't counted")
+		})
+
+		t.Run("Total", func(t *testing.T) {
+			test := setup(t)
+			callCount = 0
+			for _, email := range []string{"one@example.com", "two@example.com"} {
+				other := &models.Order{CouponCode: "limited-code", Coupon: test.Data.firstOrder.Coupon, Email: email}
+				require.NoError(t, models.RedeemCoupon(test.DB, other))
+			}
+			other := &models.Order{CouponCode: "limited-code", Coupon: test.Data.firstOrder.Coupon, Email: "three@example.com"}
+			assert.Equal(t, models.ErrCouponExhausted, models.RedeemCoupon(test.DB, other))
+			validateError(t, http.StatusConflict, pay(test))
+			assert.Equal(t, 0, callCount)
+		})
+	})
+	t.Run("StaleTotal", func(t *testing.T) {
+		callCount := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {
+			callCount++
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		site := startTestSite()
+		defer site.Close()
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		price := test.Data.firstOrder.Total
+		stale := price + 500
+		test.Data.firstOrder.PaymentState = models.PendingState
+		test.Data.firstOrder.Total = stale
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		pay := func(amount uint64) *httptest.ResponseRecorder {
+			body, err := json.Marshal(&stripePaymentParams{
+				Amount:      amount,
+				Currency:    test.Data.firstOrder.Currency,
+				StripeToken: "123456",
+				Provider:    payments.StripeProvider,
+			})
+			require.NoError(t, err)
+			return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		}
+
+		payload := &struct {
+			Data priceBreakdown `json:"data"`
+		}{}
+		extractPayload(t, http.StatusConflict, pay(stale), payload)
+		assert.Equal(t, stale, payload.Data.StoredTotal)
+		assert.Equal(t, price, payload.Data.Total)
+		assert.Equal(t, 0, callCount)
+
+		token := testAdminToken("magical-unicorn", "")
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodPost, "/orders/first-order/recalculate", nil, token), order)
+		assert.Equal(t, price, order.Total)
+
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, pay(price), &trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, 1, callCount)
+	})
+	t.Run("PinnedOrderEdited", func(t *testing.T) {
+		callCount := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, body *stripe.RequestValues, params *stripe.Params) {
+			callCount++
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		site := startTestSite()
+		defer site.Close()
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		test.Config.Pricing.QuoteValidity = 30
+		quoted := time.Now().Add(10 * time.Minute)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		test.Data.firstOrder.PricesExpireAt = &quoted
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		oldTotal := test.Data.firstOrder.Total
+
+		token := testAdminToken("magical-unicorn", "")
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{
+			LineItems: []*orderLineItem{{Sku: test.Data.firstLineItem.Sku, Quantity: 1}},
+		}, token), order)
+		assert.Equal(t, test.Data.firstLineItem.Price, order.Total)
+		require.NotNil(t, order.PricesExpireAt)
+		assert.True(t, order.PricesExpireAt.After(quoted), "the new quote is pinned again")
+
+		pay := func(amount uint64) *httptest.ResponseRecorder {
+			body, err := json.Marshal(&stripePaymentParams{
+				Amount:      amount,
+				Currency:    test.Data.firstOrder.Currency,
+				StripeToken: "123456",
+				Provider:    payments.StripeProvider,
+			})
+			require.NoError(t, err)
+			return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		}
+		validateError(t, http.StatusBadRequest, pay(oldTotal), "didn't match amount to charge")
+		assert.Equal(t, 0, callCount)
+
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, pay(order.Total), &trans)
+		assert.Equal(t, order.Total, trans.Amount)
+		assert.Equal(t, 1, callCount)
 	})
 }
 
@@ -474,7 +920,7 @@ func TestPaymentPreauthorize(t *testing.T) {
 
 			require.Len(t, createData.Transactions, 1)
 			assert.Equal(t, "sale", createData.Intent)
-			assert.Equal(t, "10", createData.Transactions[0].Amount.Total)
+			assert.Equal(t, "0.10", createData.Transactions[0].Amount.Total)
 			assert.Equal(t, "USD", createData.Transactions[0].Amount.Currency)
 			assert.Equal(t, "test", createData.Transactions[0].Description)
 		})
@@ -513,7 +959,7 @@ func TestPaymentPreauthorize(t *testing.T) {
 
 			require.Len(t, createData.Transactions, 1)
 			assert.Equal(t, "sale", createData.Intent)
-			assert.Equal(t, "10", createData.Transactions[0].Amount.Total)
+			assert.Equal(t, "0.10", createData.Transactions[0].Amount.Total)
 			assert.Equal(t, "USD", createData.Transactions[0].Amount.Currency)
 			assert.Equal(t, "test", createData.Transactions[0].Description)
 		})
@@ -592,6 +1038,7 @@ type paypalPaymentCreateParams struct {
 
 type memProvider struct {
 	refundCalls []refundCall
+	refundErr   error
 	name        string
 }
 
@@ -627,6 +1074,9 @@ func (mp *memProvider) refund(transactionID string, amount uint64, currency stri
 		id:       transactionID,
 		currency: currency,
 	})
+	if mp.refundErr != nil {
+		return "", mp.refundErr
+	}
 
 	return fmt.Sprintf("trans-%d", len(mp.refundCalls)), nil
 }
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/netlify/gocommerce/payments/paypal"
+)
+
+// paypalVerifyWebhook verifies the signature of a PayPal event with PayPal.
+var paypalVerifyWebhook = paypal.VerifyWebhook
+
+type paypalWebhookEvent struct {
+	ID        string                 `json:"id"`
+	EventType string                 `json:"event_type"`
+	Resource  *paypalWebhookResource `json:"resource"`
+}
+
+// paypalWebhookResource has the fields of the sales, refunds and disputes
+// that PayPal events are about.
+type paypalWebhookResource struct {
+	ID            string `json:"id"`
+	ParentPayment string `json:"parent_payment"`
+	SaleID        string `json:"sale_id"`
+	Amount        *struct {
+		Total    string `json:"total"`
+		Currency string `json:"currency"`
+	} `json:"amount"`
+
+	DisputeID            string `json:"dispute_id"`
+	Reason               string `json:"reason"`
+	DisputedTransactions []struct {
+		SellerTransactionID string `json:"seller_transaction_id"`
+	} `json:"disputed_transactions"`
+}
+
+// PayPalWebhook receives the events PayPal sends to the webhook configured
+// with the webhook ID. Events are verified with PayPal, and keep the
+// transactions of orders paid with PayPal in sync.
+func (a *API) PayPalWebhook(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	log := getLogEntry(r)
+
+	webhookID := config.Payment.PayPal.WebhookID
+	if webhookID == "" {
+		return notFoundError("PayPal webhooks are not configured")
+	}
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+	if err != nil {
+		return badRequestError("Could not read webhook: %v", err)
+	}
+	event := &paypalWebhookEvent{}
+	if err := json.Unmarshal(payload, event); err != nil || event.Resource == nil {
+		return badRequestError("Invalid webhook: %v", err)
+	}
+	paypalConfig := paypal.Config{
+		Env:      config.Payment.PayPal.Env,
+		ClientID: config.Payment.PayPal.ClientID,
+		Secret:   config.Payment.PayPal.Secret,
+	}
+	if err := paypalVerifyWebhook(paypalConfig, webhookID, r.Header, payload); err != nil {
+		return badRequestError("Invalid webhook: %v", err)
+	}
+
+	log = log.WithField("paypal_event", event.ID)
+	resource := event.Resource
+	var httpErr *HTTPError
+	switch event.EventType {
+	case "PAYMENT.SALE.COMPLETED":
+		httpErr = a.applyPaymentEvent(r, payments.PayPalProvider, &paymentEvent{
+			Type:      chargeSucceededEvent,
+			ChargeIDs: []string{resource.ParentPayment, resource.ID},
+		})
+	case "PAYMENT.SALE.DENIED":
+		httpErr = a.applyPaymentEvent(r, payments.PayPalProvider, &paymentEvent{
+			Type:               chargeFailedEvent,
+			ChargeIDs:          []string{resource.ParentPayment, resource.ID},
+			FailureCode:        "denied",
+			FailureDescription: "The payment was denied by PayPal",
+		})
+	case "PAYMENT.SALE.REFUNDED":
+		var amount uint64
+		if resource.Amount != nil {
+			var err error
+			amount, err = calculator.ParseAmount(resource.Amount.Total, resource.Amount.Currency)
+			if err != nil {
+				return badRequestError("Invalid refund amount: %v", err)
+			}
+		}
+		httpErr = a.applyPaymentEvent(r, payments.PayPalProvider, &paymentEvent{
+			Type:      refundCompletedEvent,
+			ChargeIDs: []string{resource.ParentPayment, resource.SaleID},
+			RefundID:  resource.ID,
+			Amount:    amount,
+		})
+	case "CUSTOMER.DISPUTE.CREATED":
+		chargeIDs := []string{}
+		for _, t := range resource.DisputedTransactions {
+			chargeIDs = append(chargeIDs, t.SellerTransactionID)
+		}
+		httpErr = a.applyPaymentEvent(r, payments.PayPalProvider, &paymentEvent{
+			Type:          disputeOpenedEvent,
+			ChargeIDs:     chargeIDs,
+			DisputeID:     resource.DisputeID,
+			DisputeReason: resource.Reason,
+		})
+	default:
+		log.Debugf("Ignoring PayPal event %v", event.EventType)
+	}
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
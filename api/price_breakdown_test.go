@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestLineItemPriceBreakdown(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+	coupons := startTestCouponURLs()
+	defer coupons.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = site.URL
+	test.Config.Coupons.URL = coupons.URL
+
+	expected := &calculator.ItemPrice{
+		Quantity:         2,
+		Subtotal:         999,
+		Discount:         150,
+		Taxes:            70,
+		Total:            919,
+		Net:              849,
+		Gross:            919,
+		LineNet:          1698,
+		LineGross:        1838,
+		AppliedTaxes:     []*calculator.AppliedTax{{Name: "taxes[1]", Percentage: 7, Amount: 70}},
+		AppliedDiscounts: []*calculator.AppliedDiscount{{Type: calculator.CouponAdjustment, Name: "coupon-code", Percentage: 15, Amount: 150}},
+	}
+	request := `{
+		"email": "info@example.com",
+		"coupon": "coupon-code",
+		"shipping_address": {"name": "Test", "address1": "Street 1", "city": "Berlin", "zip": "10115", "country": "Germany"},
+		"line_items": [{"path": "/simple-product", "quantity": 2}]
+	}`
+
+	t.Run("Preview", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", strings.NewReader(request), test.Data.testUserToken)
+		preview := &orderPreview{}
+		extractPayload(t, http.StatusOK, recorder, preview)
+		require.Len(t, preview.Price.Items, 1)
+		assert.Equal(t, *expected, preview.Price.Items[0])
+		require.Len(t, preview.LineItems, 1)
+		assert.Equal(t, expected, preview.LineItems[0].PriceBreakdown)
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(request), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, expected, order.LineItems[0].PriceBreakdown)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+order.ID, nil, test.Data.testUserToken)
+		saved := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, saved)
+		require.Len(t, saved.LineItems, 1)
+		assert.Equal(t, expected, saved.LineItems[0].PriceBreakdown, "the breakdown is kept with the order")
+	})
+}
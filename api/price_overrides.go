@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// PriceOverrideParams holds the parameters for a manual discount on an order.
+type PriceOverrideParams struct {
+	Discount uint64 `json:"discount"`
+	Reason   string `json:"reason"`
+}
+
+// PriceOverrideList lists the price overrides requested for an order. It is
+// only available to admins.
+func (a *API) PriceOverrideList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	orderID := gcontext.GetOrderID(ctx)
+
+	overrides := []models.PriceOverride{}
+	if rsp := a.db.Where("order_id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx)).Order("created_at asc").Find(&overrides); rsp.Error != nil && !rsp.RecordNotFound() {
+		return internalServerError("Error while querying for price overrides").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, overrides)
+}
+
+// PriceOverrideCreate gives a manual discount on an unpaid order, replacing any
+// earlier one. Discounts above the approval threshold of the instance are
+// pending until a second admin approves them. It is only available to admins.
+func (a *API) PriceOverrideCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+	log := getLogEntry(r)
+
+	params := &PriceOverrideParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if strings.TrimSpace(params.Reason) == "" {
+		return badRequestError("A price override requires a reason")
+	}
+
+	order, httpErr := getUnpaidOrder(a.db, gcontext.GetInstanceID(ctx), gcontext.GetOrderID(ctx))
+	if httpErr != nil {
+		return httpErr
+	}
+
+	override := &models.PriceOverride{
+		InstanceID:  order.InstanceID,
+		ID:          uuid.NewRandom().String(),
+		OrderID:     order.ID,
+		Discount:    params.Discount,
+		Currency:    order.Currency,
+		Reason:      params.Reason,
+		Status:      models.PendingState,
+		RequestedBy: claims.Subject,
+	}
+
+	tx := a.db.Begin()
+	threshold := config.Pricing.OverrideApprovalThreshold
+	if threshold == 0 || params.Discount <= threshold {
+		if httpErr := applyPriceOverride(tx, r, order, override, claims.Subject); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+	} else {
+		log.Infof("Price override of %d on order %s needs approval", override.Discount, order.ID)
+	}
+
+	if rsp := tx.Create(override); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving price override").WithInternalError(rsp.Error)
+	}
+	tx.Commit()
+
+	return sendJSON(w, http.StatusCreated, override)
+}
+
+// PriceOverrideApprove applies a pending price override. It must be approved by
+// another admin than the one who requested it.
+func (a *API) PriceOverrideApprove(w http.ResponseWriter, r *http.Request) error {
+	return a.reviewPriceOverride(w, r, true)
+}
+
+// PriceOverrideReject turns down a pending price override.
+func (a *API) PriceOverrideReject(w http.ResponseWriter, r *http.Request) error {
+	return a.reviewPriceOverride(w, r, false)
+}
+
+func (a *API) reviewPriceOverride(w http.ResponseWriter, r *http.Request, approve bool) error {
+	ctx := r.Context()
+	claims := gcontext.GetClaims(ctx)
+
+	tx := a.db.Begin()
+	override, httpErr := reviewPriceOverrideAs(tx, r, gcontext.GetOrderID(ctx), chi.URLParam(r, "override_id"), claims.Subject, approve)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	tx.Commit()
+
+	return sendJSON(w, http.StatusOK, override)
+}
+
+// reviewPriceOverrideAs approves or rejects a pending price override on behalf
+// of an admin.
+func reviewPriceOverrideAs(tx *gorm.DB, r *http.Request, orderID, overrideID, reviewer string, approve bool) (*models.PriceOverride, *HTTPError) {
+	override := &models.PriceOverride{}
+	if rsp := tx.Where("order_id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(r.Context())).First(override, "id = ?", overrideID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("Price override not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if override.Status != models.PendingState {
+		return nil, badRequestError("The price override is already %s", override.Status)
+	}
+	if override.RequestedBy == reviewer {
+		return nil, badRequestError("A price override must be reviewed by another admin")
+	}
+
+	now := time.Now()
+	override.ReviewedBy = reviewer
+	override.ReviewedAt = &now
+	override.Status = models.RejectedState
+	if approve {
+		order, httpErr := getUnpaidOrder(tx, gcontext.GetInstanceID(r.Context()), orderID)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		if httpErr := applyPriceOverride(tx, r, order, override, reviewer); httpErr != nil {
+			return nil, httpErr
+		}
+	}
+
+	if rsp := tx.Save(override); rsp.Error != nil {
+		return nil, internalServerError("Error saving price override").WithInternalError(rsp.Error)
+	}
+	return override, nil
+}
+
+func getUnpaidOrder(db *gorm.DB, instanceID, orderID string) (*models.Order, *HTTPError) {
+	order := &models.Order{}
+	if rsp := db.First(order, "id = ? AND instance_id = ?", orderID, instanceID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if order.PaymentState != models.PendingState {
+		return nil, badRequestError("Prices can only be overridden on unpaid orders")
+	}
+	return order, nil
+}
+
+// applyPriceOverride sets the discount of the override as the manual discount of
+// the order and records the change in the order's events.
+func applyPriceOverride(tx *gorm.DB, r *http.Request, order *models.Order, override *models.PriceOverride, adminID string) *HTTPError {
+	if !order.SetManualDiscount(override.Discount) {
+		return badRequestError("The discount of %d is more than the order total of %d", override.Discount, order.Total+order.ManualDiscount)
+	}
+
+	rsp := tx.Model(order).UpdateColumns(map[string]interface{}{
+		"manual_discount": order.ManualDiscount,
+		"discount":        order.Discount,
+		"total":           order.Total,
+		"raw_adjustments": order.RawAdjustments,
+	})
+	if rsp.Error != nil {
+		return internalServerError("Error saving order").WithInternalError(rsp.Error)
+	}
+
+	override.Status = models.ApprovedState
+	models.LogEvent(tx, r.RemoteAddr, adminID, order.ID, models.EventUpdated, []string{"manual_discount"})
+	return nil
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestPriceOverrideCreate(t *testing.T) {
+	t.Run("Applied", func(t *testing.T) {
+		test := newPriceOverrideTest(t)
+		w := runPriceOverride(test, "", &PriceOverrideParams{Discount: 4, Reason: "Damaged packaging"}, "admin-1")
+
+		override := new(models.PriceOverride)
+		extractPayload(t, http.StatusCreated, w, override)
+		assert.Equal(t, models.ApprovedState, override.Status)
+		assert.Equal(t, "admin-1", override.RequestedBy)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.EqualValues(t, 4, order.ManualDiscount)
+		assert.Equal(t, test.Data.firstOrder.Discount+4, order.Discount)
+		assert.Equal(t, test.Data.firstOrder.Total-4, order.Total)
+		require.NotEmpty(t, order.Adjustments)
+		assert.Equal(t, &calculator.Adjustment{Type: calculator.ManualDiscountAdjustment, Amount: 4}, order.Adjustments[len(order.Adjustments)-1])
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.First(event, "order_id = ? AND changes = ?", order.ID, "manual_discount").Error)
+		assert.Equal(t, "admin-1", event.UserID)
+	})
+	t.Run("Replaced", func(t *testing.T) {
+		test := newPriceOverrideTest(t)
+		w := runPriceOverride(test, "", &PriceOverrideParams{Discount: 4, Reason: "Damaged packaging"}, "admin-1")
+		require.Equal(t, http.StatusCreated, w.Code)
+		w = runPriceOverride(test, "", &PriceOverrideParams{Discount: 2, Reason: "Only a small dent"}, "admin-1")
+		require.Equal(t, http.StatusCreated, w.Code)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.EqualValues(t, 2, order.ManualDiscount)
+		assert.Equal(t, test.Data.firstOrder.Total-2, order.Total)
+		assert.Equal(t, []*calculator.Adjustment{{Type: calculator.ManualDiscountAdjustment, Amount: 2}}, order.Adjustments)
+	})
+	t.Run("NeedsApproval", func(t *testing.T) {
+		test := newPriceOverrideTest(t)
+		test.Config.Pricing.OverrideApprovalThreshold = 5
+		w := runPriceOverride(test, "", &PriceOverrideParams{Discount: 10, Reason: "Loyal customer"}, "admin-1")
+
+		override := new(models.PriceOverride)
+		extractPayload(t, http.StatusCreated, w, override)
+		assert.Equal(t, models.PendingState, override.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, test.Data.firstOrder.Total, order.Total)
+
+		w = runPriceOverride(test, "/"+override.ID+"/approve", nil, "admin-1")
+		validateError(t, http.StatusBadRequest, w, "another admin")
+
+		w = runPriceOverride(test, "/"+override.ID+"/approve", nil, "admin-2")
+		extractPayload(t, http.StatusOK, w, override)
+		assert.Equal(t, models.ApprovedState, override.Status)
+		assert.Equal(t, "admin-2", override.ReviewedBy)
+
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.EqualValues(t, 10, order.ManualDiscount)
+		assert.Equal(t, test.Data.firstOrder.Total-10, order.Total)
+
+		w = runPriceOverride(test, "/"+override.ID+"/reject", nil, "admin-2")
+		validateError(t, http.StatusBadRequest, w, "already approved")
+	})
+	t.Run("Rejected", func(t *testing.T) {
+		test := newPriceOverrideTest(t)
+		test.Config.Pricing.OverrideApprovalThreshold = 5
+		w := runPriceOverride(test, "", &PriceOverrideParams{Discount: 10, Reason: "Loyal customer"}, "admin-1")
+		override := new(models.PriceOverride)
+		extractPayload(t, http.StatusCreated, w, override)
+
+		w = runPriceOverride(test, "/"+override.ID+"/reject", nil, "admin-2")
+		extractPayload(t, http.StatusOK, w, override)
+		assert.Equal(t, models.RejectedState, override.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Zero(t, order.ManualDiscount)
+		assert.Equal(t, test.Data.firstOrder.Total, order.Total)
+	})
+	t.Run("PaidOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		w := runPriceOverride(test, "", &PriceOverrideParams{Discount: 4, Reason: "Too late"}, "admin-1")
+		validateError(t, http.StatusBadRequest, w, "unpaid orders")
+	})
+	t.Run("MissingReason", func(t *testing.T) {
+		test := newPriceOverrideTest(t)
+		w := runPriceOverride(test, "", &PriceOverrideParams{Discount: 4}, "admin-1")
+		validateError(t, http.StatusBadRequest, w, "requires a reason")
+	})
+	t.Run("MoreThanTotal", func(t *testing.T) {
+		test := newPriceOverrideTest(t)
+		w := runPriceOverride(test, "", &PriceOverrideParams{Discount: test.Data.firstOrder.Total + 1, Reason: "Generous"}, "admin-1")
+		validateError(t, http.StatusBadRequest, w, "more than the order total")
+	})
+	t.Run("NotWithAdminRights", func(t *testing.T) {
+		test := newPriceOverrideTest(t)
+		body, err := json.Marshal(&PriceOverrideParams{Discount: 4, Reason: "Because"})
+		require.NoError(t, err)
+		url := "/orders/" + test.Data.firstOrder.ID + "/price-overrides"
+		w := test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, w)
+	})
+}
+
+func newPriceOverrideTest(t *testing.T) *RouteTest {
+	test := NewRouteTest(t)
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("payment_state", models.PendingState).Error)
+	return test
+}
+
+func runPriceOverride(test *RouteTest, path string, params interface{}, adminID string) *httptest.ResponseRecorder {
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+	url := "/orders/" + test.Data.firstOrder.ID + "/price-overrides" + path
+	return test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), testAdminToken(adminID, ""))
+}
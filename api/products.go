@@ -0,0 +1,304 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/breaker"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/tracing"
+)
+
+// ProductCachePurge removes the cached metadata of all products of the
+// instance, or of the product page given by the path parameter.
+func (a *API) ProductCachePurge(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	namespace := productCacheNamespace(ctx)
+
+	var err error
+	if path := r.URL.Query().Get("path"); path != "" {
+		err = a.products.Delete(namespace, config.SiteURL+path)
+	} else {
+		err = a.products.Purge(namespace)
+	}
+	if err != nil {
+		return internalServerError("Error purging the product cache").WithInternalError(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func productCacheNamespace(ctx context.Context) string {
+	return "products:" + gcontext.GetInstanceID(ctx)
+}
+
+// loadProductMetadata returns the metadata of the products on a page of the
+// site. With a product cache TTL configured, the parsed metadata is cached
+// for that many seconds. A failing cache never fails the lookup.
+func (a *API) loadProductMetadata(ctx context.Context, path string) ([]*models.LineItemMetadata, error) {
+	config := gcontext.GetConfig(ctx)
+	log := logrus.WithFields(logrus.Fields{
+		"component":   "product_cache",
+		"instance_id": gcontext.GetInstanceID(ctx),
+	})
+	url := config.SiteURL + path
+	ttl := time.Duration(config.ProductCache.TTL) * time.Second
+	namespace := productCacheNamespace(ctx)
+
+	if ttl > 0 {
+		data, found, err := a.products.Get(namespace, url)
+		if err != nil {
+			log.WithError(err).Warn("Failed to read the product cache")
+		}
+		if found {
+			metaProducts := []*models.LineItemMetadata{}
+			if err := json.Unmarshal(data, &metaProducts); err == nil {
+				return metaProducts, nil
+			}
+		}
+	}
+
+	metaProducts, err := a.fetchNearestProductMetadata(ctx, path, log)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		data, err := json.Marshal(metaProducts)
+		if err == nil {
+			err = a.products.Set(namespace, url, data, ttl)
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed to write the product cache")
+		}
+	}
+	return metaProducts, nil
+}
+
+// fetchNearestProductMetadata fetches a product page from the product origin
+// of the region of this process, and from the site itself when there is no
+// such origin or it fails.
+func (a *API) fetchNearestProductMetadata(ctx context.Context, path string, log logrus.FieldLogger) ([]*models.LineItemMetadata, error) {
+	config := gcontext.GetConfig(ctx)
+	if region := a.config.Region.Name; region != "" && config.ProductOrigins[region] != "" {
+		origin := config.ProductOrigins[region]
+		metaProducts, err := a.fetchOriginProductMetadata(ctx, origin, path, log)
+		if err == nil {
+			return metaProducts, nil
+		}
+		log.WithError(err).WithField("origin", origin).Warn("Falling back to the site for product metadata")
+	}
+	return a.fetchOriginProductMetadata(ctx, config.SiteURL, path, log)
+}
+
+// fetchOriginProductMetadata fetches the metadata of the products on a page
+// from the products index of an origin, then from the JSON file of the page,
+// and then from the page itself, skipping the ones that aren't set up or
+// don't have the page.
+func (a *API) fetchOriginProductMetadata(ctx context.Context, origin, path string, log logrus.FieldLogger) ([]*models.LineItemMetadata, error) {
+	config := gcontext.GetConfig(ctx)
+	if config.Products.Index != "" {
+		metaProducts, err := a.fetchIndexedProductMetadata(ctx, origin+config.Products.Index, path, log)
+		if err == nil {
+			return metaProducts, nil
+		}
+		if _, ok := err.(*productNotFoundError); !ok {
+			return nil, err
+		}
+	}
+	if config.Products.JSON {
+		metaProducts, err := a.fetchProductMetadata(ctx, origin+productJSONPath(path))
+		if err == nil {
+			return metaProducts, nil
+		}
+		if _, ok := err.(*productNotFoundError); !ok {
+			return nil, err
+		}
+		log.WithField("path", path).Debug("No product JSON file, falling back to the product page")
+	}
+	return a.fetchProductMetadata(ctx, origin+path)
+}
+
+// productJSONPath returns the path of the JSON file with the metadata of the
+// products on a page.
+func productJSONPath(path string) string {
+	if strings.HasSuffix(path, "/") {
+		return path + "index.json"
+	}
+	return strings.TrimSuffix(path, ".html") + ".json"
+}
+
+// fetchIndexedProductMetadata looks up the metadata of the products on a page
+// in the products index. The index is cached like product pages.
+func (a *API) fetchIndexedProductMetadata(ctx context.Context, url, path string, log logrus.FieldLogger) ([]*models.LineItemMetadata, error) {
+	config := gcontext.GetConfig(ctx)
+	ttl := time.Duration(config.ProductCache.TTL) * time.Second
+	namespace := productCacheNamespace(ctx)
+
+	var data []byte
+	found := false
+	if ttl > 0 {
+		var err error
+		data, found, err = a.products.Get(namespace, url)
+		if err != nil {
+			log.WithError(err).Warn("Failed to read the product cache")
+		}
+	}
+	if !found {
+		resp, err := a.getProductURL(ctx, url, "application/json")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, &productNotFoundError{fmt.Sprintf("No products index found at '%v': %v", url, resp.Status)}
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			if err := a.products.Set(namespace, url, data, ttl); err != nil {
+				log.WithError(err).Warn("Failed to write the product cache")
+			}
+		}
+	}
+
+	index := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("Error parsing products index: %v", err)
+	}
+	entry, ok := index[path]
+	if !ok {
+		return nil, &productNotFoundError{fmt.Sprintf("No product for '%v' in the products index", path)}
+	}
+	return decodeProductMetadata(entry)
+}
+
+// decodeProductMetadata parses JSON product metadata, which is either the
+// metadata of one product or a list of them.
+func decodeProductMetadata(data []byte) ([]*models.LineItemMetadata, error) {
+	metaProducts := []*models.LineItemMetadata{}
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &metaProducts)
+	} else {
+		meta := &models.LineItemMetadata{}
+		err = json.Unmarshal(trimmed, meta)
+		metaProducts = append(metaProducts, meta)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing product metadata: %v", err)
+	}
+	return metaProducts, nil
+}
+
+// productNotFoundError is a page without the product metadata that was asked
+// for.
+type productNotFoundError struct {
+	message string
+}
+
+func (e *productNotFoundError) Error() string {
+	return e.message
+}
+
+// fetchProductMetadata fetches the metadata of the products on a page. JSON
+// is asked for first, and HTML pages are scraped for script tags with the
+// gocommerce-product class.
+func (a *API) fetchProductMetadata(ctx context.Context, url string) ([]*models.LineItemMetadata, error) {
+	resp, err := a.getProductURL(ctx, url, "application/json, text/html;q=0.9")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &productNotFoundError{fmt.Sprintf("No product metadata found for '%v'", url)}
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return decodeProductMetadata(data)
+	}
+
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	metaTag := doc.Find(".gocommerce-product")
+	if metaTag.Length() == 0 {
+		return nil, &productNotFoundError{fmt.Sprintf("No script tag with class gocommerce-product tag found for '%v'", url)}
+	}
+	metaProducts := []*models.LineItemMetadata{}
+	var parsingErr error
+	metaTag.EachWithBreak(func(_ int, tag *goquery.Selection) bool {
+		meta := &models.LineItemMetadata{}
+		parsingErr = json.Unmarshal([]byte(tag.Text()), meta)
+		if parsingErr != nil {
+			return false
+		}
+		metaProducts = append(metaProducts, meta)
+		return true
+	})
+	if parsingErr != nil {
+		return nil, fmt.Errorf("Error parsing product metadata: %v", parsingErr)
+	}
+	return metaProducts, nil
+}
+
+// getProductURL fetches a URL of the site through its circuit breaker. Server
+// errors count as failures of the site.
+func (a *API) getProductURL(ctx context.Context, url, accept string) (*http.Response, error) {
+	span, _ := tracing.StartSpan(ctx, "site.fetch_product")
+	span.SetTag("url", url)
+	defer span.Finish()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(tracing.Header, span.TraceID)
+	req.Header.Set("Accept", accept)
+
+	var resp *http.Response
+	var canceled error
+	err = breaker.Get(breaker.Site, siteOrigin(url)).Do(func() error {
+		var err error
+		resp, err = a.httpClient.Do(req.WithContext(ctx))
+		if err != nil && ctx.Err() != nil {
+			// canceled requests say nothing about the site
+			canceled = ctx.Err()
+			return nil
+		}
+		if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			return fmt.Errorf("Error fetching '%v': %v", url, resp.Status)
+		}
+		return err
+	})
+	if err == nil {
+		err = canceled
+	}
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProductCache(t *testing.T) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cached-product" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprintln(w, `<!doctype html>
+			<html>
+			<body>
+				<script class="gocommerce-product">
+				{"sku": "cached-1", "title": "Cached", "prices": [{"amount": "1.00", "currency": "USD"}]}
+				</script>
+			</body>
+			</html>`)
+	}))
+	defer server.Close()
+
+	// The cache lives in the API, so all requests of a test go to the same one.
+	serve := func(test *RouteTest, api *API, method, url string, body io.Reader, token *jwt.Token) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(method, baseURL+url, body)
+		require.NoError(t, signHTTPRequest(req, token, test.Config.JWT.Secret))
+		api.handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	newAPI := func(test *RouteTest) *API {
+		ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+		require.NoError(t, err)
+		return NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "")
+	}
+	order := func(test *RouteTest, api *API) {
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/cached-product", "quantity": 1}]
+		}`)
+		recorder := serve(test, api, http.MethodPost, "/orders", body, test.Data.testUserToken)
+		require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		api := newAPI(test)
+		order(test, api)
+		order(test, api)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&fetches))
+	})
+	t.Run("Cached", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.ProductCache.TTL = 60
+		api := newAPI(test)
+		order(test, api)
+		order(test, api)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&fetches))
+	})
+	t.Run("Purge", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.ProductCache.TTL = 60
+		token := testAdminToken("magical-unicorn", "")
+		api := newAPI(test)
+		order(test, api)
+
+		recorder := serve(test, api, http.MethodDelete, "/cache/products?path=/other-product", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+		order(test, api)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&fetches))
+
+		recorder = serve(test, api, http.MethodDelete, "/cache/products?path=/cached-product", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+		order(test, api)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&fetches))
+
+		recorder = serve(test, api, http.MethodDelete, "/cache/products", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+		order(test, api)
+		assert.EqualValues(t, 3, atomic.LoadInt32(&fetches))
+	})
+	t.Run("NotWithAdminRights", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodDelete, "/cache/products", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestProductJSON(t *testing.T) {
+	var pageFetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		product := func(sku string) string {
+			return `{"sku": "` + sku + `", "title": "` + sku + `", "prices": [{"amount": "1.00", "currency": "USD"}]}`
+		}
+		switch r.URL.Path {
+		case "/negotiated":
+			if strings.HasPrefix(r.Header.Get("Accept"), "application/json") {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, product("negotiated-1"))
+				return
+			}
+		case "/book.json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			fmt.Fprint(w, "["+product("book-1")+", "+product("book-2")+"]")
+			return
+		case "/book", "/legacy":
+			atomic.AddInt32(&pageFetches, 1)
+			fmt.Fprint(w, `<html><body><script class="gocommerce-product">`+product(strings.TrimPrefix(r.URL.Path, "/")+"-1")+`</script></body></html>`)
+			return
+		case "/products.json":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"/indexed/": `+product("indexed-1")+`}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	order := func(test *RouteTest, path, sku string) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "` + path + `", "sku": "` + sku + `", "quantity": 1}]
+		}`)
+		return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+	}
+
+	t.Run("ContentNegotiation", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := order(test, "/negotiated", "negotiated-1")
+		assert.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+	})
+	t.Run("JSONFile", func(t *testing.T) {
+		atomic.StoreInt32(&pageFetches, 0)
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Products.JSON = true
+		recorder := order(test, "/book", "book-2")
+		assert.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+		assert.EqualValues(t, 0, atomic.LoadInt32(&pageFetches))
+
+		recorder = order(test, "/legacy", "legacy-1")
+		assert.Equal(t, http.StatusCreated, recorder.Code, "pages without a JSON file are scraped")
+		assert.EqualValues(t, 1, atomic.LoadInt32(&pageFetches))
+	})
+	t.Run("Index", func(t *testing.T) {
+		atomic.StoreInt32(&pageFetches, 0)
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Products.Index = "/products.json"
+		recorder := order(test, "/indexed/", "indexed-1")
+		assert.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+
+		recorder = order(test, "/legacy", "legacy-1")
+		assert.Equal(t, http.StatusCreated, recorder.Code, "pages missing from the index are scraped")
+		assert.EqualValues(t, 1, atomic.LoadInt32(&pageFetches))
+
+		validateError(t, http.StatusBadRequest, order(test, "/missing", "missing-1"))
+	})
+}
+
+func TestProductJSONPath(t *testing.T) {
+	assert.Equal(t, "/products/book.json", productJSONPath("/products/book"))
+	assert.Equal(t, "/products/book.json", productJSONPath("/products/book.html"))
+	assert.Equal(t, "/products/book/index.json", productJSONPath("/products/book/"))
+}
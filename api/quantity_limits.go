@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// checkQuantityLimits enforces the purchase limits of the products of a new
+// order. The quantities of line items with the same SKU are added up, and
+// products sold once per customer are checked against the paid orders of
+// the user, or of the email of anonymous orders.
+func (a *API) checkQuantityLimits(tx *gorm.DB, order *models.Order) *HTTPError {
+	skus := []string{}
+	quantities := map[string]uint64{}
+	limits := map[string]*models.LineItem{}
+	for _, item := range order.LineItems {
+		if item.ManualPrice || item.Gift {
+			continue
+		}
+		if _, ok := limits[item.Sku]; !ok {
+			skus = append(skus, item.Sku)
+			limits[item.Sku] = item
+		}
+		quantities[item.Sku] += item.Quantity
+	}
+
+	failed := map[string]string{}
+	for _, sku := range skus {
+		item, quantity := limits[sku], quantities[sku]
+		switch {
+		case item.MinQuantity > 0 && quantity < item.MinQuantity:
+			failed[sku] = fmt.Sprintf("min_quantity: at least %d must be ordered", item.MinQuantity)
+		case item.MaxQuantity > 0 && quantity > item.MaxQuantity:
+			failed[sku] = fmt.Sprintf("max_quantity: at most %d can be ordered", item.MaxQuantity)
+		case item.OnePerCustomer && quantity > 1:
+			failed[sku] = "one_per_customer: only 1 can be ordered"
+		case item.OnePerCustomer:
+			bought, err := boughtBefore(tx, order, sku)
+			if err != nil {
+				return internalServerError("Error checking previous orders").WithInternalError(err)
+			}
+			if bought {
+				failed[sku] = "one_per_customer: already bought in a previous order"
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return unprocessableEntityError("Quantity limits of the products exceeded").WithData(failed)
+	}
+	return nil
+}
+
+// checkOnePerCustomer checks again, when an order is paid, that its customer
+// didn't pay for the products sold once per customer in another order since
+// it was created. The other orders of the customer with those products are
+// locked, so only one of them can be paid at a time.
+func checkOnePerCustomer(tx *gorm.DB, order *models.Order) *HTTPError {
+	failed := map[string]string{}
+	for _, item := range order.LineItems {
+		if !item.OnePerCustomer || item.ManualPrice || item.Gift {
+			continue
+		}
+		bought, err := boughtBefore(models.ForUpdate(tx), order, item.Sku)
+		if err != nil {
+			return internalServerError("Error checking previous orders").WithInternalError(err)
+		}
+		if bought {
+			failed[item.Sku] = "one_per_customer: already bought in a previous order"
+		}
+	}
+	if len(failed) > 0 {
+		return unprocessableEntityError("Quantity limits of the products exceeded").WithData(failed)
+	}
+	return nil
+}
+
+// boughtBefore tells whether the customer of an order paid for a SKU in
+// another order. Customers are the user of the order, or its normalized
+// email for anonymous orders. The orders are read whatever their payment
+// state, so a locking query also locks the ones being paid.
+func boughtBefore(tx *gorm.DB, order *models.Order, sku string) (bool, error) {
+	if order.UserID == "" && order.Email == "" {
+		return false, nil
+	}
+	orderTable := tx.NewScope(models.Order{}).QuotedTableName()
+	itemTable := tx.NewScope(models.LineItem{}).QuotedTableName()
+
+	query := tx.Model(&models.LineItem{}).
+		Joins("JOIN "+orderTable+" ON "+orderTable+".id = "+itemTable+".order_id").
+		Where(orderTable+".instance_id = ? AND "+orderTable+".deleted_at IS NULL", order.InstanceID).
+		Where(orderTable+".id != ? AND "+itemTable+".sku = ?", order.ID, sku)
+	if order.UserID != "" {
+		query = query.Where(orderTable+".user_id = ?", order.UserID)
+	} else {
+		query = query.Where(orderTable+".normalized_email = ?", models.NormalizeEmail(order.Email))
+	}
+
+	states := []string{}
+	if rsp := query.Order(orderTable+".id").Pluck(orderTable+".payment_state", &states); rsp.Error != nil {
+		return false, rsp.Error
+	}
+	for _, state := range states {
+		if state == models.PaidState {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestOrderCreateQuantityLimits(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	create := func(test *RouteTest, token *jwt.Token, items string) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{
+			"email": "bruce@wayneindustries.com",
+			"shipping_address_id": "first-address",
+			"line_items": ` + items + `
+		}`)
+		return test.TestEndpoint(http.MethodPost, "/orders", body, token)
+	}
+	limitError := func(t *testing.T, recorder *httptest.ResponseRecorder, sku, message string) {
+		payload := &struct {
+			Msg  string            `json:"msg"`
+			Data map[string]string `json:"data"`
+		}{}
+		extractPayload(t, http.StatusUnprocessableEntity, recorder, payload)
+		assert.Equal(t, "Quantity limits of the products exceeded", payload.Msg)
+		assert.Equal(t, map[string]string{sku: message}, payload.Data)
+	}
+
+	t.Run("MinAndMax", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		token := test.Data.testUserToken
+
+		rsp := create(test, token, `[{"path": "/purchase-limits-product", "sku": "limited-1", "quantity": 1}]`)
+		limitError(t, rsp, "limited-1", "min_quantity: at least 2 must be ordered")
+
+		rsp = create(test, token, `[
+			{"path": "/purchase-limits-product", "sku": "limited-1", "quantity": 2},
+			{"path": "/purchase-limits-product", "sku": "limited-1", "quantity": 2}
+		]`)
+		limitError(t, rsp, "limited-1", "max_quantity: at most 3 can be ordered")
+
+		rsp = create(test, token, `[{"path": "/purchase-limits-product", "sku": "limited-1", "quantity": 3}]`)
+		assert.Equal(t, http.StatusCreated, rsp.Code)
+	})
+
+	t.Run("OnePerCustomer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		token := test.Data.testUserToken
+
+		rsp := create(test, token, `[{"path": "/purchase-limits-product", "sku": "once-1", "quantity": 2}]`)
+		limitError(t, rsp, "once-1", "one_per_customer: only 1 can be ordered")
+
+		rsp = create(test, token, `[{"path": "/purchase-limits-product", "sku": "once-1", "quantity": 1}]`)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, rsp, order)
+
+		rsp = create(test, token, `[{"path": "/purchase-limits-product", "sku": "once-1", "quantity": 1}]`)
+		assert.Equal(t, http.StatusCreated, rsp.Code, "unpaid orders don't count")
+
+		require.NoError(t, test.DB.Model(order).Update("payment_state", models.PaidState).Error)
+		rsp = create(test, token, `[{"path": "/purchase-limits-product", "sku": "once-1", "quantity": 1}]`)
+		limitError(t, rsp, "once-1", "one_per_customer: already bought in a previous order")
+
+		body := strings.NewReader(`{
+			"email": "alfred@wayneindustries.com",
+			"shipping_address": {"name": "Alfred", "address1": "1007 Mountain Drive", "city": "Gotham", "country": "USA", "zip": "10001"},
+			"line_items": [{"path": "/purchase-limits-product", "sku": "once-1", "quantity": 1}]
+		}`)
+		rsp = test.TestEndpoint(http.MethodPost, "/orders", body, testToken("alfred", "alfred@wayneindustries.com"))
+		assert.Equal(t, http.StatusCreated, rsp.Code, "other customers can still buy it")
+	})
+
+	t.Run("OnePerCustomerPaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		token := test.Data.testUserToken
+
+		first, second := &models.Order{}, &models.Order{}
+		extractPayload(t, http.StatusCreated, create(test, token, `[{"path": "/purchase-limits-product", "sku": "once-1", "quantity": 1}]`), first)
+		extractPayload(t, http.StatusCreated, create(test, token, `[{"path": "/purchase-limits-product", "sku": "once-1", "quantity": 1}]`), second)
+		require.NoError(t, test.DB.Model(first).Update("payment_state", models.PaidState).Error)
+
+		body, err := json.Marshal(&stripePaymentParams{
+			Amount:      second.Total,
+			Currency:    second.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		})
+		require.NoError(t, err)
+		rsp := test.TestEndpoint(http.MethodPost, "/orders/"+second.ID+"/payments", bytes.NewBuffer(body), token)
+		limitError(t, rsp, "once-1", "one_per_customer: already bought in a previous order")
+	})
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+)
+
+const defaultRateLimitPeriod = 60
+
+// The modes of a rate limit that let requests over it through. Any other mode
+// enforces the limit.
+const (
+	rateLimitLogMode  = "log"
+	rateLimitWarnMode = "warn"
+)
+
+func tooManyRequestsError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusTooManyRequests, fmtString, args...)
+}
+
+// rateLimited limits how often a client can make a request, by IP address and
+// by user. Requests over the limit are rejected with a 429 that tells when to
+// try again, unless the limit is only logged or warned about. The usage of the
+// tightest bucket is sent in the X-RateLimit-Limit and X-RateLimit-Remaining
+// headers. When the limiter can't be reached, requests go through.
+func (a *API) rateLimited(name string, limit conf.RateLimitConfiguration) middlewareHandler {
+	period := limit.Period
+	if period <= 0 {
+		period = defaultRateLimitPeriod
+	}
+	return func(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+		ctx := r.Context()
+		if gcontext.IsAdmin(ctx) {
+			return ctx, nil
+		}
+
+		ip := a.clientIP(r)
+		remaining := -1
+		if err := a.takeToken(w, r, name, "ip:"+ip, limit, limit.PerIP, period, &remaining); err != nil {
+			return nil, err
+		}
+		if claims := gcontext.GetClaims(ctx); claims != nil && claims.Subject != "" {
+			if err := a.takeToken(w, r, name, "user:"+claims.Subject, limit, limit.PerUser, period, &remaining); err != nil {
+				return nil, err
+			}
+		}
+		return ctx, nil
+	}
+}
+
+// takeToken takes a token from the bucket of a client, which holds perPeriod
+// requests plus the burst allowance. The usage headers are set when the
+// bucket has fewer tokens left than the lowest one so far.
+func (a *API) takeToken(w http.ResponseWriter, r *http.Request, name, key string, limit conf.RateLimitConfiguration, perPeriod, period int, lowest *int) *HTTPError {
+	if perPeriod <= 0 {
+		return nil
+	}
+	log := getLogEntry(r)
+	capacity := perPeriod
+	if limit.Burst > 0 {
+		capacity += limit.Burst
+	}
+	interval := time.Duration(period) * time.Second / time.Duration(perPeriod)
+	ok, remaining, wait, err := a.limiter.Take(name, gcontext.GetInstanceID(r.Context())+":"+key, capacity, interval)
+	if err != nil {
+		log.WithError(err).Warn("Failed to check rate limit")
+		return nil
+	}
+	if *lowest < 0 || remaining < *lowest {
+		*lowest = remaining
+		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", capacity))
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
+	}
+	if ok {
+		return nil
+	}
+
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	log = log.WithField("rate_limit", name).WithField("client", key)
+	switch limit.Mode {
+	case rateLimitLogMode:
+		log.Info("Rate limit exceeded, only logged")
+		return nil
+	case rateLimitWarnMode:
+		log.Info("Rate limit exceeded, warned")
+		w.Header().Set("X-RateLimit-Warning", fmt.Sprintf("Too many requests, this request will be rejected once the limit is enforced. Try again in %d seconds", retryAfter))
+		return nil
+	}
+	log.Warn("Rate limit exceeded")
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+	return tooManyRequestsError("Too many requests, please try again in %d seconds", retryAfter)
+}
+
+// clientIP returns the IP address of the client of a request, without the
+// port. Behind a proxy, it's the one in the configured header, the last one
+// of a list since that's the one the proxy added.
+func (a *API) clientIP(r *http.Request) string {
+	if header := a.config.API.ClientIPHeader; header != "" {
+		values := strings.Split(r.Header.Get(header), ",")
+		if ip := strings.TrimSpace(values[len(values)-1]); net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
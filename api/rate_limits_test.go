@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// couponLookup returns a function that looks up a coupon through an API with
+// the coupon lookups limited.
+func couponLookup(t *testing.T, limit conf.RateLimitConfiguration) func(ip string, token *jwt.Token) *httptest.ResponseRecorder {
+	test := NewRouteTest(t)
+	test.GlobalConfig.RateLimits.Coupons = limit
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(t, err)
+	handler := NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler
+
+	return func(ip string, token *jwt.Token) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, baseURL+"/coupons/unknown", nil)
+		req.RemoteAddr = ip + ":1234"
+		if token != nil {
+			require.NoError(t, signHTTPRequest(req, token, test.Config.JWT.Secret))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	lookup := couponLookup(t, conf.RateLimitConfiguration{PerIP: 2, PerUser: 3, Period: 60})
+
+	t.Run("PerIP", func(t *testing.T) {
+		recorder := lookup("10.0.0.1", nil)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Equal(t, "2", recorder.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, "1", recorder.Header().Get("X-RateLimit-Remaining"))
+		recorder = lookup("10.0.0.1", nil)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Equal(t, "0", recorder.Header().Get("X-RateLimit-Remaining"))
+		recorder = lookup("10.0.0.1", nil)
+		assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		assert.Equal(t, "30", recorder.Header().Get("Retry-After"))
+		assert.Equal(t, "0", recorder.Header().Get("X-RateLimit-Remaining"))
+
+		assert.Equal(t, http.StatusNotFound, lookup("10.0.0.2", nil).Code, "other addresses have their own limit")
+	})
+	t.Run("PerUser", func(t *testing.T) {
+		token := testToken("rate-limited-user", "limited@example.com")
+		for i, ip := range []string{"10.0.1.1", "10.0.1.2", "10.0.1.3"} {
+			recorder := lookup(ip, token)
+			assert.Equal(t, http.StatusNotFound, recorder.Code, "request %d", i)
+			if i == 2 {
+				assert.Equal(t, "3", recorder.Header().Get("X-RateLimit-Limit"), "the tightest bucket is sent")
+				assert.Equal(t, "0", recorder.Header().Get("X-RateLimit-Remaining"))
+			}
+		}
+		assert.Equal(t, http.StatusTooManyRequests, lookup("10.0.1.4", token).Code, "users are limited from any address")
+	})
+	t.Run("Admins", func(t *testing.T) {
+		token := testAdminToken("admin-yo", "admin@wayne.com")
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusNotFound, lookup("10.0.2.1", token).Code)
+		}
+	})
+}
+
+func TestGiftCardRateLimit(t *testing.T) {
+	test := NewRouteTest(t)
+	test.GlobalConfig.RateLimits.GiftCards = conf.RateLimitConfiguration{PerIP: 1, Period: 60}
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(t, err)
+	handler := NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler
+
+	lookup := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, baseURL+"/gift-cards/UNKNOWN", nil)
+		req.RemoteAddr = "10.0.3.1:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, http.StatusNotFound, lookup().Code)
+	assert.Equal(t, http.StatusTooManyRequests, lookup().Code)
+}
+
+func TestClientIPHeader(t *testing.T) {
+	api := &API{config: &conf.GlobalConfiguration{}}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.2")
+	assert.Equal(t, "10.0.0.1", api.clientIP(req), "the header is ignored without a proxy")
+
+	api.config.API.ClientIPHeader = "X-Forwarded-For"
+	assert.Equal(t, "10.0.0.2", api.clientIP(req), "the proxy added the last address")
+	req.Header.Set("X-Forwarded-For", "not an address")
+	assert.Equal(t, "10.0.0.1", api.clientIP(req))
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	lookup := couponLookup(t, conf.RateLimitConfiguration{PerIP: 2, Burst: 3, Period: 60})
+	for i := 0; i < 5; i++ {
+		recorder := lookup("10.0.3.1", nil)
+		assert.Equal(t, http.StatusNotFound, recorder.Code, "request %d", i)
+		assert.Equal(t, "5", recorder.Header().Get("X-RateLimit-Limit"))
+	}
+	recorder := lookup("10.0.3.1", nil)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "30", recorder.Header().Get("Retry-After"), "the burst refills at the rate of the limit")
+}
+
+func TestRateLimitModes(t *testing.T) {
+	t.Run("Warn", func(t *testing.T) {
+		lookup := couponLookup(t, conf.RateLimitConfiguration{PerIP: 1, Mode: "warn"})
+		recorder := lookup("10.0.4.1", nil)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-RateLimit-Warning"))
+
+		recorder = lookup("10.0.4.1", nil)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Equal(t, "Too many requests, this request will be rejected once the limit is enforced. Try again in 60 seconds", recorder.Header().Get("X-RateLimit-Warning"))
+		assert.Equal(t, "0", recorder.Header().Get("X-RateLimit-Remaining"))
+		assert.Empty(t, recorder.Header().Get("Retry-After"))
+	})
+	t.Run("Log", func(t *testing.T) {
+		lookup := couponLookup(t, conf.RateLimitConfiguration{PerIP: 1, Mode: "log"})
+		for i := 0; i < 3; i++ {
+			recorder := lookup("10.0.5.1", nil)
+			assert.Equal(t, http.StatusNotFound, recorder.Code, "request %d", i)
+			assert.Empty(t, recorder.Header().Get("X-RateLimit-Warning"))
+		}
+	})
+}
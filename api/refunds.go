@@ -0,0 +1,336 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// RefundParams holds the parameters for refunding a transaction of an order.
+// Either an amount or a list of line items must be given.
+type RefundParams struct {
+	Amount    uint64            `json:"amount"`
+	LineItems []*refundLineItem `json:"line_items"`
+}
+
+type refundLineItem struct {
+	ID       int64  `json:"id"`
+	Quantity uint64 `json:"quantity"`
+}
+
+// OrderTransactionRefund refunds a charge transaction of an order. Refunds can
+// be given as an amount or as a list of line items and quantities, in which
+// case the amount is calculated with the taxes and discounts for those items.
+// It is only available to admins.
+func (a *API) OrderTransactionRefund(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	orderID := gcontext.GetOrderID(ctx)
+	log := getLogEntry(r)
+
+	params := &RefundParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+
+	transID := chi.URLParam(r, "transaction_id")
+	trans, httpErr := a.getTransaction(gcontext.GetInstanceID(r.Context()), transID)
+	if httpErr != nil {
+		return httpErr
+	}
+	if trans.OrderID != orderID {
+		return notFoundError("Transaction not found")
+	}
+	if trans.Type != models.ChargeTransactionType {
+		return badRequestError("Only charges can be refunded")
+	}
+
+	order := &models.Order{}
+	if result := orderQuery(a.db).First(order, "id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx)); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	amount := params.Amount
+	var items map[int64]uint64
+	if len(params.LineItems) > 0 {
+		if amount != 0 {
+			return badRequestError("A refund can specify either an amount or line items, not both")
+		}
+		var refunded *models.Order
+		refunded, items, httpErr = refundedLineItems(order, params.LineItems)
+		if httpErr != nil {
+			return httpErr
+		}
+		settings, err := a.loadSettings(ctx)
+		if err != nil {
+			return internalServerError("Error loading site settings").WithInternalError(err)
+		}
+		amount, err = a.refundedItemsTotal(ctx, settings, order, refunded)
+		if err != nil {
+			return internalServerError("Error pricing the refunded items").WithInternalError(err)
+		}
+	}
+
+	if amount <= 0 || amount > trans.Amount {
+		return badRequestError("The balance of the refund must be between 0 and the total amount")
+	}
+
+	log.Debugf("Refunding %d %s of transaction %s", amount, trans.Currency, trans.ID)
+	m, httpErr := a.refundTransaction(ctx, r, order, trans, amount, items)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, m)
+}
+
+// refundedLineItems checks the line item quantities to refund and returns them
+// as an order of their own. Its total is the amount to refund for them, with the
+// taxes and discounts of the original order.
+func refundedLineItems(order *models.Order, params []*refundLineItem) (*models.Order, map[int64]uint64, *HTTPError) {
+	refunded := &models.Order{
+		Currency:            order.Currency,
+		ShippingAddress:     order.ShippingAddress,
+		VATNumber:           order.VATNumber,
+		VATNumberUnverified: order.VATNumberUnverified,
+		TaxExempt:           order.TaxExempt,
+		Coupon:              order.Coupon,
+	}
+	quantities := make(map[int64]uint64)
+	for _, p := range params {
+		var item *models.LineItem
+		for _, i := range order.LineItems {
+			if i.ID == p.ID {
+				item = i
+				break
+			}
+		}
+		if item == nil {
+			return nil, nil, badRequestError("Line item %d is not part of this order", p.ID)
+		}
+		quantities[p.ID] += p.Quantity
+		if p.Quantity == 0 || item.RefundedQuantity+quantities[p.ID] > item.Quantity {
+			return nil, nil, badRequestError("Can't refund %d of line item %d, only %d not refunded yet", quantities[p.ID], p.ID, item.Quantity-item.RefundedQuantity)
+		}
+
+		refundedItem := *item
+		refundedItem.Quantity = p.Quantity
+		refunded.LineItems = append(refunded.LineItems, &refundedItem)
+	}
+
+	return refunded, quantities, nil
+}
+
+// refundedItemsTotal returns what the buyer paid for the line items of a
+// refunded order made by refundedLineItems. They are priced with the claims
+// of the buyer, and get their share of the promotions, spend tiers and manual
+// discount, which depend on the whole order.
+func (a *API) refundedItemsTotal(ctx context.Context, settings *calculator.Settings, order, refunded *models.Order) (uint64, error) {
+	claims, err := a.orderPriceClaims(ctx, a.db, order)
+	if err != nil {
+		return 0, err
+	}
+	var listed, refundedListed uint64
+	full := order.CalculateItemsPrice(settings, claims)
+	for _, item := range full.Items {
+		listed += item.Total * item.Quantity
+	}
+	for _, item := range refunded.CalculateItemsPrice(settings, claims).Items {
+		refundedListed += item.Total * item.Quantity
+	}
+	paid := full.Total
+	if order.ManualDiscount >= paid || listed == 0 {
+		return 0, nil
+	}
+	paid -= order.ManualDiscount
+	return uint64(math.Floor(float64(refundedListed)*float64(paid)/float64(listed) + 0.5)), nil
+}
+
+// refundTransaction refunds an amount of a paid charge through the payment
+// provider of the order and records the refund as its own transaction. When the
+// refund goes through, the refunded totals of the order and the line items given
+// in items are updated.
+func (a *API) refundTransaction(ctx context.Context, r *http.Request, order *models.Order, trans *models.Transaction, amount uint64, items map[int64]uint64) (*models.Transaction, *HTTPError) {
+	config := gcontext.GetConfig(ctx)
+	log := getLogEntry(r)
+
+	if trans.FailureCode != "" {
+		return nil, badRequestError("Can't refund a failed transaction")
+	}
+	if trans.Status != models.PaidState {
+		return nil, badRequestError("Can't refund a transaction that hasn't been paid")
+	}
+	if order.PaymentProcessor == "" {
+		return nil, badRequestError("Order does not specify a payment provider")
+	}
+
+	var paid uint64
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.PaidState {
+			paid += t.Amount
+		}
+	}
+	if order.TotalRefunded+amount > paid {
+		return nil, badRequestError("The refund exceeds the remaining balance of %d on the order", paid-order.TotalRefunded)
+	}
+
+	// the part of a payment that was paid with a gift card is credited back
+	// to the gift card
+	var provider payments.Provider
+	var refund payments.Refunder
+	provID := models.GiftCardProcessor
+	if trans.GiftCardID == "" {
+		provider = gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
+		if provider == nil {
+			return nil, badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
+		}
+		var err error
+		refund, err = provider.NewRefunder(ctx, r)
+		if err != nil {
+			return nil, badRequestError("Error creating payment provider: %v", err)
+		}
+		provID = provider.Name()
+	}
+
+	// ok make the refund
+	m := &models.Transaction{
+		InstanceID: order.InstanceID,
+		ID:         models.NewID(config.IDFormat),
+		Amount:     amount,
+		Currency:   trans.Currency,
+		UserID:     trans.UserID,
+		OrderID:    trans.OrderID,
+		Type:       models.RefundTransactionType,
+		Status:     models.PendingState,
+		GiftCardID: trans.GiftCardID,
+		ChargeID:   trans.ID,
+	}
+
+	// the order is locked until the refund is recorded, so its refunded
+	// total is current and the event of the provider about the refund waits
+	// to find it
+	tx := a.db.Begin()
+	locked := &models.Order{}
+	if rsp := models.ForUpdate(tx).Select("id, total_refunded").First(locked, "id = ?", order.ID); rsp.Error != nil {
+		tx.Rollback()
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	order.TotalRefunded = locked.TotalRefunded
+	if order.TotalRefunded+amount > paid {
+		tx.Rollback()
+		return nil, badRequestError("The refund exceeds the remaining balance of %d on the order", paid-order.TotalRefunded)
+	}
+	// the refunded quantities are checked again under the lock, so the same
+	// items can't be refunded twice at the same time
+	if len(items) > 0 {
+		current := []*models.LineItem{}
+		if rsp := tx.Select("id, quantity, refunded_quantity").Where("order_id = ?", order.ID).Find(&current); rsp.Error != nil {
+			tx.Rollback()
+			return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+		}
+		for _, item := range current {
+			qty, ok := items[item.ID]
+			if !ok {
+				continue
+			}
+			if item.RefundedQuantity+qty > item.Quantity {
+				tx.Rollback()
+				return nil, badRequestError("Can't refund %d of line item %d, only %d not refunded yet", qty, item.ID, item.Quantity-item.RefundedQuantity)
+			}
+			for _, i := range order.LineItems {
+				if i.ID == item.ID {
+					i.RefundedQuantity = item.RefundedQuantity
+				}
+			}
+		}
+	}
+	// gift cards are credited without a provider that would refuse to refund
+	// more than was charged
+	chargeRefunded, err := models.RefundedAmount(tx, trans)
+	if err != nil {
+		tx.Rollback()
+		return nil, internalServerError("Error during database query").WithInternalError(err)
+	}
+	if chargeRefunded+amount > trans.Amount {
+		tx.Rollback()
+		return nil, badRequestError("The refund exceeds the remaining balance of %d on the transaction", trans.Amount-chargeRefunded)
+	}
+	tx.Create(m)
+	log.Debugf("Starting refund to %s", provID)
+	var refundID string
+	if refund != nil {
+		refundID, err = refund(trans.ProcessorID, amount, trans.Currency)
+	} else {
+		refundID, err = trans.ProcessorID, models.CreditGiftCard(tx, trans.GiftCardID, amount)
+	}
+	if err != nil {
+		log.WithError(err).Info("Failed to refund value")
+		m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
+		m.FailureDescription = err.Error()
+		m.Status = models.FailedState
+	} else {
+		m.ProcessorID = refundID
+		m.Status = models.PaidState
+	}
+
+	log.Infof("Finished transaction with %s: %s", provID, m.ProcessorID)
+	tx.Save(m)
+	if m.Status == models.PaidState {
+		recordRefund(tx, r, actorID(ctx), order, m, paid)
+		for _, item := range order.LineItems {
+			if qty, ok := items[item.ID]; ok {
+				tx.Model(item).UpdateColumn("refunded_quantity", gorm.Expr("refunded_quantity + ?", qty))
+				item.RefundedQuantity += qty
+			}
+		}
+		if len(items) > 0 {
+			if err := adjustInventory(tx, order, items, 1); err != nil {
+				log.WithError(err).Error("Error restocking refunded items")
+			}
+		}
+		enqueueMail(ctx, tx, log, models.OrderRefundMailJob, &mailJob{TransactionID: m.ID})
+		if config.Webhooks.Refund != "" && !order.SuppressNotifications {
+			hook := newHook(ctx, log, order.InstanceID, models.RefundIssuedHook, config.Webhooks.Refund, m.UserID, m)
+			tx.Save(hook)
+		}
+	}
+	tx.Commit()
+
+	if m.Status == models.PaidState && provider != nil {
+		a.reverseVendorTransfers(ctx, r, provider, order, trans, m.Amount, items, log)
+	}
+	return m, nil
+}
+
+// recordRefund adds a paid refund to the refunded total of its order, and
+// moves the order to refunded once all of the paid amount was refunded.
+func recordRefund(tx *gorm.DB, r *http.Request, actorID string, order *models.Order, m *models.Transaction, paid uint64) {
+	// the total is added to in the database, so refunds recorded at the same
+	// time all count
+	query := tx.Model(&models.Order{}).Where("id = ?", order.ID)
+	query.UpdateColumn("total_refunded", gorm.Expr("total_refunded + ?", m.Amount))
+	totals := []uint64{}
+	if rsp := query.Pluck("total_refunded", &totals); rsp.Error == nil && len(totals) == 1 {
+		order.TotalRefunded = totals[0]
+	} else {
+		order.TotalRefunded += m.Amount
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, actorID, order.ID, models.EventRefunded, []string{"total_refunded"}, map[string]models.Change{
+		"total_refunded": {From: order.TotalRefunded - m.Amount, To: order.TotalRefunded},
+		"transaction":    {To: m.ID},
+	})
+	if previousState := order.State; order.TotalRefunded >= paid && order.TransitionState(models.RefundedState) {
+		tx.Model(order).UpdateColumn("state", order.State)
+		models.LogTransition(tx, r.RemoteAddr, order.UserID, order.ID, "state", previousState, order.State)
+	}
+}
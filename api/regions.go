@@ -0,0 +1,35 @@
+package api
+
+import (
+	"github.com/netlify/gocommerce/addresses"
+	"github.com/netlify/gocommerce/models"
+)
+
+// blockedItem is a line item that can't be shipped to the country of an
+// order, so the storefront can offer to remove it.
+type blockedItem struct {
+	ID    int64  `json:"id,omitempty"`
+	Sku   string `json:"sku"`
+	Title string `json:"title"`
+	Path  string `json:"path,omitempty"`
+}
+
+// checkShippingRegions rejects an order with items that can't be shipped to
+// its shipping address, and lists all of them in the data of the error.
+// Items with a quantity of 0 are being removed, so they are skipped.
+func checkShippingRegions(order *models.Order) *HTTPError {
+	country := order.ShippingAddress.Country
+	blocked := []blockedItem{}
+	for _, item := range order.LineItems {
+		if item.Quantity > 0 && !item.ShipsTo(country, addresses.CountryCode) {
+			blocked = append(blocked, blockedItem{ID: item.ID, Sku: item.Sku, Title: item.Title, Path: item.Path})
+		}
+	}
+	if len(blocked) == 0 {
+		return nil
+	}
+	return unprocessableEntityError("Some items can't be shipped to %v", country).WithData(map[string]interface{}{
+		"country":       country,
+		"blocked_items": blocked,
+	})
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderShippingRegions(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	lineItems := `[
+		{"path": "/regional-product", "sku": "usa-only", "quantity": 1},
+		{"path": "/regional-product", "sku": "not-dcland", "quantity": 1},
+		{"path": "/regional-product", "sku": "anywhere", "quantity": 1}
+	]`
+	type blockedPayload struct {
+		Data struct {
+			Country      string        `json:"country"`
+			BlockedItems []blockedItem `json:"blocked_items"`
+		} `json:"data"`
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		body := strings.NewReader(`{"shipping_address_id": "first-address", "line_items": ` + lineItems + `}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		payload := &blockedPayload{}
+		extractPayload(t, http.StatusUnprocessableEntity, recorder, payload)
+		assert.Equal(t, "dcland", payload.Data.Country)
+		require.Len(t, payload.Data.BlockedItems, 2)
+		assert.Equal(t, "usa-only", payload.Data.BlockedItems[0].Sku)
+		assert.Equal(t, "USA only", payload.Data.BlockedItems[0].Title)
+		assert.Equal(t, "/regional-product", payload.Data.BlockedItems[0].Path)
+		assert.Equal(t, "not-dcland", payload.Data.BlockedItems[1].Sku)
+	})
+
+	t.Run("CountryCodes", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		// the product ships to "USA", which is the same country
+		body := strings.NewReader(`{
+			"shipping_address": {"name": "Bruce", "address1": "1007 Mountain Drive", "city": "Gotham", "country": "United States", "zip": "10001"},
+			"line_items": [{"path": "/regional-product", "sku": "usa-only", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		assert.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+	})
+
+	t.Run("UpdateAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		body := strings.NewReader(`{
+			"shipping_address": {"name": "Bruce", "address1": "1007 Mountain Drive", "city": "Gotham", "country": "USA", "zip": "10001"},
+			"line_items": ` + lineItems + `
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+
+		saved := &models.LineItem{}
+		require.NoError(t, test.DB.First(saved, "order_id = ? AND sku = ?", order.ID, "usa-only").Error)
+		assert.Equal(t, []string{"USA"}, saved.AllowedCountries)
+
+		token := testAdminToken("admin", "")
+		url := "/orders/" + order.ID
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"shipping_address_id": "first-address"}`), token)
+		payload := &blockedPayload{}
+		extractPayload(t, http.StatusUnprocessableEntity, recorder, payload)
+		require.Len(t, payload.Data.BlockedItems, 2)
+		assert.NotZero(t, payload.Data.BlockedItems[0].ID)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{
+			"shipping_address_id": "first-address",
+			"line_items": [{"sku": "usa-only", "quantity": 0}, {"sku": "not-dcland", "quantity": 0}]
+		}`), token)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "dcland", order.ShippingAddress.Country)
+	})
+}
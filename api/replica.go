@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	stickyPrimaryCookie         = "gocommerce_primary_until"
+	defaultStickyPrimaryTimeout = 10 * time.Second
+)
+
+// readDB returns the database listings and reports are read from. That is the
+// read replica if there is one, unless the client made a change recently and
+// could otherwise miss it because of replication lag.
+func (a *API) readDB(r *http.Request) *gorm.DB {
+	if a.replica == nil {
+		return a.db
+	}
+	if cookie, err := r.Cookie(stickyPrimaryCookie); err == nil {
+		if until, err := strconv.ParseInt(cookie.Value, 10, 64); err == nil && time.Now().Unix() < until {
+			return a.db
+		}
+	}
+	return a.replica
+}
+
+// stickToPrimary sends the reads of a client to the primary database for a
+// while after every request that may change something.
+func (a *API) stickToPrimary(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil, nil
+	}
+
+	timeout := defaultStickyPrimaryTimeout
+	if a.config.Region.StickyPrimary > 0 {
+		timeout = time.Duration(a.config.Region.StickyPrimary) * time.Second
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stickyPrimaryCookie,
+		Value:    strconv.FormatInt(time.Now().Add(timeout).Unix(), 10),
+		Path:     "/",
+		MaxAge:   int(timeout / time.Second),
+		HttpOnly: true,
+	})
+	return nil, nil
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestReadReplica(t *testing.T) {
+	test := NewRouteTest(t)
+	replica := test.DB.New()
+	a := &API{db: test.DB, replica: replica, config: test.GlobalConfig}
+
+	t.Run("Reads", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		assert.True(t, a.readDB(req) == replica)
+	})
+	t.Run("AfterWrite", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		_, err := a.stickToPrimary(w, httptest.NewRequest(http.MethodPost, "/orders", nil))
+		require.NoError(t, err)
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.AddCookie(cookies[0])
+		assert.True(t, a.readDB(req) == test.DB)
+	})
+	t.Run("StickinessExpired", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.AddCookie(&http.Cookie{Name: stickyPrimaryCookie, Value: strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)})
+		assert.True(t, a.readDB(req) == replica)
+	})
+	t.Run("ReadsDontStick", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		_, err := a.stickToPrimary(w, httptest.NewRequest(http.MethodGet, "/orders", nil))
+		require.NoError(t, err)
+		assert.Empty(t, w.Result().Cookies())
+	})
+}
+
+func TestMultiRegionOrderCreate(t *testing.T) {
+	models.IDRegion = "eu-west"
+	defer func() { models.IDRegion = "" }()
+
+	test := NewRouteTest(t)
+	site := startTestSite()
+	defer site.Close()
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	defer unavailable.Close()
+
+	test.GlobalConfig.Region.Name = "eu-west"
+	test.Config.SiteURL = unavailable.URL
+	test.Config.ProductOrigins = map[string]string{"eu-west": site.URL, "us-east": unavailable.URL}
+
+	body := strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_address": {"name": "Test User", "address1": "Branengebranen", "city": "Berlin", "country": "Germany", "zip": "94107"},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`)
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", body, nil)
+
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.True(t, strings.HasPrefix(order.ID, "eu-west-"), order.ID)
+	require.Len(t, order.LineItems, 1)
+	assert.Equal(t, "product-1", order.LineItems[0].Sku)
+}
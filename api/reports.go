@@ -1,37 +1,88 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jinzhu/gorm"
 
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/rates"
 )
 
 type salesRow struct {
-	Total    uint64 `json:"total"`
-	SubTotal uint64 `json:"subtotal"`
-	Taxes    uint64 `json:"taxes"`
-	Currency string `json:"currency"`
+	Period    string `json:"period,omitempty"`
+	PriceList string `json:"price_list,omitempty"`
+	Count     uint64 `json:"count"`
+	Total     uint64 `json:"total"`
+	SubTotal  uint64 `json:"subtotal"`
+	Taxes     uint64 `json:"taxes"`
+	Shipping  uint64 `json:"shipping"`
+	Refunded  uint64 `json:"refunded"`
+	Cost      uint64 `json:"cost"`
+	Margin    int64  `json:"margin"`
+	Currency  string `json:"currency"`
 }
 
 type productsRow struct {
-	Sku      string `json:"sku"`
-	Path     string `json:"path"`
-	Total    uint64 `json:"total"`
-	Currency string `json:"currency"`
+	Period    string `json:"period,omitempty"`
+	PriceList string `json:"price_list,omitempty"`
+	Sku       string `json:"sku"`
+	Path      string `json:"path"`
+	Quantity  uint64 `json:"quantity"`
+	Orders    uint64 `json:"orders"`
+	Total     uint64 `json:"total"`
+	Net       uint64 `json:"net"`
+	Cost      uint64 `json:"cost"`
+	Margin    int64  `json:"margin"`
+	Currency  string `json:"currency"`
 }
 
-// SalesReport lists the sales numbers for a period
+// SalesReport lists the sales numbers for a period. With the interval
+// parameter set to day, week or month the numbers are split up by the
+// period the orders were created in, and with split=price_list by the price
+// list of the orders. The convert_to parameter converts the sales of each
+// day to one currency, with the exchange rates of that day. The margin is
+// what is left of the totals without taxes, shipping, refunds and the cost of
+// the items.
 func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
 	instanceID := gcontext.GetInstanceID(r.Context())
+	params := r.URL.Query()
 
-	query := a.db.
+	db := a.readDB(r)
+	period, group, err := reportPeriod(db, params, "created_at")
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	priceList, listGroup, err := reportPriceList(params, "price_list")
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	var converter *salesConverter
+	day, dayGroup := "''", ""
+	if currency := strings.ToUpper(params.Get("convert_to")); currency != "" {
+		if a.config.ExchangeRates.Source == "" {
+			return badRequestError("Sales can't be converted, exchange rates are not set up")
+		}
+		converter = &salesConverter{a: a, r: r, currency: currency, snapshots: map[string]*rates.Snapshot{}}
+		day, _, err = reportPeriod(db, url.Values{"interval": {"day"}}, "created_at")
+		if err != nil {
+			return badRequestError(err.Error())
+		}
+		dayGroup = "day, "
+	}
+
+	query := db.
 		Model(&models.Order{}).
-		Select("sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency").
+		Select(period+" as period, "+day+" as day, "+priceList+" as price_list, count(*) as count, sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, sum(shipping) as shipping, sum(total_refunded) as refunded, coalesce(sum(cost), 0) as cost, currency").
 		Where("payment_state = 'paid' AND instance_id = ?", instanceID).
-		Group("currency")
+		Group(group + dayGroup + listGroup + "currency").
+		Order("period asc")
 
-	query, err := parseTimeQueryParams(query, r.URL.Query())
+	query, err = parseTimeQueryParams(query, params)
 	if err != nil {
 		return badRequestError(err.Error())
 	}
@@ -42,32 +93,73 @@ func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
 	}
 	defer rows.Close()
 	result := []*salesRow{}
+	converted := map[string]*salesRow{}
 	for rows.Next() {
 		row := &salesRow{}
-		err = rows.Scan(&row.Total, &row.SubTotal, &row.Taxes, &row.Currency)
+		var rowDay string
+		err = rows.Scan(&row.Period, &rowDay, &row.PriceList, &row.Count, &row.Total, &row.SubTotal, &row.Taxes, &row.Shipping, &row.Refunded, &row.Cost, &row.Currency)
 		if err != nil {
 			return internalServerError("Database error").WithInternalError(err)
 		}
+		if converter != nil {
+			if httpErr := converter.convert(row, rowDay); httpErr != nil {
+				return httpErr
+			}
+			// the days of a period add up to one row in the currency
+			key := row.Period + "\x00" + row.PriceList
+			if sum, ok := converted[key]; ok {
+				sum.Count += row.Count
+				sum.Total += row.Total
+				sum.SubTotal += row.SubTotal
+				sum.Taxes += row.Taxes
+				sum.Shipping += row.Shipping
+				sum.Refunded += row.Refunded
+				sum.Cost += row.Cost
+				continue
+			}
+			converted[key] = row
+		}
 		result = append(result, row)
 	}
+	for _, row := range result {
+		row.Margin = int64(row.Total) - int64(row.Taxes) - int64(row.Shipping) - int64(row.Refunded) - int64(row.Cost)
+	}
 
 	return sendJSON(w, http.StatusOK, result)
 }
 
-// ProductsReport list the products sold within a period
+// ProductsReport list the products sold within a period, best selling first.
+// The limit parameter restricts the report to the top SKUs, and the interval
+// and split parameters split it up like the sales report, by the price list
+// of the line items. The net is what the lines were sold for after coupons,
+// promotions and spend tiers, and the margin what is left of it without the
+// cost of the items.
 func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 	instanceID := gcontext.GetInstanceID(r.Context())
-	ordersTable := a.db.NewScope(models.Order{}).QuotedTableName()
-	itemsTable := a.db.NewScope(models.LineItem{}).QuotedTableName()
-	query := a.db.
+	params := r.URL.Query()
+
+	db := a.readDB(r)
+	period, group, err := reportPeriod(db, params, "orders.created_at")
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	itemsTable := db.NewScope(models.LineItem{}).QuotedTableName()
+	priceList, listGroup, err := reportPriceList(params, itemsTable+".price_list")
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	query := db.
 		Model(&models.LineItem{}).
-		Select("sku, path, sum(quantity * price) as total, currency").
+		Select(period + " as period, " + priceList + " as price_list, sku, path, sum(quantity) as quantity, count(distinct orders.id) as orders, sum(quantity * price) as total, coalesce(sum(" + itemsTable + ".line_net), 0) as net, coalesce(sum(quantity * " + itemsTable + ".cost), 0) as cost, orders.currency as currency").
 		Joins("JOIN " + ordersTable + " as orders " + "ON orders.id = " + itemsTable + ".order_id " + "AND orders.payment_state = 'paid'").
-		Group("sku, path, currency").
+		Group(group + listGroup + "sku, path, orders.currency").
+		Order("period asc").
 		Order("total desc")
 
 	query = query.Where("orders.instance_id = ?", instanceID)
-	from, to, err := getTimeQueryParams(r.URL.Query())
+	from, to, err := getTimeQueryParams(params)
 	if err != nil {
 		return badRequestError(err.Error())
 	}
@@ -75,7 +167,11 @@ func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 		query = query.Where("orders.created_at >= ?", from)
 	}
 	if to != nil {
-		query.Where("orders.created_at <= ?", to)
+		query = query.Where("orders.created_at <= ?", to)
+	}
+	query, err = parseLimitQueryParam(query, params)
+	if err != nil {
+		return badRequestError("bad value for 'limit' parameter: %v", err)
 	}
 
 	rows, err := query.Rows()
@@ -86,12 +182,70 @@ func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 	result := []*productsRow{}
 	for rows.Next() {
 		row := &productsRow{}
-		err = rows.Scan(&row.Sku, &row.Path, &row.Total, &row.Currency)
+		err = rows.Scan(&row.Period, &row.PriceList, &row.Sku, &row.Path, &row.Quantity, &row.Orders, &row.Total, &row.Net, &row.Cost, &row.Currency)
 		if err != nil {
 			return internalServerError("Database error").WithInternalError(err)
 		}
+		row.Margin = int64(row.Net) - int64(row.Cost)
 		result = append(result, row)
 	}
 
 	return sendJSON(w, http.StatusOK, result)
 }
+
+// reportPeriod returns the SQL expression for the first day of the period a
+// timestamp column falls in, formatted as YYYY-MM-DD, and the prefix of the
+// GROUP BY clause for it. Weeks start on Monday. Without an interval all rows
+// fall in the same, empty, period.
+func reportPeriod(db *gorm.DB, params url.Values, column string) (string, string, error) {
+	interval := params.Get("interval")
+	if interval == "" {
+		return "''", "", nil
+	}
+
+	dialect := db.NewScope(nil).Dialect().GetName()
+	var expressions map[string]string
+	switch dialect {
+	case "mysql":
+		expressions = map[string]string{
+			"day":   "DATE_FORMAT(" + column + ", '%Y-%m-%d')",
+			"week":  "DATE_FORMAT(DATE_SUB(" + column + ", INTERVAL WEEKDAY(" + column + ") DAY), '%Y-%m-%d')",
+			"month": "DATE_FORMAT(" + column + ", '%Y-%m-01')",
+		}
+	case "postgres":
+		expressions = map[string]string{
+			"day":   "to_char(date_trunc('day', " + column + "), 'YYYY-MM-DD')",
+			"week":  "to_char(date_trunc('week', " + column + "), 'YYYY-MM-DD')",
+			"month": "to_char(date_trunc('month', " + column + "), 'YYYY-MM-DD')",
+		}
+	case "sqlite3":
+		expressions = map[string]string{
+			"day":   "date(" + column + ")",
+			"week":  "date(" + column + ", 'weekday 0', '-6 days')",
+			"month": "date(" + column + ", 'start of month')",
+		}
+	default:
+		return "", "", fmt.Errorf("reports by interval are not supported with %v", dialect)
+	}
+
+	expression, ok := expressions[interval]
+	if !ok {
+		return "", "", fmt.Errorf("bad value for 'interval' parameter, only 'day', 'week' and 'month' allowed")
+	}
+	return expression, "period, ", nil
+}
+
+// reportPriceList returns the SQL expression for the price list of a column,
+// with rows from before price lists counting as retail, and the prefix of the
+// GROUP BY clause for it. Without split=price_list all rows have the same,
+// empty, list.
+func reportPriceList(params url.Values, column string) (string, string, error) {
+	switch params.Get("split") {
+	case "":
+		return "''", "", nil
+	case "price_list":
+		expression := "CASE WHEN " + column + " IS NULL OR " + column + " = '' THEN '" + models.DefaultPriceList + "' ELSE " + column + " END"
+		return expression, expression + ", ", nil
+	}
+	return "", "", fmt.Errorf("bad value for 'split' parameter, only 'price_list' allowed")
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSalesReport(t *testing.T) {
+	t.Run("Total", func(t *testing.T) {
+		test := newReportTest(t)
+		rows := []*salesRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/sales"), &rows)
+		require.Len(t, rows, 1)
+		assert.Empty(t, rows[0].Period)
+		assert.EqualValues(t, 2, rows[0].Count)
+		assert.Equal(t, test.Data.firstOrder.Total+test.Data.secondOrder.Total, rows[0].Total)
+		assert.Equal(t, "USD", rows[0].Currency)
+	})
+	t.Run("ByWeek", func(t *testing.T) {
+		test := newReportTest(t)
+		rows := []*salesRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/sales?interval=week"), &rows)
+		require.Len(t, rows, 2)
+		assert.Equal(t, "2018-01-01", rows[0].Period)
+		assert.Equal(t, test.Data.firstOrder.Total, rows[0].Total)
+		assert.Equal(t, "2018-01-15", rows[1].Period)
+		assert.Equal(t, test.Data.secondOrder.Total, rows[1].Total)
+	})
+	t.Run("ByMonth", func(t *testing.T) {
+		test := newReportTest(t)
+		rows := []*salesRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/sales?interval=month"), &rows)
+		require.Len(t, rows, 1)
+		assert.Equal(t, "2018-01-01", rows[0].Period)
+		assert.EqualValues(t, 2, rows[0].Count)
+	})
+	t.Run("FromTo", func(t *testing.T) {
+		test := newReportTest(t)
+		from := time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC).Unix()
+		rows := []*salesRow{}
+		extractPayload(t, http.StatusOK, runReport(test, fmt.Sprintf("/reports/sales?interval=day&from=%d", from)), &rows)
+		require.Len(t, rows, 1)
+		assert.Equal(t, "2018-01-17", rows[0].Period)
+		assert.EqualValues(t, 1, rows[0].Count)
+	})
+	t.Run("Relative", func(t *testing.T) {
+		test := newReportTest(t)
+		rows := []*salesRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/sales?from=-P30D"), &rows)
+		assert.Len(t, rows, 0)
+
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/sales?to=-P30D"), &rows)
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 2, rows[0].Count)
+	})
+	t.Run("ByPriceList", func(t *testing.T) {
+		test := newReportTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("price_list", "wholesale").Error)
+		rows := []*salesRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/sales?split=price_list"), &rows)
+		require.Len(t, rows, 2)
+		byList := map[string]*salesRow{}
+		for _, row := range rows {
+			byList[row.PriceList] = row
+		}
+		require.Contains(t, byList, "retail")
+		require.Contains(t, byList, "wholesale")
+		assert.Equal(t, test.Data.firstOrder.Total, byList["retail"].Total)
+		assert.Equal(t, test.Data.secondOrder.Total, byList["wholesale"].Total)
+
+		validateError(t, http.StatusBadRequest, runReport(test, "/reports/sales?split=coupon"), "split")
+	})
+	t.Run("Margin", func(t *testing.T) {
+		test := newReportTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumns(map[string]interface{}{"cost": 10, "shipping": 5, "taxes": 3}).Error)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumns(map[string]interface{}{"cost": 20, "total_refunded": 7}).Error)
+		rows := []*salesRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/sales"), &rows)
+		require.Len(t, rows, 1)
+		total := test.Data.firstOrder.Total + test.Data.secondOrder.Total
+		assert.EqualValues(t, 30, rows[0].Cost)
+		assert.EqualValues(t, 5, rows[0].Shipping)
+		assert.EqualValues(t, 7, rows[0].Refunded)
+		assert.EqualValues(t, int64(total)-3-5-7-30, rows[0].Margin)
+	})
+	t.Run("BadInterval", func(t *testing.T) {
+		test := newReportTest(t)
+		validateError(t, http.StatusBadRequest, runReport(test, "/reports/sales?interval=year"), "interval")
+	})
+	t.Run("BadPeriod", func(t *testing.T) {
+		test := newReportTest(t)
+		validateError(t, http.StatusBadRequest, runReport(test, "/reports/sales?period=next_month"), "period")
+		validateError(t, http.StatusBadRequest, runReport(test, "/reports/sales?period=last_month&from=-P7D"), "period")
+	})
+}
+
+func TestProductsReport(t *testing.T) {
+	t.Run("TopSkus", func(t *testing.T) {
+		test := newReportTest(t)
+		rows := []*productsRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/products?limit=2"), &rows)
+		require.Len(t, rows, 2)
+		assert.Equal(t, "234-fancy-belts", rows[0].Sku)
+		assert.EqualValues(t, 45, rows[0].Total)
+		assert.Equal(t, test.Data.firstLineItem.Sku, rows[1].Sku)
+		assert.EqualValues(t, 2, rows[1].Quantity)
+		assert.EqualValues(t, 1, rows[1].Orders)
+		assert.EqualValues(t, 24, rows[1].Total)
+	})
+	t.Run("Margin", func(t *testing.T) {
+		test := newReportTest(t)
+		// a coupon took 4 off the first line
+		require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumns(map[string]interface{}{"cost": 5, "line_net": 20}).Error)
+		rows := []*productsRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/products"), &rows)
+		for _, row := range rows {
+			if row.Sku != test.Data.firstLineItem.Sku {
+				assert.Equal(t, row.Total, row.Net)
+				assert.EqualValues(t, row.Net, row.Margin)
+				continue
+			}
+			assert.EqualValues(t, 24, row.Total)
+			assert.EqualValues(t, 20, row.Net)
+			assert.EqualValues(t, 10, row.Cost)
+			assert.EqualValues(t, 10, row.Margin)
+		}
+	})
+	t.Run("CostFromSite", func(t *testing.T) {
+		test := newReportTest(t)
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/cost-product", "quantity": 2}]
+		}`)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken), order)
+		require.NoError(t, test.DB.Model(order).UpdateColumn("payment_state", models.PaidState).Error)
+
+		rows := []*productsRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/products"), &rows)
+		var row *productsRow
+		for _, r := range rows {
+			if r.Sku == "product-cost" {
+				row = r
+			}
+		}
+		require.NotNil(t, row)
+		assert.EqualValues(t, 2000, row.Net)
+		assert.EqualValues(t, 1250, row.Cost)
+		assert.EqualValues(t, 750, row.Margin)
+
+		sales := []*salesRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/sales?from=-P1D"), &sales)
+		require.Len(t, sales, 1)
+		assert.EqualValues(t, 1250, sales[0].Cost)
+	})
+	t.Run("ByMonthTo", func(t *testing.T) {
+		test := newReportTest(t)
+		to := time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC).Unix()
+		rows := []*productsRow{}
+		extractPayload(t, http.StatusOK, runReport(test, fmt.Sprintf("/reports/products?interval=month&to=%d", to)), &rows)
+		require.Len(t, rows, 1)
+		assert.Equal(t, "2018-01-01", rows[0].Period)
+		assert.Equal(t, test.Data.firstLineItem.Sku, rows[0].Sku)
+	})
+	t.Run("ByPriceList", func(t *testing.T) {
+		test := newReportTest(t)
+		require.NoError(t, test.DB.Model(&models.LineItem{}).Where("order_id = ?", test.Data.secondOrder.ID).UpdateColumn("price_list", "wholesale").Error)
+		rows := []*productsRow{}
+		extractPayload(t, http.StatusOK, runReport(test, "/reports/products?split=price_list"), &rows)
+		for _, row := range rows {
+			if row.Sku == test.Data.firstLineItem.Sku {
+				assert.Equal(t, "retail", row.PriceList)
+			} else {
+				assert.Equal(t, "wholesale", row.PriceList)
+			}
+		}
+	})
+}
+
+func newReportTest(t *testing.T) *RouteTest {
+	test := NewRouteTest(t)
+	require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("created_at", time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)).Error)
+	require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("created_at", time.Date(2018, 1, 17, 10, 0, 0, 0, time.UTC)).Error)
+	return test
+}
+
+func runReport(test *RouteTest, url string) *httptest.ResponseRecorder {
+	return test.TestEndpoint(http.MethodGet, url, nil, testAdminToken("admin", ""))
+}
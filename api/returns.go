@@ -0,0 +1,420 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// ReturnParams holds the parameters for returning line items of a paid order.
+// Only admins can give an override, to accept items that aren't eligible for
+// returns or to replace the refundable amount.
+type ReturnParams struct {
+	LineItems []*refundLineItem `json:"line_items"`
+	Reason    string            `json:"reason"`
+	Override  *ReturnOverride   `json:"override"`
+}
+
+// ReturnOverride replaces the refundable amount of a return that follows from
+// the return policy. It requires a reason.
+type ReturnOverride struct {
+	Amount *uint64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+// returnEligibility tells whether a line item can be returned, and why not.
+type returnEligibility struct {
+	LineItemID         int64      `json:"line_item_id"`
+	Sku                string     `json:"sku"`
+	Eligible           bool       `json:"eligible"`
+	Reason             string     `json:"reason,omitempty"`
+	ReturnableQuantity uint64     `json:"returnable_quantity"`
+	ReturnBy           *time.Time `json:"return_by,omitempty"`
+	RestockingFee      uint64     `json:"restocking_fee_percentage"`
+}
+
+// ReturnEligibility tells which line items of an order can be returned under the
+// return policy of the site, and until when.
+func (a *API) ReturnEligibility(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	order, httpErr := a.getReturnOrder(r, false)
+	if httpErr != nil {
+		return httpErr
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	pending, httpErr := a.pendingReturnQuantities(order.ID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	eligibility := make([]*returnEligibility, 0, len(order.LineItems))
+	for _, item := range order.LineItems {
+		eligibility = append(eligibility, checkReturnEligibility(settings.Returns, order, item, pending[item.ID], time.Now()))
+	}
+	return sendJSON(w, http.StatusOK, eligibility)
+}
+
+// ReturnList lists the returns of an order, oldest first.
+func (a *API) ReturnList(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.getReturnOrder(r, false)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	returns := []models.Return{}
+	if rsp := a.db.Preload("Items").Where("order_id = ?", order.ID).Order("created_at asc").Find(&returns); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, returns)
+}
+
+// ReturnCreate requests the return of line items of a paid order. The items
+// must be eligible under the return policy of the site, and the refundable
+// amount is their price with the taxes and discounts of the order, less the
+// restocking fees. Admins can accept ineligible items and set the amount with
+// an override.
+func (a *API) ReturnCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	params := &ReturnParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if len(params.LineItems) == 0 {
+		return badRequestError("A return requires line items")
+	}
+	isAdmin := gcontext.HasScope(ctx, ordersWriteScope)
+	if params.Override != nil && !isAdmin {
+		return unauthorizedError("Only admins can override returns")
+	}
+
+	order, httpErr := a.getReturnOrder(r, true)
+	if httpErr != nil {
+		return httpErr
+	}
+	if order.PaymentState != models.PaidState {
+		return badRequestError("Only paid orders can be returned")
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	pending, httpErr := a.pendingReturnQuantities(order.ID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	ret := &models.Return{
+		InstanceID: order.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		OrderID:    order.ID,
+		UserID:     order.UserID,
+		Reason:     params.Reason,
+		Currency:   order.Currency,
+		Status:     models.PendingState,
+	}
+	quantities := map[int64]uint64{}
+	ineligible := map[string]string{}
+	now := time.Now()
+	for _, p := range params.LineItems {
+		if _, ok := quantities[p.ID]; !ok {
+			ret.Items = append(ret.Items, &models.ReturnItem{LineItemID: p.ID})
+		}
+		quantities[p.ID] += p.Quantity
+	}
+	for _, ri := range ret.Items {
+		ri.Quantity = quantities[ri.LineItemID]
+		refunded, _, httpErr := refundedLineItems(order, []*refundLineItem{{ID: ri.LineItemID, Quantity: ri.Quantity}})
+		if httpErr != nil {
+			return httpErr
+		}
+		item := refunded.LineItems[0]
+		ri.Sku = item.Sku
+
+		eligibility := checkReturnEligibility(settings.Returns, order, item, pending[item.ID], now)
+		switch {
+		case ri.Quantity > eligibility.ReturnableQuantity && eligibility.ReturnableQuantity > 0:
+			ineligible[fmt.Sprint(item.ID)] = fmt.Sprintf("Only %d can be returned", eligibility.ReturnableQuantity)
+			continue
+		case !eligibility.Eligible:
+			ri.Ineligible = eligibility.Reason
+			if params.Override == nil {
+				ineligible[fmt.Sprint(item.ID)] = eligibility.Reason
+				continue
+			}
+		}
+
+		ri.Amount, err = a.refundedItemsTotal(ctx, settings, order, refunded)
+		if err != nil {
+			return internalServerError("Error pricing the returned items").WithInternalError(err)
+		}
+		if settings.Returns != nil {
+			ri.RestockingFee = settings.Returns.RuleFor(item.ProductType()).Fee(ri.Amount)
+		}
+		ri.Amount -= ri.RestockingFee
+		ret.Amount += ri.Amount
+		ret.RestockingFee += ri.RestockingFee
+	}
+	if len(ineligible) > 0 {
+		return unprocessableEntityError("Some of the line items can't be returned").WithData(ineligible)
+	}
+	if params.Override != nil {
+		if httpErr := overrideReturn(ret, params.Override, actorID(ctx)); httpErr != nil {
+			return httpErr
+		}
+	}
+
+	tx := a.db.Begin()
+	if rsp := tx.Create(ret); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving return").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, actorID(ctx), order.ID, models.EventUpdated, []string{"returns"})
+	tx.Commit()
+
+	log.Infof("Return %s of order %s requested for %d %s", ret.ID, order.ID, ret.RefundAmount(), ret.Currency)
+	return sendJSON(w, http.StatusCreated, ret)
+}
+
+// ReturnRefund refunds a pending return with its refundable amount, or the
+// amount of an override given with the request, through the payment provider
+// of the order. The returned items are put back in stock.
+func (a *API) ReturnRefund(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	override := &ReturnOverride{}
+	if err := json.NewDecoder(r.Body).Decode(override); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+
+	order, httpErr := a.getReturnOrder(r, true)
+	if httpErr != nil {
+		return httpErr
+	}
+	tx := a.db.Begin()
+	ret, httpErr := getPendingReturn(models.ForUpdate(tx), order.InstanceID, order.ID, chi.URLParam(r, "return_id"))
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if override.Amount != nil || override.Reason != "" {
+		if httpErr := overrideReturn(ret, override, actorID(ctx)); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+	}
+
+	amount := ret.RefundAmount()
+	if amount == 0 {
+		tx.Rollback()
+		return badRequestError("The return has no amount to refund")
+	}
+	var charge *models.Transaction
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.PaidState && t.Amount >= amount {
+			charge = t
+			break
+		}
+	}
+	if charge == nil {
+		tx.Rollback()
+		return badRequestError("No payment of the order covers a refund of %d", amount)
+	}
+
+	// the return is refunding while the provider refunds it, so concurrent
+	// requests can't refund it again
+	rsp := tx.Model(ret).Where("status = ?", models.PendingState).UpdateColumn("status", models.RefundingState)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving return").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return conflictError("The return is already being refunded")
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving return").WithInternalError(rsp.Error)
+	}
+
+	items := map[int64]uint64{}
+	for _, item := range ret.Items {
+		items[item.LineItemID] += item.Quantity
+	}
+	m, httpErr := a.refundTransaction(ctx, r, order, charge, amount, items)
+	if httpErr == nil && m.Status != models.PaidState {
+		httpErr = internalServerError("Refunding the return failed: %v", m.FailureDescription)
+	}
+	if httpErr != nil {
+		if rsp := a.db.Model(ret).UpdateColumn("status", models.PendingState); rsp.Error != nil {
+			getLogEntry(r).WithError(rsp.Error).Errorf("Error releasing return %s after its refund failed", ret.ID)
+		}
+		return httpErr
+	}
+
+	now := time.Now()
+	ret.Status = models.RefundedState
+	ret.RefundID = m.ID
+	ret.ReviewedBy = actorID(ctx)
+	ret.ReviewedAt = &now
+	if rsp := a.db.Save(ret); rsp.Error != nil {
+		return internalServerError("Error saving return").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// ReturnReject turns down a pending return.
+func (a *API) ReturnReject(w http.ResponseWriter, r *http.Request) error {
+	ret, httpErr := getPendingReturn(a.db, gcontext.GetInstanceID(r.Context()), gcontext.GetOrderID(r.Context()), chi.URLParam(r, "return_id"))
+	if httpErr != nil {
+		return httpErr
+	}
+
+	now := time.Now()
+	rsp := a.db.Model(ret).Where("status = ?", models.PendingState).UpdateColumns(map[string]interface{}{
+		"status":      models.RejectedState,
+		"reviewed_by": actorID(r.Context()),
+		"reviewed_at": &now,
+	})
+	if rsp.Error != nil {
+		return internalServerError("Error saving return").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		return conflictError("The return is already being refunded")
+	}
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// getReturnOrder loads the order of the request, if the requester has access
+// to it. With write, reading the order isn't enough for admins.
+func (a *API) getReturnOrder(r *http.Request, write bool) (*models.Order, *HTTPError) {
+	ctx := r.Context()
+	order := &models.Order{}
+	if rsp := orderQuery(a.db).First(order, "id = ? AND instance_id = ?", gcontext.GetOrderID(ctx), gcontext.GetInstanceID(ctx)); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	claims := gcontext.GetClaims(ctx)
+	isBuyer := order.UserID == "" || (claims != nil && claims.Subject == order.UserID)
+	scope := ordersReadScope
+	if write {
+		scope = ordersWriteScope
+	}
+	if !isBuyer && !gcontext.HasScope(ctx, scope) {
+		return nil, unauthorizedError("You don't have access to this order")
+	}
+	return order, nil
+}
+
+func getPendingReturn(db *gorm.DB, instanceID, orderID, returnID string) (*models.Return, *HTTPError) {
+	ret := &models.Return{}
+	if rsp := db.Preload("Items").Where("order_id = ? AND instance_id = ?", orderID, instanceID).First(ret, "id = ?", returnID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("Return not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if ret.Status != models.PendingState {
+		return nil, badRequestError("The return is already %s", ret.Status)
+	}
+	return ret, nil
+}
+
+// pendingReturnQuantities returns the quantities of the line items of an order
+// in returns that weren't refunded or rejected yet.
+func (a *API) pendingReturnQuantities(orderID string) (map[int64]uint64, *HTTPError) {
+	returns := []models.Return{}
+	if rsp := a.db.Preload("Items").Where("order_id = ? AND status = ?", orderID, models.PendingState).Find(&returns); rsp.Error != nil {
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	quantities := map[int64]uint64{}
+	for _, ret := range returns {
+		for _, item := range ret.Items {
+			quantities[item.LineItemID] += item.Quantity
+		}
+	}
+	return quantities, nil
+}
+
+// overrideReturn replaces the refundable amount of a return on behalf of an
+// admin.
+func overrideReturn(ret *models.Return, override *ReturnOverride, adminID string) *HTTPError {
+	if strings.TrimSpace(override.Reason) == "" {
+		return badRequestError("Overriding a return requires a reason")
+	}
+	amount := ret.Amount
+	if override.Amount != nil {
+		amount = *override.Amount
+	}
+	ret.OverrideAmount = &amount
+	ret.OverrideReason = override.Reason
+	ret.OverriddenBy = adminID
+	return nil
+}
+
+// orderPaidAt returns when the first charge of an order was paid, or nil when
+// none was. The transactions of the order must be loaded.
+func orderPaidAt(order *models.Order) *time.Time {
+	var paidAt *time.Time
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.PaidState && (paidAt == nil || t.CreatedAt.Before(*paidAt)) {
+			createdAt := t.CreatedAt
+			paidAt = &createdAt
+		}
+	}
+	return paidAt
+}
+
+// checkReturnEligibility applies a return policy to a line item of an order.
+// The return window starts when the order was paid.
+func checkReturnEligibility(policy *calculator.ReturnPolicy, order *models.Order, item *models.LineItem, pending uint64, now time.Time) *returnEligibility {
+	e := &returnEligibility{LineItemID: item.ID, Sku: item.Sku}
+	if returned := item.RefundedQuantity + pending; returned < item.Quantity {
+		e.ReturnableQuantity = item.Quantity - returned
+	}
+
+	paidAt := orderPaidAt(order)
+
+	var rule *calculator.ReturnRule
+	if policy != nil {
+		rule = policy.RuleFor(item.ProductType())
+		e.RestockingFee = rule.RestockingFee
+	}
+	switch {
+	case rule == nil:
+		e.Reason = "The shop doesn't accept returns"
+	case paidAt == nil || order.PaymentState != models.PaidState:
+		e.Reason = "The order hasn't been paid"
+	case item.NonReturnable:
+		e.Reason = "The product can't be returned"
+	case rule.WindowDays <= 0:
+		e.Reason = fmt.Sprintf("Products of type '%v' can't be returned", item.ProductType())
+	default:
+		returnBy := paidAt.AddDate(0, 0, rule.WindowDays)
+		e.ReturnBy = &returnBy
+		if now.After(returnBy) {
+			e.Reason = fmt.Sprintf("The return window closed on %v", returnBy.Format("2006-01-02"))
+		} else if e.ReturnableQuantity == 0 {
+			e.Reason = "All of the items were returned already"
+		} else {
+			e.Eligible = true
+		}
+	}
+	return e
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestReturns(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	newTest := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		return test
+	}
+	returnParams := func(t *testing.T, params *ReturnParams) *bytes.Buffer {
+		body, err := json.Marshal(params)
+		require.NoError(t, err)
+		return bytes.NewBuffer(body)
+	}
+	allItems := []*refundLineItem{{ID: 11, Quantity: 2}}
+
+	t.Run("Eligibility", func(t *testing.T) {
+		test := newTest(t)
+		w := test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder+"/returns/eligibility", nil, test.Data.testUserToken)
+		eligibility := []*returnEligibility{}
+		extractPayload(t, http.StatusOK, w, &eligibility)
+		require.Len(t, eligibility, 1)
+		assert.True(t, eligibility[0].Eligible)
+		assert.EqualValues(t, 2, eligibility[0].ReturnableQuantity)
+		assert.EqualValues(t, 10, eligibility[0].RestockingFee)
+		require.NotNil(t, eligibility[0].ReturnBy)
+		assert.WithinDuration(t, test.Data.firstTransaction.CreatedAt.AddDate(0, 0, 30), *eligibility[0].ReturnBy, time.Second)
+	})
+	t.Run("Create", func(t *testing.T) {
+		test := newTest(t)
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems, Reason: "Too fast"}), test.Data.testUserToken)
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, w, ret)
+		assert.Equal(t, models.PendingState, ret.Status)
+		assert.EqualValues(t, 22, ret.Amount)
+		assert.EqualValues(t, 2, ret.RestockingFee)
+		require.Len(t, ret.Items, 1)
+		assert.EqualValues(t, 2, ret.Items[0].Quantity)
+
+		// the items of the pending return can't be returned again
+		w = test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder+"/returns/eligibility", nil, test.Data.testUserToken)
+		eligibility := []*returnEligibility{}
+		extractPayload(t, http.StatusOK, w, &eligibility)
+		require.Len(t, eligibility, 1)
+		assert.False(t, eligibility[0].Eligible)
+		assert.EqualValues(t, 0, eligibility[0].ReturnableQuantity)
+
+		w = test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems}), test.Data.testUserToken)
+		validateError(t, http.StatusUnprocessableEntity, w)
+	})
+	t.Run("OrderDiscounts", func(t *testing.T) {
+		test := newTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("manual_discount", 12).Error)
+
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems}), test.Data.testUserToken)
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, w, ret)
+		// half of the price of the items was taken off the order
+		assert.EqualValues(t, 11, ret.Amount)
+		assert.EqualValues(t, 1, ret.RestockingFee)
+	})
+	t.Run("WindowClosed", func(t *testing.T) {
+		test := newTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("created_at", time.Now().AddDate(0, 0, -40)).Error)
+
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems}), test.Data.testUserToken)
+		validateError(t, http.StatusUnprocessableEntity, w)
+
+		// admins can accept the return anyway
+		override := &ReturnOverride{Reason: "Loyal customer"}
+		w = test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems, Override: override}), testAdminToken("magical-unicorn", ""))
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, w, ret)
+		require.Len(t, ret.Items, 1)
+		assert.Contains(t, ret.Items[0].Ineligible, "return window closed")
+		require.NotNil(t, ret.OverrideAmount)
+		assert.EqualValues(t, 22, *ret.OverrideAmount)
+		assert.Equal(t, "Loyal customer", ret.OverrideReason)
+		assert.Equal(t, "magical-unicorn", ret.OverriddenBy)
+	})
+	t.Run("NonReturnable", func(t *testing.T) {
+		test := newTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumn("non_returnable", true).Error)
+
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems}), test.Data.testUserToken)
+		validateError(t, http.StatusUnprocessableEntity, w)
+	})
+	t.Run("OverrideByBuyer", func(t *testing.T) {
+		test := newTest(t)
+		override := &ReturnOverride{Reason: "Please"}
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems, Override: override}), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, w)
+	})
+	t.Run("OverrideWithoutReason", func(t *testing.T) {
+		test := newTest(t)
+		amount := uint64(5)
+		override := &ReturnOverride{Amount: &amount}
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems, Override: override}), testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, w)
+	})
+	t.Run("Refund", func(t *testing.T) {
+		test := newTest(t)
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems}), test.Data.testUserToken)
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, w, ret)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		amount := uint64(20)
+		w = runReturnRefund(test, provider, ret.ID, &ReturnOverride{Amount: &amount, Reason: "Box was damaged"})
+		extractPayload(t, http.StatusOK, w, ret)
+		assert.Equal(t, models.RefundedState, ret.Status)
+		assert.NotEmpty(t, ret.RefundID)
+		assert.Equal(t, "magical-unicorn", ret.ReviewedBy)
+		require.Len(t, provider.refundCalls, 1)
+		assert.EqualValues(t, 20, provider.refundCalls[0].amount)
+
+		item := &models.LineItem{ID: test.Data.firstLineItem.ID}
+		require.NoError(t, test.DB.First(item).Error)
+		assert.EqualValues(t, 2, item.RefundedQuantity)
+
+		w = runReturnRefund(test, provider, ret.ID, &ReturnOverride{})
+		validateError(t, http.StatusBadRequest, w)
+	})
+	t.Run("Refunding", func(t *testing.T) {
+		test := newTest(t)
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems}), test.Data.testUserToken)
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, w, ret)
+		require.NoError(t, test.DB.Model(ret).UpdateColumn("status", models.RefundingState).Error)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		w = runReturnRefund(test, provider, ret.ID, &ReturnOverride{})
+		validateError(t, http.StatusBadRequest, w, "The return is already refunding")
+		assert.Empty(t, provider.refundCalls)
+
+		w = test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns/"+ret.ID+"/reject", nil, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, w)
+	})
+	t.Run("Reject", func(t *testing.T) {
+		test := newTest(t)
+		w := test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns", returnParams(t, &ReturnParams{LineItems: allItems}), test.Data.testUserToken)
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, w, ret)
+
+		w = test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns/"+ret.ID+"/reject", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, w)
+
+		w = test.TestEndpoint(http.MethodPost, test.Data.urlForFirstOrder+"/returns/"+ret.ID+"/reject", nil, testAdminToken("magical-unicorn", ""))
+		extractPayload(t, http.StatusOK, w, ret)
+		assert.Equal(t, models.RejectedState, ret.Status)
+
+		w = test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder+"/returns", nil, test.Data.testUserToken)
+		returns := []*models.Return{}
+		extractPayload(t, http.StatusOK, w, &returns)
+		require.Len(t, returns, 1)
+		assert.Equal(t, models.RejectedState, returns[0].Status)
+	})
+}
+
+func runReturnRefund(test *RouteTest, provider payments.Provider, returnID string, params *ReturnOverride) *httptest.ResponseRecorder {
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(test.T, err)
+	ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{provider.Name(): provider})
+
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/returns/"+returnID+"/refund", bytes.NewBuffer(body))
+	require.NoError(test.T, signHTTPRequest(r, testAdminToken("magical-unicorn", ""), test.Config.JWT.Secret))
+
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion).handler.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/tracing"
+)
+
+const (
+	defaultSettingsPath = "/gocommerce/settings.json"
+	defaultSettingsTTL  = time.Minute
+)
+
+type publicSettings struct {
+	*calculator.Settings
+	Payment publicPaymentSettings `json:"payment"`
+}
+
+type publicPaymentSettings struct {
+	Stripe *publicStripeSettings `json:"stripe,omitempty"`
+	PayPal *publicPayPalSettings `json:"paypal,omitempty"`
+}
+
+type publicStripeSettings struct {
+	PublicKey string `json:"public_key"`
+}
+
+type publicPayPalSettings struct {
+	ClientID string `json:"client_id"`
+	Env      string `json:"env"`
+}
+
+// SettingsView returns the settings of the site the prices are calculated
+// with, like taxes and member discounts, together with the public keys of the
+// enabled payment providers.
+func (a *API) SettingsView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+
+	rsp := &publicSettings{Settings: settings}
+	if config.Payment.Stripe.Enabled {
+		rsp.Payment.Stripe = &publicStripeSettings{PublicKey: config.Payment.Stripe.PublicKey}
+	}
+	if config.Payment.PayPal.Enabled {
+		rsp.Payment.PayPal = &publicPayPalSettings{ClientID: config.Payment.PayPal.ClientID, Env: config.Payment.PayPal.Env}
+	}
+	return sendJSON(w, http.StatusOK, rsp)
+}
+
+// settingsCache holds the settings loaded from each site. Entries are
+// revalidated with their ETag once they expire.
+type settingsCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cachedSettings
+}
+
+type cachedSettings struct {
+	settings  *calculator.Settings
+	etag      string
+	expiresAt time.Time
+}
+
+func (c *settingsCache) get(url string) *cachedSettings {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.entries[url]
+}
+
+func (c *settingsCache) set(url string, entry *cachedSettings) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]*cachedSettings{}
+	}
+	c.entries[url] = entry
+}
+
+// loadSettings returns the settings of the instance's site. A site without a
+// settings file gets the empty settings. When the site can't be reached, or
+// fails or returns invalid settings, the last good settings are used, if
+// any. Failures are never cached, so the next request tries again.
+func (a *API) loadSettings(ctx context.Context) (*calculator.Settings, error) {
+	config := gcontext.GetConfig(ctx)
+	url := config.SiteURL + settingsPath(config)
+
+	cached := a.settings.get(url)
+	if cached != nil && time.Now().Before(cached.expiresAt) {
+		return cached.settings, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading site settings: %v", err)
+	}
+	if cached != nil && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		req.Header.Set(tracing.Header, traceID)
+	}
+
+	lastGood := func(err error) (*calculator.Settings, error) {
+		if cached != nil {
+			return cached.settings, nil
+		}
+		return nil, err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return lastGood(fmt.Errorf("Error loading site settings: %v", err))
+	}
+	defer resp.Body.Close()
+
+	entry := &cachedSettings{
+		settings:  &calculator.Settings{},
+		etag:      resp.Header.Get("ETag"),
+		expiresAt: time.Now().Add(settingsTTL(config)),
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		if cached == nil {
+			return nil, fmt.Errorf("Error loading site settings: unexpected %v response", resp.StatusCode)
+		}
+		entry.settings = cached.settings
+		entry.etag = cached.etag
+	case resp.StatusCode == http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(entry.settings); err != nil {
+			return lastGood(fmt.Errorf("Error parsing site settings: %v", err))
+		}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return lastGood(fmt.Errorf("Error loading site settings: unexpected %v response", resp.StatusCode))
+	}
+
+	a.settings.set(url, entry)
+	return entry.settings, nil
+}
+
+func settingsPath(config *conf.Configuration) string {
+	if config.Settings.Path == "" {
+		return defaultSettingsPath
+	}
+	return config.Settings.Path
+}
+
+func settingsTTL(config *conf.Configuration) time.Duration {
+	if config.Settings.TTL <= 0 {
+		return defaultSettingsTTL
+	}
+	return time.Duration(config.Settings.TTL) * time.Second
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+)
+
+const testSettings = `{"prices_include_taxes": true, "taxes": [{"percentage": 19, "product_types": ["book"], "countries": ["Germany"]}]}`
+
+func TestSettingsView(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Payment.Stripe.Enabled = true
+	test.Config.Payment.Stripe.PublicKey = "pk_test_123"
+	test.Config.Payment.Stripe.SecretKey = "sk_test_123"
+
+	recorder := test.TestEndpoint(http.MethodGet, "/settings", nil, nil)
+	assert.NotContains(t, recorder.Body.String(), "sk_test_123")
+
+	rsp := &publicSettings{}
+	extractPayload(t, http.StatusOK, recorder, rsp)
+	require.Len(t, rsp.Taxes, 2)
+	assert.EqualValues(t, 19, rsp.Taxes[0].Percentage)
+	require.NotNil(t, rsp.Payment.Stripe)
+	assert.Equal(t, "pk_test_123", rsp.Payment.Stripe.PublicKey)
+	assert.Nil(t, rsp.Payment.PayPal)
+}
+
+func TestLoadSettings(t *testing.T) {
+	t.Run("Cached", func(t *testing.T) {
+		test := NewRouteTest(t)
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			fmt.Fprint(w, testSettings)
+		}))
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		api, ctx := newSettingsTestAPI(test)
+		first, err := api.loadSettings(ctx)
+		require.NoError(t, err)
+		second, err := api.loadSettings(ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, requests)
+		assert.True(t, first.PricesIncludeTaxes)
+		assert.Equal(t, first, second)
+	})
+	t.Run("Revalidated", func(t *testing.T) {
+		test := NewRouteTest(t)
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			fmt.Fprint(w, testSettings)
+		}))
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		api, ctx := newSettingsTestAPI(test)
+		_, err := api.loadSettings(ctx)
+		require.NoError(t, err)
+		expireSettings(api)
+
+		settings, err := api.loadSettings(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2, requests)
+		assert.True(t, settings.PricesIncludeTaxes)
+		require.Len(t, settings.Taxes, 1)
+	})
+	t.Run("SiteDown", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, testSettings)
+		}))
+		test.Config.SiteURL = server.URL
+
+		api, ctx := newSettingsTestAPI(test)
+		_, err := api.loadSettings(ctx)
+		require.NoError(t, err)
+		server.Close()
+		expireSettings(api)
+
+		settings, err := api.loadSettings(ctx)
+		require.NoError(t, err)
+		assert.True(t, settings.PricesIncludeTaxes)
+	})
+	t.Run("SiteFailing", func(t *testing.T) {
+		test := NewRouteTest(t)
+		var response string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch response {
+			case "error":
+				w.WriteHeader(http.StatusBadGateway)
+			case "invalid":
+				fmt.Fprint(w, `{"prices_include_taxes":`)
+			default:
+				fmt.Fprint(w, testSettings)
+			}
+		}))
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		api, ctx := newSettingsTestAPI(test)
+		response = "error"
+		_, err := api.loadSettings(ctx)
+		require.Error(t, err)
+
+		response = ""
+		_, err = api.loadSettings(ctx)
+		require.NoError(t, err)
+
+		for _, response = range []string{"error", "invalid"} {
+			expireSettings(api)
+			settings, err := api.loadSettings(ctx)
+			require.NoError(t, err, response)
+			assert.True(t, settings.PricesIncludeTaxes, response)
+		}
+	})
+	t.Run("CustomPath", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/.netlify/gocommerce.json" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, testSettings)
+		}))
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+		test.Config.Settings.Path = "/.netlify/gocommerce.json"
+
+		api, ctx := newSettingsTestAPI(test)
+		settings, err := api.loadSettings(ctx)
+		require.NoError(t, err)
+		assert.True(t, settings.PricesIncludeTaxes)
+	})
+	t.Run("Missing", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		api, ctx := newSettingsTestAPI(test)
+		settings, err := api.loadSettings(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, &calculator.Settings{}, settings)
+	})
+}
+
+func newSettingsTestAPI(test *RouteTest) (*API, context.Context) {
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(test.T, err)
+	return NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion), ctx
+}
+
+func expireSettings(api *API) {
+	for _, entry := range api.settings.entries {
+		entry.expiresAt = time.Now().Add(-time.Second)
+	}
+}
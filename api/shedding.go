@@ -0,0 +1,110 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priority classes of requests for load shedding. When the server is
+// overloaded, low priority requests are rejected first, and critical requests
+// last.
+type priority int
+
+const (
+	lowPriority priority = iota
+	normalPriority
+	criticalPriority
+)
+
+// latencyWeight is the weight of a new response time in the moving average.
+const latencyWeight = 0.1
+
+// loadShedder tracks the requests in flight and the average response time,
+// and rejects requests the server can't take on any more.
+type loadShedder struct {
+	maxInFlight   int
+	targetLatency time.Duration
+
+	mutex    sync.Mutex
+	inFlight int
+	latency  time.Duration
+}
+
+func newLoadShedder(maxInFlight int, targetLatency time.Duration) *loadShedder {
+	return &loadShedder{maxInFlight: maxInFlight, targetLatency: targetLatency}
+}
+
+// requestPriority classifies a request. Creating and paying orders is critical
+// and reports and exports can wait, everything else is in between. Health
+// checks are critical too, so load balancers don't take a busy server out.
+func requestPriority(r *http.Request) priority {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/health":
+		return criticalPriority
+	case r.Method == http.MethodPost && (path == "/orders" || path == "/paypal"):
+		return criticalPriority
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/orders/") && strings.HasSuffix(path, "/payments"):
+		return criticalPriority
+	case strings.HasPrefix(path, "/reports/") || path == "/orders/export":
+		return lowPriority
+	}
+	return normalPriority
+}
+
+// limit returns the number of requests in flight up to which requests of a
+// priority are accepted.
+func (s *loadShedder) limit(p priority) int {
+	overloaded := s.targetLatency > 0 && s.latency > s.targetLatency
+	switch p {
+	case criticalPriority:
+		return s.maxInFlight
+	case normalPriority:
+		if overloaded {
+			return s.maxInFlight / 2
+		}
+		return s.maxInFlight * 4 / 5
+	default:
+		if overloaded {
+			return 0
+		}
+		return s.maxInFlight / 2
+	}
+}
+
+// acquire counts a new request in flight, unless it must be rejected.
+func (s *loadShedder) acquire(p priority) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.inFlight >= s.limit(p) {
+		return false
+	}
+	s.inFlight++
+	return true
+}
+
+// release marks a request as done and adds its response time to the average.
+func (s *loadShedder) release(elapsed time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inFlight--
+	s.latency = time.Duration(float64(s.latency)*(1-latencyWeight) + float64(elapsed)*latencyWeight)
+}
+
+// handler rejects requests with a 503 when the server is overloaded.
+func (s *loadShedder) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := requestPriority(r)
+		if !s.acquire(p) {
+			getLogEntry(r).WithField("priority", p).Warn("Shedding load")
+			w.Header().Set("Retry-After", "1")
+			handleError(serviceUnavailableError("The server is overloaded, please try again later"), w, r)
+			return
+		}
+		start := time.Now()
+		defer func() { s.release(time.Since(start)) }()
+		next.ServeHTTP(w, r)
+	})
+}
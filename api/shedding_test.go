@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestPriority(t *testing.T) {
+	cases := []struct {
+		method   string
+		path     string
+		expected priority
+	}{
+		{http.MethodPost, "/orders", criticalPriority},
+		{http.MethodPost, "/orders/", criticalPriority},
+		{http.MethodPost, "/orders/first-order/payments", criticalPriority},
+		{http.MethodPost, "/paypal", criticalPriority},
+		{http.MethodGet, "/health", criticalPriority},
+		{http.MethodGet, "/orders", normalPriority},
+		{http.MethodGet, "/orders/first-order/payments", normalPriority},
+		{http.MethodGet, "/reports/sales", lowPriority},
+		{http.MethodGet, "/reports/products", lowPriority},
+		{http.MethodGet, "/orders/export", lowPriority},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		assert.Equal(t, c.expected, requestPriority(r), "%s %s", c.method, c.path)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	t.Run("ReservesHeadroom", func(t *testing.T) {
+		s := newLoadShedder(10, 0)
+		for i := 0; i < 5; i++ {
+			require.True(t, s.acquire(lowPriority))
+		}
+		assert.False(t, s.acquire(lowPriority))
+		for i := 0; i < 3; i++ {
+			require.True(t, s.acquire(normalPriority))
+		}
+		assert.False(t, s.acquire(normalPriority))
+		require.True(t, s.acquire(criticalPriority))
+		require.True(t, s.acquire(criticalPriority))
+		assert.False(t, s.acquire(criticalPriority))
+
+		s.release(time.Millisecond)
+		assert.False(t, s.acquire(normalPriority))
+		assert.True(t, s.acquire(criticalPriority))
+	})
+	t.Run("SlowResponses", func(t *testing.T) {
+		s := newLoadShedder(10, 100*time.Millisecond)
+		for i := 0; i < 50; i++ {
+			require.True(t, s.acquire(normalPriority))
+			s.release(time.Second)
+		}
+		assert.False(t, s.acquire(lowPriority))
+		for i := 0; i < 5; i++ {
+			require.True(t, s.acquire(normalPriority))
+		}
+		assert.False(t, s.acquire(normalPriority))
+		assert.True(t, s.acquire(criticalPriority))
+	})
+	t.Run("Rejects", func(t *testing.T) {
+		s := newLoadShedder(1, 0)
+		called := false
+		handler := s.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reports/sales", nil))
+		assert.False(t, called)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", nil))
+		assert.True(t, called)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 0, s.inFlight)
+	})
+}
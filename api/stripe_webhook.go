@@ -0,0 +1,200 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/webhook"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// maxWebhookSize is the largest event body accepted from payment providers.
+const maxWebhookSize = 1 << 20
+
+// StripeWebhook receives the events Stripe sends to the endpoint configured
+// with the webhook secret. Events are verified with the Stripe-Signature
+// header, and events that aren't handled are acknowledged and ignored.
+// Besides the invoices of subscriptions, the events of charges keep the
+// transactions of orders in sync with Stripe.
+func (a *API) StripeWebhook(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	log := getLogEntry(r)
+
+	secret := config.Payment.Stripe.WebhookSecret
+	if secret == "" {
+		return notFoundError("Stripe webhooks are not configured")
+	}
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+	if err != nil {
+		return badRequestError("Could not read webhook: %v", err)
+	}
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), secret)
+	if err != nil {
+		return badRequestError("Invalid webhook: %v", err)
+	}
+
+	log = log.WithField("stripe_event", event.ID)
+	var httpErr *HTTPError
+	switch event.Type {
+	case "invoice.payment_succeeded", "invoice.payment_failed":
+		invoice := &stripe.Invoice{}
+		if err := json.Unmarshal(event.Data.Raw, invoice); err != nil {
+			return badRequestError("Could not read invoice: %v", err)
+		}
+		httpErr = a.handleStripeInvoice(r, event.Type, invoice)
+	case "customer.subscription.updated", "customer.subscription.deleted":
+		sub := &stripe.Sub{}
+		if err := json.Unmarshal(event.Data.Raw, sub); err != nil {
+			return badRequestError("Could not read subscription: %v", err)
+		}
+		httpErr = a.handleStripeSubscription(r, sub)
+	case "charge.succeeded", "charge.failed", "charge.refunded":
+		charge := &stripe.Charge{}
+		if err := json.Unmarshal(event.Data.Raw, charge); err != nil {
+			return badRequestError("Could not read charge: %v", err)
+		}
+		httpErr = a.handleStripeCharge(r, event.Type, charge)
+	case "charge.dispute.created":
+		dispute := &stripe.Dispute{}
+		if err := json.Unmarshal(event.Data.Raw, dispute); err != nil {
+			return badRequestError("Could not read dispute: %v", err)
+		}
+		httpErr = a.applyPaymentEvent(r, payments.StripeProvider, &paymentEvent{
+			Type:          disputeOpenedEvent,
+			ChargeIDs:     []string{dispute.Charge},
+			DisputeID:     dispute.ID,
+			DisputeReason: string(dispute.Reason),
+		})
+	default:
+		log.Debugf("Ignoring Stripe event %v", event.Type)
+	}
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// handleStripeInvoice creates the order of a paid invoice of a subscription,
+// and marks subscriptions with failed payments as past due.
+func (a *API) handleStripeInvoice(r *http.Request, eventType string, invoice *stripe.Invoice) *HTTPError {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	if invoice.Sub == "" {
+		return nil
+	}
+	sub, err := models.GetSubscriptionByProcessorID(a.db, payments.StripeProvider, invoice.Sub)
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if sub == nil || sub.InstanceID != gcontext.GetInstanceID(ctx) {
+		log.Infof("Ignoring invoice %v of unknown subscription %v", invoice.ID, invoice.Sub)
+		return nil
+	}
+
+	if eventType == "invoice.payment_failed" {
+		sub.State = models.PastDueState
+		if rsp := a.db.Save(sub); rsp.Error != nil {
+			return internalServerError("Error saving subscription").WithInternalError(rsp.Error)
+		}
+		return nil
+	}
+
+	if rsp := a.db.Preload("ShippingAddress").Preload("BillingAddress").First(sub, "id = ?", sub.ID); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	tx := a.db.Begin()
+	tr, httpErr := createRenewalOrder(tx, r, gcontext.GetConfig(ctx), sub, invoice)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if tr == nil {
+		tx.Rollback()
+		return nil
+	}
+	if invoice.End > 0 {
+		periodEnd := time.Unix(invoice.End, 0)
+		sub.CurrentPeriodEnd = &periodEnd
+	}
+	sub.State = models.ActiveState
+	if rsp := tx.Save(sub); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving subscription").WithInternalError(rsp.Error)
+	}
+	enqueueMail(ctx, tx, log, models.OrderConfirmationMailJob, &mailJob{TransactionID: tr.ID})
+	enqueueMail(ctx, tx, log, models.OrderReceivedMailJob, &mailJob{TransactionID: tr.ID})
+	tx.Commit()
+
+	log.WithField("order_id", tr.OrderID).Infof("Created order for invoice %v of subscription %v", invoice.ID, sub.ID)
+	return nil
+}
+
+// handleStripeCharge applies the events of a charge. A refunded charge has
+// the refunds made so far, which are recorded once they succeeded.
+func (a *API) handleStripeCharge(r *http.Request, eventType string, charge *stripe.Charge) *HTTPError {
+	chargeIDs := []string{charge.ID}
+	switch eventType {
+	case "charge.succeeded":
+		return a.applyPaymentEvent(r, payments.StripeProvider, &paymentEvent{Type: chargeSucceededEvent, ChargeIDs: chargeIDs})
+	case "charge.failed":
+		return a.applyPaymentEvent(r, payments.StripeProvider, &paymentEvent{
+			Type:               chargeFailedEvent,
+			ChargeIDs:          chargeIDs,
+			FailureCode:        charge.FailCode,
+			FailureDescription: charge.FailMsg,
+		})
+	}
+	if charge.Refunds == nil {
+		return nil
+	}
+	for _, refund := range charge.Refunds.Values {
+		if refund.Status != "succeeded" {
+			continue
+		}
+		httpErr := a.applyPaymentEvent(r, payments.StripeProvider, &paymentEvent{
+			Type:      refundCompletedEvent,
+			ChargeIDs: chargeIDs,
+			RefundID:  refund.ID,
+			Amount:    refund.Amount,
+		})
+		if httpErr != nil {
+			return httpErr
+		}
+	}
+	return nil
+}
+
+// handleStripeSubscription keeps the state of a subscription in sync when it
+// changes with Stripe, like when it is canceled from the Stripe dashboard.
+func (a *API) handleStripeSubscription(r *http.Request, stripeSub *stripe.Sub) *HTTPError {
+	sub, err := models.GetSubscriptionByProcessorID(a.db, payments.StripeProvider, stripeSub.ID)
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if sub == nil || sub.InstanceID != gcontext.GetInstanceID(r.Context()) {
+		return nil
+	}
+
+	var customerID string
+	if stripeSub.Customer != nil {
+		customerID = stripeSub.Customer.ID
+	}
+	setSubscriptionResult(sub, &payments.SubscriptionResult{
+		ID:                stripeSub.ID,
+		CustomerID:        customerID,
+		Status:            string(stripeSub.Status),
+		CancelAtPeriodEnd: stripeSub.EndCancel,
+		CurrentPeriodEnd:  time.Unix(stripeSub.PeriodEnd, 0),
+	})
+	if rsp := a.db.Save(sub); rsp.Error != nil {
+		return internalServerError("Error saving subscription").WithInternalError(rsp.Error)
+	}
+	return nil
+}
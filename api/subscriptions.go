@@ -0,0 +1,356 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/breaker"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// SubscriptionParams holds the parameters for subscribing to a recurring
+// product. The token of the payment method is read by the payment provider,
+// like the stripe_token for Stripe.
+type SubscriptionParams struct {
+	Path     string `json:"path"`
+	Sku      string `json:"sku"`
+	Quantity uint64 `json:"quantity"`
+	Provider string `json:"provider"`
+
+	ShippingAddress   *models.Address `json:"shipping_address"`
+	ShippingAddressID string          `json:"shipping_address_id"`
+
+	BillingAddress   *models.Address `json:"billing_address"`
+	BillingAddressID string          `json:"billing_address_id"`
+
+	// SaveToAddressBook adds new addresses to the address book of the user.
+	SaveToAddressBook bool `json:"save_to_address_book"`
+}
+
+// SubscriptionList lists the subscriptions of the user. Admins get the
+// subscriptions of all users, or of the user in the user_id parameter.
+// Users with the orders:read permission see them like admins.
+func (a *API) SubscriptionList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	query := a.readDB(r).Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	if !gcontext.HasScope(ctx, ordersReadScope) {
+		query = query.Where("user_id = ?", gcontext.GetClaims(ctx).Subject)
+	} else if userID := r.URL.Query().Get("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Subscription{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	subs := []models.Subscription{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&subs); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, subs)
+}
+
+// SubscriptionView returns a subscription of the user.
+func (a *API) SubscriptionView(w http.ResponseWriter, r *http.Request) error {
+	sub, httpErr := a.getSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, sub)
+}
+
+// SubscriptionCreate subscribes the user to the plan of a recurring product
+// with a payment provider. The orders of the subscription are created when
+// the provider reports the payment of its invoices.
+func (a *API) SubscriptionCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := gcontext.GetClaims(ctx)
+	log := getLogEntry(r)
+
+	params := &SubscriptionParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Path == "" {
+		return badRequestError("Subscribing requires the 'path' of a product")
+	}
+	if params.Quantity == 0 {
+		params.Quantity = 1
+	}
+	if claims.Email == "" {
+		return badRequestError("Subscribing requires a user with an email")
+	}
+
+	provider := gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.Provider)]
+	if provider == nil {
+		return badRequestError("Payment provider '%s' not configured", params.Provider)
+	}
+	subscriptions, ok := provider.(payments.SubscriptionProvider)
+	if !ok {
+		return badRequestError("Payment provider '%s' doesn't support subscriptions", params.Provider)
+	}
+	subscribe, err := subscriptions.NewSubscriber(ctx, r)
+	if err != nil {
+		return badRequestError("Error creating payment provider: %v", err)
+	}
+	cancel, err := subscriptions.NewSubscriptionCanceler(ctx, r)
+	if err != nil {
+		return internalServerError("Error creating payment provider").WithInternalError(err)
+	}
+
+	metaProducts, err := a.loadProductMetadata(ctx, params.Path)
+	if err != nil {
+		if err == breaker.ErrOpen {
+			return serviceUnavailableError("The products of this shop can't be loaded right now, please try again later")
+		}
+		return internalServerError("Error loading product").WithInternalError(err)
+	}
+	var meta *models.LineItemMetadata
+	for _, m := range metaProducts {
+		if m.Sku == params.Sku || (params.Sku == "" && len(metaProducts) == 1) {
+			meta = m
+			break
+		}
+	}
+	if meta == nil {
+		return badRequestError("No product Sku from path matched: %v", params.Sku)
+	}
+	if meta.Subscription == nil || meta.Subscription.Plan == "" {
+		return badRequestError("%v is not a recurring product", meta.Sku)
+	}
+
+	sub := &models.Subscription{
+		InstanceID: gcontext.GetInstanceID(ctx),
+		ID:         uuid.NewRandom().String(),
+		UserID:     claims.Subject,
+		Email:      claims.Email,
+		Path:       params.Path,
+		Sku:        meta.Sku,
+		Title:      meta.Title,
+		Type:       meta.Type,
+		Quantity:   params.Quantity,
+		Plan:       meta.Subscription.Plan,
+		Processor:  provider.Name(),
+	}
+
+	tx := a.db.Begin()
+	owner := &models.Order{UserID: sub.UserID}
+	shipping, httpErr := a.processAddress(tx, owner, "Shipping Address", params.ShippingAddress, params.ShippingAddressID, params.SaveToAddressBook)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if shipping == nil {
+		tx.Rollback()
+		return badRequestError("Shipping Address Required")
+	}
+	sub.ShippingAddressID = shipping.ID
+	sub.BillingAddressID = shipping.ID
+	billing, httpErr := a.processAddress(tx, owner, "Billing Address", params.BillingAddress, params.BillingAddressID, params.SaveToAddressBook)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if billing != nil {
+		sub.BillingAddressID = billing.ID
+	}
+
+	result, err := subscribe(sub.Plan, sub.Quantity, sub.Email)
+	if err == breaker.ErrOpen {
+		tx.Rollback()
+		return serviceUnavailableError("Payments with %v are unavailable right now, please try again later", provider.Name())
+	}
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("There was an error subscribing: %v", err).WithInternalError(err)
+	}
+	setSubscriptionResult(sub, result)
+
+	// the customer is billed by the provider from now on, so a subscription
+	// that can't be saved is canceled right away instead of billing renewals
+	// that have no subscription to create orders for
+	rsp := tx.Create(sub)
+	if rsp.Error != nil {
+		tx.Rollback()
+	} else {
+		rsp = tx.Commit()
+	}
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Errorf("Failed to save subscription %v of %v", sub.ProcessorID, sub.Processor)
+		if _, err := cancel(sub.ProcessorID, false); err != nil {
+			log.WithError(err).Errorf("Failed to cancel unsaved subscription %v of %v", sub.ProcessorID, sub.Processor)
+		}
+		return internalServerError("Error saving subscription").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("subscription_id", sub.ID).Infof("Subscribed to plan %v", sub.Plan)
+	return sendJSON(w, http.StatusCreated, sub)
+}
+
+// SubscriptionCancel cancels a subscription of the user, right away or, with
+// at_period_end=true, when the current billing period ends.
+func (a *API) SubscriptionCancel(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	sub, httpErr := a.getSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if sub.State == models.CanceledState {
+		return badRequestError("This subscription is already canceled")
+	}
+
+	provider := gcontext.GetPaymentProviders(ctx)[sub.Processor]
+	subscriptions, ok := provider.(payments.SubscriptionProvider)
+	if !ok {
+		return badRequestError("Payment provider '%s' not configured", sub.Processor)
+	}
+	cancel, err := subscriptions.NewSubscriptionCanceler(ctx, r)
+	if err != nil {
+		return internalServerError("Error creating payment provider").WithInternalError(err)
+	}
+
+	result, err := cancel(sub.ProcessorID, r.URL.Query().Get("at_period_end") == "true")
+	if err == breaker.ErrOpen {
+		return serviceUnavailableError("Payments with %v are unavailable right now, please try again later", provider.Name())
+	}
+	if err != nil {
+		return internalServerError("There was an error canceling the subscription: %v", err).WithInternalError(err)
+	}
+	setSubscriptionResult(sub, result)
+	if rsp := a.db.Save(sub); rsp.Error != nil {
+		return internalServerError("Error saving subscription").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("subscription_id", sub.ID).Infof("Canceled subscription, at period end: %v", sub.CancelAtPeriodEnd)
+	return sendJSON(w, http.StatusOK, sub)
+}
+
+func (a *API) getSubscription(r *http.Request) (*models.Subscription, *HTTPError) {
+	ctx := r.Context()
+	sub := &models.Subscription{}
+	query := a.db.Preload("ShippingAddress").Preload("BillingAddress").Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	if rsp := query.First(sub, "id = ?", chi.URLParam(r, "subscription_id")); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("Subscription not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	scope := ordersReadScope
+	if r.Method != http.MethodGet {
+		scope = ordersWriteScope
+	}
+	if !gcontext.HasScope(ctx, scope) && sub.UserID != gcontext.GetClaims(ctx).Subject {
+		return nil, notFoundError("Subscription not found")
+	}
+	return sub, nil
+}
+
+func setSubscriptionResult(sub *models.Subscription, result *payments.SubscriptionResult) {
+	sub.ProcessorID = result.ID
+	if result.CustomerID != "" {
+		sub.CustomerID = result.CustomerID
+	}
+	sub.State = result.Status
+	sub.CancelAtPeriodEnd = result.CancelAtPeriodEnd
+	if !result.CurrentPeriodEnd.IsZero() && result.CurrentPeriodEnd.Unix() > 0 {
+		periodEnd := result.CurrentPeriodEnd
+		sub.CurrentPeriodEnd = &periodEnd
+	}
+	if sub.State == models.CanceledState && sub.CanceledAt == nil {
+		now := time.Now()
+		sub.CanceledAt = &now
+	}
+}
+
+// createRenewalOrder creates the paid order for an invoice of a subscription.
+// It returns nil if the invoice already has an order, as providers can send
+// the same event more than once. The invoice IDs of orders are unique, so
+// when the same event is handled twice at once, one of them fails to create
+// the order and the provider sends it again.
+func createRenewalOrder(tx *gorm.DB, r *http.Request, config *conf.Configuration, sub *models.Subscription, invoice *stripe.Invoice) (*models.Transaction, *HTTPError) {
+	existing := 0
+	if rsp := tx.Model(&models.Order{}).Where("subscription_invoice_id = ?", invoice.ID).Count(&existing); rsp.Error != nil {
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if existing > 0 {
+		return nil, nil
+	}
+
+	order := models.NewOrder(sub.InstanceID, "", sub.Email, strings.ToUpper(string(invoice.Currency)))
+	order.ID = models.NewID(config.IDFormat)
+	order.UserID = sub.UserID
+	order.SubscriptionID = sub.ID
+	order.SubscriptionInvoiceID = &invoice.ID
+	order.ShippingAddressID = sub.ShippingAddressID
+	order.BillingAddressID = sub.BillingAddressID
+	order.PaymentProcessor = sub.Processor
+
+	quantity := sub.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	order.LineItems = []*models.LineItem{{
+		OrderID:  order.ID,
+		Title:    sub.Title,
+		Sku:      sub.Sku,
+		Type:     sub.Type,
+		Path:     sub.Path,
+		Price:    uint64(invoice.Subtotal) / quantity,
+		Quantity: quantity,
+	}}
+	order.SubTotal = uint64(invoice.Subtotal)
+	order.Taxes = uint64(invoice.Tax)
+	order.Total = uint64(invoice.Total)
+	if invoice.Subtotal+invoice.Tax > invoice.Total {
+		order.Discount = uint64(invoice.Subtotal + invoice.Tax - invoice.Total)
+	}
+
+	invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+	if err != nil {
+		return nil, internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+	}
+	order.InvoiceNumber = invoiceNumber
+	order.PaymentState = models.PaidState
+	order.State = models.PaidState
+	if rsp := tx.Create(order); rsp.Error != nil {
+		return nil, internalServerError("Error saving order").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
+
+	tr := models.NewTransaction(order)
+	tr.ID = models.NewID(config.IDFormat)
+	tr.Status = models.PaidState
+	if invoice.Charge != nil {
+		tr.ProcessorID = invoice.Charge.ID
+	}
+	if rsp := tx.Create(tr); rsp.Error != nil {
+		return nil, internalServerError("Error saving transaction").WithInternalError(rsp.Error)
+	}
+	models.LogEventWithDiff(tx, r.RemoteAddr, order.UserID, order.ID, models.EventPaid, []string{"payment_state"}, map[string]models.Change{
+		"payment_state": {From: models.PendingState, To: models.PaidState},
+		"transaction":   {To: tr.ID},
+		"amount":        {To: tr.Amount},
+	})
+
+	log := getLogEntry(r)
+	if err := adjustInventory(tx, order, nil, -1); err != nil {
+		log.WithError(err).Error("Error updating the inventory of a paid order")
+	}
+	if config.Webhooks.Payment != "" && !order.SuppressNotifications {
+		hook := newHook(r.Context(), log, order.InstanceID, models.PaymentSucceededHook, config.Webhooks.Payment, order.UserID, order)
+		tx.Save(hook)
+	}
+	return tr, nil
+}
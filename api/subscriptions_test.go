@@ -0,0 +1,259 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// subscriptionStripeBackend answers the calls for customers and
+// subscriptions like Stripe would.
+type subscriptionStripeBackend struct {
+	calls  []string
+	status string
+}
+
+func (b *subscriptionStripeBackend) Call(method, path, key string, body *stripe.RequestValues, params *stripe.Params, v interface{}) error {
+	b.calls = append(b.calls, method+" "+path)
+	switch obj := v.(type) {
+	case *stripe.Customer:
+		obj.ID = "cus_1"
+	case *stripe.Sub:
+		obj.ID = "sub_1"
+		obj.Status = stripe.SubStatus(b.status)
+		obj.PeriodEnd = time.Now().Add(30 * 24 * time.Hour).Unix()
+		if body != nil {
+			obj.EndCancel = body.Get("at_period_end") != nil
+		}
+	}
+	return nil
+}
+
+func (b *subscriptionStripeBackend) CallMultipart(method, path, key, boundary string, body io.Reader, params *stripe.Params, v interface{}) error {
+	return nil
+}
+
+func createTestSubscription(test *RouteTest) *models.Subscription {
+	sub := &models.Subscription{
+		ID:                "test-subscription",
+		UserID:            test.Data.testUser.ID,
+		Email:             test.Data.testUser.Email,
+		Path:              "/subscription-product",
+		Sku:               "product-box",
+		Title:             "Monthly Box",
+		Type:              "Box",
+		Quantity:          1,
+		Plan:              "monthly-box",
+		Processor:         "stripe",
+		ProcessorID:       "sub_1",
+		State:             models.ActiveState,
+		ShippingAddressID: test.Data.firstOrder.ShippingAddressID,
+		BillingAddressID:  test.Data.firstOrder.BillingAddressID,
+	}
+	require.NoError(test.T, test.DB.Create(sub).Error)
+	return sub
+}
+
+func sendStripeEvent(test *RouteTest, event string, signature func(payload string) string) *httptest.ResponseRecorder {
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(test.T, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/stripe", strings.NewReader(event))
+	r.Header.Set("Stripe-Signature", signature(event))
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion).handler.ServeHTTP(w, r)
+	return w
+}
+
+func stripeSignature(secret string) func(payload string) string {
+	return func(payload string) string {
+		timestamp := time.Now().Unix()
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp, payload)))
+		return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+func TestSubscriptionCreate(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		backend := &subscriptionStripeBackend{status: "active"}
+		stripe.SetBackend(stripe.APIBackend, backend)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/subscriptions", strings.NewReader(`{
+			"path": "/subscription-product",
+			"provider": "stripe",
+			"stripe_token": "tok_visa",
+			"shipping_address_id": "`+test.Data.firstOrder.ShippingAddressID+`"
+		}`), test.Data.testUserToken)
+		sub := &models.Subscription{}
+		extractPayload(t, http.StatusCreated, recorder, sub)
+		assert.Equal(t, "product-box", sub.Sku)
+		assert.Equal(t, "monthly-box", sub.Plan)
+		assert.Equal(t, "sub_1", sub.ProcessorID)
+		assert.Equal(t, models.ActiveState, sub.State)
+		assert.Equal(t, test.Data.testUser.ID, sub.UserID)
+		assert.NotNil(t, sub.CurrentPeriodEnd)
+		assert.Equal(t, []string{"POST /customers", "POST /subscriptions"}, backend.calls)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/subscriptions", nil, test.Data.testUserToken)
+		subs := []models.Subscription{}
+		extractPayload(t, http.StatusOK, recorder, &subs)
+		assert.Len(t, subs, 1)
+	})
+	t.Run("Unsaved", func(t *testing.T) {
+		backend := &subscriptionStripeBackend{status: "active"}
+		stripe.SetBackend(stripe.APIBackend, backend)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+		test.DB.Callback().Create().Before("gorm:create").Register("fail_subscriptions", func(scope *gorm.Scope) {
+			if _, ok := scope.Value.(*models.Subscription); ok {
+				scope.Err(errors.New("database is down"))
+			}
+		})
+		defer test.DB.Callback().Create().Remove("fail_subscriptions")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/subscriptions", strings.NewReader(`{
+			"path": "/subscription-product",
+			"provider": "stripe",
+			"stripe_token": "tok_visa",
+			"shipping_address_id": "`+test.Data.firstOrder.ShippingAddressID+`"
+		}`), test.Data.testUserToken)
+		validateError(t, http.StatusInternalServerError, recorder)
+		assert.Equal(t, []string{"POST /customers", "POST /subscriptions", "DELETE /subscriptions/sub_1"}, backend.calls)
+	})
+	t.Run("NotRecurring", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/subscriptions", strings.NewReader(`{
+			"path": "/simple-product",
+			"provider": "stripe",
+			"stripe_token": "tok_visa",
+			"shipping_address_id": "`+test.Data.firstOrder.ShippingAddressID+`"
+		}`), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "not a recurring product")
+	})
+	t.Run("Anonymous", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/subscriptions", strings.NewReader(`{"path": "/subscription-product"}`), nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestSubscriptionCancel(t *testing.T) {
+	backend := &subscriptionStripeBackend{status: "active"}
+	stripe.SetBackend(stripe.APIBackend, backend)
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	test := NewRouteTest(t)
+	createTestSubscription(test)
+
+	recorder := test.TestEndpoint(http.MethodDelete, "/subscriptions/test-subscription?at_period_end=true", nil, test.Data.testUserToken)
+	sub := &models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, sub)
+	assert.True(t, sub.CancelAtPeriodEnd)
+	assert.Equal(t, models.ActiveState, sub.State)
+	assert.Equal(t, []string{"DELETE /subscriptions/sub_1"}, backend.calls)
+
+	otherToken := testToken("other-user", "other@example.com")
+	recorder = test.TestEndpoint(http.MethodDelete, "/subscriptions/test-subscription", nil, otherToken)
+	validateError(t, http.StatusNotFound, recorder)
+}
+
+func TestStripeWebhook(t *testing.T) {
+	invoicePaid := `{"id": "evt_1", "type": "invoice.payment_succeeded", "data": {"object": {
+		"id": "in_1", "subscription": "sub_1", "currency": "usd", "paid": true, "charge": "ch_1",
+		"subtotal": 1500, "tax": 285, "total": 1785, "amount_due": 1785, "period_end": 1893456000
+	}}}`
+
+	t.Run("Renewal", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec"
+		sub := createTestSubscription(test)
+
+		recorder := sendStripeEvent(test, invoicePaid, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		// Stripe can send the same event again
+		recorder = sendStripeEvent(test, invoicePaid, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		orders := []*models.Order{}
+		require.NoError(t, orderQuery(test.DB).Where("subscription_id = ?", sub.ID).Find(&orders).Error)
+		require.Len(t, orders, 1)
+		order := orders[0]
+		duplicate := &models.Order{ID: "duplicate", InstanceID: order.InstanceID, SubscriptionInvoiceID: order.SubscriptionInvoiceID}
+		assert.Error(t, test.DB.Create(duplicate).Error)
+		assert.Equal(t, "USD", order.Currency)
+		assert.Equal(t, uint64(1500), order.SubTotal)
+		assert.Equal(t, uint64(285), order.Taxes)
+		assert.Equal(t, uint64(1785), order.Total)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, test.Data.testUser.ID, order.UserID)
+		assert.NotZero(t, order.InvoiceNumber)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, "product-box", order.LineItems[0].Sku)
+		require.Len(t, order.Transactions, 1)
+		assert.Equal(t, "ch_1", order.Transactions[0].ProcessorID)
+		assert.Equal(t, models.PaidState, order.Transactions[0].Status)
+	})
+	t.Run("Canceled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec"
+		createTestSubscription(test)
+
+		recorder := sendStripeEvent(test, `{"id": "evt_2", "type": "customer.subscription.deleted", "data": {"object": {
+			"id": "sub_1", "status": "canceled", "customer": "cus_1"
+		}}}`, stripeSignature("whsec"))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		sub := &models.Subscription{}
+		require.NoError(t, test.DB.First(sub, "id = ?", "test-subscription").Error)
+		assert.Equal(t, models.CanceledState, sub.State)
+		assert.NotNil(t, sub.CanceledAt)
+	})
+	t.Run("InvalidSignature", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec"
+		createTestSubscription(test)
+
+		recorder := sendStripeEvent(test, invoicePaid, stripeSignature("other-secret"))
+		validateError(t, http.StatusBadRequest, recorder)
+
+		count := 0
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("subscription_id = ?", "test-subscription").Count(&count).Error)
+		assert.Equal(t, 0, count)
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := sendStripeEvent(test, invoicePaid, stripeSignature(""))
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func taxExemptOrderBody(extra string) *strings.Reader {
+	return strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_address": {
+			"name": "Test User",
+			"address1": "Branengebranen",
+			"city": "Berlin", "country": "Germany", "zip": "94107"
+		},
+		` + extra + `
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`)
+}
+
+func TestTaxExemption(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("User", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		url := "/users/" + test.Data.testUser.ID + "/tax-exemption"
+
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"tax_exempt": true}`), testAdminToken("admin", ""))
+		validateError(t, http.StatusBadRequest, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"tax_exempt": true, "tax_exempt_reason": "Reseller 42"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"tax_exempt": true, "tax_exempt_reason": "Reseller 42"}`), testAdminToken("admin", ""))
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.True(t, user.TaxExempt)
+		assert.Equal(t, "Reseller 42", user.TaxExemptReason)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", taxExemptOrderBody(""), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.True(t, order.TaxExempt)
+		assert.Equal(t, "Reseller 42", order.TaxExemptReason)
+		assert.Equal(t, uint64(0), order.Taxes)
+		assert.Equal(t, uint64(999), order.Total)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"tax_exempt": false, "tax_exempt_reason": "Reseller 42"}`), testAdminToken("admin", ""))
+		user = &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.False(t, user.TaxExempt)
+		assert.Empty(t, user.TaxExemptReason)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", taxExemptOrderBody(""), test.Data.testUserToken)
+		order = &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.False(t, order.TaxExempt)
+		assert.Equal(t, uint64(70), order.Taxes)
+	})
+
+	t.Run("OrderCreateAsBuyer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		body := taxExemptOrderBody(`"tax_exempt": true, "tax_exempt_reason": "Trust me",`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("OrderUpdate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", taxExemptOrderBody(""), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Equal(t, uint64(70), order.Taxes)
+
+		recorder = test.TestEndpoint(http.MethodPut, "/orders/"+order.ID, strings.NewReader(`{"tax_exempt": true}`), testAdminToken("admin", ""))
+		validateError(t, http.StatusBadRequest, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPut, "/orders/"+order.ID, strings.NewReader(`{"tax_exempt": true, "tax_exempt_reason": "Diplomat"}`), testAdminToken("admin", ""))
+		updated := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.True(t, updated.TaxExempt)
+		assert.Equal(t, "Diplomat", updated.TaxExemptReason)
+		assert.Equal(t, uint64(0), updated.Taxes)
+		assert.Equal(t, uint64(999), updated.Total)
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND changes LIKE ?", order.ID, "%tax_exempt%").First(event).Error)
+		assert.Equal(t, models.Change{From: false, To: true}, event.Diff["tax_exempt"])
+		assert.Equal(t, models.Change{From: "", To: "Diplomat"}, event.Diff["tax_exempt_reason"])
+	})
+
+	t.Run("OrderUpdateAfterPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"tax_exempt": true, "tax_exempt_reason": "Diplomat"}`)
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/"+test.Data.firstOrder.ID, body, testAdminToken("admin", ""))
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/tracing"
+)
+
+// traceRequest records a span for the whole request, which the spans of the
+// handler are children of.
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span, ctx := tracing.StartSpan(r.Context(), "http.request")
+		span.SetTag("method", r.Method)
+		span.SetTag("path", r.URL.Path)
+		defer span.Finish()
+
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+		span.SetTag("status", ww.Status())
+	})
+}
+
+// logSpan reports finished spans as log entries.
+func logSpan(span *tracing.Span) {
+	fields := logrus.Fields{
+		"component":   "tracing",
+		"trace_id":    span.TraceID,
+		"span_id":     span.SpanID,
+		"operation":   span.Operation,
+		"duration_ms": float64(span.Duration.Nanoseconds()) / 1e6,
+	}
+	if span.ParentID != "" {
+		fields["parent_id"] = span.ParentID
+	}
+	for k, v := range span.Tags() {
+		fields["tag."+k] = v
+	}
+	logrus.WithFields(fields).Info("span finished")
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/tracing"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (r *spanRecorder) report(span *tracing.Span) {
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+}
+
+func (r *spanRecorder) operations() map[string]*tracing.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := map[string]*tracing.Span{}
+	for _, span := range r.spans {
+		ops[span.Operation] = span
+	}
+	return ops
+}
+
+func TestRequestTracing(t *testing.T) {
+	var siteRequestID string
+	var mu sync.Mutex
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/simple-product" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		siteRequestID = r.Header.Get(tracing.Header)
+		mu.Unlock()
+		fmt.Fprintln(w, `<script class="gocommerce-product">
+			{"sku": "product-1", "title": "Product 1", "type": "Book", "prices": [{"amount": "9.99", "currency": "USD"}]}
+		</script>`)
+	}))
+	defer site.Close()
+
+	recorder := &spanRecorder{}
+	tracing.SetReporter(recorder.report)
+	defer tracing.SetReporter(nil)
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = site.URL
+	body := strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_address": {"name": "Test User", "address1": "610 22nd Street", "city": "San Francisco", "country": "USA", "zip": "94107"},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/orders", body)
+	r.Header.Set(tracing.Header, "checkout-1234")
+	ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+	require.NoError(t, err)
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion).handler.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "checkout-1234", w.Header().Get(tracing.Header))
+	assert.Equal(t, "checkout-1234", siteRequestID)
+
+	ops := recorder.operations()
+	for _, op := range []string{"http.request", "order.create", "db.transaction", "order.process_line_item", "site.fetch_product"} {
+		require.Contains(t, ops, op)
+		assert.Equal(t, "checkout-1234", ops[op].TraceID)
+	}
+	assert.Empty(t, ops["http.request"].ParentID)
+	assert.Equal(t, ops["http.request"].SpanID, ops["order.create"].ParentID)
+	assert.Equal(t, ops["order.create"].SpanID, ops["order.process_line_item"].ParentID)
+	assert.Equal(t, ops["order.process_line_item"].SpanID, ops["site.fetch_product"].ParentID)
+	assert.Equal(t, http.StatusCreated, ops["http.request"].Tags()["status"])
+}
+
+func TestRequestIDFromClient(t *testing.T) {
+	test := NewRouteTest(t)
+	for id, kept := range map[string]bool{
+		"abc-123":                true,
+		"bad id\nwith\tjunk":     false,
+		strings.Repeat("a", 200): false,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/health", nil)
+		r.Header.Set(tracing.Header, id)
+		NewAPIWithVersion(context.Background(), test.GlobalConfig, test.DB, defaultVersion).handler.ServeHTTP(w, r)
+		got := w.Header().Get(tracing.Header)
+		require.NotEmpty(t, got)
+		assert.Equal(t, kept, got == id, id)
+	}
+}
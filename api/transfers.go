@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// TransferListForOrder lists the vendor payouts made for an order. It is only available to admins.
+func (a *API) TransferListForOrder(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	orderID := gcontext.GetOrderID(ctx)
+
+	transfers := []models.Transfer{}
+	if rsp := a.db.Where("order_id = ? AND instance_id = ?", orderID, gcontext.GetInstanceID(ctx)).Order("created_at asc").Find(&transfers); rsp.Error != nil && !rsp.RecordNotFound() {
+		return internalServerError("Error while querying for transfers").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, transfers)
+}
+
+// payoutVendors transfers each vendor's share of a paid order to their
+// connected account. Failed transfers are recorded but don't fail the payment.
+func (a *API) payoutVendors(ctx context.Context, r *http.Request, provider payments.Provider, order *models.Order, charge *models.Transaction, log logrus.FieldLogger) {
+	transfers := models.NewVendorTransfers(order, charge)
+	if len(transfers) == 0 {
+		return
+	}
+
+	tp, ok := provider.(payments.TransferProvider)
+	if !ok {
+		log.Warnf("Payment provider %s doesn't support vendor payouts", provider.Name())
+		return
+	}
+	transfer, err := tp.NewTransferrer(ctx, r)
+	if err != nil {
+		log.WithError(err).Error("Error creating vendor transferrer")
+		return
+	}
+
+	for _, t := range transfers {
+		processorID, err := transfer(charge.ProcessorID, t.Destination, t.Amount, t.Currency)
+		if err != nil {
+			log.WithError(err).WithField("destination", t.Destination).Error("Failed to pay out vendor")
+			t.Status = models.FailedState
+			t.FailureDescription = err.Error()
+		} else {
+			t.ProcessorID = processorID
+			t.Status = models.PaidState
+		}
+		if rsp := a.db.Create(t); rsp.Error != nil {
+			log.WithError(rsp.Error).Errorf("Failed to save vendor transfer %s", t.ID)
+		}
+	}
+}
+
+// reverseVendorTransfers claws back the vendors' share of a refund. Refunds
+// of line items are taken back from the vendors of those items, and refunds
+// of an amount from every vendor, in proportion to the refunded part of the
+// original charge.
+func (a *API) reverseVendorTransfers(ctx context.Context, r *http.Request, provider payments.Provider, order *models.Order, charge *models.Transaction, refunded uint64, items map[int64]uint64, log logrus.FieldLogger) {
+	transfers, err := models.GetTransfersForTransaction(a.db, charge.ID)
+	if err != nil {
+		log.WithError(err).Error("Error while querying for transfers")
+		return
+	}
+	if len(transfers) == 0 || charge.Amount == 0 {
+		return
+	}
+
+	tp, ok := provider.(payments.TransferProvider)
+	if !ok {
+		log.Warnf("Payment provider %s doesn't support vendor payouts", provider.Name())
+		return
+	}
+	reverse, err := tp.NewTransferReverser(ctx, r)
+	if err != nil {
+		log.WithError(err).Error("Error creating vendor transfer reverser")
+		return
+	}
+
+	var byAccount map[string]uint64
+	if len(items) > 0 {
+		byAccount = refundedVendorAmounts(order, items)
+	}
+	for _, t := range transfers {
+		if t.Status != models.PaidState || t.Reversed >= t.Amount {
+			continue
+		}
+		amount := t.Amount * refunded / charge.Amount
+		if byAccount != nil {
+			amount = byAccount[t.Destination]
+		}
+		if amount > t.Amount-t.Reversed {
+			amount = t.Amount - t.Reversed
+		}
+		if amount == 0 {
+			continue
+		}
+
+		if _, err := reverse(t.ProcessorID, amount); err != nil {
+			log.WithError(err).WithField("transfer_id", t.ID).Error("Failed to reverse vendor transfer")
+			continue
+		}
+		t.Reversed += amount
+		if rsp := a.db.Save(t); rsp.Error != nil {
+			log.WithError(rsp.Error).Errorf("Failed to save vendor transfer %s", t.ID)
+		}
+	}
+}
+
+// refundedVendorAmounts returns the vendor shares of the refunded quantities
+// of line items, by connected account.
+func refundedVendorAmounts(order *models.Order, items map[int64]uint64) map[string]uint64 {
+	shares := models.VendorAmounts(order)
+	byAccount := map[string]uint64{}
+	for _, item := range order.LineItems {
+		qty, ok := items[item.ID]
+		if !ok || item.Quantity == 0 || shares[item.ID] == 0 {
+			continue
+		}
+		byAccount[item.VendorAccount] += uint64(math.Floor(float64(shares[item.ID])*float64(qty)/float64(item.Quantity) + 0.5))
+	}
+	return byAccount
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+	stripeprovider "github.com/netlify/gocommerce/payments/stripe"
+)
+
+// transferStripeBackend records the amounts of the transfers and reversals
+// made with Stripe.
+type transferStripeBackend struct {
+	transfers map[string]uint64
+	reversals map[string]uint64
+}
+
+func (b *transferStripeBackend) Call(method, path, key string, body *stripe.RequestValues, params *stripe.Params, v interface{}) error {
+	amount, _ := strconv.ParseUint(body.Get("amount")[0], 10, 64)
+	switch obj := v.(type) {
+	case *stripe.Transfer:
+		obj.ID = "tr_" + body.Get("destination")[0]
+		b.transfers[body.Get("destination")[0]] = amount
+	case *stripe.Reversal:
+		obj.ID = "trr_1"
+		b.reversals[path] += amount
+	}
+	return nil
+}
+
+func (b *transferStripeBackend) CallMultipart(method, path, key, boundary string, body io.Reader, params *stripe.Params, v interface{}) error {
+	return nil
+}
+
+// vendorOrder is an order with line items of two vendors, priced after
+// discounts, and one item of the shop itself.
+func vendorOrder() (*models.Order, *models.Transaction) {
+	order := models.NewOrder("", "session", "buyer@example.com", "USD")
+	order.ID = "vendor-order"
+	order.LineItems = []*models.LineItem{
+		{ID: 1, Sku: "a", Price: 999, Quantity: 1, VendorAccount: "acct_a", VendorShare: 15, PriceBreakdown: &calculator.ItemPrice{LineNet: 899}},
+		{ID: 2, Sku: "b", Price: 333, Quantity: 3, VendorAccount: "acct_a", VendorShare: 10, PriceBreakdown: &calculator.ItemPrice{LineNet: 999}},
+		{ID: 3, Sku: "c", Price: 300, Quantity: 2, VendorAccount: "acct_b", VendorShare: 50, PriceBreakdown: &calculator.ItemPrice{LineNet: 500}},
+		{ID: 4, Sku: "d", Price: 1000, Quantity: 1, PriceBreakdown: &calculator.ItemPrice{LineNet: 1000}},
+	}
+	charge := models.NewTransaction(order)
+	charge.ID = "vendor-charge"
+	charge.ProcessorID = "ch_1"
+	charge.Amount = 3398
+	charge.Status = models.PaidState
+	return order, charge
+}
+
+func TestVendorTransfers(t *testing.T) {
+	t.Run("Split", func(t *testing.T) {
+		order, charge := vendorOrder()
+		transfers := models.NewVendorTransfers(order, charge)
+		require.Len(t, transfers, 2)
+		// 15% of 899 rounds to 135, and 10% of 999 to 100
+		assert.Equal(t, "acct_a", transfers[0].Destination)
+		assert.EqualValues(t, 235, transfers[0].Amount)
+		assert.Equal(t, "acct_b", transfers[1].Destination)
+		assert.EqualValues(t, 250, transfers[1].Amount)
+	})
+	t.Run("ManualDiscount", func(t *testing.T) {
+		order, charge := vendorOrder()
+		order.ManualDiscount = 340
+		transfers := models.NewVendorTransfers(order, charge)
+		require.Len(t, transfers, 2)
+		// the lines get 90, 100 and 50 of the discount
+		assert.EqualValues(t, 121+90, transfers[0].Amount)
+		assert.EqualValues(t, 225, transfers[1].Amount)
+	})
+
+	backend := &transferStripeBackend{}
+	stripe.SetBackend(stripe.APIBackend, backend)
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+	provider, err := stripeprovider.NewPaymentProvider(stripeprovider.Config{SecretKey: "secret"})
+	require.NoError(t, err)
+
+	setup := func(t *testing.T) (*RouteTest, *API, *models.Order, *models.Transaction) {
+		backend.transfers = map[string]uint64{}
+		backend.reversals = map[string]uint64{}
+		test := NewRouteTest(t)
+		ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+		require.NoError(t, err)
+		a := NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion)
+
+		order, charge := vendorOrder()
+		r := httptest.NewRequest(http.MethodPost, "/orders/vendor-order/payments", nil)
+		a.payoutVendors(ctx, r, provider, order, charge, logrus.New())
+		return test, a, order, charge
+	}
+
+	t.Run("Payout", func(t *testing.T) {
+		test, _, _, charge := setup(t)
+		assert.Equal(t, map[string]uint64{"acct_a": 235, "acct_b": 250}, backend.transfers)
+
+		transfers, err := models.GetTransfersForTransaction(test.DB, charge.ID)
+		require.NoError(t, err)
+		require.Len(t, transfers, 2)
+		for _, transfer := range transfers {
+			assert.Equal(t, models.PaidState, transfer.Status)
+			assert.Equal(t, "tr_"+transfer.Destination, transfer.ProcessorID)
+		}
+	})
+	t.Run("ReverseLineItems", func(t *testing.T) {
+		test, a, order, charge := setup(t)
+		r := httptest.NewRequest(http.MethodPost, "/orders/vendor-order/transactions/vendor-charge/refund", nil)
+		a.reverseVendorTransfers(r.Context(), r, provider, order, charge, 250, map[int64]uint64{3: 1}, logrus.New())
+		assert.Equal(t, map[string]uint64{"/transfers/tr_acct_b/reversals": 125}, backend.reversals, "only the vendor of the item gives back its share")
+
+		transfers, err := models.GetTransfersForTransaction(test.DB, charge.ID)
+		require.NoError(t, err)
+		for _, transfer := range transfers {
+			if transfer.Destination == "acct_b" {
+				assert.EqualValues(t, 125, transfer.Reversed)
+			} else {
+				assert.Zero(t, transfer.Reversed)
+			}
+		}
+	})
+	t.Run("ReverseAmount", func(t *testing.T) {
+		_, a, order, charge := setup(t)
+		r := httptest.NewRequest(http.MethodPost, "/orders/vendor-order/transactions/vendor-charge/refund", nil)
+		a.reverseVendorTransfers(r.Context(), r, provider, order, charge, charge.Amount/2, nil, logrus.New())
+		assert.Equal(t, map[string]uint64{
+			"/transfers/tr_acct_a/reversals": 117,
+			"/transfers/tr_acct_b/reversals": 125,
+		}, backend.reversals)
+	})
+}
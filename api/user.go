@@ -13,6 +13,7 @@ import (
 	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
 
+	"github.com/netlify/gocommerce/claims"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
 )
@@ -24,7 +25,7 @@ func (a *API) withUser(w http.ResponseWriter, r *http.Request) (context.Context,
 
 	if u, err := models.GetUser(a.db, userID); err != nil {
 		return nil, internalServerError("problem while querying for userID: %s", userID).WithInternalError(err)
-	} else if u != nil {
+	} else if u != nil && u.InstanceID == gcontext.GetInstanceID(ctx) {
 		ctx = gcontext.WithUser(ctx, u)
 	}
 
@@ -42,7 +43,7 @@ func (a *API) withUser(w http.ResponseWriter, r *http.Request) (context.Context,
 func (a *API) UserList(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
 
-	query, err := parseUserQueryParams(a.db, r.URL.Query())
+	query, err := parseUserQueryParams(a.readDB(r), r.URL.Query())
 	if err != nil {
 		return badRequestError("Bad parameters in query: %v", err)
 	}
@@ -101,12 +102,109 @@ func (a *API) UserView(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	orders := []models.Order{}
-	a.db.Where("user_id = ?", user.ID).Find(&orders).Count(&user.OrderCount)
+	a.db.Where("user_id = ? AND instance_id = ?", user.ID, user.InstanceID).Find(&orders).Count(&user.OrderCount)
 
+	groups, err := models.GetCustomerGroups(a.db, gcontext.GetInstanceID(ctx), user.ID)
+	if err != nil {
+		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(err)
+	}
+	user.Groups = groups
+
+	return sendJSON(w, http.StatusOK, user)
+}
+
+type taxExemptionParams struct {
+	TaxExempt bool   `json:"tax_exempt"`
+	Reason    string `json:"tax_exempt_reason"`
+}
+
+// UserTaxExemptionUpdate marks a user as exempt from taxes, or not anymore.
+// The exemption applies to the orders the user creates from then on.
+func (a *API) UserTaxExemptionUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + gcontext.GetUserID(ctx))
+	}
+
+	params := &taxExemptionParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.TaxExempt && params.Reason == "" {
+		return badRequestError("Tax exempt users require a 'tax_exempt_reason'")
+	}
+	if !params.TaxExempt {
+		params.Reason = ""
+	}
+
+	user.TaxExempt = params.TaxExempt
+	user.TaxExemptReason = params.Reason
+	if rsp := a.db.Save(user); rsp.Error != nil {
+		return internalServerError("Error saving user").WithInternalError(rsp.Error)
+	}
+
+	log.WithFields(logrus.Fields{
+		"tax_exempt":        user.TaxExempt,
+		"tax_exempt_reason": user.TaxExemptReason,
+		"actor_id":          actorID(ctx),
+	}).Info("Updated tax exemption of user")
 	return sendJSON(w, http.StatusOK, user)
 }
 
-// AddressList will return the addresses for a given user
+// syncUserEmail changes the email of a known user to the one in their token,
+// when the user changed it with the identity provider. Users are only
+// created by orders and claims, and failing to update one doesn't fail the
+// request.
+func (a *API) syncUserEmail(ctx context.Context, log logrus.FieldLogger, claims *claims.JWTClaims) {
+	if claims.Subject == "" || claims.Email == "" {
+		return
+	}
+	user, err := models.GetUser(a.db, claims.Subject)
+	if err != nil {
+		log.WithError(err).Error("Error loading user to update the email of")
+		return
+	}
+	if user == nil || user.InstanceID != gcontext.GetInstanceID(ctx) || user.Email == claims.Email {
+		return
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"user_id":   user.ID,
+		"old_email": user.Email,
+		"new_email": claims.Email,
+	})
+	tx := a.db.Begin()
+	if err := user.ChangeEmail(tx, claims.Email); err != nil {
+		tx.Rollback()
+		log.WithError(err).Error("Error updating the email of user")
+		return
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error updating the email of user")
+		return
+	}
+	log.Info("Updated the email of user from token")
+}
+
+// UserEmailChangeList returns the email history of a user, newest first.
+func (a *API) UserEmailChangeList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	changes := []models.UserEmailChange{}
+	if rsp := a.db.Where("user_id = ? AND instance_id = ?", user.ID, user.InstanceID).Order("id desc").Find(&changes); rsp.Error != nil {
+		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, changes)
+}
+
+// AddressList will return the addresses in the address book of a given user
 func (a *API) AddressList(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	userID := gcontext.GetUserID(ctx)
@@ -116,7 +214,7 @@ func (a *API) AddressList(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	addrs := []models.Address{}
-	results := a.db.Where("user_id = ?", userID).Find(&addrs)
+	results := a.db.Where("user_id = ? AND snapshot = ?", userID, false).Find(&addrs)
 	if results.Error != nil {
 		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(results.Error)
 	}
@@ -134,19 +232,55 @@ func (a *API) AddressView(w http.ResponseWriter, r *http.Request) error {
 		return notFoundError("Couldn't find a record for " + userID)
 	}
 
-	addr := &models.Address{
-		ID:     addrID,
-		UserID: userID,
-	}
-	results := a.db.First(addr)
-	if results.Error != nil {
+	addr := new(models.Address)
+	results := a.db.Where("user_id = ? AND snapshot = ?", userID, false).First(addr, "id = ?", addrID)
+	if results.RecordNotFound() {
+		return notFoundError("Address not found")
+	} else if results.Error != nil {
 		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(results.Error)
 	}
 
 	return sendJSON(w, http.StatusOK, &addr)
 }
 
+// AddressUpdate will replace the fields of an address belonging to that user
+func (a *API) AddressUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	addrID := chi.URLParam(r, "addr_id")
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	addrReq := new(models.AddressRequest)
+	if err := json.NewDecoder(r.Body).Decode(addrReq); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if err := addrReq.Validate(); err != nil {
+		return badRequestError("requested address is missing a required field: %v", err)
+	}
+
+	addr := new(models.Address)
+	rsp := a.db.Where("user_id = ? AND snapshot = ?", userID, false).First(addr, "id = ?", addrID)
+	if rsp.RecordNotFound() {
+		return notFoundError("Address not found")
+	} else if rsp.Error != nil {
+		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(rsp.Error)
+	}
+
+	addr.AddressRequest = *addrReq
+	if rsp := a.db.Save(addr); rsp.Error != nil {
+		return internalServerError("failed to save address").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, addr)
+}
+
 // UserDelete will soft delete the user. It requires admin access
+// With purge=true the user and their addresses are removed for good and their
+// orders, payments, subscriptions and events are anonymized instead, keeping
+// the sales records. Users can't be purged while their subscriptions renew.
 // return errors or 200 and no body
 func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -160,6 +294,10 @@ func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	if r.URL.Query().Get("purge") == "true" {
+		return a.purgeUser(user, log)
+	}
+
 	// do a cascading delete
 	tx := a.db.Begin()
 
@@ -203,17 +341,21 @@ func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 	if err := tryDelete(tx, w, log, userID, &models.Address{}); err != nil {
 		return err
 	}
+	if err := tryDelete(tx, w, log, userID, &models.CustomerGroup{}); err != nil {
+		return err
+	}
 
 	tx.Commit()
 	log.Infof("Deleted user")
 	return nil
 }
 
-// AddressDelete will soft delete the address associated with that user. It requires admin access
+// AddressDelete will soft delete the address associated with that user
 // return errors or 200 and no body
 func (a *API) AddressDelete(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	addrID := chi.URLParam(r, "addr_id")
+	userID := gcontext.GetUserID(ctx)
 	log := getLogEntry(r).WithField("addr_id", addrID)
 
 	user := gcontext.GetUser(ctx)
@@ -222,8 +364,8 @@ func (a *API) AddressDelete(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	rsp := a.db.Delete(&models.Address{ID: addrID})
-	if rsp.RecordNotFound() {
+	rsp := a.db.Where("user_id = ? AND snapshot = ?", userID, false).Delete(&models.Address{ID: addrID})
+	if rsp.RecordNotFound() || rsp.RowsAffected == 0 {
 		log.Warn("Attempted to delete an address that doesn't exist")
 		return nil
 	} else if rsp.Error != nil {
@@ -269,6 +411,71 @@ func (a *API) CreateNewAddress(w http.ResponseWriter, r *http.Request) error {
 // -------------------------------------------------------------------------------------------------------------------
 // Helper methods
 // -------------------------------------------------------------------------------------------------------------------
+func (a *API) purgeUser(user *models.User, log logrus.FieldLogger) error {
+	// renewals build orders from the addresses the purge deletes
+	var renewing int
+	if rsp := a.db.Model(&models.Subscription{}).Where("user_id = ? AND state <> ?", user.ID, models.CanceledState).Count(&renewing); rsp.Error != nil {
+		return internalServerError("Failed to purge user").WithInternalError(rsp.Error).WithInternalMessage("failed to count subscriptions")
+	}
+	if renewing > 0 {
+		return conflictError("The user has %d subscriptions that still renew, cancel them before purging the user", renewing)
+	}
+
+	tx := a.db.Begin()
+
+	orderIDs := []string{}
+	if results := tx.Unscoped().Model(&models.Order{}).Where("user_id = ?", user.ID).Pluck("id", &orderIDs); results.Error != nil {
+		tx.Rollback()
+		return internalServerError("Failed to purge user").WithInternalError(results.Error).WithInternalMessage("failed to find associated orders")
+	}
+
+	archived, err := models.AnonymizeArchivedOrders(tx, user.ID)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to purge user").WithInternalError(err).WithInternalMessage("Failed to purge archived orders")
+	}
+	log.WithField("affected_rows", archived).Debug("Purged archived orders")
+
+	steps := []struct {
+		name  string
+		query *gorm.DB
+	}{
+		{"orders", tx.Unscoped().Model(&models.Order{}).Where("user_id = ?", user.ID).UpdateColumns(map[string]interface{}{
+			"user_id":          "",
+			"email":            "",
+			"normalized_email": "",
+			"ip":               "",
+			"session_id":       "",
+			"vat_number":       "",
+			"raw_meta_data":    "",
+		})},
+		{"transactions", tx.Unscoped().Model(&models.Transaction{}).Where("user_id = ?", user.ID).UpdateColumn("user_id", "")},
+		{"events", tx.Model(&models.Event{}).Where("user_id = ? OR order_id in (?)", user.ID, orderIDs).UpdateColumns(map[string]interface{}{
+			"user_id": "",
+			"ip":      "",
+		})},
+		{"subscriptions", tx.Model(&models.Subscription{}).Where("user_id = ?", user.ID).UpdateColumns(map[string]interface{}{
+			"user_id": "",
+			"email":   "",
+		})},
+		{"addresses", tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Address{})},
+		{"customer groups", tx.Where("user_id = ?", user.ID).Delete(&models.CustomerGroup{})},
+		{"email changes", tx.Where("user_id = ?", user.ID).Delete(&models.UserEmailChange{})},
+		{"user", tx.Unscoped().Delete(user)},
+	}
+	for _, step := range steps {
+		if step.query.Error != nil {
+			tx.Rollback()
+			return internalServerError("Failed to purge user").WithInternalError(step.query.Error).WithInternalMessage("Failed to purge %s", step.name)
+		}
+		log.WithField("affected_rows", step.query.RowsAffected).Debugf("Purged %s", step.name)
+	}
+
+	tx.Commit()
+	log.Infof("Purged user")
+	return nil
+}
+
 func tryDelete(tx *gorm.DB, w http.ResponseWriter, log logrus.FieldLogger, userID string, face interface{}) error {
 	typeName := reflect.TypeOf(face).String()
 
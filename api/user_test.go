@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -191,6 +192,12 @@ func TestUserAddressView(t *testing.T) {
 		extractPayload(t, http.StatusOK, recorder, addr)
 		validateAddress(t, test.Data.testAddress, *addr)
 	})
+	t.Run("MissingAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/addresses/dne"
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
 }
 
 func TestUserDelete(t *testing.T) {
@@ -253,20 +260,249 @@ func TestUserDelete(t *testing.T) {
 	})
 }
 
-func TestUserAddressDelete(t *testing.T) {
+func TestUserPurge(t *testing.T) {
 	test := NewRouteTest(t)
-	addr := getTestAddress()
-	addr.UserID = test.Data.testUser.ID
-	test.DB.Create(addr)
+	user := test.Data.testUser
+	models.LogEvent(test.DB, "127.0.0.1", user.ID, test.Data.firstOrder.ID, models.EventUpdated, nil)
+	require.NoError(t, test.DB.Create(&models.UserEmailChange{UserID: user.ID, OldEmail: "bruce@wayne.com", NewEmail: user.Email}).Error)
 
 	token := testAdminToken("magical-unicorn", "")
-	recorder := test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID+"/addresses/"+addr.ID, nil, token)
+	recorder := test.TestEndpoint(http.MethodDelete, "/users/"+user.ID+"?purge=true", nil, token)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	assert.True(t, test.DB.Unscoped().First(&models.User{}, "id = ?", user.ID).RecordNotFound(), "user wasn't purged")
+	assert.True(t, test.DB.Unscoped().First(&models.Address{}, "id = ?", test.Data.testAddress.ID).RecordNotFound(), "address wasn't purged")
+	assert.True(t, test.DB.First(&models.UserEmailChange{}, "user_id = ?", user.ID).RecordNotFound(), "email changes weren't purged")
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+	assert.Empty(t, order.UserID)
+	assert.Empty(t, order.Email)
+	assert.Equal(t, test.Data.firstOrder.Total, order.Total)
 
+	trans := &models.Transaction{}
+	require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+	assert.Empty(t, trans.UserID)
+
+	event := &models.Event{}
+	require.NoError(t, test.DB.First(event, "order_id = ?", test.Data.firstOrder.ID).Error)
+	assert.Empty(t, event.UserID)
+	assert.Empty(t, event.IP)
+}
+
+func TestUserPurgeSubscriptions(t *testing.T) {
+	test := NewRouteTest(t)
+	user := test.Data.testUser
+	sub := createTestSubscription(test)
+
+	token := testAdminToken("magical-unicorn", "")
+	recorder := test.TestEndpoint(http.MethodDelete, "/users/"+user.ID+"?purge=true", nil, token)
+	validateError(t, http.StatusConflict, recorder, "subscriptions that still renew")
+	assert.False(t, test.DB.First(&models.User{}, "id = ?", user.ID).RecordNotFound(), "user was purged")
+
+	require.NoError(t, test.DB.Model(sub).UpdateColumn("state", models.CanceledState).Error)
+	recorder = test.TestEndpoint(http.MethodDelete, "/users/"+user.ID+"?purge=true", nil, token)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	canceled := &models.Subscription{}
+	require.NoError(t, test.DB.First(canceled, "id = ?", sub.ID).Error)
+	assert.Empty(t, canceled.UserID)
+	assert.Empty(t, canceled.Email)
+}
+
+func TestUserPurgeArchivedOrders(t *testing.T) {
+	test := NewRouteTest(t)
+	user := test.Data.testUser
+	require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("created_at", time.Now().AddDate(-4, 0, 0)).Error)
+	_, err := models.ArchiveOrders(test.DB, time.Now().AddDate(-3, 0, 0), 10)
+	require.NoError(t, err)
+
+	token := testAdminToken("magical-unicorn", "")
+	recorder := test.TestEndpoint(http.MethodDelete, "/users/"+user.ID+"?purge=true", nil, token)
 	assert.Equal(t, http.StatusOK, recorder.Code)
-	assert.Equal(t, "", recorder.Body.String())
 
-	assert.False(t, test.DB.Unscoped().First(&addr).RecordNotFound())
-	assert.NotNil(t, addr.DeletedAt)
+	archive := &models.ArchivedOrder{}
+	require.NoError(t, test.DB.First(archive, "id = ?", test.Data.firstOrder.ID).Error)
+	assert.Empty(t, archive.UserID)
+	assert.Empty(t, archive.Email)
+	require.NotNil(t, archive.Order)
+	assert.Empty(t, archive.Order.UserID)
+	assert.Empty(t, archive.Order.Email)
+	assert.Empty(t, archive.Order.ShippingAddress.Address1)
+	assert.Equal(t, test.Data.firstOrder.Total, archive.Order.Total)
+	require.Len(t, archive.Order.Transactions, 1)
+	assert.Empty(t, archive.Order.Transactions[0].UserID)
+	assert.NotContains(t, archive.Data, user.Email)
+}
+
+func TestNormalizedEmails(t *testing.T) {
+	t.Run("Backfill", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(&models.Order{}).UpdateColumn("normalized_email", "").Error)
+		require.NoError(t, test.DB.Model(&models.User{}).UpdateColumn("normalized_email", "").Error)
+		require.NoError(t, test.DB.Model(test.Data.testUser).UpdateColumn("email", "Bruce@WayneIndustries.com").Error)
+
+		require.NoError(t, models.AutoMigrate(test.DB))
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "bruce@wayneindustries.com", order.NormalizedEmail)
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+		assert.Equal(t, "bruce@wayneindustries.com", user.NormalizedEmail)
+	})
+	t.Run("Duplicates", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Create(&models.User{ID: "other-bruce", Email: "BRUCE@wayneindustries.com"}).Error)
+		require.NoError(t, test.DB.Create(&models.User{ID: "joker", Email: "joker@dc.com"}).Error)
+
+		duplicates, err := models.FindDuplicateEmails(test.DB)
+		require.NoError(t, err)
+		require.Len(t, duplicates, 1)
+		assert.Equal(t, "bruce@wayneindustries.com", duplicates[0].NormalizedEmail)
+		require.Len(t, duplicates[0].Users, 2)
+		for _, user := range duplicates[0].Users {
+			if user.ID == test.Data.testUser.ID {
+				assert.EqualValues(t, 2, user.OrderCount)
+			} else {
+				assert.Equal(t, "other-bruce", user.ID)
+				assert.EqualValues(t, 0, user.OrderCount)
+			}
+		}
+	})
+}
+
+func TestUserEmailSync(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken(test.Data.testUser.ID, "batman@example.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID, nil, token)
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, "bruce@wayneindustries.com", user.Email)
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Users.SyncEmails = true
+		url := "/users/" + test.Data.testUser.ID
+		token := testToken(test.Data.testUser.ID, "batman@example.com")
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, "batman@example.com", user.Email)
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+		assert.Equal(t, "batman@example.com", user.NormalizedEmail)
+
+		// the same email again is no change
+		test.TestEndpoint(http.MethodGet, url, nil, token)
+		recorder = test.TestEndpoint(http.MethodGet, url+"/email-changes", nil, token)
+		changes := []models.UserEmailChange{}
+		extractPayload(t, http.StatusOK, recorder, &changes)
+		require.Len(t, changes, 1)
+		assert.Equal(t, "bruce@wayneindustries.com", changes[0].OldEmail)
+		assert.Equal(t, "batman@example.com", changes[0].NewEmail)
+
+		recorder = test.TestEndpoint(http.MethodGet, url+"/email-changes", nil, testToken("joker", "joker@dc.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("UnknownUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Users.SyncEmails = true
+		test.TestEndpoint(http.MethodGet, "/users/joker", nil, testToken("joker", "joker@dc.com"))
+		assert.True(t, test.DB.First(&models.User{}, "id = ?", "joker").RecordNotFound(), "users are not created from tokens")
+	})
+}
+
+func TestUserAddressDelete(t *testing.T) {
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		addr := getTestAddress()
+		addr.UserID = test.Data.testUser.ID
+		test.DB.Create(addr)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID+"/addresses/"+addr.ID, nil, token)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "", recorder.Body.String())
+
+		assert.False(t, test.DB.Unscoped().First(&addr).RecordNotFound())
+		assert.NotNil(t, addr.DeletedAt)
+	})
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + test.Data.testAddress.ID
+		recorder := test.TestEndpoint(http.MethodDelete, url, nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		assert.True(t, test.DB.First(&models.Address{}, "id = ?", test.Data.testAddress.ID).RecordNotFound())
+	})
+	t.Run("OtherUsersAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		other := models.User{ID: "other-user", Email: "other@example.com"}
+		test.DB.Create(&other)
+		defer test.DB.Unscoped().Delete(&other)
+
+		url := "/users/" + other.ID + "/addresses/" + test.Data.testAddress.ID
+		recorder := test.TestEndpoint(http.MethodDelete, url, nil, testToken(other.ID, other.Email))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		assert.False(t, test.DB.First(&models.Address{}, "id = ?", test.Data.testAddress.ID).RecordNotFound())
+	})
+}
+
+func TestUserAddressUpdate(t *testing.T) {
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		addr := test.Data.testAddress
+		addr.City = "Brooklyn"
+		b, err := json.Marshal(&addr.AddressRequest)
+		require.NoError(t, err)
+
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + addr.ID
+		recorder := test.TestEndpoint(http.MethodPut, url, bytes.NewBuffer(b), test.Data.testUserToken)
+
+		rspAddr := new(models.Address)
+		extractPayload(t, http.StatusOK, recorder, rspAddr)
+		validateAddress(t, addr, *rspAddr)
+
+		dbAddr := new(models.Address)
+		require.NoError(t, test.DB.First(dbAddr, "id = ?", addr.ID).Error)
+		assert.Equal(t, "Brooklyn", dbAddr.City)
+		assert.Equal(t, test.Data.testUser.ID, dbAddr.UserID)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		addr := test.Data.testAddress
+		addr.Zip = ""
+		b, err := json.Marshal(&addr.AddressRequest)
+		require.NoError(t, err)
+
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + addr.ID
+		recorder := test.TestEndpoint(http.MethodPut, url, bytes.NewBuffer(b), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("AsStranger", func(t *testing.T) {
+		test := NewRouteTest(t)
+		b, err := json.Marshal(&test.Data.testAddress.AddressRequest)
+		require.NoError(t, err)
+
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + test.Data.testAddress.ID
+		recorder := test.TestEndpoint(http.MethodPut, url, bytes.NewBuffer(b), testToken("stranger-danger", ""))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("MissingAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		b, err := json.Marshal(&test.Data.testAddress.AddressRequest)
+		require.NoError(t, err)
+
+		url := "/users/" + test.Data.testUser.ID + "/addresses/dne"
+		recorder := test.TestEndpoint(http.MethodPut, url, bytes.NewBuffer(b), test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
 }
 
 func TestUserAddressCreate(t *testing.T) {
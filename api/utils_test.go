@@ -70,6 +70,7 @@ func testConfig() (*conf.GlobalConfiguration, *conf.Configuration) {
 	config := new(conf.Configuration)
 	config.JWT.Secret = "testsecret"
 	config.JWT.AdminGroupName = "admin"
+	config.ActionLinks.URL = "https://api.example.com/"
 	config.Payment.Stripe.Enabled = true
 	config.Payment.Stripe.SecretKey = "secret"
 	return globalConfig, config
@@ -97,13 +98,21 @@ func testExpiredToken(id, email string) *jwt.Token {
 }
 
 func testAdminToken(id, email string) *jwt.Token {
+	return testRoleToken(id, email, "admin")
+}
+
+func testRoleToken(id, email string, roles ...string) *jwt.Token {
+	roleData := []interface{}{}
+	for _, role := range roles {
+		roleData = append(roleData, role)
+	}
 	claims := &claims.JWTClaims{
 		StandardClaims: jwt.StandardClaims{
 			Subject: id,
 		},
 		Email: email,
 		AppMetaData: map[string]interface{}{
-			"roles": []interface{}{"admin"},
+			"roles": roleData,
 		},
 	}
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -1,25 +1,133 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/mattes/vat"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/breaker"
+	gcontext "github.com/netlify/gocommerce/context"
+)
+
+const (
+	vatNumbersNamespace = "vatnumbers"
+	defaultVATCacheTTL  = 24 * time.Hour
+	// staleVATCacheTTL is how long validation results are kept to fall back
+	// on while VIES is down.
+	staleVATCacheTTL = 30 * 24 * time.Hour
 )
 
+// checkVAT validates a VAT number with VIES.
+var checkVAT = vat.CheckVAT
+
+// vatNumberCheck is the result of validating a VAT number.
+type vatNumberCheck struct {
+	Valid     bool      `json:"valid"`
+	Country   string    `json:"country"`
+	Company   string    `json:"company"`
+	Address   string    `json:"address"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
 // VatNumberLookup looks up information on a VAT number
 func (a *API) VatNumberLookup(w http.ResponseWriter, r *http.Request) error {
 	number := chi.URLParam(r, "vat_number")
 
-	response, err := vat.CheckVAT(number)
+	check, err := a.checkVATNumber(r.Context(), number)
+	if err == breaker.ErrOpen {
+		return serviceUnavailableError("VAT numbers can't be looked up right now, please try again later")
+	}
 	if err != nil {
 		return internalServerError("Failed to lookup VAT Number").WithInternalError(err)
 	}
 
 	return sendJSON(w, http.StatusOK, map[string]interface{}{
-		"country": response.CountryCode,
-		"valid":   response.Valid,
-		"company": response.Name,
-		"address": response.Address,
+		"country": check.Country,
+		"valid":   check.Valid,
+		"company": check.Company,
+		"address": check.Address,
 	})
 }
+
+// verifyVATNumber checks that the VAT number of an order is valid, and
+// returns whether it was validated. When VIES can't be reached, the number is
+// accepted without being validated if the instance fails open. Orders with
+// such a number are charged VAT, as it could be invalid.
+func (a *API) verifyVATNumber(ctx context.Context, log logrus.FieldLogger, number string) (bool, *HTTPError) {
+	check, err := a.checkVATNumber(ctx, number)
+	if err != nil {
+		if gcontext.GetConfig(ctx).VATNumbers.FailOpen {
+			log.WithError(err).WithField("vat_number", number).Warn("Accepting a VAT number that couldn't be validated")
+			return false, nil
+		}
+		return false, serviceUnavailableError("VAT numbers can't be verified right now, please try again later").WithInternalError(err)
+	}
+	if !check.Valid {
+		return false, badRequestError("Vat number %v is not valid", number)
+	}
+	return true, nil
+}
+
+// checkVATNumber validates a VAT number with VIES. Results are cached for the
+// configured TTL, and older results are used when VIES fails.
+func (a *API) checkVATNumber(ctx context.Context, number string) (*vatNumberCheck, error) {
+	config := gcontext.GetConfig(ctx)
+	log := logrus.WithField("component", "vat_numbers")
+	key := strings.ToUpper(strings.Replace(number, " ", "", -1))
+	ttl := defaultVATCacheTTL
+	if config.VATNumbers.CacheTTL > 0 {
+		ttl = time.Duration(config.VATNumbers.CacheTTL) * time.Hour
+	}
+
+	var cached *vatNumberCheck
+	data, found, err := a.vatNumbers.Get(vatNumbersNamespace, key)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read the VAT number cache")
+	}
+	if found {
+		check := &vatNumberCheck{}
+		if err := json.Unmarshal(data, check); err == nil {
+			cached = check
+		}
+	}
+	if cached != nil && time.Since(cached.CheckedAt) < ttl {
+		return cached, nil
+	}
+
+	var response *vat.VATresponse
+	err = breaker.Get(breaker.VAT, "").Do(func() error {
+		var err error
+		response, err = checkVAT(key)
+		return err
+	})
+	check := &vatNumberCheck{CheckedAt: time.Now()}
+	switch {
+	case err == vat.ErrVATnumberNotValid:
+	case err != nil:
+		if cached != nil {
+			log.WithError(err).Warn("Using an outdated validation of a VAT number")
+			return cached, nil
+		}
+		return nil, err
+	default:
+		check.Valid = response.Valid
+		check.Country = response.CountryCode
+		check.Company = response.Name
+		check.Address = response.Address
+	}
+
+	data, err = json.Marshal(check)
+	if err == nil {
+		err = a.vatNumbers.Set(vatNumbersNamespace, key, data, staleVATCacheTTL)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to write the VAT number cache")
+	}
+	return check, nil
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattes/vat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// stubVIES replaces the VIES lookup for a test. A nil response makes the
+// lookup fail as if VIES was down.
+func stubVIES(response *vat.VATresponse) *int {
+	calls := 0
+	checkVAT = func(number string) (*vat.VATresponse, error) {
+		calls++
+		if response == nil {
+			return nil, vat.ErrVATserviceUnreachable
+		}
+		return response, nil
+	}
+	return &calls
+}
+
+func vatOrderBody(number string) *strings.Reader {
+	return strings.NewReader(`{
+		"email": "info@example.com",
+		"vatnumber": "` + number + `",
+		"shipping_address": {
+			"name": "Test User",
+			"address1": "Branengebranen",
+			"city": "Berlin", "country": "Germany", "zip": "94107"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`)
+}
+
+func TestVATNumbers(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	defer func() { checkVAT = vat.CheckVAT }()
+
+	t.Run("Cached", func(t *testing.T) {
+		test := NewRouteTest(t)
+		calls := stubVIES(&vat.VATresponse{CountryCode: "AT", Valid: true, Name: "Example GmbH"})
+		api := NewAPI(test.GlobalConfig, test.DB)
+
+		ctx, err := WithInstanceConfig(context.Background(), test.Config, "")
+		require.NoError(t, err)
+		check, err := api.checkVATNumber(ctx, "ATU 12345678")
+		require.NoError(t, err)
+		assert.True(t, check.Valid)
+		assert.Equal(t, "Example GmbH", check.Company)
+		_, err = api.checkVATNumber(ctx, "atu12345678")
+		require.NoError(t, err)
+		assert.Equal(t, 1, *calls)
+
+		outdated, err := json.Marshal(&vatNumberCheck{Valid: true, CheckedAt: time.Now().Add(-48 * time.Hour)})
+		require.NoError(t, err)
+		require.NoError(t, api.vatNumbers.Set(vatNumbersNamespace, "ATU12345678", outdated, time.Hour))
+		calls = stubVIES(nil)
+		check, err = api.checkVATNumber(ctx, "ATU12345678")
+		require.NoError(t, err, "outdated results are used while VIES is down")
+		assert.True(t, check.Valid)
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("ReverseCharge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		stubVIES(&vat.VATresponse{CountryCode: "AT", Valid: true})
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", vatOrderBody("ATU12345678"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "ATU12345678", order.VATNumber)
+		assert.True(t, order.ReverseCharge)
+		assert.Equal(t, uint64(0), order.Taxes)
+		assert.Equal(t, uint64(999), order.Total)
+	})
+
+	t.Run("DomesticVATNumber", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		stubVIES(&vat.VATresponse{CountryCode: "DE", Valid: true})
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", vatOrderBody("DE123456789"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.False(t, order.ReverseCharge)
+		assert.Equal(t, uint64(70), order.Taxes)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		stubVIES(&vat.VATresponse{CountryCode: "AT", Valid: false})
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", vatOrderBody("ATU00000000"), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("FailClosed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		stubVIES(nil)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", vatOrderBody("ATU99999999"), test.Data.testUserToken)
+		validateError(t, http.StatusServiceUnavailable, recorder)
+	})
+
+	t.Run("FailOpen", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.VATNumbers.FailOpen = true
+		stubVIES(nil)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", vatOrderBody("ATU99999998"), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "ATU99999998", order.VATNumber)
+		assert.True(t, order.VATNumberUnverified)
+		assert.False(t, order.ReverseCharge, "unverified VAT numbers are charged VAT")
+		assert.Equal(t, uint64(70), order.Taxes)
+
+		stubVIES(&vat.VATresponse{CountryCode: "AT", Valid: true})
+		body := strings.NewReader(`{"vatnumber": "ATU99999998"}`)
+		recorder = test.TestEndpoint(http.MethodPut, "/orders/"+order.ID+"/invoice-details", body, test.Data.testUserToken)
+		verified := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, verified)
+		assert.False(t, verified.VATNumberUnverified)
+		assert.True(t, verified.ReverseCharge)
+		assert.Equal(t, uint64(0), verified.Taxes)
+	})
+}
@@ -0,0 +1,265 @@
+// Package breaker provides circuit breakers for the external services
+// gocommerce depends on. A breaker counts the failures of calls to a service,
+// and once they pile up, it fails further calls right away instead of letting
+// every request wait on a service that is down.
+package breaker
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// State is the state of a circuit breaker.
+type State string
+
+const (
+	// Closed breakers let all calls through.
+	Closed State = "closed"
+	// Open breakers fail all calls without making them.
+	Open State = "open"
+	// HalfOpen breakers let a single probe call through to find out whether
+	// the service is back.
+	HalfOpen State = "half_open"
+)
+
+// Groups of breakers of the services gocommerce calls.
+const (
+	// Payments are the payment providers, one breaker per provider.
+	Payments = "payments"
+	// Site is the site products are fetched from, one breaker per origin.
+	Site = "site"
+	// Mail is the mail service, one breaker per SMTP host or email API.
+	Mail = "mail"
+	// VAT is the VIES service that validates VAT numbers.
+	VAT = "vat"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+)
+
+// ErrOpen is returned for calls that a breaker didn't let through.
+var ErrOpen = errors.New("The service is unavailable, calls to it are suspended")
+
+var errPanicked = errors.New("The call panicked")
+
+// Settings configures a breaker.
+type Settings struct {
+	// FailureThreshold is the number of failed calls in a row after which the
+	// breaker opens. Defaults to 5.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before it lets a probe
+	// call through. Defaults to 30 seconds.
+	OpenTimeout time.Duration
+	// SlowCall is the duration after which a successful call still counts as
+	// a failure, so a service that slows down to a crawl opens the breaker
+	// too. Zero only counts errors.
+	SlowCall time.Duration
+	// IsFailure tells whether an error means the service is failing. Errors
+	// caused by the call itself, like a declined card, shouldn't open the
+	// breaker. Defaults to counting all errors.
+	IsFailure func(error) bool
+}
+
+// Stats are the metrics of a breaker.
+type Stats struct {
+	Name                string     `json:"name"`
+	State               State      `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Successes           uint64     `json:"successes"`
+	Failures            uint64     `json:"failures"`
+	Rejections          uint64     `json:"rejections"`
+	Opened              uint64     `json:"opened"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+}
+
+// Breaker is a circuit breaker for one service.
+type Breaker struct {
+	group    string
+	mutex    sync.Mutex
+	settings Settings
+	stats    Stats
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+// New returns a closed breaker.
+func New(name string, settings Settings) *Breaker {
+	b := &Breaker{stats: Stats{Name: name, State: Closed}, now: time.Now}
+	b.configure(settings)
+	return b
+}
+
+func (b *Breaker) configure(settings Settings) {
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = defaultFailureThreshold
+	}
+	if settings.OpenTimeout <= 0 {
+		settings.OpenTimeout = defaultOpenTimeout
+	}
+	b.settings = settings
+}
+
+// Name returns the name of the service of the breaker.
+func (b *Breaker) Name() string {
+	return b.stats.Name
+}
+
+// Do calls fn unless the breaker is open, and returns its error. Calls that
+// aren't let through return ErrOpen.
+func (b *Breaker) Do(fn func() error) error {
+	if !b.allow() {
+		return ErrOpen
+	}
+	start := b.now()
+	completed := false
+	defer func() {
+		if !completed {
+			// fn panicked, which mustn't leave a probe running forever.
+			b.record(errPanicked, b.now().Sub(start))
+		}
+	}()
+	err := fn()
+	completed = true
+	b.record(err, b.now().Sub(start))
+	return err
+}
+
+// Stats returns the current metrics of the breaker.
+func (b *Breaker) Stats() Stats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stats := b.stats
+	if stats.State != Closed {
+		openedAt := b.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	return stats
+}
+
+func (b *Breaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.stats.State {
+	case Closed:
+		return true
+	case Open:
+		if b.now().Sub(b.openedAt) >= b.settings.OpenTimeout {
+			b.setState(HalfOpen)
+			b.probing = true
+			return true
+		}
+	case HalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true
+		}
+	}
+	b.stats.Rejections++
+	return false
+}
+
+func (b *Breaker) record(err error, elapsed time.Duration) {
+	failed := err != nil && (b.settings.IsFailure == nil || b.settings.IsFailure(err))
+	if b.settings.SlowCall > 0 && elapsed > b.settings.SlowCall {
+		failed = true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	wasProbe := b.stats.State == HalfOpen
+	b.probing = false
+	if !failed {
+		b.stats.Successes++
+		b.stats.ConsecutiveFailures = 0
+		if wasProbe {
+			b.setState(Closed)
+		}
+		return
+	}
+
+	b.stats.Failures++
+	b.stats.ConsecutiveFailures++
+	if wasProbe || (b.stats.State == Closed && b.stats.ConsecutiveFailures >= b.settings.FailureThreshold) {
+		b.openedAt = b.now()
+		b.stats.Opened++
+		b.setState(Open)
+	}
+}
+
+func (b *Breaker) setState(state State) {
+	if b.stats.State == state {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"component": "breaker",
+		"service":   b.stats.Name,
+		"from":      b.stats.State,
+		"to":        state,
+	}).Warn("Circuit breaker changed state")
+	b.stats.State = state
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = map[string]*Breaker{}
+	groups        = map[string]Settings{}
+)
+
+// Configure sets the settings of a group of breakers, like the breakers of all
+// payment providers. Breakers of the group that exist already are updated.
+func Configure(group string, settings Settings) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	groups[group] = settings
+	for _, b := range registry {
+		if b.group == group {
+			b.mutex.Lock()
+			b.configure(settings)
+			b.mutex.Unlock()
+		}
+	}
+}
+
+// Get returns the breaker of a service in a group, shared by the whole
+// process, and creates it with the settings of the group on first use. The
+// breaker is named group:key, or just group when key is empty.
+func Get(group, key string) *Breaker {
+	name := group
+	if key != "" {
+		name += ":" + key
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	b, ok := registry[name]
+	if !ok {
+		b = New(name, groups[group])
+		b.group = group
+		registry[name] = b
+	}
+	return b
+}
+
+// All returns the metrics of all breakers created with Get, ordered by name.
+func All() []Stats {
+	registryMutex.Lock()
+	breakers := make([]*Breaker, 0, len(registry))
+	for _, b := range registry {
+		breakers = append(breakers, b)
+	}
+	registryMutex.Unlock()
+
+	stats := make([]Stats, len(breakers))
+	for i, b := range breakers {
+		stats[i] = b.Stats()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
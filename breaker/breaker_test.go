@@ -0,0 +1,126 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errFailed = errors.New("failed")
+
+func fail() error {
+	return errFailed
+}
+
+func succeed() error {
+	return nil
+}
+
+func newTestBreaker(settings Settings) (*Breaker, *time.Time) {
+	now := time.Now()
+	b := New("test", settings)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestOpensAfterThreshold(t *testing.T) {
+	b, _ := newTestBreaker(Settings{FailureThreshold: 3})
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.NoError(t, b.Do(succeed))
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, Closed, b.Stats().State)
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, Open, b.Stats().State)
+
+	called := false
+	assert.Equal(t, ErrOpen, b.Do(func() error {
+		called = true
+		return nil
+	}))
+	assert.False(t, called)
+
+	stats := b.Stats()
+	assert.EqualValues(t, 1, stats.Successes)
+	assert.EqualValues(t, 5, stats.Failures)
+	assert.EqualValues(t, 1, stats.Rejections)
+	assert.EqualValues(t, 1, stats.Opened)
+	assert.NotNil(t, stats.OpenedAt)
+}
+
+func TestHalfOpenProbe(t *testing.T) {
+	b, now := newTestBreaker(Settings{FailureThreshold: 1, OpenTimeout: time.Minute})
+	require.Equal(t, errFailed, b.Do(fail))
+	require.Equal(t, Open, b.Stats().State)
+
+	*now = now.Add(time.Minute)
+	require.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, Open, b.Stats().State, "a failed probe opens the breaker again")
+	assert.Equal(t, ErrOpen, b.Do(succeed))
+
+	*now = now.Add(time.Minute)
+	assert.NoError(t, b.Do(func() error {
+		assert.Equal(t, HalfOpen, b.Stats().State)
+		assert.Equal(t, ErrOpen, b.Do(succeed), "only one probe at a time")
+		return nil
+	}))
+	assert.Equal(t, Closed, b.Stats().State)
+	assert.Nil(t, b.Stats().OpenedAt)
+	assert.NoError(t, b.Do(succeed))
+}
+
+func TestIgnoredErrors(t *testing.T) {
+	errDeclined := errors.New("declined")
+	b, _ := newTestBreaker(Settings{FailureThreshold: 1, IsFailure: func(err error) bool {
+		return err != errDeclined
+	}})
+	assert.Equal(t, errDeclined, b.Do(func() error { return errDeclined }))
+	assert.Equal(t, Closed, b.Stats().State)
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, Open, b.Stats().State)
+}
+
+func TestSlowCalls(t *testing.T) {
+	b, now := newTestBreaker(Settings{FailureThreshold: 2, SlowCall: time.Second})
+	slow := func() error {
+		*now = now.Add(2 * time.Second)
+		return nil
+	}
+	assert.NoError(t, b.Do(slow))
+	assert.NoError(t, b.Do(slow))
+	assert.Equal(t, Open, b.Stats().State)
+}
+
+func TestPanics(t *testing.T) {
+	b, _ := newTestBreaker(Settings{FailureThreshold: 1})
+	assert.Panics(t, func() {
+		b.Do(func() error { panic("boom") })
+	})
+	assert.Equal(t, Open, b.Stats().State)
+}
+
+func TestRegistry(t *testing.T) {
+	b := Get("registry-test", "one")
+	assert.Equal(t, "registry-test:one", b.Name())
+	assert.Equal(t, b, Get("registry-test", "one"))
+	assert.NotEqual(t, b, Get("registry-test", "two"))
+
+	Configure("registry-test", Settings{FailureThreshold: 1})
+	b.Do(fail)
+	assert.Equal(t, Open, b.Stats().State, "existing breakers are configured")
+	assert.Equal(t, errFailed, Get("registry-test", "two").Do(fail))
+	assert.Equal(t, ErrOpen, Get("registry-test", "two").Do(fail), "new breakers use the settings of the group")
+
+	found := false
+	for _, stats := range All() {
+		if stats.Name == "registry-test:one" {
+			found = true
+			assert.EqualValues(t, 1, stats.Failures)
+		}
+	}
+	assert.True(t, found)
+}
@@ -0,0 +1,91 @@
+// Package cache provides the stores gocommerce caches data from the sites it
+// serves in, either in the memory of the process or in Redis to share it
+// between several processes.
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// maxMemoryEntries is the number of entries of a namespace after which the
+// memory store sweeps out expired entries.
+const maxMemoryEntries = 10000
+
+// Store keeps values for a limited time. Keys are grouped in namespaces that
+// can be purged at once.
+type Store interface {
+	// Get returns the value of a key, and false if there is none or it expired.
+	Get(namespace, key string) ([]byte, bool, error)
+	// Set stores the value of a key for the duration of ttl.
+	Set(namespace, key string, value []byte, ttl time.Duration) error
+	// Delete removes a key.
+	Delete(namespace, key string) error
+	// Purge removes all keys of a namespace.
+	Purge(namespace string) error
+}
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+type memoryStore struct {
+	mutex      sync.Mutex
+	namespaces map[string]map[string]*memoryEntry
+}
+
+// NewMemory returns a store that keeps the values in the memory of the process.
+func NewMemory() Store {
+	return &memoryStore{namespaces: map[string]map[string]*memoryEntry{}}
+}
+
+func (m *memoryStore) Get(namespace, key string) ([]byte, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.namespaces[namespace][key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(m.namespaces[namespace], key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (m *memoryStore) Set(namespace, key string, value []byte, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entries, ok := m.namespaces[namespace]
+	if !ok {
+		entries = map[string]*memoryEntry{}
+		m.namespaces[namespace] = entries
+	}
+	now := time.Now()
+	if len(entries) >= maxMemoryEntries {
+		for k, entry := range entries {
+			if now.After(entry.expiresAt) {
+				delete(entries, k)
+			}
+		}
+	}
+	entries[key] = &memoryEntry{value: value, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (m *memoryStore) Delete(namespace, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.namespaces[namespace], key)
+	return nil
+}
+
+func (m *memoryStore) Purge(namespace string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.namespaces, namespace)
+	return nil
+}
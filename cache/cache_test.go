@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestRedisStore(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+	defer server.Close()
+
+	store, err := NewRedis("redis://:secret@" + server.Addr().String() + "/2")
+	require.NoError(t, err)
+	testStore(t, store)
+
+	store, err = NewRedis("redis://:wrong@" + server.Addr().String())
+	require.NoError(t, err)
+	_, _, err = store.Get("products", "a")
+	assert.Error(t, err)
+}
+
+func TestNewRedis(t *testing.T) {
+	_, err := NewRedis("http://localhost")
+	assert.Error(t, err)
+	_, err = NewRedis("redis://localhost/db")
+	assert.Error(t, err)
+
+	store, err := NewRedis("redis://localhost")
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6379", store.(*redisStore).addr)
+}
+
+func testStore(t *testing.T, store Store) {
+	_, found, err := store.Get("products", "a")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, store.Set("products", "a", []byte("first"), time.Minute))
+	require.NoError(t, store.Set("products", "b", []byte("second"), time.Minute))
+	require.NoError(t, store.Set("other", "a", []byte("other"), time.Minute))
+	require.NoError(t, store.Set("products", "short", []byte("gone"), time.Millisecond))
+
+	value, found, err := store.Get("products", "a")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "first", string(value))
+
+	time.Sleep(5 * time.Millisecond)
+	_, found, err = store.Get("products", "short")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, store.Delete("products", "a"))
+	_, found, _ = store.Get("products", "a")
+	assert.False(t, found)
+	_, found, _ = store.Get("products", "b")
+	assert.True(t, found)
+
+	require.NoError(t, store.Purge("products"))
+	_, found, _ = store.Get("products", "b")
+	assert.False(t, found)
+	value, found, _ = store.Get("other", "a")
+	assert.True(t, found)
+	assert.Equal(t, "other", string(value))
+}
+
+type fakeRedis struct {
+	mutex   sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+// startFakeRedis serves the few commands the store and the limiter use.
+func startFakeRedis(t *testing.T, password string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{values: map[string]string{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, password)
+		}
+	}()
+	return l
+}
+
+func (f *fakeRedis) serve(conn net.Conn, password string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			if args[1] != password {
+				io.WriteString(conn, "-ERR invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			io.WriteString(conn, "+OK\r\n")
+			continue
+		}
+		if !authenticated {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		io.WriteString(conn, f.run(cmd, args[1:]))
+	}
+}
+
+func (f *fakeRedis) run(cmd string, args []string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := args[0]
+	if cmd == "EVAL" {
+		key = args[2]
+	}
+	if exp, ok := f.expires[key]; ok && time.Now().After(exp) {
+		delete(f.values, key)
+		delete(f.expires, key)
+	}
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		f.values[args[0]] = args[1]
+		ms, _ := strconv.Atoi(args[3])
+		f.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := f.values[args[0]]
+		delete(f.values, args[0])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "INCR":
+		n, _ := strconv.Atoi(f.values[args[0]])
+		f.values[args[0]] = strconv.Itoa(n + 1)
+		return fmt.Sprintf(":%d\r\n", n+1)
+	case "EVAL":
+		// counts the tokens taken instead of running the script, with
+		// buckets that don't refill
+		burst, _ := strconv.Atoi(args[3])
+		taken, _ := strconv.Atoi(f.values[key])
+		if taken >= burst {
+			return "*2\r\n:" + args[4] + "\r\n:0\r\n"
+		}
+		f.values[key] = strconv.Itoa(taken + 1)
+		return fmt.Sprintf("*2\r\n:0\r\n:%d\r\n", burst-taken-1)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("not a command: %v", reply)
+	}
+	args := make([]string, len(values))
+	for i, v := range values {
+		args[i] = string(v.([]byte))
+	}
+	return args, nil
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	for i := 0; i < 3; i++ {
+		ok, remaining, _, err := limiter.Take("orders", "1.2.3.4", 3, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 2-i, remaining)
+	}
+	ok, _, wait, err := limiter.Take("orders", "1.2.3.4", 3, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.True(t, wait > 59*time.Second && wait <= time.Minute, "waits for the next token, not %v", wait)
+
+	ok, _, _, _ = limiter.Take("orders", "5.6.7.8", 3, time.Minute)
+	assert.True(t, ok, "buckets are per key")
+	ok, _, _, _ = limiter.Take("coupons", "1.2.3.4", 3, time.Minute)
+	assert.True(t, ok, "buckets are per namespace")
+
+	ok, _, _, _ = limiter.Take("fast", "1.2.3.4", 1, 10*time.Millisecond)
+	assert.True(t, ok)
+	ok, _, _, _ = limiter.Take("fast", "1.2.3.4", 1, 10*time.Millisecond)
+	assert.False(t, ok)
+	time.Sleep(15 * time.Millisecond)
+	ok, _, _, _ = limiter.Take("fast", "1.2.3.4", 1, 10*time.Millisecond)
+	assert.True(t, ok, "buckets refill over time")
+}
+
+func TestRedisLimiter(t *testing.T) {
+	server := startFakeRedis(t, "")
+	defer server.Close()
+
+	limiter, err := NewRedisLimiter("redis://" + server.Addr().String())
+	require.NoError(t, err)
+	ok, remaining, wait, err := limiter.Take("orders", "1.2.3.4", 2, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, remaining)
+	assert.Equal(t, time.Duration(0), wait)
+
+	ok, remaining, _, err = limiter.Take("orders", "1.2.3.4", 2, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 0, remaining)
+
+	ok, _, wait, err = limiter.Take("orders", "1.2.3.4", 2, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, wait)
+}
@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limiter keeps token buckets, to limit how often a client can do something.
+// A bucket holds up to burst tokens and gets a new one every interval.
+type Limiter interface {
+	// Take takes a token from the bucket of a key, and returns the number of
+	// whole tokens left. When the bucket is empty it returns false and how
+	// long it takes until the next token.
+	Take(namespace, key string, burst int, interval time.Duration) (bool, int, time.Duration, error)
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	// fullAt is when the bucket is full again, after which it can be
+	// forgotten.
+	fullAt time.Time
+}
+
+type memoryLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewMemoryLimiter returns a limiter that keeps the buckets in the memory of
+// the process.
+func NewMemoryLimiter() Limiter {
+	return &memoryLimiter{buckets: map[string]*bucket{}}
+}
+
+func (m *memoryLimiter) Take(namespace, key string, burst int, interval time.Duration) (bool, int, time.Duration, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	if len(m.buckets) >= maxMemoryEntries {
+		for k, b := range m.buckets {
+			if now.After(b.fullAt) {
+				delete(m.buckets, k)
+			}
+		}
+	}
+
+	k := namespace + ":" + key
+	b, ok := m.buckets[k]
+	if !ok {
+		b = &bucket{tokens: float64(burst), at: now}
+		m.buckets[k] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+float64(now.Sub(b.at))/float64(interval))
+	b.at = now
+	if b.tokens < 1 {
+		return false, 0, time.Duration((1 - b.tokens) * float64(interval)), nil
+	}
+	b.tokens--
+	b.fullAt = now.Add(time.Duration((float64(burst) - b.tokens) * float64(interval)))
+	return true, int(b.tokens), 0, nil
+}
+
+// takeScript refills and takes from a bucket in one step, so processes
+// sharing it never take the same token.
+const takeScript = `
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "at")
+local tokens = tonumber(bucket[1]) or burst
+local at = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - at) / interval)
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  wait = math.ceil((1 - tokens) * interval)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "at", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * interval))
+return {wait, math.floor(tokens)}
+`
+
+// NewRedisLimiter returns a limiter that keeps the buckets in the Redis server
+// of a URL like redis://:password@localhost:6379/0, shared by all processes
+// using it.
+func NewRedisLimiter(rawURL string) (Limiter, error) {
+	store, err := NewRedis(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return store.(*redisStore), nil
+}
+
+func (r *redisStore) Take(namespace, key string, burst int, interval time.Duration) (bool, int, time.Duration, error) {
+	ms := int64(interval / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	reply, err := r.do("EVAL", takeScript, "1", redisKeyPrefix+"limits:"+namespace+":"+key,
+		strconv.Itoa(burst), strconv.FormatInt(ms, 10), strconv.FormatInt(now, 10))
+	if err != nil {
+		return false, 0, 0, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, 0, fmt.Errorf("redis: unexpected reply to EVAL: %v", reply)
+	}
+	wait, ok := values[0].(int64)
+	remaining, ok2 := values[1].(int64)
+	if !ok || !ok2 {
+		return false, 0, 0, fmt.Errorf("redis: unexpected reply to EVAL: %v", reply)
+	}
+	if wait > 0 {
+		return false, 0, time.Duration(wait) * time.Millisecond, nil
+	}
+	return true, int(remaining), 0, nil
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisKeyPrefix   = "gocommerce:"
+	redisTimeout     = 2 * time.Second
+	redisMaxIdleConn = 8
+)
+
+// redisStore keeps values in Redis. Purging a namespace bumps its generation,
+// which is part of the keys of the namespace, so the old keys are never read
+// again and expire on their own.
+type redisStore struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedis returns a store that keeps the values in the Redis server of a URL
+// like redis://:password@localhost:6379/0.
+func NewRedis(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Redis URL: %v", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("Invalid Redis URL: unsupported scheme '%v'", u.Scheme)
+	}
+
+	store := &redisStore{
+		addr: u.Host,
+		idle: make(chan *redisConn, redisMaxIdleConn),
+	}
+	if u.Port() == "" {
+		store.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		store.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		store.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Redis database '%v'", db)
+		}
+	}
+	return store, nil
+}
+
+func (r *redisStore) Get(namespace, key string) ([]byte, bool, error) {
+	k, err := r.key(namespace, key)
+	if err != nil {
+		return nil, false, err
+	}
+	reply, err := r.do("GET", k)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+	}
+	return value, true, nil
+}
+
+func (r *redisStore) Set(namespace, key string, value []byte, ttl time.Duration) error {
+	k, err := r.key(namespace, key)
+	if err != nil {
+		return err
+	}
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	_, err = r.do("SET", k, string(value), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+func (r *redisStore) Delete(namespace, key string) error {
+	k, err := r.key(namespace, key)
+	if err != nil {
+		return err
+	}
+	_, err = r.do("DEL", k)
+	return err
+}
+
+func (r *redisStore) Purge(namespace string) error {
+	_, err := r.do("INCR", r.generationKey(namespace))
+	return err
+}
+
+func (r *redisStore) generationKey(namespace string) string {
+	return redisKeyPrefix + namespace + ":generation"
+}
+
+func (r *redisStore) key(namespace, key string) (string, error) {
+	reply, err := r.do("GET", r.generationKey(namespace))
+	if err != nil {
+		return "", err
+	}
+	generation := "0"
+	if b, ok := reply.([]byte); ok {
+		generation = string(b)
+	}
+	return redisKeyPrefix + namespace + ":" + generation + ":" + key, nil
+}
+
+// do runs a command and returns its reply, which is nil, a string, an int64,
+// a []byte or a []interface{}.
+func (r *redisStore) do(args ...string) (interface{}, error) {
+	c, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The state of the connection is unknown after a network error.
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	select {
+	case r.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+func (r *redisStore) conn() (*redisConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if r.password != "" {
+		if _, err := c.do("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	cmd := make([]byte, 0, 64)
+	cmd = append(cmd, '*')
+	cmd = strconv.AppendInt(cmd, int64(len(args)), 10)
+	cmd = append(cmd, '\r', '\n')
+	for _, arg := range args {
+		cmd = append(cmd, '$')
+		cmd = strconv.AppendInt(cmd, int64(len(arg)), 10)
+		cmd = append(cmd, '\r', '\n')
+		cmd = append(cmd, arg...)
+		cmd = append(cmd, '\r', '\n')
+	}
+	if _, err := c.conn.Write(cmd); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type '%c'", kind)
+}
@@ -0,0 +1,93 @@
+package calculator
+
+import (
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxLegalTextLength = 2000
+
+var (
+	hexColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+	phonePattern    = regexp.MustCompile(`^\+?[0-9 ()./-]{3,30}$`)
+)
+
+// Branding is the look of the documents of the shop, like receipts and
+// invoices, and of its default mail templates.
+type Branding struct {
+	// LogoURL is the logo image, as an absolute URL or a path on the site.
+	LogoURL string `json:"logo_url,omitempty"`
+	// PrimaryColor is used for headings and AccentColor for lines, both as
+	// hex colors like #1a73e8.
+	PrimaryColor string `json:"primary_color,omitempty"`
+	AccentColor  string `json:"accent_color,omitempty"`
+
+	SupportEmail string `json:"support_email,omitempty"`
+	SupportPhone string `json:"support_phone,omitempty"`
+	SupportURL   string `json:"support_url,omitempty"`
+
+	// LegalText is printed at the bottom of documents and mails, like the
+	// registered office and company number of the shop.
+	LegalText string `json:"legal_text,omitempty"`
+}
+
+// Validate returns what's wrong with the branding by field, or nil when
+// it's valid.
+func (b *Branding) Validate() map[string]string {
+	invalid := map[string]string{}
+	if b.LogoURL != "" && !validLink(b.LogoURL, true) {
+		invalid["logo_url"] = "must be an http or https URL, or a path on the site"
+	}
+	for field, color := range map[string]string{"primary_color": b.PrimaryColor, "accent_color": b.AccentColor} {
+		if color != "" && !hexColorPattern.MatchString(color) {
+			invalid[field] = "must be a hex color like #1a73e8"
+		}
+	}
+	if b.SupportEmail != "" {
+		if address, err := mail.ParseAddress(b.SupportEmail); err != nil || address.Address != b.SupportEmail {
+			invalid["support_email"] = "must be an email address"
+		}
+	}
+	if b.SupportPhone != "" && !phonePattern.MatchString(b.SupportPhone) {
+		invalid["support_phone"] = "must be a phone number"
+	}
+	if b.SupportURL != "" && !validLink(b.SupportURL, false) {
+		invalid["support_url"] = "must be an http or https URL"
+	}
+	if utf8.RuneCountInString(b.LegalText) > maxLegalTextLength {
+		invalid["legal_text"] = "must be at most " + strconv.Itoa(maxLegalTextLength) + " characters"
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+	return invalid
+}
+
+// RGB returns the red, green and blue parts of a hex color from 0 to 1.
+func RGB(color string) (r, g, b float64, ok bool) {
+	if !hexColorPattern.MatchString(color) {
+		return 0, 0, 0, false
+	}
+	hex := color[1:]
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	parts := [3]float64{}
+	for i := range parts {
+		value, _ := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+		parts[i] = float64(value) / 255
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+func validLink(link string, allowPath bool) bool {
+	if allowPath && strings.HasPrefix(link, "/") && !strings.HasPrefix(link, "//") {
+		return true
+	}
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -1,30 +1,242 @@
 package calculator
 
 import (
+	"fmt"
 	"math"
-	"strconv"
+	"strings"
 
 	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/jsonschema"
 )
 
 // Price represents the total price of all line items.
 type Price struct {
-	Items []ItemPrice
+	Items []ItemPrice `json:"items"`
 
-	Subtotal uint64
-	Discount uint64
-	Taxes    uint64
-	Total    uint64
+	Subtotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
+	Taxes    uint64 `json:"taxes"`
+	Total    uint64 `json:"total"`
+
+	// Adjustments are the taxes and discounts that were applied.
+	Adjustments []*Adjustment `json:"adjustments"`
+
+	// ReverseCharge is set when no taxes were charged because the buyer
+	// accounts for the VAT themselves.
+	ReverseCharge bool `json:"reverse_charge,omitempty"`
+	// TaxExempt is set when no taxes were charged because the buyer is
+	// exempt from them.
+	TaxExempt bool `json:"tax_exempt,omitempty"`
+
+	// Shipping is the shipping cost without taxes, for the rate of
+	// ShippingMethod. The taxes on shipping are included in Taxes.
+	Shipping       uint64 `json:"shipping"`
+	ShippingMethod string `json:"shipping_method,omitempty"`
+	// ShippingError is set when the items can't be shipped to the country
+	// with the shipping method, in which case Shipping is 0.
+	ShippingError error `json:"-"`
+
+	// SpendTier is the name of the spend tier the order reached, and
+	// NextTier the tier with a higher discount it can reach next, if any.
+	SpendTier string         `json:"spend_tier,omitempty"`
+	NextTier  *NextSpendTier `json:"next_tier,omitempty"`
+}
+
+// Types of adjustments
+const (
+	TaxAdjustment            = "tax"
+	ShippingTaxAdjustment    = "shipping_tax"
+	CouponAdjustment         = "coupon"
+	MemberDiscountAdjustment = "member_discount"
+	ManualDiscountAdjustment = "manual_discount"
+	ShippingAdjustment       = "shipping"
+	PromotionAdjustment      = "promotion"
+	SpendTierAdjustment      = "spend_tier"
+)
+
+// Adjustment is a tax, discount or shipping cost that was applied to a price,
+// with the total amount it added or took off and the products it applied to.
+// Taxes and member discounts are named after their name in the settings, or
+// their position in the settings if they have no name, and shipping after its
+// method.
+type Adjustment struct {
+	Type       string   `json:"type"`
+	Name       string   `json:"name,omitempty"`
+	Percentage uint64   `json:"percentage,omitempty"`
+	Amount     uint64   `json:"amount"`
+	Skus       []string `json:"skus,omitempty"`
+	// Base is the part of the shipping costs a shipping tax was charged on.
+	Base uint64 `json:"base,omitempty"`
+}
+
+// AddAdjustment adds an amount to the adjustment of a type and name, or adds
+// a new adjustment if there is none yet.
+func (p *Price) AddAdjustment(kind, name string, percentage, amount uint64, sku string) {
+	if amount == 0 {
+		return
+	}
+	for _, a := range p.Adjustments {
+		if a.Type == kind && a.Name == name && a.Percentage == percentage {
+			a.Amount += amount
+			if sku != "" && !containsString(a.Skus, sku) {
+				a.Skus = append(a.Skus, sku)
+			}
+			return
+		}
+	}
+	adjustment := &Adjustment{Type: kind, Name: name, Percentage: percentage, Amount: amount}
+	if sku != "" {
+		adjustment.Skus = []string{sku}
+	}
+	p.Adjustments = append(p.Adjustments, adjustment)
 }
 
-// ItemPrice is the price of a single line item.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ItemPrice is the price of a single line item. Subtotal, Discount, Taxes
+// and Total are the price of one unit. PromotionDiscount, the discount of
+// promotions on the units they picked, and TierDiscount, the share of the
+// line item in the discount of the spend tier, are for the whole line and
+// left out of Total.
 type ItemPrice struct {
-	Quantity uint64
+	Quantity uint64 `json:"quantity"`
+
+	Subtotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
+	Taxes    uint64 `json:"taxes"`
+	Total    uint64 `json:"total"`
+
+	// Net is the price of one unit after discounts without taxes, and Gross
+	// with taxes, whether the prices of the site include taxes or not.
+	Net   uint64 `json:"net"`
+	Gross uint64 `json:"gross"`
+
+	// AppliedTaxes and AppliedDiscounts make up Taxes and Discount.
+	AppliedTaxes     []*AppliedTax      `json:"applied_taxes,omitempty"`
+	AppliedDiscounts []*AppliedDiscount `json:"applied_discounts,omitempty"`
+
+	// LineDiscounts are the discounts of promotions and spend tiers on the
+	// whole line, and LineNet and LineGross what the whole line costs after
+	// all discounts without and with taxes.
+	LineDiscounts []*AppliedDiscount `json:"line_discounts,omitempty"`
+	LineNet       uint64             `json:"line_net"`
+	LineGross     uint64             `json:"line_gross"`
 
-	Subtotal uint64
-	Discount uint64
-	Taxes    uint64
-	Total    uint64
+	PromotionDiscount uint64           `json:"promotion_discount,omitempty"`
+	Promotions        []*ItemPromotion `json:"promotions,omitempty"`
+	TierDiscount      uint64           `json:"tier_discount,omitempty"`
+}
+
+// AppliedTax is a tax charged on one unit of a line item.
+type AppliedTax struct {
+	Name       string `json:"name"`
+	Percentage uint64 `json:"percentage"`
+	Amount     uint64 `json:"amount"`
+}
+
+// AppliedDiscount is a discount given on one unit of a line item, of the
+// CouponAdjustment or MemberDiscountAdjustment type, or on the whole line,
+// of the PromotionAdjustment or SpendTierAdjustment type.
+type AppliedDiscount struct {
+	Type       string `json:"type"`
+	Name       string `json:"name,omitempty"`
+	Percentage uint64 `json:"percentage,omitempty"`
+	Amount     uint64 `json:"amount"`
+}
+
+// addTax adds the amount of a tax to the applied taxes, merging the taxes of
+// the items of a bundle with the same rate.
+func (p *ItemPrice) addTax(name string, percentage, amount uint64) {
+	for _, t := range p.AppliedTaxes {
+		if t.Name == name && t.Percentage == percentage {
+			t.Amount += amount
+			return
+		}
+	}
+	p.AppliedTaxes = append(p.AppliedTaxes, &AppliedTax{Name: name, Percentage: percentage, Amount: amount})
+}
+
+// discountTaxes lowers the taxes of the order by the share of the taxes of a
+// line item in a discount on it, which promotions and spend tiers give after
+// the taxes were calculated. The discount is on the price of the site, so it
+// includes the share of the taxes when prices include taxes. It returns the
+// discount without taxes, which is taken off the subtotal.
+func (p *Price) discountTaxes(round func(float64) uint64, item int, amount uint64, includeTaxes bool) uint64 {
+	itemPrice := p.Items[item]
+	base := itemPrice.Subtotal
+	if includeTaxes {
+		base += itemPrice.Taxes
+	}
+	if base == 0 {
+		p.Items[item].discountLine(amount, amount)
+		return amount
+	}
+	var lowered uint64
+	for _, tax := range itemPrice.AppliedTaxes {
+		share := round(float64(amount) * float64(tax.Amount) / float64(base))
+		if share > p.Taxes {
+			share = p.Taxes
+		}
+		for _, a := range p.Adjustments {
+			if a.Type == TaxAdjustment && a.Name == tax.Name && a.Percentage == tax.Percentage {
+				if share > a.Amount {
+					share = a.Amount
+				}
+				a.Amount -= share
+				break
+			}
+		}
+		p.Taxes -= share
+		lowered += share
+	}
+	if includeTaxes && lowered <= amount {
+		p.Items[item].discountLine(amount-lowered, amount)
+		return amount - lowered
+	}
+	p.Items[item].discountLine(amount, amount+lowered)
+	return amount
+}
+
+// discountLine takes a discount on the whole line off its net and gross
+// price.
+func (p *ItemPrice) discountLine(net, gross uint64) {
+	if net > p.LineNet {
+		net = p.LineNet
+	}
+	if gross > p.LineGross {
+		gross = p.LineGross
+	}
+	p.LineNet -= net
+	p.LineGross -= gross
+}
+
+func (p *ItemPrice) addDiscount(kind, name string, percentage, amount uint64) {
+	if amount == 0 {
+		return
+	}
+	p.AppliedDiscounts = append(p.AppliedDiscounts, &AppliedDiscount{Type: kind, Name: name, Percentage: percentage, Amount: amount})
+}
+
+// addLineDiscount adds the discount of a promotion or spend tier to the
+// discounts of the whole line, merging the units a promotion discounts.
+func (p *ItemPrice) addLineDiscount(kind, name string, percentage, amount uint64) {
+	if amount == 0 {
+		return
+	}
+	for _, d := range p.LineDiscounts {
+		if d.Type == kind && d.Name == name {
+			d.Amount += amount
+			return
+		}
+	}
+	p.LineDiscounts = append(p.LineDiscounts, &AppliedDiscount{Type: kind, Name: name, Percentage: percentage, Amount: amount})
 }
 
 // Settings represent the site-wide settings for price calculation.
@@ -32,10 +244,200 @@ type Settings struct {
 	PricesIncludeTaxes bool              `json:"prices_include_taxes"`
 	Taxes              []*Tax            `json:"taxes"`
 	MemberDiscounts    []*MemberDiscount `json:"member_discounts"`
+	Promotions         []*Promotion      `json:"promotions,omitempty"`
+	SpendTiers         []*SpendTier      `json:"spend_tiers,omitempty"`
+
+	Shipping *ShippingSettings `json:"shipping,omitempty"`
+
+	// VATCountry is the country code the VAT number of the shop starts with,
+	// like DE. When set, orders of businesses with a VAT number from another
+	// EU country are charged without taxes.
+	VATCountry string `json:"vat_country,omitempty"`
+
+	// Rounding is how taxes and discounts are rounded, half to even per
+	// unit by default.
+	Rounding *RoundingSettings `json:"rounding,omitempty"`
+
+	Invoice *InvoiceSettings `json:"invoice,omitempty"`
+	// Branding is the logo, colors, support contact and legal text of
+	// receipts, invoices and the default mail templates.
+	Branding *Branding `json:"branding,omitempty"`
+
+	// OrderData declares the keys of the metadata of orders that can be
+	// updated after the order was created.
+	OrderData map[string]*OrderDataField `json:"order_data,omitempty"`
+	// OrderDataSchema is a JSON Schema the metadata of orders must match,
+	// when they are created and whenever their metadata changes.
+	OrderDataSchema *jsonschema.Schema `json:"order_data_schema,omitempty"`
+
+	// Returns is the return policy of the shop. Without one, paid items can
+	// only be refunded by admins.
+	Returns *ReturnPolicy `json:"returns,omitempty"`
+
+	// Automations are rules that take actions on the orders matching them.
+	Automations []*Automation `json:"automations,omitempty"`
+}
+
+// Types of the actions of automations.
+const (
+	// AddTagAction adds a tag to the order.
+	AddTagAction = "add_tag"
+	// EmailAction sends a mail about the order.
+	EmailAction = "email"
+	// WebhookAction sends the order to a webhook.
+	WebhookAction = "webhook"
+	// HoldAction puts the order on hold, so it can't be shipped until an
+	// admin releases it.
+	HoldAction = "hold"
+)
+
+// Automation is a rule that takes actions on the orders that match its
+// conditions, like holding big orders for review. A rule runs at most once
+// per order.
+type Automation struct {
+	// Name identifies the rule in the history of orders.
+	Name    string              `json:"name"`
+	When    AutomationCondition `json:"when"`
+	Actions []*AutomationAction `json:"actions"`
+}
+
+// AutomationCondition is what orders an Automation applies to. All the
+// conditions that are set must match.
+type AutomationCondition struct {
+	PaymentState     string `json:"payment_state,omitempty"`
+	FulfillmentState string `json:"fulfillment_state,omitempty"`
+	Tag              string `json:"tag,omitempty"`
+	// TotalOver matches the orders with a higher total, in Currency, or in
+	// any currency without one.
+	TotalOver *uint64 `json:"total_over,omitempty"`
+	Currency  string  `json:"currency,omitempty"`
+}
+
+// AutomationAction is an action of an Automation.
+type AutomationAction struct {
+	Type string `json:"type"`
+	// Tag is the tag of add_tag actions.
+	Tag string `json:"tag,omitempty"`
+	// To is who email actions mail: the customer (the default), the admin
+	// or an email address. Template is the path of the mail template on the
+	// site.
+	To       string `json:"to,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Template string `json:"template,omitempty"`
+	// URL is where webhook actions send the order.
+	URL string `json:"url,omitempty"`
+	// Reason is why hold actions hold the order.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ReturnRule is how long items can be returned after payment, and the part of
+// their price that is kept as a restocking fee.
+type ReturnRule struct {
+	// WindowDays is the number of days after payment items can be returned
+	// in. Items can't be returned with a window of 0 days.
+	WindowDays int `json:"window_days"`
+	// RestockingFee is the percentage of the price kept on returns.
+	RestockingFee uint64 `json:"restocking_fee_percentage,omitempty"`
+}
+
+// ReturnPolicy is the default return rule of the shop, with its exceptions
+// for some product types.
+type ReturnPolicy struct {
+	ReturnRule
+	ProductTypes map[string]*ReturnRule `json:"product_types,omitempty"`
+}
+
+// RuleFor returns the return rule for products of a type.
+func (p *ReturnPolicy) RuleFor(productType string) *ReturnRule {
+	if rule, ok := p.ProductTypes[productType]; ok && rule != nil {
+		return rule
+	}
+	return &p.ReturnRule
+}
+
+// Fee returns the restocking fee kept of an amount.
+func (r *ReturnRule) Fee(amount uint64) uint64 {
+	if r.RestockingFee >= 100 {
+		return amount
+	}
+	return rint(float64(amount) * float64(r.RestockingFee) / 100)
+}
+
+// Who can write keys of the metadata of orders.
+const (
+	// CustomerWritable keys can be written by the buyer until the order is
+	// paid, and by admins.
+	CustomerWritable = "customer"
+	// AdminWritable keys can only be written by admins.
+	AdminWritable = "admin"
+)
+
+// OrderDataField declares a key of the metadata of orders.
+type OrderDataField struct {
+	// Type is the JSON type of the value: string, number, boolean, object or
+	// array. Any value is allowed without a type.
+	Type string `json:"type,omitempty"`
+	// Writable is who can write the key, CustomerWritable or AdminWritable.
+	// Defaults to admins.
+	Writable string `json:"writable,omitempty"`
+	// ImmutableAfterPayment keeps the key from changing once the order is
+	// paid, even by admins.
+	ImmutableAfterPayment bool `json:"immutable_after_payment,omitempty"`
+}
+
+// Accepts tells whether a value decoded from JSON has the type of the field.
+func (f *OrderDataField) Accepts(value interface{}) bool {
+	switch value.(type) {
+	case string:
+		return f.Type == "" || f.Type == "string"
+	case float64:
+		return f.Type == "" || f.Type == "number"
+	case bool:
+		return f.Type == "" || f.Type == "boolean"
+	case map[string]interface{}:
+		return f.Type == "" || f.Type == "object"
+	case []interface{}:
+		return f.Type == "" || f.Type == "array"
+	}
+	return false
+}
+
+// InvoiceSettings are the details of the shop printed on invoices.
+type InvoiceSettings struct {
+	Seller    string   `json:"seller"`
+	Address   []string `json:"address,omitempty"`
+	VATNumber string   `json:"vat_number,omitempty"`
+	Email     string   `json:"email,omitempty"`
+	// NumberPrefix is put in front of the invoice numbers of orders, like
+	// INV- for INV-1042.
+	NumberPrefix string `json:"number_prefix,omitempty"`
+	Footer       string `json:"footer,omitempty"`
+	// Template is the path on the site of an HTML template for invoices,
+	// which replaces the default one.
+	Template string `json:"template,omitempty"`
+}
+
+// euVATCountries are the country codes of VAT numbers that VIES validates.
+var euVATCountries = []string{
+	"AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "EL", "ES", "FI", "FR", "HR", "HU",
+	"IE", "IT", "LT", "LU", "LV", "MT", "NL", "PL", "PT", "RO", "SE", "SI", "SK", "XI",
+}
+
+// ReverseCharge tells whether an order with a validated VAT number is a B2B
+// order across EU borders, for which the buyer pays the VAT in their own
+// country instead of the shop charging it.
+func (s *Settings) ReverseCharge(vatNumber string) bool {
+	if s == nil || s.VATCountry == "" || len(vatNumber) < 2 {
+		return false
+	}
+	buyer := strings.ToUpper(vatNumber[:2])
+	seller := strings.ToUpper(s.VATCountry)
+	return buyer != seller && containsString(euVATCountries, buyer) && containsString(euVATCountries, seller)
 }
 
 // Tax represents a tax, potentially specific to countries and product types.
 type Tax struct {
+	Name         string   `json:"name,omitempty"`
 	Percentage   uint64   `json:"percentage"`
 	ProductTypes []string `json:"product_types"`
 	Countries    []string `json:"countries"`
@@ -44,6 +446,14 @@ type Tax struct {
 type taxAmount struct {
 	price      uint64
 	percentage uint64
+	name       string
+}
+
+func (t *Tax) name(index int) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("taxes[%d]", index)
 }
 
 // FixedMemberDiscount represents a fixed discount given to members.
@@ -53,15 +463,25 @@ type FixedMemberDiscount struct {
 }
 
 // MemberDiscount represents a discount given to members, either fixed
-// or a percentage.
+// or a percentage. With groups, only members of one of the customer groups
+// get the discount.
 type MemberDiscount struct {
+	Name         string                 `json:"name,omitempty"`
 	Claims       map[string]string      `json:"claims"`
+	Groups       []string               `json:"groups,omitempty"`
 	Percentage   uint64                 `json:"percentage"`
 	FixedAmount  []*FixedMemberDiscount `json:"fixed"`
 	ProductTypes []string               `json:"product_types"`
 	Products     []string               `json:"products"`
 }
 
+func (d *MemberDiscount) name(index int) string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return fmt.Sprintf("member_discounts[%d]", index)
+}
+
 // ValidForType returns whether a member discount is valid for a product type.
 func (d *MemberDiscount) ValidForType(productType string) bool {
 	if d.ProductTypes == nil || len(d.ProductTypes) == 0 {
@@ -107,13 +527,19 @@ type Coupon interface {
 	FixedDiscount(string) uint64
 }
 
+// StackableCoupon is a Coupon that can refuse to combine with other
+// discounts. Coupons that don't implement it always combine with them.
+type StackableCoupon interface {
+	Stackable() bool
+}
+
 // FixedDiscount returns what the fixed discount amount is for a particular currency.
 func (d *MemberDiscount) FixedDiscount(currency string) uint64 {
 	if d.FixedAmount != nil {
 		for _, discount := range d.FixedAmount {
 			if discount.Currency == currency {
-				amount, _ := strconv.ParseFloat(discount.Amount, 64)
-				return rint(amount * 100)
+				amount, _ := ParseAmount(discount.Amount, currency)
+				return amount
 			}
 		}
 	}
@@ -148,57 +574,157 @@ func (t *Tax) AppliesTo(country, productType string) bool {
 	return applies
 }
 
+// PriceParameters are the properties of an order its price depends on.
+type PriceParameters struct {
+	Country  string
+	Currency string
+	Coupon   Coupon
+	Items    []Item
+
+	// VATNumber is the validated VAT number of a business buyer. Taxes are
+	// left out when the reverse charge applies to it.
+	VATNumber string
+	// TaxExempt leaves out the taxes, for buyers that don't pay them.
+	TaxExempt bool
+	// ShippingMethod is the shipping rate picked by the buyer. Without one,
+	// the first rate of the shipping zone is used.
+	ShippingMethod string
+	// WithoutShipping leaves out the shipping costs, for the price of a part
+	// of an order like refunded items.
+	WithoutShipping bool
+}
+
 // CalculatePrice will calculate the final total price. It takes into account
-// currency, country, coupons, and discounts.
-func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, country, currency string, coupon Coupon, items []Item) Price {
-	price := Price{}
+// currency, country, coupons, discounts, promotions, spend tiers and
+// shipping. With prices including taxes, a buyer the reverse charge applies
+// to, or who is exempt from taxes, pays the prices without the taxes.
+func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params PriceParameters) Price {
+	country, currency, coupon := params.Country, params.Currency, params.Coupon
+	// exempt buyers pay the prices without taxes, like the reverse charge
+	price := Price{TaxExempt: params.TaxExempt, ReverseCharge: !params.TaxExempt && settings.ReverseCharge(params.VATNumber)}
+	untaxed := price.TaxExempt || price.ReverseCharge
 	includeTaxes := settings != nil && settings.PricesIncludeTaxes
-	for _, item := range items {
+	round, level := settings.round, settings.roundingLevel()
+	orderTaxes := []*orderTax{}
+	shippingTax := settings.ShippingTax(country)
+	shippedAmounts := []taxAmount{}
+	if coupon != nil {
+		var listed uint64
+		for _, item := range params.Items {
+			listed += item.PriceInLowestUnit() * item.GetQuantity()
+		}
+		if !coupon.ValidForPrice(currency, listed) {
+			coupon = nil
+		}
+	}
+	exclusive := false
+	if stackable, ok := coupon.(StackableCoupon); ok && !stackable.Stackable() {
+		exclusive = true
+	}
+	couponApplied := false
+	for _, item := range params.Items {
 		itemPrice := ItemPrice{Quantity: item.GetQuantity()}
 		itemPrice.Subtotal = item.PriceInLowestUnit()
 
 		taxAmounts := []taxAmount{}
 		if item.FixedVAT() != 0 {
-			taxAmounts = append(taxAmounts, taxAmount{price: itemPrice.Subtotal, percentage: item.FixedVAT()})
+			taxAmounts = append(taxAmounts, taxAmount{price: itemPrice.Subtotal, percentage: item.FixedVAT(), name: "vat"})
 		} else if settings != nil && item.TaxableItems() != nil && len(item.TaxableItems()) > 0 {
 			for _, item := range item.TaxableItems() {
 				amount := taxAmount{price: item.PriceInLowestUnit()}
-				for _, t := range settings.Taxes {
+				for i, t := range settings.Taxes {
 					if t.AppliesTo(country, item.ProductType()) {
 						amount.percentage = t.Percentage
+						amount.name = t.name(i)
 						break
 					}
 				}
 				taxAmounts = append(taxAmounts, amount)
 			}
 		} else if settings != nil {
-			for _, t := range settings.Taxes {
+			for i, t := range settings.Taxes {
 				if t.AppliesTo(country, item.ProductType()) {
-					taxAmounts = append(taxAmounts, taxAmount{price: itemPrice.Subtotal, percentage: t.Percentage})
+					taxAmounts = append(taxAmounts, taxAmount{price: itemPrice.Subtotal, percentage: t.Percentage, name: t.name(i)})
 					break
 				}
 			}
 		}
 
+		// the totals of the line, which are rounded per line or for the
+		// order instead of per unit at those levels
+		quantity := itemPrice.Quantity
+		lineSubtotal := itemPrice.Subtotal * quantity
+		var lineTaxes, lineDiscount uint64
+
+		shipped := shippingTax == BlendedShippingTax && settings.Shipping.ships(item.ProductType())
+		if shipped && len(taxAmounts) == 0 {
+			shippedAmounts = append(shippedAmounts, taxAmount{price: lineSubtotal})
+		}
 		if len(taxAmounts) != 0 {
 			if includeTaxes {
 				itemPrice.Subtotal = 0
 			}
+			lineSubtotal = 0
 			for _, tax := range taxAmounts {
+				listed := tax.price
 				if includeTaxes {
-					tax.price = rint(float64(tax.price) / (100 + float64(tax.percentage)) * 100)
+					tax.price = round(float64(tax.price) / (100 + float64(tax.percentage)) * 100)
 					itemPrice.Subtotal += tax.price
 				}
-				itemPrice.Taxes += rint(float64(tax.price) * float64(tax.percentage) / 100)
+				lineNet := tax.price * quantity
+				lineTax := float64(lineNet) * float64(tax.percentage) / 100
+				if includeTaxes && level != UnitRounding {
+					lineTax = float64(listed*quantity) * float64(tax.percentage) / (100 + float64(tax.percentage))
+					lineNet = listed*quantity - round(lineTax)
+				}
+				lineSubtotal += lineNet
+				if shipped {
+					shippedAmounts = append(shippedAmounts, taxAmount{price: lineNet, percentage: tax.percentage, name: tax.name})
+				}
+				taxes := round(float64(tax.price) * float64(tax.percentage) / 100)
+				rounded := taxes * quantity
+				if level != UnitRounding {
+					rounded = round(lineTax)
+				}
+				if level == OrderRounding {
+					orderTaxes = addOrderTax(orderTaxes, tax.name, tax.percentage, lineTax, rounded, item.ProductSku())
+				}
+				if untaxed {
+					continue
+				}
+				itemPrice.Taxes += taxes
+				itemPrice.addTax(tax.name, tax.percentage, taxes)
+				lineTaxes += rounded
+				if level != OrderRounding {
+					price.AddAdjustment(TaxAdjustment, tax.name, tax.percentage, rounded, item.ProductSku())
+				}
 			}
 		}
-		if coupon != nil && coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku()) {
-			itemPrice.Discount = calculateDiscount(itemPrice.Subtotal, itemPrice.Taxes, coupon.PercentageDiscount(), coupon.FixedDiscount(currency), includeTaxes)
+		// discount returns the discount of a unit and of the whole line
+		discount := func(percentage, fixed uint64) (uint64, uint64) {
+			unit := calculateDiscount(round, itemPrice.Subtotal, itemPrice.Taxes, percentage, fixed, includeTaxes)
+			if level == UnitRounding {
+				return unit, unit * quantity
+			}
+			return unit, calculateDiscount(round, lineSubtotal, lineTaxes, percentage, fixed*quantity, includeTaxes)
+		}
+		withCoupon := coupon != nil && coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku())
+		if withCoupon {
+			unit, line := discount(coupon.PercentageDiscount(), coupon.FixedDiscount(currency))
+			itemPrice.Discount = unit
+			itemPrice.addDiscount(CouponAdjustment, "", coupon.PercentageDiscount(), unit)
+			lineDiscount += line
+			price.AddAdjustment(CouponAdjustment, "", coupon.PercentageDiscount(), line, item.ProductSku())
+			couponApplied = true
 		}
-		if settings != nil && settings.MemberDiscounts != nil {
-			for _, discount := range settings.MemberDiscounts {
-				if jwtClaims != nil && claims.HasClaims(jwtClaims, discount.Claims) && discount.ValidForType(item.ProductType()) {
-					itemPrice.Discount += calculateDiscount(itemPrice.Subtotal, itemPrice.Taxes, discount.Percentage, discount.FixedDiscount(currency), includeTaxes)
+		if settings != nil && settings.MemberDiscounts != nil && !(withCoupon && exclusive) {
+			for i, memberDiscount := range settings.MemberDiscounts {
+				if jwtClaims != nil && claims.HasClaims(jwtClaims, memberDiscount.Claims) && claims.InGroups(jwtClaims, memberDiscount.Groups) && memberDiscount.ValidForType(item.ProductType()) {
+					unit, line := discount(memberDiscount.Percentage, memberDiscount.FixedDiscount(currency))
+					itemPrice.Discount += unit
+					itemPrice.addDiscount(MemberDiscountAdjustment, memberDiscount.name(i), memberDiscount.Percentage, unit)
+					lineDiscount += line
+					price.AddAdjustment(MemberDiscountAdjustment, memberDiscount.name(i), memberDiscount.Percentage, line, item.ProductSku())
 				}
 			}
 		}
@@ -207,27 +733,136 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, countr
 		if itemPrice.Total < 0 {
 			itemPrice.Total = 0
 		}
+		itemPrice.Net = itemPrice.Total - itemPrice.Taxes
+		itemPrice.Gross = itemPrice.Total
+		itemPrice.LineNet = itemPrice.Net * itemPrice.Quantity
+		itemPrice.LineGross = itemPrice.Gross * itemPrice.Quantity
 
 		price.Items = append(price.Items, itemPrice)
 
-		price.Subtotal += (itemPrice.Subtotal * itemPrice.Quantity)
-		price.Discount += (itemPrice.Discount * itemPrice.Quantity)
-		price.Taxes += (itemPrice.Taxes * itemPrice.Quantity)
-		price.Total += (itemPrice.Total * itemPrice.Quantity)
+		price.Subtotal += lineSubtotal
+		price.Discount += lineDiscount
+		if level != OrderRounding {
+			price.Taxes += lineTaxes
+		}
+	}
+	for _, tax := range orderTaxes {
+		taxes := round(tax.amount)
+		// with prices including taxes, the net prices make up the difference
+		// to the taxes rounded per line
+		if includeTaxes {
+			price.Subtotal = price.Subtotal + tax.rounded - taxes
+		}
+		if untaxed || taxes == 0 {
+			continue
+		}
+		price.Taxes += taxes
+		price.Adjustments = append(price.Adjustments, &Adjustment{Type: TaxAdjustment, Name: tax.name, Percentage: tax.percentage, Amount: taxes, Skus: tax.skus})
+	}
+	// an exclusive coupon replaces the discounts of the whole order
+	if !(couponApplied && exclusive) {
+		applyPromotions(settings, jwtClaims, params.Items, &price, includeTaxes)
+		applySpendTiers(settings, params.Items, currency, &price, includeTaxes)
+	}
+
+	if !params.WithoutShipping {
+		price.ShippingMethod, price.Shipping, price.ShippingError = settings.ShippingCost(params)
+	}
+	if price.Shipping > 0 {
+		switch shippingTax {
+		case ExemptShippingTax:
+		case BlendedShippingTax:
+			price.addBlendedShippingTaxes(round, shippedAmounts, includeTaxes, untaxed)
+		default:
+			for i, t := range settings.Taxes {
+				if t.AppliesTo(country, ShippingProductType) {
+					price.addShippingTaxes(round, []taxAmount{{price: 1, percentage: t.Percentage, name: t.name(i)}}, includeTaxes, untaxed)
+					break
+				}
+			}
+		}
+		price.AddAdjustment(ShippingAdjustment, price.ShippingMethod, 0, price.Shipping, "")
 	}
 
-	price.Total = price.Subtotal - price.Discount + price.Taxes
+	price.Total = price.Subtotal - price.Discount + price.Taxes + price.Shipping
 
 	return price
 }
 
-func calculateDiscount(amountToDiscount, taxes, percentage, fixed uint64, includeTaxes bool) uint64 {
+// addBlendedShippingTaxes taxes the shipping costs at the rates of the shipped
+// items, each on the share of the items at that rate in their net subtotal.
+// Items without taxes have a share at 0%.
+func (p *Price) addBlendedShippingTaxes(round func(float64) uint64, amounts []taxAmount, includeTaxes, untaxed bool) {
+	shares := []taxAmount{}
+	for _, amount := range amounts {
+		found := false
+		for i := range shares {
+			if shares[i].name == amount.name && shares[i].percentage == amount.percentage {
+				shares[i].price += amount.price
+				found = true
+				break
+			}
+		}
+		if !found {
+			shares = append(shares, amount)
+		}
+	}
+	p.addShippingTaxes(round, shares, includeTaxes, untaxed)
+}
+
+// addShippingTaxes splits the shipping costs into bases weighted by the price
+// of the shares, and adds the tax of each base. With prices including taxes,
+// the taxes are taken out of the shipping costs first.
+func (p *Price) addShippingTaxes(round func(float64) uint64, shares []taxAmount, includeTaxes, untaxed bool) {
+	var total, weighted float64
+	for _, share := range shares {
+		total += float64(share.price)
+		weighted += float64(share.price) * float64(share.percentage)
+	}
+	if total == 0 {
+		return
+	}
+	if includeTaxes {
+		p.Shipping = round(float64(p.Shipping) * 100 * total / (100*total + weighted))
+	}
+	if untaxed {
+		return
+	}
+	rest := p.Shipping
+	for i, share := range shares {
+		base := rest
+		if i < len(shares)-1 {
+			base = round(float64(p.Shipping) * float64(share.price) / total)
+			if base > rest {
+				base = rest
+			}
+		}
+		rest -= base
+		if share.percentage == 0 {
+			continue
+		}
+		taxes := round(float64(base) * float64(share.percentage) / 100)
+		if taxes == 0 {
+			continue
+		}
+		p.Taxes += taxes
+		p.Adjustments = append(p.Adjustments, &Adjustment{
+			Type:       ShippingTaxAdjustment,
+			Name:       share.name,
+			Percentage: share.percentage,
+			Amount:     taxes,
+			Base:       base,
+		})
+	}
+}
+
+func calculateDiscount(round func(float64) uint64, amountToDiscount, taxes, percentage, fixed uint64, includeTaxes bool) uint64 {
 	if includeTaxes {
 		amountToDiscount += taxes
 	}
 	var discount uint64
 	if percentage > 0 {
-		discount = rint(float64(amountToDiscount) * float64(percentage) / 100)
+		discount = round(float64(amountToDiscount) * float64(percentage) / 100)
 	}
 	discount += fixed
 
@@ -15,6 +15,7 @@ type TestItem struct {
 	vat      uint64
 	items    []Item
 	quantity uint64
+	weight   uint64
 }
 
 func (t *TestItem) ProductSku() string {
@@ -44,12 +45,17 @@ func (t *TestItem) GetQuantity() uint64 {
 	return 1
 }
 
+func (t *TestItem) ShippingWeight() uint64 {
+	return t.weight
+}
+
 type TestCoupon struct {
 	itemSku    string
 	itemType   string
 	moreThan   uint64
 	percentage uint64
 	fixed      uint64
+	exclusive  bool
 }
 
 func (c *TestCoupon) ValidForType(productType string) bool {
@@ -72,13 +78,17 @@ func (c *TestCoupon) FixedDiscount(currency string) uint64 {
 	return c.fixed
 }
 
+func (c *TestCoupon) Stackable() bool {
+	return !c.exclusive
+}
+
 func TestNoItems(t *testing.T) {
-	price := CalculatePrice(nil, nil, "USA", "USD", nil, nil)
+	price := CalculatePrice(nil, nil, PriceParameters{Country: "USA", Currency: "USD"})
 	assert.Equal(t, uint64(0), price.Total)
 }
 
 func TestNoTaxes(t *testing.T) {
-	price := CalculatePrice(nil, nil, "USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}})
+	price := CalculatePrice(nil, nil, PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test"}}})
 
 	assert.Equal(t, uint64(100), price.Subtotal)
 	assert.Equal(t, uint64(0), price.Taxes)
@@ -87,7 +97,7 @@ func TestNoTaxes(t *testing.T) {
 }
 
 func TestFixedVAT(t *testing.T) {
-	price := CalculatePrice(nil, nil, "USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}})
+	price := CalculatePrice(nil, nil, PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(100), price.Subtotal)
 	assert.Equal(t, uint64(9), price.Taxes)
@@ -96,7 +106,7 @@ func TestFixedVAT(t *testing.T) {
 }
 
 func TestFixedVATWhenPricesIncludeTaxes(t *testing.T) {
-	price := CalculatePrice(&Settings{PricesIncludeTaxes: true}, nil, "USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}})
+	price := CalculatePrice(&Settings{PricesIncludeTaxes: true}, nil, PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(92), price.Subtotal)
 	assert.Equal(t, uint64(8), price.Taxes)
@@ -113,7 +123,7 @@ func TestCountryBasedVAT(t *testing.T) {
 		}},
 	}
 
-	price := CalculatePrice(settings, nil, "USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}})
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test"}}})
 
 	assert.Equal(t, uint64(100), price.Subtotal)
 	assert.Equal(t, uint64(21), price.Taxes)
@@ -123,7 +133,7 @@ func TestCountryBasedVAT(t *testing.T) {
 
 func TestCouponWithNoTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
-	price := CalculatePrice(nil, nil, "USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test"}})
+	price := CalculatePrice(nil, nil, PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test"}}})
 
 	assert.Equal(t, uint64(100), price.Subtotal)
 	assert.Equal(t, uint64(0), price.Taxes)
@@ -133,7 +143,7 @@ func TestCouponWithNoTaxes(t *testing.T) {
 
 func TestCouponWithVAT(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
-	price := CalculatePrice(nil, nil, "USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test", vat: 9}})
+	price := CalculatePrice(nil, nil, PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(100), price.Subtotal)
 	assert.Equal(t, uint64(9), price.Taxes)
@@ -144,7 +154,7 @@ func TestCouponWithVAT(t *testing.T) {
 func TestCouponWithVATWhenPRiceIncludeTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	settings := &Settings{PricesIncludeTaxes: true}
-	price := CalculatePrice(settings, nil, "USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test", vat: 9}})
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(92), price.Subtotal)
 	assert.Equal(t, uint64(8), price.Taxes)
@@ -155,7 +165,7 @@ func TestCouponWithVATWhenPRiceIncludeTaxes(t *testing.T) {
 func TestCouponWithVATWhenPRiceIncludeTaxesWithQuantity(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	settings := &Settings{PricesIncludeTaxes: true}
-	price := CalculatePrice(settings, nil, "USA", "USD", coupon, []Item{&TestItem{quantity: 2, price: 100, itemType: "test", vat: 9}})
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{quantity: 2, price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(184), price.Subtotal)
 	assert.Equal(t, uint64(16), price.Taxes)
@@ -184,7 +194,7 @@ func TestPricingItems(t *testing.T) {
 			itemType: "ebook",
 		}},
 	}
-	price := CalculatePrice(settings, nil, "DE", "USD", nil, []Item{item})
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "USD", Items: []Item{item}})
 
 	assert.Equal(t, uint64(100), price.Subtotal)
 	assert.Equal(t, uint64(10), price.Taxes)
@@ -197,7 +207,7 @@ func TestMemberDiscounts(t *testing.T) {
 		Claims:     map[string]string{"app_metadata.plan": "member"},
 		Percentage: 10,
 	}}}
-	price := CalculatePrice(settings, nil, "USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}})
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(92), price.Subtotal)
 	assert.Equal(t, uint64(8), price.Taxes)
@@ -207,7 +217,7 @@ func TestMemberDiscounts(t *testing.T) {
 	claims := map[string]interface{}{}
 	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
 
-	price = CalculatePrice(settings, claims, "USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}})
+	price = CalculatePrice(settings, claims, PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(92), price.Subtotal)
 	assert.Equal(t, uint64(8), price.Taxes)
@@ -215,6 +225,21 @@ func TestMemberDiscounts(t *testing.T) {
 	assert.Equal(t, uint64(90), price.Total)
 }
 
+func TestGroupMemberDiscounts(t *testing.T) {
+	settings := &Settings{MemberDiscounts: []*MemberDiscount{&MemberDiscount{
+		Groups:     []string{"wholesale", "vip"},
+		Percentage: 20,
+	}}}
+	items := []Item{&TestItem{price: 100, itemType: "test"}}
+
+	price := CalculatePrice(settings, map[string]interface{}{"sub": "alfred"}, PriceParameters{Currency: "USD", Items: items})
+	assert.Equal(t, uint64(0), price.Discount)
+
+	price = CalculatePrice(settings, map[string]interface{}{"sub": "alfred", "customer_groups": []string{"vip"}}, PriceParameters{Currency: "USD", Items: items})
+	assert.Equal(t, uint64(20), price.Discount)
+	assert.Equal(t, uint64(80), price.Total)
+}
+
 func TestFixedMemberDiscounts(t *testing.T) {
 	settings := &Settings{PricesIncludeTaxes: true, MemberDiscounts: []*MemberDiscount{&MemberDiscount{
 		Claims: map[string]string{"app_metadata.plan": "member"},
@@ -223,7 +248,7 @@ func TestFixedMemberDiscounts(t *testing.T) {
 			Currency: "USD",
 		}},
 	}}}
-	price := CalculatePrice(settings, nil, "USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}})
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(92), price.Subtotal)
 	assert.Equal(t, uint64(8), price.Taxes)
@@ -233,10 +258,642 @@ func TestFixedMemberDiscounts(t *testing.T) {
 	claims := map[string]interface{}{}
 	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
 
-	price = CalculatePrice(settings, claims, "USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}})
+	price = CalculatePrice(settings, claims, PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}})
 
 	assert.Equal(t, uint64(92), price.Subtotal)
 	assert.Equal(t, uint64(8), price.Taxes)
 	assert.Equal(t, uint64(10), price.Discount)
 	assert.Equal(t, uint64(90), price.Total)
 }
+
+func TestAdjustments(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{&Tax{
+			Name:         "German VAT",
+			Percentage:   19,
+			ProductTypes: []string{"book"},
+			Countries:    []string{"Germany"},
+		}, &Tax{
+			Percentage:   7,
+			ProductTypes: []string{"ebook"},
+			Countries:    []string{"Germany"},
+		}},
+		MemberDiscounts: []*MemberDiscount{&MemberDiscount{
+			Claims:     map[string]string{"app_metadata.plan": "member"},
+			Percentage: 5,
+		}},
+	}
+	claims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
+	coupon := &TestCoupon{itemSku: "book-1", itemType: "book", percentage: 10}
+	items := []Item{
+		&TestItem{sku: "book-1", price: 100, itemType: "book", quantity: 2},
+		&TestItem{sku: "book-2", price: 200, itemType: "book"},
+		&TestItem{sku: "ebook-1", price: 100, itemType: "ebook"},
+	}
+	price := CalculatePrice(settings, claims, PriceParameters{Country: "Germany", Currency: "USD", Coupon: coupon, Items: items})
+
+	require.Len(t, price.Adjustments, 4)
+	assert.Equal(t, &Adjustment{Type: TaxAdjustment, Name: "German VAT", Percentage: 19, Amount: 76, Skus: []string{"book-1", "book-2"}}, price.Adjustments[0])
+	assert.Equal(t, &Adjustment{Type: CouponAdjustment, Percentage: 10, Amount: 20, Skus: []string{"book-1"}}, price.Adjustments[1])
+	assert.Equal(t, &Adjustment{Type: MemberDiscountAdjustment, Name: "member_discounts[0]", Percentage: 5, Amount: 25, Skus: []string{"book-1", "book-2", "ebook-1"}}, price.Adjustments[2])
+	assert.Equal(t, &Adjustment{Type: TaxAdjustment, Name: "taxes[1]", Percentage: 7, Amount: 7, Skus: []string{"ebook-1"}}, price.Adjustments[3])
+
+	var taxes, discounts uint64
+	for _, a := range price.Adjustments {
+		if a.Type == TaxAdjustment {
+			taxes += a.Amount
+		} else {
+			discounts += a.Amount
+		}
+	}
+	assert.Equal(t, price.Taxes, taxes)
+	assert.Equal(t, price.Discount, discounts)
+}
+
+func TestReverseCharge(t *testing.T) {
+	settings := &Settings{
+		VATCountry: "DE",
+		Taxes: []*Tax{&Tax{
+			Percentage:   19,
+			ProductTypes: []string{"test"},
+		}},
+	}
+	assert.True(t, settings.ReverseCharge("ATU12345678"))
+	assert.True(t, settings.ReverseCharge("el123456789"))
+	assert.False(t, settings.ReverseCharge("DE123456789"), "domestic orders are charged VAT")
+	assert.False(t, settings.ReverseCharge("GB123456789"), "only EU VAT numbers are reverse charged")
+	assert.False(t, settings.ReverseCharge(""))
+	assert.False(t, (&Settings{}).ReverseCharge("ATU12345678"), "the shop must have a VAT country")
+
+	items := []Item{&TestItem{price: 100, itemType: "test"}}
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "Austria", Currency: "EUR", VATNumber: "ATU12345678", Items: items})
+	assert.True(t, price.ReverseCharge)
+	assert.Equal(t, uint64(100), price.Subtotal)
+	assert.Equal(t, uint64(0), price.Taxes)
+	assert.Equal(t, uint64(100), price.Total)
+	assert.Empty(t, price.Adjustments)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "Germany", Currency: "EUR", VATNumber: "DE123456789", Items: items})
+	assert.False(t, price.ReverseCharge)
+	assert.Equal(t, uint64(19), price.Taxes)
+	assert.Equal(t, uint64(119), price.Total)
+
+	settings.PricesIncludeTaxes = true
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "Austria", Currency: "EUR", VATNumber: "ATU12345678", Items: []Item{&TestItem{price: 119, itemType: "test"}}})
+	assert.Equal(t, uint64(100), price.Subtotal)
+	assert.Equal(t, uint64(0), price.Taxes)
+	assert.Equal(t, uint64(100), price.Total)
+}
+
+func TestTaxExempt(t *testing.T) {
+	settings := &Settings{
+		VATCountry: "DE",
+		Taxes: []*Tax{&Tax{
+			Percentage:   19,
+			ProductTypes: []string{"test"},
+		}},
+	}
+	items := []Item{&TestItem{price: 100, itemType: "test"}}
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "Germany", Currency: "EUR", VATNumber: "ATU12345678", TaxExempt: true, Items: items})
+	assert.True(t, price.TaxExempt)
+	assert.False(t, price.ReverseCharge, "exempt orders aren't reverse charged")
+	assert.Equal(t, uint64(100), price.Subtotal)
+	assert.Equal(t, uint64(0), price.Taxes)
+	assert.Equal(t, uint64(100), price.Total)
+	assert.Empty(t, price.Adjustments)
+
+	settings.PricesIncludeTaxes = true
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "Germany", Currency: "EUR", TaxExempt: true, Items: []Item{&TestItem{price: 119, itemType: "test"}}})
+	assert.Equal(t, uint64(100), price.Subtotal)
+	assert.Equal(t, uint64(0), price.Taxes)
+	assert.Equal(t, uint64(100), price.Total)
+}
+
+func shippingSettings() *Settings {
+	return &Settings{
+		Taxes: []*Tax{&Tax{
+			Percentage:   19,
+			ProductTypes: []string{"book", ShippingProductType},
+			Countries:    []string{"DE"},
+		}},
+		Shipping: &ShippingSettings{
+			ProductTypes: []string{"book"},
+			Zones: []*ShippingZone{
+				&ShippingZone{
+					Name:      "Germany",
+					Countries: []string{"DE"},
+					Rates: []*ShippingRate{
+						&ShippingRate{Method: "standard", Prices: []*ShippingPrice{{Amount: "4.90", Currency: "EUR"}}},
+						&ShippingRate{Method: "express", Type: PerItemShippingRate, Prices: []*ShippingPrice{{Amount: "3.00", Currency: "EUR"}}},
+					},
+				},
+				&ShippingZone{
+					Name: "World",
+					Rates: []*ShippingRate{
+						&ShippingRate{Method: "standard", Type: WeightShippingRate, Prices: []*ShippingPrice{
+							{Amount: "10.00", Currency: "EUR", UpToWeight: 1000},
+							{Amount: "25.00", Currency: "EUR", UpToWeight: 5000},
+						}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestShippingRates(t *testing.T) {
+	settings := shippingSettings()
+	items := []Item{&TestItem{price: 1000, itemType: "book", quantity: 2, weight: 800}}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: items})
+	require.NoError(t, price.ShippingError)
+	assert.Equal(t, "standard", price.ShippingMethod)
+	assert.Equal(t, uint64(490), price.Shipping)
+	assert.Equal(t, uint64(380+93), price.Taxes)
+	assert.Equal(t, uint64(2000+380+490+93), price.Total)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: items, ShippingMethod: "express"})
+	require.NoError(t, price.ShippingError)
+	assert.Equal(t, uint64(600), price.Shipping, "express is charged per item")
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "US", Currency: "EUR", Items: items})
+	require.NoError(t, price.ShippingError)
+	assert.Equal(t, uint64(2500), price.Shipping, "1600g are in the second weight bracket")
+	assert.Equal(t, uint64(0), price.Taxes)
+	assert.Equal(t, uint64(4500), price.Total)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "US", Currency: "EUR", Items: []Item{&TestItem{price: 1000, itemType: "book", weight: 6000}}})
+	assert.Error(t, price.ShippingError, "no bracket fits 6000g")
+	assert.Equal(t, uint64(0), price.Shipping)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: items, ShippingMethod: "overnight"})
+	assert.Error(t, price.ShippingError)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "USD", Items: items})
+	assert.Error(t, price.ShippingError, "no price in USD")
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: []Item{&TestItem{price: 1000, itemType: "ebook"}}})
+	require.NoError(t, price.ShippingError)
+	assert.Equal(t, uint64(0), price.Shipping, "ebooks aren't shipped")
+	assert.Equal(t, "", price.ShippingMethod)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: items, WithoutShipping: true})
+	assert.Equal(t, uint64(0), price.Shipping)
+	assert.Equal(t, uint64(2380), price.Total)
+}
+
+func TestShippingWithPricesIncludingTaxes(t *testing.T) {
+	settings := shippingSettings()
+	settings.PricesIncludeTaxes = true
+	items := []Item{&TestItem{price: 1190, itemType: "book"}}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: items})
+	require.NoError(t, price.ShippingError)
+	assert.Equal(t, uint64(412), price.Shipping)
+	assert.Equal(t, uint64(190+78), price.Taxes)
+	assert.Equal(t, uint64(1190+490), price.Total)
+}
+
+func TestBuyXGetYPromotion(t *testing.T) {
+	settings := &Settings{Promotions: []*Promotion{{
+		Name:       "shirts",
+		Type:       BuyXGetYPromotion,
+		Buy:        &PromotionItems{Quantity: 2, ProductTypes: []string{"shirt"}},
+		Get:        &PromotionItems{Quantity: 1, ProductTypes: []string{"sock", "shirt"}},
+		Percentage: 50,
+	}}}
+	items := []Item{
+		&TestItem{sku: "blue-shirt", price: 2000, itemType: "shirt", quantity: 2},
+		&TestItem{sku: "red-shirt", price: 3000, itemType: "shirt"},
+		&TestItem{sku: "sock", price: 500, itemType: "sock", quantity: 2},
+	}
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", Currency: "USD", Items: items})
+
+	// red-shirt and one blue-shirt are bought, one sock is half off. The
+	// other blue-shirt alone doesn't get the promotion again.
+	assert.Equal(t, uint64(8000), price.Subtotal)
+	assert.Equal(t, uint64(250), price.Discount)
+	assert.Equal(t, uint64(7750), price.Total)
+	assert.Nil(t, price.Items[0].Promotions)
+	assert.Equal(t, uint64(250), price.Items[2].PromotionDiscount)
+	assert.Equal(t, []*ItemPromotion{{Name: "shirts", Units: 1, Amount: 250}}, price.Items[2].Promotions)
+	assert.Equal(t, []*Adjustment{{Type: PromotionAdjustment, Name: "shirts", Percentage: 50, Amount: 250, Skus: []string{"sock"}}}, price.Adjustments)
+}
+
+func TestBuyXGetYPromotionLimit(t *testing.T) {
+	settings := &Settings{Promotions: []*Promotion{{
+		Type:  BuyXGetYPromotion,
+		Buy:   &PromotionItems{Quantity: 1, Products: []string{"mug"}},
+		Limit: 2,
+	}}}
+	items := []Item{&TestItem{sku: "mug", price: 1000, quantity: 7}}
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", Currency: "USD", Items: items})
+
+	assert.Equal(t, uint64(2000), price.Discount)
+	assert.Equal(t, uint64(5000), price.Total)
+	assert.Equal(t, []*ItemPromotion{{Name: "promotions[0]", Units: 2, Amount: 2000}}, price.Items[0].Promotions)
+}
+
+func TestCheapestFreePromotion(t *testing.T) {
+	settings := &Settings{PricesIncludeTaxes: true, Promotions: []*Promotion{{
+		Name:   "3 for 2",
+		Type:   CheapestFreePromotion,
+		Buy:    &PromotionItems{Quantity: 3, ProductTypes: []string{"book"}},
+		Claims: map[string]string{"app_metadata.plan": "member"},
+	}}}
+	items := []Item{
+		&TestItem{sku: "a", price: 1070, itemType: "book", vat: 7},
+		&TestItem{sku: "b", price: 535, itemType: "book", vat: 7, quantity: 2},
+		&TestItem{sku: "c", price: 2140, itemType: "book", vat: 7},
+		&TestItem{sku: "d", price: 535, itemType: "book", vat: 7, quantity: 2},
+	}
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", Currency: "USD", Items: items})
+	assert.Equal(t, uint64(0), price.Discount, "only for members")
+
+	claims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
+	price = CalculatePrice(settings, claims, PriceParameters{Country: "USA", Currency: "USD", Items: items})
+
+	// c, a, b and b, d, d: the last b of the first set and the last d of the
+	// second set are free, the units of equal price in line item order.
+	// the free units take their taxes off too, and the discount is net
+	assert.Equal(t, uint64(1000), price.Discount)
+	assert.Equal(t, uint64(350-70), price.Taxes)
+	assert.Equal(t, uint64(5350-1070), price.Total)
+	assert.Nil(t, price.Items[0].Promotions)
+	assert.Equal(t, []*ItemPromotion{{Name: "3 for 2", Units: 1, Amount: 535}}, price.Items[1].Promotions)
+	assert.Nil(t, price.Items[2].Promotions)
+	assert.Equal(t, []*ItemPromotion{{Name: "3 for 2", Units: 1, Amount: 535}}, price.Items[3].Promotions)
+}
+
+func TestPromotionTaxes(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{{Name: "vat", Percentage: 19, Countries: []string{"DE"}}},
+		Promotions: []*Promotion{{
+			Name: "2 for 1",
+			Type: CheapestFreePromotion,
+			Buy:  &PromotionItems{Quantity: 2},
+		}},
+	}
+	items := []Item{&TestItem{sku: "shirt", price: 1000, quantity: 2}}
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: items})
+
+	assert.Equal(t, uint64(2000), price.Subtotal)
+	assert.Equal(t, uint64(1000), price.Discount)
+	assert.Equal(t, uint64(190), price.Taxes)
+	assert.Equal(t, uint64(1190), price.Total)
+	assert.Contains(t, price.Adjustments, &Adjustment{Type: TaxAdjustment, Name: "vat", Percentage: 19, Amount: 190, Skus: []string{"shirt"}})
+
+	shirt := price.Items[0]
+	assert.Equal(t, []*AppliedDiscount{{Type: PromotionAdjustment, Name: "2 for 1", Percentage: 100, Amount: 1000}}, shirt.LineDiscounts)
+	assert.Equal(t, uint64(1000), shirt.LineNet)
+	assert.Equal(t, uint64(1190), shirt.LineGross)
+}
+
+func spendTierSettings() *Settings {
+	return &Settings{SpendTiers: []*SpendTier{{
+		Name:       "silver",
+		Percentage: 5,
+		Minimum:    []*TierAmount{{Amount: "50.00", Currency: "USD"}},
+	}, {
+		Name:       "gold",
+		Percentage: 10,
+		Minimum:    []*TierAmount{{Amount: "100.00", Currency: "USD"}},
+	}}}
+}
+
+func TestSpendTiers(t *testing.T) {
+	settings := spendTierSettings()
+	items := []Item{
+		&TestItem{sku: "a", price: 3333, quantity: 2},
+		&TestItem{sku: "b", price: 1001},
+	}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Items: items})
+	assert.Equal(t, uint64(7667), price.Subtotal)
+	assert.Equal(t, "silver", price.SpendTier)
+	assert.Equal(t, uint64(383), price.Discount)
+	assert.Equal(t, uint64(7667-383), price.Total)
+	// 383 split 6666:1001
+	assert.Equal(t, uint64(333), price.Items[0].TierDiscount)
+	assert.Equal(t, uint64(50), price.Items[1].TierDiscount)
+	assert.Equal(t, &NextSpendTier{Name: "gold", Percentage: 10, AmountLeft: 10000 - 7667}, price.NextTier)
+	require.Len(t, price.Adjustments, 1)
+	assert.Equal(t, &Adjustment{Type: SpendTierAdjustment, Name: "silver", Percentage: 5, Amount: 383, Skus: []string{"a", "b"}}, price.Adjustments[0])
+
+	price = CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Items: []Item{&TestItem{sku: "a", price: 12000}}})
+	assert.Equal(t, "gold", price.SpendTier)
+	assert.Equal(t, uint64(1200), price.Discount)
+	assert.Nil(t, price.NextTier)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Items: []Item{&TestItem{sku: "a", price: 1000}}})
+	assert.Equal(t, "", price.SpendTier)
+	assert.Equal(t, uint64(0), price.Discount)
+	assert.Equal(t, &NextSpendTier{Name: "silver", Percentage: 5, AmountLeft: 4000}, price.NextTier)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Currency: "EUR", Items: []Item{&TestItem{sku: "a", price: 12000}}})
+	assert.Equal(t, uint64(0), price.Discount, "no tiers in EUR")
+	assert.Nil(t, price.NextTier)
+}
+
+func TestSpendTierTaxes(t *testing.T) {
+	settings := spendTierSettings()
+	settings.Taxes = []*Tax{{Name: "vat", Percentage: 19, Countries: []string{"DE"}}}
+	settings.SpendTiers[0].Minimum = append(settings.SpendTiers[0].Minimum, &TierAmount{Amount: "50.00", Currency: "EUR"})
+	items := []Item{&TestItem{sku: "a", price: 10000}}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: items})
+	assert.Equal(t, uint64(500), price.Discount)
+	assert.Equal(t, uint64(1805), price.Taxes)
+	assert.Equal(t, uint64(10000-500+1805), price.Total)
+	assert.Equal(t, []*AppliedDiscount{{Type: SpendTierAdjustment, Name: "silver", Percentage: 5, Amount: 500}}, price.Items[0].LineDiscounts)
+	assert.Equal(t, uint64(9500), price.Items[0].LineNet)
+	assert.Equal(t, uint64(10000-500+1805), price.Items[0].LineGross)
+
+	settings.SpendTiers[0].Percentage = 150
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "DE", Currency: "EUR", Items: items})
+	assert.Equal(t, uint64(10000), price.Discount, "percentages are capped at 100")
+	assert.Equal(t, uint64(0), price.Taxes)
+	assert.Equal(t, uint64(0), price.Total)
+}
+
+func TestSpendTiersAfterCoupons(t *testing.T) {
+	settings := spendTierSettings()
+	coupon := &TestCoupon{itemSku: "a", percentage: 20}
+	price := CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{sku: "a", price: 6000}}})
+
+	// 60.00 with 20% off doesn't reach the 50.00 of silver
+	assert.Equal(t, uint64(1200), price.Discount)
+	assert.Equal(t, "", price.SpendTier)
+	assert.Equal(t, uint64(200), price.NextTier.AmountLeft)
+}
+
+func TestCouponMinimum(t *testing.T) {
+	coupon := &TestCoupon{itemType: "test", percentage: 10, moreThan: 150}
+	price := CalculatePrice(nil, nil, PriceParameters{Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test"}}})
+	assert.Equal(t, uint64(0), price.Discount)
+	assert.Empty(t, price.Adjustments)
+
+	price = CalculatePrice(nil, nil, PriceParameters{Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, quantity: 2, itemType: "test"}}})
+	assert.Equal(t, uint64(20), price.Discount)
+}
+
+func TestExclusiveCoupons(t *testing.T) {
+	settings := spendTierSettings()
+	settings.MemberDiscounts = []*MemberDiscount{{Groups: []string{"vip"}, Percentage: 20}}
+	claims := map[string]interface{}{"sub": "alfred", "customer_groups": []string{"vip"}}
+	items := []Item{&TestItem{sku: "a", price: 12000}, &TestItem{sku: "b", price: 1000}}
+
+	coupon := &TestCoupon{itemSku: "a", percentage: 10}
+	price := CalculatePrice(settings, claims, PriceParameters{Currency: "USD", Coupon: coupon, Items: items})
+	assert.Equal(t, "silver", price.SpendTier, "a coupon that stacks keeps the spend tiers")
+	assert.True(t, price.Discount > 1200+2400+200)
+
+	coupon.exclusive = true
+	price = CalculatePrice(settings, claims, PriceParameters{Currency: "USD", Coupon: coupon, Items: items})
+	// only the coupon on a, and the member discount on b the coupon doesn't apply to
+	assert.Equal(t, uint64(1200+200), price.Discount)
+	assert.Equal(t, "", price.SpendTier)
+	assert.Equal(t, uint64(1200), price.Items[0].Discount)
+	assert.Equal(t, uint64(200), price.Items[1].Discount)
+}
+
+func TestShippingTaxes(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{
+			&Tax{Name: "reduced", Percentage: 7, ProductTypes: []string{"book"}, Countries: []string{"DE"}},
+			&Tax{Name: "standard", Percentage: 19, ProductTypes: []string{"poster", ShippingProductType}, Countries: []string{"DE"}},
+		},
+		Shipping: &ShippingSettings{
+			ProductTypes: []string{"book", "poster"},
+			Zones: []*ShippingZone{&ShippingZone{
+				Name:      "Germany",
+				Countries: []string{"DE"},
+				Rates:     []*ShippingRate{&ShippingRate{Method: "standard", Prices: []*ShippingPrice{{Amount: "4.90", Currency: "EUR"}}}},
+			}},
+		},
+	}
+	items := []Item{
+		&TestItem{sku: "book", price: 1000, itemType: "book", quantity: 2},
+		&TestItem{sku: "poster", price: 1000, itemType: "poster", quantity: 1},
+		&TestItem{sku: "ebook", price: 500, itemType: "ebook", quantity: 1},
+	}
+	params := PriceParameters{Country: "DE", Currency: "EUR", Items: items}
+
+	price := CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(140+190+93), price.Taxes, "shipping is taxed like its product type by default")
+	assert.Contains(t, price.Adjustments, &Adjustment{Type: ShippingTaxAdjustment, Name: "standard", Percentage: 19, Amount: 93, Base: 490})
+
+	settings.Shipping.Tax = ExemptShippingTax
+	price = CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(140+190), price.Taxes)
+	assert.Equal(t, uint64(490), price.Shipping)
+	assert.Equal(t, uint64(3500+140+190+490), price.Total)
+
+	settings.Shipping.Zones[0].Tax = BlendedShippingTax
+	price = CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(140+190+23+31), price.Taxes, "the zone overrides the default")
+	assert.Equal(t, []*Adjustment{
+		{Type: ShippingTaxAdjustment, Name: "reduced", Percentage: 7, Amount: 23, Base: 327},
+		{Type: ShippingTaxAdjustment, Name: "standard", Percentage: 19, Amount: 31, Base: 163},
+	}, price.Adjustments[len(price.Adjustments)-3:len(price.Adjustments)-1], "the ebook isn't shipped")
+
+	settings.PricesIncludeTaxes = true
+	items[0].(*TestItem).price = 1070
+	items[1].(*TestItem).price = 1190
+	price = CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(441), price.Shipping)
+	assert.Equal(t, uint64(140+190+21+28), price.Taxes)
+	assert.Equal(t, uint64(490), price.Shipping+21+28, "the shipping costs include the blended taxes")
+}
+
+func TestBrandingValidate(t *testing.T) {
+	valid := &Branding{
+		LogoURL:      "/images/logo.png",
+		PrimaryColor: "#1a73e8",
+		AccentColor:  "#fa0",
+		SupportEmail: "help@example.com",
+		SupportPhone: "+1 (555) 010-0199",
+		SupportURL:   "https://example.com/help",
+		LegalText:    "Example Inc., 1 Main Street, Springfield",
+	}
+	assert.Nil(t, valid.Validate())
+
+	invalid := &Branding{
+		LogoURL:      "javascript:alert(1)",
+		PrimaryColor: "red; background: url(x)",
+		SupportEmail: "Help <help@example.com>",
+		SupportPhone: "call us",
+		SupportURL:   "//example.com/help",
+	}
+	assert.Equal(t, map[string]string{
+		"logo_url":      "must be an http or https URL, or a path on the site",
+		"primary_color": "must be a hex color like #1a73e8",
+		"support_email": "must be an email address",
+		"support_phone": "must be a phone number",
+		"support_url":   "must be an http or https URL",
+	}, invalid.Validate())
+
+	r, g, b, ok := RGB("#f08000")
+	require.True(t, ok)
+	assert.Equal(t, []float64{240.0 / 255, 128.0 / 255, 0}, []float64{r, g, b})
+	_, _, _, ok = RGB("orange")
+	assert.False(t, ok)
+}
+
+func TestItemPriceBreakdown(t *testing.T) {
+	settings := &Settings{
+		PricesIncludeTaxes: true,
+		Taxes:              []*Tax{{Name: "VAT", Percentage: 19, ProductTypes: []string{"book"}}},
+		MemberDiscounts: []*MemberDiscount{{
+			Name:       "members",
+			Claims:     map[string]string{"app_metadata.plan": "member"},
+			Percentage: 10,
+		}},
+	}
+	claims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
+	coupon := &TestCoupon{itemType: "book", itemSku: "book-1", percentage: 10}
+	price := CalculatePrice(settings, claims, PriceParameters{Country: "DE", Currency: "EUR", Coupon: coupon, Items: []Item{
+		&TestItem{sku: "book-1", price: 119, itemType: "book", quantity: 2},
+		&TestItem{sku: "sticker-1", price: 50, itemType: "sticker", quantity: 1},
+	}})
+
+	require.Len(t, price.Items, 2)
+	book := price.Items[0]
+	assert.Equal(t, uint64(100), book.Subtotal)
+	assert.Equal(t, []*AppliedTax{{Name: "VAT", Percentage: 19, Amount: 19}}, book.AppliedTaxes)
+	assert.Equal(t, []*AppliedDiscount{
+		{Type: CouponAdjustment, Percentage: 10, Amount: 12},
+		{Type: MemberDiscountAdjustment, Name: "members", Percentage: 10, Amount: 12},
+	}, book.AppliedDiscounts)
+	assert.Equal(t, uint64(24), book.Discount)
+	assert.Equal(t, uint64(76), book.Net)
+	assert.Equal(t, uint64(95), book.Gross)
+	assert.Equal(t, book.Total, book.Gross)
+	assert.Nil(t, book.LineDiscounts)
+	assert.Equal(t, uint64(152), book.LineNet)
+	assert.Equal(t, uint64(190), book.LineGross)
+
+	sticker := price.Items[1]
+	assert.Nil(t, sticker.AppliedTaxes)
+	assert.Equal(t, []*AppliedDiscount{{Type: MemberDiscountAdjustment, Name: "members", Percentage: 10, Amount: 5}}, sticker.AppliedDiscounts)
+	assert.Equal(t, uint64(45), sticker.Net)
+	assert.Equal(t, uint64(45), sticker.Gross)
+}
+
+func TestCurrencyExponents(t *testing.T) {
+	for _, tc := range []struct {
+		currency  string
+		amount    string
+		lowest    uint64
+		formatted string
+	}{
+		{"USD", "9.99", 999, "9.99"},
+		{"eur", "10", 1000, "10.00"},
+		{"JPY", "1200", 1200, "1200"},
+		{"KRW", "15000", 15000, "15000"},
+		{"KWD", "1.255", 1255, "1.255"},
+		{"BHD", "0.5", 500, "0.500"},
+	} {
+		amount, err := ParseAmount(tc.amount, tc.currency)
+		require.NoError(t, err)
+		assert.Equal(t, tc.lowest, amount, tc.currency)
+		assert.Equal(t, tc.formatted, FormatAmount(amount, tc.currency), tc.currency)
+	}
+	_, err := ParseAmount("ten", "USD")
+	assert.Error(t, err)
+}
+
+func TestZeroDecimalCurrencyPrice(t *testing.T) {
+	settings := &Settings{
+		MemberDiscounts: []*MemberDiscount{{
+			Claims:      map[string]string{"app_metadata.plan": "member"},
+			FixedAmount: []*FixedMemberDiscount{{Amount: "100", Currency: "JPY"}},
+		}},
+		Shipping: &ShippingSettings{Zones: []*ShippingZone{{
+			Name:  "Japan",
+			Rates: []*ShippingRate{{Method: "standard", Prices: []*ShippingPrice{{Amount: "500", Currency: "JPY"}}}},
+		}}},
+	}
+	claims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
+	price := CalculatePrice(settings, claims, PriceParameters{Country: "Japan", Currency: "JPY", Items: []Item{&TestItem{price: 1200, itemType: "test"}}})
+
+	assert.Equal(t, uint64(1200), price.Subtotal)
+	assert.Equal(t, uint64(100), price.Discount)
+	assert.Equal(t, uint64(500), price.Shipping)
+	assert.Equal(t, uint64(1600), price.Total)
+}
+
+func TestRoundingMode(t *testing.T) {
+	settings := &Settings{Taxes: []*Tax{{Percentage: 10}}}
+	items := []Item{&TestItem{price: 25, itemType: "test"}}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Items: items})
+	assert.Equal(t, uint64(2), price.Taxes, "2.5 is rounded to the even 2 by default")
+
+	settings.Rounding = &RoundingSettings{Mode: HalfUpRounding}
+	price = CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Items: items})
+	assert.Equal(t, uint64(3), price.Taxes)
+	assert.Equal(t, uint64(28), price.Total)
+}
+
+func TestRoundingLevel(t *testing.T) {
+	settings := &Settings{Taxes: []*Tax{{Name: "VAT", Percentage: 10}}}
+	coupon := &TestCoupon{itemType: "test", itemSku: "a", percentage: 10}
+	items := []Item{
+		&TestItem{sku: "a", price: 15, itemType: "test", quantity: 3},
+		&TestItem{sku: "b", price: 33, itemType: "test", quantity: 1},
+		&TestItem{sku: "c", price: 33, itemType: "test", quantity: 1},
+	}
+	params := PriceParameters{Currency: "USD", Coupon: coupon, Items: items}
+
+	price := CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(2*3+3+3), price.Taxes, "the taxes of each unit are rounded")
+	assert.Equal(t, uint64(2*3), price.Discount)
+
+	settings.Rounding = &RoundingSettings{Level: LineRounding}
+	price = CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(4+3+3), price.Taxes, "4.5 for the line of a")
+	assert.Equal(t, uint64(4), price.Discount)
+	assert.Equal(t, uint64(45+66-4+10), price.Total)
+	assert.Equal(t, uint64(2), price.Items[0].Taxes, "the prices of units are still rounded per unit")
+
+	settings.Rounding = &RoundingSettings{Level: OrderRounding, Mode: HalfUpRounding}
+	price = CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(11), price.Taxes, "4.5 + 3.3 + 3.3 rounded once")
+	assert.Equal(t, uint64(5), price.Discount)
+	assert.Equal(t, []*Adjustment{
+		{Type: CouponAdjustment, Percentage: 10, Amount: 5, Skus: []string{"a"}},
+		{Type: TaxAdjustment, Name: "VAT", Percentage: 10, Amount: 11, Skus: []string{"a", "b", "c"}},
+	}, price.Adjustments)
+}
+
+func TestRoundingLevelWithPricesIncludingTaxes(t *testing.T) {
+	settings := &Settings{PricesIncludeTaxes: true, Taxes: []*Tax{{Percentage: 19}}}
+	params := PriceParameters{Currency: "EUR", Items: []Item{
+		&TestItem{sku: "a", price: 10, itemType: "test", quantity: 3},
+	}}
+
+	price := CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(24), price.Subtotal)
+	assert.Equal(t, uint64(6), price.Taxes)
+
+	settings.Rounding = &RoundingSettings{Level: LineRounding}
+	price = CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(25), price.Subtotal, "the taxes are taken out of the line")
+	assert.Equal(t, uint64(5), price.Taxes)
+	assert.Equal(t, uint64(30), price.Total)
+
+	settings.Rounding = &RoundingSettings{Level: OrderRounding}
+	params.Items = []Item{
+		&TestItem{sku: "a", price: 10, itemType: "test", quantity: 1},
+		&TestItem{sku: "b", price: 10, itemType: "test", quantity: 1},
+	}
+	price = CalculatePrice(settings, nil, params)
+	assert.Equal(t, uint64(17), price.Subtotal)
+	assert.Equal(t, uint64(3), price.Taxes)
+	assert.Equal(t, uint64(20), price.Total)
+}
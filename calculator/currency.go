@@ -0,0 +1,49 @@
+package calculator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// currencyExponents are the currencies whose lowest unit isn't a hundredth,
+// with the number of decimals of their amounts. All other currencies have 2.
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0,
+	"XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// CurrencyExponent returns the number of decimals of amounts in a currency,
+// like 2 for USD, 0 for JPY and 3 for KWD.
+func CurrencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// ParseAmount parses a decimal amount in a currency, like the prices of the
+// settings and products, into its lowest unit: 9.99 USD is 999 cents and 1000
+// JPY is 1000 yen.
+func ParseAmount(amount, currency string) (uint64, error) {
+	value, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return 0, err
+	}
+	return rint(value * math.Pow10(CurrencyExponent(currency))), nil
+}
+
+// FormatAmount formats an amount in the lowest unit of a currency as a
+// decimal with the digits of the currency, like 9.99 for 999 USD cents and
+// 999 for 999 yen.
+func FormatAmount(amount uint64, currency string) string {
+	exponent := CurrencyExponent(currency)
+	if exponent == 0 {
+		return strconv.FormatUint(amount, 10)
+	}
+	unit := uint64(math.Pow10(exponent))
+	return fmt.Sprintf("%d.%0*d", amount/unit, exponent, amount%unit)
+}
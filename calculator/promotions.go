@@ -0,0 +1,243 @@
+package calculator
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/netlify/gocommerce/claims"
+)
+
+// Types of promotions
+const (
+	BuyXGetYPromotion     = "buy_x_get_y"
+	CheapestFreePromotion = "cheapest_free"
+)
+
+// PromotionItems are the units of the products a promotion applies to. Without
+// products and product types, all products match.
+type PromotionItems struct {
+	Quantity     uint64   `json:"quantity"`
+	Products     []string `json:"products,omitempty"`
+	ProductTypes []string `json:"product_types,omitempty"`
+}
+
+func (p *PromotionItems) matches(item Item) bool {
+	if len(p.Products) > 0 && !containsString(p.Products, item.ProductSku()) {
+		return false
+	}
+	if len(p.ProductTypes) > 0 && !containsString(p.ProductTypes, item.ProductType()) {
+		return false
+	}
+	return true
+}
+
+// Promotion discounts some units of an order based on the other units in it.
+//
+// A buy_x_get_y promotion takes off Percentage of Get.Quantity units matching
+// Get for every Buy.Quantity units matching Buy. The most expensive units are
+// counted as bought and the cheapest remaining units are discounted.
+//
+// A cheapest_free promotion sorts the units matching Buy from the most to the
+// least expensive and takes off Percentage of the Get.Quantity (or 1) last
+// units of every full set of Buy.Quantity units.
+//
+// Percentage is taken off the price of a unit left after coupons and member
+// discounts, and defaults to 100. Units with the same price are picked in the
+// order of the line items, and every unit is part of one promotion at most.
+type Promotion struct {
+	Name       string            `json:"name,omitempty"`
+	Type       string            `json:"type"`
+	Buy        *PromotionItems   `json:"buy"`
+	Get        *PromotionItems   `json:"get,omitempty"`
+	Percentage uint64            `json:"percentage,omitempty"`
+	Claims     map[string]string `json:"claims,omitempty"`
+	// Groups limits the promotion to members of one of the customer groups.
+	Groups []string `json:"groups,omitempty"`
+	// Limit is how many times the promotion applies to an order at most.
+	Limit uint64 `json:"limit,omitempty"`
+}
+
+func (p *Promotion) name(index int) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return fmt.Sprintf("promotions[%d]", index)
+}
+
+func (p *Promotion) percentage() uint64 {
+	if p.Percentage == 0 || p.Percentage > 100 {
+		return 100
+	}
+	return p.Percentage
+}
+
+func (p *Promotion) getQuantity() uint64 {
+	if p.Get == nil || p.Get.Quantity == 0 {
+		return 1
+	}
+	return p.Get.Quantity
+}
+
+// ItemPromotion is the discount a promotion gave on some units of a line item.
+type ItemPromotion struct {
+	Name   string `json:"name"`
+	Units  uint64 `json:"units"`
+	Amount uint64 `json:"amount"`
+}
+
+// promotionUnit is a single unit of a line item, with the price a promotion
+// can take off.
+type promotionUnit struct {
+	item  int
+	price uint64
+	used  bool
+}
+
+// applyPromotions discounts the units picked by the promotions of the
+// settings, and records the discounts on the prices of their line items. The
+// taxes of the order are lowered by the taxes of the discounts.
+func applyPromotions(settings *Settings, jwtClaims map[string]interface{}, items []Item, price *Price, includeTaxes bool) {
+	if settings == nil || len(settings.Promotions) == 0 {
+		return
+	}
+
+	units := []*promotionUnit{}
+	for i := range items {
+		itemPrice := price.Items[i]
+		unitPrice := itemPrice.Subtotal
+		if includeTaxes {
+			unitPrice += itemPrice.Taxes
+		}
+		if itemPrice.Discount >= unitPrice {
+			continue
+		}
+		for q := uint64(0); q < itemPrice.Quantity; q++ {
+			units = append(units, &promotionUnit{item: i, price: unitPrice - itemPrice.Discount})
+		}
+	}
+	// most expensive first, in the order of the line items for equal prices
+	sort.SliceStable(units, func(i, j int) bool {
+		return units[i].price > units[j].price
+	})
+
+	for i, promotion := range settings.Promotions {
+		if promotion.Buy == nil || promotion.Buy.Quantity == 0 {
+			continue
+		}
+		if len(promotion.Claims) > 0 && (jwtClaims == nil || !claims.HasClaims(jwtClaims, promotion.Claims)) {
+			continue
+		}
+		if !claims.InGroups(jwtClaims, promotion.Groups) {
+			continue
+		}
+		var discounted []*promotionUnit
+		switch promotion.Type {
+		case BuyXGetYPromotion:
+			discounted = promotion.buyXGetY(items, units)
+		case CheapestFreePromotion:
+			discounted = promotion.cheapestFree(items, units)
+		}
+
+		name := promotion.name(i)
+		for _, unit := range discounted {
+			amount := settings.round(float64(unit.price) * float64(promotion.percentage()) / 100)
+			itemPrice := &price.Items[unit.item]
+			itemPrice.PromotionDiscount += amount
+			addItemPromotion(itemPrice, name, amount)
+			itemPrice.addLineDiscount(PromotionAdjustment, name, promotion.percentage(), amount)
+			net := price.discountTaxes(settings.round, unit.item, amount, includeTaxes)
+			price.Discount += net
+			price.AddAdjustment(PromotionAdjustment, name, promotion.percentage(), net, items[unit.item].ProductSku())
+		}
+	}
+}
+
+func addItemPromotion(itemPrice *ItemPrice, name string, amount uint64) {
+	for _, p := range itemPrice.Promotions {
+		if p.Name == name {
+			p.Units++
+			p.Amount += amount
+			return
+		}
+	}
+	itemPrice.Promotions = append(itemPrice.Promotions, &ItemPromotion{Name: name, Units: 1, Amount: amount})
+}
+
+// buyXGetY marks the units of every application of the promotion as used
+// and returns the units to discount.
+func (p *Promotion) buyXGetY(items []Item, units []*promotionUnit) []*promotionUnit {
+	get := p.Get
+	if get == nil {
+		get = p.Buy
+	}
+	discounted := []*promotionUnit{}
+	for applied := uint64(0); p.Limit == 0 || applied < p.Limit; applied++ {
+		bought := []*promotionUnit{}
+		for _, unit := range units {
+			if uint64(len(bought)) == p.Buy.Quantity {
+				break
+			}
+			if !unit.used && p.Buy.matches(items[unit.item]) {
+				bought = append(bought, unit)
+			}
+		}
+		if uint64(len(bought)) < p.Buy.Quantity {
+			break
+		}
+
+		free := []*promotionUnit{}
+		for j := len(units) - 1; j >= 0 && uint64(len(free)) < p.getQuantity(); j-- {
+			unit := units[j]
+			if !unit.used && !containsUnit(bought, unit) && get.matches(items[unit.item]) {
+				free = append(free, unit)
+			}
+		}
+		if uint64(len(free)) < p.getQuantity() {
+			break
+		}
+
+		for _, unit := range append(bought, free...) {
+			unit.used = true
+		}
+		discounted = append(discounted, free...)
+	}
+	return discounted
+}
+
+// cheapestFree marks the units of every full set as used and returns the
+// cheapest units of the sets.
+func (p *Promotion) cheapestFree(items []Item, units []*promotionUnit) []*promotionUnit {
+	set := []*promotionUnit{}
+	for _, unit := range units {
+		if !unit.used && p.Buy.matches(items[unit.item]) {
+			set = append(set, unit)
+		}
+	}
+
+	free := p.getQuantity()
+	if free > p.Buy.Quantity {
+		free = p.Buy.Quantity
+	}
+	discounted := []*promotionUnit{}
+	for applied := uint64(0); p.Limit == 0 || applied < p.Limit; applied++ {
+		start := applied * p.Buy.Quantity
+		end := start + p.Buy.Quantity
+		if end > uint64(len(set)) {
+			break
+		}
+		for _, unit := range set[start:end] {
+			unit.used = true
+		}
+		discounted = append(discounted, set[end-free:end]...)
+	}
+	return discounted
+}
+
+func containsUnit(units []*promotionUnit, unit *promotionUnit) bool {
+	for _, u := range units {
+		if u == unit {
+			return true
+		}
+	}
+	return false
+}
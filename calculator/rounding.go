@@ -0,0 +1,87 @@
+package calculator
+
+import "math"
+
+// Rounding modes
+const (
+	// HalfEvenRounding rounds halves to the even neighbor, like 2.5 to 2 and
+	// 3.5 to 4, so rounding errors even out over many amounts.
+	HalfEvenRounding = "half_even"
+	// HalfUpRounding rounds halves up, like 2.5 to 3, as many tax
+	// authorities require.
+	HalfUpRounding = "half_up"
+)
+
+// Rounding levels
+const (
+	// UnitRounding rounds the taxes and discounts of one unit of each item.
+	UnitRounding = "unit"
+	// LineRounding rounds the taxes and discounts of each line item.
+	LineRounding = "line"
+	// OrderRounding rounds the taxes of each rate once for the whole order,
+	// and the discounts of each line item.
+	OrderRounding = "order"
+)
+
+// RoundingSettings are how taxes and discounts are rounded to the lowest unit
+// of the currency. The prices of single units, like ItemPrice, are always
+// rounded per unit; the level decides how the totals of the order add up.
+type RoundingSettings struct {
+	// Mode is HalfEvenRounding (the default) or HalfUpRounding.
+	Mode string `json:"mode,omitempty"`
+	// Level is UnitRounding (the default), LineRounding or OrderRounding.
+	Level string `json:"level,omitempty"`
+}
+
+// round rounds an amount with the rounding mode of the settings.
+func (s *Settings) round(x float64) uint64 {
+	if s != nil && s.Rounding != nil && s.Rounding.Mode == HalfUpRounding {
+		if x <= 0 {
+			return 0
+		}
+		return uint64(math.Floor(x + 0.5))
+	}
+	return rint(x)
+}
+
+// roundingLevel returns the rounding level of the settings.
+func (s *Settings) roundingLevel() string {
+	if s == nil || s.Rounding == nil {
+		return UnitRounding
+	}
+	switch s.Rounding.Level {
+	case LineRounding, OrderRounding:
+		return s.Rounding.Level
+	}
+	return UnitRounding
+}
+
+// orderTax is the unrounded tax of a rate on the items of an order, for
+// rounding at the order level. Rounded is the sum of the taxes rounded per
+// line.
+type orderTax struct {
+	name       string
+	percentage uint64
+	amount     float64
+	rounded    uint64
+	skus       []string
+}
+
+// addOrderTax adds the tax of a line item to the tax of its rate.
+func addOrderTax(taxes []*orderTax, name string, percentage uint64, amount float64, rounded uint64, sku string) []*orderTax {
+	for _, t := range taxes {
+		if t.name == name && t.percentage == percentage {
+			t.amount += amount
+			t.rounded += rounded
+			if sku != "" && !containsString(t.skus, sku) {
+				t.skus = append(t.skus, sku)
+			}
+			return taxes
+		}
+	}
+	tax := &orderTax{name: name, percentage: percentage, amount: amount, rounded: rounded}
+	if sku != "" {
+		tax.skus = []string{sku}
+	}
+	return append(taxes, tax)
+}
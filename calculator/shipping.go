@@ -0,0 +1,184 @@
+package calculator
+
+import (
+	"fmt"
+)
+
+// ShippingProductType is the product type taxes on shipping are configured
+// with. A tax with "shipping" in its product types applies to the shipping
+// costs of the countries of the tax.
+const ShippingProductType = "shipping"
+
+// How shipping costs are taxed.
+const (
+	// ProductTypeShippingTax taxes shipping costs with the first tax that
+	// has ShippingProductType in its product types. It is the default.
+	ProductTypeShippingTax = "product_type"
+	// ExemptShippingTax doesn't tax shipping costs.
+	ExemptShippingTax = "exempt"
+	// BlendedShippingTax taxes shipping costs at the rates of the shipped
+	// items, each on the share of the items at that rate in their subtotal.
+	BlendedShippingTax = "blended"
+)
+
+// Types of shipping rates
+const (
+	// FlatShippingRate charges the same for every order.
+	FlatShippingRate = "flat"
+	// PerItemShippingRate charges for every shipped item.
+	PerItemShippingRate = "per_item"
+	// WeightShippingRate charges by the total weight of the shipped items.
+	WeightShippingRate = "weight"
+)
+
+// ShippingSettings are the shipping zones and the product types that need to
+// be shipped.
+type ShippingSettings struct {
+	// ProductTypes are the product types that are shipped. Empty means all.
+	ProductTypes []string        `json:"product_types"`
+	Zones        []*ShippingZone `json:"zones"`
+	// Tax is how shipping costs are taxed in the zones that don't set it
+	// themselves, ProductTypeShippingTax by default.
+	Tax string `json:"tax,omitempty"`
+}
+
+// ShippingZone is a group of countries with the same shipping rates. A zone
+// without countries covers all countries that aren't in another zone.
+type ShippingZone struct {
+	Name      string          `json:"name"`
+	Countries []string        `json:"countries"`
+	Rates     []*ShippingRate `json:"rates"`
+	// Tax is how shipping costs to the zone are taxed.
+	Tax string `json:"tax,omitempty"`
+}
+
+// ShippingRate is a shipping method of a zone, like standard or express.
+type ShippingRate struct {
+	Method string           `json:"method"`
+	Type   string           `json:"type"`
+	Prices []*ShippingPrice `json:"prices"`
+}
+
+// ShippingPrice is the price of a shipping rate in a currency. Weight rates
+// have a price per weight bracket, and the first bracket that the weight of
+// the order fits in is charged.
+type ShippingPrice struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+	// UpToWeight is the highest weight in grams of the bracket, 0 means any
+	// weight.
+	UpToWeight uint64 `json:"up_to_weight,omitempty"`
+}
+
+// WeightedItem is implemented by items that have a shipping weight.
+type WeightedItem interface {
+	ShippingWeight() uint64
+}
+
+// ShippingCost returns the shipping method and shipping cost of an order, as
+// configured in the prices of the settings. Orders without shipped items
+// don't pay for shipping.
+func (s *Settings) ShippingCost(params PriceParameters) (string, uint64, error) {
+	if s == nil || s.Shipping == nil || len(s.Shipping.Zones) == 0 {
+		return "", 0, nil
+	}
+
+	var quantity, weight uint64
+	for _, item := range params.Items {
+		if !s.Shipping.ships(item.ProductType()) {
+			continue
+		}
+		quantity += item.GetQuantity()
+		if weighted, ok := item.(WeightedItem); ok {
+			weight += weighted.ShippingWeight() * item.GetQuantity()
+		}
+	}
+	if quantity == 0 {
+		return "", 0, nil
+	}
+
+	zone := s.Shipping.zone(params.Country)
+	if zone == nil || len(zone.Rates) == 0 {
+		return "", 0, fmt.Errorf("Orders can't be shipped to %v", params.Country)
+	}
+	rate := zone.Rates[0]
+	if params.ShippingMethod != "" {
+		rate = nil
+		for _, r := range zone.Rates {
+			if r.Method == params.ShippingMethod {
+				rate = r
+				break
+			}
+		}
+		if rate == nil {
+			return "", 0, fmt.Errorf("Shipping method %v isn't available for %v", params.ShippingMethod, params.Country)
+		}
+	}
+
+	switch rate.Type {
+	case FlatShippingRate, "":
+		if amount, ok := rate.price(params.Currency, 0); ok {
+			return rate.Method, amount, nil
+		}
+	case PerItemShippingRate:
+		if amount, ok := rate.price(params.Currency, 0); ok {
+			return rate.Method, amount * quantity, nil
+		}
+	case WeightShippingRate:
+		if amount, ok := rate.price(params.Currency, weight); ok {
+			return rate.Method, amount, nil
+		}
+		return "", 0, fmt.Errorf("Shipping method %v has no price for a weight of %vg", rate.Method, weight)
+	default:
+		return "", 0, fmt.Errorf("Unknown type of shipping rate %v", rate.Type)
+	}
+	return "", 0, fmt.Errorf("Shipping method %v has no price in %v", rate.Method, params.Currency)
+}
+
+// ShippingTax returns how the shipping costs to a country are taxed.
+func (s *Settings) ShippingTax(country string) string {
+	if s == nil || s.Shipping == nil {
+		return ProductTypeShippingTax
+	}
+	if zone := s.Shipping.zone(country); zone != nil && zone.Tax != "" {
+		return zone.Tax
+	}
+	if s.Shipping.Tax != "" {
+		return s.Shipping.Tax
+	}
+	return ProductTypeShippingTax
+}
+
+func (s *ShippingSettings) ships(productType string) bool {
+	return len(s.ProductTypes) == 0 || containsString(s.ProductTypes, productType)
+}
+
+func (s *ShippingSettings) zone(country string) *ShippingZone {
+	var rest *ShippingZone
+	for _, zone := range s.Zones {
+		if len(zone.Countries) == 0 {
+			if rest == nil {
+				rest = zone
+			}
+		} else if containsString(zone.Countries, country) {
+			return zone
+		}
+	}
+	return rest
+}
+
+// price returns the price of the rate in a currency, for the first weight
+// bracket the weight fits in.
+func (r *ShippingRate) price(currency string, weight uint64) (uint64, bool) {
+	for _, p := range r.Prices {
+		if p.Currency != currency || (p.UpToWeight != 0 && weight > p.UpToWeight) {
+			continue
+		}
+		amount, err := ParseAmount(p.Amount, currency)
+		if err != nil {
+			continue
+		}
+		return amount, true
+	}
+	return 0, false
+}
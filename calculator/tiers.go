@@ -0,0 +1,132 @@
+package calculator
+
+import (
+	"fmt"
+)
+
+// SpendTier is a discount on the whole order for orders that spend at least
+// the minimum of the tier in their currency.
+type SpendTier struct {
+	Name       string        `json:"name,omitempty"`
+	Percentage uint64        `json:"percentage"`
+	Minimum    []*TierAmount `json:"minimum"`
+}
+
+// TierAmount is the minimum spend of a tier in a currency.
+type TierAmount struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (t *SpendTier) name(index int) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("spend_tiers[%d]", index)
+}
+
+// percentage returns the percentage of the tier, which is at most 100.
+func (t *SpendTier) percentage() uint64 {
+	if t.Percentage > 100 {
+		return 100
+	}
+	return t.Percentage
+}
+
+// minimum returns the minimum spend of the tier in a currency, and false if
+// the tier has no minimum in the currency.
+func (t *SpendTier) minimum(currency string) (uint64, bool) {
+	for _, m := range t.Minimum {
+		if m.Currency == currency {
+			amount, err := ParseAmount(m.Amount, currency)
+			if err != nil {
+				return 0, false
+			}
+			return amount, true
+		}
+	}
+	return 0, false
+}
+
+// NextSpendTier is the next tier an order can reach, with the amount it has
+// to spend more to get it.
+type NextSpendTier struct {
+	Name       string `json:"name"`
+	Percentage uint64 `json:"percentage"`
+	AmountLeft uint64 `json:"amount_left"`
+}
+
+// applySpendTiers discounts the order by the percentage of the highest tier
+// its spend reaches. The spend is what the items cost after the other
+// discounts, with taxes when prices include taxes. The discount is split over
+// the line items in proportion to what they add to the spend, and lowers their
+// taxes. Percentages above 100 take off the whole spend.
+func applySpendTiers(settings *Settings, items []Item, currency string, price *Price, includeTaxes bool) {
+	if settings == nil || len(settings.SpendTiers) == 0 {
+		return
+	}
+
+	lineSpend := make([]uint64, len(price.Items))
+	var spend uint64
+	for i, itemPrice := range price.Items {
+		unitPrice := itemPrice.Subtotal
+		if includeTaxes {
+			unitPrice += itemPrice.Taxes
+		}
+		if itemPrice.Discount >= unitPrice {
+			continue
+		}
+		line := (unitPrice - itemPrice.Discount) * itemPrice.Quantity
+		if itemPrice.PromotionDiscount >= line {
+			continue
+		}
+		lineSpend[i] = line - itemPrice.PromotionDiscount
+		spend += lineSpend[i]
+	}
+
+	var reached *SpendTier
+	var reachedIndex int
+	var reachedMinimum uint64
+	for i, tier := range settings.SpendTiers {
+		minimum, ok := tier.minimum(currency)
+		if !ok {
+			continue
+		}
+		if spend >= minimum && (reached == nil || minimum > reachedMinimum) {
+			reached, reachedIndex, reachedMinimum = tier, i, minimum
+		}
+	}
+	for i, tier := range settings.SpendTiers {
+		minimum, ok := tier.minimum(currency)
+		if !ok || spend >= minimum || (reached != nil && tier.percentage() <= reached.percentage()) {
+			continue
+		}
+		if price.NextTier == nil || minimum-spend < price.NextTier.AmountLeft {
+			price.NextTier = &NextSpendTier{Name: tier.name(i), Percentage: tier.percentage(), AmountLeft: minimum - spend}
+		}
+	}
+	if reached == nil || reached.percentage() == 0 || spend == 0 {
+		return
+	}
+
+	discount := settings.round(float64(spend) * float64(reached.percentage()) / 100)
+	name := reached.name(reachedIndex)
+	price.SpendTier = name
+
+	// the share of each line item is rounded on the running total, so the
+	// shares add up to the discount
+	var cumulative, allocated uint64
+	for i, line := range lineSpend {
+		if line == 0 {
+			continue
+		}
+		cumulative += line
+		share := settings.round(float64(discount)*float64(cumulative)/float64(spend)) - allocated
+		allocated += share
+		price.Items[i].TierDiscount = share
+		price.Items[i].addLineDiscount(SpendTierAdjustment, name, reached.percentage(), share)
+		net := price.discountTaxes(settings.round, i, share, includeTaxes)
+		price.Discount += net
+		price.AddAdjustment(SpendTierAdjustment, name, reached.percentage(), net, items[i].ProductSku())
+	}
+}
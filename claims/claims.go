@@ -47,3 +47,35 @@ func HasClaims(userClaims map[string]interface{}, requiredClaims map[string]stri
 	}
 	return false
 }
+
+// CustomerGroupsKey is the claim the customer groups of a user are added to
+// before prices are calculated.
+const CustomerGroupsKey = "customer_groups"
+
+// InGroups is used to determine if the user of a set of userClaims is in at
+// least one of the groups.
+func InGroups(userClaims map[string]interface{}, groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	if userClaims == nil {
+		return false
+	}
+
+	userGroups := CustomerGroups(userClaims)
+	for _, group := range groups {
+		for _, userGroup := range userGroups {
+			if group == userGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CustomerGroups returns the customer groups of the user of a set of
+// userClaims.
+func CustomerGroups(userClaims map[string]interface{}) []string {
+	groups, _ := userClaims[CustomerGroupsKey].([]string)
+	return groups
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	archiveYears     int
+	archiveBatchSize int
+	archiveRestore   string
+)
+
+var archiveCmd = cobra.Command{
+	Use:   "archive",
+	Short: "Move old orders to the archive",
+	Long:  "Move the orders created more than --years years ago to the archived orders table. Archived orders can still be retrieved from the API with archived=true, and moved back with --restore.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, archive)
+	},
+}
+
+func init() {
+	archiveCmd.Flags().IntVar(&archiveYears, "years", 3, "Archive orders older than this many years")
+	archiveCmd.Flags().IntVar(&archiveBatchSize, "batch-size", 100, "Number of orders to load at a time")
+	archiveCmd.Flags().StringVar(&archiveRestore, "restore", "", "Move the archived order with this ID back to the orders table")
+}
+
+func archive(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
+	if archiveRestore != "" {
+		restoreArchivedOrder(globalConfig)
+		return
+	}
+	if archiveYears < 1 {
+		logrus.Fatal("--years must be at least 1")
+	}
+	if archiveBatchSize < 1 {
+		logrus.Fatal("--batch-size must be at least 1")
+	}
+
+	db, err := models.Connect(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	before := time.Now().AddDate(-archiveYears, 0, 0)
+	archived, err := models.ArchiveOrders(db, before, archiveBatchSize)
+	if err != nil {
+		logrus.Fatalf("Error archiving orders after archiving %d: %+v", archived, err)
+	}
+	fmt.Printf("Archived %d orders created before %s.\n", archived, before.Format("2006-01-02"))
+}
+
+func restoreArchivedOrder(globalConfig *conf.GlobalConfiguration) {
+	db, err := models.Connect(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	order, err := models.RestoreArchivedOrder(db, archiveRestore)
+	if err != nil {
+		logrus.Fatalf("Error restoring order %s: %+v", archiveRestore, err)
+	}
+	fmt.Printf("Restored order %s.\n", order.ID)
+}
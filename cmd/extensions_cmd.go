@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/extensions"
+)
+
+var extensionsCmd = cobra.Command{
+	Use:   "extensions",
+	Short: "List the compiled in extensions and the hook points they use",
+	Run:   listExtensions,
+}
+
+var extensionsDocsCmd = cobra.Command{
+	Use:   "docs",
+	Short: "Print the Markdown docs of the extension hook points",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Print(extensions.Lifecycle())
+	},
+}
+
+func init() {
+	extensionsCmd.AddCommand(&extensionsDocsCmd)
+}
+
+func listExtensions(cmd *cobra.Command, args []string) {
+	for _, ext := range extensions.Registered() {
+		fmt.Printf("%s\t%s\n", ext.Name(), strings.Join(extensions.PointsOf(ext), ", "))
+	}
+}
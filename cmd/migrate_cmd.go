@@ -1,24 +1,105 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var (
+	migrateDown  bool
+	migrateSteps int
+)
+
 var migrateCmd = cobra.Command{
-	Use:  "migrate",
-	Long: "Migrate database strucutures. This will create new tables and add missing collumns and indexes.",
+	Use:   "migrate",
+	Short: "Run the migrations of the database schema",
+	Long:  "Run the versioned migrations of the database schema that didn't run yet. With --down the last --steps migrations are rolled back instead.",
 	Run: func(cmd *cobra.Command, args []string) {
 		execWithConfig(cmd, migrate)
 	},
 }
 
+var duplicateEmailsCmd = cobra.Command{
+	Use:   "duplicate-emails",
+	Short: "List the users that should be merged",
+	Long:  "List the users of each instance whose emails are the same after normalizing them, like Foo@example.com and foo@example.com.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, duplicateEmails)
+	},
+}
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateDown, "down", false, "Roll back migrations instead of running them")
+	migrateCmd.Flags().IntVar(&migrateSteps, "steps", 1, "Number of migrations to roll back with --down")
+	migrateCmd.AddCommand(&duplicateEmailsCmd)
+}
+
 func migrate(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
+	if migrateDown && migrateSteps < 1 {
+		logrus.Fatal("--steps must be at least 1")
+	}
+
+	globalConfig.DB.Automigrate = false
 	db, err := models.Connect(globalConfig)
 	if err != nil {
 		logrus.Fatalf("Error opening database: %+v", err)
 	}
 	defer db.Close()
+
+	if migrateDown {
+		rolledBack, err := models.MigrateDown(db, migrateSteps)
+		for _, m := range rolledBack {
+			fmt.Printf("Rolled back %d %v\n", m.Version, m.Name)
+		}
+		if err != nil {
+			logrus.Fatalf("Error rolling back migrations: %+v", err)
+		}
+		if len(rolledBack) == 0 {
+			fmt.Println("No migrations to roll back.")
+		}
+		return
+	}
+
+	ran, err := models.Migrate(db)
+	for _, m := range ran {
+		fmt.Printf("Migrated %d %v\n", m.Version, m.Name)
+	}
+	if err != nil {
+		logrus.Fatalf("Error running migrations: %+v", err)
+	}
+	if len(ran) == 0 {
+		fmt.Println("The database is up to date.")
+	}
+}
+
+func duplicateEmails(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
+	db, err := models.Connect(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	duplicates, err := models.FindDuplicateEmails(db)
+	if err != nil {
+		logrus.Fatalf("Error finding duplicate emails: %+v", err)
+	}
+	if len(duplicates) == 0 {
+		fmt.Println("No duplicate emails found.")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNORMALIZED EMAIL\tUSER ID\tEMAIL\tORDERS\tCREATED")
+	for _, d := range duplicates {
+		for _, user := range d.Users {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", d.InstanceID, d.NormalizedEmail, user.ID, user.Email, user.OrderCount, user.CreatedAt.Format("2006-01-02"))
+		}
+	}
+	w.Flush()
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/netlify/gocommerce/api"
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/outbound"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -28,6 +29,11 @@ func multi(cmd *cobra.Command, args []string) {
 	if globalConfig.DB.Namespace != "" {
 		models.Namespace = globalConfig.DB.Namespace
 	}
+	models.StripEmailPlusTags = globalConfig.Emails.StripPlusTags
+	models.IDRegion = globalConfig.Region.Name
+	if err := outbound.Configure(&globalConfig.Outbound); err != nil {
+		logrus.Fatalf("Failed to configure outbound requests: %+v", err)
+	}
 
 	db, err := models.Connect(globalConfig)
 	if err != nil {
@@ -48,6 +54,9 @@ func multi(cmd *cobra.Command, args []string) {
 	logrus.Infof("GoCommerce API started on: %s", l)
 
 	models.RunHooks(bgDB, logrus.WithField("component", "hooks"))
+	api.RunJobs(bgDB, logrus.WithField("component", "jobs"))
+	api.RunAbandonedOrders(bgDB, logrus.WithField("component", "abandoned_orders"))
+	runExchangeRates(globalConfig, bgDB)
 
 	api.ListenAndServe(l)
 }
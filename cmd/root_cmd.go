@@ -6,6 +6,7 @@ import (
 
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/outbound"
 )
 
 var configFile = ""
@@ -22,7 +23,7 @@ var rootCmd = cobra.Command{
 // RootCmd will add flags and subcommands to the different commands
 func RootCmd() *cobra.Command {
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "The configuration file")
-	rootCmd.AddCommand(&serveCmd, &migrateCmd, &multiCmd, &versionCmd)
+	rootCmd.AddCommand(&serveCmd, &migrateCmd, &multiCmd, &versionCmd, &extensionsCmd, &archiveCmd)
 	return &rootCmd
 }
 
@@ -39,5 +40,10 @@ func execWithConfig(cmd *cobra.Command, fn func(globalConfig *conf.GlobalConfigu
 	if globalConfig.DB.Namespace != "" {
 		models.Namespace = globalConfig.DB.Namespace
 	}
+	models.StripEmailPlusTags = globalConfig.Emails.StripPlusTags
+	models.IDRegion = globalConfig.Region.Name
+	if err := outbound.Configure(&globalConfig.Outbound); err != nil {
+		logrus.Fatalf("Failed to configure outbound requests: %+v", err)
+	}
 	fn(globalConfig, config)
 }
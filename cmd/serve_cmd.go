@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/api"
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/rates"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -42,6 +44,22 @@ func serve(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
 	logrus.Infof("GoCommerce API started on: %s", l)
 
 	models.RunHooks(bgDB, logrus.WithField("component", "hooks"))
+	api.RunJobs(bgDB, logrus.WithField("component", "jobs"))
+	api.RunAbandonedOrders(bgDB, logrus.WithField("component", "abandoned_orders"))
+	runExchangeRates(globalConfig, bgDB)
 
 	api.ListenAndServe(l)
 }
+
+// runExchangeRates fetches the daily exchange rates in the background, if a
+// source is set up.
+func runExchangeRates(globalConfig *conf.GlobalConfiguration, db *gorm.DB) {
+	if globalConfig.ExchangeRates.Source == "" {
+		return
+	}
+	source, err := rates.NewSource(globalConfig.ExchangeRates.Source, globalConfig.ExchangeRates.AppID, globalConfig.ExchangeRates.URL)
+	if err != nil {
+		logrus.Fatalf("Error setting up exchange rates: %+v", err)
+	}
+	models.RunExchangeRates(db, source, logrus.WithField("component", "exchange_rates"))
+}
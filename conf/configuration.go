@@ -15,12 +15,72 @@ type DBConfiguration struct {
 	URL         string `envconfig:"DATABASE_URL" required:"true"`
 	Namespace   string
 	Automigrate bool
+
+	// ReplicaURL is a read replica of the database in the region of this
+	// process. Listings and reports are read from it, while all writes go to
+	// the primary at URL.
+	ReplicaURL string `envconfig:"DATABASE_REPLICA_URL"`
 }
 
 // JWTConfiguration holds all the JWT related configuration.
 type JWTConfiguration struct {
 	Secret         string `json:"secret"`
 	AdminGroupName string `json:"admin_group_name" split_words:"true"`
+	// Roles are the permission scopes granted to the roles in the
+	// app_metadata of a JWT, as space separated lists like
+	// "orders:read payments:refund". The admin group has all scopes.
+	Roles map[string]string `json:"roles"`
+}
+
+// BreakerConfiguration holds the settings of the circuit breakers of a kind of
+// external service.
+type BreakerConfiguration struct {
+	// FailureThreshold is the number of failed calls in a row after which
+	// calls to the service are suspended, 5 by default.
+	FailureThreshold int `split_words:"true"`
+	// OpenTimeout is the number of seconds calls are suspended before a
+	// single call probes whether the service is back, 30 by default.
+	OpenTimeout int `split_words:"true"`
+	// SlowCall is the number of milliseconds after which a call counts as
+	// failed even if it succeeds. Zero only counts errors.
+	SlowCall int `split_words:"true"`
+}
+
+// RateLimitConfiguration holds the number of requests to an endpoint a client
+// can make in a period, with a token bucket that holds that many requests
+// and refills over the period. Zero disables a limit.
+type RateLimitConfiguration struct {
+	// PerIP limits the requests of each IP address.
+	PerIP int `envconfig:"PER_IP"`
+	// PerUser limits the requests of each signed in user, from any address.
+	PerUser int `split_words:"true"`
+	// Period is the number of seconds the bucket takes to refill the limit,
+	// 60 by default.
+	Period int
+	// Burst is the number of requests a client can make on top of the limit
+	// in a spike. They refill at the same rate as the limit.
+	Burst int
+	// Mode is what happens to requests over the limit: "enforce" rejects
+	// them, the default, "warn" lets them through with an
+	// X-RateLimit-Warning header and "log" only logs them, to roll a limit
+	// out gradually.
+	Mode string
+}
+
+// OutboundConfiguration holds the settings of the HTTP requests to other
+// services, like payment providers, product pages and webhooks.
+type OutboundConfiguration struct {
+	// ProxyURL sends all requests through a proxy. Without it, the
+	// HTTP_PROXY and HTTPS_PROXY environment variables are used.
+	ProxyURL string `split_words:"true"`
+	// NoProxy is a comma separated list of hosts that are requested
+	// directly, including their subdomains.
+	NoProxy string `split_words:"true"`
+	// CABundle is the path of a PEM file with certificates that are trusted
+	// on top of the ones of the system, like the CA of an internal network.
+	CABundle string `envconfig:"CA_BUNDLE"`
+	// TLSMinVersion is the oldest TLS version accepted, like 1.2.
+	TLSMinVersion string `envconfig:"TLS_MIN_VERSION"`
 }
 
 // GlobalConfiguration holds all the global configuration for gocommerce
@@ -29,6 +89,86 @@ type GlobalConfiguration struct {
 		Host     string
 		Port     int `envconfig:"PORT" default:"8080"`
 		Endpoint string
+		// ClientIPHeader is the header the proxy in front of the API sets
+		// to the IP address of the client, like X-Forwarded-For. Only set
+		// it behind a proxy that overwrites the header, since clients can
+		// send any value. Without it, the address the request came from is
+		// the client's.
+		ClientIPHeader string `split_words:"true"`
+	}
+	Admin struct {
+		// Enabled serves the built-in admin dashboard under /admin.
+		Enabled bool
+	}
+	ProductCache struct {
+		// RedisURL shares the product cache between processes in Redis,
+		// instead of keeping it in the memory of each process.
+		RedisURL string `envconfig:"REDIS_URL"`
+	} `split_words:"true"`
+	Emails struct {
+		// StripPlusTags matches foo+shop@example.com to the same customer as
+		// foo@example.com.
+		StripPlusTags bool `split_words:"true"`
+	}
+	Outbound        OutboundConfiguration
+	CircuitBreakers struct {
+		Payments BreakerConfiguration
+		Site     BreakerConfiguration
+		Mail     BreakerConfiguration
+		VAT      BreakerConfiguration
+	} `split_words:"true"`
+	LoadShedding struct {
+		// MaxInFlight is the number of requests handled at the same time
+		// before requests are rejected with a 503. Reports and exports are
+		// rejected first, at half of it, and the last fifth is reserved for
+		// creating and paying orders. Zero disables load shedding.
+		MaxInFlight int `split_words:"true"`
+		// TargetLatency is the average response time in milliseconds above
+		// which the server counts as overloaded, whatever the number of
+		// requests. Reports and exports are rejected then, and other reads
+		// at half of MaxInFlight. Zero only limits the number of requests.
+		TargetLatency int `split_words:"true"`
+	} `split_words:"true"`
+	RateLimits struct {
+		// RedisURL shares the rate limits between processes in Redis,
+		// instead of counting the requests of each process on its own.
+		RedisURL string `envconfig:"REDIS_URL"`
+		// Orders limits creating orders.
+		Orders RateLimitConfiguration
+		// Coupons limits looking up coupons, against guessing codes.
+		Coupons RateLimitConfiguration
+		// GiftCards limits looking up gift card balances, against guessing
+		// codes.
+		GiftCards RateLimitConfiguration `split_words:"true"`
+		// Payments limits paying orders and PayPal preauthorizations,
+		// against testing stolen cards.
+		Payments RateLimitConfiguration
+	} `split_words:"true"`
+	Tracing struct {
+		// Enabled logs a span for each request and for its steps that can
+		// be slow: processing line items, fetching products, database
+		// transactions and calls to payment providers. The spans of a
+		// request are logged with its X-Request-ID as trace_id.
+		Enabled bool
+	}
+	ExchangeRates struct {
+		// Source is where the daily exchange rates are fetched from, either
+		// ecb or openexchangerates. Without one, no rates are fetched.
+		Source string
+		// AppID is the key of Open Exchange Rates.
+		AppID string `envconfig:"APP_ID"`
+		// URL replaces the URL of the source.
+		URL string
+	} `split_words:"true"`
+	Region struct {
+		// Name is the region this process runs in, like "eu-west". The IDs
+		// of new orders and transactions start with it, so IDs created in
+		// different regions never collide.
+		Name string
+		// StickyPrimary is the number of seconds a client reads from the
+		// primary database instead of the replica after it made a change, so
+		// it sees its own writes despite replication lag. 10 by default.
+		StickyPrimary int `split_words:"true"`
 	}
 	DB                DBConfiguration
 	Logging           nconf.LoggingConfig `envconfig:"LOG"`
@@ -40,6 +180,8 @@ type GlobalConfiguration struct {
 type EmailContentConfiguration struct {
 	OrderConfirmation string `json:"order_confirmation" split_words:"true"`
 	OrderReceived     string `json:"order_received" split_words:"true"`
+	OrderRefund       string `json:"order_refund" split_words:"true"`
+	OrderBackordered  string `json:"order_backordered" split_words:"true"`
 }
 
 // Configuration holds all the per-tenant configuration for gocommerce
@@ -47,7 +189,13 @@ type Configuration struct {
 	SiteURL string           `json:"site_url" split_words:"true"`
 	JWT     JWTConfiguration `json:"jwt"`
 
+	// IDFormat is the format of the IDs of new orders and transactions,
+	// either uuidv7 (the default) or uuidv4.
+	IDFormat string `json:"id_format" split_words:"true"`
+
 	Mailer struct {
+		// Provider is either smtp (the default) or mailgun.
+		Provider   string                    `json:"provider"`
 		Host       string                    `json:"host"`
 		Port       int                       `json:"port"`
 		User       string                    `json:"user"`
@@ -55,18 +203,30 @@ type Configuration struct {
 		AdminEmail string                    `json:"admin_email" split_words:"true"`
 		Subjects   EmailContentConfiguration `json:"subjects"`
 		Templates  EmailContentConfiguration `json:"templates"`
+		Mailgun    struct {
+			Domain string `json:"domain"`
+			APIKey string `json:"api_key" split_words:"true"`
+			URL    string `json:"url"`
+		} `json:"mailgun"`
 	} `json:"mailer"`
 
 	Payment struct {
 		Stripe struct {
 			Enabled   bool   `json:"enabled"`
+			PublicKey string `json:"public_key" split_words:"true"`
 			SecretKey string `json:"secret_key" split_words:"true"`
+			// WebhookSecret is the signing secret of the endpoint Stripe
+			// sends events to, see POST /webhooks/stripe.
+			WebhookSecret string `json:"webhook_secret" split_words:"true"`
 		} `json:"stripe"`
 		PayPal struct {
 			Enabled  bool   `json:"enabled"`
 			ClientID string `json:"client_id" split_words:"true"`
 			Secret   string `json:"secret"`
 			Env      string `json:"env"`
+			// WebhookID is the ID PayPal gave the webhook it sends events
+			// to, see POST /webhooks/paypal.
+			WebhookID string `json:"webhook_id" split_words:"true"`
 		} `json:"paypal"`
 	} `json:"payment"`
 
@@ -79,13 +239,156 @@ type Configuration struct {
 		URL      string `json:"url"`
 		User     string `json:"user"`
 		Password string `json:"password"`
+		// Secret is the key the coupons are signed with. When it is set,
+		// coupons without a valid signature are rejected.
+		Secret string `json:"secret"`
 	} `json:"coupons"`
 
+	Defaults struct {
+		Country  string `json:"country"`
+		Currency string `json:"currency"`
+		Locale   string `json:"locale"`
+		// GeoIPHeader is the request header a CDN or proxy sets to the
+		// country of the client, like CF-IPCountry.
+		GeoIPHeader string `json:"geoip_header" split_words:"true"`
+	} `json:"defaults"`
+
+	Users struct {
+		// SyncEmails updates the email of a known user to the one in their
+		// token when it changed, like after they changed it with the
+		// identity provider. Every change is kept in the email history of
+		// the user.
+		SyncEmails bool `json:"sync_emails" split_words:"true"`
+	} `json:"users"`
+
+	Settings struct {
+		// Path is where the site serves its gocommerce settings, by default
+		// /gocommerce/settings.json.
+		Path string `json:"path"`
+		// TTL is the number of seconds the settings are cached before they
+		// are revalidated with the site.
+		TTL int `json:"ttl"`
+	} `json:"settings"`
+
+	// ProductOrigins are origins serving the same product pages as SiteURL,
+	// by the name of the region they are closest to. Product pages are
+	// fetched from the origin of the region of the process, and from
+	// SiteURL when there is none or it fails.
+	ProductOrigins map[string]string `json:"product_origins" split_words:"true"`
+
+	Products struct {
+		// JSON fetches the metadata of a product page from a JSON file next
+		// to it, /products/book.json for /products/book and
+		// /products/book/index.json for /products/book/, and falls back to
+		// the page itself when the site has no such file.
+		JSON bool `json:"json"`
+		// Index is the path of a JSON file with the metadata of all products
+		// by the path of their page. Pages missing from it are fetched as
+		// before.
+		Index string `json:"index"`
+	} `json:"products"`
+
+	ProductCache struct {
+		// TTL is the number of seconds the metadata of a product page is
+		// cached. Zero disables the cache, so every order fetches its product
+		// pages.
+		TTL int `json:"ttl"`
+	} `json:"product_cache" split_words:"true"`
+
+	VATNumbers struct {
+		// CacheTTL is the number of hours the result of validating a VAT
+		// number with VIES is reused, 24 by default. Older results are still
+		// used while VIES is down.
+		CacheTTL int `json:"cache_ttl" split_words:"true"`
+		// FailOpen accepts VAT numbers that can't be validated because VIES
+		// is down, instead of rejecting the order until it is back. Orders
+		// with such numbers are charged VAT until they are validated.
+		FailOpen bool `json:"fail_open" split_words:"true"`
+	} `json:"vat_numbers" split_words:"true"`
+
+	AddressValidation struct {
+		// Provider verifies and normalizes the shipping addresses of new
+		// orders: easypost, smartystreets or regex, which only checks the
+		// format of postal codes. Without one, addresses are only checked
+		// for the required fields.
+		Provider string `json:"provider"`
+		// Mode is advisory (the default), which accepts addresses the
+		// provider finds invalid as entered, or blocking, which rejects them.
+		Mode string `json:"mode"`
+		// APIKey is the key of EasyPost.
+		APIKey string `json:"api_key" envconfig:"API_KEY"`
+		// AuthID and AuthToken are the credentials of SmartyStreets.
+		AuthID    string `json:"auth_id" split_words:"true"`
+		AuthToken string `json:"auth_token" split_words:"true"`
+		// URL replaces the URL of the provider.
+		URL string `json:"url"`
+	} `json:"address_validation" split_words:"true"`
+
+	Pricing struct {
+		// QuoteValidity is the number of minutes the prices calculated for an
+		// order are guaranteed. Zero means the prices never expire.
+		QuoteValidity int `json:"quote_validity" split_words:"true"`
+		// OverrideApprovalThreshold is the largest manual discount an admin
+		// can give on an order without the approval of a second admin. Zero
+		// means no approval is needed.
+		OverrideApprovalThreshold uint64 `json:"override_approval_threshold" split_words:"true"`
+	} `json:"pricing"`
+
+	ActionLinks struct {
+		// URL is the public URL of the API that action links point to.
+		// Links can't be issued without it.
+		URL string `json:"url"`
+		// TTL is the number of hours an action link can be used, 72 by
+		// default.
+		TTL int `json:"ttl"`
+		// InMails adds links to refund the payment to the mails notifying
+		// the admin of new orders.
+		InMails bool `json:"in_mails" split_words:"true"`
+	} `json:"action_links" split_words:"true"`
+
+	Inventory struct {
+		// OversellPolicy decides what happens when the stock of an order ran
+		// out between creating and paying it: reject (the default) fails the
+		// payment, backorder takes the payment and records the missing
+		// quantities as backordered.
+		OversellPolicy string `json:"oversell_policy" split_words:"true"`
+	} `json:"inventory"`
+
+	AbandonedOrders struct {
+		// After is the number of hours an order can stay unpaid before it is
+		// cancelled as abandoned. Zero keeps unpaid orders around forever.
+		After int `json:"after"`
+		// PurgeAfter is the number of days abandoned orders are kept before
+		// they are deleted for good. Zero keeps them.
+		PurgeAfter int `json:"purge_after" split_words:"true"`
+	} `json:"abandoned_orders" split_words:"true"`
+
+	// TestMode suppresses the mails and webhooks of all new orders, for
+	// staging instances and test runs.
+	TestMode bool `json:"test_mode" split_words:"true"`
+
+	Idempotency struct {
+		// Window is the number of hours the response to a request with an
+		// Idempotency-Key header is replayed to retries, 24 by default.
+		Window int `json:"window"`
+	} `json:"idempotency"`
+
 	Webhooks struct {
-		Order   string `json:"order"`
-		Payment string `json:"payment"`
-		Update  string `json:"update"`
-		Refund  string `json:"refund"`
+		Order         string `json:"order"`
+		Payment       string `json:"payment"`
+		PaymentFailed string `json:"payment_failed" split_words:"true"`
+		Update        string `json:"update"`
+		Refund        string `json:"refund"`
+		// Abandoned is called with every order that is cancelled because it
+		// stayed unpaid, to send recovery mails.
+		Abandoned string `json:"abandoned"`
+
+		// Validation is called with every new order before it is saved. The
+		// order is rejected when it answers with a 4xx status.
+		Validation string `json:"validation"`
+		// ValidationTimeout is the number of seconds to wait for the validation
+		// webhook, 10 by default.
+		ValidationTimeout int `json:"validation_timeout" split_words:"true"`
 
 		Secret string `json:"secret"`
 	} `json:"webhooks"`
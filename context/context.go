@@ -28,6 +28,7 @@ const (
 	couponsKey         = contextKey("coupons")
 	requestIDKey       = contextKey("request_id")
 	adminFlagKey       = contextKey("is_admin")
+	scopesKey          = contextKey("scopes")
 	mailerKey          = contextKey("mailer")
 	assetStoreKey      = contextKey("asset_store")
 	paymentProviderKey = contextKey("payment-provider")
@@ -185,6 +186,27 @@ func IsAdmin(ctx context.Context) bool {
 	return obj.(bool)
 }
 
+// WithScopes adds the permission scopes the roles of the user grant to the
+// context.
+func WithScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesKey, scopes)
+}
+
+// HasScope tells whether the user has a permission scope. Admins have all
+// scopes.
+func HasScope(ctx context.Context, scope string) bool {
+	if IsAdmin(ctx) {
+		return true
+	}
+	scopes, _ := ctx.Value(scopesKey).([]string)
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
 // GetUserID reads the user ID from the context.
 func GetUserID(ctx context.Context) string {
 	id, _ := ctx.Value(userIDKey).(string)
@@ -1,9 +1,16 @@
 package coupons
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,6 +20,21 @@ import (
 
 const cacheTime = 1 * time.Minute
 
+// fetchTimeout is how long loading the coupons may take, so a slow site
+// doesn't hold up orders.
+const fetchTimeout = 10 * time.Second
+
+// maxCouponsSize is the largest coupons file that is read.
+const maxCouponsSize = 10 << 20
+
+// SignatureHeader is the response header with the HMAC-SHA256 of the coupons,
+// as sha256= and the hex encoded signature.
+const SignatureHeader = "X-Coupons-Signature-256"
+
+// ErrInvalidSignature is returned when the coupons aren't signed with the
+// configured secret.
+var ErrInvalidSignature = errors.New("Coupons signature doesn't match")
+
 // Cache is an interface for how to lookup a coupon based upon the code.
 type Cache interface {
 	Lookup(string) (*models.Coupon, error)
@@ -30,13 +52,15 @@ type couponsResponse struct {
 }
 
 type couponCacheFromURL struct {
-	url       string
-	user      string
-	password  string
-	lastFetch time.Time
-	coupons   map[string]*models.Coupon
-	mutex     sync.Mutex
-	client    *http.Client
+	url        string
+	user       string
+	password   string
+	secret     string
+	lastFetch  time.Time
+	refreshing bool
+	coupons    map[string]*models.Coupon
+	mutex      sync.Mutex
+	client     *http.Client
 }
 
 // NewCouponCacheFromURL creates a coupon cache using the provided configuration.
@@ -49,19 +73,51 @@ func NewCouponCacheFromURL(config *conf.Configuration) Cache {
 		url:      config.Coupons.URL,
 		user:     config.Coupons.User,
 		password: config.Coupons.Password,
+		secret:   config.Coupons.Secret,
 		coupons:  map[string]*models.Coupon{},
-		client:   &http.Client{},
+		client:   &http.Client{Timeout: fetchTimeout},
 	}
 }
 
+// Lookup finds a coupon by its code. The coupons are loaded again when they
+// are older than the cache time, by one lookup at a time while the others
+// keep using the coupons that were loaded before. When loading fails, the
+// last coupons that were loaded are used until it succeeds.
 func (c *couponCacheFromURL) Lookup(code string) (*models.Coupon, error) {
-	if c.coupons != nil && time.Now().Before(c.lastFetch.Add(cacheTime)) {
-		coupon, ok := c.coupons[code]
-		if ok {
-			return coupon, nil
+	c.mutex.Lock()
+	loaded := !c.lastFetch.IsZero()
+	refresh := time.Now().After(c.lastFetch.Add(cacheTime)) && !c.refreshing
+	if refresh {
+		c.refreshing = true
+	}
+	c.mutex.Unlock()
+
+	if refresh || !loaded {
+		coupons, err := c.load()
+		c.mutex.Lock()
+		if refresh {
+			c.refreshing = false
 		}
-		return nil, &CouponNotFound{}
+		if err == nil {
+			c.coupons = coupons
+			c.lastFetch = time.Now()
+		}
+		c.mutex.Unlock()
+		if err != nil && !loaded {
+			return nil, err
+		}
+	}
+
+	c.mutex.Lock()
+	coupon, ok := c.coupons[code]
+	c.mutex.Unlock()
+	if !ok {
+		return nil, CouponNotFound{}
 	}
+	return coupon, nil
+}
+
+func (c *couponCacheFromURL) load() (map[string]*models.Coupon, error) {
 	req, err := http.NewRequest("GET", c.url, nil)
 	if err != nil {
 		return nil, err
@@ -80,22 +136,40 @@ func (c *couponCacheFromURL) Lookup(code string) (*models.Coupon, error) {
 		return nil, fmt.Errorf("Coupon URL returned %v", resp.StatusCode)
 	}
 
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCouponsSize))
+	if err != nil {
+		return nil, err
+	}
+	if c.secret != "" {
+		if err := Verify(c.secret, body, resp.Header.Get(SignatureHeader)); err != nil {
+			return nil, err
+		}
+	}
+
 	couponsResponse := &couponsResponse{}
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(couponsResponse); err != nil {
+	if err := json.Unmarshal(body, couponsResponse); err != nil {
 		return nil, err
 	}
 	for key, coupon := range couponsResponse.Coupons {
 		coupon.Code = key
 	}
+	return couponsResponse.Coupons, nil
+}
 
-	c.mutex.Lock()
-	c.coupons = couponsResponse.Coupons
-	c.mutex.Unlock()
+// Sign returns the signature of coupons for the SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
 
-	coupon, ok := c.coupons[code]
-	if ok {
-		return coupon, nil
+// Verify checks the signature of coupons from the SignatureHeader.
+func Verify(secret string, body []byte, signature string) error {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(Sign(secret, body)), []byte(signature)) {
+		return ErrInvalidSignature
 	}
-	return nil, &CouponNotFound{}
+	return nil
 }
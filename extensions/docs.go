@@ -0,0 +1,31 @@
+package extensions
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Lifecycle renders the hook points as Markdown, in the order they happen
+// during the lifecycle of an order.
+func Lifecycle() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "# Extension hook points")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "This file is generated by `gocommerce extensions docs`, do not edit it by hand.")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "Extensions are registered with `extensions.Register` from the `init` function of")
+	fmt.Fprintln(buf, "their package and compiled in with a blank import in `main.go`. Registered")
+	fmt.Fprintln(buf, "extensions are called in the order of their names at every hook point whose")
+	fmt.Fprintln(buf, "interface they implement.")
+	for i, p := range Points {
+		fmt.Fprintln(buf)
+		fmt.Fprintf(buf, "## %d. %s\n", i+1, p.Name)
+		fmt.Fprintln(buf)
+		fmt.Fprintf(buf, "- Interface: `extensions.%s`\n", p.Interface)
+		fmt.Fprintf(buf, "- Method: `%s`\n", p.Method)
+		fmt.Fprintf(buf, "- Stage: %s\n", p.Stage)
+		fmt.Fprintln(buf)
+		fmt.Fprintln(buf, p.Description)
+	}
+	return buf.String()
+}
@@ -0,0 +1,237 @@
+// Package extensions lets deployers compile custom business logic into
+// gocommerce without modifying the core handlers.
+//
+// An extension is registered from the init function of its package, the same
+// way database drivers are:
+//
+//	func init() {
+//		extensions.Register(&myExtension{})
+//	}
+//
+// and is compiled in with a blank import in the main package. Depending on the
+// interfaces it implements, an extension is called at one or more of the hook
+// points listed in Points.
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// Extension is a module of custom business logic. It must implement at least
+// one of the hook interfaces of this package.
+type Extension interface {
+	Name() string
+}
+
+// OrderValidator is called before a new order is saved. Returning an error
+// rejects the order, and the message of the error is shown to the buyer.
+type OrderValidator interface {
+	ValidateOrder(ctx context.Context, order *models.Order) error
+}
+
+// PriceAdjuster is called for every line item of a new order once its price is
+// looked up, and before the totals of the order are calculated. It may change
+// the price of the item.
+type PriceAdjuster interface {
+	AdjustPrice(ctx context.Context, order *models.Order, item *models.LineItem) error
+}
+
+// PaymentListener is called after a payment for an order succeeded and the
+// order is marked as paid. Errors are logged and don't affect the payment.
+type PaymentListener interface {
+	OrderPaid(ctx context.Context, order *models.Order, transaction *models.Transaction) error
+}
+
+// WebhookEnricher is called with the payload of every webhook before it is
+// stored for delivery. It may add or change fields of the payload.
+type WebhookEnricher interface {
+	EnrichWebhook(ctx context.Context, hookType string, payload map[string]interface{}) error
+}
+
+// Point describes a hook point extensions can be called at.
+type Point struct {
+	Name        string
+	Interface   string
+	Method      string
+	Stage       string
+	Description string
+	implements  func(Extension) bool
+}
+
+// Points is the list of hook points in the order they happen during the
+// lifecycle of an order.
+var Points = []Point{
+	{
+		Name:        "price-adjust",
+		Interface:   "PriceAdjuster",
+		Method:      "AdjustPrice(ctx context.Context, order *models.Order, item *models.LineItem) error",
+		Stage:       "POST /orders",
+		Description: "Called for every line item of a new order once its price is looked up on the site, and before taxes, discounts and totals are calculated. The extension may change the price of the item. An error aborts the order with a 500 response.",
+		implements:  func(e Extension) bool { _, ok := e.(PriceAdjuster); return ok },
+	},
+	{
+		Name:        "pre-validate-order",
+		Interface:   "OrderValidator",
+		Method:      "ValidateOrder(ctx context.Context, order *models.Order) error",
+		Stage:       "POST /orders",
+		Description: "Called with the fully priced order before it is saved, and before the validation webhook. An error rejects the order with a 400 response carrying the message of the error.",
+		implements:  func(e Extension) bool { _, ok := e.(OrderValidator); return ok },
+	},
+	{
+		Name:        "post-payment",
+		Interface:   "PaymentListener",
+		Method:      "OrderPaid(ctx context.Context, order *models.Order, transaction *models.Transaction) error",
+		Stage:       "POST /orders/{id}/payments",
+		Description: "Called after a payment succeeded and the order is marked as paid. Errors are logged and don't affect the payment.",
+		implements:  func(e Extension) bool { _, ok := e.(PaymentListener); return ok },
+	},
+	{
+		Name:        "webhook-enrich",
+		Interface:   "WebhookEnricher",
+		Method:      "EnrichWebhook(ctx context.Context, hookType string, payload map[string]interface{}) error",
+		Stage:       "every webhook",
+		Description: "Called with the JSON payload of every webhook before it is stored for delivery. The extension may add or change fields of the payload. An error is logged and the webhook is sent with its original payload.",
+		implements:  func(e Extension) bool { _, ok := e.(WebhookEnricher); return ok },
+	},
+}
+
+var (
+	mutex      sync.RWMutex
+	registered = map[string]Extension{}
+)
+
+// Register makes an extension available to all instances. It panics if an
+// extension with the same name is already registered, or if the extension
+// doesn't implement any of the hook interfaces.
+func Register(ext Extension) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if ext == nil {
+		panic("extensions: Register extension is nil")
+	}
+	name := ext.Name()
+	if _, dup := registered[name]; dup {
+		panic("extensions: Register called twice for extension " + name)
+	}
+	if len(pointsOf(ext)) == 0 {
+		panic("extensions: " + name + " doesn't implement any hook interface")
+	}
+	registered[name] = ext
+}
+
+// Unregister removes a registered extension. It is mostly useful in tests.
+func Unregister(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(registered, name)
+}
+
+// Registered returns the registered extensions sorted by name, which is the
+// order they are called in.
+func Registered() []Extension {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	names := make([]string, 0, len(registered))
+	for name := range registered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exts := make([]Extension, len(names))
+	for i, name := range names {
+		exts[i] = registered[name]
+	}
+	return exts
+}
+
+// PointsOf returns the names of the hook points an extension is called at.
+func PointsOf(ext Extension) []string {
+	return pointsOf(ext)
+}
+
+func pointsOf(ext Extension) []string {
+	names := []string{}
+	for _, p := range Points {
+		if p.implements(ext) {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// ValidateOrder runs the order validators. The first error rejects the order.
+func ValidateOrder(ctx context.Context, order *models.Order) error {
+	for _, ext := range Registered() {
+		if v, ok := ext.(OrderValidator); ok {
+			if err := v.ValidateOrder(ctx, order); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AdjustPrice runs the price adjusters for a line item.
+func AdjustPrice(ctx context.Context, order *models.Order, item *models.LineItem) error {
+	for _, ext := range Registered() {
+		if a, ok := ext.(PriceAdjuster); ok {
+			if err := a.AdjustPrice(ctx, order, item); err != nil {
+				return fmt.Errorf("Extension %v failed to adjust the price of %v: %v", ext.Name(), item.Sku, err)
+			}
+		}
+	}
+	return nil
+}
+
+// OrderPaid runs the payment listeners. All of them are called, and their
+// errors are returned together.
+func OrderPaid(ctx context.Context, order *models.Order, transaction *models.Transaction) []error {
+	var errs []error
+	for _, ext := range Registered() {
+		if l, ok := ext.(PaymentListener); ok {
+			if err := l.OrderPaid(ctx, order, transaction); err != nil {
+				errs = append(errs, fmt.Errorf("Extension %v failed after payment: %v", ext.Name(), err))
+			}
+		}
+	}
+	return errs
+}
+
+// EnrichWebhook runs the webhook enrichers on a payload. Without any enrichers
+// the payload is returned as is, otherwise the enriched JSON object is returned.
+// Payloads that aren't JSON objects can't be enriched.
+func EnrichWebhook(ctx context.Context, hookType string, payload interface{}) (interface{}, error) {
+	var enrichers []Extension
+	for _, ext := range Registered() {
+		if _, ok := ext.(WebhookEnricher); ok {
+			enrichers = append(enrichers, ext)
+		}
+	}
+	if len(enrichers) == 0 {
+		return payload, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return payload, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return payload, fmt.Errorf("Webhook payload of %v can't be enriched: %v", hookType, err)
+	}
+
+	for _, ext := range enrichers {
+		if err := ext.(WebhookEnricher).EnrichWebhook(ctx, hookType, fields); err != nil {
+			return payload, fmt.Errorf("Extension %v failed to enrich %v webhook: %v", ext.Name(), hookType, err)
+		}
+	}
+	return fields, nil
+}
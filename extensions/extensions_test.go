@@ -0,0 +1,94 @@
+package extensions
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+type listener struct {
+	name string
+	err  error
+	paid []string
+}
+
+func (l *listener) Name() string { return l.name }
+
+func (l *listener) OrderPaid(ctx context.Context, order *models.Order, transaction *models.Transaction) error {
+	l.paid = append(l.paid, order.ID)
+	return l.err
+}
+
+type enricher struct{}
+
+func (enricher) Name() string { return "enricher" }
+
+func (enricher) EnrichWebhook(ctx context.Context, hookType string, payload map[string]interface{}) error {
+	payload["hook"] = hookType
+	return nil
+}
+
+type noop struct{}
+
+func (noop) Name() string { return "noop" }
+
+func TestRegister(t *testing.T) {
+	first := &listener{name: "first"}
+	Register(first)
+	defer Unregister("first")
+
+	assert.Panics(t, func() { Register(&listener{name: "first"}) })
+	assert.Panics(t, func() { Register(noop{}) })
+	assert.Equal(t, []string{"post-payment"}, PointsOf(first))
+}
+
+func TestOrderPaid(t *testing.T) {
+	failing := &listener{name: "a-failing", err: errors.New("ERP is down")}
+	working := &listener{name: "b-working"}
+	Register(failing)
+	Register(working)
+	defer Unregister(failing.name)
+	defer Unregister(working.name)
+
+	errs := OrderPaid(context.Background(), &models.Order{ID: "order-1"}, &models.Transaction{})
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "ERP is down")
+	assert.Equal(t, []string{"order-1"}, failing.paid)
+	assert.Equal(t, []string{"order-1"}, working.paid)
+}
+
+func TestEnrichWebhook(t *testing.T) {
+	order := &models.Order{ID: "order-1"}
+	payload, err := EnrichWebhook(context.Background(), "order.created", order)
+	require.NoError(t, err)
+	assert.Equal(t, order, payload)
+
+	Register(enricher{})
+	defer Unregister("enricher")
+
+	payload, err = EnrichWebhook(context.Background(), "order.created", order)
+	require.NoError(t, err)
+	fields, ok := payload.(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, "order-1", fields["id"])
+	assert.Equal(t, "order.created", fields["hook"])
+
+	payload, err = EnrichWebhook(context.Background(), "order.created", []string{"not", "an", "object"})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"not", "an", "object"}, payload)
+}
+
+func TestLifecycle(t *testing.T) {
+	docs := Lifecycle()
+	for _, p := range Points {
+		assert.Contains(t, docs, p.Name)
+		assert.Contains(t, docs, "extensions."+p.Interface)
+	}
+	assert.True(t, strings.Index(docs, "price-adjust") < strings.Index(docs, "post-payment"))
+}
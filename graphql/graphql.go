@@ -0,0 +1,430 @@
+// Package graphql runs GraphQL queries against a schema of Go resolvers. It
+// covers what storefronts need to fetch nested data in one request: queries
+// with arguments, variables, aliases, fragments and the @skip and @include
+// directives. Mutations, subscriptions and introspection are not supported.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Schema is the root of the types a query can select from.
+type Schema struct {
+	Query *Object
+	// MaxDepth is how deep fields with object types can be nested in a
+	// query, and MaxCost how many fields a query can select, counting the
+	// fields of each item of lists. Queries over the limits are rejected
+	// before they run. Zero means no limit.
+	MaxDepth int
+	MaxCost  int
+}
+
+// Object is a type with fields that can be selected.
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Field is a field of an object type.
+type Field struct {
+	// Type is the object type of the value of the field, or of the items of a
+	// list. Fields without a type hold JSON values, which can't have fields
+	// selected.
+	Type *Object
+	// Resolve returns the value of the field. Without it, the value is the
+	// property of the source with the name of the field in its JSON.
+	Resolve ResolveFunc
+	// ListSize returns the most items a list field returns with the
+	// arguments of a query, for the cost of the query. Fields without it
+	// count as one item.
+	ListSize func(args map[string]interface{}) int
+}
+
+// ResolveFunc returns the value of a field.
+type ResolveFunc func(p ResolveParams) (interface{}, error)
+
+// ResolveParams are the parameters a field is resolved with.
+type ResolveParams struct {
+	Context context.Context
+	// Source is the value of the object the field is selected on.
+	Source interface{}
+	Args   map[string]interface{}
+}
+
+// Request is a query, as it's posted to a GraphQL endpoint.
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Error is an error of a request, with the path of the field it happened on.
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Response is the result of a request. When fields fail, they are null in
+// the data and their errors are listed.
+type Response struct {
+	Data   *Result  `json:"data"`
+	Errors []*Error `json:"errors,omitempty"`
+}
+
+// Result holds the selected fields of an object in the order of the query.
+type Result struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// Get returns the value of a field of the result.
+func (r *Result) Get(key string) interface{} {
+	return r.values[key]
+}
+
+func (r *Result) set(key string, value interface{}) {
+	if _, exists := r.values[key]; !exists {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = value
+}
+
+// MarshalJSON encodes the fields in the order of the query.
+func (r *Result) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type executor struct {
+	ctx       context.Context
+	schema    *Schema
+	fragments map[string]*fragment
+	variables map[string]interface{}
+	errors    []*Error
+}
+
+// Execute runs the query of a request.
+func Execute(ctx context.Context, schema *Schema, req *Request) *Response {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+
+	var op *operation
+	for _, o := range doc.operations {
+		if req.OperationName == "" || o.name == req.OperationName {
+			if op != nil {
+				return &Response{Errors: []*Error{{Message: "Must provide the name of the operation to run"}}}
+			}
+			op = o
+		}
+	}
+	if op == nil {
+		return &Response{Errors: []*Error{{Message: fmt.Sprintf("Unknown operation named %q", req.OperationName)}}}
+	}
+	if op.kind != "query" {
+		return &Response{Errors: []*Error{{Message: fmt.Sprintf("The %v operation is not supported", op.kind)}}}
+	}
+
+	e := &executor{ctx: ctx, schema: schema, fragments: doc.fragments, variables: map[string]interface{}{}}
+	for _, def := range op.variables {
+		value, ok := req.Variables[def.name]
+		if !ok || value == nil {
+			if def.defaultValue != nil {
+				value = e.resolveValue(def.defaultValue)
+			} else if def.required {
+				return &Response{Errors: []*Error{{Message: fmt.Sprintf("Variable $%v of required type %v was not provided", def.name, def.typeName)}}}
+			}
+		}
+		e.variables[def.name] = value
+	}
+
+	if schema.MaxDepth > 0 || schema.MaxCost > 0 {
+		cost, depth := e.measure(schema.Query, op.selections, 1)
+		// unknown fragments are reported when the query runs
+		e.errors = nil
+		if schema.MaxDepth > 0 && depth > schema.MaxDepth {
+			return &Response{Errors: []*Error{{Message: fmt.Sprintf("The query is nested deeper than the maximum of %d levels", schema.MaxDepth)}}}
+		}
+		if schema.MaxCost > 0 && cost > schema.MaxCost {
+			return &Response{Errors: []*Error{{Message: fmt.Sprintf("The query selects more than the maximum of %d fields", schema.MaxCost)}}}
+		}
+	}
+
+	data := e.executeSelections(schema.Query, nil, op.selections, nil)
+	return &Response{Data: data, Errors: e.errors}
+}
+
+func (e *executor) addError(path []interface{}, format string, args ...interface{}) {
+	e.errors = append(e.errors, &Error{Message: fmt.Sprintf(format, args...), Path: path})
+}
+
+// resolveValue replaces the variables in a value of the query with their
+// values.
+func (e *executor) resolveValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case variable:
+		return e.variables[string(v)]
+	case enumValue:
+		return string(v)
+	case listValue:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.resolveValue(item)
+		}
+		return list
+	case objectValue:
+		object := map[string]interface{}{}
+		for key, item := range v {
+			object[key] = e.resolveValue(item)
+		}
+		return object
+	}
+	return value
+}
+
+func (e *executor) resolveArguments(arguments map[string]interface{}) map[string]interface{} {
+	args := map[string]interface{}{}
+	for name, value := range arguments {
+		args[name] = e.resolveValue(value)
+	}
+	return args
+}
+
+// included evaluates the @skip and @include directives of a selection.
+func (e *executor) included(directives []*directive) bool {
+	for _, d := range directives {
+		condition, _ := e.resolveValue(d.arguments["if"]).(bool)
+		if (d.name == "skip" && condition) || (d.name == "include" && !condition) {
+			return false
+		}
+	}
+	return true
+}
+
+// collectFields returns the fields of a selection set on an object type by
+// their response key, in the order they first appear, with the fields of
+// fragments merged in.
+func (e *executor) collectFields(obj *Object, selections []selection, keys []string, fields map[string][]*field, visited map[string]bool) []string {
+	for _, s := range selections {
+		switch s := s.(type) {
+		case *field:
+			if !e.included(s.directives) {
+				continue
+			}
+			key := s.key()
+			if _, exists := fields[key]; !exists {
+				keys = append(keys, key)
+			}
+			fields[key] = append(fields[key], s)
+		case *inlineFragment:
+			if !e.included(s.directives) || (s.typeCondition != "" && s.typeCondition != obj.Name) {
+				continue
+			}
+			keys = e.collectFields(obj, s.selections, keys, fields, visited)
+		case *fragmentSpread:
+			if !e.included(s.directives) || visited[s.name] {
+				continue
+			}
+			visited[s.name] = true
+			f, ok := e.fragments[s.name]
+			if !ok {
+				e.addError(nil, "Unknown fragment %q", s.name)
+				continue
+			}
+			if f.typeCondition != obj.Name {
+				continue
+			}
+			keys = e.collectFields(obj, f.selections, keys, fields, visited)
+		}
+	}
+	return keys
+}
+
+// measure returns the cost and the depth of the selections on an object type
+// at a depth of the query. It stops once the limits of the schema are
+// exceeded, which also ends fragments that spread themselves.
+func (e *executor) measure(obj *Object, selections []selection, depth int) (int, int) {
+	if e.exceeds(0, depth) {
+		return 0, depth
+	}
+	fields := map[string][]*field{}
+	keys := e.collectFields(obj, selections, nil, fields, map[string]bool{})
+	cost, maxDepth := 0, depth
+	for _, key := range keys {
+		f := fields[key][0]
+		def, ok := obj.Fields[f.name]
+		if !ok {
+			continue
+		}
+		cost++
+		if def.Type == nil {
+			continue
+		}
+
+		var subSelections []selection
+		for _, f := range fields[key] {
+			subSelections = append(subSelections, f.selections...)
+		}
+		subCost, subDepth := e.measure(def.Type, subSelections, depth+1)
+		size := 1
+		if def.ListSize != nil {
+			size = def.ListSize(e.resolveArguments(f.arguments))
+		}
+		cost += size * subCost
+		if subDepth > maxDepth {
+			maxDepth = subDepth
+		}
+		if e.exceeds(cost, maxDepth) {
+			break
+		}
+	}
+	return cost, maxDepth
+}
+
+func (e *executor) exceeds(cost, depth int) bool {
+	return (e.schema.MaxCost > 0 && cost > e.schema.MaxCost) || (e.schema.MaxDepth > 0 && depth > e.schema.MaxDepth)
+}
+
+func (e *executor) executeSelections(obj *Object, source interface{}, selections []selection, path []interface{}) *Result {
+	fields := map[string][]*field{}
+	keys := e.collectFields(obj, selections, nil, fields, map[string]bool{})
+	result := &Result{values: map[string]interface{}{}}
+
+	var sourceJSON map[string]interface{}
+	for _, key := range keys {
+		f := fields[key][0]
+		fieldPath := append(append([]interface{}{}, path...), key)
+		if f.name == "__typename" {
+			result.set(key, obj.Name)
+			continue
+		}
+		def, ok := obj.Fields[f.name]
+		if !ok {
+			e.addError(fieldPath, "Cannot query field %q on type %q", f.name, obj.Name)
+			continue
+		}
+
+		var value interface{}
+		var err error
+		if def.Resolve != nil {
+			value, err = def.Resolve(ResolveParams{Context: e.ctx, Source: source, Args: e.resolveArguments(f.arguments)})
+		} else {
+			if sourceJSON == nil {
+				sourceJSON, err = toJSON(source)
+			}
+			value = sourceJSON[f.name]
+		}
+		if err != nil {
+			e.addError(fieldPath, "%v", err)
+			result.set(key, nil)
+			continue
+		}
+
+		var subSelections []selection
+		for _, f := range fields[key] {
+			subSelections = append(subSelections, f.selections...)
+		}
+		result.set(key, e.completeValue(def, f.name, value, subSelections, fieldPath))
+	}
+	return result
+}
+
+// completeValue selects the fields of the value of a field with an object
+// type, or of each item of a list of them.
+func (e *executor) completeValue(def *Field, name string, value interface{}, selections []selection, path []interface{}) interface{} {
+	if def.Type == nil {
+		if len(selections) > 0 {
+			e.addError(path, "Field %q can't have a selection of subfields", name)
+			return nil
+		}
+		return value
+	}
+	if len(selections) == 0 {
+		e.addError(path, "Field %q of type %q must have a selection of subfields", name, def.Type.Name)
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || ((v.Kind() == reflect.Ptr || v.Kind() == reflect.Slice || v.Kind() == reflect.Interface) && v.IsNil()) {
+		return nil
+	}
+	if v.Kind() == reflect.Slice {
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			itemPath := append(append([]interface{}{}, path...), i)
+			item := v.Index(i)
+			if item.Kind() == reflect.Ptr && item.IsNil() {
+				continue
+			}
+			list[i] = e.executeSelections(def.Type, item.Interface(), selections, itemPath)
+		}
+		return list
+	}
+	return e.executeSelections(def.Type, value, selections, path)
+}
+
+// toJSON returns the properties of a value as they are encoded in JSON.
+func toJSON(value interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	properties := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&properties); err != nil {
+		return nil, err
+	}
+	return properties, nil
+}
+
+// IntArg returns an integer argument, or def when it's not given.
+func IntArg(args map[string]interface{}, name string, def int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return int(n), nil
+		}
+	}
+	return 0, fmt.Errorf("Argument %q must be an integer", name)
+}
+
+// StringArg returns a string argument, or an empty string when it's not
+// given.
+func StringArg(args map[string]interface{}, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("Argument %q must be a string", name)
+}
@@ -0,0 +1,225 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testItem struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Price uint64 `json:"price"`
+}
+
+type testOrder struct {
+	ID    string      `json:"id"`
+	Email string      `json:"email"`
+	Items []*testItem `json:"-"`
+}
+
+func testSchema() *Schema {
+	item := &Object{Name: "Item", Fields: map[string]*Field{
+		"id":    {},
+		"title": {},
+		"price": {},
+	}}
+	order := &Object{Name: "Order", Fields: map[string]*Field{
+		"id":    {},
+		"email": {},
+		"items": {Type: item, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*testOrder).Items, nil
+		}},
+		"secret": {Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, errors.New("No access")
+		}},
+	}}
+	orders := map[string]*testOrder{
+		"1": {ID: "1", Email: "a@example.com", Items: []*testItem{{ID: 1, Title: "Book", Price: 999}, {ID: 2, Title: "Pen", Price: 100}}},
+		"2": {ID: "2", Email: "b@example.com"},
+	}
+	return &Schema{Query: &Object{Name: "Query", Fields: map[string]*Field{
+		"order": {Type: order, Resolve: func(p ResolveParams) (interface{}, error) {
+			id, err := StringArg(p.Args, "id")
+			if err != nil {
+				return nil, err
+			}
+			if o, ok := orders[id]; ok {
+				return o, nil
+			}
+			return nil, nil
+		}},
+		"orders": {Type: order, Resolve: func(p ResolveParams) (interface{}, error) {
+			limit, err := IntArg(p.Args, "limit", 10)
+			if err != nil {
+				return nil, err
+			}
+			list := []*testOrder{orders["1"], orders["2"]}
+			if limit < len(list) {
+				list = list[:limit]
+			}
+			return list, nil
+		}},
+	}}}
+}
+
+func execute(t *testing.T, req *Request) string {
+	rsp := Execute(context.Background(), testSchema(), req)
+	data, err := json.Marshal(rsp)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestExecute(t *testing.T) {
+	cases := []struct {
+		name     string
+		req      *Request
+		expected string
+	}{
+		{
+			"Fields in the order of the query",
+			&Request{Query: `{ order(id: "1") { email id items { title price } } }`},
+			`{"data":{"order":{"email":"a@example.com","id":"1","items":[{"title":"Book","price":999},{"title":"Pen","price":100}]}}}`,
+		},
+		{
+			"Aliases and typename",
+			&Request{Query: `query { first: order(id: "1") { __typename id } second: order(id: "2") { id } none: order(id: "3") { id } }`},
+			`{"data":{"first":{"__typename":"Order","id":"1"},"second":{"id":"2"},"none":null}}`,
+		},
+		{
+			"Variables",
+			&Request{Query: `query Orders($limit: Int = 2) { orders(limit: $limit) { id } }`, Variables: map[string]interface{}{"limit": float64(1)}},
+			`{"data":{"orders":[{"id":"1"}]}}`,
+		},
+		{
+			"Default values of variables",
+			&Request{Query: `query Orders($limit: Int = 2) { orders(limit: $limit) { id } }`},
+			`{"data":{"orders":[{"id":"1"},{"id":"2"}]}}`,
+		},
+		{
+			"Fragments",
+			&Request{Query: `
+				# comments and commas are ignored
+				query { order(id: "1") { ...OrderFields, ... on Order { items { id } } } }
+				fragment OrderFields on Order { id email }`},
+			`{"data":{"order":{"id":"1","email":"a@example.com","items":[{"id":1},{"id":2}]}}}`,
+		},
+		{
+			"Directives",
+			&Request{Query: `query($withEmail: Boolean!) { order(id: "1") { id email @include(if: $withEmail) items @skip(if: true) { id } } }`, Variables: map[string]interface{}{"withEmail": false}},
+			`{"data":{"order":{"id":"1"}}}`,
+		},
+		{
+			"Operation names",
+			&Request{Query: `query A { order(id: "1") { id } } query B { order(id: "2") { id } }`, OperationName: "B"},
+			`{"data":{"order":{"id":"2"}}}`,
+		},
+		{
+			"Errors of fields",
+			&Request{Query: `{ order(id: "1") { id secret unknown } }`},
+			`{"data":{"order":{"id":"1","secret":null}},"errors":[{"message":"No access","path":["order","secret"]},{"message":"Cannot query field \"unknown\" on type \"Order\"","path":["order","unknown"]}]}`,
+		},
+		{
+			"Missing selections",
+			&Request{Query: `{ order(id: "1") }`},
+			`{"data":{"order":null},"errors":[{"message":"Field \"order\" of type \"Order\" must have a selection of subfields","path":["order"]}]}`,
+		},
+		{
+			"Invalid arguments",
+			&Request{Query: `{ orders(limit: "many") { id } }`},
+			`{"data":{"orders":null},"errors":[{"message":"Argument \"limit\" must be an integer","path":["orders"]}]}`,
+		},
+		{
+			"Syntax errors",
+			&Request{Query: `{ order(id: "1") { id }`},
+			`{"data":null,"errors":[{"message":"Syntax error: unexpected end of query at position 23"}]}`,
+		},
+		{
+			"Several operations",
+			&Request{Query: `query A { orders { id } } query B { orders { id } }`},
+			`{"data":null,"errors":[{"message":"Must provide the name of the operation to run"}]}`,
+		},
+		{
+			"Mutations",
+			&Request{Query: `mutation { deleteOrder(id: "1") { id } }`},
+			`{"data":null,"errors":[{"message":"The mutation operation is not supported"}]}`,
+		},
+		{
+			"Required variables",
+			&Request{Query: `query($id: ID!) { order(id: $id) { id } }`},
+			`{"data":null,"errors":[{"message":"Variable $id of required type ID! was not provided"}]}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, execute(t, c.req))
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	schema := testSchema()
+	order := schema.Query.Fields["order"].Type
+	order.Fields["self"] = &Field{Type: order, Resolve: func(p ResolveParams) (interface{}, error) {
+		return p.Source, nil
+	}}
+	schema.Query.Fields["orders"].ListSize = func(args map[string]interface{}) int {
+		limit, _ := IntArg(args, "limit", 10)
+		return limit
+	}
+	schema.MaxDepth = 4
+	schema.MaxCost = 20
+
+	cases := []struct {
+		name     string
+		req      *Request
+		expected string
+	}{
+		{
+			"Within the limits",
+			&Request{Query: `{ orders(limit: 2) { id self { id items { id } } } }`},
+			`{"data":{"orders":[{"id":"1","self":{"id":"1","items":[{"id":1},{"id":2}]}},{"id":"2","self":{"id":"2","items":null}}]}}`,
+		},
+		{
+			"Too deep",
+			&Request{Query: `{ order(id: "1") { self { self { self { id } } } } }`},
+			`{"data":null,"errors":[{"message":"The query is nested deeper than the maximum of 4 levels"}]}`,
+		},
+		{
+			"Fragments spreading themselves",
+			&Request{Query: `{ order(id: "1") { ...Self } } fragment Self on Order { id self { ...Self } }`},
+			`{"data":null,"errors":[{"message":"The query is nested deeper than the maximum of 4 levels"}]}`,
+		},
+		{
+			"Too costly",
+			&Request{Query: `query($limit: Int) { orders(limit: $limit) { id email } }`, Variables: map[string]interface{}{"limit": float64(10)}},
+			`{"data":null,"errors":[{"message":"The query selects more than the maximum of 20 fields"}]}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := json.Marshal(Execute(context.Background(), schema, c.req))
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, string(data))
+		})
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	doc, err := parse(`{ f(a: -1.5e3, b: "tab\tand é", c: [1, true, null, RED], d: {x: $v}) }`)
+	require.NoError(t, err)
+	f := doc.operations[0].selections[0].(*field)
+	assert.Equal(t, -1500.0, f.arguments["a"])
+	assert.Equal(t, "tab\tand é", f.arguments["b"])
+	assert.Equal(t, listValue{int64(1), true, nil, enumValue("RED")}, f.arguments["c"])
+	assert.Equal(t, objectValue{"x": variable("v")}, f.arguments["d"])
+
+	for _, query := range []string{`{ f(a: $v) `, `{ f(a: "open) }`, `{ f(a: 1.) }`, `{ }`, `fragment on on X { a }`, `{ f(a: """block""") }`} {
+		_, err := parse(query)
+		assert.Error(t, err, query)
+	}
+}
@@ -0,0 +1,644 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	eofToken tokenKind = iota
+	punctuatorToken
+	nameToken
+	intToken
+	floatToken
+	stringToken
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == eofToken {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+// skipIgnored skips white space, commas and comments, which have no meaning
+// in GraphQL.
+func (l *lexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\ufeff"):
+			l.pos += len("\ufeff")
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipIgnored()
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: eofToken, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return token{kind: punctuatorToken, value: "...", pos: start}, nil
+	case strings.IndexByte("!$():=@[]{|}", c) >= 0:
+		l.pos++
+		return token{kind: punctuatorToken, value: string(c), pos: start}, nil
+	case isNameStart(c):
+		for l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return token{kind: nameToken, value: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || isDigit(c):
+		return l.number()
+	case c == '"':
+		return l.string()
+	}
+	return token{}, fmt.Errorf("Syntax error: unexpected character %q at position %d", c, start)
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	kind := intToken
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	digits := func() int {
+		from := l.pos
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		return l.pos - from
+	}
+	if digits() == 0 {
+		return token{}, fmt.Errorf("Syntax error: invalid number at position %d", start)
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = floatToken
+		l.pos++
+		if digits() == 0 {
+			return token{}, fmt.Errorf("Syntax error: invalid number at position %d", start)
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = floatToken
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if digits() == 0 {
+			return token{}, fmt.Errorf("Syntax error: invalid number at position %d", start)
+		}
+	}
+	return token{kind: kind, value: l.src[start:l.pos], pos: start}, nil
+}
+
+// string reads a string literal. Escapes in GraphQL strings are the same as
+// in JSON strings.
+func (l *lexer) string() (token, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		return token{}, fmt.Errorf("Syntax error: block strings are not supported, at position %d", start)
+	}
+	l.pos++
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos += 2
+			continue
+		case '\n', '\r':
+			return token{}, fmt.Errorf("Syntax error: unterminated string at position %d", start)
+		case '"':
+			l.pos++
+			var value string
+			if err := json.Unmarshal([]byte(l.src[start:l.pos]), &value); err != nil {
+				return token{}, fmt.Errorf("Syntax error: invalid string at position %d", start)
+			}
+			return token{kind: stringToken, value: value, pos: start}, nil
+		}
+		l.pos++
+	}
+	return token{}, fmt.Errorf("Syntax error: unterminated string at position %d", start)
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind       string
+	name       string
+	variables  []*variableDefinition
+	selections []selection
+}
+
+type variableDefinition struct {
+	name         string
+	typeName     string
+	required     bool
+	defaultValue interface{}
+}
+
+type fragment struct {
+	name          string
+	typeCondition string
+	selections    []selection
+}
+
+// A selection is a *field, a *fragmentSpread or an *inlineFragment.
+type selection interface{}
+
+type field struct {
+	alias      string
+	name       string
+	arguments  map[string]interface{}
+	directives []*directive
+	selections []selection
+}
+
+func (f *field) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type fragmentSpread struct {
+	name       string
+	directives []*directive
+}
+
+type inlineFragment struct {
+	typeCondition string
+	directives    []*directive
+	selections    []selection
+}
+
+type directive struct {
+	name      string
+	arguments map[string]interface{}
+}
+
+// Values in the query are Go values like JSON values, except for variables,
+// enums, lists and objects, which can contain variables.
+type (
+	variable    string
+	enumValue   string
+	listValue   []interface{}
+	objectValue map[string]interface{}
+)
+
+type parser struct {
+	lex *lexer
+	tok token
+}
+
+func parse(query string) (*document, error) {
+	p := &parser{lex: &lexer{src: query}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	doc := &document{fragments: map[string]*fragment{}}
+	for p.tok.kind != eofToken {
+		switch {
+		case p.isPunctuator("{"):
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{kind: "query", selections: selections})
+		case p.tok.kind == nameToken && (p.tok.value == "query" || p.tok.value == "mutation" || p.tok.value == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.tok.kind == nameToken && p.tok.value == "fragment":
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := doc.fragments[f.name]; exists {
+				return nil, fmt.Errorf("There can be only one fragment named %q", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("The query has no operation")
+	}
+	return doc, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	return fmt.Errorf("Syntax error: unexpected %v at position %d", p.tok, p.tok.pos)
+}
+
+func (p *parser) isPunctuator(value string) bool {
+	return p.tok.kind == punctuatorToken && p.tok.value == value
+}
+
+// skip advances past a punctuator, and returns whether it was there.
+func (p *parser) skip(value string) (bool, error) {
+	if !p.isPunctuator(value) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *parser) expect(value string) error {
+	if !p.isPunctuator(value) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != nameToken {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *parser) operation() (*operation, error) {
+	op := &operation{kind: p.tok.value}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == nameToken {
+		op.name = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := p.skip("("); err != nil {
+		return nil, err
+	} else if ok {
+		for !p.isPunctuator(")") {
+			def, err := p.variableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, def)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+func (p *parser) variableDefinition() (*variableDefinition, error) {
+	if err := p.expect("$"); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	typeName, err := p.typeReference()
+	if err != nil {
+		return nil, err
+	}
+	def := &variableDefinition{name: name, typeName: typeName, required: strings.HasSuffix(typeName, "!")}
+	if ok, err := p.skip("="); err != nil {
+		return nil, err
+	} else if ok {
+		if def.defaultValue, err = p.value(true); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func (p *parser) typeReference() (string, error) {
+	var typeName string
+	if ok, err := p.skip("["); err != nil {
+		return "", err
+	} else if ok {
+		inner, err := p.typeReference()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		typeName = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typeName = name
+	}
+	if ok, err := p.skip("!"); err != nil {
+		return "", err
+	} else if ok {
+		typeName += "!"
+	}
+	return typeName, nil
+}
+
+func (p *parser) fragment() (*fragment, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if name == "on" {
+		return nil, fmt.Errorf("Syntax error: a fragment can't be named \"on\"")
+	}
+	if p.tok.kind != nameToken || p.tok.value != "on" {
+		return nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	typeCondition, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	return &fragment{name: name, typeCondition: typeCondition, selections: selections}, nil
+}
+
+func (p *parser) selectionSet() ([]selection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	selections := []selection{}
+	for !p.isPunctuator("}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("Syntax error: empty selection at position %d", p.tok.pos)
+	}
+	return selections, p.advance()
+}
+
+func (p *parser) selection() (selection, error) {
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if ok {
+		return p.fragmentSelection()
+	}
+
+	f := &field{}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		f.alias = name
+		if name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	f.name = name
+	if f.arguments, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if f.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.isPunctuator("{") {
+		if f.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (p *parser) fragmentSelection() (selection, error) {
+	if p.tok.kind == nameToken && p.tok.value != "on" {
+		spread := &fragmentSpread{name: p.tok.value}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		var err error
+		if spread.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		return spread, nil
+	}
+
+	inline := &inlineFragment{}
+	if p.tok.kind == nameToken {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		typeCondition, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		inline.typeCondition = typeCondition
+	}
+	var err error
+	if inline.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if inline.selections, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return inline, nil
+}
+
+func (p *parser) arguments() (map[string]interface{}, error) {
+	arguments := map[string]interface{}{}
+	if ok, err := p.skip("("); err != nil || !ok {
+		return arguments, err
+	}
+	for !p.isPunctuator(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if arguments[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return arguments, p.advance()
+}
+
+func (p *parser) directives() ([]*directive, error) {
+	var directives []*directive
+	for p.isPunctuator("@") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		arguments, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, &directive{name: name, arguments: arguments})
+	}
+	return directives, nil
+}
+
+// value reads a value. Constant values, like the defaults of variables, can't
+// contain variables.
+func (p *parser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	var value interface{}
+	switch tok.kind {
+	case intToken:
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Syntax error: invalid number at position %d", tok.pos)
+		}
+		value = n
+	case floatToken:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Syntax error: invalid number at position %d", tok.pos)
+		}
+		value = f
+	case stringToken:
+		value = tok.value
+	case nameToken:
+		switch tok.value {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = nil
+		default:
+			value = enumValue(tok.value)
+		}
+	case punctuatorToken:
+		switch tok.value {
+		case "$":
+			if constant {
+				return nil, p.unexpected()
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			return variable(name), nil
+		case "[":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			list := listValue{}
+			for !p.isPunctuator("]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, p.advance()
+		case "{":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			object := objectValue{}
+			for !p.isPunctuator("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if object[name], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			return object, p.advance()
+		default:
+			return nil, p.unexpected()
+		}
+	default:
+		return nil, p.unexpected()
+	}
+	return value, p.advance()
+}
@@ -0,0 +1,110 @@
+package invoice
+
+import (
+	"bytes"
+	"html/template"
+)
+
+// DefaultTemplate is the HTML template of invoices when the site has none.
+// Templates get the Invoice, and can format amounts with its Amount method
+// and contact details with SupportContact.
+const DefaultTemplate = `<!doctype html>
+<html lang="{{ with .Locale }}{{ . }}{{ else }}en{{ end }}">
+<head>
+<meta charset="utf-8">
+<title>{{ .Labels.invoice }} {{ .Number }}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 14px; margin: 40px; }
+table { border-collapse: collapse; width: 100%; margin: 20px 0; }
+th, td { padding: 6px; border-bottom: 1px solid #ddd; text-align: left; }
+.amount { text-align: right; }
+.logo { max-height: 60px; max-width: 240px; }
+.legal { color: #666; font-size: 11px; }
+{{ with .Branding.PrimaryColor }}h1, h3 { color: {{ . }}; }{{ end }}
+{{ with .Branding.AccentColor }}th { border-bottom: 2px solid {{ . }}; }{{ end }}
+</style>
+</head>
+<body>
+{{ with .Branding.LogoURL }}<img class="logo" src="{{ . }}" alt="{{ $.Seller.Seller }}">{{ end }}
+<h1>{{ .Labels.invoice }}</h1>
+<p>{{ .Labels.number }}: <strong>{{ .Number }}</strong><br>{{ .Labels.date }}: {{ .FormattedDate }}</p>
+
+<table>
+<tr>
+<td>
+<strong>{{ .Labels.seller }}</strong><br>
+{{ with .Seller.Seller }}{{ . }}<br>{{ end }}
+{{ range .Seller.Address }}{{ . }}<br>{{ end }}
+{{ with .Seller.Email }}{{ . }}<br>{{ end }}
+{{ with .Seller.VATNumber }}{{ $.Labels.vat_number }}: {{ . }}{{ end }}
+</td>
+<td>
+<strong>{{ .Labels.bill_to }}</strong><br>
+{{ with .Buyer.Company }}{{ . }}<br>{{ end }}
+{{ with .Buyer.Name }}{{ . }}<br>{{ end }}
+{{ range .Buyer.Address }}{{ . }}<br>{{ end }}
+{{ with .Buyer.Email }}{{ . }}<br>{{ end }}
+{{ with .Buyer.VATNumber }}{{ $.Labels.vat_number }}: {{ . }}{{ end }}
+</td>
+</tr>
+</table>
+
+<table>
+<tr>
+<th>{{ .Labels.item }}</th>
+<th class="amount">{{ .Labels.quantity }}</th>
+<th class="amount">{{ .Labels.unit_price }}</th>
+<th class="amount">{{ .Labels.tax_rate }}</th>
+<th class="amount">{{ .Labels.net }}</th>
+<th class="amount">{{ .Labels.tax }}</th>
+<th class="amount">{{ .Labels.total }}</th>
+</tr>
+{{ range .Lines }}<tr>
+<td>{{ .Title }}{{ with .Sku }} <small>({{ . }})</small>{{ end }}</td>
+<td class="amount">{{ .Quantity }}</td>
+<td class="amount">{{ $.Amount .UnitPrice }}</td>
+<td class="amount">{{ $.Percentage .Rate }}</td>
+<td class="amount">{{ $.Amount .Net }}</td>
+<td class="amount">{{ $.Amount .Tax }}</td>
+<td class="amount">{{ $.Amount .Total }}</td>
+</tr>
+{{ end }}</table>
+
+<table>
+<tr><td>{{ .Labels.subtotal }}</td><td class="amount">{{ .Amount .Subtotal }}</td></tr>
+{{ if .Discount }}<tr><td>{{ .Labels.discount }}</td><td class="amount">-{{ .Amount .Discount }}</td></tr>{{ end }}
+{{ if .Shipping }}<tr><td>{{ .Labels.shipping }}</td><td class="amount">{{ .Amount .Shipping }}</td></tr>{{ end }}
+<tr><td>{{ .Labels.taxes }}</td><td class="amount">{{ .Amount .Tax }}</td></tr>
+<tr><td><strong>{{ .Labels.total }}</strong></td><td class="amount"><strong>{{ .Amount .Total }}</strong></td></tr>
+</table>
+
+<h3>{{ .Labels.tax_breakdown }}</h3>
+<table>
+{{ range .Taxes }}<tr><td>{{ $.Percentage .Rate }}</td><td class="amount">{{ $.Amount .Net }}</td><td class="amount">{{ $.Amount .Tax }}</td></tr>
+{{ end }}</table>
+
+{{ if .ReverseCharge }}<p>{{ .Labels.reverse_charge }}</p>{{ end }}
+{{ if .TaxExempt }}<p>{{ .TaxExemptNote }}</p>{{ end }}
+{{ with .Seller.Footer }}<p>{{ . }}</p>{{ end }}
+{{ with .SupportContact }}<p>{{ $.Labels.support }} {{ . }}</p>{{ end }}
+{{ with .Branding.LegalText }}<p class="legal">{{ . }}</p>{{ end }}
+</body>
+</html>
+`
+
+// HTML renders an invoice with an HTML template, or the default template
+// when it's empty.
+func HTML(inv *Invoice, tmpl string) ([]byte, error) {
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+	t, err := template.New("invoice").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, inv); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
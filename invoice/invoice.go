@@ -0,0 +1,336 @@
+// Package invoice renders the invoices of paid orders as HTML and PDF. An
+// invoice lists the seller and buyer with their VAT numbers, the sequential
+// invoice number of the order, and the taxes of every line and tax rate.
+package invoice
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
+
+// ErrNoInvoiceNumber is returned for orders that haven't been paid yet, and
+// have no invoice number.
+var ErrNoInvoiceNumber = errors.New("The order has no invoice number yet")
+
+// Invoice is an order as it's printed on an invoice. Amounts are in the
+// lowest unit of the currency.
+type Invoice struct {
+	Number string
+	Date   time.Time
+	Locale string
+	Labels map[string]string
+
+	Seller *calculator.InvoiceSettings
+	Buyer  Party
+	// Branding is the logo, colors, support contact and legal text of the
+	// shop. It's never nil.
+	Branding *calculator.Branding
+
+	// ReverseCharge is set for orders without taxes, where the buyer owes
+	// the VAT in their own country.
+	ReverseCharge bool
+	// TaxExempt is set for orders without taxes, because the buyer is
+	// exempt from them for TaxExemptReason.
+	TaxExempt       bool
+	TaxExemptReason string
+
+	Currency string
+	Lines    []*Line
+	Taxes    []*TaxRate
+
+	Subtotal    uint64
+	Discount    uint64
+	Shipping    uint64
+	ShippingTax uint64
+	Tax         uint64
+	Total       uint64
+
+	Order *models.Order
+}
+
+// Party is the buyer of an order.
+type Party struct {
+	Name      string
+	Company   string
+	Address   []string
+	Email     string
+	VATNumber string
+}
+
+// Line is a line item of an invoice. Net and Tax are the amounts of all the
+// items of the line, and Rate the percentage of the taxes on them.
+type Line struct {
+	Title     string
+	Sku       string
+	Quantity  uint64
+	UnitPrice uint64
+	Rate      uint64
+	Net       uint64
+	Tax       uint64
+	Total     uint64
+}
+
+// TaxRate is the net amount and taxes of all lines, and shipping, with the
+// same tax percentage.
+type TaxRate struct {
+	Rate uint64
+	Net  uint64
+	Tax  uint64
+}
+
+// New returns the invoice of an order. The taxes of the order are split over
+// its lines by the skus they were charged for. With prices that include
+// taxes, the taxes are taken out of the prices of the lines.
+func New(order *models.Order, settings *calculator.Settings) (*Invoice, error) {
+	if order.InvoiceNumber == 0 {
+		return nil, ErrNoInvoiceNumber
+	}
+	seller := &calculator.InvoiceSettings{}
+	branding := &calculator.Branding{}
+	includeTaxes := false
+	if settings != nil {
+		includeTaxes = settings.PricesIncludeTaxes
+		if settings.Invoice != nil {
+			seller = settings.Invoice
+		}
+		if settings.Branding != nil {
+			branding = settings.Branding
+		}
+	}
+
+	inv := &Invoice{
+		Number:          seller.NumberPrefix + strconv.FormatInt(order.InvoiceNumber, 10),
+		Date:            order.CreatedAt,
+		Locale:          order.Locale,
+		Labels:          labelsFor(order.Locale),
+		Seller:          seller,
+		Buyer:           buyer(order),
+		Branding:        branding,
+		ReverseCharge:   order.ReverseCharge,
+		TaxExempt:       order.TaxExempt,
+		TaxExemptReason: order.TaxExemptReason,
+		Currency:        order.Currency,
+		Subtotal:        order.SubTotal,
+		Discount:        order.Discount,
+		Shipping:        order.Shipping,
+		Tax:             order.Taxes,
+		Total:           order.Total,
+		Order:           order,
+	}
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.PaidState {
+			inv.Date = t.CreatedAt
+			break
+		}
+	}
+
+	amounts := make([]uint64, len(order.LineItems))
+	for i, item := range order.LineItems {
+		amounts[i] = item.PriceInLowestUnit() * item.Quantity
+		inv.Lines = append(inv.Lines, &Line{
+			Title:     item.Title,
+			Sku:       item.Sku,
+			Quantity:  item.Quantity,
+			UnitPrice: item.PriceInLowestUnit(),
+		})
+	}
+
+	shippingTaxes := []*calculator.Adjustment{}
+	foundTaxes := false
+	for _, adjustment := range order.Adjustments {
+		if adjustment.Type == calculator.ShippingTaxAdjustment {
+			inv.ShippingTax += adjustment.Amount
+			shippingTaxes = append(shippingTaxes, adjustment)
+			continue
+		}
+		if adjustment.Type != calculator.TaxAdjustment {
+			continue
+		}
+		foundTaxes = true
+		if len(adjustment.Skus) == 0 {
+			// orders from before shipping taxes had their own type taxed
+			// all of the shipping at one rate
+			inv.ShippingTax += adjustment.Amount
+			shippingTaxes = append(shippingTaxes, &calculator.Adjustment{
+				Percentage: adjustment.Percentage,
+				Amount:     adjustment.Amount,
+				Base:       order.Shipping,
+			})
+			continue
+		}
+		weights := make([]uint64, len(amounts))
+		for i, item := range order.LineItems {
+			if containsString(adjustment.Skus, item.Sku) {
+				weights[i] = amounts[i]
+				inv.Lines[i].Rate += adjustment.Percentage
+			}
+		}
+		for i, share := range split(adjustment.Amount, weights) {
+			inv.Lines[i].Tax += share
+		}
+	}
+	if !foundTaxes && order.Taxes > 0 {
+		// orders from before adjustments were stored only have the VAT of
+		// their line items
+		weights := make([]uint64, len(amounts))
+		for i, item := range order.LineItems {
+			weights[i] = amounts[i] * item.VAT
+			inv.Lines[i].Rate = item.VAT
+		}
+		for i, share := range split(order.Taxes, weights) {
+			inv.Lines[i].Tax = share
+		}
+	}
+
+	rates := map[uint64]*TaxRate{}
+	addRate := func(rate, net, tax uint64) {
+		r, ok := rates[rate]
+		if !ok {
+			r = &TaxRate{Rate: rate}
+			rates[rate] = r
+			inv.Taxes = append(inv.Taxes, r)
+		}
+		r.Net += net
+		r.Tax += tax
+	}
+	for i, line := range inv.Lines {
+		line.Net = amounts[i]
+		if includeTaxes && line.Tax <= line.Net {
+			line.Net -= line.Tax
+		}
+		line.Total = line.Net + line.Tax
+		addRate(line.Rate, line.Net, line.Tax)
+	}
+	if inv.Shipping > 0 {
+		rest := inv.Shipping
+		for _, adjustment := range shippingTaxes {
+			base := adjustment.Base
+			if base > rest {
+				base = rest
+			}
+			rest -= base
+			addRate(adjustment.Percentage, base, adjustment.Amount)
+		}
+		if rest > 0 {
+			addRate(0, rest, 0)
+		}
+	}
+	return inv, nil
+}
+
+func buyer(order *models.Order) Party {
+	address := order.BillingAddress
+	if address.Address1 == "" {
+		address = order.ShippingAddress
+	}
+	name := address.Name
+	if name == "" {
+		name = strings.TrimSpace(address.FirstName + " " + address.LastName)
+	}
+	lines := []string{}
+	for _, line := range []string{
+		address.Address1,
+		address.Address2,
+		strings.TrimSpace(address.Zip + " " + address.City),
+		address.State,
+		address.Country,
+	} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return Party{
+		Name:      name,
+		Company:   address.Company,
+		Address:   lines,
+		Email:     order.Email,
+		VATNumber: order.VATNumber,
+	}
+}
+
+// split divides an amount by weights. The share of each weight is rounded on
+// the running total, so the shares add up to the amount.
+func split(amount uint64, weights []uint64) []uint64 {
+	shares := make([]uint64, len(weights))
+	var total uint64
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		return shares
+	}
+	var cumulative, allocated uint64
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		cumulative += w
+		share := uint64(float64(amount)*float64(cumulative)/float64(total)+0.5) - allocated
+		allocated += share
+		shares[i] = share
+	}
+	return shares
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Amount formats an amount in the currency of the invoice, with the decimal
+// separator of its locale.
+func (inv *Invoice) Amount(amount uint64) string {
+	value := calculator.FormatAmount(amount, inv.Currency)
+	if decimalComma(inv.Locale) {
+		return strings.Replace(value, ".", ",", 1) + " " + inv.Currency
+	}
+	return inv.Currency + " " + value
+}
+
+// Percentage formats a tax rate.
+func (inv *Invoice) Percentage(rate uint64) string {
+	if decimalComma(inv.Locale) {
+		return strconv.FormatUint(rate, 10) + " %"
+	}
+	return strconv.FormatUint(rate, 10) + "%"
+}
+
+// TaxExemptNote tells that the buyer is exempt from taxes, and why.
+func (inv *Invoice) TaxExemptNote() string {
+	if inv.TaxExemptReason == "" {
+		return inv.Labels["tax_exempt"]
+	}
+	return inv.Labels["tax_exempt"] + ": " + inv.TaxExemptReason
+}
+
+// FormattedDate returns the date of the invoice in the format of its locale.
+func (inv *Invoice) FormattedDate() string {
+	switch language(inv.Locale) {
+	case "de":
+		return inv.Date.Format("02.01.2006")
+	case "fr", "es", "it", "nl":
+		return inv.Date.Format("02/01/2006")
+	}
+	return inv.Date.Format("January 2, 2006")
+}
+
+// SupportContact returns the support email, phone and URL of the shop on
+// one line, or an empty string when it has none.
+func (inv *Invoice) SupportContact() string {
+	contact := []string{}
+	for _, c := range []string{inv.Branding.SupportEmail, inv.Branding.SupportPhone, inv.Branding.SupportURL} {
+		if c != "" {
+			contact = append(contact, c)
+		}
+	}
+	return strings.Join(contact, " · ")
+}
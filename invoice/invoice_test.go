@@ -0,0 +1,215 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testOrder() *models.Order {
+	order := models.NewOrder("", "session", "buyer@example.com", "EUR")
+	order.InvoiceNumber = 1042
+	order.CreatedAt = time.Date(2018, 3, 4, 10, 0, 0, 0, time.UTC)
+	order.LineItems = []*models.LineItem{
+		{Title: "Book", Sku: "book", Price: 1000, Quantity: 2},
+		{Title: "E-Book", Sku: "ebook", Price: 500, Quantity: 1},
+		{Title: "Poster", Sku: "poster", Price: 1500, Quantity: 1},
+	}
+	order.BillingAddress = models.Address{AddressRequest: models.AddressRequest{
+		Name: "Bruce Wayne", Company: "Wayne Enterprises", Address1: "1007 Mountain Drive", City: "Gotham", Zip: "10001", Country: "USA",
+	}}
+	order.SubTotal = 4000
+	order.Shipping = 490
+	order.Taxes = 140 + 95 + 285 + 93
+	order.Total = order.SubTotal + order.Shipping + order.Taxes
+	order.Adjustments = []*calculator.Adjustment{
+		{Type: calculator.TaxAdjustment, Name: "reduced", Percentage: 7, Amount: 140, Skus: []string{"book"}},
+		{Type: calculator.TaxAdjustment, Name: "standard", Percentage: 19, Amount: 380, Skus: []string{"ebook", "poster"}},
+		{Type: calculator.TaxAdjustment, Name: "standard", Percentage: 19, Amount: 93},
+		{Type: calculator.ShippingAdjustment, Name: "standard", Amount: 490},
+	}
+	return order
+}
+
+func TestNew(t *testing.T) {
+	settings := &calculator.Settings{Invoice: &calculator.InvoiceSettings{Seller: "Shop", NumberPrefix: "INV-"}}
+	inv, err := New(testOrder(), settings)
+	require.NoError(t, err)
+
+	assert.Equal(t, "INV-1042", inv.Number)
+	assert.Equal(t, "Bruce Wayne", inv.Buyer.Name)
+	assert.Equal(t, []string{"1007 Mountain Drive", "10001 Gotham", "USA"}, inv.Buyer.Address)
+	require.Len(t, inv.Lines, 3)
+	assert.Equal(t, &Line{Title: "Book", Sku: "book", Quantity: 2, UnitPrice: 1000, Rate: 7, Net: 2000, Tax: 140, Total: 2140}, inv.Lines[0])
+	assert.Equal(t, &Line{Title: "E-Book", Sku: "ebook", Quantity: 1, UnitPrice: 500, Rate: 19, Net: 500, Tax: 95, Total: 595}, inv.Lines[1])
+	assert.Equal(t, &Line{Title: "Poster", Sku: "poster", Quantity: 1, UnitPrice: 1500, Rate: 19, Net: 1500, Tax: 285, Total: 1785}, inv.Lines[2])
+	assert.EqualValues(t, 93, inv.ShippingTax)
+	assert.Equal(t, []*TaxRate{{Rate: 7, Net: 2000, Tax: 140}, {Rate: 19, Net: 2490, Tax: 473}}, inv.Taxes)
+}
+
+func TestNewBlendedShippingTaxes(t *testing.T) {
+	order := testOrder()
+	order.Taxes = 140 + 95 + 285 + 16 + 44
+	order.Adjustments = []*calculator.Adjustment{
+		{Type: calculator.TaxAdjustment, Name: "reduced", Percentage: 7, Amount: 140, Skus: []string{"book"}},
+		{Type: calculator.TaxAdjustment, Name: "standard", Percentage: 19, Amount: 380, Skus: []string{"ebook", "poster"}},
+		{Type: calculator.ShippingTaxAdjustment, Name: "reduced", Percentage: 7, Amount: 16, Base: 230},
+		{Type: calculator.ShippingTaxAdjustment, Name: "standard", Percentage: 19, Amount: 44, Base: 230},
+		{Type: calculator.ShippingAdjustment, Name: "standard", Amount: 490},
+	}
+	inv, err := New(order, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 60, inv.ShippingTax)
+	assert.Equal(t, []*TaxRate{{Rate: 7, Net: 2230, Tax: 156}, {Rate: 19, Net: 2230, Tax: 424}, {Rate: 0, Net: 30}}, inv.Taxes)
+}
+
+func TestNewPricesIncludeTaxes(t *testing.T) {
+	order := testOrder()
+	inv, err := New(order, &calculator.Settings{PricesIncludeTaxes: true})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1860, inv.Lines[0].Net)
+	assert.EqualValues(t, 2000, inv.Lines[0].Total)
+	assert.Equal(t, "1042", inv.Number)
+}
+
+func TestNewWithoutAdjustments(t *testing.T) {
+	order := testOrder()
+	order.Adjustments = nil
+	order.Shipping = 0
+	order.Taxes = 100
+	order.LineItems[0].VAT = 10
+	inv, err := New(order, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, inv.Lines[0].Tax)
+	assert.EqualValues(t, 10, inv.Lines[0].Rate)
+	assert.EqualValues(t, 0, inv.Lines[1].Tax)
+}
+
+func TestNewUnpaid(t *testing.T) {
+	order := testOrder()
+	order.InvoiceNumber = 0
+	_, err := New(order, nil)
+	assert.Equal(t, ErrNoInvoiceNumber, err)
+}
+
+func TestLocalization(t *testing.T) {
+	order := testOrder()
+	order.Locale = "de-AT"
+	inv, err := New(order, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Rechnung", inv.Labels["invoice"])
+	assert.Equal(t, "1234,05 EUR", inv.Amount(123405))
+	assert.Equal(t, "19 %", inv.Percentage(19))
+	assert.Equal(t, "04.03.2018", inv.FormattedDate())
+
+	inv.Locale = "pt-BR"
+	inv.Labels = labelsFor(inv.Locale)
+	assert.Equal(t, "Invoice", inv.Labels["invoice"])
+
+	inv.Locale = "en-US"
+	assert.Equal(t, "EUR 0.05", inv.Amount(5))
+	assert.Equal(t, "March 4, 2018", inv.FormattedDate())
+
+	inv.Currency = "JPY"
+	assert.Equal(t, "JPY 1200", inv.Amount(1200))
+	inv.Currency = "KWD"
+	assert.Equal(t, "KWD 1.255", inv.Amount(1255))
+}
+
+func TestHTML(t *testing.T) {
+	order := testOrder()
+	order.LineItems[0].Title = "<script>alert(1)</script>"
+	inv, err := New(order, nil)
+	require.NoError(t, err)
+	html, err := HTML(inv, "")
+	require.NoError(t, err)
+	assert.Contains(t, string(html), "&lt;script&gt;")
+	assert.Contains(t, string(html), "EUR 51.03")
+
+	_, err = HTML(inv, "{{ .Unknown }")
+	assert.Error(t, err)
+}
+
+func TestHTMLTaxExempt(t *testing.T) {
+	order := testOrder()
+	order.TaxExempt = true
+	order.TaxExemptReason = "Reseller certificate 42"
+	inv, err := New(order, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Exempt from taxes: Reseller certificate 42", inv.TaxExemptNote())
+	html, err := HTML(inv, "")
+	require.NoError(t, err)
+	assert.Contains(t, string(html), "Exempt from taxes: Reseller certificate 42")
+}
+
+func TestPDF(t *testing.T) {
+	order := testOrder()
+	order.LineItems[0].Title = "Grüße (Band 1) – Sonderausgabe"
+	for i := 0; i < 80; i++ {
+		order.LineItems = append(order.LineItems, &models.LineItem{Title: fmt.Sprintf("Item %d", i), Quantity: 1, Price: 100})
+	}
+	inv, err := New(order, &calculator.Settings{Invoice: &calculator.InvoiceSettings{Footer: "Thank you!"}})
+	require.NoError(t, err)
+	data := PDF(inv)
+
+	require.True(t, bytes.HasPrefix(data, []byte("%PDF-1.4\n")))
+	assert.Contains(t, string(data), "(Gr\xfc\xdfe \\(Band 1\\) \x96 Sonderausgabe \\(book\\))")
+	count := regexp.MustCompile(`/Count (\d+) `).FindSubmatch(data)
+	require.NotNil(t, count)
+	pages, err := strconv.Atoi(string(count[1]))
+	require.NoError(t, err)
+	assert.True(t, pages > 1, "expected several pages, got %d", pages)
+
+	// the cross-reference table points at the objects
+	match := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(data)
+	require.NotNil(t, match)
+	xref, err := strconv.Atoi(string(match[1]))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data[xref:], []byte("xref\n")))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(data[xref:], -1)
+	require.Len(t, entries, 4+2*pages)
+	for i, entry := range entries {
+		offset, err := strconv.Atoi(string(entry[1]))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(data[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))), "object %d", i+1)
+	}
+}
+
+func TestBranding(t *testing.T) {
+	settings := &calculator.Settings{Branding: &calculator.Branding{
+		LogoURL:      "https://example.com/logo.png",
+		PrimaryColor: "#ff0000",
+		SupportEmail: "help@example.com",
+		SupportPhone: "+1 555 0100",
+		LegalText:    "Example Inc., registered in Springfield",
+	}}
+	inv, err := New(testOrder(), settings)
+	require.NoError(t, err)
+	assert.Equal(t, "help@example.com · +1 555 0100", inv.SupportContact())
+
+	html, err := HTML(inv, "")
+	require.NoError(t, err)
+	assert.Contains(t, string(html), `<img class="logo" src="https://example.com/logo.png"`)
+	assert.Contains(t, string(html), "h1, h3 { color: #ff0000; }")
+	assert.Contains(t, string(html), "Questions about your order? help@example.com · &#43;1 555 0100")
+	assert.Contains(t, string(html), "Example Inc., registered in Springfield")
+
+	data := string(PDF(inv))
+	assert.Contains(t, data, "1.000 0.000 0.000 rg\n")
+	assert.Contains(t, data, "(Example Inc., registered in Springfield)")
+
+	inv, err = New(testOrder(), nil)
+	require.NoError(t, err)
+	html, err = HTML(inv, "")
+	require.NoError(t, err)
+	assert.NotContains(t, string(html), "logo.png")
+	assert.NotContains(t, string(PDF(inv)), " rg\n")
+}
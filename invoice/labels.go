@@ -0,0 +1,103 @@
+package invoice
+
+import "strings"
+
+// labels are the texts printed on invoices by language. Languages without
+// labels get the English ones.
+var labels = map[string]map[string]string{
+	"en": {
+		"invoice":        "Invoice",
+		"number":         "Invoice number",
+		"date":           "Date",
+		"seller":         "Seller",
+		"bill_to":        "Bill to",
+		"vat_number":     "VAT number",
+		"item":           "Item",
+		"quantity":       "Qty",
+		"unit_price":     "Unit price",
+		"tax_rate":       "Tax",
+		"net":            "Net",
+		"tax":            "Tax amount",
+		"total":          "Total",
+		"subtotal":       "Subtotal",
+		"discount":       "Discount",
+		"shipping":       "Shipping",
+		"taxes":          "Taxes",
+		"tax_breakdown":  "Taxes by rate",
+		"reverse_charge": "Reverse charge: the recipient is liable for the VAT.",
+		"tax_exempt":     "Exempt from taxes",
+		"support":        "Questions about your order?",
+	},
+	"de": {
+		"invoice":        "Rechnung",
+		"number":         "Rechnungsnummer",
+		"date":           "Datum",
+		"seller":         "Verkäufer",
+		"bill_to":        "Rechnung an",
+		"vat_number":     "USt-IdNr.",
+		"item":           "Artikel",
+		"quantity":       "Menge",
+		"unit_price":     "Einzelpreis",
+		"tax_rate":       "USt.",
+		"net":            "Netto",
+		"tax":            "Steuer",
+		"total":          "Gesamt",
+		"subtotal":       "Zwischensumme",
+		"discount":       "Rabatt",
+		"shipping":       "Versand",
+		"taxes":          "Steuern",
+		"tax_breakdown":  "Steuern nach Satz",
+		"reverse_charge": "Steuerschuldnerschaft des Leistungsempfängers (Reverse Charge).",
+		"tax_exempt":     "Steuerbefreit",
+		"support":        "Fragen zu Ihrer Bestellung?",
+	},
+	"fr": {
+		"invoice":        "Facture",
+		"number":         "Numéro de facture",
+		"date":           "Date",
+		"seller":         "Vendeur",
+		"bill_to":        "Facturé à",
+		"vat_number":     "Numéro de TVA",
+		"item":           "Article",
+		"quantity":       "Qté",
+		"unit_price":     "Prix unitaire",
+		"tax_rate":       "TVA",
+		"net":            "HT",
+		"tax":            "Montant TVA",
+		"total":          "TTC",
+		"subtotal":       "Sous-total",
+		"discount":       "Remise",
+		"shipping":       "Livraison",
+		"taxes":          "Taxes",
+		"tax_breakdown":  "TVA par taux",
+		"reverse_charge": "Autoliquidation : TVA due par le preneur.",
+		"tax_exempt":     "Exonéré de taxes",
+		"support":        "Des questions sur votre commande ?",
+	},
+}
+
+// language returns the language of a locale like de-AT.
+func language(locale string) string {
+	locale = strings.ToLower(locale)
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	return locale
+}
+
+func labelsFor(locale string) map[string]string {
+	if l, ok := labels[language(locale)]; ok {
+		return l
+	}
+	return labels["en"]
+}
+
+// decimalComma tells whether amounts are written with a decimal comma in a
+// locale.
+func decimalComma(locale string) bool {
+	switch language(locale) {
+	case "de", "fr", "es", "it", "nl", "pt", "da", "sv", "nb", "fi", "pl":
+		return true
+	}
+	return false
+}
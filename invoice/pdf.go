@@ -0,0 +1,347 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/netlify/gocommerce/calculator"
+)
+
+const (
+	pageWidth  = 595.0
+	pageHeight = 842.0
+	margin     = 50.0
+	right      = pageWidth - margin
+)
+
+// PDF renders an invoice as a PDF document on A4 pages. The logo of the
+// branding is left out, since the document only has text and lines.
+func PDF(inv *Invoice) []byte {
+	d := &document{}
+	d.newPage()
+	l := inv.Labels
+	primary, accent := inv.Branding.PrimaryColor, inv.Branding.AccentColor
+
+	d.coloredText(margin, d.y, 20, true, primary, l["invoice"])
+	d.textRight(right, d.y, 10, false, l["number"]+": "+inv.Number)
+	d.advance(14)
+	d.textRight(right, d.y, 10, false, l["date"]+": "+inv.FormattedDate())
+	d.advance(30)
+
+	seller := []string{inv.Seller.Seller}
+	seller = append(seller, inv.Seller.Address...)
+	seller = append(seller, inv.Seller.Email)
+	if inv.Seller.VATNumber != "" {
+		seller = append(seller, l["vat_number"]+": "+inv.Seller.VATNumber)
+	}
+	buyer := []string{inv.Buyer.Company, inv.Buyer.Name}
+	buyer = append(buyer, inv.Buyer.Address...)
+	buyer = append(buyer, inv.Buyer.Email)
+	if inv.Buyer.VATNumber != "" {
+		buyer = append(buyer, l["vat_number"]+": "+inv.Buyer.VATNumber)
+	}
+	seller, buyer = nonEmpty(seller), nonEmpty(buyer)
+	d.text(margin, d.y, 10, true, l["seller"])
+	d.text(320, d.y, 10, true, l["bill_to"])
+	d.advance(14)
+	for i := 0; i < len(seller) || i < len(buyer); i++ {
+		if i < len(seller) {
+			d.text(margin, d.y, 10, false, truncate(seller[i], 10, 250))
+		}
+		if i < len(buyer) {
+			d.text(320, d.y, 10, false, truncate(buyer[i], 10, right-320))
+		}
+		d.advance(14)
+	}
+	d.advance(20)
+
+	// the right edges of the columns of the line items
+	columns := []float64{300, 360, 395, 445, 495, right}
+	header := func() {
+		d.text(margin, d.y, 9, true, l["item"])
+		for i, label := range []string{l["quantity"], l["unit_price"], l["tax_rate"], l["net"], l["tax"], l["total"]} {
+			d.textRight(columns[i], d.y, 9, true, label)
+		}
+		d.advance(6)
+		d.coloredLine(margin, d.y, right, d.y, accent)
+		d.advance(12)
+	}
+	header()
+	for _, line := range inv.Lines {
+		if d.y < margin+14 {
+			d.newPage()
+			header()
+		}
+		title := line.Title
+		if line.Sku != "" {
+			title += " (" + line.Sku + ")"
+		}
+		d.text(margin, d.y, 9, false, truncate(title, 9, columns[0]-margin-30))
+		for i, value := range []string{
+			fmt.Sprintf("%d", line.Quantity),
+			inv.Amount(line.UnitPrice),
+			inv.Percentage(line.Rate),
+			inv.Amount(line.Net),
+			inv.Amount(line.Tax),
+			inv.Amount(line.Total),
+		} {
+			d.textRight(columns[i], d.y, 9, false, value)
+		}
+		d.advance(14)
+	}
+	d.coloredLine(margin, d.y+8, right, d.y+8, accent)
+	d.advance(10)
+
+	total := func(label, amount string, bold bool) {
+		d.text(350, d.y, 10, bold, label)
+		d.textRight(right, d.y, 10, bold, amount)
+		d.advance(14)
+	}
+	total(l["subtotal"], inv.Amount(inv.Subtotal), false)
+	if inv.Discount > 0 {
+		total(l["discount"], "-"+inv.Amount(inv.Discount), false)
+	}
+	if inv.Shipping > 0 {
+		total(l["shipping"], inv.Amount(inv.Shipping), false)
+	}
+	total(l["taxes"], inv.Amount(inv.Tax), false)
+	total(l["total"], inv.Amount(inv.Total), true)
+	d.advance(16)
+
+	d.coloredText(margin, d.y, 10, true, primary, l["tax_breakdown"])
+	d.advance(14)
+	for _, rate := range inv.Taxes {
+		d.text(margin, d.y, 9, false, inv.Percentage(rate.Rate))
+		d.textRight(columns[3], d.y, 9, false, inv.Amount(rate.Net))
+		d.textRight(columns[4], d.y, 9, false, inv.Amount(rate.Tax))
+		d.advance(14)
+	}
+	d.advance(10)
+
+	notes := []string{}
+	if inv.ReverseCharge {
+		notes = append(notes, l["reverse_charge"])
+	}
+	if inv.TaxExempt {
+		notes = append(notes, inv.TaxExemptNote())
+	}
+	if inv.Seller.Footer != "" {
+		notes = append(notes, inv.Seller.Footer)
+	}
+	if contact := inv.SupportContact(); contact != "" {
+		notes = append(notes, l["support"]+" "+contact)
+	}
+	if inv.Branding.LegalText != "" {
+		notes = append(notes, inv.Branding.LegalText)
+	}
+	for _, note := range notes {
+		for _, line := range wrap(note, 9, right-margin) {
+			d.text(margin, d.y, 9, false, line)
+			d.advance(12)
+		}
+		d.advance(6)
+	}
+
+	return d.bytes()
+}
+
+func nonEmpty(lines []string) []string {
+	result := []string{}
+	for _, line := range lines {
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// truncate shortens text to fit a width.
+func truncate(s string, size, width float64) string {
+	if textWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && textWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// wrap breaks text into lines that fit a width.
+func wrap(s string, size, width float64) []string {
+	lines := []string{}
+	line := ""
+	for _, word := range strings.Fields(s) {
+		if line != "" && textWidth(line+" "+word, size) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// document is a minimal PDF writer for text and lines. It uses the standard
+// Helvetica fonts, which PDF readers have built in, so no fonts have to be
+// embedded.
+type document struct {
+	pages []*bytes.Buffer
+	page  *bytes.Buffer
+	y     float64
+}
+
+func (d *document) newPage() {
+	d.page = &bytes.Buffer{}
+	d.pages = append(d.pages, d.page)
+	d.y = pageHeight - margin
+}
+
+// advance moves down the page, and to a new page at the bottom margin.
+func (d *document) advance(height float64) {
+	d.y -= height
+	if d.y < margin {
+		d.newPage()
+	}
+}
+
+func (d *document) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, escapePDF(winAnsi(s)))
+}
+
+func (d *document) textRight(x, y, size float64, bold bool, s string) {
+	d.text(x-textWidth(s, size), y, size, bold, s)
+}
+
+func (d *document) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.page, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// coloredText writes text in a hex color, or in black when the color isn't
+// valid.
+func (d *document) coloredText(x, y, size float64, bold bool, color, s string) {
+	r, g, b, ok := calculator.RGB(color)
+	if !ok {
+		d.text(x, y, size, bold, s)
+		return
+	}
+	fmt.Fprintf(d.page, "%.3f %.3f %.3f rg\n", r, g, b)
+	d.text(x, y, size, bold, s)
+	fmt.Fprint(d.page, "0 g\n")
+}
+
+// coloredLine draws a line in a hex color, or in black when the color isn't
+// valid.
+func (d *document) coloredLine(x1, y1, x2, y2 float64, color string) {
+	r, g, b, ok := calculator.RGB(color)
+	if !ok {
+		d.line(x1, y1, x2, y2)
+		return
+	}
+	fmt.Fprintf(d.page, "%.3f %.3f %.3f RG\n", r, g, b)
+	d.line(x1, y1, x2, y2)
+	fmt.Fprint(d.page, "0 G\n")
+}
+
+func (d *document) bytes() []byte {
+	buf := &bytes.Buffer{}
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	kids := []string{}
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 5+2*i))
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", page.Len(), page.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// winAnsiSpecials are the characters of the WinAnsi encoding outside of
+// Latin-1.
+var winAnsiSpecials = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92,
+	'“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// winAnsi encodes text for the standard fonts. Characters they don't have
+// become question marks.
+func winAnsi(s string) []byte {
+	encoded := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 0x20:
+			encoded = append(encoded, ' ')
+		case r < 0x7f || (r >= 0xa0 && r <= 0xff):
+			encoded = append(encoded, byte(r))
+		case winAnsiSpecials[r] != 0:
+			encoded = append(encoded, winAnsiSpecials[r])
+		default:
+			encoded = append(encoded, '?')
+		}
+	}
+	return encoded
+}
+
+func escapePDF(s []byte) string {
+	buf := &bytes.Buffer{}
+	for _, b := range s {
+		if b == '\\' || b == '(' || b == ')' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(b)
+	}
+	return buf.String()
+}
+
+// helveticaWidths are the widths of the ASCII characters from space to tilde
+// in Helvetica, in thousandths of the font size.
+var helveticaWidths = []int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// textWidth estimates the width of text in Helvetica. Characters outside of
+// ASCII count as wide as a digit.
+func textWidth(s string, size float64) float64 {
+	width := 0
+	for _, b := range winAnsi(s) {
+		if b >= 0x20 && int(b-0x20) < len(helveticaWidths) {
+			width += helveticaWidths[b-0x20]
+		} else {
+			width += 556
+		}
+	}
+	return float64(width) * size / 1000
+}
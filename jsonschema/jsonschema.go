@@ -0,0 +1,299 @@
+// Package jsonschema validates JSON values against the common keywords of
+// JSON Schema: type, enum, const, the bounds of numbers, strings, arrays and
+// objects, pattern, format, properties, required, additionalProperties and
+// items. Other keywords, like $ref and the combinators, are ignored.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Schema is a JSON Schema. The booleans true and false are schemas too,
+// which accept any value and no value.
+type Schema struct {
+	// Type is a type name, or a list of them: string, number, integer,
+	// boolean, object, array or null.
+	Type  interface{}   `json:"type,omitempty"`
+	Enum  []interface{} `json:"enum,omitempty"`
+	Const interface{}   `json:"const,omitempty"`
+
+	Minimum          *float64 `json:"minimum,omitempty"`
+	Maximum          *float64 `json:"maximum,omitempty"`
+	ExclusiveMinimum *float64 `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum *float64 `json:"exclusiveMaximum,omitempty"`
+
+	MinLength *int   `json:"minLength,omitempty"`
+	MaxLength *int   `json:"maxLength,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+	// Format is email, uri, date or date-time. Other formats are ignored.
+	Format string `json:"format,omitempty"`
+
+	Items    *Schema `json:"items,omitempty"`
+	MinItems *int    `json:"minItems,omitempty"`
+	MaxItems *int    `json:"maxItems,omitempty"`
+
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+
+	reject  bool
+	pattern *regexp.Regexp
+}
+
+// FieldError is a value that doesn't match its schema. Field is the path of
+// the value, like address.lines.0, and empty for the value itself.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + " " + e.Message
+}
+
+type schemaFields Schema
+
+// UnmarshalJSON reads a schema, or a boolean schema, and compiles its
+// patterns.
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	switch string(bytes.TrimSpace(data)) {
+	case "true":
+		*s = Schema{}
+		return nil
+	case "false":
+		*s = Schema{reject: true}
+		return nil
+	}
+
+	fields := schemaFields{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*s = Schema(fields)
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+		s.pattern = pattern
+	}
+	if _, err := s.types(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MarshalJSON writes a schema, and boolean schemas as booleans.
+func (s Schema) MarshalJSON() ([]byte, error) {
+	if s.reject {
+		return []byte("false"), nil
+	}
+	return json.Marshal(schemaFields(s))
+}
+
+// Validate checks a value decoded from JSON against the schema, and returns
+// the errors of all the fields that don't match, sorted by field.
+func (s *Schema) Validate(value interface{}) []FieldError {
+	errs := s.validate("", value, nil)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
+	return errs
+}
+
+func (s *Schema) types() ([]string, error) {
+	switch t := s.Type.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{t}, nil
+	case []interface{}:
+		types := make([]string, len(t))
+		for i, name := range t {
+			str, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid type %v", name)
+			}
+			types[i] = str
+		}
+		return types, nil
+	}
+	return nil, fmt.Errorf("invalid type %v", s.Type)
+}
+
+func (s *Schema) validate(path string, value interface{}, errs []FieldError) []FieldError {
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.reject {
+		fail("isn't allowed")
+		return errs
+	}
+
+	types, _ := s.types()
+	if len(types) > 0 && !hasType(types, value) {
+		fail("must be of type %v", strings.Join(types, " or "))
+		return errs
+	}
+	if len(s.Enum) > 0 && !contains(s.Enum, value) {
+		fail("must be one of %v", formatValues(s.Enum))
+	}
+	if s.Const != nil && !equal(s.Const, value) {
+		fail("must be %v", formatValues([]interface{}{s.Const}))
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && v <= *s.ExclusiveMinimum {
+			fail("must be more than %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && v >= *s.ExclusiveMaximum {
+			fail("must be less than %v", *s.ExclusiveMaximum)
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %v", s.Pattern)
+		}
+		if !validFormat(s.Format, v) {
+			fail("must be a valid %v", s.Format)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				errs = s.Items.validate(join(path, strconv.Itoa(i)), item, errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				errs = append(errs, FieldError{Field: join(path, key), Message: "is required"})
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, ok := s.Properties[key]; ok {
+				errs = property.validate(join(path, key), v[key], errs)
+			} else if s.AdditionalProperties != nil {
+				errs = s.AdditionalProperties.validate(join(path, key), v[key], errs)
+			}
+		}
+	}
+	return errs
+}
+
+func join(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func hasType(types []string, value interface{}) bool {
+	for _, t := range types {
+		switch v := value.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func formatValues(values []interface{}) string {
+	formatted := make([]string, len(values))
+	for i, v := range values {
+		data, _ := json.Marshal(v)
+		formatted[i] = string(data)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func validFormat(format, value string) bool {
+	switch format {
+	case "email":
+		address, err := mail.ParseAddress(value)
+		return err == nil && address.Address == value
+	case "uri":
+		u, err := url.Parse(value)
+		return err == nil && u.IsAbs()
+	case "date":
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	}
+	return true
+}
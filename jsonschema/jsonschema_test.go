@@ -0,0 +1,77 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parse(t *testing.T, data string) *Schema {
+	schema := &Schema{}
+	require.NoError(t, json.Unmarshal([]byte(data), schema))
+	return schema
+}
+
+func decode(t *testing.T, data string) interface{} {
+	var value interface{}
+	require.NoError(t, json.Unmarshal([]byte(data), &value))
+	return value
+}
+
+func TestValidate(t *testing.T) {
+	schema := parse(t, `{
+		"type": "object",
+		"properties": {
+			"po_number": {"type": "string", "pattern": "^PO-[0-9]+$"},
+			"seats": {"type": "integer", "minimum": 1, "maximum": 10},
+			"color": {"enum": ["red", "blue"]},
+			"note": {"type": ["string", "null"], "maxLength": 5},
+			"contact": {
+				"type": "object",
+				"properties": {"email": {"type": "string", "format": "email"}},
+				"required": ["email"],
+				"additionalProperties": false
+			},
+			"dates": {"type": "array", "items": {"type": "string", "format": "date"}, "maxItems": 2}
+		},
+		"required": ["po_number"]
+	}`)
+
+	assert.Empty(t, schema.Validate(decode(t, `{
+		"po_number": "PO-1", "seats": 2, "color": "red", "note": null,
+		"contact": {"email": "bruce@example.com"}, "dates": ["2017-09-01"], "other": true
+	}`)))
+
+	assert.Equal(t, []FieldError{
+		{Field: "color", Message: `must be one of "red", "blue"`},
+		{Field: "contact.email", Message: "is required"},
+		{Field: "contact.phone", Message: "isn't allowed"},
+		{Field: "dates", Message: "must have at most 2 items"},
+		{Field: "dates.1", Message: "must be a valid date"},
+		{Field: "note", Message: "must be at most 5 characters"},
+		{Field: "po_number", Message: "is required"},
+		{Field: "seats", Message: "must be of type integer"},
+	}, schema.Validate(decode(t, `{
+		"seats": 1.5, "color": "green", "note": "too long",
+		"contact": {"phone": "555"}, "dates": ["2017-09-01", "tomorrow", "2017-09-03"]
+	}`)))
+
+	assert.Equal(t, []FieldError{{Field: "", Message: "must be of type object"}}, schema.Validate(decode(t, `[]`)))
+	assert.Equal(t, []FieldError{{Field: "seats", Message: "must be at least 1"}}, schema.Validate(decode(t, `{"po_number": "PO-1", "seats": 0}`)))
+}
+
+func TestParse(t *testing.T) {
+	schema := &Schema{}
+	assert.Error(t, json.Unmarshal([]byte(`{"pattern": "("}`), schema))
+	assert.Error(t, json.Unmarshal([]byte(`{"type": 42}`), schema))
+
+	schema = parse(t, `{"properties": {"a": false}, "additionalProperties": true}`)
+	assert.Len(t, schema.Validate(decode(t, `{"a": 1}`)), 1)
+	assert.Empty(t, schema.Validate(decode(t, `{"b": 1}`)))
+
+	data, err := json.Marshal(schema)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"properties": {"a": false}, "additionalProperties": {}}`, string(data))
+}
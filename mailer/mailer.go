@@ -5,6 +5,8 @@ import (
 	"log"
 	"time"
 
+	"github.com/netlify/gocommerce/breaker"
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/mailme"
@@ -13,13 +15,39 @@ import (
 // Mailer will send mail and use templates from the site for easy mail styling
 type Mailer interface {
 	OrderConfirmationMail(transaction *models.Transaction) error
-	OrderReceivedMail(transaction *models.Transaction) error
+	OrderReceivedMail(transaction *models.Transaction, actionLinks map[string]string) error
+	OrderRefundMail(transaction *models.Transaction) error
+	OrderBackorderedMail(transaction *models.Transaction) error
+	OrderMail(order *models.Order, to, subject, templateURL string) error
 	OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error)
+	// WithBranding returns a mailer that passes the branding of the site to
+	// the mail templates as .Branding.
+	WithBranding(branding *calculator.Branding) Mailer
 }
 
 type mailer struct {
 	Config         *conf.Configuration
 	TemplateMailer *mailme.Mailer
+	Sender         sender
+	Branding       *calculator.Branding
+}
+
+// sender sends a templated mail, over SMTP or through an email API.
+type sender interface {
+	Mail(to, subjectTemplate, templateURL, defaultTemplate string, templateData map[string]interface{}) error
+}
+
+// breakerSender stops sending mail for a while when the mail service keeps
+// failing, instead of making every order wait for it to time out.
+type breakerSender struct {
+	sender  sender
+	breaker *breaker.Breaker
+}
+
+func (s *breakerSender) Mail(to, subjectTemplate, templateURL, defaultTemplate string, templateData map[string]interface{}) error {
+	return s.breaker.Do(func() error {
+		return s.sender.Mail(to, subjectTemplate, templateURL, defaultTemplate, templateData)
+	})
 }
 
 // MailSubjects holds the subject lines for the emails
@@ -30,26 +58,50 @@ type MailSubjects struct {
 // NewMailer returns a new authlify mailer
 func NewMailer(conf *conf.Configuration) Mailer {
 	mailConf := conf.Mailer
-	if mailConf.AdminEmail == "" || mailConf.Host == "" || mailConf.Port == 0 {
+	if mailConf.AdminEmail == "" {
 		return newNoopMailer()
 	}
 
-	return &mailer{
-		Config: conf,
-		TemplateMailer: &mailme.Mailer{
-			BaseURL: conf.SiteURL,
-			From:    mailConf.AdminEmail,
-			Host:    mailConf.Host,
-			Port:    mailConf.Port,
-			User:    mailConf.User,
-			Pass:    mailConf.Pass,
-			FuncMap: map[string]interface{}{
-				"dateFormat":     dateFormat,
-				"price":          price,
-				"hasProductType": hasProductType,
-			},
+	templateMailer := &mailme.Mailer{
+		BaseURL: conf.SiteURL,
+		From:    mailConf.AdminEmail,
+		Host:    mailConf.Host,
+		Port:    mailConf.Port,
+		User:    mailConf.User,
+		Pass:    mailConf.Pass,
+		FuncMap: map[string]interface{}{
+			"dateFormat":     dateFormat,
+			"price":          price,
+			"hasProductType": hasProductType,
 		},
 	}
+
+	switch mailConf.Provider {
+	case "mailgun":
+		if mailConf.Mailgun.Domain == "" || mailConf.Mailgun.APIKey == "" {
+			return newNoopMailer()
+		}
+		return &mailer{
+			Config:         conf,
+			TemplateMailer: templateMailer,
+			Sender: &breakerSender{
+				sender:  newMailgunSender(templateMailer, mailConf.Mailgun.Domain, mailConf.Mailgun.APIKey, mailConf.Mailgun.URL),
+				breaker: breaker.Get(breaker.Mail, "mailgun:"+mailConf.Mailgun.Domain),
+			},
+		}
+	default:
+		if mailConf.Host == "" || mailConf.Port == 0 {
+			return newNoopMailer()
+		}
+		return &mailer{
+			Config:         conf,
+			TemplateMailer: templateMailer,
+			Sender: &breakerSender{
+				sender:  templateMailer,
+				breaker: breaker.Get(breaker.Mail, fmt.Sprintf("%v:%v", mailConf.Host, mailConf.Port)),
+			},
+		}
+	}
 }
 
 func dateFormat(layout string, date time.Time) string {
@@ -59,11 +111,11 @@ func dateFormat(layout string, date time.Time) string {
 func price(amount uint64, currency string) string {
 	switch currency {
 	case "USD":
-		return fmt.Sprintf("$%.2f", float64(amount)/100)
+		return "$" + calculator.FormatAmount(amount, currency)
 	case "EUR":
-		return fmt.Sprintf("%.2f€", float64(amount)/100)
+		return calculator.FormatAmount(amount, currency) + "€"
 	default:
-		return fmt.Sprintf("%.2f %v", float64(amount)/100, currency)
+		return calculator.FormatAmount(amount, currency) + " " + currency
 	}
 }
 
@@ -80,25 +132,29 @@ const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
 
 <ul>
 {{ range .Order.LineItems }}
-<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+<li>{{ .Title }} <strong>{{ if .Gift }}{{ .Quantity }} x free gift{{ else }}{{ .Quantity }} x {{ price .Price $.Order.Currency }}{{ end }}</strong></li>
 {{ end }}
 </ul>
 
-<p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+<p>Subtotal: {{ price .Order.SubTotal .Order.Currency }}</p>
+{{ if .Order.Discount }}<p>Discount: -{{ price .Order.Discount .Order.Currency }}</p>{{ end }}
+<p>Taxes: {{ price .Order.Taxes .Order.Currency }}</p>
+<p>Total amount: <strong>{{ price .Order.Total .Order.Currency }}</strong></p>
+{{ if .Order.InvoiceNumber }}<p>Invoice number: {{ .Order.InvoiceNumber }}</p>{{ end }}
 `
 
 // OrderConfirmationMail sends an order confirmation to the user
 func (m *mailer) OrderConfirmationMail(transaction *models.Transaction) error {
 	log.Printf("Sending order confirmation to %v with template %v", transaction.Order.Email, m.Config.Mailer.Templates.OrderConfirmation)
-	return m.TemplateMailer.Mail(
+	return m.Sender.Mail(
 		transaction.Order.Email,
 		withDefault(m.Config.Mailer.Subjects.OrderConfirmation, "Order Confirmation"),
 		m.Config.Mailer.Templates.OrderConfirmation,
-		defaultConfirmationTemplate,
-		map[string]interface{}{
+		branded(defaultConfirmationTemplate),
+		m.templateData(map[string]interface{}{
 			"Order":       transaction.Order,
 			"Transaction": transaction,
-		},
+		}),
 	)
 }
 
@@ -106,24 +162,103 @@ const defaultReceivedTemplate = `<h2>Order Received From {{ .Order.Email }}</h2>
 
 <ul>
 {{ range .Order.LineItems }}
-<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+<li>{{ .Title }} <strong>{{ if .Gift }}{{ .Quantity }} x free gift{{ else }}{{ .Quantity }} x {{ price .Price $.Order.Currency }}{{ end }}</strong></li>
 {{ end }}
 </ul>
 
-<p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+<p>Total amount: <strong>{{ price .Order.Total .Order.Currency }}</strong></p>
+{{ with .Order.DeliveryInstructions }}<p>Delivery instructions: {{ . }}</p>{{ end }}
+{{ with .ActionLinks.refund }}<p><a href="{{ . }}">Refund this payment</a></p>{{ end }}
 `
 
-// OrderReceivedMail sends a notification to the shop admin
-func (m *mailer) OrderReceivedMail(transaction *models.Transaction) error {
-	return m.TemplateMailer.Mail(
+// OrderReceivedMail sends a notification to the shop admin. The action links
+// are signed URLs that take an action on the order, keyed by the action.
+func (m *mailer) OrderReceivedMail(transaction *models.Transaction, actionLinks map[string]string) error {
+	return m.Sender.Mail(
 		m.Config.Mailer.AdminEmail,
 		withDefault(m.Config.Mailer.Subjects.OrderReceived, "Order Received From {{ .Order.Email }}"),
 		m.Config.Mailer.Templates.OrderReceived,
-		defaultReceivedTemplate,
-		map[string]interface{}{
+		branded(defaultReceivedTemplate),
+		m.templateData(map[string]interface{}{
 			"Order":       transaction.Order,
 			"Transaction": transaction,
-		},
+			"ActionLinks": actionLinks,
+		}),
+	)
+}
+
+const defaultRefundTemplate = `<h2>Your order has been refunded</h2>
+
+<p>We have refunded <strong>{{ price .Transaction.Amount .Transaction.Currency }}</strong> of your order.</p>
+
+<p>Total refunded: <strong>{{ price .Order.TotalRefunded .Order.Currency }}</strong></p>
+`
+
+// OrderRefundMail notifies the user that (part of) an order has been refunded
+func (m *mailer) OrderRefundMail(transaction *models.Transaction) error {
+	return m.Sender.Mail(
+		transaction.Order.Email,
+		withDefault(m.Config.Mailer.Subjects.OrderRefund, "Order Refund"),
+		m.Config.Mailer.Templates.OrderRefund,
+		branded(defaultRefundTemplate),
+		m.templateData(map[string]interface{}{
+			"Order":       transaction.Order,
+			"Transaction": transaction,
+		}),
+	)
+}
+
+const defaultBackorderedTemplate = `<h2>Some items of your order are on backorder</h2>
+
+<p>Thank you for your order. These items sold out while you were checking out:</p>
+
+<ul>
+{{ range .Order.LineItems }}{{ if .BackorderedQuantity }}
+<li>{{ .Title }} <strong>{{ .BackorderedQuantity }} of {{ .Quantity }}</strong></li>
+{{ end }}{{ end }}
+</ul>
+
+<p>We will ship them as soon as they are back in stock. If you'd rather not wait, reply to this
+email and we will cancel the backordered items and refund them.</p>
+`
+
+// OrderBackorderedMail tells the buyer that some items of their paid order
+// are out of stock, and what they can do about it.
+func (m *mailer) OrderBackorderedMail(transaction *models.Transaction) error {
+	return m.Sender.Mail(
+		transaction.Order.Email,
+		withDefault(m.Config.Mailer.Subjects.OrderBackordered, "Some items of your order are on backorder"),
+		m.Config.Mailer.Templates.OrderBackordered,
+		branded(defaultBackorderedTemplate),
+		m.templateData(map[string]interface{}{
+			"Order":       transaction.Order,
+			"Transaction": transaction,
+		}),
+	)
+}
+
+const defaultOrderTemplate = `<h2>Order {{ .Order.ID }}</h2>
+
+<ul>
+{{ range .Order.LineItems }}
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ price .Price $.Order.Currency }}</strong></li>
+{{ end }}
+</ul>
+
+<p>Total amount: <strong>{{ price .Order.Total .Order.Currency }}</strong></p>
+`
+
+// OrderMail sends a mail about an order with a template of the site, like
+// the mails of automations.
+func (m *mailer) OrderMail(order *models.Order, to, subject, templateURL string) error {
+	return m.Sender.Mail(
+		to,
+		withDefault(subject, "Order {{ .Order.ID }}"),
+		templateURL,
+		branded(defaultOrderTemplate),
+		m.templateData(map[string]interface{}{
+			"Order": order,
+		}),
 	)
 }
 
@@ -132,10 +267,41 @@ func (m *mailer) OrderConfirmationMailBody(transaction *models.Transaction, temp
 		templateURL = m.Config.Mailer.Templates.OrderConfirmation
 	}
 
-	return m.TemplateMailer.MailBody(templateURL, defaultReceivedTemplate, map[string]interface{}{
+	return m.TemplateMailer.MailBody(templateURL, branded(defaultConfirmationTemplate), m.templateData(map[string]interface{}{
 		"Order":       transaction.Order,
 		"Transaction": transaction,
-	})
+	}))
+}
+
+func (m *mailer) WithBranding(branding *calculator.Branding) Mailer {
+	branded := *m
+	branded.Branding = branding
+	return &branded
+}
+
+// templateData adds the branding of the site to the data of a mail template.
+func (m *mailer) templateData(data map[string]interface{}) map[string]interface{} {
+	branding := m.Branding
+	if branding == nil {
+		branding = &calculator.Branding{}
+	}
+	data["Branding"] = branding
+	return data
+}
+
+const brandingHeader = `{{ with .Branding.PrimaryColor }}<style>h2 { color: {{ . }}; }</style>{{ end }}
+{{ with .Branding.LogoURL }}<p><img src="{{ . }}" alt="" style="max-height: 60px"></p>{{ end }}
+`
+
+const brandingFooter = `{{ with .Branding }}{{ if or .SupportEmail .SupportPhone .SupportURL }}
+<p>Questions about your order?{{ with .SupportEmail }} <a href="mailto:{{ . }}">{{ . }}</a>{{ end }}{{ with .SupportPhone }} {{ . }}{{ end }}{{ with .SupportURL }} <a href="{{ . }}">{{ . }}</a>{{ end }}</p>
+{{ end }}{{ with .LegalText }}<p style="color: #666; font-size: 11px">{{ . }}</p>
+{{ end }}{{ end }}`
+
+// branded adds the logo, colors, support contact and legal text of the
+// branding to a default mail template.
+func branded(template string) string {
+	return brandingHeader + template + brandingFooter
 }
 
 func withDefault(value string, defaultValue string) string {
@@ -1,10 +1,17 @@
 package mailer
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
+	"github.com/netlify/gocommerce/breaker"
 	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNoopMailer(t *testing.T) {
@@ -21,3 +28,73 @@ func TestTemplateMailer(t *testing.T) {
 	m := NewMailer(conf)
 	assert.IsType(t, &mailer{}, m)
 }
+
+func TestMailgunMailer(t *testing.T) {
+	var form url.Values
+	var user, pass, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ = r.BasicAuth()
+		path = r.URL.Path
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		fmt.Fprint(w, `{"id":"<msg@example.com>","message":"Queued. Thank you."}`)
+	}))
+	defer server.Close()
+
+	conf := &conf.Configuration{}
+	conf.Mailer.AdminEmail = "shop@example.com"
+	conf.Mailer.Provider = "mailgun"
+	conf.Mailer.Mailgun.Domain = "mg.example.com"
+	conf.Mailer.Mailgun.APIKey = "key-123"
+	conf.Mailer.Mailgun.URL = server.URL
+	m := NewMailer(conf)
+	require.IsType(t, &mailer{}, m)
+
+	order := models.NewOrder("", "session", "buyer@example.com", "USD")
+	order.LineItems = []*models.LineItem{{Title: "Book", Quantity: 2, Price: 999}}
+	order.SubTotal = 1998
+	order.Total = 1998
+	transaction := models.NewTransaction(order)
+
+	require.NoError(t, m.OrderConfirmationMail(transaction))
+	assert.Equal(t, "/mg.example.com/messages", path)
+	assert.Equal(t, "api", user)
+	assert.Equal(t, "key-123", pass)
+	assert.Equal(t, "shop@example.com", form.Get("from"))
+	assert.Equal(t, "buyer@example.com", form.Get("to"))
+	assert.Equal(t, "Order Confirmation", form.Get("subject"))
+	assert.Contains(t, form.Get("html"), "Book <strong>2 x $9.99</strong>")
+	assert.Contains(t, form.Get("html"), "Total amount: <strong>$19.98</strong>")
+
+	order.Email = "o'brien+books@example.com"
+	require.NoError(t, m.OrderReceivedMail(transaction, nil))
+	assert.Equal(t, "shop@example.com", form.Get("to"))
+	assert.Equal(t, "Order Received From o'brien+books@example.com", form.Get("subject"))
+}
+
+func TestMailgunOutage(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	breaker.Configure(breaker.Mail, breaker.Settings{FailureThreshold: 2})
+	defer breaker.Configure(breaker.Mail, breaker.Settings{})
+
+	conf := &conf.Configuration{}
+	conf.Mailer.AdminEmail = "shop@example.com"
+	conf.Mailer.Provider = "mailgun"
+	conf.Mailer.Mailgun.Domain = "outage.example.com"
+	conf.Mailer.Mailgun.APIKey = "key-123"
+	conf.Mailer.Mailgun.URL = server.URL
+	m := NewMailer(conf)
+
+	order := models.NewOrder("", "session", "buyer@example.com", "USD")
+	transaction := models.NewTransaction(order)
+	assert.Error(t, m.OrderConfirmationMail(transaction))
+	assert.Error(t, m.OrderConfirmationMail(transaction))
+	assert.Equal(t, breaker.ErrOpen, m.OrderConfirmationMail(transaction))
+	assert.Equal(t, 2, calls)
+}
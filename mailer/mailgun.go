@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/netlify/mailme"
+)
+
+const defaultMailgunURL = "https://api.mailgun.net/v3"
+
+// mailgunSender renders mails with the site templates and sends them through
+// the Mailgun HTTP API instead of SMTP.
+type mailgunSender struct {
+	TemplateMailer *mailme.Mailer
+	Domain         string
+	APIKey         string
+	URL            string
+	client         *http.Client
+}
+
+func newMailgunSender(templateMailer *mailme.Mailer, domain, apiKey, apiURL string) *mailgunSender {
+	if apiURL == "" {
+		apiURL = defaultMailgunURL
+	}
+	return &mailgunSender{
+		TemplateMailer: templateMailer,
+		Domain:         domain,
+		APIKey:         apiKey,
+		URL:            strings.TrimSuffix(apiURL, "/"),
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Mail has the same signature as mailme.Mailer.Mail so both can be used to send.
+func (s *mailgunSender) Mail(to, subjectTemplate, templateURL, defaultTemplate string, templateData map[string]interface{}) error {
+	// subjects are plain text, HTML escaping would show up in them
+	tmp, err := template.New("Subject").Funcs(template.FuncMap(s.TemplateMailer.FuncMap)).Parse(subjectTemplate)
+	if err != nil {
+		return err
+	}
+	subject := &bytes.Buffer{}
+	if err := tmp.Execute(subject, templateData); err != nil {
+		return err
+	}
+
+	body, err := s.TemplateMailer.MailBody(templateURL, defaultTemplate, templateData)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"from":    {s.TemplateMailer.From},
+		"to":      {to},
+		"subject": {subject.String()},
+		"html":    {body},
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/"+s.Domain+"/messages", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", s.APIKey)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Mailgun responded with %v: %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package mailer
 
-import "github.com/netlify/gocommerce/models"
+import (
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
 
 type noopMailer struct{}
 
@@ -11,10 +14,23 @@ func newNoopMailer() Mailer {
 func (m *noopMailer) OrderConfirmationMail(transaction *models.Transaction) error {
 	return nil
 }
-func (m *noopMailer) OrderReceivedMail(transaction *models.Transaction) error {
+func (m *noopMailer) OrderReceivedMail(transaction *models.Transaction, actionLinks map[string]string) error {
+	return nil
+}
+func (m *noopMailer) OrderRefundMail(transaction *models.Transaction) error {
+	return nil
+}
+func (m *noopMailer) OrderBackorderedMail(transaction *models.Transaction) error {
+	return nil
+}
+func (m *noopMailer) OrderMail(order *models.Order, to, subject, templateURL string) error {
 	return nil
 }
 
 func (m *noopMailer) OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error) {
 	return "Order Confirmed", nil
 }
+
+func (m *noopMailer) WithBranding(branding *calculator.Branding) Mailer {
+	return m
+}
@@ -0,0 +1,257 @@
+// Package metrics keeps the metrics of the calls gocommerce makes to payment
+// providers: how long they take and how they end, per provider and operation,
+// and the rates of successful and declined calls over the last minutes. The
+// outcomes tell payments the provider declined apart from providers that
+// can't be reached or fail, and from requests gocommerce got wrong.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outcomes of calls to payment providers.
+const (
+	// Success is a call that went through.
+	Success = "success"
+	// Declined is a payment the provider rejected, like a declined card.
+	Declined = "declined"
+	// NetworkError is a call that didn't reach the provider or got no answer.
+	NetworkError = "network_error"
+	// ProviderError is a call the provider failed to handle.
+	ProviderError = "provider_error"
+	// InternalError is a call the provider refused as invalid, which points
+	// to a bug or a misconfiguration of gocommerce.
+	InternalError = "internal_error"
+	// Unavailable is a call that wasn't made because the circuit breaker of
+	// the provider is open.
+	Unavailable = "unavailable"
+)
+
+// Outcomes are all outcomes of calls, in the order they are reported.
+var Outcomes = []string{Success, Declined, NetworkError, ProviderError, InternalError, Unavailable}
+
+// LatencyBuckets are the upper bounds of the buckets of the latency
+// histogram, in seconds.
+var LatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Windows are the periods the rolling rates are calculated over.
+var Windows = []time.Duration{15 * time.Minute, time.Hour}
+
+// windowMinutes is the number of minutes calls are counted for the rolling
+// rates, which covers the longest window.
+const windowMinutes = 60
+
+// PaymentStats are the metrics of an operation of a payment provider, like
+// charges with Stripe.
+type PaymentStats struct {
+	Provider  string            `json:"provider"`
+	Operation string            `json:"operation"`
+	Calls     map[string]uint64 `json:"calls"`
+	// Latency counts the calls that took at most the bound of each of the
+	// LatencyBuckets, and the count of all calls last.
+	Latency    []uint64 `json:"latency_buckets"`
+	LatencySum float64  `json:"latency_seconds_sum"`
+	Rates      []Rate   `json:"rates"`
+}
+
+// Rate is the share of calls that succeeded and that were declined over a
+// window of the last minutes. Rates are 0 without calls.
+type Rate struct {
+	Window      string  `json:"window"`
+	Calls       uint64  `json:"calls"`
+	SuccessRate float64 `json:"success_rate"`
+	DeclineRate float64 `json:"decline_rate"`
+}
+
+// minute counts the calls of one minute.
+type minute struct {
+	start     int64
+	calls     uint64
+	successes uint64
+	declines  uint64
+}
+
+type series struct {
+	provider   string
+	operation  string
+	calls      map[string]uint64
+	latency    []uint64
+	latencySum float64
+	minutes    [windowMinutes]minute
+}
+
+// Registry keeps the metrics of payment providers.
+type Registry struct {
+	mutex  sync.Mutex
+	series map[string]*series
+	now    func() time.Time
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{series: map[string]*series{}, now: time.Now}
+}
+
+// Record counts a call to an operation of a payment provider, with its
+// outcome and how long it took.
+func (r *Registry) Record(provider, operation, outcome string, elapsed time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := provider + ":" + operation
+	s, ok := r.series[key]
+	if !ok {
+		s = &series{
+			provider:  provider,
+			operation: operation,
+			calls:     map[string]uint64{},
+			latency:   make([]uint64, len(LatencyBuckets)+1),
+		}
+		r.series[key] = s
+	}
+
+	s.calls[outcome]++
+	seconds := elapsed.Seconds()
+	for i, bound := range LatencyBuckets {
+		if seconds <= bound {
+			s.latency[i]++
+		}
+	}
+	s.latency[len(LatencyBuckets)]++
+	s.latencySum += seconds
+
+	start := r.now().Unix() / 60
+	m := &s.minutes[start%windowMinutes]
+	if m.start != start {
+		*m = minute{start: start}
+	}
+	m.calls++
+	switch outcome {
+	case Success:
+		m.successes++
+	case Declined:
+		m.declines++
+	}
+}
+
+// Payments returns the metrics of all payment providers, ordered by provider
+// and operation.
+func (r *Registry) Payments() []PaymentStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	current := r.now().Unix() / 60
+	stats := make([]PaymentStats, 0, len(r.series))
+	for _, s := range r.series {
+		ps := PaymentStats{
+			Provider:   s.provider,
+			Operation:  s.operation,
+			Calls:      map[string]uint64{},
+			Latency:    append([]uint64{}, s.latency...),
+			LatencySum: s.latencySum,
+		}
+		for outcome, count := range s.calls {
+			ps.Calls[outcome] = count
+		}
+		for _, window := range Windows {
+			ps.Rates = append(ps.Rates, s.rate(current, window))
+		}
+		stats = append(stats, ps)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Provider != stats[j].Provider {
+			return stats[i].Provider < stats[j].Provider
+		}
+		return stats[i].Operation < stats[j].Operation
+	})
+	return stats
+}
+
+func (s *series) rate(current int64, window time.Duration) Rate {
+	rate := Rate{Window: formatWindow(window)}
+	var successes, declines uint64
+	for _, m := range s.minutes {
+		if m.calls > 0 && current-m.start < int64(window/time.Minute) {
+			rate.Calls += m.calls
+			successes += m.successes
+			declines += m.declines
+		}
+	}
+	if rate.Calls > 0 {
+		rate.SuccessRate = float64(successes) / float64(rate.Calls)
+		rate.DeclineRate = float64(declines) / float64(rate.Calls)
+	}
+	return rate
+}
+
+func formatWindow(window time.Duration) string {
+	if window%time.Hour == 0 {
+		return fmt.Sprintf("%dh", window/time.Hour)
+	}
+	return fmt.Sprintf("%dm", window/time.Minute)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (r *Registry) WritePrometheus(w io.Writer) {
+	stats := r.Payments()
+
+	fmt.Fprintln(w, "# HELP gocommerce_payment_calls_total Calls to payment providers by outcome.")
+	fmt.Fprintln(w, "# TYPE gocommerce_payment_calls_total counter")
+	for _, s := range stats {
+		for _, outcome := range Outcomes {
+			fmt.Fprintf(w, "gocommerce_payment_calls_total{%s,outcome=%q} %d\n", s.labels(), outcome, s.Calls[outcome])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP gocommerce_payment_latency_seconds Latency of calls to payment providers.")
+	fmt.Fprintln(w, "# TYPE gocommerce_payment_latency_seconds histogram")
+	for _, s := range stats {
+		for i, bound := range LatencyBuckets {
+			fmt.Fprintf(w, "gocommerce_payment_latency_seconds_bucket{%s,le=\"%g\"} %d\n", s.labels(), bound, s.Latency[i])
+		}
+		count := s.Latency[len(LatencyBuckets)]
+		fmt.Fprintf(w, "gocommerce_payment_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", s.labels(), count)
+		fmt.Fprintf(w, "gocommerce_payment_latency_seconds_sum{%s} %g\n", s.labels(), s.LatencySum)
+		fmt.Fprintf(w, "gocommerce_payment_latency_seconds_count{%s} %d\n", s.labels(), count)
+	}
+
+	fmt.Fprintln(w, "# HELP gocommerce_payment_success_rate Share of calls to payment providers that succeeded over the window.")
+	fmt.Fprintln(w, "# TYPE gocommerce_payment_success_rate gauge")
+	for _, s := range stats {
+		for _, rate := range s.Rates {
+			fmt.Fprintf(w, "gocommerce_payment_success_rate{%s,window=%q} %g\n", s.labels(), rate.Window, rate.SuccessRate)
+		}
+	}
+	fmt.Fprintln(w, "# HELP gocommerce_payment_decline_rate Share of calls to payment providers that were declined over the window.")
+	fmt.Fprintln(w, "# TYPE gocommerce_payment_decline_rate gauge")
+	for _, s := range stats {
+		for _, rate := range s.Rates {
+			fmt.Fprintf(w, "gocommerce_payment_decline_rate{%s,window=%q} %g\n", s.labels(), rate.Window, rate.DeclineRate)
+		}
+	}
+}
+
+func (s PaymentStats) labels() string {
+	return fmt.Sprintf("provider=%q,operation=%q", s.Provider, s.Operation)
+}
+
+var defaultRegistry = NewRegistry()
+
+// Record counts a call to a payment provider in the registry of the process.
+func Record(provider, operation, outcome string, elapsed time.Duration) {
+	defaultRegistry.Record(provider, operation, outcome, elapsed)
+}
+
+// Payments returns the metrics of the payment providers in the registry of
+// the process.
+func Payments() []PaymentStats {
+	return defaultRegistry.Payments()
+}
+
+// WritePrometheus writes the metrics in the registry of the process in the
+// Prometheus text format.
+func WritePrometheus(w io.Writer) {
+	defaultRegistry.WritePrometheus(w)
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRegistry() (*Registry, *time.Time) {
+	now := time.Now()
+	r := NewRegistry()
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestRecord(t *testing.T) {
+	r, _ := newTestRegistry()
+	r.Record("stripe", "charge", Success, 50*time.Millisecond)
+	r.Record("stripe", "charge", Declined, 300*time.Millisecond)
+	r.Record("stripe", "charge", NetworkError, 40*time.Second)
+	r.Record("paypal", "charge", Success, time.Second)
+
+	stats := r.Payments()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "paypal", stats[0].Provider)
+	s := stats[1]
+	assert.Equal(t, "stripe", s.Provider)
+	assert.Equal(t, "charge", s.Operation)
+	assert.Equal(t, map[string]uint64{Success: 1, Declined: 1, NetworkError: 1}, s.Calls)
+	assert.Equal(t, []uint64{1, 1, 2, 2, 2, 2, 2, 2, 3}, s.Latency)
+	assert.InDelta(t, 40.35, s.LatencySum, 0.001)
+}
+
+func TestRollingRates(t *testing.T) {
+	r, now := newTestRegistry()
+	for i := 0; i < 4; i++ {
+		r.Record("stripe", "charge", Success, time.Millisecond)
+	}
+	*now = now.Add(30 * time.Minute)
+	r.Record("stripe", "charge", Success, time.Millisecond)
+	r.Record("stripe", "charge", Declined, time.Millisecond)
+
+	rates := r.Payments()[0].Rates
+	require.Len(t, rates, 2)
+	assert.Equal(t, Rate{Window: "15m", Calls: 2, SuccessRate: 0.5, DeclineRate: 0.5}, rates[0])
+	assert.Equal(t, "1h", rates[1].Window)
+	assert.EqualValues(t, 6, rates[1].Calls)
+	assert.InDelta(t, 5.0/6, rates[1].SuccessRate, 0.001)
+
+	*now = now.Add(2 * time.Hour)
+	rates = r.Payments()[0].Rates
+	assert.Equal(t, Rate{Window: "15m"}, rates[0])
+	assert.Equal(t, Rate{Window: "1h"}, rates[1])
+	assert.EqualValues(t, 5, r.Payments()[0].Calls[Success])
+}
+
+func TestWritePrometheus(t *testing.T) {
+	r, _ := newTestRegistry()
+	r.Record("stripe", "charge", Declined, 200*time.Millisecond)
+
+	buf := &bytes.Buffer{}
+	r.WritePrometheus(buf)
+	out := buf.String()
+	assert.Contains(t, out, `gocommerce_payment_calls_total{provider="stripe",operation="charge",outcome="declined"} 1`)
+	assert.Contains(t, out, `gocommerce_payment_calls_total{provider="stripe",operation="charge",outcome="success"} 0`)
+	assert.Contains(t, out, `gocommerce_payment_latency_seconds_bucket{provider="stripe",operation="charge",le="0.25"} 1`)
+	assert.Contains(t, out, `gocommerce_payment_latency_seconds_count{provider="stripe",operation="charge"} 1`)
+	assert.Contains(t, out, `gocommerce_payment_decline_rate{provider="stripe",operation="charge",window="15m"} 1`)
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// PurgeAbandonedOrders deletes the orders of an instance that were abandoned
+// before a point in time for good, batchSize orders at a time. Every order is
+// deleted in its own transaction, together with the rows that reference it:
+// line items, downloads, transactions, returns, action links, price
+// overrides, funnel steps, background jobs, events and the address snapshots
+// no other order uses. Abandoned orders were never paid, so they redeemed no
+// coupons. Orders that were paid after all are kept. It returns the number of
+// purged orders.
+func PurgeAbandonedOrders(db *gorm.DB, instanceID string, before time.Time, batchSize int) (int, error) {
+	purged := 0
+	for {
+		orders := []*Order{}
+		rsp := db.Unscoped().
+			Preload("LineItems").
+			Where("instance_id = ? AND abandoned_at < ? AND payment_state = ?", instanceID, before, PendingState).
+			Order("abandoned_at asc").
+			Limit(batchSize).
+			Find(&orders)
+		if rsp.Error != nil {
+			return purged, rsp.Error
+		}
+
+		for _, order := range orders {
+			tx := db.Begin()
+			if err := deleteOrder(tx, order); err != nil {
+				tx.Rollback()
+				return purged, errors.Wrapf(err, "purging order %s", order.ID)
+			}
+			if err := tx.Where("order_id = ?", order.ID).Delete(&Event{}).Error; err != nil {
+				tx.Rollback()
+				return purged, errors.Wrapf(err, "purging order %s", order.ID)
+			}
+			if err := tx.Commit().Error; err != nil {
+				return purged, errors.Wrapf(err, "purging order %s", order.ID)
+			}
+			purged++
+		}
+		if len(orders) < batchSize {
+			return purged, nil
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Actions that can be taken with an ActionLink
+const (
+	// RefundAction refunds an amount of a paid transaction.
+	RefundAction = "refund"
+	// MarkPaidAction marks an unpaid order as paid outside of the payment
+	// providers, like by bank transfer.
+	MarkPaidAction = "mark_paid"
+	// ApprovePriceOverrideAction approves a price override that was held
+	// for approval.
+	ApprovePriceOverrideAction = "approve_price_override"
+)
+
+// ManualProcessor is the payment processor of orders that were marked as
+// paid by an admin.
+const ManualProcessor = "manual"
+
+// ActionLink is a link an admin can follow to take an action on an order
+// without logging in, like from a notification mail. Every link can only be
+// used once, before it expires, and on behalf of the admin it was issued by.
+type ActionLink struct {
+	InstanceID string `json:"-"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id" sql:"index:idx_action_links_order_id"`
+	Action     string `json:"action"`
+
+	TransactionID string `json:"transaction_id,omitempty"`
+	OverrideID    string `json:"override_id,omitempty"`
+	Amount        uint64 `json:"amount,omitempty"`
+
+	IssuedBy  string     `json:"issued_by,omitempty"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	UsedFrom  string     `json:"used_from,omitempty"`
+	// Result is the outcome of using the link, either "ok" or the error
+	// the action failed with.
+	Result string `json:"result,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the ActionLink model.
+func (ActionLink) TableName() string {
+	return tableName("action_links")
+}
+
+// Expired checks if the link can no longer be used.
+func (l *ActionLink) Expired() bool {
+	return l.ExpiresAt.Before(time.Now())
+}
+
+// UseActionLink marks a link as used from an IP. It returns false if the
+// link was used already.
+func UseActionLink(db *gorm.DB, link *ActionLink, ip string) (bool, error) {
+	now := time.Now()
+	rsp := db.Model(&ActionLink{}).
+		Where("id = ? AND used_at IS NULL", link.ID).
+		UpdateColumns(map[string]interface{}{"used_at": now, "used_from": ip})
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return false, nil
+	}
+	link.UsedAt = &now
+	link.UsedFrom = ip
+	return true, nil
+}
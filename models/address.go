@@ -4,6 +4,15 @@ import (
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// Results of verifying the shipping address of an Order.
+const (
+	AddressVerified   = "verified"
+	AddressUnverified = "unverified"
 )
 
 // AddressRequest is the raw address data
@@ -23,7 +32,9 @@ type AddressRequest struct {
 	LastName  string `json:"last_name,omitempty"`
 }
 
-// Address is a stored address, reusable with an ID.
+// Address is a stored address. The addresses in the address book of a user
+// are reusable with their ID. Orders and subscriptions use snapshots of them,
+// which don't change when the user edits their address book.
 type Address struct {
 	AddressRequest
 
@@ -32,6 +43,18 @@ type Address struct {
 	User   *User  `json:"-"`
 	UserID string `json:"-"`
 
+	// Snapshot is set on the copies of addresses orders and subscriptions
+	// use. They aren't part of the address book of the user.
+	Snapshot bool `json:"-" sql:"index:idx_addresses_snapshot"`
+	// SourceID is the ID of the address in the address book a snapshot was
+	// copied from.
+	SourceID string `json:"source_id,omitempty"`
+	// Backfilled is set on the snapshots the migration to snapshots made of
+	// the addresses orders and subscriptions shared with the address book.
+	// Only those are turned back into the shared addresses when the
+	// migration is rolled back.
+	Backfilled bool `json:"-"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"deleted_at"`
 }
@@ -85,3 +108,140 @@ func (a *AddressRequest) combineNames() {
 		a.LastName = ""
 	}
 }
+
+// addressColumns are the columns orders and subscriptions reference their
+// addresses with.
+var addressColumns = []string{"shipping_address_id", "billing_address_id"}
+
+type addressRefs struct {
+	ID                string
+	ShippingAddressID string
+	BillingAddressID  string
+}
+
+// snapshotAddresses gives the orders and subscriptions that use addresses of
+// the address book snapshots of them, which they used to share with the book
+// before there were snapshots. An order that ships and bills to the same
+// address gets a single snapshot.
+func snapshotAddresses(db *gorm.DB) error {
+	if rsp := db.AutoMigrate(Address{}); rsp.Error != nil {
+		return rsp.Error
+	}
+	shared := "SELECT id FROM " + db.NewScope(Address{}).QuotedTableName() + " WHERE snapshot = ?"
+	for _, model := range []interface{}{&Order{}, &Subscription{}} {
+		refs := []addressRefs{}
+		rsp := db.Unscoped().Model(model).
+			Select("id, shipping_address_id, billing_address_id").
+			Where("shipping_address_id IN ("+shared+") OR billing_address_id IN ("+shared+")", false, false).
+			Scan(&refs)
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+
+		for _, ref := range refs {
+			snapshots := map[string]string{}
+			columns := map[string]interface{}{}
+			for i, id := range []string{ref.ShippingAddressID, ref.BillingAddressID} {
+				if id == "" {
+					continue
+				}
+				snapshotID, ok := snapshots[id]
+				if !ok {
+					source := &Address{}
+					if rsp := db.Unscoped().First(source, "id = ?", id); rsp.RecordNotFound() || source.Snapshot {
+						continue
+					} else if rsp.Error != nil {
+						return rsp.Error
+					}
+					snapshot := &Address{AddressRequest: source.AddressRequest, ID: uuid.NewRandom().String(), UserID: source.UserID, Snapshot: true, SourceID: source.ID, Backfilled: true}
+					if rsp := db.Create(snapshot); rsp.Error != nil {
+						return rsp.Error
+					}
+					snapshotID = snapshot.ID
+					snapshots[id] = snapshotID
+				}
+				columns[addressColumns[i]] = snapshotID
+			}
+			if len(columns) == 0 {
+				continue
+			}
+			if rsp := db.Unscoped().Model(model).Where("id = ?", ref.ID).UpdateColumns(columns); rsp.Error != nil {
+				return rsp.Error
+			}
+		}
+	}
+	return nil
+}
+
+// unsnapshotAddresses points orders and subscriptions back at the addresses
+// of the address book the back-filled snapshots were copied from, and removes
+// those snapshots. The snapshots orders took since, and those of addresses
+// that are gone from the book, are kept.
+func unsnapshotAddresses(db *gorm.DB) error {
+	// snapshots back-filled before they were marked can't be told apart
+	scope := db.NewScope(Address{})
+	if !scope.Dialect().HasColumn(scope.TableName(), "backfilled") {
+		return nil
+	}
+	snapshots := []*Address{}
+	if rsp := db.Unscoped().Where("snapshot = ? AND backfilled = ? AND source_id <> ?", true, true, "").Find(&snapshots); rsp.Error != nil {
+		return rsp.Error
+	}
+	sourceIDs := []string{}
+	for _, snapshot := range snapshots {
+		sourceIDs = append(sourceIDs, snapshot.SourceID)
+	}
+	existing := []string{}
+	if len(sourceIDs) > 0 {
+		if rsp := db.Unscoped().Model(Address{}).Where("id IN (?)", sourceIDs).Pluck("id", &existing); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	sources := map[string]bool{}
+	for _, id := range existing {
+		sources[id] = true
+	}
+
+	for _, snapshot := range snapshots {
+		if !sources[snapshot.SourceID] {
+			continue
+		}
+		for _, model := range []interface{}{&Order{}, &Subscription{}} {
+			for _, column := range addressColumns {
+				if rsp := db.Unscoped().Model(model).Where(column+" = ?", snapshot.ID).UpdateColumn(column, snapshot.SourceID); rsp.Error != nil {
+					return rsp.Error
+				}
+			}
+		}
+		if rsp := db.Unscoped().Delete(snapshot); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// deleteUnusedSnapshot deletes an address snapshot unless an order or a
+// subscription still uses it. Addresses of the address book are kept.
+func deleteUnusedSnapshot(tx *gorm.DB, id string) error {
+	for _, model := range []interface{}{&Order{}, &Subscription{}} {
+		var count int
+		if err := tx.Unscoped().Model(model).Where("shipping_address_id = ? OR billing_address_id = ?", id, id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+	}
+	return tx.Unscoped().Where("id = ? AND snapshot = ?", id, true).Delete(&Address{}).Error
+}
+
+// uniqueStrings returns the non-empty values, without duplicates.
+func uniqueStrings(values ...string) []string {
+	unique := []string{}
+	for _, value := range values {
+		if value != "" && !contains(unique, value) {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,570 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// ArchivedOrder is an Order that was moved out of the orders table by
+// ArchiveOrders to keep that table small. Every column of the order and of
+// the rows that belong to it is stored in Data, so the order can be restored
+// with RestoreArchivedOrder, and only the fields needed to look it up are kept
+// in their own columns.
+type ArchivedOrder struct {
+	InstanceID      string `json:"-" sql:"index:idx_archived_orders_instance_id"`
+	ID              string `json:"id"`
+	UserID          string `json:"user_id,omitempty" sql:"index:idx_archived_orders_user_id"`
+	Email           string `json:"email"`
+	NormalizedEmail string `json:"-" sql:"index:idx_archived_orders_normalized_email"`
+
+	Order *Order `json:"order" sql:"-"`
+	// RawOrder is the JSON of orders archived before Data, which left out the
+	// fields that aren't in the JSON of an order.
+	RawOrder string `json:"-" gorm:"size:65535"`
+	Data     string `json:"-" sql:"type:text"`
+
+	CreatedAt  time.Time `json:"created_at" sql:"index:idx_archived_orders_created_at"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// TableName returns the database table name for the ArchivedOrder model.
+func (ArchivedOrder) TableName() string {
+	return tableName("archived_orders")
+}
+
+// archivedRow holds every column of an archived row by name.
+type archivedRow map[string]json.RawMessage
+
+// archivedOrderData is an order with the rows that belong to it, as they
+// are stored in the archive. Address snapshots are stored even when other
+// orders still use them, so the order can always be shown with its
+// addresses.
+type archivedOrderData struct {
+	Order          archivedRow   `json:"order"`
+	Addresses      []archivedRow `json:"addresses,omitempty"`
+	LineItems      []archivedRow `json:"line_items,omitempty"`
+	PriceItems     []archivedRow `json:"price_items,omitempty"`
+	Downloads      []archivedRow `json:"downloads,omitempty"`
+	Transactions   []archivedRow `json:"transactions,omitempty"`
+	Transfers      []archivedRow `json:"transfers,omitempty"`
+	Returns        []archivedRow `json:"returns,omitempty"`
+	ReturnItems    []archivedRow `json:"return_items,omitempty"`
+	ActionLinks    []archivedRow `json:"action_links,omitempty"`
+	PriceOverrides []archivedRow `json:"price_overrides,omitempty"`
+	FunnelEvents   []archivedRow `json:"funnel_events,omitempty"`
+}
+
+// archivedRecords are the rows of an archived order, loaded into their
+// models.
+type archivedRecords struct {
+	Order          *Order
+	Addresses      []*Address
+	LineItems      []*LineItem
+	PriceItems     []*PriceItem
+	Downloads      []*Download
+	Transactions   []*Transaction
+	Transfers      []*Transfer
+	Returns        []*Return
+	ReturnItems    []*ReturnItem
+	ActionLinks    []*ActionLink
+	PriceOverrides []*PriceOverride
+	FunnelEvents   []*FunnelEvent
+}
+
+// AfterFind database callback.
+func (a *ArchivedOrder) AfterFind() error {
+	if a.Data != "" {
+		records, err := a.records()
+		if err != nil {
+			return err
+		}
+		a.Order = records.order()
+		return nil
+	}
+	if a.RawOrder == "" {
+		return nil
+	}
+	a.Order = &Order{}
+	if err := json.Unmarshal([]byte(a.RawOrder), a.Order); err != nil {
+		return err
+	}
+	a.Order.InstanceID = a.InstanceID
+	return nil
+}
+
+// records loads the rows stored in the archive into their models.
+func (a *ArchivedOrder) records() (*archivedRecords, error) {
+	data := &archivedOrderData{}
+	if err := json.Unmarshal([]byte(a.Data), data); err != nil {
+		return nil, err
+	}
+	records := &archivedRecords{Order: &Order{}}
+	if err := decodeArchivedRow(data.Order, records.Order); err != nil {
+		return nil, err
+	}
+	for _, rows := range []struct {
+		rows  []archivedRow
+		slice interface{}
+	}{
+		{data.Addresses, &records.Addresses},
+		{data.LineItems, &records.LineItems},
+		{data.PriceItems, &records.PriceItems},
+		{data.Downloads, &records.Downloads},
+		{data.Transactions, &records.Transactions},
+		{data.Transfers, &records.Transfers},
+		{data.Returns, &records.Returns},
+		{data.ReturnItems, &records.ReturnItems},
+		{data.ActionLinks, &records.ActionLinks},
+		{data.PriceOverrides, &records.PriceOverrides},
+		{data.FunnelEvents, &records.FunnelEvents},
+	} {
+		if err := decodeArchivedRows(rows.rows, rows.slice); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// order assembles the order of the records like it is loaded from the orders
+// table with its associations.
+func (r *archivedRecords) order() *Order {
+	order := r.Order
+	for _, address := range r.Addresses {
+		if address.ID == order.ShippingAddressID {
+			order.ShippingAddress = *address
+		}
+		if address.ID == order.BillingAddressID {
+			order.BillingAddress = *address
+		}
+	}
+	order.LineItems = r.LineItems
+	for _, item := range order.LineItems {
+		for _, price := range r.PriceItems {
+			if price.LineItemID == item.ID {
+				item.PriceItems = append(item.PriceItems, price)
+			}
+		}
+	}
+	order.Downloads = make([]Download, len(r.Downloads))
+	for i, download := range r.Downloads {
+		order.Downloads[i] = *download
+	}
+	order.Transactions = r.Transactions
+	return order
+}
+
+// ArchiveOrders moves the orders created before a point in time to the
+// archived orders table, batchSize orders at a time. Every order is moved in
+// its own transaction, together with the rows that belong to it. Address
+// snapshots that other orders or subscriptions still use are left in place,
+// and so are the events of the order. It returns the number of archived
+// orders.
+func ArchiveOrders(db *gorm.DB, before time.Time, batchSize int) (int, error) {
+	archived := 0
+	for {
+		orders := []*Order{}
+		rsp := db.
+			Preload("LineItems").
+			Preload("LineItems.PriceItems").
+			Preload("Downloads").
+			Preload("ShippingAddress").
+			Preload("BillingAddress").
+			Preload("Transactions").
+			Where("created_at < ?", before).
+			Order("created_at asc").
+			Limit(batchSize).
+			Find(&orders)
+		if rsp.Error != nil {
+			return archived, rsp.Error
+		}
+
+		for _, order := range orders {
+			if err := archiveOrder(db, order); err != nil {
+				return archived, errors.Wrapf(err, "archiving order %s", order.ID)
+			}
+			archived++
+		}
+		if len(orders) < batchSize {
+			return archived, nil
+		}
+	}
+}
+
+func archiveOrder(db *gorm.DB, order *Order) error {
+	tx := db.Begin()
+	records, err := loadOrderRecords(tx, order)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	data, err := records.encode(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	archive := &ArchivedOrder{
+		InstanceID:      order.InstanceID,
+		ID:              order.ID,
+		UserID:          order.UserID,
+		Email:           order.Email,
+		NormalizedEmail: order.NormalizedEmail,
+		Data:            string(data),
+		CreatedAt:       order.CreatedAt,
+		ArchivedAt:      time.Now(),
+	}
+	if err := tx.Create(archive).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := deleteOrder(tx, order); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// loadOrderRecords loads the rows that belong to an order, which must have
+// its line items, addresses and transactions loaded.
+func loadOrderRecords(tx *gorm.DB, order *Order) (*archivedRecords, error) {
+	records := &archivedRecords{Order: order, LineItems: order.LineItems, Transactions: order.Transactions}
+	for _, item := range order.LineItems {
+		records.PriceItems = append(records.PriceItems, item.PriceItems...)
+	}
+	if order.ShippingAddressID != "" {
+		records.Addresses = append(records.Addresses, &order.ShippingAddress)
+	}
+	if order.BillingAddressID != "" && order.BillingAddressID != order.ShippingAddressID {
+		records.Addresses = append(records.Addresses, &order.BillingAddress)
+	}
+
+	for _, rows := range []interface{}{
+		&records.Downloads,
+		&records.Transfers,
+		&records.Returns,
+		&records.ActionLinks,
+		&records.PriceOverrides,
+		&records.FunnelEvents,
+	} {
+		if err := tx.Unscoped().Where("order_id = ?", order.ID).Find(rows).Error; err != nil {
+			return nil, err
+		}
+	}
+	returnIDs := make([]string, len(records.Returns))
+	for i, ret := range records.Returns {
+		returnIDs[i] = ret.ID
+	}
+	if len(returnIDs) > 0 {
+		if err := tx.Unscoped().Where("return_id IN (?)", returnIDs).Find(&records.ReturnItems).Error; err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// encode stores every column of the records.
+func (r *archivedRecords) encode(db *gorm.DB) ([]byte, error) {
+	data := &archivedOrderData{}
+	var err error
+	if data.Order, err = encodeArchivedRow(db, r.Order); err != nil {
+		return nil, err
+	}
+	for _, rows := range []struct {
+		rows  *[]archivedRow
+		slice interface{}
+	}{
+		{&data.Addresses, r.Addresses},
+		{&data.LineItems, r.LineItems},
+		{&data.PriceItems, r.PriceItems},
+		{&data.Downloads, r.Downloads},
+		{&data.Transactions, r.Transactions},
+		{&data.Transfers, r.Transfers},
+		{&data.Returns, r.Returns},
+		{&data.ReturnItems, r.ReturnItems},
+		{&data.ActionLinks, r.ActionLinks},
+		{&data.PriceOverrides, r.PriceOverrides},
+		{&data.FunnelEvents, r.FunnelEvents},
+	} {
+		slice := reflect.ValueOf(rows.slice)
+		for i := 0; i < slice.Len(); i++ {
+			row, err := encodeArchivedRow(db, slice.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			*rows.rows = append(*rows.rows, row)
+		}
+	}
+	return json.Marshal(data)
+}
+
+// RestoreArchivedOrder moves an archived order back to the orders table,
+// together with the rows that were archived with it.
+func RestoreArchivedOrder(db *gorm.DB, id string) (*Order, error) {
+	tx := db.Begin()
+	archive := &ArchivedOrder{}
+	if rsp := tx.First(archive, "id = ?", id); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	if archive.Data == "" {
+		tx.Rollback()
+		return nil, errors.Errorf("order %s was archived without all its columns and can't be restored", id)
+	}
+	records, err := archive.records()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	rows := []interface{}{records.Order}
+	for _, address := range records.Addresses {
+		var count int
+		if err := tx.Unscoped().Model(&Address{}).Where("id = ?", address.ID).Count(&count).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if count == 0 {
+			rows = append(rows, address)
+		}
+	}
+	for _, slice := range []interface{}{
+		records.LineItems,
+		records.PriceItems,
+		records.Downloads,
+		records.Transactions,
+		records.Transfers,
+		records.Returns,
+		records.ReturnItems,
+		records.ActionLinks,
+		records.PriceOverrides,
+		records.FunnelEvents,
+	} {
+		value := reflect.ValueOf(slice)
+		for i := 0; i < value.Len(); i++ {
+			rows = append(rows, value.Index(i).Interface())
+		}
+	}
+	for _, row := range rows {
+		if err := insertRow(tx, row); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Delete(archive).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return records.order(), nil
+}
+
+// anonymizedOrderColumns are the columns of an order that are cleared when
+// its user is purged.
+var anonymizedOrderColumns = []string{"user_id", "email", "normalized_email", "ip", "session_id", "vat_number", "raw_meta_data"}
+
+// AnonymizeArchivedOrders removes a user from their archived orders, like
+// their orders are anonymized when the user is purged: the orders are kept
+// for the sales records, but the contact details and addresses of the user
+// are removed from them. It returns the number of anonymized orders.
+func AnonymizeArchivedOrders(tx *gorm.DB, userID string) (int64, error) {
+	archives := []*ArchivedOrder{}
+	if err := tx.Where("user_id = ?", userID).Find(&archives).Error; err != nil {
+		return 0, err
+	}
+	for _, archive := range archives {
+		updates := map[string]interface{}{"user_id": "", "email": "", "normalized_email": ""}
+		if archive.Data != "" {
+			data, err := anonymizeArchivedData(archive.Data, userID)
+			if err != nil {
+				return 0, errors.Wrapf(err, "anonymizing archived order %s", archive.ID)
+			}
+			updates["data"] = data
+		}
+		if archive.RawOrder != "" && archive.Order != nil {
+			order := archive.Order
+			order.UserID, order.Email, order.IP, order.VATNumber = "", "", "", ""
+			order.MetaData = nil
+			order.ShippingAddress, order.BillingAddress = Address{}, Address{}
+			for _, trans := range order.Transactions {
+				trans.UserID = ""
+			}
+			raw, err := json.Marshal(order)
+			if err != nil {
+				return 0, errors.Wrapf(err, "anonymizing archived order %s", archive.ID)
+			}
+			updates["raw_order"] = string(raw)
+		}
+		if err := tx.Model(archive).UpdateColumns(updates).Error; err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(archives)), nil
+}
+
+// anonymizeArchivedData clears the columns of the archived order that
+// identify the user, drops their addresses and removes them from the
+// transactions.
+func anonymizeArchivedData(raw string, userID string) (string, error) {
+	data := &archivedOrderData{}
+	if err := json.Unmarshal([]byte(raw), data); err != nil {
+		return "", err
+	}
+	empty := json.RawMessage(`""`)
+	for _, column := range anonymizedOrderColumns {
+		if _, ok := data.Order[column]; ok {
+			data.Order[column] = empty
+		}
+	}
+	addresses := []archivedRow{}
+	for _, address := range data.Addresses {
+		var owner string
+		if err := json.Unmarshal(address["user_id"], &owner); err != nil || owner != userID {
+			addresses = append(addresses, address)
+		}
+	}
+	data.Addresses = addresses
+	for _, trans := range data.Transactions {
+		trans["user_id"] = empty
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// encodeArchivedRow stores the value of every column of a model.
+func encodeArchivedRow(db *gorm.DB, value interface{}) (archivedRow, error) {
+	row := archivedRow{}
+	for _, field := range db.NewScope(value).Fields() {
+		if !field.IsNormal || field.IsIgnored {
+			continue
+		}
+		data, err := json.Marshal(field.Field.Interface())
+		if err != nil {
+			return nil, errors.Wrapf(err, "archiving column %s", field.DBName)
+		}
+		row[field.DBName] = data
+	}
+	return row, nil
+}
+
+// decodeArchivedRow sets the columns of a model from an archived row, and
+// runs its AfterFind callback like when it's loaded from its table.
+func decodeArchivedRow(row archivedRow, value interface{}) error {
+	scope := (&gorm.DB{}).NewScope(value)
+	for _, field := range scope.Fields() {
+		data, ok := row[field.DBName]
+		if !ok || !field.IsNormal || field.IsIgnored {
+			continue
+		}
+		if err := json.Unmarshal(data, field.Field.Addr().Interface()); err != nil {
+			return errors.Wrapf(err, "restoring column %s", field.DBName)
+		}
+	}
+	if callback, ok := value.(interface {
+		AfterFind() error
+	}); ok {
+		return callback.AfterFind()
+	}
+	return nil
+}
+
+// decodeArchivedRows loads archived rows into a pointer to a slice of
+// pointers to models.
+func decodeArchivedRows(rows []archivedRow, slice interface{}) error {
+	value := reflect.ValueOf(slice).Elem()
+	model := value.Type().Elem().Elem()
+	for _, row := range rows {
+		item := reflect.New(model)
+		if err := decodeArchivedRow(row, item.Interface()); err != nil {
+			return err
+		}
+		value.Set(reflect.Append(value, item))
+	}
+	return nil
+}
+
+// insertRow inserts a model with all its columns as they are, without the
+// callbacks and associations of gorm's Create.
+func insertRow(tx *gorm.DB, value interface{}) error {
+	scope := tx.NewScope(value)
+	columns := []string{}
+	placeholders := []string{}
+	values := []interface{}{}
+	for _, field := range scope.Fields() {
+		if !field.IsNormal || field.IsIgnored {
+			continue
+		}
+		columns = append(columns, scope.Quote(field.DBName))
+		placeholders = append(placeholders, "?")
+		values = append(values, field.Field.Interface())
+	}
+	sql := "INSERT INTO " + scope.QuotedTableName() + " (" + strings.Join(columns, ",") + ") VALUES (" + strings.Join(placeholders, ",") + ")"
+	return tx.Exec(sql, values...).Error
+}
+
+// deleteOrder deletes an order for good, together with the rows that belong
+// to it. Address snapshots are deleted unless other orders or subscriptions
+// still use them.
+func deleteOrder(tx *gorm.DB, order *Order) error {
+	lineItemIDs := make([]int64, len(order.LineItems))
+	for i, item := range order.LineItems {
+		lineItemIDs[i] = item.ID
+	}
+	if len(lineItemIDs) > 0 {
+		if err := tx.Unscoped().Where("line_item_id IN (?)", lineItemIDs).Delete(&PriceItem{}).Error; err != nil {
+			return err
+		}
+	}
+	returnIDs := []string{}
+	if err := tx.Unscoped().Model(&Return{}).Where("order_id = ?", order.ID).Pluck("id", &returnIDs).Error; err != nil {
+		return err
+	}
+	if len(returnIDs) > 0 {
+		if err := tx.Unscoped().Where("return_id IN (?)", returnIDs).Delete(&ReturnItem{}).Error; err != nil {
+			return err
+		}
+	}
+	if err := deleteOrderJobs(tx, order); err != nil {
+		return err
+	}
+	for _, model := range []interface{}{
+		&LineItem{}, &Download{}, &Transaction{}, &Transfer{}, &Return{},
+		&ActionLink{}, &PriceOverride{}, &FunnelEvent{},
+	} {
+		if err := tx.Unscoped().Where("order_id = ?", order.ID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Where("id = ?", order.ID).Delete(&Order{}).Error; err != nil {
+		return err
+	}
+	for _, id := range uniqueStrings(order.ShippingAddressID, order.BillingAddressID) {
+		if err := deleteUnusedSnapshot(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOrderJobs deletes the background jobs of an Order. Jobs only
+// reference orders in their payloads, by the ID of the order or of one of its
+// transactions.
+func deleteOrderJobs(tx *gorm.DB, order *Order) error {
+	transactionIDs := []string{}
+	if err := tx.Unscoped().Model(&Transaction{}).Where("order_id = ?", order.ID).Pluck("id", &transactionIDs).Error; err != nil {
+		return err
+	}
+	query := tx.Where("instance_id = ? AND payload LIKE ?", order.InstanceID, `%"order_id":"`+order.ID+`"%`)
+	for _, id := range transactionIDs {
+		query = query.Or("instance_id = ? AND payload LIKE ?", order.InstanceID, `%"transaction_id":"`+id+`"%`)
+	}
+	return query.Delete(&Job{}).Error
+}
@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// CompletedState is the state of a BulkRefund once all of its refunds were attempted
+const CompletedState = "completed"
+
+// BulkRefund refunds a SKU from all the paid orders it was sold in over a period
+// of time, e.g. for a product recall. The items hold the report of each refund.
+type BulkRefund struct {
+	InstanceID string `json:"-"`
+	ID         string `json:"id"`
+
+	Sku  string     `json:"sku"`
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+
+	Status string            `json:"status"`
+	Items  []*BulkRefundItem `json:"items"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// TableName returns the database table name for the BulkRefund model.
+func (BulkRefund) TableName() string {
+	return tableName("bulk_refunds")
+}
+
+// BulkRefundItem is the refund of the recalled line items of a single order.
+type BulkRefundItem struct {
+	ID           int64  `json:"-"`
+	BulkRefundID string `json:"-"`
+
+	OrderID       string `json:"order_id"`
+	TransactionID string `json:"transaction_id"`
+	RefundID      string `json:"refund_id,omitempty"`
+
+	Quantity uint64 `json:"quantity"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+
+	Status             string `json:"status"`
+	FailureDescription string `json:"failure_description,omitempty"`
+}
+
+// TableName returns the database table name for the BulkRefundItem model.
+func (BulkRefundItem) TableName() string {
+	return tableName("bulk_refund_items")
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"fmt"
+	"strings"
+
 	// this is where we do the connections
 	_ "github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/dialers/mysql"
 	_ "github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/dialers/postgres"
@@ -20,12 +23,65 @@ import (
 // want table names to collide.
 var Namespace string
 
+// dialects are the SQL dialects of the supported database drivers.
+var dialects = map[string]string{
+	"sqlite3":          "sqlite3",
+	"mysql":            "mysql",
+	"postgres":         "postgres",
+	"cloudsqlpostgres": "postgres",
+}
+
+// Dialect returns the SQL dialect of a database configuration: the configured
+// one, or the one of its driver. Only SQLite, MySQL and PostgreSQL are
+// supported.
+func Dialect(config *conf.DBConfiguration) (string, error) {
+	dialect := config.Dialect
+	if dialect == "" {
+		dialect = dialects[config.Driver]
+	}
+	switch dialect {
+	case "sqlite3", "mysql", "postgres":
+		return dialect, nil
+	case "":
+		return "", fmt.Errorf("unsupported database driver %q, use sqlite3, mysql or postgres", config.Driver)
+	}
+	return "", fmt.Errorf("unsupported database dialect %q, use sqlite3, mysql or postgres", dialect)
+}
+
+// ForUpdate locks the rows a query loads until the end of its transaction, so
+// concurrent writers wait for it. SQLite has no row locks and takes a lock on
+// the whole database for writes instead.
+func ForUpdate(tx *gorm.DB) *gorm.DB {
+	if tx.NewScope(nil).Dialect().GetName() == "sqlite3" {
+		return tx
+	}
+	return tx.Set("gorm:query_option", "FOR UPDATE")
+}
+
+// connectionURL adds the options GoCommerce depends on to a database URL.
+// MySQL only returns timestamps as times with parseTime.
+func connectionURL(dialect, url string) string {
+	if dialect != "mysql" || strings.Contains(url, "parseTime=") {
+		return url
+	}
+	if strings.Contains(url, "?") {
+		return url + "&parseTime=true"
+	}
+	return url + "?parseTime=true"
+}
+
+func open(config *conf.GlobalConfiguration, url string) (*gorm.DB, error) {
+	dialect, err := Dialect(&config.DB)
+	if err != nil {
+		return nil, err
+	}
+	config.DB.Dialect = dialect
+	return gorm.Open(dialect, config.DB.Driver, connectionURL(dialect, url))
+}
+
 // Connect will connect to that storage engine
 func Connect(config *conf.GlobalConfiguration) (*gorm.DB, error) {
-	if config.DB.Dialect == "" {
-		config.DB.Dialect = config.DB.Driver
-	}
-	db, err := gorm.Open(config.DB.Dialect, config.DB.Driver, config.DB.URL)
+	db, err := open(config, config.DB.URL)
 	if err != nil {
 		return nil, errors.Wrap(err, "opening database connection")
 	}
@@ -40,7 +96,7 @@ func Connect(config *conf.GlobalConfiguration) (*gorm.DB, error) {
 	}
 
 	if config.DB.Automigrate {
-		if err := AutoMigrate(db); err != nil {
+		if _, err := Migrate(db); err != nil {
 			return nil, errors.Wrap(err, "migrating tables")
 		}
 	}
@@ -48,6 +104,22 @@ func Connect(config *conf.GlobalConfiguration) (*gorm.DB, error) {
 	return db, nil
 }
 
+// ConnectReplica connects to the read replica of the database. It returns nil
+// without a replica configured.
+func ConnectReplica(config *conf.GlobalConfiguration) (*gorm.DB, error) {
+	if config.DB.ReplicaURL == "" {
+		return nil, nil
+	}
+	db, err := open(config, config.DB.ReplicaURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening replica connection")
+	}
+	if err := db.DB().Ping(); err != nil {
+		return nil, errors.Wrap(err, "checking replica connection")
+	}
+	return db, nil
+}
+
 func tableName(defaultName string) string {
 	if Namespace != "" {
 		return Namespace + "_" + defaultName
@@ -55,21 +127,47 @@ func tableName(defaultName string) string {
 	return defaultName
 }
 
-// AutoMigrate runs the gorm automigration for all models
-func AutoMigrate(db *gorm.DB) error {
-	db = db.AutoMigrate(Address{},
+// allModels are the models with a table of their own.
+func allModels() []interface{} {
+	return []interface{}{
+		Address{},
 		LineItem{},
 		AddonItem{},
 		PriceItem{},
 		Hook{},
+		Job{},
 		Download{},
 		Order{},
 		OrderNote{},
 		Transaction{},
+		Transfer{},
+		BulkRefund{},
+		BulkRefundItem{},
+		PriceOverride{},
+		Return{},
+		ReturnItem{},
+		Inventory{},
 		User{},
+		UserEmailChange{},
 		Event{},
 		Instance{},
 		InvoiceNumber{},
-	)
-	return db.Error
+		ArchivedOrder{},
+		IdempotencyKey{},
+		GiftCard{},
+		ActionLink{},
+		Subscription{},
+		CustomerGroup{},
+		ExchangeRate{},
+		FunnelEvent{},
+		CouponUsage{},
+	}
+}
+
+// AutoMigrate runs the gorm automigration for all models
+func AutoMigrate(db *gorm.DB) error {
+	if rsp := db.AutoMigrate(allModels()...); rsp.Error != nil {
+		return rsp.Error
+	}
+	return backfillNormalizedEmails(db)
 }
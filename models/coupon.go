@@ -2,8 +2,10 @@ package models
 
 import (
 	"math"
-	"strconv"
+	"strings"
 	"time"
+
+	"github.com/netlify/gocommerce/calculator"
 )
 
 // FixedAmount represents an amount and currency pair
@@ -18,6 +20,10 @@ type Coupon struct {
 
 	StartDate *time.Time `json:"start_date,omitempty"`
 	EndDate   *time.Time `json:"end_date,omitempty"`
+	// StartsAt and EndsAt are the validity window of the coupon. They take
+	// precedence over StartDate and EndDate.
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
 
 	Percentage  uint64         `json:"percentage,omitempty"`
 	FixedAmount []*FixedAmount `json:"fixed,omitempty"`
@@ -25,14 +31,51 @@ type Coupon struct {
 	ProductTypes []string               `json:"product_types,omitempty"`
 	Products     []string               `json:"products,omitempty"`
 	Claims       map[string]interface{} `json:"claims,omitempty"`
+
+	Gift *CouponGift `json:"gift,omitempty"`
+
+	// Minimum is the subtotal an order must reach in its currency for the
+	// coupon to apply.
+	Minimum []*FixedAmount `json:"minimum,omitempty"`
+
+	// MaxRedemptions is how many paid orders can use the coupon, and
+	// MaxRedemptionsPerUser how many of those can be of the same buyer.
+	// Zero means no limit.
+	MaxRedemptions        uint64 `json:"max_redemptions,omitempty"`
+	MaxRedemptionsPerUser uint64 `json:"max_redemptions_per_user,omitempty"`
+
+	// Exclusive coupons don't stack with other discounts: items the coupon
+	// applies to get no member discounts, and orders it applies to get no
+	// promotions or spend tiers.
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+// CouponGift is a product that is added for free to the orders a coupon
+// applies to.
+type CouponGift struct {
+	// Path is the page of the site with the product metadata of the gift.
+	Path     string `json:"path"`
+	Sku      string `json:"sku,omitempty"`
+	Quantity uint64 `json:"quantity,omitempty"`
+
+	// Minimum is the subtotal an order must reach in its currency to get
+	// the gift.
+	Minimum []*FixedAmount `json:"minimum,omitempty"`
 }
 
 // Valid returns whether a coupon is valid or not.
 func (c *Coupon) Valid() bool {
-	if c.StartDate != nil && time.Now().Before(*c.StartDate) {
+	start, end := c.StartDate, c.EndDate
+	if c.StartsAt != nil {
+		start = c.StartsAt
+	}
+	if c.EndsAt != nil {
+		end = c.EndsAt
+	}
+	if start != nil && time.Now().Before(*start) {
 		return false
 	}
-	if c.EndDate != nil && time.Now().After(*c.EndDate) {
+	if end != nil && time.Now().After(*end) {
 		return false
 	}
 	return true
@@ -76,12 +119,36 @@ func (c *Coupon) ValidForType(productType string) bool {
 	return false
 }
 
-// ValidForPrice returns whether a coupon applies to a specific amount.
+// ValidForPrice returns whether a coupon applies to an order with a subtotal
+// in a currency, which must reach the minimum of the currency if there's one.
 func (c *Coupon) ValidForPrice(currency string, price uint64) bool {
-	// TODO: Support for coupons based on amount
+	if c == nil {
+		return true
+	}
+	for _, minimum := range c.Minimum {
+		if strings.EqualFold(minimum.Currency, currency) {
+			amount, _ := calculator.ParseAmount(minimum.Amount, currency)
+			return price >= amount
+		}
+	}
 	return true
 }
 
+// ValidForItems returns whether the subtotal of line items reaches the
+// minimum of the coupon in a currency.
+func (c *Coupon) ValidForItems(items []*LineItem, currency string) bool {
+	var subtotal uint64
+	for _, item := range items {
+		subtotal += item.PriceInLowestUnit() * item.GetQuantity()
+	}
+	return c.ValidForPrice(currency, subtotal)
+}
+
+// Stackable returns whether the coupon combines with other discounts.
+func (c *Coupon) Stackable() bool {
+	return c == nil || !c.Exclusive
+}
+
 // PercentageDiscount returns the percentage discount of a Coupon.
 func (c *Coupon) PercentageDiscount() uint64 {
 	return c.Percentage
@@ -92,8 +159,8 @@ func (c *Coupon) FixedDiscount(currency string) uint64 {
 	if c.FixedAmount != nil {
 		for _, discount := range c.FixedAmount {
 			if discount.Currency == currency {
-				amount, _ := strconv.ParseFloat(discount.Amount, 64)
-				return rint(amount * 100)
+				amount, _ := calculator.ParseAmount(discount.Amount, currency)
+				return amount
 			}
 		}
 	}
@@ -101,6 +168,29 @@ func (c *Coupon) FixedDiscount(currency string) uint64 {
 	return 0
 }
 
+// QualifiesForGift returns whether an order with the line items and subtotal
+// gets the gift of a Coupon. At least one of the line items must be one the
+// coupon applies to.
+func (c *Coupon) QualifiesForGift(items []*LineItem, currency string, subtotal uint64) bool {
+	if c == nil || c.Gift == nil || c.Gift.Path == "" {
+		return false
+	}
+	for _, minimum := range c.Gift.Minimum {
+		if strings.EqualFold(minimum.Currency, currency) {
+			amount, _ := calculator.ParseAmount(minimum.Amount, currency)
+			if subtotal < amount {
+				return false
+			}
+		}
+	}
+	for _, item := range items {
+		if !item.Gift && c.ValidForProduct(item.Sku) && c.ValidForType(item.Type) {
+			return true
+		}
+	}
+	return false
+}
+
 // Nopes - no `round` method in go
 // See https://gist.github.com/siddontang/1806573b9a8574989ccb
 func rint(x float64) uint64 {
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrCouponExhausted is returned when redeeming a coupon that was redeemed as
+// often as it can be, in total or by the buyer.
+var ErrCouponExhausted = errors.New("coupon was redeemed the maximum number of times")
+
+// CouponUsage counts the paid orders that redeemed a coupon. There is a count
+// of all orders, with an empty UserKey, and one for each buyer.
+type CouponUsage struct {
+	ID          int64  `json:"-"`
+	InstanceID  string `json:"-" sql:"unique_index:idx_coupon_usages_code_user"`
+	Code        string `json:"code" sql:"unique_index:idx_coupon_usages_code_user"`
+	UserKey     string `json:"-" sql:"unique_index:idx_coupon_usages_code_user"`
+	Redemptions uint64 `json:"redemptions"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the CouponUsage model.
+func (CouponUsage) TableName() string {
+	return tableName("coupon_usages")
+}
+
+// couponUserKey identifies the buyer of an Order for the per-user limit of a
+// coupon, by the user or else by the email of guests.
+func couponUserKey(order *Order) string {
+	if order.UserID != "" {
+		return "user:" + order.UserID
+	}
+	if order.Email != "" {
+		return "email:" + NormalizeEmail(order.Email)
+	}
+	return ""
+}
+
+// CouponRedemptions returns how often a coupon was redeemed in total, and by
+// the buyer of an Order.
+func CouponRedemptions(db *gorm.DB, order *Order) (total uint64, user uint64, err error) {
+	if total, err = couponRedemptions(db, order.InstanceID, order.CouponCode, ""); err != nil {
+		return 0, 0, err
+	}
+	if key := couponUserKey(order); key != "" {
+		if user, err = couponRedemptions(db, order.InstanceID, order.CouponCode, key); err != nil {
+			return 0, 0, err
+		}
+	}
+	return total, user, nil
+}
+
+func couponRedemptions(db *gorm.DB, instanceID, code, userKey string) (uint64, error) {
+	usage := &CouponUsage{}
+	if rsp := db.Where("instance_id = ? AND code = ? AND user_key = ?", instanceID, code, userKey).First(usage); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return 0, nil
+		}
+		return 0, rsp.Error
+	}
+	return usage.Redemptions, nil
+}
+
+// Exhausted returns whether a coupon redeemed total times, and user times by
+// a buyer, can't be redeemed by the buyer again.
+func (c *Coupon) Exhausted(total, user uint64) bool {
+	return (c.MaxRedemptions > 0 && total >= c.MaxRedemptions) ||
+		(c.MaxRedemptionsPerUser > 0 && user >= c.MaxRedemptionsPerUser)
+}
+
+// RedeemCoupon counts a redemption of the coupon of an Order, and returns
+// ErrCouponExhausted if that exceeds one of its limits. The counts are only
+// raised while they are below the limits, so concurrent payments can't redeem
+// a coupon more often than it allows. Run it in the transaction of the
+// payment, which is rolled back when it fails.
+func RedeemCoupon(db *gorm.DB, order *Order) error {
+	if order.Coupon == nil || order.CouponCode == "" {
+		return nil
+	}
+	if err := redeemCoupon(db, order.InstanceID, order.CouponCode, "", order.Coupon.MaxRedemptions); err != nil {
+		return err
+	}
+	if key := couponUserKey(order); key != "" {
+		return redeemCoupon(db, order.InstanceID, order.CouponCode, key, order.Coupon.MaxRedemptionsPerUser)
+	}
+	return nil
+}
+
+func redeemCoupon(db *gorm.DB, instanceID, code, userKey string, max uint64) error {
+	usage := &CouponUsage{}
+	if rsp := db.Where("instance_id = ? AND code = ? AND user_key = ?", instanceID, code, userKey).First(usage); rsp.RecordNotFound() {
+		usage = &CouponUsage{InstanceID: instanceID, Code: code, UserKey: userKey}
+		if rsp := db.Create(usage); rsp.Error != nil {
+			return rsp.Error
+		}
+	} else if rsp.Error != nil {
+		return rsp.Error
+	}
+	query := db.Model(&CouponUsage{}).Where("id = ?", usage.ID)
+	if max > 0 {
+		query = query.Where("redemptions < ?", max)
+	}
+	rsp := query.UpdateColumn("redemptions", gorm.Expr("redemptions + 1"))
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return ErrCouponExhausted
+	}
+	return nil
+}
+
+// ReleaseCoupon takes back the redemption of the coupon of an Order, when its
+// payment failed.
+func ReleaseCoupon(db *gorm.DB, order *Order) error {
+	if order.Coupon == nil || order.CouponCode == "" {
+		return nil
+	}
+	keys := []string{""}
+	if key := couponUserKey(order); key != "" {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		rsp := db.Model(&CouponUsage{}).
+			Where("instance_id = ? AND code = ? AND user_key = ? AND redemptions > 0", order.InstanceID, order.CouponCode, key).
+			UpdateColumn("redemptions", gorm.Expr("redemptions - 1"))
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// CustomerGroup is the membership of a user in a customer group, like
+// wholesale or VIP. Groups are managed by admins, and price lists, member
+// discounts and promotions can be limited to them.
+type CustomerGroup struct {
+	InstanceID string `json:"-"`
+	ID         int64  `json:"-"`
+	UserID     string `json:"user_id" sql:"index:idx_customer_groups_user"`
+	Name       string `json:"name"`
+
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the CustomerGroup model.
+func (CustomerGroup) TableName() string {
+	return tableName("customer_groups")
+}
+
+// GetCustomerGroups returns the names of the customer groups of a user.
+func GetCustomerGroups(db *gorm.DB, instanceID, userID string) ([]string, error) {
+	groups := []string{}
+	rsp := db.Model(&CustomerGroup{}).Where("instance_id = ? AND user_id = ?", instanceID, userID).Order("name asc").Pluck("name", &groups)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return groups, nil
+}
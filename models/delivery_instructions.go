@@ -0,0 +1,44 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxDeliveryInstructionsLength is the maximum number of characters of the
+// delivery instructions of an order. Carriers cut off longer notes on their
+// labels.
+const MaxDeliveryInstructionsLength = 500
+
+// CleanDeliveryInstructions returns delivery instructions as plain text that
+// can be printed on packing slips and passed to carriers: control and
+// invisible characters and markup brackets are removed, runs of whitespace
+// become single spaces and empty lines are dropped. It fails when the
+// instructions are too long.
+func CleanDeliveryInstructions(instructions string) (string, error) {
+	lines := []string{}
+	for _, line := range strings.Split(strings.Replace(instructions, "\r\n", "\n", -1), "\n") {
+		line = strings.Map(func(r rune) rune {
+			switch {
+			case r == '\t' || r == '\r':
+				return ' '
+			case r == '<' || r == '>':
+				return -1
+			case unicode.IsControl(r) || unicode.In(r, unicode.Cf) || r == utf8.RuneError:
+				return -1
+			}
+			return r
+		}, line)
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	cleaned := strings.Join(lines, "\n")
+	if utf8.RuneCountInString(cleaned) > MaxDeliveryInstructionsLength {
+		return "", fmt.Errorf("Delivery instructions can't be longer than %d characters", MaxDeliveryInstructionsLength)
+	}
+	return cleaned, nil
+}
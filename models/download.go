@@ -20,6 +20,16 @@ type Download struct {
 
 	DownloadCount uint64 `json:"downloads"`
 
+	// MaxDownloads, ExpiryDays and PinIP limit the access to the asset, as
+	// set in the metadata of the product. MaxDownloads is how often it can
+	// be downloaded, ExpiryDays for how many days after the order was paid,
+	// and PinIP ties it to the IP address it was first downloaded from,
+	// which is kept in PinnedIP. Zero values don't limit anything.
+	MaxDownloads uint64 `json:"max_downloads,omitempty"`
+	ExpiryDays   int    `json:"expiry_days,omitempty"`
+	PinIP        bool   `json:"pin_ip,omitempty"`
+	PinnedIP     string `json:"-"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-" sql:"index:idx_downloads_deleted_at"`
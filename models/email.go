@@ -0,0 +1,116 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// StripEmailPlusTags makes NormalizeEmail remove the +tag of the local part of
+// an email, so foo+shop@example.com and foo@example.com are the same customer.
+var StripEmailPlusTags bool
+
+// NormalizeEmail returns the form of an email orders and users are matched by.
+// It is lowercased and trimmed, and with StripEmailPlusTags set any +tag is
+// removed.
+func NormalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if StripEmailPlusTags {
+		at := strings.LastIndex(email, "@")
+		if plus := strings.Index(email, "+"); plus > 0 && plus < at {
+			email = email[:plus] + email[at:]
+		}
+	}
+	return email
+}
+
+// DuplicateEmail is a group of users of an instance that have the same
+// normalized email, and should probably be merged.
+type DuplicateEmail struct {
+	InstanceID      string
+	NormalizedEmail string
+	Users           []*User
+}
+
+// FindDuplicateEmails returns the users that share a normalized email with
+// another user of the same instance.
+func FindDuplicateEmails(db *gorm.DB) ([]*DuplicateEmail, error) {
+	rows, err := db.Model(&User{}).
+		Select("instance_id, normalized_email").
+		Where("normalized_email <> ''").
+		Group("instance_id, normalized_email").
+		Having("count(*) > 1").
+		Order("instance_id, normalized_email").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	duplicates := []*DuplicateEmail{}
+	for rows.Next() {
+		d := &DuplicateEmail{}
+		if err := rows.Scan(&d.InstanceID, &d.NormalizedEmail); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		duplicates = append(duplicates, d)
+	}
+	rows.Close()
+
+	for _, d := range duplicates {
+		err := db.
+			Where("instance_id = ? AND normalized_email = ?", d.InstanceID, d.NormalizedEmail).
+			Order("created_at").
+			Find(&d.Users).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range d.Users {
+			if err := db.Model(&Order{}).Where("user_id = ?", user.ID).Count(&user.OrderCount).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+	return duplicates, nil
+}
+
+// backfillNormalizedEmails sets the normalized email of the orders and users
+// saved before emails were normalized.
+func backfillNormalizedEmails(db *gorm.DB) error {
+	const batchSize = 500
+	for _, model := range []interface{}{Order{}, User{}} {
+		table := db.NewScope(model).TableName()
+		lastID := ""
+		for {
+			rows, err := db.Table(table).
+				Select("id, email").
+				Where("(normalized_email = '' OR normalized_email IS NULL) AND email <> '' AND id > ?", lastID).
+				Order("id").
+				Limit(batchSize).
+				Rows()
+			if err != nil {
+				return err
+			}
+			emails := map[string]string{}
+			for rows.Next() {
+				var id, email string
+				if err := rows.Scan(&id, &email); err != nil {
+					rows.Close()
+					return err
+				}
+				emails[id] = email
+				lastID = id
+			}
+			rows.Close()
+
+			for id, email := range emails {
+				if err := db.Table(table).Where("id = ?", id).UpdateColumn("normalized_email", NormalizeEmail(email)).Error; err != nil {
+					return err
+				}
+			}
+			if len(emails) < batchSize {
+				break
+			}
+		}
+	}
+	return nil
+}
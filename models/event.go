@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"strings"
 	"time"
 
@@ -22,14 +23,44 @@ type Event struct {
 	Type    string `json:"type"`
 	Changes string `json:"data"`
 
+	// Diff holds the values of the changed fields before and after the event.
+	Diff    map[string]Change `json:"diff,omitempty" sql:"-"`
+	RawDiff string            `json:"-" gorm:"size:65535"`
+
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Change is the value of a field of an order before and after an event.
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
 // TableName returns the database table name for the Event model.
 func (Event) TableName() string {
 	return tableName("events")
 }
 
+// AfterFind database callback.
+func (e *Event) AfterFind() error {
+	if e.RawDiff != "" {
+		return json.Unmarshal([]byte(e.RawDiff), &e.Diff)
+	}
+	return nil
+}
+
+// BeforeSave database callback.
+func (e *Event) BeforeSave() error {
+	if e.Diff != nil {
+		data, err := json.Marshal(e.Diff)
+		if err != nil {
+			return err
+		}
+		e.RawDiff = string(data)
+	}
+	return nil
+}
+
 // EventType is the type of change that occurred.
 type EventType string
 
@@ -40,18 +71,58 @@ const (
 	EventUpdated EventType = "updated"
 	// EventDeleted is the EventType when an order is deleted.
 	EventDeleted EventType = "deleted"
+	// EventTransitioned is the EventType when the state or fulfillment state
+	// of an order changes. Its data is "field:from->to".
+	EventTransitioned EventType = "transitioned"
+	// EventPaid is the EventType when an order is paid.
+	EventPaid EventType = "paid"
+	// EventRefunded is the EventType when a payment of an order is refunded.
+	EventRefunded EventType = "refunded"
+	// EventClaimed is the EventType when an anonymous order is claimed by a
+	// user with the same email.
+	EventClaimed EventType = "claimed"
+	// EventDisputed is the EventType when the buyer disputes a payment of an
+	// order with their bank.
+	EventDisputed EventType = "disputed"
+	// EventBackordered is the EventType when an order is paid while some of
+	// its items are out of stock.
+	EventBackordered EventType = "backordered"
+	// EventReassigned is the EventType when an admin moves an order to
+	// another user.
+	EventReassigned EventType = "reassigned"
+	// EventAutomated is the EventType when an automation of the site
+	// settings took its actions on an order. Its data is the name of the
+	// automation.
+	EventAutomated EventType = "automated"
+	// EventAbandoned is the EventType when an order that stayed unpaid for
+	// too long is cancelled.
+	EventAbandoned EventType = "abandoned"
 )
 
 // LogEvent logs a new event
 func LogEvent(db *gorm.DB, ip, userID, orderID string, eventType EventType, changes []string) {
+	LogEventWithDiff(db, ip, userID, orderID, eventType, changes, nil)
+}
+
+// LogEventWithDiff logs a new event together with the old and new values of
+// the changed fields.
+func LogEventWithDiff(db *gorm.DB, ip, userID, orderID string, eventType EventType, changes []string, diff map[string]Change) {
 	event := &Event{
 		IP:      ip,
 		UserID:  userID,
 		OrderID: orderID,
 		Type:    string(eventType),
+		Diff:    diff,
 	}
 	if changes != nil {
 		event.Changes = strings.Join(changes, ",")
 	}
 	db.Create(event)
 }
+
+// LogTransition logs the change of a state field of an order
+func LogTransition(db *gorm.DB, ip, userID, orderID, field, from, to string) {
+	LogEventWithDiff(db, ip, userID, orderID, EventTransitioned, []string{field + ":" + from + "->" + to}, map[string]Change{
+		field: {From: from, To: to},
+	})
+}
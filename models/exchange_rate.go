@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/rates"
+)
+
+// exchangeRatesPeriod is how often the source of exchange rates is checked
+// for the rates of a new day.
+const exchangeRatesPeriod = time.Hour
+
+// ExchangeRate is the rate of a currency against the base currency of its
+// source on a day. Rates are shared by all instances.
+type ExchangeRate struct {
+	ID       int64   `json:"-"`
+	Source   string  `json:"source" sql:"unique_index:idx_exchange_rates_source_date"`
+	Date     string  `json:"date" sql:"unique_index:idx_exchange_rates_source_date"`
+	Currency string  `json:"currency" sql:"unique_index:idx_exchange_rates_source_date"`
+	Base     string  `json:"base"`
+	Rate     float64 `json:"rate"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the ExchangeRate model.
+func (ExchangeRate) TableName() string {
+	return tableName("exchange_rates")
+}
+
+// SaveExchangeRates stores the rates of a day, replacing the ones stored for
+// it before.
+func SaveExchangeRates(db *gorm.DB, source string, snapshot *rates.Snapshot) error {
+	tx := db.Begin()
+	if rsp := tx.Where("source = ? AND date = ?", source, snapshot.Date).Delete(ExchangeRate{}); rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+	for currency, rate := range snapshot.Rates {
+		if currency == snapshot.Base {
+			continue
+		}
+		row := &ExchangeRate{Source: source, Date: snapshot.Date, Currency: currency, Base: snapshot.Base, Rate: rate}
+		if rsp := tx.Create(row); rsp.Error != nil {
+			tx.Rollback()
+			return rsp.Error
+		}
+	}
+	return tx.Commit().Error
+}
+
+// GetExchangeRates returns the rates of a source in effect on a day, which are
+// the latest ones on or before it since there are none for weekends and
+// holidays. It returns nil if there are none.
+func GetExchangeRates(db *gorm.DB, source, date string) (*rates.Snapshot, error) {
+	latest := &ExchangeRate{}
+	if rsp := db.Where("source = ? AND date <= ?", source, date).Order("date desc").First(latest); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+
+	rows := []*ExchangeRate{}
+	if rsp := db.Where("source = ? AND date = ?", source, latest.Date).Find(&rows); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	snapshot := &rates.Snapshot{Date: latest.Date, Base: latest.Base, Rates: map[string]float64{}}
+	for _, row := range rows {
+		snapshot.Rates[row.Currency] = row.Rate
+	}
+	return snapshot, nil
+}
+
+// RunExchangeRates fetches the rates of the source in the background and
+// stores the days that are new.
+func RunExchangeRates(db *gorm.DB, source rates.Source, log *logrus.Entry) {
+	go func() {
+		for {
+			if err := fetchExchangeRates(db, source, log); err != nil {
+				log.WithError(err).Error("Error fetching exchange rates")
+			}
+			time.Sleep(exchangeRatesPeriod)
+		}
+	}()
+}
+
+func fetchExchangeRates(db *gorm.DB, source rates.Source, log *logrus.Entry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	snapshots, err := source.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		// rates of today can still change during the day, older ones don't
+		if snapshot.Date < time.Now().UTC().Format(rates.DateFormat) {
+			count := 0
+			if rsp := db.Model(ExchangeRate{}).Where("source = ? AND date = ?", source.Name(), snapshot.Date).Count(&count); rsp.Error != nil {
+				return rsp.Error
+			}
+			if count > 0 {
+				continue
+			}
+		}
+		if err := SaveExchangeRates(db, source.Name(), snapshot); err != nil {
+			return err
+		}
+		log.WithField("date", snapshot.Date).Debug("Stored exchange rates")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Steps of a checkout, in the order buyers go through them.
+const (
+	CartPreviewedStep    = "cart_previewed"
+	OrderCreatedStep     = "order_created"
+	PaymentAttemptedStep = "payment_attempted"
+	PaidStep             = "paid"
+)
+
+// FunnelSteps are the steps of a checkout, in order.
+var FunnelSteps = []string{CartPreviewedStep, OrderCreatedStep, PaymentAttemptedStep, PaidStep}
+
+// FunnelEvent records when a checkout first reached a step. Checkouts are
+// identified by the session ID the checkout page sends with the cart and the
+// order, or by the ID of the order without a session.
+type FunnelEvent struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_funnel_events_checkout_step"`
+	CheckoutID string `json:"checkout_id" sql:"unique_index:idx_funnel_events_checkout_step"`
+	Step       string `json:"step" sql:"unique_index:idx_funnel_events_checkout_step"`
+	OrderID    string `json:"order_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at" sql:"index:idx_funnel_events_created_at"`
+}
+
+// TableName returns the database table name for the FunnelEvent model.
+func (FunnelEvent) TableName() string {
+	return tableName("funnel_events")
+}
+
+// CheckoutID returns the ID of the checkout the Order was created in.
+func (o *Order) CheckoutID() string {
+	if o.SessionID != "" {
+		return o.SessionID
+	}
+	return o.ID
+}
+
+// RecordFunnelStep records that a checkout reached a step, unless it was
+// recorded before. The insert skips steps that are recorded already instead
+// of failing on the unique index, which would abort the transaction of the
+// order it's recorded in on Postgres when two requests race.
+func RecordFunnelStep(db *gorm.DB, instanceID, checkoutID, orderID, step string) error {
+	scope := db.NewScope(FunnelEvent{})
+	insert, conflict := "INSERT", ""
+	switch scope.Dialect().GetName() {
+	case "postgres":
+		conflict = " ON CONFLICT DO NOTHING"
+	case "mysql":
+		insert = "INSERT IGNORE"
+	case "sqlite3":
+		insert = "INSERT OR IGNORE"
+	}
+	return db.Exec(insert+" INTO "+scope.QuotedTableName()+" (instance_id, checkout_id, step, order_id, created_at) VALUES (?, ?, ?, ?, ?)"+conflict,
+		instanceID, checkoutID, step, orderID, time.Now()).Error
+}
+
+// RecordOrderFunnelStep records that the checkout of an Order reached a step.
+func RecordOrderFunnelStep(db *gorm.DB, order *Order, step string) error {
+	return RecordFunnelStep(db, order.InstanceID, order.CheckoutID(), order.ID, step)
+}
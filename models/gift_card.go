@@ -0,0 +1,77 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// GiftCardProcessor is the payment processor of orders that were paid for
+// with a gift card alone.
+const GiftCardProcessor = "gift_card"
+
+// GiftCard is a code with a balance that can be spent on orders in its
+// currency. Payments draw the balance down, and refunds of those payments
+// credit it back.
+type GiftCard struct {
+	InstanceID string `json:"-" sql:"unique_index:idx_gift_cards_code"`
+	ID         string `json:"id"`
+	Code       string `json:"code" sql:"unique_index:idx_gift_cards_code"`
+
+	Currency       string     `json:"currency"`
+	InitialBalance uint64     `json:"initial_balance"`
+	Balance        uint64     `json:"balance"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+
+	Note     string `json:"note,omitempty"`
+	IssuedBy string `json:"issued_by,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the GiftCard model.
+func (GiftCard) TableName() string {
+	return tableName("gift_cards")
+}
+
+// Expired checks if the gift card can no longer be used.
+func (g *GiftCard) Expired() bool {
+	return g.ExpiresAt != nil && g.ExpiresAt.Before(time.Now())
+}
+
+// GetGiftCard returns the GiftCard with a code, or nil if there is none.
+func GetGiftCard(db *gorm.DB, instanceID, code string) (*GiftCard, error) {
+	card := &GiftCard{}
+	if rsp := db.Where("instance_id = ? AND code = ?", instanceID, code).First(card); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return card, nil
+}
+
+// RedeemGiftCard takes an amount off the balance of a gift card. It returns
+// false without changing anything if the balance is lower than the amount,
+// like when the card was spent by another payment in the meantime.
+func RedeemGiftCard(db *gorm.DB, card *GiftCard, amount uint64) (bool, error) {
+	rsp := db.Model(&GiftCard{}).
+		Where("id = ? AND balance >= ?", card.ID, amount).
+		UpdateColumn("balance", gorm.Expr("balance - ?", amount))
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return false, nil
+	}
+	card.Balance -= amount
+	return true, nil
+}
+
+// CreditGiftCard adds an amount to the balance of a gift card.
+func CreditGiftCard(db *gorm.DB, cardID string, amount uint64) error {
+	return db.Model(&GiftCard{}).
+		Where("id = ?", cardID).
+		UpdateColumn("balance", gorm.Expr("balance + ?", amount)).Error
+}
@@ -2,9 +2,13 @@ package models
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,6 +16,8 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/webhooks"
 )
 
 const maxConcurrentHooks = 5
@@ -19,33 +25,49 @@ const maxRetries = 5
 const retryPeriod = 30 * time.Second
 const signatureExpiration = 5 * time.Minute
 
-// Hook represents a webhook.
+// Event types a Hook can be triggered for.
+const (
+	OrderCreatedHook     = "order.created"
+	OrderUpdatedHook     = "order.updated"
+	PaymentSucceededHook = "payment.succeeded"
+	PaymentFailedHook    = "payment.failed"
+	RefundIssuedHook     = "refund.issued"
+	OrderAutomatedHook   = "order.automated"
+	OrderAbandonedHook   = "order.abandoned"
+
+	// OrderValidateHook is sent synchronously before a new order is saved,
+	// and is never stored or retried.
+	OrderValidateHook = "order.validate"
+)
+
+// Hook represents a webhook and the log of its deliveries.
 type Hook struct {
-	ID uint64
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-"`
 
-	UserID string
+	UserID string `json:"user_id,omitempty"`
 
-	Type string
+	Type string `json:"type"`
 
-	Done   bool
-	Failed bool
+	Done   bool `json:"done"`
+	Failed bool `json:"failed"`
 
-	URL     string
-	Payload string
-	Secret  string
+	URL     string `json:"url"`
+	Payload string `json:"payload"`
+	Secret  string `json:"-"`
 
-	ResponseStatus  string
-	ResponseHeaders string
-	ResponseBody    string
-	ErrorMessage    *string
+	ResponseStatus  string  `json:"response_status,omitempty"`
+	ResponseHeaders string  `json:"response_headers,omitempty"`
+	ResponseBody    string  `json:"response_body,omitempty"`
+	ErrorMessage    *string `json:"error_message,omitempty"`
 
-	Tries int
+	Tries int `json:"tries"`
 
-	CreatedAt   time.Time
-	RunAfter    *time.Time
-	LockedAt    *time.Time
-	LockedBy    *string
-	CompletedAt *time.Time
+	CreatedAt   time.Time  `json:"created_at"`
+	RunAfter    *time.Time `json:"run_after,omitempty"`
+	LockedAt    *time.Time `json:"-"`
+	LockedBy    *string    `json:"-"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
 }
 
 // TableName returns the database table name for the Hook model.
@@ -54,28 +76,41 @@ func (Hook) TableName() string {
 }
 
 // NewHook creates a Hook model.
-func NewHook(hookType, url, userID, secret string, payload interface{}) *Hook {
+func NewHook(instanceID, hookType, url, userID, secret string, payload interface{}) *Hook {
 	json, _ := json.Marshal(payload)
 	return &Hook{
-		Type:    hookType,
-		UserID:  userID,
-		URL:     url,
-		Secret:  secret,
-		Payload: string(json),
+		InstanceID: instanceID,
+		Type:       hookType,
+		UserID:     userID,
+		URL:        url,
+		Secret:     secret,
+		Payload:    string(json),
 	}
 }
 
-// Trigger creates and executes the HTTP request for a Hook.
-func (h *Hook) Trigger(client *http.Client, log *logrus.Entry) (*http.Response, error) {
+// Trigger creates and executes the HTTP request for a Hook. Every try is
+// signed with a new nonce, see the webhooks package, and stored hooks carry
+// their ID so receivers can tell retries apart from new hooks.
+func (h *Hook) Trigger(client *http.Client, log logrus.FieldLogger) (*http.Response, error) {
 	log.Infof("Triggering hook %v: %v", h.ID, h.URL)
 	h.Tries++
 	body := bytes.NewBufferString(h.Payload)
 	req, err := http.NewRequest("POST", h.URL, body)
-	req.Header.Set("Content-Type", "application/json")
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhooks.EventHeader, h.Type)
+	if h.ID != 0 {
+		req.Header.Set(webhooks.IDHeader, strconv.FormatUint(h.ID, 10))
+	}
 	if h.Secret != "" {
+		req.Header.Set(webhooks.SignatureHeader, webhooks.Sign(h.Secret, []byte(h.Payload), time.Now(), webhooks.NewNonce()))
+
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write([]byte(h.Payload))
+		req.Header.Set("X-Commerce-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 			"sub": h.UserID,
 			"exp": time.Now().Add(signatureExpiration).Unix(),
@@ -112,7 +147,7 @@ func (h *Hook) handleError(db *gorm.DB, log *logrus.Entry, resp *http.Response,
 		h.Done = true
 		h.CompletedAt = &now
 	} else {
-		runAfter := now.Add(time.Duration(h.Tries) * retryPeriod)
+		runAfter := now.Add(retryPeriod << uint(h.Tries-1))
 		h.RunAfter = &runAfter
 		log.Errorf("Hook %v failed %v - retrying at %v", h.ID, err, runAfter)
 	}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Formats for the IDs of new orders and transactions. Existing rows keep their
+// IDs, whatever format they were created with.
+const (
+	UUIDv4Format = "uuidv4"
+	UUIDv7Format = "uuidv7"
+)
+
+// IDRegion is the region of a multi-region deployment. When it is set, new
+// IDs start with it, like eu-west-0162b4c2-..., so IDs created in different
+// regions never collide.
+var IDRegion string
+
+// NewID generates an ID in the given format. Time-ordered UUIDv7 IDs are the
+// default, they keep inserts into large indexes local.
+func NewID(format string) string {
+	var id string
+	if format == UUIDv4Format {
+		id = uuid.NewRandom().String()
+	} else {
+		id = newUUIDv7(time.Now())
+	}
+	if IDRegion != "" {
+		return IDRegion + "-" + id
+	}
+	return id
+}
+
+// newUUIDv7 builds a UUID that starts with the Unix time in milliseconds,
+// followed by random bits.
+func newUUIDv7(t time.Time) string {
+	id := make(uuid.UUID, 16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		return uuid.NewRandom().String()
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(id[0:6], ts[2:])
+	id[6] = (id[6] & 0x0f) | 0x70 // version 7
+	id[8] = (id[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return id.String()
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// IdempotencyKey is a key sent by a client with the Idempotency-Key header,
+// together with the response to the request it was first sent with. Retries
+// of the request with the same key get the stored response instead of
+// creating another order or payment.
+type IdempotencyKey struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_idempotency_keys_key"`
+	Key        string `json:"key" gorm:"column:idempotency_key" sql:"unique_index:idx_idempotency_keys_key"`
+
+	// UserID is the subject of the token the key was first used with, and
+	// RequestHash is a hash of the method, path and body of the request. A
+	// key can't be reused for another user or request.
+	UserID      string `json:"user_id,omitempty"`
+	RequestHash string `json:"-"`
+
+	// StatusCode is zero while the first request is still being handled.
+	StatusCode int    `json:"status_code"`
+	Response   string `json:"-" sql:"type:text"`
+
+	CreatedAt time.Time `json:"created_at" sql:"index:idx_idempotency_keys_created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the IdempotencyKey model.
+func (IdempotencyKey) TableName() string {
+	return tableName("idempotency_keys")
+}
+
+// Completed returns true if the response to the first request was stored.
+func (k *IdempotencyKey) Completed() bool {
+	return k.StatusCode != 0
+}
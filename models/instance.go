@@ -15,6 +15,9 @@ type Instance struct {
 	ID string `json:"id"`
 	// Netlify UUID
 	UUID string `json:"uuid,omitempty"`
+	// Domain is the hostname the store of the instance is served on, like
+	// shop.example.com, for routing requests without an instance header.
+	Domain string `json:"domain,omitempty" sql:"index:idx_instances_domain"`
 
 	RawBaseConfig string              `json:"-" gorm:"size:65535"`
 	BaseConfig    *conf.Configuration `json:"config"`
@@ -88,6 +91,18 @@ func GetInstanceByUUID(db *gorm.DB, uuid string) (*Instance, error) {
 	return &instance, nil
 }
 
+// GetInstanceByDomain finds an instance by the hostname of its store.
+func GetInstanceByDomain(db *gorm.DB, domain string) (*Instance, error) {
+	instance := Instance{}
+	if rsp := db.Where("domain = ?", domain).First(&instance); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, ModelNotFoundError{"instance"}
+		}
+		return nil, errors.Wrap(rsp.Error, "error finding instance")
+	}
+	return &instance, nil
+}
+
 func CreateInstance(db *gorm.DB, instance *Instance) error {
 	if result := db.Create(instance); result.Error != nil {
 		return errors.Wrap(result.Error, "Error creating instance")
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Inventory is the stock level of a SKU. Only SKUs with an Inventory are
+// tracked, all other products can be ordered in any quantity. The stock goes
+// down when an order is paid and back up when its items are refunded.
+type Inventory struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_inventory_sku"`
+	Sku        string `json:"sku" sql:"unique_index:idx_inventory_sku"`
+	Stock      int64  `json:"stock"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Inventory model.
+func (Inventory) TableName() string {
+	return tableName("inventory")
+}
+
+// GetInventory returns the Inventory of a SKU, or nil if the SKU isn't tracked.
+func GetInventory(db *gorm.DB, instanceID, sku string) (*Inventory, error) {
+	inventory := &Inventory{}
+	if rsp := db.Where("instance_id = ? AND sku = ?", instanceID, sku).First(inventory); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return inventory, nil
+}
+
+// SeedInventory starts tracking a SKU with an initial stock, unless it is
+// tracked already. It returns the Inventory of the SKU.
+func SeedInventory(db *gorm.DB, instanceID, sku string, stock uint64) (*Inventory, error) {
+	inventory, err := GetInventory(db, instanceID, sku)
+	if err != nil || inventory != nil {
+		return inventory, err
+	}
+	inventory = &Inventory{InstanceID: instanceID, Sku: sku, Stock: int64(stock)}
+	return inventory, db.Create(inventory).Error
+}
+
+// AdjustInventory changes the stock of a SKU by delta. Nothing happens when
+// the SKU isn't tracked.
+func AdjustInventory(db *gorm.DB, instanceID, sku string, delta int64) error {
+	return db.Model(&Inventory{}).
+		Where("instance_id = ? AND sku = ?", instanceID, sku).
+		UpdateColumn("stock", gorm.Expr("stock + ?", delta)).Error
+}
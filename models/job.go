@@ -0,0 +1,153 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Types of background jobs.
+const (
+	OrderConfirmationMailJob = "mail.order_confirmation"
+	OrderReceivedMailJob     = "mail.order_received"
+	OrderBackorderedMailJob  = "mail.order_backordered"
+	OrderRefundMailJob       = "mail.order_refund"
+	AutomationMailJob        = "mail.automation"
+	OrderAutomationsJob      = "automations.order"
+	BulkRefundJob            = "refunds.bulk"
+)
+
+const (
+	// MaxJobTries is how often a job is tried before it is dead.
+	MaxJobTries = 5
+	// jobRetryPeriod is the wait before the first retry, which doubles with
+	// every try.
+	jobRetryPeriod = 30 * time.Second
+	// jobLockTimeout is how long a job stays locked by a worker. Jobs of
+	// workers that died are picked up again after it.
+	jobLockTimeout = 5 * time.Minute
+)
+
+// Job is a side effect of a request, like sending a mail, that runs in the
+// background and is retried when it fails. Jobs that failed MaxJobTries times
+// are dead, and are only tried again when an admin retries them.
+type Job struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index:idx_jobs_instance_id"`
+
+	Type    string `json:"type"`
+	Payload string `json:"payload" gorm:"size:65535"`
+
+	Done  bool `json:"done" sql:"index:idx_jobs_done"`
+	Dead  bool `json:"dead" sql:"index:idx_jobs_dead"`
+	Tries int  `json:"tries"`
+
+	ErrorMessage *string `json:"error_message,omitempty"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	RunAfter    *time.Time `json:"run_after,omitempty"`
+	LockedAt    *time.Time `json:"-"`
+	LockedBy    *string    `json:"-"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// TableName returns the database table name for the Job model.
+func (Job) TableName() string {
+	return tableName("jobs")
+}
+
+// EnqueueJob stores a job to run in the background.
+func EnqueueJob(db *gorm.DB, instanceID, jobType string, payload interface{}) (*Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{InstanceID: instanceID, Type: jobType, Payload: string(data)}
+	if rsp := db.Create(job); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return job, nil
+}
+
+// DecodePayload reads the payload of a job.
+func (j *Job) DecodePayload(payload interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), payload)
+}
+
+// ClaimJobs locks up to limit jobs that are due for a worker, and returns
+// them.
+func ClaimJobs(db *gorm.DB, workerID string, limit int) ([]*Job, error) {
+	now := time.Now()
+	due := []uint64{}
+	rsp := db.Model(&Job{}).
+		Where("done = ? AND (locked_at IS NULL OR locked_at < ?) AND (run_after IS NULL OR run_after < ?)", false, now.Add(-jobLockTimeout), now).
+		Order("id asc").Limit(limit).
+		Pluck("id", &due)
+	if rsp.Error != nil || len(due) == 0 {
+		return nil, rsp.Error
+	}
+
+	// Another worker may have claimed some of them in the meantime, only the
+	// ones this update locks belong to this worker.
+	rsp = db.Model(&Job{}).
+		Where("id IN (?) AND done = ? AND (locked_at IS NULL OR locked_at < ?)", due, false, now.Add(-jobLockTimeout)).
+		UpdateColumns(map[string]interface{}{"locked_at": now, "locked_by": workerID})
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	jobs := []*Job{}
+	if rsp := db.Where("id IN (?) AND done = ? AND locked_by = ?", due, false, workerID).Order("id asc").Find(&jobs); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return jobs, nil
+}
+
+// Complete records that a job ran.
+func (j *Job) Complete(db *gorm.DB) error {
+	now := time.Now()
+	j.Tries++
+	j.Done = true
+	j.ErrorMessage = nil
+	j.CompletedAt = &now
+	j.LockedAt = nil
+	j.LockedBy = nil
+	return db.Save(j).Error
+}
+
+// Fail records that a job failed. It is retried with an exponential backoff,
+// until it is dead after MaxJobTries tries.
+func (j *Job) Fail(db *gorm.DB, err error) error {
+	now := time.Now()
+	msg := err.Error()
+	j.Tries++
+	j.ErrorMessage = &msg
+	j.LockedAt = nil
+	j.LockedBy = nil
+	if j.Tries >= MaxJobTries {
+		j.Done = true
+		j.Dead = true
+		j.CompletedAt = &now
+	} else {
+		runAfter := now.Add(jobRetryPeriod << uint(j.Tries-1))
+		j.RunAfter = &runAfter
+	}
+	return db.Save(j).Error
+}
+
+// PurgeJobs deletes the jobs that ran successfully before a time, and returns
+// how many it deleted. Dead jobs are kept, so admins can still retry them.
+func PurgeJobs(db *gorm.DB, before time.Time) (int64, error) {
+	rsp := db.Where("done = ? AND dead = ? AND completed_at < ?", true, false, before).Delete(&Job{})
+	return rsp.RowsAffected, rsp.Error
+}
+
+// Retry queues a dead job to run again right away, with new tries.
+func (j *Job) Retry(db *gorm.DB) error {
+	j.Done = false
+	j.Dead = false
+	j.Tries = 0
+	j.RunAfter = nil
+	j.CompletedAt = nil
+	return db.Save(j).Error
+}
@@ -1,10 +1,11 @@
 package models
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/netlify/gocommerce/calculator"
@@ -26,12 +27,65 @@ type LineItem struct {
 
 	Price uint64 `json:"price"`
 	VAT   uint64 `json:"vat"`
+	Cost  uint64 `json:"-"`
+	// LineNet is what the whole line costs without taxes, after coupons,
+	// promotions and spend tiers. It is kept from the price breakdown for
+	// reports.
+	LineNet uint64 `json:"-"`
+
+	// Weight is the shipping weight of a single item in grams.
+	Weight uint64 `json:"weight,omitempty"`
 
 	PriceItems []*PriceItem `json:"price_items"`
 	AddonItems []*AddonItem `json:"addons"`
 	AddonPrice uint64       `json:"addon_price"`
 
-	Quantity uint64 `json:"quantity"`
+	// PriceList is the price list of the product the price was picked from.
+	PriceList string `json:"price_list,omitempty"`
+
+	Quantity         uint64 `json:"quantity"`
+	RefundedQuantity uint64 `json:"refunded_quantity"`
+	// BackorderedQuantity is the part of the quantity that was out of stock
+	// when the order was paid.
+	BackorderedQuantity uint64 `json:"backordered_quantity,omitempty"`
+
+	// Gift is set on the free products added by the gift of a coupon.
+	Gift bool `json:"gift,omitempty"`
+
+	// NonReturnable items can't be returned, whatever the return policy.
+	NonReturnable bool `json:"non_returnable,omitempty"`
+
+	// ManualPrice is set on the items an admin priced by hand instead of
+	// taking the price from the product on the site.
+	ManualPrice bool `json:"manual_price,omitempty"`
+
+	Vendor        string `json:"vendor,omitempty"`
+	VendorAccount string `json:"-"`
+	VendorShare   uint64 `json:"-"`
+
+	// InitialStock is the inventory published in the product metadata, used
+	// to start tracking the stock of the SKU.
+	InitialStock *uint64 `sql:"-" json:"-"`
+
+	// MinQuantity, MaxQuantity and OnePerCustomer are the purchase limits
+	// published in the product metadata, checked when the order is created.
+	// OnePerCustomer is saved, since it is checked again when the order is
+	// paid.
+	MinQuantity    uint64 `sql:"-" json:"-"`
+	MaxQuantity    uint64 `sql:"-" json:"-"`
+	OnePerCustomer bool   `json:"-"`
+
+	// AllowedCountries and RestrictedCountries are the countries the product
+	// can and can't be shipped to, from the product metadata.
+	AllowedCountries       []string `sql:"-" json:"allowed_countries,omitempty"`
+	RawAllowedCountries    string   `json:"-"`
+	RestrictedCountries    []string `sql:"-" json:"restricted_countries,omitempty"`
+	RawRestrictedCountries string   `json:"-"`
+
+	// PriceBreakdown is the price of the item when the order was last priced,
+	// with the taxes and discounts applied to it.
+	PriceBreakdown    *calculator.ItemPrice `sql:"-" json:"price_breakdown,omitempty"`
+	RawPriceBreakdown string                `json:"-" gorm:"size:65535"`
 
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-"`
@@ -47,6 +101,24 @@ func (LineItem) TableName() string {
 
 // BeforeSave database callback.
 func (i *LineItem) BeforeSave() error {
+	var err error
+	if i.RawAllowedCountries, err = encodeCountries(i.AllowedCountries); err != nil {
+		return err
+	}
+	if i.RawRestrictedCountries, err = encodeCountries(i.RestrictedCountries); err != nil {
+		return err
+	}
+	i.RawPriceBreakdown = ""
+	i.LineNet = (i.Price + i.AddonPrice) * i.Quantity
+	if i.PriceBreakdown != nil {
+		data, err := json.Marshal(i.PriceBreakdown)
+		if err != nil {
+			return err
+		}
+		i.RawPriceBreakdown = string(data)
+		i.LineNet = i.PriceBreakdown.LineNet
+	}
+
 	if len(i.MetaData) == 0 {
 		i.RawMetaData = ""
 		return nil
@@ -61,15 +133,64 @@ func (i *LineItem) BeforeSave() error {
 
 // AfterFind database callback.
 func (i *LineItem) AfterFind() error {
+	if i.RawAllowedCountries != "" {
+		if err := json.Unmarshal([]byte(i.RawAllowedCountries), &i.AllowedCountries); err != nil {
+			return err
+		}
+	}
+	if i.RawRestrictedCountries != "" {
+		if err := json.Unmarshal([]byte(i.RawRestrictedCountries), &i.RestrictedCountries); err != nil {
+			return err
+		}
+	}
+	if i.RawPriceBreakdown != "" {
+		i.PriceBreakdown = &calculator.ItemPrice{}
+		if err := json.Unmarshal([]byte(i.RawPriceBreakdown), i.PriceBreakdown); err != nil {
+			return err
+		}
+	}
 	if i.RawMetaData != "" {
 		return json.Unmarshal([]byte(i.RawMetaData), &i.MetaData)
 	}
 	return nil
 }
 
+func encodeCountries(countries []string) (string, error) {
+	if len(countries) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(countries)
+	return string(data), err
+}
+
+// ShipsTo tells whether the item can be shipped to a country. Items ship
+// anywhere when no country is known yet. Countries are compared by the ISO
+// code that code returns for them, like addresses.CountryCode, so names and
+// codes of the same country match, and by name when it doesn't know them.
+func (i *LineItem) ShipsTo(country string, code func(string) string) bool {
+	if country == "" {
+		return true
+	}
+	if len(i.AllowedCountries) > 0 && !containsCountry(i.AllowedCountries, country, code) {
+		return false
+	}
+	return !containsCountry(i.RestrictedCountries, country, code)
+}
+
+func containsCountry(countries []string, country string, code func(string) string) bool {
+	countryCode := code(country)
+	for _, c := range countries {
+		if strings.EqualFold(strings.TrimSpace(c), strings.TrimSpace(country)) || (countryCode != "" && code(c) == countryCode) {
+			return true
+		}
+	}
+	return false
+}
+
 // PriceItem represent the subcomponent price items of a LineItem.
 type PriceItem struct {
-	ID int64 `json:"id"`
+	ID         int64 `json:"id"`
+	LineItemID int64 `json:"-"`
 
 	Amount uint64 `json:"amount"`
 	Type   string `json:"type"`
@@ -132,12 +253,45 @@ type PriceMetadata struct {
 	Amount   string            `json:"amount"`
 	Currency string            `json:"currency"`
 	VAT      string            `json:"vat"`
+	Cost     string            `json:"cost"`
 	Items    []PriceMetaItem   `json:"items"`
 	Claims   map[string]string `json:"claims"`
+	// Groups limits the price to members of one of the customer groups.
+	Groups []string `json:"groups"`
 
 	cents uint64
 }
 
+// DefaultPriceList is the price list of products with a single list of
+// prices, and the list buyers pay unless they are in the customer group of
+// another list.
+const DefaultPriceList = "retail"
+
+// PriceLists are the prices of a product by price list. In the metadata of a
+// product they are either an array of prices, which is the retail list, or
+// an object of named lists like {"retail": [...], "wholesale": [...]}. Buyers
+// in a customer group with the name of a list pay its prices.
+type PriceLists map[string][]PriceMetadata
+
+// UnmarshalJSON reads either form of the prices of a product.
+func (l *PriceLists) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		prices := []PriceMetadata{}
+		if err := json.Unmarshal(data, &prices); err != nil {
+			return err
+		}
+		*l = PriceLists{DefaultPriceList: prices}
+		return nil
+	}
+	lists := map[string][]PriceMetadata{}
+	if err := json.Unmarshal(data, &lists); err != nil {
+		return err
+	}
+	*l = lists
+	return nil
+}
+
 // PriceMetaItem model
 type PriceMetaItem struct {
 	Amount string `json:"amount"`
@@ -147,25 +301,104 @@ type PriceMetaItem struct {
 
 // AddonMetaItem model
 type AddonMetaItem struct {
-	Sku         string          `json:"sku"`
-	Title       string          `json:"title"`
-	Description string          `json:"description"`
-	Prices      []PriceMetadata `json:"prices"`
+	Sku          string                        `json:"sku"`
+	Title        string                        `json:"title"`
+	Description  string                        `json:"description"`
+	Translations map[string]ProductTranslation `json:"translations"`
+	Prices       PriceLists                    `json:"prices"`
+}
+
+// ProductTranslation is the title and description of a product in another
+// language. Either can be left out to use the untranslated one.
+type ProductTranslation struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// translate returns the title and description of a product in a locale like
+// de-AT, from the translation for that locale or else for its language. The
+// untranslated title and description are those of the default locale of the
+// site.
+func translate(translations map[string]ProductTranslation, locale, title, description string) (string, string) {
+	locale = strings.ToLower(strings.Replace(locale, "_", "-", -1))
+	if locale == "" || len(translations) == 0 {
+		return title, description
+	}
+	language := locale
+	if i := strings.Index(locale, "-"); i >= 0 {
+		language = locale[:i]
+	}
+
+	var found *ProductTranslation
+	for key, translation := range translations {
+		key = strings.ToLower(strings.Replace(key, "_", "-", -1))
+		if key == locale {
+			t := translation
+			found = &t
+			break
+		}
+		if key == language {
+			t := translation
+			found = &t
+		}
+	}
+	if found == nil {
+		return title, description
+	}
+	if found.Title != "" {
+		title = found.Title
+	}
+	if found.Description != "" {
+		description = found.Description
+	}
+	return title, description
+}
+
+// VendorMetadata model
+type VendorMetadata struct {
+	ID            string `json:"id"`
+	StripeAccount string `json:"stripe_account"`
+	Share         uint64 `json:"share"`
 }
 
 // LineItemMetadata model
 type LineItemMetadata struct {
-	Sku         string          `json:"sku"`
-	Title       string          `json:"title"`
-	Description string          `json:"description"`
-	VAT         uint64          `json:"vat"`
-	Prices      []PriceMetadata `json:"prices"`
-	Type        string          `json:"type"`
+	Sku         string     `json:"sku"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	VAT         uint64     `json:"vat"`
+	Weight      uint64     `json:"weight"`
+	Prices      PriceLists `json:"prices"`
+	Type        string     `json:"type"`
+
+	// Translations are the title and description of the product in other
+	// languages, by locale like de or pt-BR. Line items get the ones
+	// matching the locale of their order.
+	Translations map[string]ProductTranslation `json:"translations"`
 
 	Downloads []Download      `json:"downloads"`
 	Addons    []AddonMetaItem `json:"addons"`
 
+	Vendor *VendorMetadata `json:"vendor"`
+
+	Subscription *SubscriptionMetadata `json:"subscription"`
+
 	Webhook string `json:"webhook"`
+
+	Inventory *uint64 `json:"inventory"`
+
+	NonReturnable bool `json:"non_returnable"`
+
+	// MinQuantity and MaxQuantity limit the quantity of the product in an
+	// order, and OnePerCustomer allows a customer to buy it only once.
+	MinQuantity    uint64 `json:"min_quantity"`
+	MaxQuantity    uint64 `json:"max_quantity"`
+	OnePerCustomer bool   `json:"one_per_customer"`
+
+	// AllowedCountries limits the countries the product ships to, and it
+	// doesn't ship to the RestrictedCountries.
+	AllowedCountries    []string `json:"allowed_countries"`
+	RestrictedCountries []string `json:"restricted_countries"`
 }
 
 // ProductSku returns the Sku of the line item to match the calculator.Item interface
@@ -178,6 +411,11 @@ func (i *LineItem) PriceInLowestUnit() uint64 {
 	return i.Price + i.AddonPrice
 }
 
+// ShippingWeight implements the calculator.WeightedItem interface.
+func (i *LineItem) ShippingWeight() uint64 {
+	return i.Weight
+}
+
 // ProductType implements part of the calculator.Item interface.
 func (i *LineItem) ProductType() string {
 	return i.Type
@@ -208,10 +446,26 @@ func (i *LineItem) GetQuantity() uint64 {
 // Process calculates the price of a LineItem.
 func (i *LineItem) Process(userClaims map[string]interface{}, order *Order, meta *LineItemMetadata) error {
 	i.Sku = meta.Sku
-	i.Title = meta.Title
-	i.Description = meta.Description
+	i.Title, i.Description = translate(meta.Translations, order.Locale, meta.Title, meta.Description)
 	i.VAT = meta.VAT
+	i.Weight = meta.Weight
 	i.Type = meta.Type
+	i.InitialStock = meta.Inventory
+	i.NonReturnable = meta.NonReturnable
+	i.MinQuantity = meta.MinQuantity
+	i.MaxQuantity = meta.MaxQuantity
+	i.OnePerCustomer = meta.OnePerCustomer
+	i.AllowedCountries = meta.AllowedCountries
+	i.RestrictedCountries = meta.RestrictedCountries
+
+	if meta.Vendor != nil {
+		if meta.Vendor.Share > 100 {
+			return fmt.Errorf("Vendor share for item %v can't be more than 100 percent", i.Sku)
+		}
+		i.Vendor = meta.Vendor.ID
+		i.VendorAccount = meta.Vendor.StripeAccount
+		i.VendorShare = meta.Vendor.Share
+	}
 
 	for index, addon := range i.AddonItems {
 		var metaAddon *AddonMetaItem
@@ -225,16 +479,50 @@ func (i *LineItem) Process(userClaims map[string]interface{}, order *Order, meta
 			return fmt.Errorf("Unkown addon %v for item %v", addon.Sku, i.Sku)
 		}
 
-		lowestPrice, err := determineLowestPrice(userClaims, metaAddon.Prices, order.Currency)
+		lowestPrice, _, err := determinePrice(addon.Sku, userClaims, metaAddon.Prices, order.Currency)
 		if err != nil {
 			return err
 		}
 
-		i.AddonItems[index].Title = metaAddon.Title
-		i.AddonItems[index].Description = metaAddon.Description
+		i.AddonItems[index].Title, i.AddonItems[index].Description = translate(metaAddon.Translations, order.Locale, metaAddon.Title, metaAddon.Description)
 		i.AddonItems[index].Price = lowestPrice.cents
 	}
 
+	i.addDownloads(order, meta)
+
+	return i.calculatePrice(userClaims, meta.Prices, order.Currency)
+}
+
+// ProcessManual fills in a LineItem that an admin priced by hand, for a
+// product that is not looked up on the site.
+func (i *LineItem) ProcessManual(price uint64, title, productType, description string, vat uint64) {
+	i.Title = title
+	i.Type = productType
+	i.Description = description
+	i.VAT = vat
+	i.Price = price
+	i.ManualPrice = true
+}
+
+// ProcessGift fills in a LineItem that is given away for free as the gift of
+// a coupon. It keeps the type and VAT of the product, so it is taxed like the
+// product at its price of zero.
+func (i *LineItem) ProcessGift(order *Order, meta *LineItemMetadata) {
+	i.Sku = meta.Sku
+	i.Title, i.Description = translate(meta.Translations, order.Locale, meta.Title, meta.Description)
+	i.VAT = meta.VAT
+	i.Weight = meta.Weight
+	i.Type = meta.Type
+	i.InitialStock = meta.Inventory
+	i.NonReturnable = meta.NonReturnable
+	i.Gift = true
+	i.Price = 0
+	i.AddonPrice = 0
+
+	i.addDownloads(order, meta)
+}
+
+func (i *LineItem) addDownloads(order *Order, meta *LineItemMetadata) {
 	for _, download := range meta.Downloads {
 		alreadyCreated := false
 		for _, d := range order.Downloads {
@@ -247,27 +535,35 @@ func (i *LineItem) Process(userClaims map[string]interface{}, order *Order, meta
 			continue
 		}
 		download.ID = uuid.NewRandom().String()
-		download.Title = i.Title
+		if download.Title == "" {
+			download.Title = i.Title
+		}
 		download.Sku = i.Sku
 		order.Downloads = append(order.Downloads, download)
 	}
-
-	return i.calculatePrice(userClaims, meta.Prices, order.Currency)
 }
 
-func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []PriceMetadata, currency string) error {
-	lowestPrice, err := determineLowestPrice(userClaims, prices, currency)
+func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices PriceLists, currency string) error {
+	lowestPrice, list, err := determinePrice(i.Sku, userClaims, prices, currency)
 	if err != nil {
 		return err
 	}
 	i.Price = lowestPrice.cents
+	i.PriceList = list
+	if lowestPrice.Cost != "" {
+		cost, err := calculator.ParseAmount(lowestPrice.Cost, currency)
+		if err != nil {
+			return err
+		}
+		i.Cost = cost
+	}
 	i.PriceItems = make([]*PriceItem, len(lowestPrice.Items))
 	for index, item := range lowestPrice.Items {
-		amount, err := strconv.ParseFloat(item.Amount, 64)
+		amount, err := calculator.ParseAmount(item.Amount, currency)
 		if err != nil {
 			return err
 		}
-		i.PriceItems[index] = &PriceItem{Amount: uint64(amount * 100), Type: item.Type, VAT: item.VAT}
+		i.PriceItems[index] = &PriceItem{Amount: amount, Type: item.Type, VAT: item.VAT}
 	}
 	for _, addon := range i.AddonItems {
 		i.AddonPrice += addon.Price
@@ -276,22 +572,74 @@ func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []Pr
 	return nil
 }
 
-func determineLowestPrice(userClaims map[string]interface{}, prices []PriceMetadata, currency string) (PriceMetadata, error) {
+// MissingPriceError is returned when a product doesn't publish a price in the
+// currency of an order.
+type MissingPriceError struct {
+	Sku       string
+	Currency  string
+	Available []string
+}
+
+func (e *MissingPriceError) Error() string {
+	if len(e.Available) == 0 {
+		return fmt.Sprintf("%v has no price", e.Sku)
+	}
+	return fmt.Sprintf("%v is not available in %v, only in %v", e.Sku, e.Currency, strings.Join(e.Available, ", "))
+}
+
+// determinePrice picks the price a buyer pays from the price lists of a
+// product: the lowest price of the lists of their customer groups, or the
+// retail price when none of the lists has a price in the currency for them.
+func determinePrice(sku string, userClaims map[string]interface{}, lists PriceLists, currency string) (PriceMetadata, string, error) {
+	var price PriceMetadata
+	var list string
+	for _, group := range claims.CustomerGroups(userClaims) {
+		prices, ok := lists[group]
+		if !ok || group == DefaultPriceList {
+			continue
+		}
+		groupPrice, err := determineLowestPrice(sku, userClaims, prices, currency)
+		if err != nil {
+			continue
+		}
+		if list == "" || groupPrice.cents < price.cents {
+			price, list = groupPrice, group
+		}
+	}
+	if list != "" {
+		return price, list, nil
+	}
+
+	price, err := determineLowestPrice(sku, userClaims, lists[DefaultPriceList], currency)
+	return price, DefaultPriceList, err
+}
+
+func determineLowestPrice(sku string, userClaims map[string]interface{}, prices []PriceMetadata, currency string) (PriceMetadata, error) {
 	lowestPrice := PriceMetadata{}
 	found := false
+	inCurrency := false
+	available := []string{}
 	for _, price := range prices {
-		if price.Currency == currency {
-			amount, err := strconv.ParseFloat(price.Amount, 64)
-			if err != nil {
-				return lowestPrice, err
-			}
-			price.cents = uint64(amount * 100)
-			if (!found || price.cents < lowestPrice.cents) && claims.HasClaims(userClaims, price.Claims) {
-				lowestPrice = price
-				found = true
+		if !strings.EqualFold(price.Currency, currency) {
+			if c := strings.ToUpper(price.Currency); !contains(available, c) {
+				available = append(available, c)
 			}
+			continue
+		}
+		inCurrency = true
+		var err error
+		price.cents, err = calculator.ParseAmount(price.Amount, currency)
+		if err != nil {
+			return lowestPrice, err
+		}
+		if (!found || price.cents < lowestPrice.cents) && claims.HasClaims(userClaims, price.Claims) && claims.InGroups(userClaims, price.Groups) {
+			lowestPrice = price
+			found = true
 		}
 	}
+	if !inCurrency {
+		return lowestPrice, &MissingPriceError{Sku: sku, Currency: currency, Available: available}
+	}
 	if !found {
 		return lowestPrice, errors.New("No valid price found for item")
 	}
@@ -0,0 +1,21 @@
+package models
+
+// Sources a LocaleInference value can come from, in order of precedence.
+const (
+	LocaleSourceRequest        = "request"
+	LocaleSourceGeoIP          = "geoip"
+	LocaleSourceAcceptLanguage = "accept_language"
+	LocaleSourceInstance       = "instance"
+	LocaleSourceFallback       = "fallback"
+)
+
+// LocaleInference records the country, currency and locale used for an
+// Order and where each of them came from.
+type LocaleInference struct {
+	Country        string `json:"country"`
+	CountrySource  string `json:"country_source,omitempty"`
+	Currency       string `json:"currency"`
+	CurrencySource string `json:"currency_source"`
+	Locale         string `json:"locale"`
+	LocaleSource   string `json:"locale_source,omitempty"`
+}
@@ -0,0 +1,556 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gocommerce/calculator"
+)
+
+// Migration is a versioned change of the database schema. Migrations run in
+// the order of their versions, and can be rolled back with Down.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(db *gorm.DB) error
+	Down    func(db *gorm.DB) error
+}
+
+// SchemaMigration records a migration that ran on the database.
+type SchemaMigration struct {
+	Version   int64 `gorm:"primary_key"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName returns the database table name for the SchemaMigration model.
+func (SchemaMigration) TableName() string {
+	return tableName("schema_migrations")
+}
+
+// Migrations are all the migrations of the schema, by version. Changes to the
+// models that add tables, columns or indexes get a migration of their own, so
+// databases created before them are migrated too.
+var Migrations = []*Migration{
+	{
+		Version: 1,
+		Name:    "create tables",
+		Up:      AutoMigrate,
+		Down: func(db *gorm.DB) error {
+			models := allModels()
+			for i := len(models) - 1; i >= 0; i-- {
+				if rsp := db.DropTableIfExists(models[i]); rsp.Error != nil {
+					return rsp.Error
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 2,
+		Name:    "index order sessions",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Model(Order{}).RemoveIndex("idx_" + db.NewScope(Order{}).TableName() + "_session_id").Error
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create returns",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(LineItem{}, Return{}, ReturnItem{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			if rsp := db.DropTableIfExists(ReturnItem{}, Return{}); rsp.Error != nil {
+				return rsp.Error
+			}
+			// SQLite can't drop columns, the column is left unused there
+			if db.NewScope(LineItem{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(LineItem{}).DropColumn("non_returnable").Error
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create exchange rates",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(ExchangeRate{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(ExchangeRate{}).Error
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add instance domains",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Instance{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			if rsp := db.Model(Instance{}).RemoveIndex("idx_instances_domain"); rsp.Error != nil {
+				return rsp.Error
+			}
+			// SQLite can't drop columns, the column is left unused there
+			if db.NewScope(Instance{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(Instance{}).DropColumn("domain").Error
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create funnel events",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(FunnelEvent{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(FunnelEvent{}).Error
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create coupon usages",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(CouponUsage{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(CouponUsage{}).Error
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add tax exemptions",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(User{}, Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(User{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			for _, model := range []interface{}{User{}, Order{}} {
+				for _, column := range []string{"tax_exempt", "tax_exempt_reason"} {
+					if rsp := db.Model(model).DropColumn(column); rsp.Error != nil {
+						return rsp.Error
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add address verification",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the column is left unused there
+			if db.NewScope(Order{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(Order{}).DropColumn("address_verification").Error
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add address book",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Address{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(Address{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			for _, column := range []string{"snapshot", "source_id", "backfilled"} {
+				if rsp := db.Model(Address{}).DropColumn(column); rsp.Error != nil {
+					return rsp.Error
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 11,
+		Name:    "snapshot order addresses",
+		Up:      snapshotAddresses,
+		Down:    unsnapshotAddresses,
+	},
+	{
+		Version: 12,
+		Name:    "create jobs",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Job{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(Job{}).Error
+		},
+	},
+	{
+		Version: 13,
+		Name:    "create user email changes",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(UserEmailChange{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(UserEmailChange{}).Error
+		},
+	},
+	{
+		Version: 14,
+		Name:    "add manual line item prices",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(LineItem{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the column is left unused there
+			if db.NewScope(LineItem{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(LineItem{}).DropColumn("manual_price").Error
+		},
+	},
+	{
+		Version: 15,
+		Name:    "add order tags and holds",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(Order{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			for _, column := range []string{"raw_tags", "on_hold", "hold_reason"} {
+				if rsp := db.Model(Order{}).DropColumn(column); rsp.Error != nil {
+					return rsp.Error
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 16,
+		Name:    "add line item countries",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(LineItem{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(LineItem{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			for _, column := range []string{"raw_allowed_countries", "raw_restricted_countries"} {
+				if rsp := db.Model(LineItem{}).DropColumn(column); rsp.Error != nil {
+					return rsp.Error
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 17,
+		Name:    "add line item price breakdowns",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(LineItem{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(LineItem{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(LineItem{}).DropColumn("raw_price_breakdown").Error
+		},
+	},
+	{
+		Version: 18,
+		Name:    "add order notification suppression",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(Order{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(Order{}).DropColumn("suppress_notifications").Error
+		},
+	},
+	{
+		Version: 19,
+		Name:    "add abandoned orders",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(Order{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(Order{}).DropColumn("abandoned_at").Error
+		},
+	},
+	{
+		Version: 20,
+		Name:    "add download limits",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Download{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(Download{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			for _, column := range []string{"max_downloads", "expiry_days", "pin_ip", "pinned_ip"} {
+				if rsp := db.Model(Download{}).DropColumn(column); rsp.Error != nil {
+					return rsp.Error
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 21,
+		Name:    "archive all order columns",
+		Up: func(db *gorm.DB) error {
+			if rsp := db.AutoMigrate(ArchivedOrder{}); rsp.Error != nil {
+				return rsp.Error
+			}
+			// text is limited to 64KB on MySQL
+			if db.NewScope(ArchivedOrder{}).Dialect().GetName() == "mysql" {
+				return db.Model(ArchivedOrder{}).ModifyColumn("data", "longtext").Error
+			}
+			return nil
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the column is left unused there
+			if db.NewScope(ArchivedOrder{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(ArchivedOrder{}).DropColumn("data").Error
+		},
+	},
+	{
+		Version: 22,
+		Name:    "add unverified vat numbers",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the column is left unused there
+			if db.NewScope(Order{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(Order{}).DropColumn("vat_number_unverified").Error
+		},
+	},
+	{
+		Version: 23,
+		Name:    "index subscription invoices",
+		Up: func(db *gorm.DB) error {
+			// orders that aren't renewals had an empty invoice ID, which
+			// the unique index doesn't allow more than once
+			if rsp := db.Model(Order{}).Unscoped().Where("subscription_invoice_id = ?", "").UpdateColumn("subscription_invoice_id", gorm.Expr("NULL")); rsp.Error != nil {
+				return rsp.Error
+			}
+			return db.AutoMigrate(Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Model(Order{}).RemoveIndex("idx_orders_subscription_invoice_id").Error
+		},
+	},
+	{
+		Version: 24,
+		Name:    "add one per customer line items",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(LineItem{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the column is left unused there
+			if db.NewScope(LineItem{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(LineItem{}).DropColumn("one_per_customer").Error
+		},
+	},
+	{
+		Version: 25,
+		Name:    "add pinned exchange rates",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Order{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(Order{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			for _, column := range []string{"exchange_rate", "exchange_rate_currency", "exchange_rate_date"} {
+				if rsp := db.Model(Order{}).DropColumn(column); rsp.Error != nil {
+					return rsp.Error
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 26,
+		Name:    "store large idempotent responses",
+		Up: func(db *gorm.DB) error {
+			// text is limited to 64KB on MySQL
+			if db.NewScope(IdempotencyKey{}).Dialect().GetName() == "mysql" {
+				return db.Model(IdempotencyKey{}).ModifyColumn("response", "longtext").Error
+			}
+			return nil
+		},
+		Down: func(db *gorm.DB) error {
+			// the larger column is kept, so stored responses aren't cut off
+			return nil
+		},
+	},
+	{
+		Version: 27,
+		Name:    "add line item nets",
+		Up: func(db *gorm.DB) error {
+			if rsp := db.AutoMigrate(LineItem{}); rsp.Error != nil {
+				return rsp.Error
+			}
+			if rsp := db.Model(LineItem{}).UpdateColumn("line_net", gorm.Expr("(price + addon_price) * quantity")); rsp.Error != nil {
+				return rsp.Error
+			}
+
+			// items priced with a breakdown take the discounted net from it
+			rows, err := db.Model(LineItem{}).Where("raw_price_breakdown <> ''").Select("id, raw_price_breakdown").Rows()
+			if err != nil {
+				return err
+			}
+			nets := map[int64]uint64{}
+			for rows.Next() {
+				var id int64
+				var raw string
+				if err := rows.Scan(&id, &raw); err != nil {
+					rows.Close()
+					return err
+				}
+				breakdown := calculator.ItemPrice{}
+				if err := json.Unmarshal([]byte(raw), &breakdown); err != nil {
+					rows.Close()
+					return errors.Wrapf(err, "parsing price breakdown of line item %d", id)
+				}
+				nets[id] = breakdown.LineNet
+			}
+			rows.Close()
+			for id, net := range nets {
+				if rsp := db.Model(LineItem{}).Where("id = ?", id).UpdateColumn("line_net", net); rsp.Error != nil {
+					return rsp.Error
+				}
+			}
+			return nil
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(LineItem{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(LineItem{}).DropColumn("line_net").Error
+		},
+	},
+	{
+		Version: 28,
+		Name:    "link refunds to charges",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(Transaction{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			// SQLite can't drop columns, the columns are left unused there
+			if db.NewScope(Transaction{}).Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return db.Model(Transaction{}).DropColumn("charge_id").Error
+		},
+	},
+}
+
+// AppliedMigrations returns the versions of the migrations that ran on the
+// database.
+func AppliedMigrations(db *gorm.DB) (map[int64]bool, error) {
+	if rsp := db.AutoMigrate(SchemaMigration{}); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	applied := []SchemaMigration{}
+	if rsp := db.Find(&applied); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	versions := map[int64]bool{}
+	for _, m := range applied {
+		versions[m.Version] = true
+	}
+	return versions, nil
+}
+
+// Migrate runs the migrations that didn't run on the database yet, each in a
+// transaction of its own. It returns the migrations that ran.
+func Migrate(db *gorm.DB) ([]*Migration, error) {
+	applied, err := AppliedMigrations(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading applied migrations")
+	}
+
+	ran := []*Migration{}
+	for _, m := range Migrations {
+		if applied[m.Version] {
+			continue
+		}
+		tx := db.Begin()
+		if err := m.Up(tx); err != nil {
+			tx.Rollback()
+			return ran, errors.Wrapf(err, "running migration %d %v", m.Version, m.Name)
+		}
+		if rsp := tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}); rsp.Error != nil {
+			tx.Rollback()
+			return ran, errors.Wrapf(rsp.Error, "recording migration %d %v", m.Version, m.Name)
+		}
+		if rsp := tx.Commit(); rsp.Error != nil {
+			return ran, errors.Wrapf(rsp.Error, "committing migration %d %v", m.Version, m.Name)
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// MigrateDown rolls back the last steps migrations that ran on the database,
+// newest first. It returns the migrations that were rolled back.
+func MigrateDown(db *gorm.DB, steps int) ([]*Migration, error) {
+	applied, err := AppliedMigrations(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading applied migrations")
+	}
+
+	rolledBack := []*Migration{}
+	for i := len(Migrations) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+		m := Migrations[i]
+		if !applied[m.Version] {
+			continue
+		}
+		tx := db.Begin()
+		if err := m.Down(tx); err != nil {
+			tx.Rollback()
+			return rolledBack, errors.Wrapf(err, "rolling back migration %d %v", m.Version, m.Name)
+		}
+		if rsp := tx.Delete(&SchemaMigration{Version: m.Version}); rsp.Error != nil {
+			tx.Rollback()
+			return rolledBack, errors.Wrapf(rsp.Error, "recording rollback of migration %d %v", m.Version, m.Name)
+		}
+		if rsp := tx.Commit(); rsp.Error != nil {
+			return rolledBack, errors.Wrapf(rsp.Error, "committing rollback of migration %d %v", m.Version, m.Name)
+		}
+		rolledBack = append(rolledBack, m)
+	}
+	return rolledBack, nil
+}
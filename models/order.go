@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/rates"
 	"github.com/pborman/uuid"
 )
 
@@ -37,27 +39,64 @@ type Order struct {
 
 	User      *User  `json:"user,omitempty"`
 	UserID    string `json:"user_id,omitempty"`
-	SessionID string `json:"-"`
+	SessionID string `json:"-" sql:"index"`
 
 	Email string `json:"email"`
+	// NormalizedEmail is the email orders are matched by, see NormalizeEmail.
+	NormalizedEmail string `json:"-" sql:"index:idx_orders_normalized_email"`
 
 	LineItems []*LineItem `json:"line_items"`
 
 	Downloads []Download `json:"downloads"`
 
 	Currency string `json:"currency"`
+	Locale   string `json:"locale"`
 	Taxes    uint64 `json:"taxes"`
 	Shipping uint64 `json:"shipping"`
 	SubTotal uint64 `json:"subtotal"`
 	Discount uint64 `json:"discount"`
+	Cost     uint64 `json:"-"`
 
-	Total uint64 `json:"total"`
+	// ShippingMethod is the shipping rate of the zone of the shipping
+	// address that Shipping was calculated with.
+	ShippingMethod string `json:"shipping_method,omitempty"`
 
-	PaymentState     string `json:"payment_state"`
-	FulfillmentState string `json:"fulfillment_state"`
+	// DeliveryInstructions are notes of the buyer for the carrier, like
+	// where to leave the package. See CleanDeliveryInstructions.
+	DeliveryInstructions string `json:"delivery_instructions,omitempty" sql:"size:500"`
+
+	// PriceList is the price list the line items were priced with. When
+	// some products have no price in the list of the customer group of the
+	// buyer, it's still the list of the group.
+	PriceList string `json:"price_list,omitempty" sql:"index:idx_orders_price_list"`
+
+	// ManualDiscount is the discount of an approved PriceOverride. It is
+	// included in Discount.
+	ManualDiscount uint64 `json:"manual_discount"`
+
+	// Adjustments are the taxes and discounts that were applied to the Order
+	// when it was last priced.
+	Adjustments    []*calculator.Adjustment `json:"adjustments" sql:"-"`
+	RawAdjustments string                   `json:"-" gorm:"size:65535"`
+
+	Total         uint64 `json:"total"`
+	TotalRefunded uint64 `json:"total_refunded" sql:"index:idx_orders_total_refunded"`
+
+	PricedAt       *time.Time `json:"priced_at,omitempty"`
+	PricesExpireAt *time.Time `json:"prices_expire_at,omitempty"`
+
+	// ExchangeRate is the amount of the currency of the Order that one unit
+	// of ExchangeRateCurrency, the default currency of the shop, bought when
+	// the prices were pinned, with the exchange rates of ExchangeRateDate.
+	ExchangeRate         float64 `json:"exchange_rate,omitempty"`
+	ExchangeRateCurrency string  `json:"exchange_rate_currency,omitempty"`
+	ExchangeRateDate     string  `json:"exchange_rate_date,omitempty"`
+
+	PaymentState     string `json:"payment_state" sql:"index:idx_orders_payment_state"`
+	FulfillmentState string `json:"fulfillment_state" sql:"index:idx_orders_fulfillment_state"`
 	State            string `json:"state"`
 
-	PaymentProcessor string `json:"payment_processor"`
+	PaymentProcessor string `json:"payment_processor" sql:"index:idx_orders_payment_processor"`
 
 	Transactions []*Transaction `json:"transactions"`
 	Notes        []*OrderNote   `json:"notes"`
@@ -65,22 +104,66 @@ type Order struct {
 	ShippingAddress   Address `json:"shipping_address" gorm:"ForeignKey:ShippingAddressID"`
 	ShippingAddressID string  `json:"shipping_address_id"`
 
+	// AddressVerification is the result of verifying the shipping address
+	// with the address validation provider of the instance, empty when it
+	// wasn't verified.
+	AddressVerification string `json:"address_verification,omitempty"`
+
 	BillingAddress   Address `json:"billing_address" gorm:"ForeignKey:BillingAddressID"`
 	BillingAddressID string  `json:"billing_address_id"`
 
 	VATNumber string `json:"vatnumber"`
+	// VATNumberUnverified is set when the VAT number was accepted while it
+	// couldn't be validated. The Order is charged VAT until the number is
+	// validated.
+	VATNumberUnverified bool `json:"vatnumber_unverified,omitempty"`
+
+	// ReverseCharge is set when the Order was priced without taxes, because
+	// the VAT number belongs to a business in another EU country, which pays
+	// the VAT itself.
+	ReverseCharge bool `json:"reverse_charge"`
+
+	// TaxExempt is set when the Order is priced without taxes, because the
+	// buyer or the Order was exempted by an admin for TaxExemptReason.
+	TaxExempt       bool   `json:"tax_exempt"`
+	TaxExemptReason string `json:"tax_exempt_reason,omitempty"`
 
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-"`
 
+	// Tags label orders for the workflows of the shop, like the rules of
+	// automations.
+	Tags    []string `sql:"-" json:"tags,omitempty"`
+	RawTags string   `json:"-"`
+
+	// OnHold orders can't be shipped until an admin releases them.
+	OnHold     bool   `json:"on_hold" sql:"index:idx_orders_on_hold"`
+	HoldReason string `json:"hold_reason,omitempty"`
+
+	// SuppressNotifications keeps the mails and webhooks about the Order
+	// from being sent, for imported and test orders.
+	SuppressNotifications bool `json:"suppress_notifications,omitempty"`
+
+	// AbandonedAt is when the Order was cancelled because it stayed unpaid
+	// for too long, see conf.Configuration.AbandonedOrders.
+	AbandonedAt *time.Time `json:"abandoned_at,omitempty" sql:"index:idx_orders_abandoned_at"`
+
 	CouponCode string `json:"coupon_code,omitempty"`
 
+	// SubscriptionID is set on the orders created for the renewals of a
+	// Subscription, along with the ID of the invoice of the provider.
+	SubscriptionID string `json:"subscription_id,omitempty" sql:"index:idx_orders_subscription_id"`
+	// SubscriptionInvoiceID is NULL for other orders, so it can be unique.
+	SubscriptionInvoiceID *string `json:"-" sql:"unique_index:idx_orders_subscription_invoice_id"`
+
 	Coupon    *Coupon `json:"coupon,omitempty" sql:"-"`
 	RawCoupon string  `json:"-"`
 
+	Inferred *LocaleInference `json:"inferred,omitempty" sql:"-"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
-	DeletedAt *time.Time `json:"-" sql:"index:idx_orders_deleted_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" sql:"index:idx_orders_deleted_at"`
 }
 
 // TableName returns the database table name for the Order model.
@@ -96,6 +179,12 @@ func (o *Order) AfterFind() error {
 			return err
 		}
 	}
+	if o.RawTags != "" {
+		err := json.Unmarshal([]byte(o.RawTags), &o.Tags)
+		if err != nil {
+			return err
+		}
+	}
 	if o.RawCoupon != "" {
 		o.Coupon = &Coupon{}
 		err := json.Unmarshal([]byte(o.RawCoupon), &o.Coupon)
@@ -103,12 +192,19 @@ func (o *Order) AfterFind() error {
 			return err
 		}
 	}
+	if o.RawAdjustments != "" {
+		err := json.Unmarshal([]byte(o.RawAdjustments), &o.Adjustments)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
 // BeforeSave database callback.
 func (o *Order) BeforeSave() error {
+	o.NormalizedEmail = NormalizeEmail(o.Email)
 	if o.MetaData != nil {
 		data, err := json.Marshal(o.MetaData)
 		if err != nil {
@@ -116,6 +212,15 @@ func (o *Order) BeforeSave() error {
 		}
 		o.RawMetaData = string(data)
 	}
+	if len(o.Tags) > 0 {
+		data, err := json.Marshal(o.Tags)
+		if err != nil {
+			return err
+		}
+		o.RawTags = string(data)
+	} else {
+		o.RawTags = ""
+	}
 	if o.Coupon != nil {
 		data, err := json.Marshal(o.Coupon)
 		if err != nil {
@@ -124,6 +229,56 @@ func (o *Order) BeforeSave() error {
 		o.RawCoupon = string(data)
 	}
 
+	return o.encodeAdjustments()
+}
+
+// HasTag tells whether the order has a tag.
+func (o *Order) HasTag(tag string) bool {
+	for _, t := range o.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTag adds a tag to the order, and tells whether it didn't have it yet.
+func (o *Order) AddTag(tag string) bool {
+	if o.HasTag(tag) {
+		return false
+	}
+	o.Tags = append(o.Tags, tag)
+	return true
+}
+
+// SaveTagsAndHold saves only the tags and the hold of the Order, so changes
+// made to its other columns since it was loaded are kept.
+func (o *Order) SaveTagsAndHold(db *gorm.DB) error {
+	rawTags := ""
+	if len(o.Tags) > 0 {
+		data, err := json.Marshal(o.Tags)
+		if err != nil {
+			return err
+		}
+		rawTags = string(data)
+	}
+	o.RawTags = rawTags
+	return db.Model(o).UpdateColumns(map[string]interface{}{
+		"raw_tags":    o.RawTags,
+		"on_hold":     o.OnHold,
+		"hold_reason": o.HoldReason,
+	}).Error
+}
+
+func (o *Order) encodeAdjustments() error {
+	if o.Adjustments == nil {
+		return nil
+	}
+	data, err := json.Marshal(o.Adjustments)
+	if err != nil {
+		return err
+	}
+	o.RawAdjustments = string(data)
 	return nil
 }
 
@@ -142,17 +297,132 @@ func NewOrder(instanceID, sessionID, email, currency string) *Order {
 	return order
 }
 
-// CalculateTotal calculates the total price of an Order.
-func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]interface{}) {
-	items := make([]calculator.Item, len(o.LineItems))
+// CalculateTotal calculates the total price of an Order and returns the
+// price breakdown it is based on.
+func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]interface{}) calculator.Price {
+	price := calculator.CalculatePrice(settings, claims, o.priceParameters())
+	if o.ManualDiscount > 0 {
+		discount := o.ManualDiscount
+		if discount > price.Total {
+			discount = price.Total
+		}
+		price.Discount += discount
+		price.Total -= discount
+		price.AddAdjustment(calculator.ManualDiscountAdjustment, "", 0, discount, "")
+	}
+	for _, adjustment := range price.Adjustments {
+		if adjustment.Type == calculator.CouponAdjustment && o.Coupon != nil {
+			adjustment.Name = o.Coupon.Code
+		}
+	}
 	for i, item := range o.LineItems {
-		items[i] = item
+		breakdown := price.Items[i]
+		for _, discount := range breakdown.AppliedDiscounts {
+			if discount.Type == calculator.CouponAdjustment && o.Coupon != nil {
+				discount.Name = o.Coupon.Code
+			}
+		}
+		item.PriceBreakdown = &breakdown
 	}
 
-	price := calculator.CalculatePrice(settings, claims, o.ShippingAddress.Country, o.Currency, o.Coupon, items)
-
+	o.Adjustments = price.Adjustments
+	if o.Adjustments == nil {
+		o.Adjustments = []*calculator.Adjustment{}
+	}
+	o.ReverseCharge = price.ReverseCharge
+	if price.ShippingError == nil {
+		o.ShippingMethod = price.ShippingMethod
+	}
+	o.Shipping = price.Shipping
 	o.SubTotal = price.Subtotal
 	o.Taxes = price.Taxes
 	o.Discount = price.Discount
 	o.Total = price.Total
+	return price
+}
+
+// CalculateItemsPrice calculates the price of the line items of an Order
+// without shipping costs, like for a refund of some of its items. The Order
+// isn't changed.
+func (o *Order) CalculateItemsPrice(settings *calculator.Settings, claims map[string]interface{}) calculator.Price {
+	params := o.priceParameters()
+	params.WithoutShipping = true
+	return calculator.CalculatePrice(settings, claims, params)
+}
+
+func (o *Order) priceParameters() calculator.PriceParameters {
+	items := make([]calculator.Item, len(o.LineItems))
+	for i, item := range o.LineItems {
+		items[i] = item
+	}
+	params := calculator.PriceParameters{
+		Country:        o.ShippingAddress.Country,
+		Currency:       o.Currency,
+		Coupon:         o.Coupon,
+		Items:          items,
+		VATNumber:      o.VATNumber,
+		TaxExempt:      o.TaxExempt,
+		ShippingMethod: o.ShippingMethod,
+	}
+	if o.VATNumberUnverified {
+		params.VATNumber = ""
+	}
+	return params
+}
+
+// SetManualDiscount replaces the manual discount of the Order and updates its
+// totals and adjustments. It returns false if the discount is more than the
+// Order's total.
+func (o *Order) SetManualDiscount(amount uint64) bool {
+	total := o.Total + o.ManualDiscount
+	if amount > total {
+		return false
+	}
+	o.Discount = o.Discount - o.ManualDiscount + amount
+	o.Total = total - amount
+	o.ManualDiscount = amount
+
+	adjustments := []*calculator.Adjustment{}
+	for _, adjustment := range o.Adjustments {
+		if adjustment.Type != calculator.ManualDiscountAdjustment {
+			adjustments = append(adjustments, adjustment)
+		}
+	}
+	if amount > 0 {
+		adjustments = append(adjustments, &calculator.Adjustment{Type: calculator.ManualDiscountAdjustment, Amount: amount})
+	}
+	o.Adjustments = adjustments
+	o.encodeAdjustments()
+	return true
+}
+
+// PinPrices records when the prices of the Order were calculated. When validity
+// is positive, the prices are only guaranteed until then. Orders in another
+// currency than the default currency of the shop also record the exchange
+// rate between the two in the snapshot, when there is one.
+func (o *Order) PinPrices(validity time.Duration, snapshot *rates.Snapshot, currency string) {
+	now := time.Now()
+	o.PricedAt = &now
+	o.PricesExpireAt = nil
+	if validity > 0 {
+		expires := now.Add(validity)
+		o.PricesExpireAt = &expires
+	}
+
+	o.ExchangeRate, o.ExchangeRateCurrency, o.ExchangeRateDate = 0, "", ""
+	if snapshot == nil || currency == "" || currency == o.Currency {
+		return
+	}
+	rebased, err := snapshot.Rebase(currency)
+	if err != nil {
+		return
+	}
+	if rate, ok := rebased.Rate(o.Currency); ok {
+		o.ExchangeRate, o.ExchangeRateCurrency, o.ExchangeRateDate = rate, currency, snapshot.Date
+	}
+}
+
+// PricesExpired returns true if the pinned prices of the Order are no longer valid.
+func (o *Order) PricesExpired() bool {
+	return o.PricesExpireAt != nil && time.Now().After(*o.PricesExpireAt)
 }
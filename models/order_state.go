@@ -0,0 +1,78 @@
+package models
+
+// ShippingState is the fulfillment state of an Order that is being shipped
+const ShippingState = "shipping"
+
+// DeliveredState is the state of an Order that reached the buyer
+const DeliveredState = "delivered"
+
+// RefundedState is the state of an Order that was refunded in full
+const RefundedState = "refunded"
+
+var stateTransitions = map[string][]string{
+	PendingState:   {PaidState, FailedState},
+	PaidState:      {ShippedState, RefundedState, FailedState},
+	ShippedState:   {DeliveredState, RefundedState},
+	DeliveredState: {RefundedState},
+	FailedState:    {},
+	RefundedState:  {},
+}
+
+var fulfillmentStateTransitions = map[string][]string{
+	PendingState:   {ShippingState, ShippedState},
+	ShippingState:  {PendingState, ShippedState},
+	ShippedState:   {DeliveredState},
+	DeliveredState: {},
+}
+
+// AllowedStateTransitions returns the states the Order can move to from its
+// current state.
+func (o *Order) AllowedStateTransitions() []string {
+	return allowedTransitions(stateTransitions, o.State)
+}
+
+// AllowedFulfillmentStateTransitions returns the fulfillment states the Order
+// can move to from its current fulfillment state.
+func (o *Order) AllowedFulfillmentStateTransitions() []string {
+	return allowedTransitions(fulfillmentStateTransitions, o.FulfillmentState)
+}
+
+// TransitionState moves the Order to a new state. It returns false if the
+// transition isn't allowed.
+func (o *Order) TransitionState(state string) bool {
+	if !contains(o.AllowedStateTransitions(), state) {
+		return false
+	}
+	o.State = state
+	return true
+}
+
+// TransitionFulfillmentState moves the Order to a new fulfillment state. It
+// returns false if the transition isn't allowed.
+func (o *Order) TransitionFulfillmentState(state string) bool {
+	if !contains(o.AllowedFulfillmentStateTransitions(), state) {
+		return false
+	}
+	o.FulfillmentState = state
+	return true
+}
+
+func allowedTransitions(transitions map[string][]string, state string) []string {
+	// orders from before the states were tracked start out as pending
+	if state == "" {
+		state = PendingState
+	}
+	if allowed, ok := transitions[state]; ok {
+		return allowed
+	}
+	return []string{}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// ApprovedState is the state of a PriceOverride once it applies to its order
+const ApprovedState = "approved"
+
+// RejectedState is the state of a PriceOverride that was turned down
+const RejectedState = "rejected"
+
+// PriceOverride is a manual discount an admin gives on an unpaid order. When
+// the discount is above the approval threshold of the instance, it only applies
+// once a second admin approved it.
+type PriceOverride struct {
+	InstanceID string `json:"-"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id"`
+
+	Discount uint64 `json:"discount"`
+	Currency string `json:"currency"`
+	Reason   string `json:"reason"`
+
+	Status      string     `json:"status"`
+	RequestedBy string     `json:"requested_by"`
+	ReviewedBy  string     `json:"reviewed_by,omitempty"`
+	ReviewedAt  *time.Time `json:"reviewed_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the PriceOverride model.
+func (PriceOverride) TableName() string {
+	return tableName("price_overrides")
+}
@@ -0,0 +1,74 @@
+package models
+
+import "time"
+
+// RefundingState is the state of a Return while its refund is taken
+const RefundingState = "refunding"
+
+// Return is a request to send back items of a paid order. Its amount is what
+// the return policy of the site allows to refund for the items, which an admin
+// can override with a reason when refunding the return.
+type Return struct {
+	InstanceID string `json:"-"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id" sql:"index:idx_returns_order_id"`
+	UserID     string `json:"user_id,omitempty"`
+
+	Items []*ReturnItem `json:"items"`
+	// Reason is why the buyer sends back the items.
+	Reason string `json:"reason,omitempty"`
+
+	// Amount is the refundable amount of the items, after the restocking
+	// fees.
+	Amount        uint64 `json:"amount"`
+	RestockingFee uint64 `json:"restocking_fee"`
+	Currency      string `json:"currency"`
+
+	// OverrideAmount replaces Amount when an admin overrode it, or accepted
+	// items that aren't eligible for returns.
+	OverrideAmount *uint64 `json:"override_amount,omitempty"`
+	OverrideReason string  `json:"override_reason,omitempty"`
+	OverriddenBy   string  `json:"overridden_by,omitempty"`
+
+	Status     string     `json:"status"`
+	RefundID   string     `json:"refund_id,omitempty"`
+	ReviewedBy string     `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Return model.
+func (Return) TableName() string {
+	return tableName("returns")
+}
+
+// RefundAmount is the amount the return is refunded with.
+func (r *Return) RefundAmount() uint64 {
+	if r.OverrideAmount != nil {
+		return *r.OverrideAmount
+	}
+	return r.Amount
+}
+
+// ReturnItem is a quantity of a line item sent back with a Return.
+type ReturnItem struct {
+	ID         int64  `json:"-"`
+	ReturnID   string `json:"-"`
+	LineItemID int64  `json:"line_item_id"`
+
+	Sku      string `json:"sku"`
+	Quantity uint64 `json:"quantity"`
+
+	Amount        uint64 `json:"amount"`
+	RestockingFee uint64 `json:"restocking_fee"`
+	// Ineligible is why the item wasn't eligible for a return, when an admin
+	// accepted it anyway.
+	Ineligible string `json:"ineligible,omitempty"`
+}
+
+// TableName returns the database table name for the ReturnItem model.
+func (ReturnItem) TableName() string {
+	return tableName("return_items")
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ActiveState is the state of a Subscription that renews.
+const ActiveState = "active"
+
+// PastDueState is the state of a Subscription whose last renewal failed to
+// be paid.
+const PastDueState = "past_due"
+
+// CanceledState is the state of a Subscription that no longer renews.
+const CanceledState = "canceled"
+
+// SubscriptionMetadata is the recurring plan a product is billed on.
+type SubscriptionMetadata struct {
+	// Plan is the ID of the plan with the payment provider.
+	Plan string `json:"plan"`
+}
+
+// Subscription is a recurring product a user is billed for by a payment
+// provider. Every paid invoice of the provider becomes an Order of the
+// Subscription.
+type Subscription struct {
+	InstanceID string `json:"-"`
+	ID         string `json:"id"`
+	UserID     string `json:"user_id" sql:"index:idx_subscriptions_user_id"`
+	Email      string `json:"email"`
+
+	Path     string `json:"path"`
+	Sku      string `json:"sku"`
+	Title    string `json:"title"`
+	Type     string `json:"type"`
+	Quantity uint64 `json:"quantity"`
+	Plan     string `json:"plan"`
+
+	Processor   string `json:"processor"`
+	ProcessorID string `json:"processor_id" sql:"index:idx_subscriptions_processor_id"`
+	CustomerID  string `json:"-"`
+
+	// State is the status of the subscription with the payment provider,
+	// like active, past_due or canceled.
+	State             string     `json:"state"`
+	CancelAtPeriodEnd bool       `json:"cancel_at_period_end"`
+	CurrentPeriodEnd  *time.Time `json:"current_period_end,omitempty"`
+	CanceledAt        *time.Time `json:"canceled_at,omitempty"`
+
+	ShippingAddress   Address `json:"shipping_address" gorm:"ForeignKey:ShippingAddressID"`
+	ShippingAddressID string  `json:"shipping_address_id"`
+
+	BillingAddress   Address `json:"billing_address" gorm:"ForeignKey:BillingAddressID"`
+	BillingAddressID string  `json:"billing_address_id"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Subscription model.
+func (Subscription) TableName() string {
+	return tableName("subscriptions")
+}
+
+// GetSubscriptionByProcessorID returns the Subscription with the ID of a
+// payment provider, or nil if there is none.
+func GetSubscriptionByProcessorID(db *gorm.DB, processor, processorID string) (*Subscription, error) {
+	sub := &Subscription{}
+	if rsp := db.Where("processor = ? AND processor_id = ?", processor, processorID).First(sub); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return sub, nil
+}
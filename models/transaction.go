@@ -21,6 +21,11 @@ type Transaction struct {
 	OrderID    string `json:"order_id"`
 
 	ProcessorID string `json:"processor_id"`
+	// GiftCardID is set for the part of a payment that was paid with a
+	// gift card, and for refunds of it.
+	GiftCardID string `json:"gift_card_id,omitempty"`
+	// ChargeID is the charge a refund was made from.
+	ChargeID string `json:"charge_id,omitempty"`
 
 	User   *User  `json:"-"`
 	UserID string `json:"user_id,omitempty"`
@@ -34,10 +39,35 @@ type Transaction struct {
 	Status string `json:"status"`
 	Type   string `json:"type"`
 
+	// DisputeID is set when the buyer disputed the charge with their bank,
+	// as reported by the webhooks of the payment provider.
+	DisputeID     string     `json:"dispute_id,omitempty"`
+	DisputeReason string     `json:"dispute_reason,omitempty"`
+	DisputedAt    *time.Time `json:"disputed_at,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"-"`
 }
 
+// RefundedAmount returns how much of a charge was refunded or is being
+// refunded. Refunds from before they were linked to their charge count
+// against the charge with the same gift card on the order.
+func RefundedAmount(db *gorm.DB, charge *Transaction) (uint64, error) {
+	amounts := []uint64{}
+	rsp := db.Model(&Transaction{}).
+		Where("type = ? AND status <> ?", RefundTransactionType, FailedState).
+		Where("charge_id = ? OR (charge_id = '' AND order_id = ? AND gift_card_id = ?)", charge.ID, charge.OrderID, charge.GiftCardID).
+		Pluck("amount", &amounts)
+	if rsp.Error != nil {
+		return 0, rsp.Error
+	}
+	var refunded uint64
+	for _, amount := range amounts {
+		refunded += amount
+	}
+	return refunded, nil
+}
+
 // TableName returns the database table name for the Transaction model.
 func (Transaction) TableName() string {
 	return tableName("transactions")
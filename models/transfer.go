@@ -0,0 +1,114 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// Transfer is a payout of a vendor's share of an order to a connected account.
+type Transfer struct {
+	InstanceID    string `json:"-"`
+	ID            string `json:"id"`
+	OrderID       string `json:"order_id"`
+	TransactionID string `json:"transaction_id"`
+
+	Vendor      string `json:"vendor"`
+	Destination string `json:"destination"`
+	ProcessorID string `json:"processor_id"`
+
+	Amount   uint64 `json:"amount"`
+	Reversed uint64 `json:"reversed"`
+	Currency string `json:"currency"`
+
+	FailureDescription string `json:"failure_description,omitempty"`
+
+	Status string `json:"status"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the Transfer model.
+func (Transfer) TableName() string {
+	return tableName("transfers")
+}
+
+// NewVendorTransfers splits the vendor shares of an order's line items into
+// one pending Transfer per connected account.
+func NewVendorTransfers(order *Order, transaction *Transaction) []*Transfer {
+	transfers := []*Transfer{}
+	byAccount := map[string]*Transfer{}
+	amounts := VendorAmounts(order)
+	for _, item := range order.LineItems {
+		amount := amounts[item.ID]
+		if amount == 0 {
+			continue
+		}
+
+		transfer, ok := byAccount[item.VendorAccount]
+		if !ok {
+			transfer = &Transfer{
+				InstanceID:    order.InstanceID,
+				ID:            uuid.NewRandom().String(),
+				OrderID:       order.ID,
+				TransactionID: transaction.ID,
+				Vendor:        item.Vendor,
+				Destination:   item.VendorAccount,
+				Currency:      order.Currency,
+				Status:        PendingState,
+			}
+			byAccount[item.VendorAccount] = transfer
+			transfers = append(transfers, transfer)
+		}
+		transfer.Amount += amount
+	}
+	return transfers
+}
+
+// VendorAmounts returns what the vendor of each line item of an order is
+// paid for the whole line, by line item ID. The share is taken from what the
+// buyer paid for the line without taxes, after coupons, promotions, spend
+// tiers and its part of the manual discount of the order.
+func VendorAmounts(order *Order) map[int64]uint64 {
+	nets := make(map[int64]uint64, len(order.LineItems))
+	var total uint64
+	for _, item := range order.LineItems {
+		net := (item.Price + item.AddonPrice) * item.Quantity
+		if item.PriceBreakdown != nil {
+			net = item.PriceBreakdown.LineNet
+		}
+		nets[item.ID] = net
+		total += net
+	}
+
+	amounts := map[int64]uint64{}
+	for _, item := range order.LineItems {
+		if item.VendorAccount == "" || item.VendorShare == 0 {
+			continue
+		}
+		net := nets[item.ID]
+		if order.ManualDiscount > 0 && total > 0 {
+			discount := rint(float64(order.ManualDiscount) * float64(net) / float64(total))
+			if discount > net {
+				discount = net
+			}
+			net -= discount
+		}
+		if amount := rint(float64(net) * float64(item.VendorShare) / 100); amount > 0 {
+			amounts[item.ID] = amount
+		}
+	}
+	return amounts
+}
+
+// GetTransfersForTransaction finds all the transfers paid out of a transaction.
+func GetTransfersForTransaction(db *gorm.DB, transactionID string) ([]*Transfer, error) {
+	transfers := []*Transfer{}
+	if rsp := db.Where("transaction_id = ?", transactionID).Find(&transfers); rsp.Error != nil && !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+	return transfers, nil
+}
@@ -11,12 +11,21 @@ type User struct {
 	InstanceID string `json:"-"`
 	ID         string `json:"id"`
 	Email      string `json:"email"`
+	// NormalizedEmail is the email users are matched by, see NormalizeEmail.
+	NormalizedEmail string `json:"-" sql:"index:idx_users_normalized_email"`
+
+	// TaxExempt users, like verified resellers, are charged no taxes on
+	// their new orders. TaxExemptReason tells why, for audits.
+	TaxExempt       bool   `json:"tax_exempt"`
+	TaxExemptReason string `json:"tax_exempt_reason,omitempty"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-"`
 
 	OrderCount int64 `json:"order_count,ommitempty" gorm:"-"`
+	// Groups are the names of the customer groups of the user.
+	Groups []string `json:"groups,omitempty" sql:"-"`
 }
 
 // TableName returns the database table name for the User model.
@@ -24,6 +33,44 @@ func (User) TableName() string {
 	return tableName("users")
 }
 
+// BeforeSave database callback.
+func (u *User) BeforeSave() error {
+	u.NormalizedEmail = NormalizeEmail(u.Email)
+	return nil
+}
+
+// UserEmailChange records a change of the email of a user.
+type UserEmailChange struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-"`
+	UserID     string `json:"user_id" sql:"index:idx_user_email_changes_user_id"`
+	OldEmail   string `json:"old_email"`
+	NewEmail   string `json:"new_email"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the UserEmailChange model.
+func (UserEmailChange) TableName() string {
+	return tableName("user_email_changes")
+}
+
+// ChangeEmail changes the email of a user, and records the change in the
+// email history of the user.
+func (u *User) ChangeEmail(tx *gorm.DB, email string) error {
+	change := &UserEmailChange{
+		InstanceID: u.InstanceID,
+		UserID:     u.ID,
+		OldEmail:   u.Email,
+		NewEmail:   email,
+	}
+	if rsp := tx.Create(change); rsp.Error != nil {
+		return rsp.Error
+	}
+	u.Email = email
+	return tx.Save(u).Error
+}
+
 func GetUser(db *gorm.DB, userID string) (*User, error) {
 	user := &User{ID: userID}
 	if result := db.Find(user); result.Error != nil {
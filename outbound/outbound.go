@@ -0,0 +1,114 @@
+// Package outbound configures the HTTP requests gocommerce makes to other
+// services: product pages, payment providers, webhooks, mail APIs and VIES.
+// All of them use the default transport of net/http, so the proxy and TLS
+// settings are applied to it once at startup.
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// tlsVersions are the supported values of the minimum TLS version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": 0x0304,
+}
+
+// Configure applies the outbound configuration to the default transport of
+// net/http. Without a proxy URL, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables still apply.
+func Configure(config *conf.OutboundConfiguration) error {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return errors.New("The default HTTP transport was replaced")
+	}
+	return configureTransport(transport, config)
+}
+
+func configureTransport(transport *http.Transport, config *conf.OutboundConfiguration) error {
+	if config.ProxyURL != "" {
+		proxy, err := url.Parse(config.ProxyURL)
+		if err != nil || proxy.Host == "" {
+			return fmt.Errorf("Invalid proxy URL '%v'", config.ProxyURL)
+		}
+		transport.Proxy = proxyFunc(proxy, config.NoProxy)
+	}
+
+	if config.CABundle == "" && config.TLSMinVersion == "" {
+		return nil
+	}
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	if config.TLSMinVersion != "" {
+		version, ok := tlsVersions[config.TLSMinVersion]
+		if !ok {
+			return fmt.Errorf("Unknown TLS version '%v', use 1.0, 1.1, 1.2 or 1.3", config.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if config.CABundle != "" {
+		pool, err := loadCABundle(config.CABundle)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+	return nil
+}
+
+// loadCABundle returns the certificates of the system with the ones of a PEM
+// file added.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading CA bundle")
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in CA bundle '%v'", path)
+	}
+	return pool, nil
+}
+
+// proxyFunc sends all requests through a proxy, except the ones to hosts on
+// the comma separated noProxy list. Entries match the host and its subdomains,
+// and * matches all hosts.
+func proxyFunc(proxy *url.URL, noProxy string) func(*http.Request) (*url.URL, error) {
+	exceptions := []string{}
+	for _, entry := range strings.Split(noProxy, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			exceptions = append(exceptions, strings.TrimPrefix(entry, "."))
+		}
+	}
+	return func(r *http.Request) (*url.URL, error) {
+		host := strings.ToLower(r.URL.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		for _, exception := range exceptions {
+			if exception == "*" || host == exception || strings.HasSuffix(host, "."+exception) {
+				return nil, nil
+			}
+		}
+		return proxy, nil
+	}
+}
@@ -0,0 +1,76 @@
+package outbound
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+func TestProxy(t *testing.T) {
+	transport := &http.Transport{}
+	err := configureTransport(transport, &conf.OutboundConfiguration{
+		ProxyURL: "http://proxy.internal:3128",
+		NoProxy:  "localhost, .example.com,internal.net",
+	})
+	require.NoError(t, err)
+
+	proxied := func(rawURL string) string {
+		r := httptest.NewRequest(http.MethodGet, rawURL, nil)
+		proxy, err := transport.Proxy(r)
+		require.NoError(t, err)
+		if proxy == nil {
+			return ""
+		}
+		return proxy.String()
+	}
+	assert.Equal(t, "http://proxy.internal:3128", proxied("https://api.stripe.com/v1/charges"))
+	assert.Equal(t, "", proxied("http://localhost:8080/"))
+	assert.Equal(t, "", proxied("https://shop.example.com/product"))
+	assert.Equal(t, "", proxied("https://example.com/product"))
+	assert.Equal(t, "", proxied("https://api.internal.net/"))
+	assert.Equal(t, "http://proxy.internal:3128", proxied("https://notexample.com/"))
+
+	assert.Error(t, configureTransport(&http.Transport{}, &conf.OutboundConfiguration{ProxyURL: "proxy"}))
+}
+
+func TestTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	bundle, err := ioutil.TempFile("", "ca-bundle")
+	require.NoError(t, err)
+	defer os.Remove(bundle.Name())
+	require.NoError(t, pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	require.NoError(t, bundle.Close())
+
+	get := func(config *conf.OutboundConfiguration) error {
+		transport := &http.Transport{}
+		require.NoError(t, configureTransport(transport, config))
+		client := &http.Client{Transport: transport}
+		rsp, err := client.Get(server.URL)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return err
+	}
+	assert.Error(t, get(&conf.OutboundConfiguration{}), "the test server isn't trusted by default")
+	assert.NoError(t, get(&conf.OutboundConfiguration{CABundle: bundle.Name(), TLSMinVersion: "1.2"}))
+
+	transport := &http.Transport{}
+	require.NoError(t, configureTransport(transport, &conf.OutboundConfiguration{TLSMinVersion: "1.2"}))
+	assert.Equal(t, uint16(tls.VersionTLS12), transport.TLSClientConfig.MinVersion)
+
+	assert.Error(t, configureTransport(&http.Transport{}, &conf.OutboundConfiguration{TLSMinVersion: "2"}))
+	assert.Error(t, configureTransport(&http.Transport{}, &conf.OutboundConfiguration{CABundle: "/nonexistent.pem"}))
+}
@@ -3,6 +3,7 @@ package payments
 import (
 	"context"
 	"net/http"
+	"time"
 )
 
 const (
@@ -21,6 +22,12 @@ type Provider interface {
 	NewPreauthorizer(ctx context.Context, r *http.Request) (Preauthorizer, error)
 }
 
+// HealthChecker is implemented by payment providers that can check whether
+// their API is reachable with the configured credentials.
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+}
+
 // Charger wraps the Charge method which creates new payments with the provider.
 type Charger func(amount uint64, currency string) (string, error)
 
@@ -31,7 +38,46 @@ type Refunder func(transactionID string, amount uint64, currency string) (string
 // with the provider.
 type Preauthorizer func(amount uint64, currency string, description string) (*PreauthorizationResult, error)
 
+// Transferrer wraps the Transfer method which moves part of a captured charge
+// to a connected account.
+type Transferrer func(chargeID string, destination string, amount uint64, currency string) (string, error)
+
+// TransferReverser wraps the method which reverses a transfer to a connected
+// account, either fully or partially.
+type TransferReverser func(transferID string, amount uint64) (string, error)
+
+// TransferProvider is implemented by payment providers that can pay out
+// marketplace vendors through connected accounts.
+type TransferProvider interface {
+	NewTransferrer(ctx context.Context, r *http.Request) (Transferrer, error)
+	NewTransferReverser(ctx context.Context, r *http.Request) (TransferReverser, error)
+}
+
 // PreauthorizationResult contains the data returned from a Preauthorization.
 type PreauthorizationResult struct {
 	ID string `json:"id"`
 }
+
+// Subscriber wraps the method which subscribes a customer to a recurring
+// plan with the provider.
+type Subscriber func(plan string, quantity uint64, email string) (*SubscriptionResult, error)
+
+// SubscriptionCanceler wraps the method which cancels a subscription, either
+// right away or at the end of the current billing period.
+type SubscriptionCanceler func(subscriptionID string, atPeriodEnd bool) (*SubscriptionResult, error)
+
+// SubscriptionProvider is implemented by payment providers that can bill
+// customers on a recurring plan.
+type SubscriptionProvider interface {
+	NewSubscriber(ctx context.Context, r *http.Request) (Subscriber, error)
+	NewSubscriptionCanceler(ctx context.Context, r *http.Request) (SubscriptionCanceler, error)
+}
+
+// SubscriptionResult contains the state of a subscription with the provider.
+type SubscriptionResult struct {
+	ID                string
+	CustomerID        string
+	Status            string
+	CancelAtPeriodEnd bool
+	CurrentPeriodEnd  time.Time
+}
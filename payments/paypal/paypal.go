@@ -5,10 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 	"sync"
 
 	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/payments"
@@ -39,20 +39,10 @@ func NewPaymentProvider(config Config) (payments.Provider, error) {
 	if config.ClientID == "" || config.Secret == "" {
 		return nil, errors.New("missing PayPal client_id and/or secret")
 	}
-	var ppEnv string
-	if config.Env == "production" {
-		ppEnv = paypalsdk.APIBaseLive
-	} else if config.Env == "sandbox" {
-		ppEnv = paypalsdk.APIBaseSandBox
-	} else {
-		// used for testing
-		ppEnv = config.Env
-	}
-
 	paypal, err := paypalsdk.NewClient(
 		config.ClientID,
 		config.Secret,
-		ppEnv,
+		apiBase(config.Env),
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error configuring paypal")
@@ -67,10 +57,27 @@ func NewPaymentProvider(config Config) (payments.Provider, error) {
 	}, nil
 }
 
+func apiBase(env string) string {
+	if env == "production" {
+		return paypalsdk.APIBaseLive
+	} else if env == "sandbox" {
+		return paypalsdk.APIBaseSandBox
+	}
+	// used for testing
+	return env
+}
+
 func (p *paypalPaymentProvider) Name() string {
 	return payments.PayPalProvider
 }
 
+// Ping requests an access token, which only succeeds when PayPal is reachable
+// and the client ID and secret are valid.
+func (p *paypalPaymentProvider) Ping(ctx context.Context) error {
+	_, err := p.client.GetAccessToken()
+	return err
+}
+
 func (p *paypalPaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
 	var bp paypalBodyParams
 	bod, err := r.GetBody()
@@ -103,7 +110,7 @@ func (p *paypalPaymentProvider) charge(paymentID string, userID string, amount u
 		return "", fmt.Errorf("No amount in this transaction %v", payment.Transactions[0])
 	}
 
-	transactionValue := fmt.Sprintf("%.2f", float64(amount)/100)
+	transactionValue := calculator.FormatAmount(amount, currency)
 
 	if transactionValue != payment.Transactions[0].Amount.Total || payment.Transactions[0].Amount.Currency != currency {
 		return "", fmt.Errorf("The Amount in the transaction doesn't match the amount for the order: %v", payment.Transactions[0].Amount)
@@ -123,7 +130,7 @@ func (p *paypalPaymentProvider) NewRefunder(ctx context.Context, r *http.Request
 
 func (p *paypalPaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
 	amt := &paypalsdk.Amount{
-		Total:    strconv.FormatUint(amount, 10),
+		Total:    calculator.FormatAmount(amount, currency),
 		Currency: currency,
 	}
 	ref, err := p.client.RefundSale(transactionID, amt)
@@ -156,7 +163,7 @@ func (p *paypalPaymentProvider) preauthorize(config *conf.Configuration, amount
 		ExperienceProfileID: profile.ID,
 		Transactions: []paypalsdk.Transaction{paypalsdk.Transaction{
 			Amount: &paypalsdk.Amount{
-				Total:    strconv.FormatUint(amount, 10),
+				Total:    calculator.FormatAmount(amount, currency),
 				Currency: currency,
 			},
 			Description: description,
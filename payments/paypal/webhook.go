@@ -0,0 +1,58 @@
+package paypal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
+	"github.com/pkg/errors"
+)
+
+// webhookVerification asks PayPal to verify the signature of an event sent
+// to a webhook.
+type webhookVerification struct {
+	AuthAlgo         string          `json:"auth_algo"`
+	CertURL          string          `json:"cert_url"`
+	TransmissionID   string          `json:"transmission_id"`
+	TransmissionSig  string          `json:"transmission_sig"`
+	TransmissionTime string          `json:"transmission_time"`
+	WebhookID        string          `json:"webhook_id"`
+	WebhookEvent     json.RawMessage `json:"webhook_event"`
+}
+
+// VerifyWebhook checks with PayPal that an event with the headers of its
+// request was sent by PayPal to the webhook with the ID.
+func VerifyWebhook(config Config, webhookID string, header http.Header, payload []byte) error {
+	client, err := paypalsdk.NewClient(config.ClientID, config.Secret, apiBase(config.Env))
+	if err != nil {
+		return errors.Wrap(err, "Error configuring paypal")
+	}
+	if _, err := client.GetAccessToken(); err != nil {
+		return errors.Wrap(err, "Error authorizing with paypal")
+	}
+
+	req, err := client.NewRequest(http.MethodPost, client.APIBase+"/v1/notifications/verify-webhook-signature", &webhookVerification{
+		AuthAlgo:         header.Get("Paypal-Auth-Algo"),
+		CertURL:          header.Get("Paypal-Cert-Url"),
+		TransmissionID:   header.Get("Paypal-Transmission-Id"),
+		TransmissionSig:  header.Get("Paypal-Transmission-Sig"),
+		TransmissionTime: header.Get("Paypal-Transmission-Time"),
+		WebhookID:        webhookID,
+		WebhookEvent:     json.RawMessage(payload),
+	})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	result := struct {
+		Status string `json:"verification_status"`
+	}{}
+	if err := client.SendWithAuth(req, &result); err != nil {
+		return errors.Wrap(err, "Error verifying webhook with paypal")
+	}
+	if result.Status != "SUCCESS" {
+		return fmt.Errorf("PayPal did not verify the webhook: %v", result.Status)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package stripe
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"encoding/json"
 
@@ -42,6 +43,13 @@ func (s *stripePaymentProvider) Name() string {
 	return payments.StripeProvider
 }
 
+// Ping fetches the balance of the account, which only succeeds when Stripe is
+// reachable and the secret key is valid.
+func (s *stripePaymentProvider) Ping(ctx context.Context) error {
+	_, err := s.client.Balance.Get(nil)
+	return err
+}
+
 func (s *stripePaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
 	var bp stripeBodyParams
 	bod, err := r.GetBody()
@@ -94,3 +102,105 @@ func (s *stripePaymentProvider) refund(transactionID string, amount uint64, curr
 func (s *stripePaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
 	return nil, errors.New("Stripe does not require preauthorization")
 }
+
+func (s *stripePaymentProvider) NewTransferrer(ctx context.Context, r *http.Request) (payments.Transferrer, error) {
+	return s.transfer, nil
+}
+
+func (s *stripePaymentProvider) transfer(chargeID string, destination string, amount uint64, currency string) (string, error) {
+	tr, err := s.client.Transfers.New(&stripe.TransferParams{
+		Amount:   int64(amount),
+		Currency: stripe.Currency(currency),
+		Dest:     destination,
+		SourceTx: chargeID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return tr.ID, nil
+}
+
+func (s *stripePaymentProvider) NewTransferReverser(ctx context.Context, r *http.Request) (payments.TransferReverser, error) {
+	return s.reverseTransfer, nil
+}
+
+func (s *stripePaymentProvider) reverseTransfer(transferID string, amount uint64) (string, error) {
+	rev, err := s.client.Reversals.New(&stripe.ReversalParams{
+		Transfer: transferID,
+		Amount:   amount,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return rev.ID, nil
+}
+
+func (s *stripePaymentProvider) NewSubscriber(ctx context.Context, r *http.Request) (payments.Subscriber, error) {
+	var bp stripeBodyParams
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(bod).Decode(&bp)
+	if err != nil {
+		return nil, err
+	}
+	if bp.StripeToken == "" {
+		return nil, errors.New("Stripe requires a stripe_token for creating a subscription")
+	}
+
+	return func(plan string, quantity uint64, email string) (*payments.SubscriptionResult, error) {
+		return s.subscribe(bp.StripeToken, plan, quantity, email)
+	}, nil
+}
+
+func (s *stripePaymentProvider) subscribe(token string, plan string, quantity uint64, email string) (*payments.SubscriptionResult, error) {
+	params := &stripe.CustomerParams{Email: email}
+	if err := params.SetSource(token); err != nil {
+		return nil, err
+	}
+	cus, err := s.client.Customers.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := s.client.Subs.New(&stripe.SubParams{
+		Customer: cus.ID,
+		Plan:     plan,
+		Quantity: quantity,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return subscriptionResult(sub, cus.ID), nil
+}
+
+func (s *stripePaymentProvider) NewSubscriptionCanceler(ctx context.Context, r *http.Request) (payments.SubscriptionCanceler, error) {
+	return s.cancelSubscription, nil
+}
+
+func (s *stripePaymentProvider) cancelSubscription(subscriptionID string, atPeriodEnd bool) (*payments.SubscriptionResult, error) {
+	sub, err := s.client.Subs.Cancel(subscriptionID, &stripe.SubParams{EndCancel: atPeriodEnd})
+	if err != nil {
+		return nil, err
+	}
+
+	var customerID string
+	if sub.Customer != nil {
+		customerID = sub.Customer.ID
+	}
+	return subscriptionResult(sub, customerID), nil
+}
+
+func subscriptionResult(sub *stripe.Sub, customerID string) *payments.SubscriptionResult {
+	return &payments.SubscriptionResult{
+		ID:                sub.ID,
+		CustomerID:        customerID,
+		Status:            string(sub.Status),
+		CancelAtPeriodEnd: sub.EndCancel,
+		CurrentPeriodEnd:  time.Unix(sub.PeriodEnd, 0),
+	}
+}
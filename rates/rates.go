@@ -0,0 +1,214 @@
+// Package rates fetches daily exchange rates from the European Central Bank
+// or Open Exchange Rates. The rates of a day are stored as a snapshot, so
+// amounts in different currencies are always converted with the rates of the
+// day they were paid, no matter when a report is run.
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Names of the sources of exchange rates.
+const (
+	ECB               = "ecb"
+	OpenExchangeRates = "openexchangerates"
+)
+
+// DateFormat is the format of the date of a snapshot.
+const DateFormat = "2006-01-02"
+
+const (
+	ecbURL               = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+	openExchangeRatesURL = "https://openexchangerates.org/api/latest.json"
+)
+
+// Snapshot are the exchange rates of a day, as the amount of each currency
+// one unit of the base currency buys.
+type Snapshot struct {
+	Date  string             `json:"date"`
+	Base  string             `json:"base"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// Rate returns the amount of a currency one unit of the base buys.
+func (s *Snapshot) Rate(currency string) (float64, bool) {
+	if currency == s.Base {
+		return 1, true
+	}
+	rate, ok := s.Rates[currency]
+	return rate, ok && rate > 0
+}
+
+// Convert converts an amount in the lowest unit of a currency to another
+// currency.
+func (s *Snapshot) Convert(amount uint64, from, to string) (uint64, error) {
+	if from == to {
+		return amount, nil
+	}
+	fromRate, ok := s.Rate(from)
+	if !ok {
+		return 0, fmt.Errorf("No exchange rate for %v on %v", from, s.Date)
+	}
+	toRate, ok := s.Rate(to)
+	if !ok {
+		return 0, fmt.Errorf("No exchange rate for %v on %v", to, s.Date)
+	}
+	return uint64(math.Floor(float64(amount)/fromRate*toRate + 0.5)), nil
+}
+
+// Rebase returns the snapshot with the rates of another base currency.
+func (s *Snapshot) Rebase(base string) (*Snapshot, error) {
+	if base == s.Base {
+		return s, nil
+	}
+	baseRate, ok := s.Rate(base)
+	if !ok {
+		return nil, fmt.Errorf("No exchange rate for %v on %v", base, s.Date)
+	}
+	rebased := &Snapshot{Date: s.Date, Base: base, Rates: map[string]float64{s.Base: 1 / baseRate}}
+	for currency, rate := range s.Rates {
+		if currency != base {
+			rebased.Rates[currency] = rate / baseRate
+		}
+	}
+	return rebased, nil
+}
+
+// Source fetches the latest exchange rates.
+type Source interface {
+	Name() string
+	Fetch(ctx context.Context) ([]*Snapshot, error)
+}
+
+// NewSource returns the source with a name. The URL replaces the one of the
+// source, like the 90 day history of the ECB to fill in past days, and the
+// app ID is the key of Open Exchange Rates.
+func NewSource(name, appID, sourceURL string) (Source, error) {
+	switch name {
+	case ECB:
+		if sourceURL == "" {
+			sourceURL = ecbURL
+		}
+		return &ecbSource{url: sourceURL}, nil
+	case OpenExchangeRates:
+		if appID == "" {
+			return nil, fmt.Errorf("Open Exchange Rates needs an app ID")
+		}
+		if sourceURL == "" {
+			sourceURL = openExchangeRatesURL
+		}
+		return &openExchangeRatesSource{url: sourceURL, appID: appID}, nil
+	}
+	return nil, fmt.Errorf("Unknown source of exchange rates: %v", name)
+}
+
+type ecbSource struct {
+	url string
+}
+
+func (s *ecbSource) Name() string {
+	return ECB
+}
+
+// Fetch reads the reference rates of the ECB, which are published for euros
+// on working days around 16:00 CET.
+func (s *ecbSource) Fetch(ctx context.Context) ([]*Snapshot, error) {
+	resp, err := get(ctx, s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data := struct {
+		Cube struct {
+			Days []struct {
+				Time  string `xml:"time,attr"`
+				Rates []struct {
+					Currency string  `xml:"currency,attr"`
+					Rate     float64 `xml:"rate,attr"`
+				} `xml:"Cube"`
+			} `xml:"Cube"`
+		} `xml:"Cube"`
+	}{}
+	if err := xml.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("Error reading ECB exchange rates: %v", err)
+	}
+
+	snapshots := []*Snapshot{}
+	for _, day := range data.Cube.Days {
+		if _, err := time.Parse(DateFormat, day.Time); err != nil {
+			return nil, fmt.Errorf("Bad date in ECB exchange rates: %v", day.Time)
+		}
+		snapshot := &Snapshot{Date: day.Time, Base: "EUR", Rates: map[string]float64{}}
+		for _, rate := range day.Rates {
+			snapshot.Rates[rate.Currency] = rate.Rate
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+type openExchangeRatesSource struct {
+	url   string
+	appID string
+}
+
+func (s *openExchangeRatesSource) Name() string {
+	return OpenExchangeRates
+}
+
+// Fetch reads the latest rates of Open Exchange Rates, which are for US
+// dollars on the free plan. Rates fetched during a day replace the earlier
+// ones of that day.
+func (s *openExchangeRatesSource) Fetch(ctx context.Context) ([]*Snapshot, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("app_id", s.appID)
+	u.RawQuery = query.Encode()
+
+	resp, err := get(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data := struct {
+		Timestamp int64              `json:"timestamp"`
+		Base      string             `json:"base"`
+		Rates     map[string]float64 `json:"rates"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("Error reading Open Exchange Rates: %v", err)
+	}
+	if data.Base == "" || data.Timestamp == 0 {
+		return nil, fmt.Errorf("Open Exchange Rates returned no rates")
+	}
+	date := time.Unix(data.Timestamp, 0).UTC().Format(DateFormat)
+	return []*Snapshot{{Date: date, Base: data.Base, Rates: data.Rates}}, nil
+}
+
+func get(ctx context.Context, sourceURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Fetching exchange rates from %v failed with status %v", req.URL.Host, resp.StatusCode)
+	}
+	return resp, nil
+}
@@ -0,0 +1,93 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const ecbResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<gesmes:subject>Reference rates</gesmes:subject>
+	<Cube>
+		<Cube time="2018-03-02">
+			<Cube currency="USD" rate="1.2320"/>
+			<Cube currency="GBP" rate="0.89320"/>
+		</Cube>
+		<Cube time="2018-03-01">
+			<Cube currency="USD" rate="1.2250"/>
+		</Cube>
+	</Cube>
+</gesmes:Envelope>`
+
+func TestECB(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, ecbResponse)
+	}))
+	defer server.Close()
+
+	source, err := NewSource(ECB, "", server.URL)
+	require.NoError(t, err)
+	snapshots, err := source.Fetch(context.Background())
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, &Snapshot{Date: "2018-03-02", Base: "EUR", Rates: map[string]float64{"USD": 1.232, "GBP": 0.8932}}, snapshots[0])
+	assert.Equal(t, "2018-03-01", snapshots[1].Date)
+}
+
+func TestOpenExchangeRates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("app_id") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"timestamp": 1520035200, "base": "USD", "rates": {"EUR": 0.8117, "USD": 1}}`)
+	}))
+	defer server.Close()
+
+	_, err := NewSource(OpenExchangeRates, "", server.URL)
+	assert.Error(t, err, "an app ID is required")
+
+	source, err := NewSource(OpenExchangeRates, "secret", server.URL)
+	require.NoError(t, err)
+	snapshots, err := source.Fetch(context.Background())
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, "2018-03-03", snapshots[0].Date)
+	assert.Equal(t, "USD", snapshots[0].Base)
+
+	source, _ = NewSource(OpenExchangeRates, "wrong", server.URL)
+	_, err = source.Fetch(context.Background())
+	assert.Error(t, err)
+
+	_, err = NewSource("bank-of-gotham", "", "")
+	assert.Error(t, err)
+}
+
+func TestConvert(t *testing.T) {
+	snapshot := &Snapshot{Date: "2018-03-02", Base: "EUR", Rates: map[string]float64{"USD": 1.25, "GBP": 0.9}}
+
+	amount, err := snapshot.Convert(1000, "EUR", "USD")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1250, amount)
+
+	amount, err = snapshot.Convert(1250, "USD", "GBP")
+	require.NoError(t, err)
+	assert.EqualValues(t, 900, amount)
+
+	_, err = snapshot.Convert(1000, "EUR", "JPY")
+	assert.Error(t, err)
+
+	rebased, err := snapshot.Rebase("USD")
+	require.NoError(t, err)
+	assert.Equal(t, "USD", rebased.Base)
+	assert.InDelta(t, 0.8, rebased.Rates["EUR"], 0.0001)
+	assert.InDelta(t, 0.72, rebased.Rates["GBP"], 0.0001)
+	_, ok := rebased.Rates["USD"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,145 @@
+// Package tracing records spans for the steps of a request that can be slow,
+// like fetching products from the site, database transactions and calls to
+// payment providers. The spans of a request share its trace ID, which is the
+// X-Request-ID of the request, so a slow checkout can be followed from the
+// request to each call it made. Finished spans are handed to the reporter,
+// if one is set.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Header is the HTTP header the trace ID of a request is read from and sent
+// with, to the client and to the site.
+const Header = "X-Request-ID"
+
+// Span is a timed step of a request.
+type Span struct {
+	TraceID   string
+	SpanID    string
+	ParentID  string
+	Operation string
+	Start     time.Time
+	Duration  time.Duration
+
+	mu       sync.Mutex
+	tags     map[string]interface{}
+	finished bool
+}
+
+// Reporter receives the spans when they finish.
+type Reporter func(*Span)
+
+var (
+	reporterMu sync.RWMutex
+	reporter   Reporter
+)
+
+// SetReporter sets the reporter of finished spans. A nil reporter drops them.
+func SetReporter(r Reporter) {
+	reporterMu.Lock()
+	reporter = r
+	reporterMu.Unlock()
+}
+
+type contextKey string
+
+const (
+	spanKey    = contextKey("span")
+	traceIDKey = contextKey("trace_id")
+)
+
+// WithTraceID sets the trace ID of the spans started from the context.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey, traceID)
+}
+
+// TraceID returns the trace ID of the context, or an empty string.
+func TraceID(ctx context.Context) string {
+	if span := FromContext(ctx); span != nil {
+		return span.TraceID
+	}
+	id, _ := ctx.Value(traceIDKey).(string)
+	return id
+}
+
+// FromContext returns the span of the context, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// StartSpan starts a span as a child of the span of the context, and returns it
+// with a context for its own children. Spans without a parent get the trace ID
+// of the context, or a new one.
+func StartSpan(ctx context.Context, operation string) (*Span, context.Context) {
+	span := &Span{
+		SpanID:    newID(),
+		Operation: operation,
+		Start:     time.Now(),
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else if span.TraceID = TraceID(ctx); span.TraceID == "" {
+		span.TraceID = uuid.NewRandom().String()
+	}
+	return span, context.WithValue(ctx, spanKey, span)
+}
+
+// SetTag sets a tag of the span, like the ID of an order.
+func (s *Span) SetTag(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tags == nil {
+		s.tags = map[string]interface{}{}
+	}
+	s.tags[key] = value
+}
+
+// SetError tags the span with an error, if there is one.
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.SetTag("error", err.Error())
+	}
+}
+
+// Tags returns a copy of the tags of the span.
+func (s *Span) Tags() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tags := make(map[string]interface{}, len(s.tags))
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Finish ends the span and reports it. Only the first call counts.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.Duration = time.Since(s.Start)
+	s.mu.Unlock()
+
+	reporterMu.RLock()
+	r := reporter
+	reporterMu.RUnlock()
+	if r != nil {
+		r(s)
+	}
+}
+
+func newID() string {
+	return hex.EncodeToString(uuid.NewRandom()[:8])
+}
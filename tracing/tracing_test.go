@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpans(t *testing.T) {
+	finished := []*Span{}
+	SetReporter(func(s *Span) { finished = append(finished, s) })
+	defer SetReporter(nil)
+
+	ctx := WithTraceID(context.Background(), "request-1")
+	assert.Equal(t, "request-1", TraceID(ctx))
+
+	root, ctx := StartSpan(ctx, "root")
+	child, childCtx := StartSpan(ctx, "child")
+	assert.Equal(t, child, FromContext(childCtx))
+	child.SetTag("sku", "product-1")
+	child.SetError(errors.New("out of stock"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	require.Len(t, finished, 2)
+	assert.Equal(t, "child", finished[0].Operation)
+	assert.Equal(t, "request-1", child.TraceID)
+	assert.Equal(t, "request-1", root.TraceID)
+	assert.Equal(t, root.SpanID, child.ParentID)
+	assert.Empty(t, root.ParentID)
+	assert.NotEqual(t, root.SpanID, child.SpanID)
+	assert.Equal(t, map[string]interface{}{"sku": "product-1", "error": "out of stock"}, child.Tags())
+}
+
+func TestSpanWithoutTrace(t *testing.T) {
+	SetReporter(nil)
+	span, ctx := StartSpan(context.Background(), "orphan")
+	assert.NotEmpty(t, span.TraceID)
+	assert.Equal(t, span.TraceID, TraceID(ctx))
+	span.Finish()
+}
@@ -0,0 +1,73 @@
+package webhooks_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// An order webhook consumer that rejects forged and replayed webhooks, and
+// handles each webhook once even when gocommerce retries it.
+func Example() {
+	verifier := webhooks.NewVerifier("hook-secret")
+
+	var mu sync.Mutex
+	handled := map[string]bool{}
+	consumer := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(webhooks.IDHeader)
+		mu.Lock()
+		defer mu.Unlock()
+		if handled[id] {
+			// a retry of a webhook that was handled, but whose response
+			// got lost
+			return
+		}
+
+		order := struct {
+			ID    string `json:"id"`
+			Total uint64 `json:"total"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("%v: order %v of %v\n", r.Header.Get(webhooks.EventHeader), order.ID, order.Total)
+		handled[id] = true
+	}))
+	server := httptest.NewServer(consumer)
+	defer server.Close()
+
+	payload := `{"id": "order-1", "total": 4200}`
+	deliver := func(webhookID string, signature string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(payload))
+		req.Header.Set(webhooks.EventHeader, "payment.succeeded")
+		req.Header.Set(webhooks.IDHeader, webhookID)
+		req.Header.Set(webhooks.SignatureHeader, signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	signature := webhooks.Sign("hook-secret", []byte(payload), time.Now(), webhooks.NewNonce())
+	fmt.Println(deliver("42", signature))
+	fmt.Println(deliver("42", signature), "replayed")
+	fmt.Println(deliver("42", webhooks.Sign("hook-secret", []byte(payload), time.Now(), webhooks.NewNonce())), "retried")
+	fmt.Println(deliver("43", webhooks.Sign("other-secret", []byte(payload), time.Now(), webhooks.NewNonce())), "forged")
+	// Output:
+	// payment.succeeded: order order-1 of 4200
+	// 200
+	// 401 replayed
+	// 200 retried
+	// 401 forged
+}
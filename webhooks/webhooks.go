@@ -0,0 +1,199 @@
+// Package webhooks verifies the webhooks gocommerce sends, for services that
+// consume them in Go.
+//
+// Every webhook carries the time it was sent and a nonce, a random value that
+// is new for each delivery, signed together with the payload in the
+// X-Commerce-Signature-V2 header. A Verifier checks the signature, rejects
+// webhooks sent longer ago than its tolerance and rejects nonces it has seen
+// before, so a captured webhook can't be sent again. Retries of a webhook are
+// new deliveries with a nonce of their own, but keep the X-Commerce-Webhook-ID
+// of the first one, which consumers use to handle each webhook only once.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of the webhooks.
+const (
+	EventHeader     = "X-Commerce-Event"
+	IDHeader        = "X-Commerce-Webhook-ID"
+	SignatureHeader = "X-Commerce-Signature-V2"
+)
+
+// DefaultTolerance is how long after it was sent a webhook is accepted, when
+// a Verifier doesn't set its own.
+const DefaultTolerance = 5 * time.Minute
+
+// Errors of verifying a webhook.
+var (
+	ErrMissingSignature = errors.New("webhook has no signature")
+	ErrInvalidSignature = errors.New("webhook signature doesn't match")
+	ErrExpired          = errors.New("webhook was sent too long ago")
+	ErrReplayed         = errors.New("webhook was already received")
+)
+
+// Sign returns the value of the signature header for a payload sent at a time
+// with a nonce.
+func Sign(secret string, payload []byte, timestamp time.Time, nonce string) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",n=" + nonce + ",sha256=" + hex.EncodeToString(mac(secret, t, nonce, payload))
+}
+
+// NewNonce returns a random nonce for a delivery.
+func NewNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func mac(secret, timestamp, nonce string, payload []byte) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(timestamp + "." + nonce + "."))
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+// NonceStore remembers the nonces of verified webhooks.
+type NonceStore interface {
+	// Add records a nonce until it expires, and reports whether it was
+	// already recorded.
+	Add(nonce string, expires time.Time) (seen bool, err error)
+}
+
+// MemoryNonceStore keeps nonces in memory, which protects a single process.
+// Consumers running several processes need a shared store, like a table with
+// a unique nonce column.
+type MemoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+// NewMemoryNonceStore returns an empty MemoryNonceStore.
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: map[string]time.Time{}}
+}
+
+// Add records a nonce and drops the ones that expired.
+func (s *MemoryNonceStore) Add(nonce string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for n, e := range s.nonces {
+		if e.Before(now) {
+			delete(s.nonces, n)
+		}
+	}
+	if _, ok := s.nonces[nonce]; ok {
+		return true, nil
+	}
+	s.nonces[nonce] = expires
+	return false, nil
+}
+
+// Verifier checks the signatures of webhooks signed with a secret.
+type Verifier struct {
+	Secret string
+	// Tolerance is how long after it was sent a webhook is accepted,
+	// DefaultTolerance if zero.
+	Tolerance time.Duration
+	// Nonces rejects webhooks that were received before. Without a store,
+	// replays within the tolerance aren't detected.
+	Nonces NonceStore
+
+	now func() time.Time
+}
+
+// NewVerifier returns a Verifier with the default tolerance that remembers
+// nonces in memory.
+func NewVerifier(secret string) *Verifier {
+	return &Verifier{Secret: secret, Nonces: NewMemoryNonceStore()}
+}
+
+// Verify checks the signature header of a webhook against its payload.
+func (v *Verifier) Verify(header http.Header, payload []byte) error {
+	value := header.Get(SignatureHeader)
+	if value == "" {
+		return ErrMissingSignature
+	}
+	var timestamp, nonce, signature string
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidSignature
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "n":
+			nonce = kv[1]
+		case "sha256":
+			signature = kv[1]
+		}
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" {
+		return ErrInvalidSignature
+	}
+	expected := mac(v.Secret, timestamp, nonce, payload)
+	actual, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, actual) {
+		return ErrInvalidSignature
+	}
+
+	tolerance := v.Tolerance
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+	sentAt := time.Unix(sent, 0)
+	if now.Sub(sentAt) > tolerance || sentAt.Sub(now) > tolerance {
+		return ErrExpired
+	}
+
+	if v.Nonces != nil {
+		seen, err := v.Nonces.Add(nonce, sentAt.Add(tolerance))
+		if err != nil {
+			return err
+		}
+		if seen {
+			return ErrReplayed
+		}
+	}
+	return nil
+}
+
+// Middleware only passes on requests with a valid webhook, and answers others
+// with 401 Unauthorized. The body of the request can still be read by the
+// next handler.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading webhook", http.StatusBadRequest)
+			return
+		}
+		if err := v.Verify(r.Header, payload); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		next.ServeHTTP(w, r)
+	})
+}
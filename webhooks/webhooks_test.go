@@ -0,0 +1,80 @@
+package webhooks
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedHeader(secret, payload string, sent time.Time, nonce string) http.Header {
+	header := http.Header{}
+	header.Set(SignatureHeader, Sign(secret, []byte(payload), sent, nonce))
+	return header
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	payload := `{"id": "order-1"}`
+	v := NewVerifier("secret")
+	v.now = func() time.Time { return now }
+
+	assert.NoError(t, v.Verify(signedHeader("secret", payload, now, "nonce-1"), []byte(payload)))
+	assert.Equal(t, ErrReplayed, v.Verify(signedHeader("secret", payload, now, "nonce-1"), []byte(payload)))
+	assert.NoError(t, v.Verify(signedHeader("secret", payload, now.Add(-time.Minute), "nonce-2"), []byte(payload)))
+
+	assert.Equal(t, ErrMissingSignature, v.Verify(http.Header{}, []byte(payload)))
+	assert.Equal(t, ErrInvalidSignature, v.Verify(signedHeader("other", payload, now, "nonce-3"), []byte(payload)))
+	assert.Equal(t, ErrInvalidSignature, v.Verify(signedHeader("secret", payload, now, "nonce-4"), []byte(`{"id": "order-2"}`)))
+	assert.Equal(t, ErrExpired, v.Verify(signedHeader("secret", payload, now.Add(-10*time.Minute), "nonce-5"), []byte(payload)))
+
+	// the nonce and the time are signed too
+	header := signedHeader("secret", payload, now, "nonce-6")
+	header.Set(SignatureHeader, strings.Replace(header.Get(SignatureHeader), "n=nonce-6", "n=nonce-7", 1))
+	assert.Equal(t, ErrInvalidSignature, v.Verify(header, []byte(payload)))
+
+	v.Tolerance = time.Hour
+	assert.NoError(t, v.Verify(signedHeader("secret", payload, now.Add(-10*time.Minute), "nonce-8"), []byte(payload)))
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := NewMemoryNonceStore()
+	seen, err := store.Add("a", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	seen, _ = store.Add("b", time.Now().Add(time.Minute))
+	assert.False(t, seen)
+	seen, _ = store.Add("b", time.Now().Add(time.Minute))
+	assert.True(t, seen)
+
+	seen, _ = store.Add("a", time.Now().Add(time.Minute))
+	assert.False(t, seen, "expired nonces are forgotten")
+}
+
+func TestMiddleware(t *testing.T) {
+	v := NewVerifier("secret")
+	var received string
+	handler := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+	}))
+
+	payload := `{"id": "order-1"}`
+	req := httptest.NewRequest(http.MethodPost, "/hooks", strings.NewReader(payload))
+	req.Header = signedHeader("secret", payload, time.Now(), NewNonce())
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, payload, received)
+
+	req = httptest.NewRequest(http.MethodPost, "/hooks", strings.NewReader(payload))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}